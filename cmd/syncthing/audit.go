@@ -7,19 +7,27 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
 	"io"
 
+	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 )
 
 // The auditSvc subscribes to events and writes these in JSON format, one
-// event per line, to the specified writer.
+// event per line, to the specified writer. Configuration saves are written
+// as what changed, and by which request when it was made over the API,
+// rather than as the whole configuration with its secrets.
 type auditSvc struct {
 	w       io.Writer     // audit destination
 	stop    chan struct{} // signals time to stop
 	started chan struct{} // signals startup complete
 	stopped chan struct{} // signals stop complete
+
+	prevCfg config.Configuration // as last saved
 }
 
 func newAuditSvc(w io.Writer) *auditSvc {
@@ -37,6 +45,9 @@ func (s *auditSvc) Serve() {
 	sub := events.Default.Subscribe(events.AllEvents)
 	defer events.Default.Unsubscribe(sub)
 	enc := json.NewEncoder(s.w)
+	if cfg != nil {
+		s.prevCfg = cfg.Raw()
+	}
 
 	// We're ready to start processing events.
 	close(s.started)
@@ -44,6 +55,16 @@ func (s *auditSvc) Serve() {
 	for {
 		select {
 		case ev := <-sub.C():
+			switch ev.Type {
+			case events.StartupComplete:
+				// When started by the flag there was no configuration yet
+				// when we started.
+				if s.prevCfg.Version == 0 {
+					s.prevCfg = cfg.Raw()
+				}
+			case events.ConfigSaved:
+				ev = s.configSaved(ev)
+			}
 			enc.Encode(ev)
 		case <-s.stop:
 			return
@@ -67,3 +88,85 @@ func (s *auditSvc) WaitForStart() {
 func (s *auditSvc) WaitForStop() {
 	<-s.stopped
 }
+
+// configSaved returns the event for the audit log in place of the
+// ConfigSaved event.
+func (s *auditSvc) configSaved(ev events.Event) events.Event {
+	saved, ok := ev.Data.(config.SavedConfiguration)
+	if !ok {
+		return ev
+	}
+
+	data := map[string]interface{}{
+		"changes": configChanges(s.prevCfg, saved.Configuration),
+	}
+	if saved.By != nil {
+		data["request"] = saved.By
+	}
+	s.prevCfg = saved.Configuration
+
+	ev.Data = data
+	return ev
+}
+
+// configChanges describes the differences between two configurations, one
+// line per folder, device or section.
+func configChanges(from, to config.Configuration) []string {
+	if from.Version == 0 {
+		return []string{"configuration loaded"}
+	}
+
+	var changes []string
+
+	fromFolders := make(map[string]config.FolderConfiguration)
+	for _, f := range from.Folders {
+		fromFolders[f.ID] = f
+	}
+	for _, f := range to.Folders {
+		if old, ok := fromFolders[f.ID]; !ok {
+			changes = append(changes, fmt.Sprintf("folder %q added", f.ID))
+		} else if !sameXML(old, f) {
+			changes = append(changes, fmt.Sprintf("folder %q changed", f.ID))
+		}
+		delete(fromFolders, f.ID)
+	}
+	for id := range fromFolders {
+		changes = append(changes, fmt.Sprintf("folder %q removed", id))
+	}
+
+	fromDevices := make(map[string]config.DeviceConfiguration)
+	for _, d := range from.Devices {
+		fromDevices[d.DeviceID.String()] = d
+	}
+	for _, d := range to.Devices {
+		id := d.DeviceID.String()
+		if old, ok := fromDevices[id]; !ok {
+			changes = append(changes, fmt.Sprintf("device %s added", id))
+		} else if !sameXML(old, d) {
+			changes = append(changes, fmt.Sprintf("device %s changed", id))
+		}
+		delete(fromDevices, id)
+	}
+	for id := range fromDevices {
+		changes = append(changes, fmt.Sprintf("device %s removed", id))
+	}
+
+	if !sameXML(from.GUI, to.GUI) {
+		changes = append(changes, "gui changed")
+	}
+	if !sameXML(from.Options, to.Options) {
+		changes = append(changes, "options changed")
+	}
+	if !sameXML(from.IgnoredDevices, to.IgnoredDevices) {
+		changes = append(changes, "ignored devices changed")
+	}
+	return changes
+}
+
+// sameXML returns whether the two values are the same as far as the config
+// file is concerned, where nil and empty lists are no different.
+func sameXML(a, b interface{}) bool {
+	abs, aerr := xml.Marshal(a)
+	bbs, berr := xml.Marshal(b)
+	return aerr == nil && berr == nil && bytes.Equal(abs, bbs)
+}
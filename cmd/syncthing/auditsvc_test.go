@@ -8,10 +8,14 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 )
 
@@ -52,3 +56,39 @@ func TestAuditService(t *testing.T) {
 		t.Error("Missing third event")
 	}
 }
+
+func TestAuditConfigSaved(t *testing.T) {
+	device, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	from := config.Configuration{
+		Version: config.CurrentVersion,
+		Folders: []config.FolderConfiguration{{ID: "default"}, {ID: "photos"}},
+		GUI:     config.GUIConfiguration{Password: "secret hash"},
+	}
+	to := from.Copy()
+	to.Folders = []config.FolderConfiguration{{ID: "default", RescanIntervalS: 10}, {ID: "music"}}
+	to.Devices = []config.DeviceConfiguration{{DeviceID: device}}
+	to.GUI.Password = "another secret hash"
+
+	expected := []string{
+		`folder "default" changed`,
+		`folder "music" added`,
+		`folder "photos" removed`,
+		"device " + device.String() + " added",
+		"gui changed",
+	}
+	if changes := configChanges(from, to); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Incorrect changes %q", changes)
+	}
+
+	svc := newAuditSvc(nil)
+	svc.prevCfg = from
+	by := map[string]string{"user": "jb", "method": "POST", "path": "/rest/system/config"}
+	ev := svc.configSaved(events.Event{Type: events.ConfigSaved, Time: time.Now(), Data: config.SavedConfiguration{Configuration: to, By: by}})
+	data := ev.Data.(map[string]interface{})
+	if by := data["request"].(map[string]string)["user"]; by != "jb" {
+		t.Errorf("Incorrect user %q", by)
+	}
+	if strings.Contains(fmt.Sprint(data), "secret") {
+		t.Error("Secrets in the audit log")
+	}
+}
@@ -18,9 +18,44 @@ import (
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/socks"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/thejerf/suture"
 )
 
+const (
+	replaceTimeout = 10 * time.Second       // for a replaced connection to close
+	dialStagger    = 250 * time.Millisecond // between parallel dial attempts
+)
+
+// The kind of a connection, in order of preference.
+type connType int
+
+const (
+	connTypeRelay connType = iota
+	connTypeWAN
+	connTypeLAN
+)
+
+func (t connType) String() string {
+	switch t {
+	case connTypeRelay:
+		return "relay"
+	case connTypeWAN:
+		return "WAN"
+	case connTypeLAN:
+		return "LAN"
+	}
+	return "unknown"
+}
+
+// A typedConn is a connection along with its kind.
+type typedConn struct {
+	*tls.Conn
+	typ connType
+}
+
 // The connection service listens on TLS and dials configured unconnected
 // devices. Successful connections are handed to the model.
 type connectionSvc struct {
@@ -29,7 +64,12 @@ type connectionSvc struct {
 	myID   protocol.DeviceID
 	model  *model.Model
 	tlsCfg *tls.Config
-	conns  chan *tls.Conn
+	conns  chan typedConn
+	relays *relaySvc
+
+	types     map[protocol.DeviceID]connType // of the current connections
+	replacing map[protocol.DeviceID]bool     // while waiting for the replaced connection to close
+	typesMut  sync.Mutex
 }
 
 func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.Model, tlsCfg *tls.Config) *connectionSvc {
@@ -39,8 +79,12 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 		myID:       myID,
 		model:      model,
 		tlsCfg:     tlsCfg,
-		conns:      make(chan *tls.Conn),
+		conns:      make(chan typedConn),
+		types:      make(map[protocol.DeviceID]connType),
+		replacing:  make(map[protocol.DeviceID]bool),
+		typesMut:   sync.NewMutex(),
 	}
+	svc.relays = newRelaySvc(cfg, tlsCfg, svc.conns)
 
 	// There are several moving parts here; one routine per listening address
 	// to handle incoming connections, one routine to periodically attempt
@@ -86,6 +130,7 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 		svc.Add(listener)
 	}
 	svc.Add(serviceFunc(svc.handle))
+	svc.Add(svc.relays)
 
 	return svc
 }
@@ -130,14 +175,39 @@ next:
 		// this one. But in case we are two devices connecting to each other
 		// in parallel we don't want to do that or we end up with no
 		// connections still established...
-		if s.model.ConnectedTo(remoteID) {
-			l.Infof("Connected to already connected device (%s)", remoteID)
+		//
+		// Unless the new connection is of a better kind, say direct instead
+		// of relayed, in which case it replaces the current one. Or we want
+		// more than one connection to the device, in which case a new one of
+		// the same kind is an extra connection for block requests.
+		extra, replace := false, false
+		if s.isReplacing(remoteID) {
+			l.Infof("Connected to device being reconnected (%s)", remoteID)
 			conn.Close()
 			continue
 		}
+		if s.model.ConnectedTo(remoteID) {
+			cur := s.connType(remoteID)
+			switch {
+			case conn.typ > cur:
+				replace = true
+			case conn.typ == cur && s.model.Connections(remoteID) < wantedConnections(s.cfg.Devices()[remoteID]):
+				extra = true
+			default:
+				l.Infof("Connected to already connected device (%s)", remoteID)
+				conn.Close()
+				continue
+			}
+		}
 
 		for deviceID, deviceCfg := range s.cfg.Devices() {
 			if deviceID == remoteID {
+				if deviceCfg.Paused {
+					l.Infof("Connection from %s with paused device ID %s", conn.RemoteAddr(), remoteID)
+					conn.Close()
+					continue next
+				}
+
 				// Verify the name on the certificate. By default we set it to
 				// "syncthing" when generating, but the user may have replaced
 				// the certificate and used another name.
@@ -170,19 +240,69 @@ next:
 					rd = &limitedReader{conn, readRateLimit}
 				}
 
+				// Limits set on the device apply on top of the global ones,
+				// regardless of where the device is.
+
+				if deviceCfg.MaxSendKbps > 0 {
+					wr = &limitedWriter{wr, osutil.NewRateLimit(deviceCfg.MaxSendKbps)}
+				}
+				if deviceCfg.MaxRecvKbps > 0 {
+					rd = &limitedReader{rd, osutil.NewRateLimit(deviceCfg.MaxRecvKbps)}
+				}
+
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
-				protoConn := protocol.NewConnection(remoteID, rd, wr, s.model, name, deviceCfg.Compression)
 
-				l.Infof("Established secure connection to %s at %s", remoteID, name)
-				if debugNet {
-					l.Debugf("cipher suite: %04X in lan: %t", conn.ConnectionState().CipherSuite, !limit)
+				if extra {
+					compression := s.model.NegotiateCompression(remoteID)
+					if s.model.AddExtraConnection(remoteID, conn.Conn, func(receiver protocol.Model) protocol.Connection {
+						return protocol.NewConnection(remoteID, rd, wr, receiver, name, compression)
+					}) {
+						l.Infof("Established extra connection to %s at %s", remoteID, name)
+					}
+					continue next
+				}
+
+				conn := conn // for when it's added on the side
+				add := func() {
+					compression := s.model.NegotiateCompression(remoteID)
+					protoConn := protocol.NewConnection(remoteID, rd, wr, s.model, name, compression)
+
+					l.Infof("Established secure connection to %s at %s (%s)", remoteID, name, conn.typ)
+					if debugNet.Enabled() {
+						l.Debugf("cipher suite: %04X in lan: %t compression: %v", conn.ConnectionState().CipherSuite, !limit, compression)
+					}
+					events.Default.Log(events.DeviceConnected, map[string]string{
+						"id":   remoteID.String(),
+						"addr": conn.RemoteAddr().String(),
+					})
+
+					s.typesMut.Lock()
+					s.types[remoteID] = conn.typ
+					s.typesMut.Unlock()
+
+					s.model.AddConnection(conn.Conn, protoConn)
+				}
+
+				if replace {
+					// Waiting for the replaced connection to close mustn't
+					// hold up other connections, so it's done on the side.
+					// Other connections to the device are refused meanwhile.
+					cur := s.connType(remoteID)
+					l.Infof("Replacing %s connection to %s with %s connection", cur, remoteID, conn.typ)
+					s.setReplacing(remoteID, true)
+					go func() {
+						defer s.setReplacing(remoteID, false)
+						if !s.disconnect(remoteID) {
+							l.Infof("Replaced connection to %s did not close", remoteID)
+							conn.Close()
+							return
+						}
+						add()
+					}()
+					continue next
 				}
-				events.Default.Log(events.DeviceConnected, map[string]string{
-					"id":   remoteID.String(),
-					"addr": conn.RemoteAddr().String(),
-				})
 
-				s.model.AddConnection(conn, protoConn)
+				add()
 				continue next
 			}
 		}
@@ -202,7 +322,7 @@ next:
 }
 
 func (s *connectionSvc) listen(addr string) {
-	if debugNet {
+	if debugNet.Enabled() {
 		l.Debugln("listening on", addr)
 	}
 
@@ -214,6 +334,7 @@ func (s *connectionSvc) listen(addr string) {
 	if err != nil {
 		l.Fatalln("listen (BEP):", err)
 	}
+	setReady("listeners")
 
 	for {
 		conn, err := listener.Accept()
@@ -222,7 +343,7 @@ func (s *connectionSvc) listen(addr string) {
 			continue
 		}
 
-		if debugNet {
+		if debugNet.Enabled() {
 			l.Debugln("connect from", conn.RemoteAddr())
 		}
 
@@ -230,33 +351,51 @@ func (s *connectionSvc) listen(addr string) {
 		s.setTCPOptions(tcpConn)
 
 		tc := tls.Server(conn, s.tlsCfg)
-		err = tc.Handshake()
+		err = s.handshake(tc)
 		if err != nil {
 			l.Infoln("TLS handshake:", err)
 			tc.Close()
 			continue
 		}
 
-		s.conns <- tc
+		s.conns <- typedConn{tc, directConnType(conn.RemoteAddr())}
 	}
 }
 
 func (s *connectionSvc) connect() {
 	delay := time.Second
 	for {
+		v6 := haveGlobalIPv6()
 	nextDevice:
 		for deviceID, deviceCfg := range s.cfg.Devices() {
-			if deviceID == myID {
+			if deviceID == myID || deviceCfg.Paused {
 				continue
 			}
 
-			if s.model.ConnectedTo(deviceID) {
-				continue
+			// When we have all the connections we want, we only look for a
+			// better kind of connection; a direct one if we are relayed, or
+			// one on the LAN.
+			connected := s.model.ConnectedTo(deviceID)
+			onlyLAN := false
+			if connected && s.model.Connections(deviceID) >= wantedConnections(deviceCfg) {
+				switch s.connType(deviceID) {
+				case connTypeLAN:
+					continue
+				case connTypeWAN:
+					onlyLAN = true
+				}
 			}
 
 			var addrs []string
 			for _, addr := range deviceCfg.Addresses {
 				if addr == "dynamic" {
+					// The address that worked last time, possibly before a
+					// restart, is tried along with those discovered.
+					// Discovery takes a while to find anything after
+					// startup.
+					if last := s.model.LastAddress(deviceID); last != "" {
+						addrs = append(addrs, last)
+					}
 					if discoverer != nil {
 						t := discoverer.Lookup(deviceID)
 						if len(t) == 0 {
@@ -264,11 +403,25 @@ func (s *connectionSvc) connect() {
 						}
 						addrs = append(addrs, t...)
 					}
-				} else {
+				} else if strings.HasPrefix(addr, "dns://") {
+					addrs = append(addrs, dnsAddrs.lookup(addr)...)
+				} else if !strings.HasPrefix(addr, "relay://") {
 					addrs = append(addrs, addr)
 				}
 			}
 
+			if v6 {
+				addrs = ipv6First(addrs)
+			}
+
+			// Only addresses in the allowed networks of the device are
+			// dialed, if it has any.
+			if len(deviceCfg.AllowedNets) > 0 {
+				addrs = allowedAddrs(deviceCfg.AllowedNets, addrs)
+			}
+
+			var dialAddrs []string
+			seen := make(map[string]bool)
 			for _, addr := range addrs {
 				host, port, err := net.SplitHostPort(addr)
 				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
@@ -278,38 +431,31 @@ func (s *connectionSvc) connect() {
 					// addr is on the form "1.2.3.4:"
 					addr = net.JoinHostPort(host, "22000")
 				}
-				if debugNet {
-					l.Debugln("dial", deviceCfg.DeviceID, addr)
-				}
-
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
+				if seen[addr] || onlyLAN && !isLANAddr(addr) {
 					continue
 				}
+				seen[addr] = true
+				dialAddrs = append(dialAddrs, addr)
+			}
 
-				conn, err := net.DialTCP("tcp", nil, raddr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
-					continue
-				}
+			if tc, ok := dialFirst(dialAddrs, dialStagger, s.dialTLS); ok {
+				s.model.SetLastAddress(deviceID, tc.RemoteAddr().String())
+				s.conns <- tc
+				continue nextDevice
+			}
 
-				s.setTCPOptions(conn)
+			// None of the addresses worked; try reaching the device through
+			// a relay instead, unless we are already.
 
-				tc := tls.Client(conn, s.tlsCfg)
-				err = tc.Handshake()
+			if !connected && s.cfg.Options().RelaysEnabled && !deviceCfg.NoRelays {
+				tc, err := s.relays.dial(deviceCfg)
 				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
+					if debugNet.Enabled() {
+						l.Debugln("relay", deviceCfg.DeviceID, err)
+					}
 					continue
 				}
-
-				s.conns <- tc
-				continue nextDevice
+				s.conns <- typedConn{tc, connTypeRelay}
 			}
 		}
 
@@ -321,40 +467,346 @@ func (s *connectionSvc) connect() {
 	}
 }
 
-func (*connectionSvc) setTCPOptions(conn *net.TCPConn) {
+// haveGlobalIPv6 returns whether we have an IPv6 address reachable from the
+// internet, in which case we prefer connecting over IPv6; there is no NAT
+// in the way there.
+func haveGlobalIPv6() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() && ipnet.IP[0]&0xfe != 0xfc {
+			return true
+		}
+	}
+	return false
+}
+
+// ipv6First returns the addresses with the IPv6 ones first, otherwise in
+// the same order.
+func ipv6First(addrs []string) []string {
+	var v6, others []string
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			v6 = append(v6, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	return append(v6, others...)
+}
+
+// dial connects to the address, through the proxy if one is configured.
+func (s *connectionSvc) dial(addr string) (*net.TCPConn, error) {
+	if proxyAddr := s.cfg.Options().ProxyAddress; proxyAddr != "" {
+		proxy, err := socks.Parse(proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		proxy.Timeout = s.dialTimeout()
+		conn, err := proxy.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, s.dialTimeout())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// dialTLS connects to the address and performs the TLS handshake.
+func (s *connectionSvc) dialTLS(addr string) (typedConn, error) {
+	if debugNet.Enabled() {
+		l.Debugln("dial", addr)
+	}
+
+	conn, err := s.dial(addr)
+	if err != nil {
+		return typedConn{}, err
+	}
+
+	s.setTCPOptions(conn)
+
+	tc := tls.Client(conn, s.tlsCfg)
+	if err := s.handshake(tc); err != nil {
+		l.Infoln("TLS handshake:", err)
+		tc.Close()
+		return typedConn{}, err
+	}
+
+	typ := directConnType(conn.RemoteAddr())
+	if s.cfg.Options().ProxyAddress != "" {
+		// The remote address is that of the proxy.
+		typ = connTypeWAN
+	}
+	return typedConn{tc, typ}, nil
+}
+
+// dialFirst dials the addresses in parallel and returns the first connection
+// made. Each attempt starts stagger after the one before it, or as soon as an
+// attempt fails, so that a preferred address that works wins but one that
+// doesn't can't hold up the others for long. The connections made by the
+// losing attempts are closed.
+func dialFirst(addrs []string, stagger time.Duration, dial func(string) (typedConn, error)) (typedConn, bool) {
+	type result struct {
+		conn typedConn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	started, pending := 0, 0
+
+	start := func() {
+		go func(addr string) {
+			conn, err := dial(addr)
+			if err != nil && debugNet.Enabled() {
+				l.Debugln("dial", addr, err)
+			}
+			results <- result{conn, err}
+		}(addrs[started])
+		started++
+		pending++
+	}
+
+	if len(addrs) > 0 {
+		start()
+	}
+	for pending > 0 {
+		var next <-chan time.Time
+		if started < len(addrs) {
+			next = time.After(stagger)
+		}
+
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if res := <-results; res.err == nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, true
+			}
+			if started < len(addrs) {
+				start()
+			}
+
+		case <-next:
+			start()
+		}
+	}
+	return typedConn{}, false
+}
+
+// handshake performs the TLS handshake, giving up after the dial timeout.
+func (s *connectionSvc) handshake(tc *tls.Conn) error {
+	tc.SetDeadline(time.Now().Add(s.dialTimeout()))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+	return nil
+}
+
+func (s *connectionSvc) dialTimeout() time.Duration {
+	return time.Duration(s.cfg.Options().DialTimeoutS) * time.Second
+}
+
+// wantedConnections returns the number of connections we want to keep to the
+// device.
+func wantedConnections(cfg config.DeviceConfiguration) int {
+	if cfg.Connections < 1 {
+		return 1
+	}
+	return cfg.Connections
+}
+
+func (s *connectionSvc) setTCPOptions(conn *net.TCPConn) {
+	opts := s.cfg.Options()
 	var err error
 	if err = conn.SetLinger(0); err != nil {
 		l.Infoln(err)
 	}
-	if err = conn.SetNoDelay(false); err != nil {
+	if err = conn.SetNoDelay(opts.TCPNoDelay); err != nil {
 		l.Infoln(err)
 	}
-	if err = conn.SetKeepAlivePeriod(60 * time.Second); err != nil {
-		l.Infoln(err)
+	keepAliveS := opts.TCPKeepAliveS
+	if keepAliveS == 0 {
+		keepAliveS = opts.KeepAliveS
+	}
+	if keepAliveS > 0 {
+		if err = conn.SetKeepAlivePeriod(time.Duration(keepAliveS) * time.Second); err != nil {
+			l.Infoln(err)
+		}
 	}
-	if err = conn.SetKeepAlive(true); err != nil {
+	if err = conn.SetKeepAlive(keepAliveS > 0); err != nil {
 		l.Infoln(err)
 	}
+	if opts.TCPSendBufferKiB > 0 {
+		if err = conn.SetWriteBuffer(opts.TCPSendBufferKiB << 10); err != nil {
+			l.Infoln("Send buffer:", err)
+		}
+	}
+	if opts.TCPRecvBufferKiB > 0 {
+		if err = conn.SetReadBuffer(opts.TCPRecvBufferKiB << 10); err != nil {
+			l.Infoln("Receive buffer:", err)
+		}
+	}
+	if class := opts.TrafficClass; class != 0 {
+		// For QoS on the way, e.g. 32 for DSCP CS1, "lower effort".
+		if err = osutil.SetTrafficClass(conn, class); err != nil {
+			l.Infoln("Traffic class:", err)
+		}
+	}
 }
 
 func (s *connectionSvc) shouldLimit(addr net.Addr) bool {
 	if s.cfg.Options().LimitBandwidthInLan {
 		return true
 	}
-
 	tcpaddr, ok := addr.(*net.TCPAddr)
-	if !ok {
-		return true
-	}
+	return !ok || !isLAN(tcpaddr.IP)
+}
+
+func isLAN(ip net.IP) bool {
 	for _, lan := range lans {
-		if lan.Contains(tcpaddr.IP) {
+		if lan.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsLoopback()
+}
+
+// allowedAddrs returns the addresses that are in the given networks. Host
+// names are resolved and replaced by their allowed addresses, so that what's
+// dialed is what was checked.
+func allowedAddrs(cidrs []string, addrs []string) []string {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, ipnet)
+		} else {
+			l.Infof("Allowed network %q: %v", cidr, err)
+		}
+	}
+	allowed := func(ip net.IP) bool {
+		for _, ipnet := range nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var res []string
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, ""
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if ips, err = net.LookupIP(host); err != nil {
+			if debugNet.Enabled() {
+				l.Debugln("allowed addresses:", err)
+			}
+			continue
+		}
+
+		for _, ip := range ips {
+			if !allowed(ip) {
+				if debugNet.Enabled() {
+					l.Debugln("address not allowed:", addr, ip)
+				}
+				continue
+			}
+			if port == "" {
+				// Keep the form, so the default port is added as usual.
+				res = append(res, ip.String())
+			} else {
+				res = append(res, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+	return res
+}
+
+// isLANAddr returns whether the address, as configured or discovered, is
+// on the LAN. Host names aren't resolved, and count as not on the LAN.
+func isLANAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isLAN(ip)
+}
+
+func directConnType(addr net.Addr) connType {
+	if tcpaddr, ok := addr.(*net.TCPAddr); ok && isLAN(tcpaddr.IP) {
+		return connTypeLAN
+	}
+	return connTypeWAN
+}
+
+// connType returns the kind of the current connection to the device.
+func (s *connectionSvc) connType(deviceID protocol.DeviceID) connType {
+	s.typesMut.Lock()
+	defer s.typesMut.Unlock()
+	return s.types[deviceID]
+}
+
+// isReplacing returns whether a connection to the device is being replaced.
+func (s *connectionSvc) isReplacing(deviceID protocol.DeviceID) bool {
+	s.typesMut.Lock()
+	defer s.typesMut.Unlock()
+	return s.replacing[deviceID]
+}
+
+func (s *connectionSvc) setReplacing(deviceID protocol.DeviceID, replacing bool) {
+	s.typesMut.Lock()
+	defer s.typesMut.Unlock()
+	if replacing {
+		s.replacing[deviceID] = true
+	} else {
+		delete(s.replacing, deviceID)
+	}
+}
+
+// disconnect closes the connections to the device and waits for the model
+// to let go of them, so that a new one can be added. It returns false if
+// that doesn't happen in time.
+func (s *connectionSvc) disconnect(deviceID protocol.DeviceID) bool {
+	s.model.Disconnect(deviceID)
+	t0 := time.Now()
+	for s.model.Connections(deviceID) > 0 {
+		if time.Since(t0) > replaceTimeout {
 			return false
 		}
+		time.Sleep(50 * time.Millisecond)
 	}
-	return !tcpaddr.IP.IsLoopback()
+	return true
 }
 
 func (s *connectionSvc) VerifyConfiguration(from, to config.Configuration) error {
+	if to.Options.ProxyAddress != "" {
+		if _, err := socks.Parse(to.Options.ProxyAddress); err != nil {
+			return fmt.Errorf("proxy address: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,159 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIPv6First(t *testing.T) {
+	addrs := []string{"192.0.2.42:22000", "example.com:22000", "[2001:db8::1]:22000", "198.51.100.7", "2001:db8::2"}
+	expected := []string{"[2001:db8::1]:22000", "2001:db8::2", "192.0.2.42:22000", "example.com:22000", "198.51.100.7"}
+
+	if res := ipv6First(addrs); !reflect.DeepEqual(res, expected) {
+		t.Errorf("incorrect order %v != %v", res, expected)
+	}
+}
+
+func TestDialFirst(t *testing.T) {
+	delays := map[string]time.Duration{
+		"failing": 0,
+		"slow":    300 * time.Millisecond,
+		"fast":    10 * time.Millisecond,
+		"slower":  400 * time.Millisecond,
+	}
+	closed := make(chan string, len(delays))
+
+	dial := func(addr string) (typedConn, error) {
+		time.Sleep(delays[addr])
+		if addr == "failing" {
+			return typedConn{}, errors.New("connection refused")
+		}
+		c1, c2 := net.Pipe()
+		go func() {
+			// Wait for the connection to be closed.
+			c2.Read(make([]byte, 1))
+			closed <- addr
+		}()
+		return typedConn{tls.Client(c1, &tls.Config{}), connTypeWAN}, nil
+	}
+
+	// The failing address makes the next one start right away, the fast one
+	// starts 100ms later and wins over the slow one. The slower one is never
+	// started.
+
+	tc, ok := dialFirst([]string{"failing", "slow", "fast", "slower"}, 100*time.Millisecond, dial)
+	if !ok {
+		t.Fatal("no connection")
+	}
+	tc.Close()
+
+	for _, expected := range []string{"fast", "slow"} {
+		select {
+		case addr := <-closed:
+			if addr != expected {
+				t.Errorf("%s closed, expected %s", addr, expected)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s not closed", expected)
+		}
+	}
+	select {
+	case addr := <-closed:
+		t.Errorf("unexpected dial of %s", addr)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if _, ok := dialFirst([]string{"failing", "failing"}, time.Second, dial); ok {
+		t.Error("unexpected connection when all dials fail")
+	}
+	if _, ok := dialFirst(nil, time.Second, dial); ok {
+		t.Error("unexpected connection without addresses")
+	}
+}
+
+func TestIsLANAddr(t *testing.T) {
+	defer func(orig []*net.IPNet) { lans = orig }(lans)
+	_, vpn, _ := net.ParseCIDR("10.8.0.0/16")
+	lans = []*net.IPNet{vpn}
+
+	cases := map[string]bool{
+		"10.8.1.2:22000":    true,
+		"10.9.1.2:22000":    false,
+		"127.0.0.1:22000":   true,
+		"[::1]:22000":       true,
+		"192.0.2.42":        false,
+		"example.com:22000": false,
+	}
+	for addr, expected := range cases {
+		if res := isLANAddr(addr); res != expected {
+			t.Errorf("isLANAddr(%q) = %v, expected %v", addr, res, expected)
+		}
+	}
+}
+
+func TestAllowedAddrs(t *testing.T) {
+	nets := []string{"10.0.0.0/8", "fd00::/8", "bogus"}
+	addrs := []string{"10.1.2.3:22000", "192.0.2.42:22000", "10.4.5.6", "[fd00::1]:22000", "2001:db8::1", "localhost:22000"}
+	expected := []string{"10.1.2.3:22000", "10.4.5.6", "[fd00::1]:22000"}
+
+	if res := allowedAddrs(nets, addrs); !reflect.DeepEqual(res, expected) {
+		t.Errorf("incorrect allowed addresses %v != %v", res, expected)
+	}
+
+	// Host names are replaced by their allowed addresses.
+	expected = []string{"127.0.0.1:22000"}
+	if res := allowedAddrs([]string{"127.0.0.0/8"}, []string{"localhost:22000"}); !reflect.DeepEqual(res, expected) {
+		t.Errorf("incorrect allowed addresses %v != %v", res, expected)
+	}
+}
+
+func TestDNSAddrLookup(t *testing.T) {
+	r := newDNSAddrResolver()
+	lookups := 0
+	r.lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		if name != "srv.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return "", []*net.SRV{{Target: "a.example.com.", Port: 22000}, {Target: "b.example.com.", Port: 22001}}, nil
+	}
+	r.lookupTXT = func(name string) ([]string, error) {
+		if name != "txt.example.com" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"192.0.2.42:22000 [2001:db8::1]:22000"}, nil
+	}
+
+	tests := []struct {
+		addr  string
+		addrs []string
+	}{
+		{"dns://srv.example.com", []string{"a.example.com:22000", "b.example.com:22001"}},
+		{"dns://txt.example.com/", []string{"192.0.2.42:22000", "[2001:db8::1]:22000"}},
+		{"dns://none.example.com", nil},
+	}
+	for _, tc := range tests {
+		if res := r.lookup(tc.addr); !reflect.DeepEqual(res, tc.addrs) {
+			t.Errorf("incorrect addresses %v != %v for %s", res, tc.addrs, tc.addr)
+		}
+	}
+
+	// Resolved names are cached; the failed one is looked up again.
+	lookups = 0
+	for _, tc := range tests {
+		r.lookup(tc.addr)
+	}
+	if lookups != 1 {
+		t.Errorf("incorrect number of lookups %d != 1", lookups)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// How often the dbCompactSvc checks whether a compaction is due.
+const dbCompactCheckInterval = time.Hour
+
+type dbCompaction struct {
+	Time       time.Time `json:"time"`
+	DurationMs int64     `json:"durationMs"`
+	SizeBefore int64     `json:"sizeBefore"`
+	SizeAfter  int64     `json:"sizeAfter"`
+	Reclaimed  int64     `json:"reclaimed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// The dbCompactSvc compacts the database every databaseCompactionH hours, and
+// when asked to over the REST API. The time of the last compaction is kept in
+// the database so that restarts don't keep putting it off.
+type dbCompactSvc struct {
+	db   *leveldb.DB
+	dir  string
+	misc *db.NamespacedKV
+	stop chan struct{}
+
+	mut  sync.Mutex // one compaction at a time
+	last *dbCompaction
+}
+
+func newDBCompactSvc(ldb *leveldb.DB, dir string) *dbCompactSvc {
+	return &dbCompactSvc{
+		db:   ldb,
+		dir:  dir,
+		misc: db.NewMiscDataNamespace(ldb),
+		stop: make(chan struct{}),
+		mut:  sync.NewMutex(),
+	}
+}
+
+// Serve runs the compaction service.
+func (s *dbCompactSvc) Serve() {
+	// Not right at startup, which is busy enough as it is.
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if s.due(cfg.Options().DatabaseCompactionH, time.Now()) {
+				s.Compact()
+			}
+			timer.Reset(dbCompactCheckInterval)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the compaction service.
+func (s *dbCompactSvc) Stop() {
+	close(s.stop)
+}
+
+func (s *dbCompactSvc) String() string {
+	return "dbCompactSvc"
+}
+
+// due returns whether the last compaction was at least the given number of
+// hours ago. The first one is due that long after the service first ran.
+func (s *dbCompactSvc) due(hours int, now time.Time) bool {
+	if hours <= 0 {
+		return false
+	}
+	last, ok := s.misc.Time("lastCompaction")
+	if !ok {
+		s.misc.PutTime("lastCompaction", now)
+		return false
+	}
+	return now.Sub(last) >= time.Duration(hours)*time.Hour
+}
+
+// Compact compacts the database and returns what it came to.
+func (s *dbCompactSvc) Compact() dbCompaction {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	res := dbCompaction{Time: time.Now()}
+	l.Infoln("Compacting the database")
+	before, after, err := db.Compact(s.db, s.dir)
+	res.DurationMs = int64(time.Since(res.Time) / time.Millisecond)
+	res.SizeBefore, res.SizeAfter = before, after
+	res.Reclaimed = before - after
+	if err != nil {
+		res.Error = err.Error()
+		l.Warnln("Compacting the database:", err)
+	} else {
+		l.Infof("Compacted the database in %v; %d bytes reclaimed (%d bytes left)", time.Since(res.Time), res.Reclaimed, after)
+	}
+
+	s.misc.PutTime("lastCompaction", res.Time)
+	s.last = &res
+	return res
+}
+
+// Last returns the last compaction since startup, or nil.
+func (s *dbCompactSvc) Last() *dbCompaction {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.last
+}
@@ -0,0 +1,43 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDBCompactDue(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newDBCompactSvc(ldb, "")
+	now := time.Now()
+
+	if s.due(0, now) {
+		t.Error("Compaction due while turned off")
+	}
+	if s.due(24, now) {
+		t.Error("Compaction due on the first check")
+	}
+	if s.due(24, now.Add(23*time.Hour)) {
+		t.Error("Compaction due before the interval")
+	}
+	if !s.due(24, now.Add(25*time.Hour)) {
+		t.Error("Compaction not due after the interval")
+	}
+
+	// The time survives a new service on the same database.
+	s = newDBCompactSvc(ldb, "")
+	if !s.due(24, now.Add(25*time.Hour)) {
+		t.Error("Compaction not due after a restart")
+	}
+}
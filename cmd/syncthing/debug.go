@@ -6,13 +6,10 @@
 
 package main
 
-import (
-	"os"
-	"strings"
-)
+import "github.com/syncthing/syncthing/internal/trace"
 
 var (
-	debugNet    = strings.Contains(os.Getenv("STTRACE"), "net") || os.Getenv("STTRACE") == "all"
-	debugHTTP   = strings.Contains(os.Getenv("STTRACE"), "http") || os.Getenv("STTRACE") == "all"
-	debugSuture = strings.Contains(os.Getenv("STTRACE"), "suture") || os.Getenv("STTRACE") == "all"
+	debugNet    = trace.Register("net")
+	debugHTTP   = trace.Register("http")
+	debugSuture = trace.Register("suture")
 )
@@ -0,0 +1,183 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+const (
+	desktopNotifyEvents = events.StateChanged | events.FileConflict | events.DeviceRejected | events.FolderRejected
+
+	// The same notification isn't shown again for this long; rejected
+	// devices and folders in particular come back with every connection
+	// attempt.
+	desktopNotifyRepeat = time.Hour
+	// Nor is any notification shown sooner than this after the last, so
+	// that a burst of conflicts doesn't flood the desktop; those that come
+	// in the meantime are shown together once it has passed.
+	desktopNotifyMinInterval = 5 * time.Second
+	// At most this many messages are shown in one notification.
+	desktopNotifyMaxLines = 5
+)
+
+// The desktopNotifySvc shows desktop notifications for the event types
+// listed in the options, when there is a desktop session to show them in.
+type desktopNotifySvc struct {
+	show func(title, body string) error
+
+	shown    map[string]time.Time // by title and body
+	pending  []desktopNotification
+	lastShow time.Time
+	stop     chan struct{}
+}
+
+type desktopNotification struct {
+	title, body string
+}
+
+func newDesktopNotifySvc() *desktopNotifySvc {
+	return &desktopNotifySvc{
+		show:  showDesktopNotification,
+		shown: make(map[string]time.Time),
+		stop:  make(chan struct{}),
+	}
+}
+
+// Serve runs the desktop notification service.
+func (s *desktopNotifySvc) Serve() {
+	sub := events.Default.Subscribe(desktopNotifyEvents)
+	defer events.Default.Unsubscribe(sub)
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case ev := <-sub.C():
+			s.handleEvent(ev, cfg.Options().DesktopNotify)
+		case <-timer:
+			timer = nil
+		case <-s.stop:
+			return
+		}
+
+		if timer == nil {
+			if wait := s.flush(time.Now()); wait > 0 {
+				timer = time.After(wait)
+			}
+		}
+	}
+}
+
+// Stop stops the desktop notification service.
+func (s *desktopNotifySvc) Stop() {
+	close(s.stop)
+}
+
+func (s *desktopNotifySvc) handleEvent(ev events.Event, types []string) {
+	enabled := false
+	for _, name := range types {
+		if events.UnmarshalEventType(name) == ev.Type {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return
+	}
+
+	title, body := desktopMessage(ev)
+	if title == "" {
+		return
+	}
+
+	now := time.Now()
+	key := title + "\n" + body
+	if last, ok := s.shown[key]; ok && now.Sub(last) < desktopNotifyRepeat {
+		return
+	}
+	s.shown[key] = now
+	s.pending = append(s.pending, desktopNotification{title, body})
+}
+
+// flush shows the pending notifications, coalesced into one, unless the last
+// was shown less than desktopNotifyMinInterval ago; then it returns how long
+// to wait before trying again.
+func (s *desktopNotifySvc) flush(now time.Time) time.Duration {
+	if len(s.pending) == 0 {
+		return 0
+	}
+	if wait := s.lastShow.Add(desktopNotifyMinInterval).Sub(now); wait > 0 {
+		return wait
+	}
+
+	title, body := coalesceNotifications(s.pending)
+	s.pending = nil
+	s.lastShow = now
+
+	if err := s.show(title, body); err != nil && debugHTTP.Enabled() {
+		l.Debugln("desktop notification:", err)
+	}
+	return 0
+}
+
+// coalesceNotifications returns the title and text of one notification
+// standing for all of the given ones.
+func coalesceNotifications(ns []desktopNotification) (title, body string) {
+	if len(ns) == 1 {
+		return ns[0].title, ns[0].body
+	}
+
+	title = ns[0].title
+	var lines []string
+	for i, n := range ns {
+		if n.title != title {
+			title = fmt.Sprintf("%d notifications", len(ns))
+		}
+		if i < desktopNotifyMaxLines {
+			lines = append(lines, n.body)
+		}
+	}
+	if len(ns) > desktopNotifyMaxLines {
+		lines = append(lines, fmt.Sprintf("And %d more.", len(ns)-desktopNotifyMaxLines))
+	}
+	return title, strings.Join(lines, "\n")
+}
+
+// desktopMessage returns the title and text of the notification for the
+// event, or empty strings if it's not worth one.
+func desktopMessage(ev events.Event) (title, body string) {
+	switch ev.Type {
+	case events.StateChanged:
+		data, _ := ev.Data.(map[string]interface{})
+		if data["from"] == "syncing" && data["to"] == "idle" {
+			return "Folder in sync", fmt.Sprintf("Folder %q is up to date.", data["folder"])
+		}
+
+	case events.FileConflict:
+		data, _ := ev.Data.(map[string]interface{})
+		return "Conflicting changes", fmt.Sprintf("%s in folder %q was changed in conflict; the other version is kept as %s.", data["item"], data["folder"], data["conflictCopy"])
+
+	case events.DeviceRejected:
+		data, _ := ev.Data.(map[string]string)
+		return "New device", fmt.Sprintf("Device %s at %s wants to connect.", data["device"], data["address"])
+
+	case events.FolderRejected:
+		data, _ := ev.Data.(map[string]string)
+		name := data["device"]
+		if id, err := protocol.DeviceIDFromString(name); err == nil {
+			if device, ok := cfg.Devices()[id]; ok && device.Name != "" {
+				name = device.Name
+			}
+		}
+		return "New folder", fmt.Sprintf("Device %s wants to share folder %q.", name, data["folder"])
+	}
+	return "", ""
+}
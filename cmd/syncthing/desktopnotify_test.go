@@ -0,0 +1,91 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+func TestDesktopNotify(t *testing.T) {
+	var shown []string
+	s := newDesktopNotifySvc()
+	s.show = func(title, body string) error {
+		shown = append(shown, title)
+		return nil
+	}
+
+	synced := events.Event{Type: events.StateChanged, Data: map[string]interface{}{"folder": "default", "from": "syncing", "to": "idle"}}
+	scanned := events.Event{Type: events.StateChanged, Data: map[string]interface{}{"folder": "default", "from": "scanning", "to": "idle"}}
+	conflict := events.Event{Type: events.FileConflict, Data: map[string]interface{}{"folder": "default", "item": "a.txt", "conflictCopy": "a.sync-conflict-20150101-120000.txt"}}
+
+	s.handleEvent(synced, []string{"FileConflict"})
+	if len(shown) != 0 {
+		t.Fatalf("Notification %q for a type not asked for", shown)
+	}
+
+	types := []string{"StateChanged", "FileConflict"}
+	now := time.Now()
+	s.handleEvent(scanned, types)
+	s.handleEvent(synced, types)
+	s.flush(now)
+	if len(shown) != 1 || shown[0] != "Folder in sync" {
+		t.Fatalf("Incorrect notifications %q", shown)
+	}
+
+	// Too soon after the last one, so it waits.
+	s.handleEvent(conflict, types)
+	if wait := s.flush(now.Add(time.Second)); wait != desktopNotifyMinInterval-time.Second {
+		t.Errorf("Incorrect wait %v", wait)
+	}
+	if len(shown) != 1 {
+		t.Fatalf("Incorrect notifications %q", shown)
+	}
+
+	s.flush(now.Add(desktopNotifyMinInterval))
+	if len(shown) != 2 || shown[1] != "Conflicting changes" {
+		t.Fatalf("Incorrect notifications %q", shown)
+	}
+
+	// The same one again.
+	s.handleEvent(conflict, types)
+	s.flush(now.Add(2 * desktopNotifyMinInterval))
+	if len(shown) != 2 {
+		t.Fatalf("Repeated notification %q", shown)
+	}
+}
+
+func TestDesktopNotifyCoalesce(t *testing.T) {
+	var titles, bodies []string
+	s := newDesktopNotifySvc()
+	s.show = func(title, body string) error {
+		titles = append(titles, title)
+		bodies = append(bodies, body)
+		return nil
+	}
+
+	now := time.Now()
+	s.lastShow = now
+	types := []string{"FileConflict"}
+	for i := 0; i < desktopNotifyMaxLines+2; i++ {
+		ev := events.Event{Type: events.FileConflict, Data: map[string]interface{}{"folder": "default", "item": fmt.Sprintf("%d.txt", i)}}
+		s.handleEvent(ev, types)
+	}
+	s.flush(now.Add(desktopNotifyMinInterval))
+
+	if len(titles) != 1 || titles[0] != "Conflicting changes" {
+		t.Fatalf("Incorrect notifications %q", titles)
+	}
+	lines := strings.Split(bodies[0], "\n")
+	if len(lines) != desktopNotifyMaxLines+1 || lines[desktopNotifyMaxLines] != "And 2 more." {
+		t.Errorf("Incorrect coalesced notification %q", bodies[0])
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// showDesktopNotification shows the notification through Notification
+// Center on Mac OS X, or through the desktop's notification daemon over
+// D-Bus, using notify-send from libnotify, elsewhere.
+func showDesktopNotification(title, body string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		script := "display notification " + appleScriptString(body) + " with title " + appleScriptString("Syncthing: "+title)
+		return exec.Command("osascript", "-e", script).Run()
+
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return errors.New("no desktop session")
+		}
+		return exec.Command("notify-send", "--app-name=Syncthing", "Syncthing: "+title, body).Run()
+	}
+}
+
+func appleScriptString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
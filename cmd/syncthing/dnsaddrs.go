@@ -0,0 +1,102 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// A device address on the form dns://name is looked up in DNS: the SRV
+// records for _syncthing._tcp.name give the hosts and ports of the device.
+// Without those, each TXT record of name is taken to be an address on the
+// usual host:port form. This lets a device on a dynamic IP be reached through
+// a dyndns name, without global discovery.
+
+const dnsCacheLifetime = 5 * time.Minute
+
+type dnsAddrResolver struct {
+	lookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+	lookupTXT func(name string) ([]string, error)
+
+	cache map[string]dnsCacheEntry
+	mut   sync.Mutex
+}
+
+type dnsCacheEntry struct {
+	addrs []string
+	when  time.Time
+}
+
+var dnsAddrs = newDNSAddrResolver()
+
+func newDNSAddrResolver() *dnsAddrResolver {
+	return &dnsAddrResolver{
+		lookupSRV: net.LookupSRV,
+		lookupTXT: net.LookupTXT,
+		cache:     make(map[string]dnsCacheEntry),
+		mut:       sync.NewMutex(),
+	}
+}
+
+// lookup returns the addresses of the dns:// address, from the cache if
+// they were looked up recently.
+func (r *dnsAddrResolver) lookup(addr string) []string {
+	name := strings.TrimSuffix(strings.TrimPrefix(addr, "dns://"), "/")
+
+	r.mut.Lock()
+	entry, ok := r.cache[name]
+	r.mut.Unlock()
+	if ok && time.Since(entry.when) < dnsCacheLifetime {
+		return entry.addrs
+	}
+
+	addrs, err := r.lookupName(name)
+	if err != nil {
+		if debugNet.Enabled() {
+			l.Debugln("dns lookup:", name, err)
+		}
+		if ok {
+			// Keep using what we had until the name resolves again.
+			return entry.addrs
+		}
+		return nil
+	}
+
+	r.mut.Lock()
+	r.cache[name] = dnsCacheEntry{addrs, time.Now()}
+	r.mut.Unlock()
+	return addrs
+}
+
+func (r *dnsAddrResolver) lookupName(name string) ([]string, error) {
+	_, srvs, err := r.lookupSRV("syncthing", "tcp", name)
+	if err == nil && len(srvs) > 0 {
+		// The records come sorted by priority and randomized by weight.
+		addrs := make([]string, len(srvs))
+		for i, srv := range srvs {
+			addrs[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		}
+		return addrs, nil
+	}
+
+	txts, err := r.lookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, txt := range txts {
+		for _, addr := range strings.Fields(txt) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
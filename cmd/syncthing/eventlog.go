@@ -0,0 +1,133 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+// Events are written to the database at most this often.
+const eventLogFlushInterval = time.Second
+
+// The eventLogSvc keeps events of the configured types in the database, so
+// that after a restart the event IDs carry on where they were and the
+// clients of /rest/events can resume from the last event they saw. The
+// highest event ID is kept too, as events of other types use up IDs as well.
+type eventLogSvc struct {
+	log     *db.EventLog
+	mask    events.EventType
+	size    int
+	stop    chan struct{} // signals time to stop
+	started chan struct{} // signals startup complete
+}
+
+func newEventLogSvc(log *db.EventLog, opts config.OptionsConfiguration) *eventLogSvc {
+	return &eventLogSvc{
+		log:     log,
+		mask:    eventLogMask(opts.EventLogTypes),
+		size:    opts.EventLogSize,
+		stop:    make(chan struct{}),
+		started: make(chan struct{}),
+	}
+}
+
+// eventLogMask returns the mask for the named event types, or for all of
+// them when none are named.
+func eventLogMask(types []string) events.EventType {
+	if len(types) == 0 {
+		return events.AllEvents
+	}
+	var mask events.EventType
+	for _, name := range types {
+		t := events.UnmarshalEventType(name)
+		if t == 0 {
+			l.Warnf("Event log: unknown event type %q", name)
+			continue
+		}
+		mask |= t
+	}
+	return mask
+}
+
+// Serve runs the event log service.
+func (s *eventLogSvc) Serve() {
+	sub := events.Default.Subscribe(events.AllEvents)
+	defer events.Default.Unsubscribe(sub)
+	close(s.started)
+
+	ticker := time.NewTicker(eventLogFlushInterval)
+	defer ticker.Stop()
+
+	s.log.Truncate(s.size)
+	// Truncating after every event would be wasteful, so the log may grow
+	// by a tenth before it's cut back.
+	sinceTruncate := 0
+	var batch db.EventBatch
+	for {
+		select {
+		case ev := <-sub.C():
+			batch.Seen(ev.ID)
+			if ev.Type&s.mask == 0 {
+				continue
+			}
+			bs, err := json.Marshal(ev)
+			if err != nil {
+				// The GUI couldn't have shown it either.
+				continue
+			}
+			batch.Add(ev.ID, bs)
+			sinceTruncate++
+		case <-ticker.C:
+			s.log.Append(&batch)
+			if sinceTruncate > s.size/10 {
+				s.log.Truncate(s.size)
+				sinceTruncate = 0
+			}
+		case <-s.stop:
+			s.log.Append(&batch)
+			return
+		}
+	}
+}
+
+// Stop stops the event log service.
+func (s *eventLogSvc) Stop() {
+	close(s.stop)
+}
+
+// WaitForStart returns once the event log service is ready to receive
+// events.
+func (s *eventLogSvc) WaitForStart() {
+	<-s.started
+}
+
+// restoreEvents returns the events kept in the log and makes the IDs of new
+// events follow them, and any other events logged before.
+func restoreEvents(log *db.EventLog) []events.Event {
+	var evs []events.Event
+	for _, bs := range log.Events() {
+		var ev events.Event
+		if err := json.Unmarshal(bs, &ev); err != nil {
+			// An event of a type this version doesn't know, perhaps.
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	lastID := log.LastID()
+	if len(evs) > 0 && evs[len(evs)-1].ID > lastID {
+		lastID = evs[len(evs)-1].ID
+	}
+	if lastID > 0 {
+		events.Default.Resume(lastID)
+	}
+	return evs
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRestoreEvents(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := db.NewEventLog(ldb)
+
+	const lastID = 1 << 20
+	var b db.EventBatch
+	for id := lastID - 2; id <= lastID; id++ {
+		bs, _ := json.Marshal(events.Event{ID: id, Time: time.Now(), Type: events.DeviceConnected, Data: "foo"})
+		b.Add(id, bs)
+	}
+	b.Add(lastID+1, []byte(`{"id":1048577,"type":"FromTheFuture"}`))
+	// Events that weren't stored came after them.
+	b.Seen(lastID + 100)
+	log.Append(&b)
+
+	evs := restoreEvents(log)
+	if len(evs) != 3 || evs[2].ID != lastID || evs[2].Type != events.DeviceConnected || evs[2].Data != "foo" {
+		t.Fatalf("Incorrect events %v", evs)
+	}
+
+	sub := events.Default.Subscribe(events.Ping)
+	defer events.Default.Unsubscribe(sub)
+	events.Default.Log(events.Ping, nil)
+	if ev, err := sub.Poll(time.Second); err != nil || ev.ID <= lastID+100 {
+		t.Errorf("Event ID %d doesn't follow the restored ones, %v", ev.ID, err)
+	}
+}
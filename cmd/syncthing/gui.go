@@ -16,10 +16,12 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -34,6 +36,7 @@ import (
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syncthing/syncthing/internal/trace"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/vitrun/qart/qr"
 	"golang.org/x/crypto/bcrypt"
@@ -44,12 +47,15 @@ type guiError struct {
 	Error string    `json:"error"`
 }
 
+const fetchProgressIntv = time.Second
+
 var (
 	configInSync = true
 	guiErrors    = []guiError{}
 	guiErrorsMut = sync.NewMutex()
 	startTime    = time.Now()
 	eventSub     *events.BufferedSubscription
+	eventHistory []events.Event // restored from the database at startup
 )
 
 type apiSvc struct {
@@ -60,6 +66,8 @@ type apiSvc struct {
 	fss             *folderSummarySvc
 	stop            chan struct{}
 	systemConfigMut sync.Mutex
+	pendingTOTP     []byte                // secret being enrolled, until confirmed
+	transactionCfg  *config.Configuration // the result of the last transaction, until rolled back
 }
 
 func newAPISvc(cfg config.GUIConfiguration, assetDir string, m *model.Model) (*apiSvc, error) {
@@ -76,6 +84,10 @@ func newAPISvc(cfg config.GUIConfiguration, assetDir string, m *model.Model) (*a
 }
 
 func (s *apiSvc) getListener(cfg config.GUIConfiguration) (net.Listener, error) {
+	if cfg.Network() == "unix" {
+		return unixListener(cfg)
+	}
+
 	cert, err := tls.LoadX509KeyPair(locations[locHTTPSCertFile], locations[locHTTPSKeyFile])
 	if err != nil {
 		l.Infoln("Loading HTTPS certificate:", err)
@@ -111,8 +123,13 @@ func (s *apiSvc) getListener(cfg config.GUIConfiguration) (net.Listener, error)
 			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
 		},
 	}
+	if cfg.ClientCertAuth == "accept" || cfg.ClientCertAuth == "require" {
+		// Verified by clientCertMiddleware, as certificates may be trusted
+		// by fingerprint alone.
+		tlsCfg.ClientAuth = tls.RequestClientCert
+	}
 
-	rawListener, err := net.Listen("tcp", cfg.Address)
+	rawListener, err := net.Listen("tcp", cfg.ListenAddress())
 	if err != nil {
 		return nil, err
 	}
@@ -121,23 +138,65 @@ func (s *apiSvc) getListener(cfg config.GUIConfiguration) (net.Listener, error)
 	return listener, nil
 }
 
+// unixListener listens on the Unix socket of the configuration. Whoever can
+// open the socket file can talk to us, so there is no TLS; a reverse proxy in
+// front can add it.
+func unixListener(cfg config.GUIConfiguration) (net.Listener, error) {
+	mode, err := cfg.UnixSocketMode()
+	if err != nil {
+		return nil, err
+	}
+
+	path := cfg.ListenAddress()
+	// A socket left behind by an instance that didn't shut down cleanly
+	// would make the listen fail. Anything else at the path is left alone.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
 func (s *apiSvc) Serve() {
 	s.stop = make(chan struct{})
 
 	l.AddHandler(logger.LevelWarn, s.showGuiError)
 	sub := events.Default.Subscribe(events.AllEvents)
-	eventSub = events.NewBufferedSubscription(sub, 1000)
+	eventSub = events.NewBufferedSubscriptionFrom(sub, 1000, eventHistory)
 	defer events.Default.Unsubscribe(sub)
 
 	// The GET handlers
 	getRestMux := http.NewServeMux()
+	getRestMux.HandleFunc("/rest/config/history", s.getConfigHistory)            // -
+	getRestMux.HandleFunc("/rest/config/history/diff", s.getConfigDiff)          // version [against]
+	getRestMux.HandleFunc("/rest/db/compact", s.getDBCompact)                    // -
 	getRestMux.HandleFunc("/rest/db/completion", s.getDBCompletion)              // device folder
+	getRestMux.HandleFunc("/rest/db/export", s.getDBExport)                      // folder
+	getRestMux.HandleFunc("/rest/db/failed", s.getDBFailed)                      // folder
 	getRestMux.HandleFunc("/rest/db/file", s.getDBFile)                          // folder file
 	getRestMux.HandleFunc("/rest/db/ignores", s.getDBIgnores)                    // folder
-	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                          // folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/db/localchanged", s.getDBLocalChanged)          // folder
+	getRestMux.HandleFunc("/rest/db/progress", s.getDBProgress)                  // [folder]
+	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                          // folder [perpage] [page] [filter] [order]
+	getRestMux.HandleFunc("/rest/db/remotehave", s.getDBRemoteHave)              // device folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/db/remoteneed", s.getDBRemoteNeed)              // device folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/db/search", s.getDBSearch)                      // query [folder] [perpage] [page]
 	getRestMux.HandleFunc("/rest/db/status", s.getDBStatus)                      // folder
 	getRestMux.HandleFunc("/rest/db/browse", s.getDBBrowse)                      // folder [prefix] [dirsonly] [levels]
-	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit]
+	getRestMux.HandleFunc("/rest/db/subtrees", s.getDBSubtrees)                  // folder [prefix] [levels]
+	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit] [events] [folder]
+	getRestMux.HandleFunc("/rest/events/ws", s.getEventsWS)                      // [since] [events] [folder]
+	getRestMux.HandleFunc("/rest/noauth/health", getHealth)                      // -
 	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                // -
 	getRestMux.HandleFunc("/rest/stats/folder", s.getFolderStats)                // -
 	getRestMux.HandleFunc("/rest/svc/deviceid", s.getDeviceID)                   // id
@@ -147,40 +206,75 @@ func (s *apiSvc) Serve() {
 	getRestMux.HandleFunc("/rest/system/config", s.getSystemConfig)              // -
 	getRestMux.HandleFunc("/rest/system/config/insync", s.getSystemConfigInsync) // -
 	getRestMux.HandleFunc("/rest/system/connections", s.getSystemConnections)    // -
+	getRestMux.HandleFunc("/rest/system/dbstatus", s.getSystemDBStatus)          // -
+	getRestMux.HandleFunc("/rest/system/debug", s.getSystemDebug)                // -
 	getRestMux.HandleFunc("/rest/system/discovery", s.getSystemDiscovery)        // -
 	getRestMux.HandleFunc("/rest/system/error", s.getSystemError)                // -
+	getRestMux.HandleFunc("/rest/system/log", s.getSystemLog)                    // [since] [level] [facility]
 	getRestMux.HandleFunc("/rest/system/ping", s.restPing)                       // -
+	getRestMux.HandleFunc("/rest/system/power", s.getSystemPower)                // -
+	getRestMux.HandleFunc("/rest/system/relays", s.getSystemRelays)              // -
+	getRestMux.HandleFunc("/rest/system/sessions", s.getSystemSessions)          // -
 	getRestMux.HandleFunc("/rest/system/status", s.getSystemStatus)              // -
+	getRestMux.HandleFunc("/rest/system/totp", s.getTOTP)                        // -
 	getRestMux.HandleFunc("/rest/system/upgrade", s.getSystemUpgrade)            // -
 	getRestMux.HandleFunc("/rest/system/version", s.getSystemVersion)            // -
+	getRestMux.HandleFunc("/rest/v2/connections", s.getV2Connections)            // -
+	getRestMux.HandleFunc("/rest/v2/folders", s.getV2Folders)                    // -
+	getRestMux.HandleFunc("/rest/v2/folders/", s.getV2Folders)                   // -
+	getRestMux.HandleFunc("/rest/v2/system/status", s.getV2SystemStatus)         // -
+	getRestMux.HandleFunc("/rest/v2/system/version", s.getV2Version)             // -
 
 	// The POST handlers
 	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/rest/config/rollback", s.postConfigRollback)      // [version]
+	postRestMux.HandleFunc("/rest/config/transaction", s.postTransaction)      // <body>
+	postRestMux.HandleFunc("/rest/config/validate", s.postConfigValidate)      // <body>
+	postRestMux.HandleFunc("/rest/db/check", s.postDBCheck)                    // [repair]
+	postRestMux.HandleFunc("/rest/db/compact", s.postDBCompact)                // -
 	postRestMux.HandleFunc("/rest/db/prio", s.postDBPrio)                      // folder file [perpage] [page]
+	postRestMux.HandleFunc("/rest/db/fetch", s.postDBFetch)                    // folder file
 	postRestMux.HandleFunc("/rest/db/ignores", s.postDBIgnores)                // folder
-	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)              // folder
+	postRestMux.HandleFunc("/rest/db/import", s.postDBImport)                  // folder <body>
+	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)              // folder [sub...]
+	postRestMux.HandleFunc("/rest/db/pause", s.postDBPause)                    // folder
+	postRestMux.HandleFunc("/rest/db/resume", s.postDBResume)                  // folder
+	postRestMux.HandleFunc("/rest/db/revert", s.postDBRevert)                  // folder [sub...]
 	postRestMux.HandleFunc("/rest/db/scan", s.postDBScan)                      // folder [sub...] [delay]
+	postRestMux.HandleFunc("/rest/db/subtrees", s.postDBSubtrees)              // folder path enable
 	postRestMux.HandleFunc("/rest/system/config", s.postSystemConfig)          // <body>
+	postRestMux.HandleFunc("/rest/system/debug", s.postSystemDebug)            // [enable] [disable]
 	postRestMux.HandleFunc("/rest/system/discovery", s.postSystemDiscovery)    // device addr
 	postRestMux.HandleFunc("/rest/system/error", s.postSystemError)            // <body>
 	postRestMux.HandleFunc("/rest/system/error/clear", s.postSystemErrorClear) // -
+	postRestMux.HandleFunc("/rest/system/logout", s.postSystemLogout)          // -
+	postRestMux.HandleFunc("/rest/system/pause", s.postSystemPause)            // device
 	postRestMux.HandleFunc("/rest/system/ping", s.restPing)                    // -
+	postRestMux.HandleFunc("/rest/system/power", s.postSystemPower)            // mode [metered]
 	postRestMux.HandleFunc("/rest/system/reset", s.postSystemReset)            // [folder]
 	postRestMux.HandleFunc("/rest/system/restart", s.postSystemRestart)        // -
+	postRestMux.HandleFunc("/rest/system/resume", s.postSystemResume)          // device
+	postRestMux.HandleFunc("/rest/system/sessions/end", s.postSessionsEnd)     // id
 	postRestMux.HandleFunc("/rest/system/shutdown", s.postSystemShutdown)      // -
+	postRestMux.HandleFunc("/rest/system/totp/confirm", s.postTOTPConfirm)     // code
+	postRestMux.HandleFunc("/rest/system/totp/disable", s.postTOTPDisable)     // code
+	postRestMux.HandleFunc("/rest/system/totp/enroll", s.postTOTPEnroll)       // -
 	postRestMux.HandleFunc("/rest/system/upgrade", s.postSystemUpgrade)        // -
 
 	// Debug endpoints, not for general use
 	getRestMux.HandleFunc("/rest/debug/peerCompletion", s.getPeerCompletion)
 
-	// A handler that splits requests between the two above and disables
-	// caching
-	restMux := noCacheMiddleware(getPostHandler(getRestMux, postRestMux))
+	// A handler that splits requests between the two above, disables
+	// caching and flags the endpoints replaced in /rest/v2
+	restMux := noCacheMiddleware(deprecationMiddleware(getPostHandler(getRestMux, postRestMux)))
 
 	// The main routing handler
 	mux := http.NewServeMux()
 	mux.Handle("/rest/", restMux)
+	mux.Handle("/rest/config/folders/", noCacheMiddleware(http.HandlerFunc(s.configFolder)))
+	mux.Handle("/rest/config/devices/", noCacheMiddleware(http.HandlerFunc(s.configDevice)))
 	mux.HandleFunc("/qr/", s.getQR)
+	mux.HandleFunc("/metrics", s.getMetrics)
 
 	// Serve compiled in assets unless an asset directory was set (for development)
 	mux.Handle("/", embeddedStatic{
@@ -190,22 +284,51 @@ func (s *apiSvc) Serve() {
 
 	// Wrap everything in CSRF protection. The /rest prefix should be
 	// protected, other requests will grant cookies.
-	handler := csrfMiddleware("/rest", s.cfg.APIKey, mux)
+	handler := csrfMiddleware("/rest", s.cfg, apiKeyMiddleware(s.cfg, mux))
 
 	// Add our version as a header to responses
 	handler = withVersionMiddleware(handler)
+	unauthed := handler
 
-	// Wrap everything in basic auth, if user/password is set.
-	if len(s.cfg.User) > 0 && len(s.cfg.Password) > 0 {
+	// Wrap everything in basic auth, if user/password is set or LDAP is used.
+	if len(s.cfg.User) > 0 && len(s.cfg.Password) > 0 || s.cfg.AuthMode == "ldap" {
 		handler = basicAuthAndSessionMiddleware(s.cfg, handler)
 	}
 
-	// Redirect to HTTPS if we are supposed to
-	if s.cfg.UseTLS {
+	// Health checks may skip the authentication above, but not a required
+	// client certificate below.
+	if s.cfg.UnauthenticatedHealth {
+		handler = noAuthHealthMiddleware(handler)
+	}
+
+	// Client certificates either replace the above or come on top of it.
+	if mode := s.cfg.ClientCertAuth; mode == "accept" || mode == "require" {
+		certs, err := newClientCertVerifier(s.cfg)
+		if err != nil {
+			// Nothing will be trusted, which locks out everyone in require
+			// mode rather than letting everyone in.
+			l.Warnln("Client certificates:", err)
+		}
+		handler = clientCertMiddleware(mode == "require", certs, handler, unauthed)
+	}
+
+	// Let dashboards on other origins use the API, if configured.
+	if len(s.cfg.CORSAllowedOrigins) > 0 {
+		handler = corsMiddleware(s.cfg, handler)
+	}
+
+	// Accept requests under the base path of a reverse proxy.
+	if base := s.cfg.URLBase(); base != "" {
+		handler = basePathMiddleware(base, handler)
+	}
+
+	// Redirect to HTTPS if we are supposed to. There is no HTTPS on a Unix
+	// socket.
+	if s.cfg.UseTLS && s.cfg.Network() != "unix" {
 		handler = redirectToHTTPSMiddleware(handler)
 	}
 
-	if debugHTTP {
+	if debugHTTP.Enabled() {
 		handler = debugMiddleware(handler)
 	}
 
@@ -245,7 +368,7 @@ func (s *apiSvc) VerifyConfiguration(from, to config.Configuration) error {
 }
 
 func (s *apiSvc) CommitConfiguration(from, to config.Configuration) bool {
-	if to.GUI == from.GUI {
+	if reflect.DeepEqual(to.GUI, from.GUI) {
 		return true
 	}
 
@@ -327,6 +450,25 @@ func redirectToHTTPSMiddleware(h http.Handler) http.Handler {
 	})
 }
 
+// basePathMiddleware removes the base path from requests, so that the GUI
+// works whether or not the reverse proxy in front strips it. The base path
+// itself is redirected to the index with a trailing slash, as the GUI refers
+// to its assets and the API relative to the page.
+func basePathMiddleware(base string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == base:
+			u := *r.URL
+			u.Path = base + "/"
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+			return
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, base)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func noCacheMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store")
@@ -389,8 +531,10 @@ func (s *apiSvc) getDBCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res := map[string]float64{
+	res := map[string]interface{}{
 		"completion": s.model.Completion(device, folder),
+		// "paused" or "error" when the device doesn't sync the folder
+		"remoteState": s.model.RemoteFolderState(device, folder),
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -419,6 +563,10 @@ func folderSummary(m *model.Model, folder string) map[string]interface{} {
 	needFiles, needBytes := m.NeedSize(folder)
 	res["needFiles"], res["needBytes"] = needFiles, needBytes
 
+	res["quotaBytes"] = int64(cfg.Folders()[folder].QuotaMiB) << 20
+	res["quietHours"] = m.InQuietHours(folder)
+	res["quotaExceeded"] = m.QuotaExceeded(folder)
+
 	res["inSyncFiles"], res["inSyncBytes"] = globalFiles-needFiles, globalBytes-needBytes
 
 	var err error
@@ -444,29 +592,186 @@ func folderSummary(m *model.Model, folder string) map[string]interface{} {
 func (s *apiSvc) postDBOverride(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var folder = qs.Get("folder")
-	go s.model.Override(folder)
+	go s.model.Override(folder, qs["sub"])
 }
 
-func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
+func (s *apiSvc) postDBRevert(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	go s.model.Revert(folder, qs["sub"])
+}
+
+func (s *apiSvc) postDBPause(w http.ResponseWriter, r *http.Request) {
+	s.setFolderPaused(w, r, true)
+}
+
+func (s *apiSvc) postDBResume(w http.ResponseWriter, r *http.Request) {
+	s.setFolderPaused(w, r, false)
+}
+
+func (s *apiSvc) setFolderPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	folderCfg, ok := cfg.Folders()[folder]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	if refuseLocked(w, "folders") {
+		return
+	}
+	folderCfg = folderCfg.Copy()
+	folderCfg.Paused = paused
+
+	resp := cfg.SetFolder(folderCfg)
+	configInSync = !resp.RequiresRestart
+	cfg.SaveBy(requestActor(r))
+}
+
+func (s *apiSvc) getDBSubtrees(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	prefix := strings.Trim(qs.Get("prefix"), "/")
 
+	levels, err := strconv.Atoi(qs.Get("levels"))
+	if err != nil {
+		levels = -1
+	}
+
+	folderCfg, ok := cfg.Folders()[folder]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	subtrees := folderCfg.Subtrees
+	if subtrees == nil {
+		subtrees = []string{}
+	}
+
+	// The directories in the cluster, and whether we sync them (or
+	// something within them).
+	tree := s.model.GlobalDirectoryTree(folder, prefix, levels, true)
+	dirs := []map[string]interface{}{}
+	var walk func(dir string, tree map[string]interface{})
+	walk = func(dir string, tree map[string]interface{}) {
+		names := make([]string, 0, len(tree))
+		for name := range tree {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := name
+			if dir != "" {
+				path = dir + "/" + name
+			}
+			dirs = append(dirs, map[string]interface{}{
+				"path":     path,
+				"selected": folderCfg.IsSelected(filepath.FromSlash(path)),
+			})
+			if sub, ok := tree[name].(map[string]interface{}); ok {
+				walk(path, sub)
+			}
+		}
+	}
+	walk(prefix, tree)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subtrees": subtrees,
+		"tree":     dirs,
+	})
+}
+
+func (s *apiSvc) postDBSubtrees(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
 	folder := qs.Get("folder")
+	sub := filepath.ToSlash(filepath.Clean(filepath.FromSlash(strings.Trim(qs.Get("path"), "/"))))
+	enable := qs.Get("enable") == "true"
 
-	page, err := strconv.Atoi(qs.Get("page"))
-	if err != nil || page < 1 {
-		page = 1
+	folderCfg, ok := cfg.Folders()[folder]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
 	}
-	perpage, err := strconv.Atoi(qs.Get("perpage"))
-	if err != nil || perpage < 1 {
-		perpage = 1 << 16
+	if sub == "." || sub == ".." || strings.HasPrefix(sub, "../") {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if refuseLocked(w, "folders") {
+		return
+	}
+
+	folderCfg = folderCfg.Copy()
+	var subtrees []string
+	for _, cur := range folderCfg.Subtrees {
+		if cur != sub {
+			subtrees = append(subtrees, cur)
+		}
+	}
+	if enable {
+		subtrees = append(subtrees, sub)
 	}
+	sort.Strings(subtrees)
+	folderCfg.Subtrees = subtrees
+
+	resp := cfg.SetFolder(folderCfg)
+	configInSync = !resp.RequiresRestart
+	cfg.SaveBy(requestActor(r))
+}
 
-	progress, queued, rest, total := s.model.NeedFolderFiles(folder, page, perpage)
+func (s *apiSvc) getDBLocalChanged(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+
+	files := s.model.LocalChangedFiles(folder)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files": s.toNeedSlice(files),
+	})
+}
+
+func (s *apiSvc) getDBFailed(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"folder": folder,
+		"items":  s.model.FailedItems(folder),
+	})
+}
+
+func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	folder := qs.Get("folder")
+	page, perpage := pageParams(qs)
+
+	var order config.PullOrder
+	order.UnmarshalText([]byte(qs.Get("order")))
+
+	progress, queued, rest, total := s.model.NeedFolderFiles(folder, page, perpage, qs.Get("filter"), order)
+
+	// The position of each queued file in the pull queue, starting at one.
+	// Files that have left the queue in the meantime get zero.
+	_, queueNames := s.model.PullQueue(folder)
+	positions := make(map[string]int, len(queueNames))
+	for i, name := range queueNames {
+		positions[name] = i + 1
+	}
+	queuedOut := make([]jsonQueuedFileInfo, len(queued))
+	for i, f := range queued {
+		queuedOut[i] = jsonQueuedFileInfo{f, positions[f.Name]}
+	}
 
 	// Convert the struct to a more loose structure, and inject the size.
 	output := map[string]interface{}{
 		"progress": s.toNeedSlice(progress),
-		"queued":   s.toNeedSlice(queued),
+		"queued":   queuedOut,
 		"rest":     s.toNeedSlice(rest),
 		"total":    total,
 		"page":     page,
@@ -477,8 +782,114 @@ func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(output)
 }
 
+// getDBProgress returns the progress of the files being pulled, in the same
+// form as the DownloadProgress events.
+func (s *apiSvc) getDBProgress(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.model.AllPullProgress(qs.Get("folder")))
+}
+
+// getDBRemoteNeed returns what the device needs of the folder, as far as we
+// know from its index, and how much of each file it already has.
+func (s *apiSvc) getDBRemoteNeed(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	page, perpage := pageParams(qs)
+
+	files, total := s.model.RemoteNeedFiles(device, qs.Get("folder"), page, perpage)
+	out := make([]map[string]interface{}, len(files))
+	for i, f := range files {
+		out[i] = jsonDBFileInfo(f.FileInfoTruncated).fields()
+		out[i]["completion"] = f.Completion
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":   out,
+		"total":   total,
+		"page":    page,
+		"perpage": perpage,
+	})
+}
+
+// getDBRemoteHave returns the files of the folder the device has announced.
+func (s *apiSvc) getDBRemoteHave(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	page, perpage := pageParams(qs)
+
+	files, total := s.model.RemoteHaveFiles(device, qs.Get("folder"), page, perpage)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":   s.toNeedSlice(files),
+		"total":   total,
+		"page":    page,
+		"perpage": perpage,
+	})
+}
+
+// getDBSearch returns the files in the index, of the folder or of all
+// folders, with names matching the query.
+func (s *apiSvc) getDBSearch(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	query := qs.Get("query")
+	if query == "" {
+		http.Error(w, "Empty query", http.StatusBadRequest)
+		return
+	}
+	page, perpage := pageParams(qs)
+
+	files, total := s.model.SearchFiles(qs.Get("folder"), query, page, perpage)
+	out := make([]map[string]interface{}, len(files))
+	for i, f := range files {
+		out[i] = jsonDBFileInfo(f.FileInfoTruncated).fields()
+		out[i]["folder"] = f.Folder
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":   out,
+		"total":   total,
+		"page":    page,
+		"perpage": perpage,
+	})
+}
+
+// pageParams returns the page, starting at one, and the number of items
+// per page asked for.
+func pageParams(qs url.Values) (page, perpage int) {
+	page, err := strconv.Atoi(qs.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perpage, err = strconv.Atoi(qs.Get("perpage"))
+	if err != nil || perpage < 1 {
+		perpage = 1 << 16
+	}
+	return page, perpage
+}
+
 func (s *apiSvc) getSystemConnections(w http.ResponseWriter, r *http.Request) {
 	var res = s.model.ConnectionStats()
+	if conns, ok := res["connections"].(map[string]model.ConnectionInfo); ok && connections != nil {
+		// The model doesn't know how the connections were made.
+		for id, info := range conns {
+			if device, err := protocol.DeviceIDFromString(id); err == nil {
+				info.Type = connections.connType(device).String()
+				conns[id] = info
+			}
+		}
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
 }
@@ -540,6 +951,10 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Two factor authentication isn't part of the posted config.
+	to.GUI.TOTPSecret = cfg.GUI().TOTPSecret
+	to.GUI.TOTPRecoveryCodes = cfg.GUI().TOTPRecoveryCodes
+
 	// Fixup usage reporting settings
 
 	if curAcc := cfg.Options().URAccepted; to.Options.URAccepted > curAcc {
@@ -552,11 +967,16 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		to.Options.URUniqueID = ""
 	}
 
+	if err := checkConfigLock(cfg.Raw(), to); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	// Activate and save
 
 	resp := cfg.Replace(to)
 	configInSync = !resp.RequiresRestart
-	cfg.Save()
+	cfg.SaveBy(requestActor(r))
 }
 
 func (s *apiSvc) getSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
@@ -564,6 +984,39 @@ func (s *apiSvc) getSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
 }
 
+func (s *apiSvc) postSystemPause(w http.ResponseWriter, r *http.Request) {
+	s.setDevicePaused(w, r, true)
+}
+
+func (s *apiSvc) postSystemResume(w http.ResponseWriter, r *http.Request) {
+	s.setDevicePaused(w, r, false)
+}
+
+func (s *apiSvc) setDevicePaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	var qs = r.URL.Query()
+	device, err := protocol.DeviceIDFromString(qs.Get("device"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	deviceCfg, ok := cfg.Devices()[device]
+	if !ok {
+		http.Error(w, "No such device", 404)
+		return
+	}
+
+	if refuseLocked(w, "devices") {
+		return
+	}
+	deviceCfg = deviceCfg.Copy()
+	deviceCfg.Paused = paused
+
+	resp := cfg.SetDevice(deviceCfg)
+	configInSync = !resp.RequiresRestart
+	cfg.SaveBy(requestActor(r))
+}
+
 func (s *apiSvc) postSystemRestart(w http.ResponseWriter, r *http.Request) {
 	s.flushResponse(`{"ok": "restarting"}`, w)
 	go restart()
@@ -618,6 +1071,9 @@ func (s *apiSvc) getSystemStatus(w http.ResponseWriter, r *http.Request) {
 	if cfg.Options().GlobalAnnEnabled && discoverer != nil {
 		res["extAnnounceOK"] = discoverer.ExtAnnounceOK()
 	}
+	if discoSrv != nil {
+		res["discoveryServer"] = discoSrv.Status()
+	}
 	cpuUsageLock.RLock()
 	var cpusum float64
 	for _, p := range cpuUsagePercent {
@@ -660,6 +1116,63 @@ func (s *apiSvc) showGuiError(l logger.LogLevel, err string) {
 	guiErrorsMut.Unlock()
 }
 
+// getSystemLog returns the recent log lines, optionally only those after a
+// time, of at least a level, or from a facility.
+func (s *apiSvc) getSystemLog(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var since time.Time
+	if str := qs.Get("since"); str != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, str); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	level := logger.LevelDebug
+	if str := qs.Get("level"); str != "" {
+		var ok bool
+		if level, ok = parseLogLevel(str); !ok {
+			http.Error(w, "Unknown level", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]logLine{
+		"messages": recentLog.Since(since, level, qs.Get("facility")),
+	})
+}
+
+// getSystemDebug returns the debug facilities and whether they're enabled.
+func (s *apiSvc) getSystemDebug(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"facilities": trace.Facilities(),
+	})
+}
+
+// postSystemDebug enables and disables debug facilities, given as comma
+// separated lists.
+func (s *apiSvc) postSystemDebug(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	for _, change := range []struct {
+		param   string
+		enabled bool
+	}{{"enable", true}, {"disable", false}} {
+		for _, name := range strings.Split(qs.Get(change.param), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if err := trace.Set(name, change.enabled); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			l.Infof("Debug facility %q enabled: %v", name, change.enabled)
+		}
+	}
+}
+
 func (s *apiSvc) postSystemDiscovery(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var device = qs.Get("device")
@@ -685,11 +1198,135 @@ func (s *apiSvc) getSystemDiscovery(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(devices)
 }
 
+func (s *apiSvc) getSystemPower(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	status := map[string]interface{}{}
+	if power != nil {
+		status = power.Status()
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *apiSvc) getSystemDBStatus(w http.ResponseWriter, r *http.Request) {
+	res, err := s.model.DatabaseStatus(dbDir)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *apiSvc) getSystemRelays(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	status := map[string]interface{}{}
+	if relays != nil {
+		status = relays.Status()
+	}
+	if relayServer != nil {
+		status["server"] = relayServer.Status()
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *apiSvc) postSystemPower(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	if power == nil {
+		http.Error(w, "Not available", 500)
+		return
+	}
+	if !power.SetMode(qs.Get("mode"), qs.Get("metered") == "true") {
+		http.Error(w, "Unknown mode, use auto, reduced or normal", http.StatusBadRequest)
+		return
+	}
+	s.getSystemPower(w, r)
+}
+
+func (s *apiSvc) getDBCompact(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res := map[string]interface{}{
+		"intervalH": cfg.Options().DatabaseCompactionH,
+	}
+	if dbCompactor != nil {
+		if last := dbCompactor.Last(); last != nil {
+			res["last"] = last
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func (s *apiSvc) postDBCheck(w http.ResponseWriter, r *http.Request) {
+	res := s.model.CheckIndex()
+	problems := 0
+	for _, folder := range res {
+		problems += folder.Problems()
+	}
+	repair := problems > 0 && r.URL.Query().Get("repair") == "true"
+	if repair {
+		s.model.ScheduleIndexRepair()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"folders":  res,
+		"problems": problems,
+		"repair":   repair,
+	})
+	if repair {
+		// The repair is done at startup, before the folders are opened.
+		go restart()
+	}
+}
+
+func (s *apiSvc) postDBCompact(w http.ResponseWriter, r *http.Request) {
+	if dbCompactor == nil {
+		http.Error(w, "Not available", 500)
+		return
+	}
+	res := dbCompactor.Compact()
+	if res.Error != "" {
+		http.Error(w, res.Error, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (s *apiSvc) getReport(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(reportData(s.model))
 }
 
+func (s *apiSvc) getDBExport(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	if _, ok := cfg.Folders()[folder]; !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", folder+".stindex"))
+	if err := s.model.ExportIndex(folder, w); err != nil {
+		// Too late for an error status, but the import will notice the
+		// truncated file.
+		l.Warnf("Exporting the index of %q: %v", folder, err)
+	}
+}
+
+func (s *apiSvc) postDBImport(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	imported, skipped, err := s.model.ImportIndex(folder, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	l.Infof("Imported %d files into the index of %q; %d left to scanning", imported, folder, skipped)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]int{
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
+
 func (s *apiSvc) getDBIgnores(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -727,12 +1364,67 @@ func (s *apiSvc) postDBIgnores(w http.ResponseWriter, r *http.Request) {
 	s.getDBIgnores(w, r)
 }
 
+// eventFilter selects events by type and by the folder they concern. Events
+// that don't concern any folder aren't filtered by folder.
+type eventFilter struct {
+	mask    events.EventType
+	folders map[string]bool // nil for all
+}
+
+// newEventFilter returns the filter for the comma separated lists of event
+// types and folders in the "events" and "folder" parameters.
+func newEventFilter(qs url.Values) (eventFilter, error) {
+	f := eventFilter{mask: events.AllEvents}
+	if types := qs.Get("events"); types != "" {
+		f.mask = 0
+		for _, name := range strings.Split(types, ",") {
+			t := events.UnmarshalEventType(strings.TrimSpace(name))
+			if t == 0 {
+				return f, fmt.Errorf("Unknown event type %s", name)
+			}
+			f.mask |= t
+		}
+	}
+	if folders := qs.Get("folder"); folders != "" {
+		f.folders = make(map[string]bool)
+		for _, folder := range strings.Split(folders, ",") {
+			f.folders[strings.TrimSpace(folder)] = true
+		}
+	}
+	return f, nil
+}
+
+func (f eventFilter) match(ev events.Event) bool {
+	if ev.Type&f.mask == 0 {
+		return false
+	}
+	if f.folders == nil {
+		return true
+	}
+	switch data := ev.Data.(type) {
+	case map[string]interface{}:
+		if folder, ok := data["folder"].(string); ok {
+			return f.folders[folder]
+		}
+	case map[string]string:
+		if folder, ok := data["folder"]; ok {
+			return f.folders[folder]
+		}
+	}
+	return true
+}
+
 func (s *apiSvc) getEvents(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	sinceStr := qs.Get("since")
 	limitStr := qs.Get("limit")
 	since, _ := strconv.Atoi(sinceStr)
 	limit, _ := strconv.Atoi(limitStr)
+	filter, err := newEventFilter(qs)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
 	s.fss.gotEventRequest()
 
@@ -743,14 +1435,113 @@ func (s *apiSvc) getEvents(w http.ResponseWriter, r *http.Request) {
 	f := w.(http.Flusher)
 	f.Flush()
 
-	evs := eventSub.Since(since, nil)
+	// When everything is filtered out we keep waiting, for about as long
+	// as it takes for the next ping event to end an unfiltered request.
+	deadline := time.Now().Add(time.Minute)
+	var evs []events.Event
+	for {
+		for _, ev := range eventSub.Since(since, nil) {
+			since = ev.ID
+			if filter.match(ev) {
+				evs = append(evs, ev)
+			}
+		}
+		if len(evs) > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
 	if 0 < limit && limit < len(evs) {
 		evs = evs[len(evs)-limit:]
 	}
+	if evs == nil {
+		evs = []events.Event{}
+	}
 
 	json.NewEncoder(w).Encode(evs)
 }
 
+// getEventsWS streams the events after since over a WebSocket, each message
+// being a JSON array of events like the ones from getEvents, filtered the
+// same way.
+func (s *apiSvc) getEventsWS(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	since, _ := strconv.Atoi(qs.Get("since"))
+	filter, err := newEventFilter(qs)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	conn, rw, err := wsUpgrade(w, r, s.cfg.CORSAllowedOrigins)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The reading side answers pings, and notices the client going away.
+	// Writes are serialized by wmut, and given up on when the client doesn't
+	// read them.
+
+	wmut := sync.NewMutex()
+	write := func(opcode byte, payload []byte) error {
+		wmut.Lock()
+		defer wmut.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return wsWriteFrame(conn, opcode, payload)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			opcode, payload, err := wsReadFrame(rw)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsOpPing:
+				write(wsOpPong, payload)
+			case wsOpClose:
+				write(wsOpClose, nil)
+				return
+			}
+		}
+	}()
+
+	// Waiting for events ends at the latest with the next ping event, so we
+	// notice a closed connection within a minute or so.
+
+	var evs []events.Event
+	for {
+		evs = eventSub.Since(since, evs[:0])
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		var sel []events.Event
+		for _, ev := range evs {
+			since = ev.ID
+			if filter.match(ev) {
+				sel = append(sel, ev)
+			}
+		}
+		if len(sel) == 0 {
+			continue
+		}
+
+		s.fss.gotEventRequest()
+		bs, err := json.Marshal(sel)
+		if err != nil {
+			return
+		}
+		if err := write(wsOpText, bs); err != nil {
+			return
+		}
+	}
+}
+
 func (s *apiSvc) getSystemUpgrade(w http.ResponseWriter, r *http.Request) {
 	if noUpgrade {
 		http.Error(w, upgrade.ErrUpgradeUnsupported.Error(), 500)
@@ -854,6 +1645,80 @@ func (s *apiSvc) postDBPrio(w http.ResponseWriter, r *http.Request) {
 	s.getDBNeed(w, r)
 }
 
+// postDBFetch pulls the given file right away and streams its progress, as
+// one JSON object per line, until it is done.
+func (s *apiSvc) postDBFetch(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	file := qs.Get("file")
+
+	// Subscribe before starting the pull, so that we don't miss it
+	// finishing.
+	sub := events.Default.Subscribe(events.ItemFinished)
+	defer events.Default.Unsubscribe(sub)
+
+	needed, err := s.model.PullNow(folder, file)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	f := w.(http.Flusher)
+
+	status := map[string]interface{}{
+		"folder": folder,
+		"file":   file,
+	}
+	send := func(state string) {
+		status["state"] = state
+		enc.Encode(status)
+		f.Flush()
+	}
+
+	if !needed {
+		send("done")
+		return
+	}
+
+	t := time.NewTicker(fetchProgressIntv)
+	defer t.Stop()
+	gone := w.(http.CloseNotifier).CloseNotify()
+
+	for {
+		select {
+		case <-gone:
+			return
+
+		case ev := <-sub.C():
+			data := ev.Data.(map[string]interface{})
+			if data["folder"] != folder || data["item"] != file {
+				continue
+			}
+			if err := data["error"].(*string); err != nil {
+				status["error"] = *err
+				send("failed")
+			} else {
+				send("done")
+			}
+			return
+
+		case <-t.C:
+			if !s.model.NeedsFile(folder, file) {
+				send("done")
+				return
+			}
+			if progress, ok := s.model.PullProgress(folder, file); ok {
+				status["progress"] = progress
+				send("pulling")
+			} else {
+				send("queued")
+			}
+		}
+	}
+}
+
 func (s *apiSvc) getQR(w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var text = qs.Get("text")
@@ -1019,14 +1884,29 @@ func (f jsonFileInfo) MarshalJSON() ([]byte, error) {
 type jsonDBFileInfo db.FileInfoTruncated
 
 func (f jsonDBFileInfo) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
+	return json.Marshal(f.fields())
+}
+
+func (f jsonDBFileInfo) fields() map[string]interface{} {
+	return map[string]interface{}{
 		"name":         f.Name,
 		"size":         db.FileInfoTruncated(f).Size(),
 		"flags":        fmt.Sprintf("%#o", f.Flags),
 		"modified":     time.Unix(f.Modified, 0),
 		"localVersion": f.LocalVersion,
 		"version":      jsonVersionVector(f.Version),
-	})
+	}
+}
+
+type jsonQueuedFileInfo struct {
+	file     db.FileInfoTruncated
+	position int
+}
+
+func (f jsonQueuedFileInfo) MarshalJSON() ([]byte, error) {
+	fields := jsonDBFileInfo(f.file).fields()
+	fields["queuePosition"] = f.position
+	return json.Marshal(fields)
 }
 
 type jsonVersionVector protocol.Vector
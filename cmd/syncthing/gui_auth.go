@@ -15,34 +15,180 @@ import (
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
-	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syncthing/syncthing/internal/events"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var (
-	sessions    = make(map[string]bool)
-	sessionsMut = sync.NewMutex()
-)
+// lookupAPIKey returns the configured API key the request carries, either
+// in the X-API-Key header or as a bearer token. The main API key has full
+// access, and is labelled "main".
+func lookupAPIKey(r *http.Request, cfg config.GUIConfiguration) (config.APIKeyConfiguration, bool) {
+	key := r.Header.Get("X-API-Key")
+	if hdr := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(hdr, "Bearer ") {
+		key = hdr[7:]
+	}
+	if key == "" {
+		return config.APIKeyConfiguration{}, false
+	}
+
+	if config.APIKeyMatches(cfg.APIKey, key) {
+		return config.APIKeyConfiguration{Key: key, Label: "main"}, true
+	}
+	for _, extra := range cfg.ExtraAPIKeys {
+		if config.APIKeyMatches(extra.Key, key) {
+			return extra, true
+		}
+	}
+	return config.APIKeyConfiguration{}, false
+}
+
+// readOnlyPaths are the endpoints a read only API key may GET: the state of
+// the folders, devices and system, for dashboards and monitoring. Anything
+// not listed, such as the configuration with the other keys in it, its
+// history, the index export or the file system browser, is refused, so that
+// new endpoints aren't open to read only keys until they're added here. Paths
+// ending in a slash cover everything below them.
+var readOnlyPaths = map[string]bool{
+	"/metrics":                   true,
+	"/rest/db/browse":            true,
+	"/rest/db/compact":           true,
+	"/rest/db/completion":        true,
+	"/rest/db/failed":            true,
+	"/rest/db/file":              true,
+	"/rest/db/ignores":           true,
+	"/rest/db/localchanged":      true,
+	"/rest/db/need":              true,
+	"/rest/db/progress":          true,
+	"/rest/db/remotehave":        true,
+	"/rest/db/remoteneed":        true,
+	"/rest/db/search":            true,
+	"/rest/db/status":            true,
+	"/rest/db/subtrees":          true,
+	"/rest/events":               true,
+	"/rest/events/ws":            true,
+	"/rest/noauth/health":        true,
+	"/rest/stats/device":         true,
+	"/rest/stats/folder":         true,
+	"/rest/svc/deviceid":         true,
+	"/rest/svc/lang":             true,
+	"/rest/system/config/insync": true,
+	"/rest/system/connections":   true,
+	"/rest/system/dbstatus":      true,
+	"/rest/system/discovery":     true,
+	"/rest/system/error":         true,
+	"/rest/system/log":           true,
+	"/rest/system/ping":          true,
+	"/rest/system/power":         true,
+	"/rest/system/relays":        true,
+	"/rest/system/status":        true,
+	"/rest/system/upgrade":       true,
+	"/rest/system/version":       true,
+	"/rest/v2/connections":       true,
+	"/rest/v2/folders":           true,
+	"/rest/v2/folders/":          true,
+	"/rest/v2/system/status":     true,
+	"/rest/v2/system/version":    true,
+}
+
+// readOnlyAllowed returns whether a read only API key may make the request.
+func readOnlyAllowed(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if readOnlyPaths[r.URL.Path] {
+		return true
+	}
+	if i := strings.LastIndex(r.URL.Path, "/"); i > 0 {
+		return readOnlyPaths[r.URL.Path[:i+1]]
+	}
+	return false
+}
+
+// apiKeyMiddleware refuses requests made with a read only API key other than
+// to read the state of things, see readOnlyPaths. Requests made with a key
+// that change something are logged under the label of the key.
+func apiKeyMiddleware(cfg config.GUIConfiguration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := lookupAPIKey(r, cfg)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		label := keyLabel(key)
+		if debugHTTP.Enabled() {
+			l.Debugf("http: %s %s with API key %q", r.Method, r.URL.Path, label)
+		}
+
+		if key.ReadOnly && !readOnlyAllowed(r) {
+			l.Infof("Refused %s %s with read only API key %q", r.Method, r.URL.Path, label)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		logAPIRequest(r, "key", label)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func keyLabel(key config.APIKeyConfiguration) string {
+	if key.Label == "" {
+		return "unlabelled"
+	}
+	return key.Label
+}
+
+// logAPIRequest logs a request that changes something as an APIRequest
+// event, for the audit log, with who made it: the label of an API key or
+// the name of a user.
+func logAPIRequest(r *http.Request, who, name string) {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return
+	}
+	events.Default.Log(events.APIRequest, apiRequestData(r, who, name))
+}
+
+func apiRequestData(r *http.Request, who, name string) map[string]string {
+	data := map[string]string{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}
+	if who != "" {
+		data[who] = name
+	}
+	return data
+}
+
+// requestActor returns who made the request, which got past authentication
+// already, as in its APIRequest event, for the audit log of the
+// configuration changes it makes.
+func requestActor(r *http.Request) map[string]string {
+	gui := cfg.GUI()
+	if key, ok := lookupAPIKey(r, gui); ok {
+		return apiRequestData(r, "key", keyLabel(key))
+	}
+	if id, ok := validSession(r, gui); ok {
+		return apiRequestData(r, "user", sessionUser(id))
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return apiRequestData(r, "user", user)
+	}
+	return apiRequestData(r, "", "")
+}
 
 func basicAuthAndSessionMiddleware(cfg config.GUIConfiguration, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if cfg.APIKey != "" && r.Header.Get("X-API-Key") == cfg.APIKey {
+		if _, ok := lookupAPIKey(r, cfg); ok {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		cookie, err := r.Cookie("sessionid")
-		if err == nil && cookie != nil {
-			sessionsMut.Lock()
-			_, ok := sessions[cookie.Value]
-			sessionsMut.Unlock()
-			if ok {
-				next.ServeHTTP(w, r)
-				return
-			}
+		if id, ok := validSession(r, cfg); ok {
+			logAPIRequest(r, "user", sessionUser(id))
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		if debugHTTP {
+		if debugHTTP.Enabled() {
 			l.Debugln("Sessionless HTTP request with authentication; this is expensive.")
 		}
 
@@ -58,6 +204,14 @@ func basicAuthAndSessionMiddleware(cfg config.GUIConfiguration, next http.Handle
 			return
 		}
 
+		// After a logout the browser would log straight back in with the
+		// password it remembers. Asking again makes it forget it.
+		if _, err := r.Cookie("loggedout"); err == nil {
+			http.SetCookie(w, &http.Cookie{Name: "loggedout", Path: cfg.URLBase() + "/", MaxAge: -1})
+			error()
+			return
+		}
+
 		hdr = hdr[6:]
 		bs, err := base64.StdEncoding.DecodeString(hdr)
 		if err != nil {
@@ -71,26 +225,49 @@ func basicAuthAndSessionMiddleware(cfg config.GUIConfiguration, next http.Handle
 			return
 		}
 
-		if string(fields[0]) != cfg.User {
+		if !authenticate(cfg, string(fields[0]), string(fields[1])) {
 			error()
 			return
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(cfg.Password), fields[1]); err != nil {
-			error()
-			return
+		// The second factor, from the header or the form we ask with.
+		fromForm := r.Method == "POST" && r.URL.Path == "/totp"
+		if cfg.TOTPSecret != "" {
+			code := r.Header.Get("X-TOTP-Code")
+			if fromForm {
+				code = r.FormValue("code")
+			}
+			if code == "" || !checkTOTP(cfg, string(fields[0]), code) {
+				time.Sleep(time.Duration(rand.Intn(100)+100) * time.Millisecond)
+				totpForm(w, code != "")
+				return
+			}
 		}
 
-		sessionid := randomString(32)
-		sessionsMut.Lock()
-		sessions[sessionid] = true
-		sessionsMut.Unlock()
-		http.SetCookie(w, &http.Cookie{
-			Name:   "sessionid",
-			Value:  sessionid,
-			MaxAge: 0,
-		})
+		newSession(w, r, cfg, string(fields[0]))
+
+		if fromForm {
+			http.Redirect(w, r, "./", http.StatusSeeOther)
+			return
+		}
 
+		logAPIRequest(r, "user", string(fields[0]))
 		next.ServeHTTP(w, r)
 	})
 }
+
+// authenticate checks the user name and password of a login.
+func authenticate(cfg config.GUIConfiguration, user, password string) bool {
+	if cfg.AuthMode == "ldap" {
+		if err := ldapAuthenticate(cfg.LDAP, user, password); err != nil {
+			l.Infof("LDAP login for %q failed: %v", user, err)
+			return false
+		}
+		return true
+	}
+
+	if user != cfg.User {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(cfg.Password), []byte(password)) == nil
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+func TestLookupAPIKey(t *testing.T) {
+	gui := config.GUIConfiguration{
+		APIKey:       "abc123",
+		ExtraAPIKeys: []config.APIKeyConfiguration{{Key: "def456", ReadOnly: true}, {Key: config.HashAPIKey("ghi789")}},
+	}
+
+	cases := []struct {
+		name, value string
+		ok          bool
+		readOnly    bool
+	}{
+		{"X-API-Key", "abc123", true, false},
+		{"X-API-Key", "abc", false, false},
+		{"X-API-Key", "def456", true, true},
+		{"Authorization", "Bearer abc123", true, false},
+		{"Authorization", "Bearer def456", true, true},
+		{"X-API-Key", "ghi789", true, false},
+		{"X-API-Key", config.HashAPIKey("ghi789"), false, false},
+		{"Authorization", "Bearer abc", false, false},
+		{"Authorization", "Basic abc123", false, false},
+		{"", "", false, false},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", "/metrics", nil)
+		if tc.name != "" {
+			r.Header.Set(tc.name, tc.value)
+		}
+		key, ok := lookupAPIKey(r, gui)
+		if ok != tc.ok || key.ReadOnly != tc.readOnly {
+			t.Errorf("%s: %q: got %v, %v, expected %v, %v", tc.name, tc.value, ok, key.ReadOnly, tc.ok, tc.readOnly)
+		}
+	}
+
+	// Without a main key, no key is accepted.
+
+	r, _ := http.NewRequest("GET", "/metrics", nil)
+	if _, ok := lookupAPIKey(r, config.GUIConfiguration{}); ok {
+		t.Error("Accepted a request without key")
+	}
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	gui := config.GUIConfiguration{
+		APIKey:       "abc123",
+		ExtraAPIKeys: []config.APIKeyConfiguration{{Key: "def456", Label: "dashboard", ReadOnly: true}},
+	}
+	h := apiKeyMiddleware(gui, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	sub := events.Default.Subscribe(events.APIRequest)
+	defer events.Default.Unsubscribe(sub)
+
+	cases := []struct {
+		key, method, path string
+		status            int
+	}{
+		{"abc123", "POST", "/rest/system/restart", http.StatusOK},
+		{"abc123", "GET", "/rest/system/config", http.StatusOK},
+		{"def456", "GET", "/rest/system/status", http.StatusOK},
+		{"def456", "GET", "/metrics", http.StatusOK},
+		{"def456", "POST", "/rest/system/restart", http.StatusForbidden},
+		{"def456", "DELETE", "/rest/config/folders/default", http.StatusForbidden},
+		{"def456", "GET", "/rest/system/config", http.StatusForbidden},
+		{"def456", "GET", "/rest/v2/folders/default", http.StatusOK},
+		{"def456", "GET", "/rest/config/folders/default", http.StatusForbidden},
+		{"def456", "GET", "/rest/db/export", http.StatusForbidden},
+		{"def456", "GET", "/rest/system/sessions", http.StatusForbidden},
+		{"def456", "GET", "/rest/config/history", http.StatusForbidden},
+		{"def456", "GET", "/rest/config/history/diff", http.StatusForbidden},
+		{"def456", "GET", "/rest/some/new/endpoint", http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest(tc.method, tc.path, nil)
+		r.Header.Set("X-API-Key", tc.key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s %s %s: got status %d, expected %d", tc.key, tc.method, tc.path, w.Code, tc.status)
+		}
+	}
+	// The requests that changed something are in the audit log, under the
+	// label of the key.
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := ev.Data.(map[string]string); data["key"] != "main" || data["method"] != "POST" || data["path"] != "/rest/system/restart" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	if ev, err := sub.Poll(100 * time.Millisecond); err != events.ErrTimeout {
+		t.Errorf("Unexpected event %v for a refused request", ev)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// clientCertVerifier decides whether the client certificate of a request is
+// trusted, either by CA or by fingerprint.
+type clientCertVerifier struct {
+	roots        *x509.CertPool
+	fingerprints map[string]bool
+}
+
+// newClientCertVerifier returns a verifier for the configured CAs and
+// fingerprints. On error the verifier is still usable, trusting whatever
+// was loaded before the error.
+func newClientCertVerifier(cfg config.GUIConfiguration) (*clientCertVerifier, error) {
+	v := &clientCertVerifier{fingerprints: make(map[string]bool)}
+	for _, fp := range cfg.ClientCertFingerprints {
+		v.fingerprints[normalizeFingerprint(fp)] = true
+	}
+
+	if cfg.ClientCAFile == "" {
+		return v, nil
+	}
+	bs, err := ioutil.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return v, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bs) {
+		return v, errors.New("no certificates in " + cfg.ClientCAFile)
+	}
+	v.roots = roots
+	return v, nil
+}
+
+func (v *clientCertVerifier) trusted(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := r.TLS.PeerCertificates[0]
+
+	sum := sha256.Sum256(cert.Raw)
+	if v.fingerprints[hex.EncodeToString(sum[:])] {
+		return true
+	}
+
+	if v.roots == nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// normalizeFingerprint accepts fingerprints in upper or lower case, with or
+// without colons between the bytes.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fp), ":", "", -1))
+}
+
+// clientCertMiddleware passes requests with a trusted client certificate on
+// to the unauthenticated handler when certificates are accepted instead of a
+// password, and to the authenticated one when they are required on top of
+// it. Without a trusted certificate, requests are refused when one is
+// required and need the usual authentication otherwise.
+func clientCertMiddleware(require bool, v *clientCertVerifier, authed, unauthed http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trusted := v.trusted(r)
+		switch {
+		case trusted && require:
+			authed.ServeHTTP(w, r)
+		case trusted:
+			unauthed.ServeHTTP(w, r)
+		case require:
+			if debugHTTP.Enabled() {
+				l.Debugln("Refused request without a trusted client certificate from", r.RemoteAddr)
+			}
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+		default:
+			authed.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestClientCertMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var certs []*x509.Certificate
+	for _, name := range []string{"trusted", "other"} {
+		cert, err := newCertificate(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key"), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, parsed)
+	}
+	trusted, other := certs[0], certs[1]
+
+	sum := sha256.Sum256(trusted.Raw)
+	var fp []string
+	for _, b := range sum {
+		fp = append(fp, fmt.Sprintf("%02X", b))
+	}
+
+	verifiers := map[string]config.GUIConfiguration{
+		"fingerprint": {ClientCertFingerprints: []string{strings.Join(fp, ":")}},
+		"ca":          {ClientCAFile: filepath.Join(dir, "trusted.pem")},
+	}
+	for name, cfg := range verifiers {
+		v, err := newClientCertVerifier(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, require := range []bool{false, true} {
+			var reached string
+			h := clientCertMiddleware(require, v,
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = "authed" }),
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = "unauthed" }))
+
+			cases := []struct {
+				cert     *x509.Certificate
+				expected string
+			}{
+				{trusted, "unauthed"},
+				{other, "authed"},
+				{nil, "authed"},
+			}
+			if require {
+				cases[0].expected = "authed"
+				cases[1].expected = ""
+				cases[2].expected = ""
+			}
+
+			for _, tc := range cases {
+				reached = ""
+				r, _ := http.NewRequest("GET", "/rest/system/status", nil)
+				if tc.cert != nil {
+					r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}}
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if reached != tc.expected || reached == "" && w.Code != http.StatusForbidden {
+					t.Errorf("%s, require %v: reached %q (%d), expected %q", name, require, reached, w.Code, tc.expected)
+				}
+			}
+		}
+	}
+
+	if _, err := newClientCertVerifier(config.GUIConfiguration{ClientCAFile: filepath.Join(dir, "trusted.key")}); err == nil {
+		t.Error("No error for a CA file without certificates")
+	}
+}
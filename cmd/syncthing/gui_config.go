@@ -0,0 +1,795 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/merge"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/versioner"
+)
+
+// Folders and devices can be handled one by one, instead of posting back the
+// entire configuration, which would undo changes made in the meantime.
+//
+//   GET    /rest/config/folders/         all folders
+//   GET    /rest/config/folders/<id>     one folder
+//   PUT    /rest/config/folders/<id>     adds or replaces the folder
+//   PATCH  /rest/config/folders/<id>     changes the given fields of the folder
+//   DELETE /rest/config/folders/<id>     removes the folder
+//
+// and likewise for /rest/config/devices/. Invalid changes are refused with
+// 400 Bad Request and the reason in the response body.
+//
+//   POST   /rest/config/validate         checks the posted configuration
+//
+// answers with {"valid": ..., "errors": [{"path": ..., "message": ...}]}
+// without applying anything. The path points into the configuration, as in
+// folders[default].versioning.params.keep, and is empty for problems that
+// don't belong to any one part of it.
+//
+//   POST   /rest/config/transaction      applies a list of operations
+//   POST   /rest/config/rollback         undoes the last transaction
+//   POST   /rest/config/rollback?version=<version>
+//                                        returns to a version in the history
+//
+// A transaction is {"operations": [...]}, each operation being one of
+//
+//   {"op": "putFolder", "folder": {...}}
+//   {"op": "patchFolder", "id": <folder>, "folder": {...}}
+//   {"op": "deleteFolder", "id": <folder>}
+//   {"op": "shareFolder", "id": <folder>, "deviceID": <device>}
+//   {"op": "unshareFolder", "id": <folder>, "deviceID": <device>}
+//
+// and likewise putDevice, patchDevice and deleteDevice. The operations are
+// applied in order to the configuration as it is, and the result is only
+// put in place when all of them succeed and it validates; otherwise the
+// answer is 400 Bad Request with the errors as above. Once the change is
+// accepted the config file is backed up, for the rollback to restore. The
+// rollback is refused with 409 Conflict when the configuration was changed
+// again since the transaction.
+//
+// The history of the config file, the versions saved last:
+//
+//   GET    /rest/config/history          the versions, the latest first
+//   GET    /rest/config/history/diff?version=<version>[&against=<version>]
+//                                        the changes in the version, from the
+//                                        one before it unless given
+//
+// Changes to the sections listed as locked in the GUI configuration are
+// refused with 403 Forbidden, here and wherever else the API changes the
+// configuration.
+
+func (s *apiSvc) configFolder(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	id := strings.TrimPrefix(r.URL.Path, "/rest/config/folders/")
+	cur, exists := cfg.Folders()[id]
+
+	switch {
+	case r.Method == "GET" && id == "":
+		var folders []config.FolderConfiguration
+		for _, fcfg := range cfg.Folders() {
+			folders = append(folders, fcfg)
+		}
+		sort.Sort(foldersByID(folders))
+		writeConfigJSON(w, http.StatusOK, folders)
+
+	case id == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	case r.Method == "GET":
+		if !exists {
+			http.Error(w, "No such folder", http.StatusNotFound)
+			return
+		}
+		writeConfigJSON(w, http.StatusOK, cur)
+
+	case r.Method == "PUT" || r.Method == "PATCH":
+		if refuseLocked(w, "folders") {
+			return
+		}
+		var fcfg config.FolderConfiguration
+		if r.Method == "PATCH" {
+			if !exists {
+				http.Error(w, "No such folder", http.StatusNotFound)
+				return
+			}
+			// Decoding into a copy, as the current slices are shared with
+			// the running configuration.
+			bs, _ := json.Marshal(cur)
+			json.Unmarshal(bs, &fcfg)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&fcfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if fcfg.ID == "" {
+			fcfg.ID = id
+		}
+		fcfg.Invalid = ""
+		if err := validateFolder(fcfg, id, cfg.Devices()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !commitConfig(w, r, cfg.SetFolder(fcfg)) {
+			return
+		}
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		writeConfigJSON(w, status, cfg.Folders()[id])
+
+	case r.Method == "DELETE":
+		if refuseLocked(w, "folders") {
+			return
+		}
+		resp, ok := cfg.RemoveFolder(id)
+		if !ok {
+			http.Error(w, "No such folder", http.StatusNotFound)
+			return
+		}
+		commitConfig(w, r, resp)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *apiSvc) configDevice(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	str := strings.TrimPrefix(r.URL.Path, "/rest/config/devices/")
+	if r.Method == "GET" && str == "" {
+		writeConfigJSON(w, http.StatusOK, cfg.Raw().Devices)
+		return
+	}
+	id, err := protocol.DeviceIDFromString(str)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cur, exists := cfg.Devices()[id]
+
+	switch r.Method {
+	case "GET":
+		if !exists {
+			http.Error(w, "No such device", http.StatusNotFound)
+			return
+		}
+		writeConfigJSON(w, http.StatusOK, cur)
+
+	case "PUT", "PATCH":
+		if refuseLocked(w, "devices") {
+			return
+		}
+		var dcfg config.DeviceConfiguration
+		if r.Method == "PATCH" {
+			if !exists {
+				http.Error(w, "No such device", http.StatusNotFound)
+				return
+			}
+			bs, _ := json.Marshal(cur)
+			json.Unmarshal(bs, &dcfg)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&dcfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if dcfg.DeviceID == (protocol.DeviceID{}) {
+			dcfg.DeviceID = id
+		}
+		if len(dcfg.Addresses) == 0 {
+			dcfg.Addresses = []string{"dynamic"}
+		}
+		if err := validateDevice(dcfg, id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !commitConfig(w, r, cfg.SetDevice(dcfg)) {
+			return
+		}
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		writeConfigJSON(w, status, cfg.Devices()[id])
+
+	case "DELETE":
+		if refuseLocked(w, "devices") {
+			return
+		}
+		if id == myID {
+			http.Error(w, "Cannot remove this device", http.StatusBadRequest)
+			return
+		}
+		resp, ok := cfg.RemoveDevice(id)
+		if !ok {
+			http.Error(w, "No such device", http.StatusNotFound)
+			return
+		}
+		commitConfig(w, r, resp)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateFolder returns why the folder can't be set at the given ID, among
+// the given devices, or nil.
+func validateFolder(fcfg config.FolderConfiguration, id string, devices map[protocol.DeviceID]config.DeviceConfiguration) error {
+	if fcfg.ID != id {
+		return fmt.Errorf("folder ID %q doesn't match the URL", fcfg.ID)
+	}
+	if fcfg.RawPath == "" {
+		return errors.New("no directory configured")
+	}
+	if fcfg.ReadOnly && fcfg.ReceiveOnly {
+		return errors.New("a folder can't be both read only and receive only")
+	}
+	if fcfg.RescanIntervalS < 0 {
+		return errors.New("negative rescan interval")
+	}
+	for _, dev := range fcfg.Devices {
+		if _, ok := devices[dev.DeviceID]; !ok {
+			return fmt.Errorf("unknown device %s", dev.DeviceID)
+		}
+	}
+	return nil
+}
+
+// validateDevice returns why the device can't be set at the given ID, or nil.
+func validateDevice(dcfg config.DeviceConfiguration, id protocol.DeviceID) error {
+	if dcfg.DeviceID != id {
+		return fmt.Errorf("device ID %s doesn't match the URL", dcfg.DeviceID)
+	}
+	for _, cidr := range dcfg.AllowedNets {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("allowed network %q: %v", cidr, err)
+		}
+	}
+	if dcfg.Connections < 0 {
+		return errors.New("negative number of connections")
+	}
+	return nil
+}
+
+// A configProblem is one thing wrong with a posted configuration.
+type configProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// The versioning parameters that must be whole numbers, by versioner.
+var versioningNumbers = map[string][]string{
+	"simple":    {"keep"},
+	"staggered": {"maxAge", "cleanInterval"},
+	"trashcan":  {"cleanoutDays"},
+}
+
+func (s *apiSvc) postConfigValidate(w http.ResponseWriter, r *http.Request) {
+	var to config.Configuration
+	if err := json.NewDecoder(r.Body).Decode(&to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	problems := validateConfig(to)
+	if len(problems) == 0 {
+		// The running services have their say too.
+		if err := cfg.Verify(to); err != nil {
+			problems = append(problems, configProblem{"", err.Error()})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":  len(problems) == 0,
+		"errors": problems,
+	})
+}
+
+// validateConfig returns what's wrong with the configuration, in the order
+// the folders and devices are given.
+func validateConfig(to config.Configuration) []configProblem {
+	problems := []configProblem{}
+	add := func(path, format string, args ...interface{}) {
+		problems = append(problems, configProblem{path, fmt.Sprintf(format, args...)})
+	}
+
+	devices := make(map[protocol.DeviceID]config.DeviceConfiguration)
+	for _, dcfg := range to.Devices {
+		path := fmt.Sprintf("devices[%s]", dcfg.DeviceID)
+		if _, ok := devices[dcfg.DeviceID]; ok {
+			add(path, "duplicate device ID")
+		}
+		devices[dcfg.DeviceID] = dcfg
+		if err := validateDevice(dcfg, dcfg.DeviceID); err != nil {
+			add(path, "%v", err)
+		}
+	}
+
+	folderIDs := make(map[string]bool)
+	folderPaths := make(map[string]string) // folder ID by cleaned path
+	for _, fcfg := range to.Folders {
+		path := fmt.Sprintf("folders[%s]", fcfg.ID)
+		if fcfg.ID == "" {
+			add(path+".id", "no folder ID")
+		} else if folderIDs[fcfg.ID] {
+			add(path+".id", "duplicate folder ID")
+		}
+		folderIDs[fcfg.ID] = true
+		if err := validateFolder(fcfg, fcfg.ID, devices); err != nil {
+			add(path, "%v", err)
+		}
+
+		if fcfg.RawPath != "" {
+			dir := filepath.Clean(fcfg.Path())
+			for other, otherID := range folderPaths {
+				switch {
+				case other == dir:
+					add(path+".path", "same directory as folder %q", otherID)
+				case strings.HasPrefix(dir, other+string(filepath.Separator)):
+					add(path+".path", "inside the directory of folder %q", otherID)
+				case strings.HasPrefix(other, dir+string(filepath.Separator)):
+					add(path+".path", "contains the directory of folder %q", otherID)
+				}
+			}
+			folderPaths[dir] = fcfg.ID
+		}
+
+		vers := fcfg.Versioning
+		if vers.Type == "" {
+			continue
+		}
+		if _, ok := versioner.Factories[vers.Type]; !ok {
+			add(path+".versioning.type", "unknown versioning type %q", vers.Type)
+			continue
+		}
+		for _, param := range versioningNumbers[vers.Type] {
+			if v, ok := vers.Params[param]; ok {
+				if n, err := strconv.Atoi(v); err != nil || n < 0 {
+					add(path+".versioning.params."+param, "%q is not a whole number", v)
+				}
+			}
+		}
+		if vers.Type == "external" && strings.TrimSpace(vers.Params["command"]) == "" {
+			add(path+".versioning.params.command", "no command given")
+		}
+	}
+
+	return problems
+}
+
+// A configOperation is one change in a transaction.
+type configOperation struct {
+	Op       string          `json:"op"`
+	ID       string          `json:"id"`       // Of the folder or device
+	DeviceID string          `json:"deviceID"` // To share the folder with
+	Folder   json.RawMessage `json:"folder"`
+	Device   json.RawMessage `json:"device"`
+}
+
+var errConfigProblems = errors.New("invalid configuration")
+
+// configBackupPath returns where the configuration before the last
+// transaction is kept.
+func configBackupPath() string {
+	return cfg.ConfigPath() + ".pre-transaction"
+}
+
+func (s *apiSvc) postTransaction(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	var tx struct {
+		Operations []configOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var problems []configProblem
+	resp, err := cfg.Update(func(to *config.Configuration) error {
+		from := to.Copy()
+		for i, op := range tx.Operations {
+			if err := applyConfigOperation(to, op); err != nil {
+				problems = append(problems, configProblem{fmt.Sprintf("operations[%d]", i), err.Error()})
+			}
+		}
+		if len(problems) == 0 {
+			problems = validateConfig(*to)
+		}
+		if len(problems) > 0 {
+			return errConfigProblems
+		}
+		return checkConfigLock(from, *to)
+	})
+	if err == nil && resp.ValidationError != nil {
+		problems = []configProblem{{"", resp.ValidationError.Error()}}
+		err = errConfigProblems
+	}
+	if _, ok := err.(configLockedError); ok {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	switch err {
+	case nil:
+		if resp.RequiresRestart {
+			configInSync = false
+		}
+		// The config file is still as it was before the transaction.
+		backup := configBackupPath()
+		if err := osutil.Copy(cfg.ConfigPath(), backup); err != nil {
+			l.Warnln("Backing up the configuration:", err)
+			os.Remove(backup)
+			backup = ""
+		}
+		cfg.SaveBy(requestActor(r))
+		raw := cfg.Raw()
+		s.transactionCfg = &raw
+		l.Infof("Configuration transaction of %d operations applied", len(tx.Operations))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"backup":          backup,
+			"requiresRestart": resp.RequiresRestart,
+		})
+	case errConfigProblems:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": problems})
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *apiSvc) postConfigRollback(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	if version := r.URL.Query().Get("version"); version != "" {
+		s.rollbackToVersion(w, r, version)
+		return
+	}
+
+	if s.transactionCfg == nil {
+		http.Error(w, "No transaction to roll back", http.StatusNotFound)
+		return
+	}
+	if !reflect.DeepEqual(cfg.Raw(), *s.transactionCfg) {
+		http.Error(w, "The configuration was changed since the transaction", http.StatusConflict)
+		return
+	}
+	backup, err := config.Load(configBackupPath(), myID)
+	if os.IsNotExist(err) {
+		http.Error(w, "No transaction to roll back", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := checkConfigLock(cfg.Raw(), backup.Raw()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if commitConfig(w, r, cfg.Replace(backup.Raw())) {
+		s.transactionCfg = nil
+		l.Infoln("Configuration rolled back to before the last transaction")
+	}
+}
+
+func (s *apiSvc) rollbackToVersion(w http.ResponseWriter, r *http.Request, version string) {
+	if _, err := cfg.HistoryFile(version); err != nil {
+		http.Error(w, "No such version", http.StatusNotFound)
+		return
+	}
+	to, err := cfg.HistoryConfig(version, myID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := checkConfigLock(cfg.Raw(), to); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if commitConfig(w, r, cfg.Replace(to)) {
+		l.Infof("Configuration rolled back to the version of %s", version)
+	}
+}
+
+func (s *apiSvc) getConfigHistory(w http.ResponseWriter, r *http.Request) {
+	versions, err := cfg.History()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		versions = []config.HistoryVersion{}
+	}
+	writeConfigJSON(w, http.StatusOK, versions)
+}
+
+func (s *apiSvc) getConfigDiff(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	version, against := qs.Get("version"), qs.Get("against")
+
+	to, err := cfg.HistoryFile(version)
+	if err != nil {
+		http.Error(w, "No such version", http.StatusNotFound)
+		return
+	}
+	if against == "" {
+		// The version before, if there is one; otherwise everything in the
+		// version is new.
+		versions, _ := cfg.History()
+		for i, v := range versions {
+			if v.Version == version && i+1 < len(versions) {
+				against = versions[i+1].Version
+			}
+		}
+	}
+	var from []byte
+	if against != "" {
+		if from, err = cfg.HistoryFile(against); err != nil {
+			http.Error(w, "No such version", http.StatusNotFound)
+			return
+		}
+	}
+
+	diff, ok := merge.Diff(from, to)
+	if !ok {
+		http.Error(w, "The versions are too large to compare", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "--- %s\n+++ %s\n%s", against, version, diff)
+}
+
+// applyConfigOperation makes the change of the operation to the
+// configuration.
+func applyConfigOperation(to *config.Configuration, op configOperation) error {
+	folderIdx := -1
+	for i, fcfg := range to.Folders {
+		if fcfg.ID == op.ID {
+			folderIdx = i
+		}
+	}
+	deviceIdx := -1
+	device, deviceErr := protocol.DeviceIDFromString(op.ID)
+	for i, dcfg := range to.Devices {
+		if deviceErr == nil && dcfg.DeviceID == device {
+			deviceIdx = i
+		}
+	}
+
+	switch op.Op {
+	case "putFolder", "patchFolder":
+		var fcfg config.FolderConfiguration
+		if op.Op == "patchFolder" {
+			if folderIdx < 0 {
+				return fmt.Errorf("no folder %q", op.ID)
+			}
+			bs, _ := json.Marshal(to.Folders[folderIdx])
+			json.Unmarshal(bs, &fcfg)
+		}
+		if err := json.Unmarshal(op.Folder, &fcfg); err != nil {
+			return err
+		}
+		if op.Op == "patchFolder" && fcfg.ID != op.ID {
+			return errors.New("the folder ID can't be changed")
+		}
+		fcfg.Invalid = ""
+		for i := range to.Folders {
+			if to.Folders[i].ID == fcfg.ID {
+				to.Folders[i] = fcfg
+				return nil
+			}
+		}
+		to.Folders = append(to.Folders, fcfg)
+
+	case "deleteFolder":
+		if folderIdx < 0 {
+			return fmt.Errorf("no folder %q", op.ID)
+		}
+		to.Folders = append(to.Folders[:folderIdx], to.Folders[folderIdx+1:]...)
+
+	case "shareFolder", "unshareFolder":
+		if folderIdx < 0 {
+			return fmt.Errorf("no folder %q", op.ID)
+		}
+		id, err := protocol.DeviceIDFromString(op.DeviceID)
+		if err != nil {
+			return err
+		}
+		fcfg := &to.Folders[folderIdx]
+		var devices []config.FolderDeviceConfiguration
+		for _, dev := range fcfg.Devices {
+			if dev.DeviceID != id {
+				devices = append(devices, dev)
+			}
+		}
+		if op.Op == "shareFolder" {
+			devices = append(devices, config.FolderDeviceConfiguration{DeviceID: id})
+		}
+		fcfg.Devices = devices
+
+	case "putDevice", "patchDevice":
+		var dcfg config.DeviceConfiguration
+		if op.Op == "patchDevice" {
+			if deviceIdx < 0 {
+				return fmt.Errorf("no device %q", op.ID)
+			}
+			bs, _ := json.Marshal(to.Devices[deviceIdx])
+			json.Unmarshal(bs, &dcfg)
+		}
+		if err := json.Unmarshal(op.Device, &dcfg); err != nil {
+			return err
+		}
+		if op.Op == "patchDevice" && dcfg.DeviceID != device {
+			return errors.New("the device ID can't be changed")
+		}
+		if len(dcfg.Addresses) == 0 {
+			dcfg.Addresses = []string{"dynamic"}
+		}
+		for i := range to.Devices {
+			if to.Devices[i].DeviceID == dcfg.DeviceID {
+				to.Devices[i] = dcfg
+				return nil
+			}
+		}
+		to.Devices = append(to.Devices, dcfg)
+
+	case "deleteDevice":
+		if deviceIdx < 0 {
+			return fmt.Errorf("no device %q", op.ID)
+		}
+		if device == myID {
+			return errors.New("cannot remove this device")
+		}
+		to.Devices = append(to.Devices[:deviceIdx], to.Devices[deviceIdx+1:]...)
+		for i := range to.Folders {
+			var devices []config.FolderDeviceConfiguration
+			for _, dev := range to.Folders[i].Devices {
+				if dev.DeviceID != device {
+					devices = append(devices, dev)
+				}
+			}
+			to.Folders[i].Devices = devices
+		}
+
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	return nil
+}
+
+// configLockedError is the error for changes to a locked section of the
+// configuration.
+type configLockedError string
+
+func (e configLockedError) Error() string {
+	if e == "lock" {
+		return "The configuration lock can only be changed in the config file"
+	}
+	return fmt.Sprintf("The %s configuration is locked", string(e))
+}
+
+// checkConfigLock returns a configLockedError if the change from one
+// configuration to the other touches a section that is locked in the
+// former, or changes the lock itself.
+func checkConfigLock(from, to config.Configuration) error {
+	if !reflect.DeepEqual(from.GUI.LockedSections, to.GUI.LockedSections) {
+		return configLockedError("lock")
+	}
+	sections := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"folders", from.Folders, to.Folders},
+		{"devices", from.Devices, to.Devices},
+		{"options", from.Options, to.Options},
+		{"gui", from.GUI, to.GUI},
+		{"all", from.IgnoredDevices, to.IgnoredDevices},
+	}
+	for _, s := range sections {
+		if !from.GUI.IsLocked(s.name) {
+			continue
+		}
+		if !reflect.DeepEqual(asShown(s.from), asShown(s.to)) {
+			return configLockedError(s.name)
+		}
+	}
+	return nil
+}
+
+// asShown returns the value as the API shows it, which leaves out what's
+// only kept at runtime, without empty lists and objects, which may as well
+// be missing.
+func asShown(v interface{}) interface{} {
+	bs, _ := json.Marshal(v)
+	var shown interface{}
+	json.Unmarshal(bs, &shown)
+	return withoutEmpty(shown)
+}
+
+func withoutEmpty(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if val = withoutEmpty(val); val == nil {
+				delete(v, key)
+			} else {
+				v[key] = val
+			}
+		}
+		if len(v) == 0 {
+			return nil
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = withoutEmpty(v[i])
+		}
+		if len(v) == 0 {
+			return nil
+		}
+	}
+	return v
+}
+
+// refuseLocked answers 403 Forbidden, and returns true, if the section of
+// the configuration is locked.
+func refuseLocked(w http.ResponseWriter, section string) bool {
+	if !cfg.GUI().IsLocked(section) {
+		return false
+	}
+	http.Error(w, configLockedError(section).Error(), http.StatusForbidden)
+	return true
+}
+
+// commitConfig saves the configuration after a change made by the request,
+// or responds with why the change was refused. It returns whether the change
+// was made.
+func commitConfig(w http.ResponseWriter, r *http.Request, resp config.CommitResponse) bool {
+	if resp.ValidationError != nil {
+		http.Error(w, resp.ValidationError.Error(), http.StatusBadRequest)
+		return false
+	}
+	if resp.RequiresRestart {
+		configInSync = false
+	}
+	cfg.SaveBy(requestActor(r))
+	return true
+}
+
+func writeConfigJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type foldersByID []config.FolderConfiguration
+
+func (f foldersByID) Len() int           { return len(f) }
+func (f foldersByID) Less(a, b int) bool { return f[a].ID < f[b].ID }
+func (f foldersByID) Swap(a, b int)      { f[a], f[b] = f[b], f[a] }
@@ -0,0 +1,340 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+func TestConfigFolderDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ")
+	device2, _ := protocol.DeviceIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
+	oldCfg, oldID := cfg, myID
+	defer func() { cfg, myID = oldCfg, oldID }()
+	myID = device1
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	s := &apiSvc{systemConfigMut: sync.NewMutex()}
+	request := func(h http.HandlerFunc, method, path, body string) (int, string) {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	folderPath := "/rest/config/folders/default"
+	devicePath := "/rest/config/devices/" + device2.String()
+
+	// The folder can't be shared with a device that isn't configured.
+
+	body := `{"path": "/tmp/default", "devices": [{"deviceID": "` + device2.String() + `"}]}`
+	if code, resp := request(s.configFolder, "PUT", folderPath, body); code != http.StatusBadRequest || !strings.Contains(resp, "unknown device") {
+		t.Errorf("Unexpected response %d %q for an unknown device", code, resp)
+	}
+
+	if code, _ := request(s.configDevice, "PUT", devicePath, `{"name": "two"}`); code != http.StatusCreated {
+		t.Errorf("Unexpected status %d adding the device", code)
+	}
+	if code, _ := request(s.configFolder, "PUT", folderPath, body); code != http.StatusCreated {
+		t.Errorf("Unexpected status %d adding the folder", code)
+	}
+
+	// A patch changes the given fields only.
+
+	if code, _ := request(s.configFolder, "PATCH", folderPath, `{"rescanIntervalS": 120}`); code != http.StatusOK {
+		t.Errorf("Unexpected status %d patching the folder", code)
+	}
+	fcfg := cfg.Folders()["default"]
+	if fcfg.RescanIntervalS != 120 || fcfg.RawPath != "/tmp/default" || len(fcfg.Devices) != 1 {
+		t.Errorf("Incorrect folder %+v after patch", fcfg)
+	}
+
+	if code, _ := request(s.configFolder, "PATCH", folderPath, `{"readOnly": true, "receiveOnly": true}`); code != http.StatusBadRequest {
+		t.Errorf("Unexpected status %d for an invalid folder", code)
+	}
+	if code, _ := request(s.configFolder, "PATCH", folderPath, `{"id": "other"}`); code != http.StatusBadRequest {
+		t.Errorf("Unexpected status %d for a mismatched ID", code)
+	}
+
+	// Removing the device stops sharing the folder with it.
+
+	if code, _ := request(s.configDevice, "DELETE", devicePath, ""); code != http.StatusOK {
+		t.Errorf("Unexpected status %d removing the device", code)
+	}
+	if devs := cfg.Folders()["default"].Devices; len(devs) != 0 {
+		t.Errorf("Folder still shared with %v", devs)
+	}
+	if code, _ := request(s.configDevice, "GET", devicePath, ""); code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d for a removed device", code)
+	}
+	if code, _ := request(s.configDevice, "DELETE", "/rest/config/devices/"+device1.String(), ""); code != http.StatusBadRequest {
+		t.Errorf("Unexpected status %d removing this device", code)
+	}
+
+	if code, _ := request(s.configFolder, "DELETE", folderPath, ""); code != http.StatusOK {
+		t.Errorf("Unexpected status %d removing the folder", code)
+	}
+	if code, _ := request(s.configFolder, "DELETE", folderPath, ""); code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d removing the folder again", code)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ")
+	device2, _ := protocol.DeviceIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = config.Wrap("/tmp/test", config.Configuration{})
+
+	body := `{
+		"devices": [{"deviceID": "` + device1.String() + `"}, {"deviceID": "` + device1.String() + `"}],
+		"folders": [
+			{"id": "a", "path": "/tmp/a", "devices": [{"deviceID": "` + device1.String() + `"}]},
+			{"id": "b", "path": "/tmp/a/b"},
+			{"id": "a", "path": "/tmp/c", "versioning": {"type": "simple", "params": {"keep": "many"}}},
+			{"id": "d", "path": "/tmp/d", "devices": [{"deviceID": "` + device2.String() + `"}], "versioning": {"type": "external"}},
+			{"id": "e", "path": "/tmp/e", "versioning": {"type": "magic"}}
+		]
+	}`
+	r, _ := http.NewRequest("POST", "/rest/config/validate", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	(&apiSvc{}).postConfigValidate(w, r)
+
+	var resp struct {
+		Valid  bool
+		Errors []configProblem
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"devices[" + device1.String() + "]",
+		"folders[b].path",
+		"folders[a].id",
+		"folders[a].versioning.params.keep",
+		"folders[d]",
+		"folders[d].versioning.params.command",
+		"folders[e].versioning.type",
+	}
+	if resp.Valid || len(resp.Errors) != len(expected) {
+		t.Fatalf("Incorrect problems %+v", resp)
+	}
+	for i, path := range expected {
+		if resp.Errors[i].Path != path {
+			t.Errorf("Problem %d at %q, expected %q: %s", i, resp.Errors[i].Path, path, resp.Errors[i].Message)
+		}
+	}
+
+	r, _ = http.NewRequest("POST", "/rest/config/validate", strings.NewReader(`{"folders": [{"id": "a", "path": "/tmp/a"}]}`))
+	w = httptest.NewRecorder()
+	(&apiSvc{}).postConfigValidate(w, r)
+	if !strings.Contains(w.Body.String(), `"valid":true`) {
+		t.Errorf("Valid config not accepted: %s", w.Body.String())
+	}
+}
+
+func TestConfigTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ")
+	device2, _ := protocol.DeviceIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
+	oldCfg, oldID := cfg, myID
+	defer func() { cfg, myID = oldCfg, oldID }()
+	myID = device1
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Version: config.CurrentVersion,
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+		Folders: []config.FolderConfiguration{{ID: "a", RawPath: "/tmp/a"}, {ID: "b", RawPath: "/tmp/b"}},
+	})
+	cfg.Save()
+
+	s := &apiSvc{systemConfigMut: sync.NewMutex()}
+	request := func(h http.HandlerFunc, body string) (int, string) {
+		r, _ := http.NewRequest("POST", "/rest/config/transaction", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code, w.Body.String()
+	}
+	shared := func(folder string) bool {
+		for _, dev := range cfg.Folders()[folder].Devices {
+			if dev.DeviceID == device2 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A failing operation leaves everything as it was.
+	body := `{"operations": [
+		{"op": "putDevice", "device": {"deviceID": "` + device2.String() + `", "name": "two"}},
+		{"op": "shareFolder", "id": "a", "deviceID": "` + device2.String() + `"},
+		{"op": "shareFolder", "id": "nonexistent", "deviceID": "` + device2.String() + `"}
+	]}`
+	if code, resp := request(s.postTransaction, body); code != http.StatusBadRequest || !strings.Contains(resp, "operations[2]") {
+		t.Errorf("Unexpected response %d %q for a failing transaction", code, resp)
+	}
+	if _, ok := cfg.Devices()[device2]; ok || shared("a") {
+		t.Error("Failing transaction partly applied")
+	}
+
+	body = strings.Replace(body, "nonexistent", "b", 1)
+	if code, resp := request(s.postTransaction, body); code != http.StatusOK {
+		t.Fatalf("Unexpected response %d %q", code, resp)
+	}
+	if cfg.Devices()[device2].Name != "two" || !shared("a") || !shared("b") {
+		t.Errorf("Transaction not applied, %+v", cfg.Raw())
+	}
+
+	if code, resp := request(s.postConfigRollback, ""); code != http.StatusOK {
+		t.Fatalf("Unexpected response %d %q rolling back", code, resp)
+	}
+	if _, ok := cfg.Devices()[device2]; ok || shared("a") || shared("b") {
+		t.Errorf("Transaction not rolled back, %+v", cfg.Raw())
+	}
+	if code, _ := request(s.postConfigRollback, ""); code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d rolling back twice", code)
+	}
+
+	// Not after another change.
+	if code, resp := request(s.postTransaction, body); code != http.StatusOK {
+		t.Fatalf("Unexpected response %d %q", code, resp)
+	}
+	dev := cfg.Devices()[device2]
+	dev.Name = "renamed"
+	cfg.SetDevice(dev)
+	if code, _ := request(s.postConfigRollback, ""); code != http.StatusConflict {
+		t.Errorf("Unexpected status %d rolling back after another change", code)
+	}
+	if cfg.Devices()[device2].Name != "renamed" {
+		t.Error("Rolled back over another change")
+	}
+}
+
+func TestConfigLock(t *testing.T) {
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ")
+	from := config.Configuration{
+		Folders: []config.FolderConfiguration{{ID: "default", RawPath: "/tmp/default"}},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+		GUI:     config.GUIConfiguration{LockedSections: []string{"folders"}},
+	}
+
+	to := from.Copy()
+	to.Devices[0].Name = "renamed"
+	if err := checkConfigLock(from, to); err != nil {
+		t.Errorf("Unlocked section refused: %v", err)
+	}
+	to = from.Copy()
+	to.Folders[0].RawPath = "/tmp/other"
+	if err := checkConfigLock(from, to); err != configLockedError("folders") {
+		t.Errorf("Unexpected error %v for a locked section", err)
+	}
+	to = from.Copy()
+	to.GUI.LockedSections = nil
+	if err := checkConfigLock(from, to); err != configLockedError("lock") {
+		t.Errorf("Unexpected error %v unlocking", err)
+	}
+	to = from.Copy()
+	to.IgnoredDevices = []protocol.DeviceID{device1}
+	if err := checkConfigLock(from, to); err != nil {
+		t.Errorf("Unexpected error %v for ignored devices", err)
+	}
+	from.GUI.LockedSections = []string{"all"}
+	to.GUI.LockedSections = []string{"all"}
+	if err := checkConfigLock(from, to); err != configLockedError("all") {
+		t.Errorf("Unexpected error %v for ignored devices with all locked", err)
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	from.GUI.LockedSections = []string{"folders"}
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), from)
+
+	s := &apiSvc{systemConfigMut: sync.NewMutex()}
+	r, _ := http.NewRequest("DELETE", "/rest/config/folders/default", nil)
+	w := httptest.NewRecorder()
+	s.configFolder(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status %d removing a folder while locked", w.Code)
+	}
+	if _, ok := cfg.Folders()["default"]; !ok {
+		t.Error("Folder removed while locked")
+	}
+}
+
+func TestConfigHistoryDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ")
+	oldCfg, oldID := cfg, myID
+	defer func() { cfg, myID = oldCfg, oldID }()
+	myID = device1
+	raw := config.New(device1)
+	raw.Devices = []config.DeviceConfiguration{{DeviceID: device1, Name: "before"}}
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), raw)
+	cfg.SetHistoryDir(filepath.Join(dir, "config.history"))
+	cfg.Save()
+	dev := cfg.Devices()[device1]
+	dev.Name = "after"
+	cfg.SetDevice(dev)
+	cfg.Save()
+
+	s := &apiSvc{systemConfigMut: sync.NewMutex()}
+	request := func(h http.HandlerFunc, method, path string) (int, string) {
+		r, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	var versions []config.HistoryVersion
+	code, body := request(s.getConfigHistory, "GET", "/rest/config/history")
+	if err := json.Unmarshal([]byte(body), &versions); code != http.StatusOK || err != nil || len(versions) != 2 {
+		t.Fatalf("Unexpected response %d %q", code, body)
+	}
+
+	code, body = request(s.getConfigDiff, "GET", "/rest/config/history/diff?version="+versions[0].Version)
+	if code != http.StatusOK || !strings.Contains(body, `-    <device id="`+device1.String()+`" name="before"`) || !strings.Contains(body, `name="after"`) {
+		t.Errorf("Unexpected diff %d %q", code, body)
+	}
+
+	code, _ = request(s.postConfigRollback, "POST", "/rest/config/rollback?version="+versions[1].Version)
+	if name := cfg.Devices()[device1].Name; code != http.StatusOK || name != "before" {
+		t.Errorf("Unexpected status %d and name %q after rollback", code, name)
+	}
+}
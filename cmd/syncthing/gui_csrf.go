@@ -14,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
 )
@@ -24,11 +25,11 @@ var csrfMut = sync.NewMutex()
 // Check for CSRF token on /rest/ URLs. If a correct one is not given, reject
 // the request with 403. For / and /index.html, set a new CSRF cookie if none
 // is currently set.
-func csrfMiddleware(prefix, apiKey string, next http.Handler) http.Handler {
+func csrfMiddleware(prefix string, cfg config.GUIConfiguration, next http.Handler) http.Handler {
 	loadCsrfTokens()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Allow requests carrying a valid API key
-		if apiKey != "" && r.Header.Get("X-API-Key") == apiKey {
+		if _, ok := lookupAPIKey(r, cfg); ok {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -40,6 +41,7 @@ func csrfMiddleware(prefix, apiKey string, next http.Handler) http.Handler {
 				cookie = &http.Cookie{
 					Name:  "CSRF-Token",
 					Value: newCsrfToken(),
+					Path:  cfg.URLBase() + "/",
 				}
 				http.SetCookie(w, cookie)
 			}
@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/ldap"
+)
+
+const ldapTimeout = 10 * time.Second
+
+// ldapAuthenticate binds to the LDAP server as the user, and checks that the
+// user is in the required group, if any.
+func ldapAuthenticate(cfg config.LDAPConfiguration, user, password string) error {
+	if cfg.Address == "" || !strings.Contains(cfg.BindDN, "%s") {
+		return errors.New("LDAP address or bind DN not configured")
+	}
+	if user == "" || password == "" {
+		return errors.New("empty user name or password")
+	}
+
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return err
+	}
+	tlsCfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	// Passwords only go over an unencrypted connection when that's asked
+	// for explicitly.
+	transport := cfg.Transport
+	if transport == "" {
+		transport = "starttls"
+	}
+
+	var conn *ldap.Conn
+	switch transport {
+	case "plain", "starttls":
+		conn, err = ldap.Dial(cfg.Address, nil, ldapTimeout)
+	case "tls":
+		conn, err = ldap.Dial(cfg.Address, tlsCfg, ldapTimeout)
+	default:
+		return fmt.Errorf("unknown LDAP transport %q", cfg.Transport)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	if transport == "starttls" {
+		if err := conn.StartTLS(tlsCfg); err != nil {
+			return err
+		}
+	}
+
+	dn := strings.Replace(cfg.BindDN, "%s", ldap.EscapeDN(user), -1)
+	if err := conn.Bind(dn, password); err != nil {
+		return err
+	}
+
+	if cfg.GroupDN == "" {
+		return nil
+	}
+	attr := cfg.GroupAttribute
+	if attr == "" {
+		attr = "member"
+	}
+	member, err := conn.Compare(cfg.GroupDN, attr, dn)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return fmt.Errorf("not a member of %s", cfg.GroupDN)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/model"
+)
+
+// getMetrics serves the state of the folders and connections in the
+// Prometheus text exposition format. Scrapers aren't browsers, so the API
+// key, read only or not, is required even when a session or password would
+// otherwise do.
+func (s *apiSvc) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if _, ok := lookupAPIKey(r, s.cfg); !ok {
+		http.Error(w, "Not Authorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p := &promWriter{w: w}
+
+	var folders []string
+	for id := range cfg.Folders() {
+		folders = append(folders, id)
+	}
+	sort.Strings(folders)
+
+	for _, folder := range folders {
+		state, _, _ := s.model.State(folder)
+		if state == "" {
+			state = "unknown"
+		}
+		p.sample("syncthing_folder_state", "gauge", "The current state of the folder.", 1, "folder", folder, "state", state)
+	}
+
+	// Walking the needed files is the expensive part, so it's done once per
+	// folder for both metrics.
+	needFiles := make([]int, len(folders))
+	needBytes := make([]int64, len(folders))
+	for i, folder := range folders {
+		needFiles[i], needBytes[i] = s.model.NeedSize(folder)
+	}
+	for i, folder := range folders {
+		p.sample("syncthing_folder_need_bytes", "gauge", "Bytes the folder needs to be in sync.", float64(needBytes[i]), "folder", folder)
+	}
+	for i, folder := range folders {
+		p.sample("syncthing_folder_need_files", "gauge", "Files the folder needs to be in sync.", float64(needFiles[i]), "folder", folder)
+	}
+	for _, folder := range folders {
+		_, _, bytes := s.model.GlobalSize(folder)
+		p.sample("syncthing_folder_global_bytes", "gauge", "Size of the newest version of the folder in the cluster.", float64(bytes), "folder", folder)
+	}
+	for _, folder := range folders {
+		_, _, bytes := s.model.LocalSize(folder)
+		p.sample("syncthing_folder_local_bytes", "gauge", "Size of the folder on this device.", float64(bytes), "folder", folder)
+	}
+	for _, folder := range folders {
+		d := s.model.LastScanDuration(folder)
+		p.sample("syncthing_folder_last_scan_duration_seconds", "gauge", "How long the last completed scan of the folder took.", d.Seconds(), "folder", folder)
+	}
+
+	stats := s.model.ConnectionStats()
+	conns, _ := stats["connections"].(map[string]model.ConnectionInfo)
+	var devices []string
+	for id := range conns {
+		devices = append(devices, id)
+	}
+	sort.Strings(devices)
+
+	p.sample("syncthing_connections", "gauge", "Number of connected devices.", float64(len(conns)))
+	for _, dev := range devices {
+		p.sample("syncthing_connection_in_bytes_total", "counter", "Bytes received from the device on the current connection.", float64(conns[dev].InBytesTotal), "device", dev)
+	}
+	for _, dev := range devices {
+		p.sample("syncthing_connection_out_bytes_total", "counter", "Bytes sent to the device on the current connection.", float64(conns[dev].OutBytesTotal), "device", dev)
+	}
+	for _, dev := range devices {
+		p.sample("syncthing_connection_in_bytes_per_second", "gauge", "Recent receive rate from the device.", float64(conns[dev].InBytesRate), "device", dev)
+	}
+	for _, dev := range devices {
+		p.sample("syncthing_connection_out_bytes_per_second", "gauge", "Recent send rate to the device.", float64(conns[dev].OutBytesRate), "device", dev)
+	}
+	if total, ok := stats["total"].(model.ConnectionInfo); ok {
+		p.sample("syncthing_in_bytes_total", "counter", "Bytes received from all devices.", float64(total.InBytesTotal))
+		p.sample("syncthing_out_bytes_total", "counter", "Bytes sent to all devices.", float64(total.OutBytesTotal))
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	p.sample("go_goroutines", "gauge", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	p.sample("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", float64(m.Alloc))
+	p.sample("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.", float64(m.Sys))
+	p.sample("go_memstats_heap_released_bytes", "gauge", "Number of heap bytes released to the system.", float64(m.HeapReleased))
+	p.sample("go_gc_count", "counter", "Number of completed GC cycles.", float64(m.NumGC))
+	p.sample("go_gc_pause_seconds_total", "counter", "Total time spent in GC pauses.", float64(m.PauseTotalNs)/1e9)
+}
+
+// promWriter writes samples in the Prometheus text format. The samples of a
+// metric must be written one after the other; the HELP and TYPE lines are
+// written before the first of them.
+type promWriter struct {
+	w    io.Writer
+	last string
+}
+
+// sample writes a sample of the named metric. The labels are given as name,
+// value pairs.
+func (p *promWriter) sample(name, typ, help string, value float64, labels ...string) {
+	if name != p.last {
+		fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		p.last = name
+	}
+
+	var lbls []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		lbls = append(lbls, labels[i]+`="`+promEscaper.Replace(labels[i+1])+`"`)
+	}
+	if len(lbls) > 0 {
+		name += "{" + strings.Join(lbls, ",") + "}"
+	}
+	fmt.Fprintf(p.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
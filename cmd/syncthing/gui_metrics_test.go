@@ -0,0 +1,32 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPromWriter(t *testing.T) {
+	var buf bytes.Buffer
+	p := &promWriter{w: &buf}
+	p.sample("test_bytes", "gauge", "Some bytes.", 1234, "folder", `a "b"\c`)
+	p.sample("test_bytes", "gauge", "Some bytes.", 0.5, "folder", "d\ne")
+	p.sample("test_total", "counter", "A total.", 1e12)
+
+	expected := `# HELP test_bytes Some bytes.
+# TYPE test_bytes gauge
+test_bytes{folder="a \"b\"\\c"} 1234
+test_bytes{folder="d\ne"} 0.5
+# HELP test_total A total.
+# TYPE test_total counter
+test_total 1e+12
+`
+	if buf.String() != expected {
+		t.Errorf("Incorrect output\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// A session is started by a successful login and kept by a cookie. The
+// cookie value is never shown; sessions are listed and ended by a handle
+// derived from it.
+type guiSession struct {
+	user     string
+	address  string
+	created  time.Time
+	lastSeen time.Time
+}
+
+var (
+	sessions    = make(map[string]*guiSession)
+	sessionsMut = sync.NewMutex()
+)
+
+func (s *guiSession) expired(cfg config.GUIConfiguration, now time.Time) bool {
+	if cfg.SessionIdleTimeoutS > 0 && now.Sub(s.lastSeen) > time.Duration(cfg.SessionIdleTimeoutS)*time.Second {
+		return true
+	}
+	if cfg.SessionMaxAgeS > 0 && now.Sub(s.created) > time.Duration(cfg.SessionMaxAgeS)*time.Second {
+		return true
+	}
+	return false
+}
+
+// newSession starts a session for the user and sets the cookie for it.
+// Expired sessions are removed while we're at it.
+func newSession(w http.ResponseWriter, r *http.Request, cfg config.GUIConfiguration, user string) {
+	id := randomString(32)
+	now := time.Now()
+
+	sessionsMut.Lock()
+	for sid, s := range sessions {
+		if s.expired(cfg, now) {
+			delete(sessions, sid)
+		}
+	}
+	sessions[id] = &guiSession{
+		user:     user,
+		address:  r.RemoteAddr,
+		created:  now,
+		lastSeen: now,
+	}
+	sessionsMut.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   "sessionid",
+		Value:  id,
+		Path:   cfg.URLBase() + "/",
+		MaxAge: 0,
+	})
+}
+
+// validSession returns the ID of the unexpired session the request belongs
+// to, and marks the session as used.
+func validSession(r *http.Request, cfg config.GUIConfiguration) (string, bool) {
+	cookie, err := r.Cookie("sessionid")
+	if err != nil {
+		return "", false
+	}
+
+	sessionsMut.Lock()
+	defer sessionsMut.Unlock()
+	s, ok := sessions[cookie.Value]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	if s.expired(cfg, now) {
+		delete(sessions, cookie.Value)
+		return "", false
+	}
+	s.lastSeen = now
+	return cookie.Value, true
+}
+
+// sessionUser returns the user the session was started for.
+func sessionUser(id string) string {
+	sessionsMut.Lock()
+	defer sessionsMut.Unlock()
+	if s, ok := sessions[id]; ok {
+		return s.user
+	}
+	return ""
+}
+
+func sessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Address  string    `json:"address"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+	Current  bool      `json:"current"`
+}
+
+type sessionsByCreated []sessionInfo
+
+func (s sessionsByCreated) Len() int           { return len(s) }
+func (s sessionsByCreated) Less(a, b int) bool { return s[a].Created.Before(s[b].Created) }
+func (s sessionsByCreated) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
+
+func (s *apiSvc) getSystemSessions(w http.ResponseWriter, r *http.Request) {
+	var current string
+	if cookie, err := r.Cookie("sessionid"); err == nil {
+		current = cookie.Value
+	}
+
+	now := time.Now()
+	infos := []sessionInfo{}
+	sessionsMut.Lock()
+	for id, sess := range sessions {
+		if sess.expired(s.cfg, now) {
+			continue
+		}
+		infos = append(infos, sessionInfo{
+			ID:       sessionHandle(id),
+			User:     sess.user,
+			Address:  sess.address,
+			Created:  sess.created,
+			LastSeen: sess.lastSeen,
+			Current:  id == current,
+		})
+	}
+	sessionsMut.Unlock()
+	sort.Sort(sessionsByCreated(infos))
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// postSessionsEnd ends the session with the given handle, or all of
+// them for "all".
+func (s *apiSvc) postSessionsEnd(w http.ResponseWriter, r *http.Request) {
+	handle := r.URL.Query().Get("id")
+	ended := 0
+	sessionsMut.Lock()
+	for id := range sessions {
+		if handle == "all" || sessionHandle(id) == handle {
+			delete(sessions, id)
+			ended++
+		}
+	}
+	sessionsMut.Unlock()
+
+	if ended == 0 {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	l.Infof("Ended %d GUI session(s)", ended)
+}
+
+// postSystemLogout ends the session of the request.
+func (s *apiSvc) postSystemLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("sessionid"); err == nil {
+		sessionsMut.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMut.Unlock()
+	}
+
+	path := s.cfg.URLBase() + "/"
+	http.SetCookie(w, &http.Cookie{Name: "sessionid", Path: path, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: "loggedout", Value: "1", Path: path})
+}
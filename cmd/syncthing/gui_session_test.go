@@ -0,0 +1,105 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessions(t *testing.T) {
+	password, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	gui := config.GUIConfiguration{User: "user", Password: string(password), SessionIdleTimeoutS: 60, SessionMaxAgeS: 3600}
+	s := &apiSvc{cfg: gui}
+
+	sessionsMut.Lock()
+	sessions = make(map[string]*guiSession)
+	sessionsMut.Unlock()
+
+	h := basicAuthAndSessionMiddleware(gui, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(h http.Handler, method string, auth bool, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, "/rest/system/status", nil)
+		if auth {
+			r.SetBasicAuth("user", "pass")
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	cookieOf := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+
+	login := request(h, "GET", true)
+	session := cookieOf(login, "sessionid")
+	if login.Code != http.StatusOK || session == nil {
+		t.Fatalf("Unexpected status %d for a login", login.Code)
+	}
+	if w := request(h, "GET", false, session); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d with the session", w.Code)
+	}
+
+	// The session is listed, and can be ended by its handle.
+	w := request(http.HandlerFunc(s.getSystemSessions), "GET", false, session)
+	var infos []sessionInfo
+	json.NewDecoder(w.Body).Decode(&infos)
+	if len(infos) != 1 || !infos[0].Current || infos[0].User != "user" || infos[0].ID == session.Value {
+		t.Fatalf("Incorrect sessions %+v", infos)
+	}
+	r, _ := http.NewRequest("POST", "/rest/system/sessions/end?id="+infos[0].ID, nil)
+	w = httptest.NewRecorder()
+	s.postSessionsEnd(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d ending the session", w.Code)
+	}
+	if w := request(h, "GET", false, session); w.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %d with an ended session", w.Code)
+	}
+
+	// Sessions expire when idle, and when old.
+	for _, change := range []func(*guiSession){
+		func(g *guiSession) { g.lastSeen = g.lastSeen.Add(-2 * time.Minute) },
+		func(g *guiSession) { g.created = g.created.Add(-2 * time.Hour) },
+	} {
+		session = cookieOf(request(h, "GET", true), "sessionid")
+		sessionsMut.Lock()
+		change(sessions[session.Value])
+		sessionsMut.Unlock()
+		if w := request(h, "GET", false, session); w.Code != http.StatusUnauthorized {
+			t.Errorf("Unexpected status %d with an expired session", w.Code)
+		}
+	}
+
+	// After logging out, the browser is asked for the password again rather
+	// than logging straight back in.
+	session = cookieOf(request(h, "GET", true), "sessionid")
+	w = request(http.HandlerFunc(s.postSystemLogout), "POST", false, session)
+	loggedOut := cookieOf(w, "loggedout")
+	if loggedOut == nil {
+		t.Fatal("No logged out cookie")
+	}
+	if w := request(h, "GET", true, session, loggedOut); w.Code != http.StatusUnauthorized || cookieOf(w, "sessionid") != nil {
+		t.Errorf("Unexpected status %d after logging out", w.Code)
+	}
+	if w := request(h, "GET", true); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d logging in again", w.Code)
+	}
+}
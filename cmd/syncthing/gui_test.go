@@ -0,0 +1,256 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+func TestUnixListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No Unix sockets on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gui.sock")
+	cfg := config.GUIConfiguration{Address: "unix://" + path, UnixSocketPermissions: "0660"}
+
+	// A stale socket from an earlier run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := unixListener(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("Incorrect permissions %o", perm)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Anything but a socket is left alone.
+	other := filepath.Join(dir, "file")
+	ioutil.WriteFile(other, []byte("data"), 0644)
+	if _, err := unixListener(config.GUIConfiguration{Address: other}); err == nil {
+		t.Error("Listening over a regular file")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("Regular file removed:", err)
+	}
+}
+
+func TestBasePathMiddleware(t *testing.T) {
+	var seen string
+	h := basePathMiddleware("/syncthing", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+	}))
+
+	// Requests are accepted whether or not the proxy strips the base path.
+	cases := map[string]string{
+		"/syncthing/rest/system/status": "/rest/system/status",
+		"/rest/system/status":           "/rest/system/status",
+		"/syncthing/":                   "/",
+		"/syncthingother/":              "/syncthingother/",
+	}
+	for path, expected := range cases {
+		seen = ""
+		r, _ := http.NewRequest("GET", path, nil)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if seen != expected {
+			t.Errorf("Incorrect path %q for %q, expected %q", seen, path, expected)
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/syncthing?lang=de", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != "/syncthing/?lang=de" {
+		t.Errorf("Unexpected response %d %q for the base path", w.Code, loc)
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	cfg := config.GUIConfiguration{CORSAllowedOrigins: []string{"https://dash.example.com/"}}
+	called := false
+	h := corsMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		called = false
+		r, _ := http.NewRequest(method, "/rest/system/status", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// Preflights are answered without going further.
+	w := request("OPTIONS", "https://dash.example.com")
+	if called || w.Code != http.StatusNoContent {
+		t.Errorf("Unexpected status %d for a preflight", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://dash.example.com" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, PUT, PATCH, DELETE" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "X-API-Key, Authorization, Content-Type" {
+		t.Errorf("Incorrect preflight headers %v", w.Header())
+	}
+
+	w = request("GET", "https://dash.example.com")
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "https://dash.example.com" {
+		t.Errorf("Incorrect headers %v for an allowed origin", w.Header())
+	}
+
+	// Other origins get no CORS headers, so the browser refuses them.
+	for _, origin := range []string{"https://evil.example.com", ""} {
+		w = request("OPTIONS", origin)
+		if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("Incorrect headers %v for origin %q", w.Header(), origin)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	readinessMut.Lock()
+	saved := readiness
+	readiness = map[string]bool{"config": true, "database": false}
+	readinessMut.Unlock()
+	defer func() {
+		readinessMut.Lock()
+		readiness = saved
+		readinessMut.Unlock()
+	}()
+
+	h := noAuthHealthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Not Authorized", http.StatusUnauthorized)
+	}))
+	request := func(path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("/rest/noauth/health"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"ready":false`) {
+		t.Errorf("Unexpected response %d %s before ready", w.Code, w.Body.String())
+	}
+	setReady("database")
+	if w := request("/rest/noauth/health"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ready":true`) {
+		t.Errorf("Unexpected response %d %s when ready", w.Code, w.Body.String())
+	}
+	if w := request("/rest/system/status"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %d for another path", w.Code)
+	}
+
+	// A required client certificate is required for health checks too.
+	h = clientCertMiddleware(true, &clientCertVerifier{}, h, h)
+	if w := request("/rest/noauth/health"); w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status %d without a client certificate", w.Code)
+	}
+}
+
+func TestV2API(t *testing.T) {
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = config.Wrap("/dev/null", config.Configuration{})
+
+	s := &apiSvc{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/system/version", s.getSystemVersion)
+	mux.HandleFunc("/rest/v2/system/version", s.getV2Version)
+	mux.HandleFunc("/rest/v2/folders/", s.getV2Folders)
+	h := deprecationMiddleware(mux)
+	request := func(path string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("/rest/system/version")
+	if w.Header().Get("Deprecation") != "true" || w.Header().Get("Link") != `</rest/v2/system/version>; rel="successor-version"` {
+		t.Errorf("Missing deprecation headers: %v", w.Header())
+	}
+
+	w = request("/rest/v2/system/version")
+	if w.Header().Get("Deprecation") != "" {
+		t.Error("Deprecation header on a v2 endpoint")
+	}
+	for _, key := range []string{`"version":`, `"longVersion":`, `"os":`, `"arch":`} {
+		if !strings.Contains(w.Body.String(), key) {
+			t.Errorf("Missing %s in %s", key, w.Body.String())
+		}
+	}
+
+	w = request("/rest/v2/folders/nonexistent")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"error":`) {
+		t.Errorf("Unexpected response %d %s for an unknown folder", w.Code, w.Body.String())
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	if _, err := newEventFilter(url.Values{"events": {"ItemFinished,Nonexistent"}}); err == nil {
+		t.Error("Unexpected nil error for an unknown event type")
+	}
+
+	f, err := newEventFilter(url.Values{"events": {"ItemFinished, DeviceConnected"}, "folder": {"default,photos"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ev    events.Event
+		match bool
+	}{
+		{events.Event{Type: events.ItemFinished, Data: map[string]interface{}{"folder": "default"}}, true},
+		{events.Event{Type: events.ItemFinished, Data: map[string]interface{}{"folder": "photos"}}, true},
+		{events.Event{Type: events.ItemFinished, Data: map[string]interface{}{"folder": "other"}}, false},
+		{events.Event{Type: events.LocalIndexUpdated, Data: map[string]interface{}{"folder": "default"}}, false},
+		{events.Event{Type: events.DeviceConnected, Data: map[string]string{"id": "device"}}, true},
+	}
+	for i, tc := range cases {
+		if m := f.match(tc.ev); m != tc.match {
+			t.Errorf("Case %d: unexpected match %v", i, m)
+		}
+	}
+}
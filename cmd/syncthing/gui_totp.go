@@ -0,0 +1,314 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/sync"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Time based one time passwords (RFC 6238) as a second factor after the
+// password. Browsers get a form to enter the code in; other clients can send
+// it in the X-TOTP-Code header. A recovery code can be used once instead.
+//
+//   GET  /rest/system/totp           whether it's enabled
+//   POST /rest/system/totp/enroll    creates a secret to add to the app
+//   POST /rest/system/totp/confirm   code: enables it, returns recovery codes
+//   POST /rest/system/totp/disable   code: disables it
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // periods before and after now that are accepted
+	totpSecretSize    = 20
+	totpRecoveryCodes = 8
+)
+
+var (
+	totpEncoding = base32.StdEncoding
+	totpMut      = sync.NewMutex() // so that a recovery code is only used once
+
+	// The last period a code was accepted for, by user. Codes for it and
+	// earlier ones are refused, so that a code seen by someone else can't
+	// be used again while it's still valid. Protected by totpMut.
+	totpLastPeriod = make(map[string]uint64)
+)
+
+// totpCode returns the code for the secret in the given period (RFC 4226).
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpValid returns whether the code is correct for the secret at the time,
+// allowing for some clock skew.
+func totpValid(secret []byte, code string, now time.Time) bool {
+	_, ok := totpPeriodOf(secret, code, now)
+	return ok
+}
+
+// totpPeriodOf returns the period the code is correct for, if it's correct
+// for the secret at the time, allowing for some clock skew.
+func totpPeriodOf(secret []byte, code string, now time.Time) (uint64, bool) {
+	counter := uint64(now.Unix() / totpPeriod)
+	var period uint64
+	valid := false
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected := totpCode(secret, counter+uint64(i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			period, valid = counter+uint64(i), true
+		}
+	}
+	return period, valid
+}
+
+// checkTOTP returns whether the code is a current TOTP code that the user
+// hasn't used yet, or one of the recovery codes, which is then used up.
+func checkTOTP(guiCfg config.GUIConfiguration, user, code string) bool {
+	code = strings.TrimSpace(code)
+	secret, err := openTOTPSecret(guiCfg.TOTPSecret)
+	if err != nil {
+		l.Warnln("Two factor authentication:", err)
+		return false
+	}
+
+	totpMut.Lock()
+	defer totpMut.Unlock()
+
+	if period, ok := totpPeriodOf(secret, code, time.Now()); ok {
+		if last, used := totpLastPeriod[user]; used && period <= last {
+			l.Infof("Refused reused two factor code for %q", user)
+			return false
+		}
+		totpLastPeriod[user] = period
+		return true
+	}
+
+	code = normalizeRecoveryCode(code)
+	gui := cfg.GUI()
+	for i, hash := range gui.TOTPRecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			gui.TOTPRecoveryCodes = append(gui.TOTPRecoveryCodes[:i:i], gui.TOTPRecoveryCodes[i+1:]...)
+			cfg.SetGUI(gui)
+			cfg.Save()
+			l.Infof("Recovery code used for login; %d left", len(gui.TOTPRecoveryCodes))
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.Replace(code, "-", "", -1), " ", "", -1))
+}
+
+// totpCipher returns the cipher for the TOTP secret, keyed by the device
+// key, so that the config file alone doesn't give the secret away.
+func totpCipher() (cipher.AEAD, error) {
+	bs, err := ioutil.ReadFile(locations[locKeyFile])
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(append([]byte("syncthing gui totp\n"), bs...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealTOTPSecret(secret []byte) (string, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func openTOTPSecret(sealed string) ([]byte, error) {
+	aead, err := totpCipher()
+	if err != nil {
+		return nil, err
+	}
+	bs, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) < aead.NonceSize() {
+		return nil, errors.New("TOTP secret too short")
+	}
+	return aead.Open(nil, bs[:aead.NonceSize()], bs[aead.NonceSize():], nil)
+}
+
+// totpForm asks the browser for the code, after the password was accepted.
+// It's a 403 rather than a 401 so that browsers keep using the password.
+func totpForm(w http.ResponseWriter, failed bool) {
+	msg := ""
+	if failed {
+		msg = "<p>Incorrect code.</p>"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Syncthing</title></head>
+<body><form method="post" action="totp">
+<p>Enter the code from your authenticator app, or a recovery code.</p>%s
+<input name="code" autocomplete="one-time-code" autofocus> <button type="submit">Verify</button>
+</form></body></html>
+`, msg)
+}
+
+func (s *apiSvc) getTOTP(w http.ResponseWriter, r *http.Request) {
+	gui := cfg.GUI()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":       gui.TOTPSecret != "",
+		"recoveryCodes": len(gui.TOTPRecoveryCodes),
+	})
+}
+
+func (s *apiSvc) postTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	if refuseLocked(w, "gui") {
+		return
+	}
+	if cfg.GUI().TOTPSecret != "" {
+		http.Error(w, "Two factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	secret := make([]byte, totpSecretSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	s.pendingTOTP = secret
+
+	enc := strings.TrimRight(totpEncoding.EncodeToString(secret), "=")
+	label := url.PathEscape("Syncthing:" + cfg.GUI().User)
+	uri := fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=Syncthing&digits=%d&period=%d", label, enc, totpDigits, totpPeriod)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": enc,
+		"uri":    uri,
+	})
+}
+
+func (s *apiSvc) postTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	if refuseLocked(w, "gui") {
+		return
+	}
+	if s.pendingTOTP == nil {
+		http.Error(w, "No enrollment in progress", http.StatusBadRequest)
+		return
+	}
+	if !totpValid(s.pendingTOTP, r.URL.Query().Get("code"), time.Now()) {
+		http.Error(w, "Incorrect code", http.StatusBadRequest)
+		return
+	}
+
+	sealed, err := sealTOTPSecret(s.pendingTOTP)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var codes, hashes []string
+	for i := 0; i < totpRecoveryCodes; i++ {
+		bs := make([]byte, 10)
+		if _, err := io.ReadFull(rand.Reader, bs); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(bs))
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), 0)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		hashes = append(hashes, string(hash))
+	}
+
+	gui := cfg.GUI()
+	gui.TOTPSecret = sealed
+	gui.TOTPRecoveryCodes = hashes
+	cfg.SetGUI(gui)
+	cfg.SaveBy(requestActor(r))
+	s.pendingTOTP = nil
+	l.Infoln("Two factor authentication enabled for the GUI")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+func (s *apiSvc) postTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	s.systemConfigMut.Lock()
+	defer s.systemConfigMut.Unlock()
+
+	if refuseLocked(w, "gui") {
+		return
+	}
+	gui := cfg.GUI()
+	if gui.TOTPSecret == "" {
+		http.Error(w, "Two factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	// A stolen session alone isn't enough to turn it off.
+	user := ""
+	if id, ok := validSession(r, s.cfg); ok {
+		user = sessionUser(id)
+	}
+	if !checkTOTP(gui, user, r.URL.Query().Get("code")) {
+		http.Error(w, "Incorrect code", http.StatusBadRequest)
+		return
+	}
+
+	gui = cfg.GUI()
+	gui.TOTPSecret = ""
+	gui.TOTPRecoveryCodes = nil
+	cfg.SetGUI(gui)
+	cfg.SaveBy(requestActor(r))
+	l.Infoln("Two factor authentication disabled for the GUI")
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, cut to six digits.
+	secret := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range cases {
+		if code := totpCode(secret, uint64(unix/totpPeriod)); code != expected {
+			t.Errorf("Incorrect code %s at %d, expected %s", code, unix, expected)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	for _, d := range []time.Duration{-totpPeriod * time.Second, 0, totpPeriod * time.Second} {
+		if !totpValid(secret, "081804", now.Add(d)) {
+			t.Errorf("Code not valid %v from its time", d)
+		}
+	}
+	if totpValid(secret, "081804", now.Add(3*totpPeriod*time.Second)) {
+		t.Error("Code still valid long after its time")
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, oldCfg := locations[locKeyFile], cfg
+	defer func() { locations[locKeyFile], cfg = oldKey, oldCfg }()
+	locations[locKeyFile] = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(locations[locKeyFile], []byte("not much of a key"), 0600)
+
+	secret := []byte("12345678901234567890")
+	sealed, err := sealTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := openTOTPSecret(sealed); err != nil || string(opened) != string(secret) {
+		t.Fatalf("Incorrect secret %q, %v", opened, err)
+	}
+
+	password, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	recovery, _ := bcrypt.GenerateFromPassword([]byte("abcdabcdabcdabcd"), bcrypt.MinCost)
+	gui := config.GUIConfiguration{
+		User:              "user",
+		Password:          string(password),
+		TOTPSecret:        sealed,
+		TOTPRecoveryCodes: []string{string(recovery)},
+	}
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{GUI: gui})
+
+	h := basicAuthAndSessionMiddleware(gui, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	login := func(header, form string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if form != "" {
+			r, _ = http.NewRequest("POST", "/totp?code="+form, nil)
+		}
+		r.SetBasicAuth("user", "pass")
+		if header != "" {
+			r.Header.Set("X-TOTP-Code", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := login("", ""); w.Code != http.StatusForbidden || w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Unexpected status %d without a code", w.Code)
+	}
+	if w := login("000000", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status %d for a wrong code", w.Code)
+	}
+	code := totpCode(secret, uint64(time.Now().Unix()/totpPeriod))
+	if w := login(code, ""); w.Code != http.StatusOK || w.Header().Get("Set-Cookie") == "" {
+		t.Errorf("Unexpected status %d for a correct code", w.Code)
+	}
+	if w := login(code, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status %d for a reused code", w.Code)
+	}
+
+	// The recovery code works from the form, once.
+	if w := login("", "ABCD-abcd-ABCD-abcd"); w.Code != http.StatusSeeOther {
+		t.Errorf("Unexpected status %d for a recovery code", w.Code)
+	}
+	if left := cfg.GUI().TOTPRecoveryCodes; len(left) != 0 {
+		t.Errorf("Recovery code not used up, %d left", len(left))
+	}
+	if w := login("", "ABCD-abcd-ABCD-abcd"); w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected status %d for a used recovery code", w.Code)
+	}
+}
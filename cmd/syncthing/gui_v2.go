@@ -0,0 +1,194 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/model"
+)
+
+// The /rest/v2 API answers with the types below, which are part of the API
+// rather than of the program: fields may be added, but are never renamed,
+// retyped or removed within the version. Errors are answered as v2Error
+// with a fitting status code.
+//
+//   GET /rest/v2/system/version
+//   GET /rest/v2/system/status
+//   GET /rest/v2/folders
+//   GET /rest/v2/folders/<id>
+//   GET /rest/v2/connections
+//
+// The older endpoints these replace keep working, but point to their
+// successors with Deprecation and Link headers.
+
+type v2Error struct {
+	Error string `json:"error"`
+}
+
+type v2Version struct {
+	Version     string `json:"version"`
+	LongVersion string `json:"longVersion"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+}
+
+type v2SystemStatus struct {
+	MyID       string    `json:"myID"`
+	StartTime  time.Time `json:"startTime"`
+	UptimeS    int64     `json:"uptimeS"`
+	Goroutines int       `json:"goroutines"`
+	AllocBytes uint64    `json:"allocBytes"`
+	SysBytes   uint64    `json:"sysBytes"`
+}
+
+type v2Folder struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	State        string    `json:"state"`
+	StateChanged time.Time `json:"stateChanged"`
+	Error        string    `json:"error,omitempty"`
+	GlobalFiles  int       `json:"globalFiles"`
+	GlobalBytes  int64     `json:"globalBytes"`
+	LocalFiles   int       `json:"localFiles"`
+	LocalBytes   int64     `json:"localBytes"`
+	NeedFiles    int       `json:"needFiles"`
+	NeedBytes    int64     `json:"needBytes"`
+}
+
+type v2Connection struct {
+	DeviceID      string    `json:"deviceID"`
+	Address       string    `json:"address"`
+	Type          string    `json:"type"`
+	ClientVersion string    `json:"clientVersion"`
+	StartedAt     time.Time `json:"startedAt"`
+	InBytesTotal  int64     `json:"inBytesTotal"`
+	OutBytesTotal int64     `json:"outBytesTotal"`
+}
+
+// v2Successors maps the deprecated endpoints to their replacements.
+var v2Successors = map[string]string{
+	"/rest/system/version":     "/rest/v2/system/version",
+	"/rest/system/status":      "/rest/v2/system/status",
+	"/rest/system/connections": "/rest/v2/connections",
+	"/rest/db/status":          "/rest/v2/folders/{folder}",
+}
+
+// deprecationMiddleware marks responses from endpoints that have a v2
+// successor, so that clients can notice before they go away.
+func deprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if successor, ok := v2Successors[r.URL.Path]; ok {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeV2(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *apiSvc) getV2Version(w http.ResponseWriter, r *http.Request) {
+	writeV2(w, http.StatusOK, v2Version{
+		Version:     Version,
+		LongVersion: LongVersion,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+	})
+}
+
+func (s *apiSvc) getV2SystemStatus(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	writeV2(w, http.StatusOK, v2SystemStatus{
+		MyID:       myID.String(),
+		StartTime:  startTime,
+		UptimeS:    int64(time.Since(startTime).Seconds()),
+		Goroutines: runtime.NumGoroutine(),
+		AllocBytes: m.Alloc,
+		SysBytes:   m.Sys - m.HeapReleased,
+	})
+}
+
+func (s *apiSvc) getV2Folders(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/rest/v2/folders"), "/")
+	folders := cfg.Folders()
+
+	if id != "" {
+		if _, ok := folders[id]; !ok {
+			writeV2(w, http.StatusNotFound, v2Error{"no such folder"})
+			return
+		}
+		writeV2(w, http.StatusOK, s.v2Folder(id))
+		return
+	}
+
+	var ids []string
+	for id := range folders {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	res := []v2Folder{}
+	for _, id := range ids {
+		res = append(res, s.v2Folder(id))
+	}
+	writeV2(w, http.StatusOK, res)
+}
+
+func (s *apiSvc) v2Folder(id string) v2Folder {
+	f := v2Folder{
+		ID:   id,
+		Path: cfg.Folders()[id].Path(),
+	}
+	f.GlobalFiles, _, f.GlobalBytes = s.model.GlobalSize(id)
+	f.LocalFiles, _, f.LocalBytes = s.model.LocalSize(id)
+	f.NeedFiles, f.NeedBytes = s.model.NeedSize(id)
+
+	var err error
+	f.State, f.StateChanged, err = s.model.State(id)
+	if err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
+
+func (s *apiSvc) getV2Connections(w http.ResponseWriter, r *http.Request) {
+	conns, _ := s.model.ConnectionStats()["connections"].(map[string]model.ConnectionInfo)
+	var ids []string
+	for id := range conns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	res := []v2Connection{}
+	for _, id := range ids {
+		info := conns[id]
+		c := v2Connection{
+			DeviceID:      id,
+			Address:       info.Address,
+			ClientVersion: info.ClientVersion,
+			StartedAt:     info.StartedAt,
+			InBytesTotal:  info.InBytesTotal,
+			OutBytesTotal: info.OutBytesTotal,
+		}
+		if device, err := protocol.DeviceIDFromString(id); err == nil && connections != nil {
+			c.Type = connections.connType(device).String()
+		}
+		res = append(res, c)
+	}
+	writeV2(w, http.StatusOK, res)
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The server side of the WebSocket protocol (RFC 6455), as much as the
+// event stream needs: we send text messages and answer pings and closes.
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	wsMaxReadSize = 64 << 10
+
+	// A frame that can't be written within this time means a client that
+	// stopped reading.
+	wsWriteTimeout = 10 * time.Second
+)
+
+var (
+	errWSHandshake = errors.New("not a WebSocket handshake")
+	errWSOrigin    = errors.New("cross origin WebSocket request")
+	errWSFrame     = errors.New("malformed WebSocket frame")
+)
+
+// wsUpgrade answers the WebSocket handshake of the request, and returns the
+// connection taken over from the HTTP server. Browsers let any page open a
+// WebSocket, so requests from pages on other origins are refused, unless the
+// origin is among the allowed CORS origins.
+func wsUpgrade(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(r.Header, "Connection", "upgrade") || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, errWSHandshake.Error(), http.StatusBadRequest)
+		return nil, nil, errWSHandshake
+	}
+	if !wsOriginAllowed(r, allowedOrigins) {
+		http.Error(w, errWSOrigin.Error(), http.StatusForbidden)
+		return nil, nil, errWSOrigin
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, nil, errWSHandshake
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The server's read timeout is for requests, not for the stream.
+	conn.SetDeadline(time.Time{})
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// wsOriginAllowed returns whether the request comes from a page of the GUI
+// itself, or from one on an allowed CORS origin. Behind a reverse proxy the
+// GUI is at the host the proxy was asked for, which it passes on in
+// X-Forwarded-Host. Pages can't set that header on a WebSocket, so it can be
+// trusted for this.
+func wsOriginAllowed(r *http.Request, allowedOrigins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not from a browser.
+		return true
+	}
+	if corsOriginAllowed(allowedOrigins, origin) {
+		return true
+	}
+	uri, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if uri.Host == r.Host {
+		return true
+	}
+	fwd := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0])
+	return fwd != "" && uri.Host == fwd
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, val := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsWriteFrame writes an unfragmented, unmasked frame, as servers do.
+func wsWriteFrame(w io.Writer, opcode byte, payload []byte) error {
+	hdr := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		hdr = append(hdr, ext[:]...)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// wsReadFrame reads a frame from the client, which must be masked, and
+// returns its opcode and unmasked payload.
+func wsReadFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[1]&0x80 == 0 {
+		return 0, nil, errWSFrame
+	}
+
+	size := uint64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > wsMaxReadSize {
+		return 0, nil, errWSFrame
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return hdr[0] & 0x0f, payload, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsDial opens a WebSocket to the server, with the given Origin if it's not
+// empty, and returns the connection and the handshake response.
+func wsDial(t *testing.T, srv *httptest.Server, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	// The example key from RFC 6455.
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := wsUpgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Echo what the client sends.
+		opcode, payload, err := wsReadFrame(rw)
+		if err != nil {
+			return
+		}
+		wsWriteFrame(conn, opcode, payload)
+	}))
+	defer srv.Close()
+
+	conn, br, resp := wsDial(t, srv, "")
+	defer conn.Close()
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Incorrect handshake response %v", resp)
+	}
+
+	// A masked client frame, with a payload long enough for an extended
+	// length.
+
+	msg := strings.Repeat("hello ", 30)
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | wsOpText, 0x80 | 126, 0, byte(len(msg))}
+	frame = append(frame, mask...)
+	for i := range msg {
+		frame = append(frame, msg[i]^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0] != 0x80|wsOpText || hdr[1] != 126 || int(hdr[2])<<8|int(hdr[3]) != len(msg) {
+		t.Fatalf("Incorrect frame header %x", hdr)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != msg {
+		t.Errorf("Incorrect echo %q, %v", buf, err)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, _, err := wsUpgrade(w, r, []string{"https://dashboard.example.com/"}); err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	conn, _, resp := wsDial(t, srv, "http://evil.example.com")
+	conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status %d for another origin", resp.StatusCode)
+	}
+
+	conn, _, resp = wsDial(t, srv, srv.URL)
+	conn.Close()
+	if resp.StatusCode != 101 {
+		t.Errorf("Unexpected status %d for the same origin", resp.StatusCode)
+	}
+
+	conn, _, resp = wsDial(t, srv, "https://dashboard.example.com")
+	conn.Close()
+	if resp.StatusCode != 101 {
+		t.Errorf("Unexpected status %d for an allowed CORS origin", resp.StatusCode)
+	}
+}
+
+func TestWebSocketOriginProxied(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://127.0.0.1:8384/rest/events/ws", nil)
+	r.Header.Set("Origin", "https://proxy.example.com")
+	if wsOriginAllowed(r, nil) {
+		t.Error("Origin of the proxy allowed without X-Forwarded-Host")
+	}
+	r.Header.Set("X-Forwarded-Host", "proxy.example.com, 127.0.0.1:8384")
+	if !wsOriginAllowed(r, nil) {
+		t.Error("Origin of the proxy not allowed")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// We're ready when the parts below are up. Until then the health check says
+// we're alive, but not ready, for load balancers and orchestrators to wait.
+var (
+	readiness = map[string]bool{
+		"config":    false,
+		"database":  false,
+		"listeners": false,
+	}
+	readinessMut = sync.NewMutex()
+)
+
+func setReady(part string) {
+	readinessMut.Lock()
+	readiness[part] = true
+	readinessMut.Unlock()
+}
+
+// getHealth answers 200 when ready and 503 before, with the state of each
+// part. Nothing about folders or devices is told, as it may be unauthenticated.
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]bool)
+	ready := true
+	readinessMut.Lock()
+	for part, ok := range readiness {
+		checks[part] = ok
+		ready = ready && ok
+	}
+	readinessMut.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"alive":  true,
+		"ready":  ready,
+		"checks": checks,
+	})
+}
+
+// noAuthHealthMiddleware answers health checks before authentication.
+func noAuthHealthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rest/noauth/health" && (r.Method == "GET" || r.Method == "HEAD") {
+			getHealth(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -6,15 +6,11 @@
 
 package main
 
-import (
-	"io"
-
-	"github.com/juju/ratelimit"
-)
+import "io"
 
 type limitedReader struct {
 	r      io.Reader
-	bucket *ratelimit.Bucket
+	bucket rateLimiter
 }
 
 func (r *limitedReader) Read(buf []byte) (int, error) {
@@ -8,13 +8,22 @@ package main
 
 import (
 	"io"
+	"time"
 
 	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/osutil"
 )
 
+// A rateLimiter blocks until the given number of bytes may be transferred.
+// It's satisfied by *ratelimit.Bucket.
+type rateLimiter interface {
+	Wait(count int64)
+}
+
 type limitedWriter struct {
 	w      io.Writer
-	bucket *ratelimit.Bucket
+	bucket rateLimiter
 }
 
 func (w *limitedWriter) Write(buf []byte) (int, error) {
@@ -23,3 +32,47 @@ func (w *limitedWriter) Write(buf []byte) (int, error) {
 	}
 	return w.w.Write(buf)
 }
+
+// A scheduledRateLimit applies the rate limit of the first time window
+// containing the current time, or the default limit outside of them. A nil
+// bucket means unlimited.
+type scheduledRateLimit struct {
+	def     *ratelimit.Bucket
+	windows []config.TimeWindow
+	buckets []*ratelimit.Bucket
+	now     func() time.Time
+}
+
+// newScheduledRateLimit returns a rate limit of defKbps, or the rate given
+// by kbps for the window, during each of the windows.
+func newScheduledRateLimit(defKbps int, windows []config.RateLimitWindow, kbps func(config.RateLimitWindow) int) *scheduledRateLimit {
+	r := &scheduledRateLimit{now: time.Now}
+	if defKbps > 0 {
+		r.def = osutil.NewRateLimit(defKbps)
+	}
+	for _, w := range windows {
+		var b *ratelimit.Bucket
+		if rate := kbps(w); rate > 0 {
+			b = osutil.NewRateLimit(rate)
+		}
+		r.windows = append(r.windows, w.TimeWindow)
+		r.buckets = append(r.buckets, b)
+	}
+	return r
+}
+
+func (r *scheduledRateLimit) Wait(count int64) {
+	if b := r.current(); b != nil {
+		b.Wait(count)
+	}
+}
+
+func (r *scheduledRateLimit) current() *ratelimit.Bucket {
+	now := r.now()
+	for i, w := range r.windows {
+		if w.Contains(now) {
+			return r.buckets[i]
+		}
+	}
+	return r.def
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+func TestDeviceRateLimitChain(t *testing.T) {
+	// A device limit stacked on top of the global one draws from both
+	// buckets.
+
+	global := osutil.NewRateLimit(1000)
+	device := osutil.NewRateLimit(10)
+
+	var buf bytes.Buffer
+	wr := &limitedWriter{&limitedWriter{&buf, global}, device}
+	if _, err := wr.Write(make([]byte, 20000)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 20000 {
+		t.Errorf("Incorrect number of bytes written %d != 20000", buf.Len())
+	}
+
+	if n := device.TakeAvailable(50000); n < 30000 || n > 31000 {
+		t.Errorf("Device bucket has %d tokens left, expected about 30000", n)
+	}
+	if n := global.TakeAvailable(5000000); n < 4980000 {
+		t.Errorf("Global bucket has %d tokens left, expected about 4980000", n)
+	}
+}
+
+func TestDeviceRateLimitThrottles(t *testing.T) {
+	// 100 kB/s with a 500 kB burst; reading 520 kB must wait for the bucket
+	// to refill with the last 20 kB, about 200 ms.
+
+	rd := &limitedReader{bytes.NewReader(make([]byte, 520000)), osutil.NewRateLimit(100)}
+
+	t0 := time.Now()
+	bs, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 520000 {
+		t.Errorf("Incorrect number of bytes read %d != 520000", len(bs))
+	}
+	if d := time.Since(t0); d < 150*time.Millisecond {
+		t.Errorf("Read was not throttled, took %v", d)
+	}
+}
+
+func TestScheduledRateLimit(t *testing.T) {
+	windows := []config.RateLimitWindow{
+		{TimeWindow: config.TimeWindow{Start: "09:00", End: "17:00"}, MaxSendKbps: 500},
+		{TimeWindow: config.TimeWindow{Start: "17:00", End: "09:00"}},
+	}
+	r := newScheduledRateLimit(100, windows, func(w config.RateLimitWindow) int { return w.MaxSendKbps })
+
+	r.now = func() time.Time { return time.Date(2015, time.June, 1, 12, 0, 0, 0, time.Local) }
+	if b := r.current(); b == nil || b.Rate() != 500000 {
+		t.Error("Expected the 500 kB/s limit during business hours")
+	}
+
+	r.now = func() time.Time { return time.Date(2015, time.June, 1, 23, 0, 0, 0, time.Local) }
+	if b := r.current(); b != nil {
+		t.Error("Expected no limit at night")
+	}
+
+	r = newScheduledRateLimit(100, windows[:1], func(w config.RateLimitWindow) int { return w.MaxSendKbps })
+	r.now = func() time.Time { return time.Date(2015, time.June, 1, 23, 0, 0, 0, time.Local) }
+	if b := r.current(); b == nil || b.Rate() != 100000 {
+		t.Error("Expected the default limit outside of the windows")
+	}
+}
@@ -32,6 +32,7 @@ const (
 	locPanicLog                   = "panicLog"
 	locAuditLog                   = "auditLog"
 	locDefFolder                  = "defFolder"
+	locConfigHistory              = "configHistory"
 )
 
 // Platform dependent directories
@@ -53,6 +54,7 @@ var locations = map[locationEnum]string{
 	locPanicLog:      "${config}/panic-${timestamp}.log",
 	locAuditLog:      "${config}/audit-${timestamp}.log",
 	locDefFolder:     "${home}/Sync",
+	locConfigHistory: "${config}/config.history",
 }
 
 // expandLocations replaces the variables in the location map with actual
@@ -69,6 +71,18 @@ func expandLocations() error {
 		}
 		locations[key] = dir
 	}
+
+	// The configuration is kept in JSON or YAML instead when there's a
+	// config.json or config.yaml and no config.xml.
+	if _, err := os.Stat(locations[locConfigFile]); os.IsNotExist(err) {
+		for _, ext := range []string{".json", ".yaml"} {
+			file := strings.TrimSuffix(locations[locConfigFile], ".xml") + ext
+			if _, err := os.Stat(file); err == nil {
+				locations[locConfigFile] = file
+				break
+			}
+		}
+	}
 	return nil
 }
 
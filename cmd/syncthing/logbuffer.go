@@ -0,0 +1,124 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const logBufferSize = 1000
+
+var logLevelNames = []string{
+	logger.LevelDebug:   "debug",
+	logger.LevelVerbose: "verbose",
+	logger.LevelInfo:    "info",
+	logger.LevelOK:      "ok",
+	logger.LevelWarn:    "warn",
+	logger.LevelFatal:   "fatal",
+}
+
+// A logLine is a logged message and where it came from. The facility is the
+// name of the package that logged it.
+type logLine struct {
+	When     time.Time `json:"when"`
+	Level    string    `json:"level"`
+	Facility string    `json:"facility"`
+	Message  string    `json:"message"`
+
+	level logger.LogLevel
+}
+
+// logBuffer keeps the most recent log lines, for looking at remotely.
+type logBuffer struct {
+	lines []logLine
+	next  int
+	full  bool
+	mut   sync.Mutex
+}
+
+var recentLog = newLogBuffer(logBufferSize)
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{
+		lines: make([]logLine, size),
+		mut:   sync.NewMutex(),
+	}
+}
+
+// Attach makes the buffer receive the lines of all levels from the logger.
+func (b *logBuffer) Attach(lg *logger.Logger) {
+	for level := logger.LevelDebug; level < logger.NumLevels; level++ {
+		lg.AddHandler(level, b.handle)
+	}
+}
+
+func (b *logBuffer) handle(level logger.LogLevel, msg string) {
+	// Our caller is the logger, and its caller the code that logged.
+	facility := ""
+	if pc, _, _, ok := runtime.Caller(3); ok {
+		facility = packageName(runtime.FuncForPC(pc).Name())
+	}
+	b.add(logLine{When: time.Now(), Level: logLevelNames[level], Facility: facility, Message: msg, level: level})
+}
+
+func (b *logBuffer) add(line logLine) {
+	b.mut.Lock()
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.mut.Unlock()
+}
+
+// Since returns the lines logged after the time, of at least the level,
+// and of the facility unless that's empty, oldest first.
+func (b *logBuffer) Since(t time.Time, level logger.LogLevel, facility string) []logLine {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	var ordered []logLine
+	if b.full {
+		ordered = append(ordered, b.lines[b.next:]...)
+	}
+	ordered = append(ordered, b.lines[:b.next]...)
+
+	res := []logLine{}
+	for _, line := range ordered {
+		if line.When.After(t) && line.level >= level && (facility == "" || line.Facility == facility) {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// packageName returns the last element of the package path of a function
+// name such as "github.com/syncthing/syncthing/internal/model.(*Model).Index".
+func packageName(fn string) string {
+	if i := strings.LastIndex(fn, "/"); i >= 0 {
+		fn = fn[i+1:]
+	}
+	if i := strings.Index(fn, "."); i >= 0 {
+		fn = fn[:i]
+	}
+	return fn
+}
+
+// parseLogLevel returns the level with the name, as in the log lines.
+func parseLogLevel(name string) (logger.LogLevel, bool) {
+	for level, n := range logLevelNames {
+		if n == name {
+			return logger.LogLevel(level), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/calmh/logger"
+)
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(3)
+	lg := logger.New()
+	b.Attach(lg)
+
+	start := time.Now().Add(-time.Second)
+	lg.Debugln("one")
+	lg.Infoln("two")
+	lg.Warnln("three")
+	lg.Infof("four %d", 4)
+
+	// The oldest line is gone, and the rest come in order.
+	lines := b.Since(start, logger.LevelDebug, "")
+	var msgs []string
+	for _, line := range lines {
+		msgs = append(msgs, line.Level+" "+line.Message)
+	}
+	if fmt.Sprint(msgs) != "[info two warn three info four 4]" {
+		t.Errorf("Incorrect lines %v", msgs)
+	}
+	// That's "main" when built as a command rather than as a test.
+	pc, _, _, _ := runtime.Caller(0)
+	if pkg := packageName(runtime.FuncForPC(pc).Name()); lines[0].Facility != pkg {
+		t.Errorf("Incorrect facility %q, expected %q", lines[0].Facility, pkg)
+	}
+
+	if lines := b.Since(start, logger.LevelWarn, ""); len(lines) != 1 || lines[0].Message != "three" {
+		t.Errorf("Incorrect lines %v of level warn", lines)
+	}
+	if lines := b.Since(start, logger.LevelDebug, "model"); len(lines) != 0 {
+		t.Errorf("Incorrect lines %v of another facility", lines)
+	}
+	if lines := b.Since(time.Now().Add(time.Second), logger.LevelDebug, ""); len(lines) != 0 {
+		t.Errorf("Incorrect lines %v in the future", lines)
+	}
+}
+
+func TestPackageName(t *testing.T) {
+	cases := map[string]string{
+		"github.com/syncthing/syncthing/internal/model.(*Model).Index": "model",
+		"main.(*apiSvc).Serve":                                "main",
+		"github.com/syncthing/syncthing/internal/db.func·001": "db",
+	}
+	for fn, expected := range cases {
+		if pkg := packageName(fn); pkg != expected {
+			t.Errorf("Incorrect package %q for %q", pkg, fn)
+		}
+	}
+}
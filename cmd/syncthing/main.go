@@ -26,7 +26,6 @@ import (
 	"time"
 
 	"github.com/calmh/logger"
-	"github.com/juju/ratelimit"
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
@@ -34,11 +33,13 @@ import (
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/relay"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/thejerf/suture"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -105,10 +106,17 @@ var (
 	myID           protocol.DeviceID
 	confDir        string
 	logFlags       = log.Ltime
-	writeRateLimit *ratelimit.Bucket
-	readRateLimit  *ratelimit.Bucket
+	writeRateLimit rateLimiter
+	readRateLimit  rateLimiter
 	stop           = make(chan int)
 	discoverer     *discover.Discoverer
+	power          *powerSvc
+	dbDir          string // of the database, or empty when it is in memory
+	dbCompactor    *dbCompactSvc
+	connections    *connectionSvc
+	relays         *relaySvc
+	relayServer    *relay.Server
+	discoSrv       *discover.Server
 	cert           tls.Certificate
 	lans           []*net.IPNet
 )
@@ -120,6 +128,10 @@ The default configuration directory is:
 
   %s
 
+The configuration is kept in config.xml there, or in config.json or
+config.yaml when one of those exists instead; they all hold the same
+settings, in the format of their name.
+
 
 The -logflags value is a sum of the following:
 
@@ -134,6 +146,19 @@ above). The value 0 is used to disable all of the above. The default is to
 show time only (2).
 
 
+Overriding Options
+------------------
+
+Options in the config file can be overridden with -option name=value, which
+may be given more than once, or with environment variables such as
+STOPTION_GLOBALANNOUNCEENABLED=false. The name is that of the element in the
+options section of the config file, in any case, and lists are given comma
+separated. Names prefixed with "gui." are those of the GUI section, such as
+-option gui.address=127.0.0.1:8080 or STGUIOPTION_APIKEY=abc123. The flags
+win over the environment, and both over the config file; overridden values
+aren't saved.
+
+
 Development Settings
 --------------------
 
@@ -153,6 +178,8 @@ are mostly useful for developers. Use with care.
                  - "locks"    (the sync package; trace long held locks)
                  - "net"      (the main package; connections & network messages)
                  - "model"    (the model package)
+                 - "natpmp"   (the natpmp package)
+                 - "relay"    (the relay package)
                  - "scanner"  (the scanner package)
                  - "stats"    (the stats package)
                  - "suture"   (the suture package; service management)
@@ -187,6 +214,7 @@ are mostly useful for developers. Use with care.
 // Command line and environment options
 var (
 	reset             bool
+	checkDB           bool
 	showVersion       bool
 	doUpgrade         bool
 	doUpgradeCheck    bool
@@ -197,6 +225,7 @@ var (
 	logFile           string
 	auditEnabled      bool
 	verbose           bool
+	optionFlags       optionOverrides
 	noRestart         = os.Getenv("STNORESTART") != ""
 	noUpgrade         = os.Getenv("STNOUPGRADE") != ""
 	guiAddress        = os.Getenv("STGUIADDRESS") // legacy
@@ -229,12 +258,14 @@ func main() {
 	flag.BoolVar(&noBrowser, "no-browser", false, "Do not start browser")
 	flag.BoolVar(&noRestart, "no-restart", noRestart, "Do not restart; just exit")
 	flag.BoolVar(&reset, "reset", false, "Reset the database")
+	flag.BoolVar(&checkDB, "check-db", false, "Check and repair the database, then exit")
 	flag.BoolVar(&doUpgrade, "upgrade", false, "Perform upgrade")
 	flag.BoolVar(&doUpgradeCheck, "upgrade-check", false, "Check for available upgrade")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.StringVar(&upgradeTo, "upgrade-to", upgradeTo, "Force upgrade directly from specified URL")
 	flag.BoolVar(&auditEnabled, "audit", false, "Write events to audit file")
 	flag.BoolVar(&verbose, "verbose", false, "Print verbose log output")
+	flag.Var(&optionFlags, "option", "Override an option; name=value")
 
 	flag.Usage = usageFor(flag.CommandLine, usage, fmt.Sprintf(extraUsage, baseDirs["config"]))
 	flag.Parse()
@@ -375,6 +406,11 @@ func main() {
 		return
 	}
 
+	if checkDB {
+		checkDatabase()
+		return
+	}
+
 	if noRestart {
 		syncthingMain()
 	} else {
@@ -387,18 +423,30 @@ func upgradeViaRest() error {
 	if err != nil {
 		return err
 	}
-	target := cfg.GUI().Address
-	if cfg.GUI().UseTLS {
+	guiCfg := cfg.GUI()
+	if guiAPIKey != "" {
+		guiCfg.APIKey = guiAPIKey
+	} else if config.IsHashedAPIKey(guiCfg.APIKey) {
+		return fmt.Errorf("the API key in the config file is hashed; give it with -gui-apikey")
+	}
+	target := guiCfg.ListenAddress()
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	switch {
+	case guiCfg.Network() == "unix":
+		tr.Dial = func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", guiCfg.ListenAddress())
+		}
+		target = "http://localhost"
+	case guiCfg.UseTLS:
 		target = "https://" + target
-	} else {
+	default:
 		target = "http://" + target
 	}
 	r, _ := http.NewRequest("POST", target+"/rest/system/upgrade", nil)
-	r.Header.Set("X-API-Key", cfg.GUI().APIKey)
+	r.Header.Set("X-API-Key", guiCfg.APIKey)
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
 	client := &http.Client{
 		Transport: tr,
 		Timeout:   60 * time.Second,
@@ -424,7 +472,7 @@ func syncthingMain() {
 	// We want any logging it does to go through our log system.
 	mainSvc := suture.New("main", suture.Spec{
 		Log: func(line string) {
-			if debugSuture {
+			if debugSuture.Enabled() {
 				l.Debugln(line)
 			}
 		},
@@ -435,8 +483,11 @@ func syncthingMain() {
 	// lines look ugly.
 	l.SetPrefix("[start] ")
 
+	// Keep the recent log lines for the REST API.
+	recentLog.Attach(l)
+
 	if auditEnabled {
-		startAuditing(mainSvc)
+		startAuditing(mainSvc, "")
 	}
 
 	if verbose {
@@ -500,6 +551,15 @@ func syncthingMain() {
 		cfg.Save()
 		l.Infof("Edit %s to taste or use the GUI\n", cfgFile)
 	}
+	cfg.SetHistoryDir(locations[locConfigHistory])
+	if err := overrideOptions(cfg, os.Environ(), optionFlags); err != nil {
+		l.Fatalln("Overriding options:", err)
+	}
+	setReady("config")
+
+	if opts := cfg.Options(); opts.AuditEnabled && !auditEnabled {
+		startAuditing(mainSvc, opts.AuditFile)
+	}
 
 	if cfg.Raw().OriginalVersion != config.CurrentVersion {
 		l.Infoln("Archiving a copy of old config file format")
@@ -553,40 +613,70 @@ func syncthingMain() {
 		symlinks.Supported = false
 	}
 
-	if opts.MaxSendKbps > 0 {
-		writeRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxSendKbps), int64(5*1000*opts.MaxSendKbps))
-	}
-	if opts.MaxRecvKbps > 0 {
-		readRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxRecvKbps), int64(5*1000*opts.MaxRecvKbps))
+	if len(opts.RateLimits) > 0 {
+		// The limits depend on the time of day.
+		writeRateLimit = newScheduledRateLimit(opts.MaxSendKbps, opts.RateLimits, func(w config.RateLimitWindow) int { return w.MaxSendKbps })
+		readRateLimit = newScheduledRateLimit(opts.MaxRecvKbps, opts.RateLimits, func(w config.RateLimitWindow) int { return w.MaxRecvKbps })
+	} else {
+		if opts.MaxSendKbps > 0 {
+			writeRateLimit = osutil.NewRateLimit(opts.MaxSendKbps)
+		}
+		if opts.MaxRecvKbps > 0 {
+			readRateLimit = osutil.NewRateLimit(opts.MaxRecvKbps)
+		}
 	}
 
-	if (opts.MaxRecvKbps > 0 || opts.MaxSendKbps > 0) && !opts.LimitBandwidthInLan {
-		lans, _ = osutil.GetLans()
-		networks := make([]string, 0, len(lans))
-		for _, lan := range lans {
-			networks = append(networks, lan.String())
+	// The local networks decide both what isn't rate limited and which
+	// connections are preferred over others.
+	lans, _ = osutil.GetLans()
+	for _, cidr := range opts.AlwaysLocalNets {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			l.Warnf("Always local network %q: %v", cidr, err)
+			continue
 		}
-		l.Infoln("Local networks:", strings.Join(networks, ", "))
+		lans = append(lans, ipnet)
+	}
+	networks := make([]string, 0, len(lans))
+	for _, lan := range lans {
+		networks = append(networks, lan.String())
 	}
+	l.Infoln("Local networks:", strings.Join(networks, ", "))
 
-	dbFile := locations[locDatabase]
-	ldb, err := leveldb.OpenFile(dbFile, dbOpts())
-	if err != nil && errors.IsCorrupted(err) {
-		ldb, err = leveldb.RecoverFile(dbFile, dbOpts())
+	var ldb *leveldb.DB
+	if opts.DatabaseInMemory {
+		// Nothing survives a restart, so everything is scanned again.
+		l.Infoln("Keeping the database in memory")
+		ldb, err = leveldb.Open(storage.NewMemStorage(), dbOpts())
+	} else {
+		dbDir = locations[locDatabase]
+		ldb, err = leveldb.OpenFile(dbDir, dbOpts())
+		if err != nil && errors.IsCorrupted(err) {
+			ldb, err = leveldb.RecoverFile(dbDir, dbOpts())
+		}
 	}
 	if err != nil {
 		l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
 	}
+	for _, res := range db.RepairIfScheduled(ldb) {
+		l.Infoln("Index repair:", res)
+	}
+	setReady("database")
 
-	// Remove database entries for folders that no longer exist in the config
-	folders := cfg.Folders()
-	for _, folder := range db.ListFolders(ldb) {
-		if _, ok := folders[folder]; !ok {
-			l.Infof("Cleaning data for dropped folder %q", folder)
-			db.DropFolder(ldb, folder)
-		}
+	// Carry on with the events kept from the last run, if any
+	eventLog := db.NewEventLog(ldb)
+	if opts.EventLogSize > 0 {
+		eventHistory = restoreEvents(eventLog)
+		eventLogSvc := newEventLogSvc(eventLog, opts)
+		mainSvc.Add(eventLogSvc)
+		eventLogSvc.WaitForStart()
+	} else {
+		eventLog.Truncate(0)
 	}
 
+	dbCompactor = newDBCompactSvc(ldb, dbDir)
+	mainSvc.Add(dbCompactor)
+
 	m := model.NewModel(cfg, myID, myName, "syncthing", Version, ldb)
 	cfg.Subscribe(m)
 	mainSvc.Add(m)
@@ -616,12 +706,39 @@ func syncthingMain() {
 		if folderCfg.ReadOnly {
 			l.Okf("Ready to synchronize %s (read only; no external updates accepted)", folderCfg.ID)
 			m.StartFolderRO(folderCfg.ID)
+		} else if folderCfg.ReceiveOnly {
+			l.Okf("Ready to synchronize %s (receive only; no local changes sent)", folderCfg.ID)
+			m.StartFolderRW(folderCfg.ID)
 		} else {
 			l.Okf("Ready to synchronize %s (read-write)", folderCfg.ID)
 			m.StartFolderRW(folderCfg.ID)
 		}
 	}
 
+	// Remove the database entries of folders that no longer exist in the
+	// config, and of devices that folders are no longer shared with. Large
+	// indexes take a while, so it's done in the background. The model does
+	// the same for what's removed while we're running.
+	go func() {
+		folders := cfg.Folders()
+		for _, folder := range db.ListFolders(ldb) {
+			if _, ok := folders[folder]; !ok {
+				l.Infof("Cleaning data for dropped folder %q", folder)
+				db.DropFolder(ldb, folder)
+			}
+		}
+		m.DropUnsharedDevices()
+	}()
+
+	// Webhooks and notifications, which follow changes to the configuration,
+	// so they always run.
+
+	webhookSvc := newWebhookSvc(cfg.Options().Webhooks)
+	cfg.Subscribe(webhookSvc)
+	mainSvc.Add(webhookSvc)
+	mainSvc.Add(newNotifySvc(m))
+	mainSvc.Add(newDesktopNotifySvc())
+
 	// GUI
 
 	setupGUI(mainSvc, cfg, m)
@@ -636,20 +753,56 @@ func syncthingMain() {
 	// Start discovery
 
 	localPort := addr.Port
+	discover.DefaultLocalBroadcastInterval = time.Duration(opts.LocalAnnIntervalS) * time.Second
+	discover.DefaultGlobalBroadcastInterval = time.Duration(opts.GlobalAnnIntervalS) * time.Second
 	discoverer = discovery(localPort)
+	m.SetAddressBook(discoverer)
 
-	// Start UPnP. The UPnP service will restart global discovery if the
-	// external port changes.
+	// Start UPnP, or PCP and NAT-PMP. The service will restart global
+	// discovery if the external port changes.
 
-	if opts.UPnPEnabled {
+	if opts.UPnPEnabled || opts.NATPMPEnabled {
 		upnpSvc := newUPnPSvc(cfg, localPort)
 		mainSvc.Add(upnpSvc)
 	}
 
+	// Reduce activity while on battery or a metered network.
+
+	power = newPowerSvc(m)
+	mainSvc.Add(power)
+
 	connectionSvc := newConnectionSvc(cfg, myID, m, tlsCfg)
+	connections = connectionSvc
+	relays = connectionSvc.relays
 	cfg.Subscribe(connectionSvc)
 	mainSvc.Add(connectionSvc)
 
+	// Relay connections for other devices, if so configured.
+
+	if opts.RelayServerEnabled {
+		srv, err := newRelayServer(cert, opts)
+		if err != nil {
+			l.Warnln("Relay server:", err)
+		} else {
+			l.Infof("Relay server listening on %v; other devices can use it as relay://<address>:%d/?id=%s", srv.Addr(), srv.Addr().(*net.TCPAddr).Port, myID)
+			relayServer = srv
+			mainSvc.Add(srv)
+		}
+	}
+
+	// Global discovery for other devices, if so configured.
+
+	if opts.DiscoSrvEnabled {
+		srv, err := newDiscoveryServer(opts)
+		if err != nil {
+			l.Warnln("Discovery server:", err)
+		} else {
+			l.Infof("Discovery server listening on %v; other devices can use it as udp4://<address>:%d", srv.Addr(), srv.Addr().(*net.UDPAddr).Port)
+			discoSrv = srv
+			mainSvc.Add(srv)
+		}
+	}
+
 	if cpuProfile {
 		f, err := os.Create(fmt.Sprintf("cpu-%d.pprof", os.Getpid()))
 		if err != nil {
@@ -747,9 +900,17 @@ func dbOpts() *opt.Options {
 	}
 }
 
-func startAuditing(mainSvc *suture.Supervisor) {
-	auditFile := timestampedLoc(locAuditLog)
-	fd, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+// startAuditing starts writing the audit log to the given file, appending
+// to it, or to a new timestamped file when none is given.
+func startAuditing(mainSvc *suture.Supervisor, auditFile string) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if auditFile == "" {
+		auditFile = timestampedLoc(locAuditLog)
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	} else if !filepath.IsAbs(auditFile) {
+		auditFile = filepath.Join(baseDirs["config"], auditFile)
+	}
+	fd, err := os.OpenFile(auditFile, flags, 0600)
 	if err != nil {
 		l.Fatalln("Audit:", err)
 	}
@@ -768,7 +929,15 @@ func setupGUI(mainSvc *suture.Supervisor, cfg *config.Wrapper, m *model.Model) {
 	opts := cfg.Options()
 	guiCfg := overrideGUIConfig(cfg.GUI(), guiAddress, guiAuthentication, guiAPIKey)
 
-	if guiCfg.Enabled && guiCfg.Address != "" {
+	if guiCfg.Enabled && guiCfg.Network() == "unix" {
+		l.Infoln("Starting web GUI on Unix socket", guiCfg.ListenAddress())
+		api, err := newAPISvc(guiCfg, guiAssets, m)
+		if err != nil {
+			l.Fatalln("Cannot start GUI:", err)
+		}
+		cfg.Subscribe(api)
+		mainSvc.Add(api)
+	} else if guiCfg.Enabled && guiCfg.Address != "" {
 		addr, err := net.ResolveTCPAddr("tcp", guiCfg.Address)
 		if err != nil {
 			l.Fatalf("Cannot start GUI on %q: %v", guiCfg.Address, err)
@@ -853,6 +1022,28 @@ func resetDB() error {
 	return os.RemoveAll(locations[locDatabase])
 }
 
+// checkDatabase checks and repairs the database, printing what it found.
+func checkDatabase() {
+	dbFile := locations[locDatabase]
+	opts := &opt.Options{OpenFilesCacheCapacity: 100}
+	ldb, err := leveldb.OpenFile(dbFile, opts)
+	if err != nil && errors.IsCorrupted(err) {
+		ldb, err = leveldb.RecoverFile(dbFile, opts)
+	}
+	if err != nil {
+		l.Fatalln("Cannot open database:", err, "- Is Syncthing running?")
+	}
+	defer ldb.Close()
+
+	res := db.CheckIndex(ldb, true)
+	for _, folder := range res {
+		fmt.Println(folder)
+	}
+	if len(res) == 0 {
+		fmt.Println("No folders in the database")
+	}
+}
+
 func restart() {
 	l.Infoln("Restarting")
 	stop <- exitRestarting
@@ -870,6 +1061,9 @@ func discovery(extPort int) *discover.Discoverer {
 	if opts.LocalAnnEnabled {
 		l.Infoln("Starting local discovery announcements")
 		disc.StartLocal(opts.LocalAnnPort, opts.LocalAnnMCAddr)
+		if opts.LocalAnnMDNSEnabled {
+			disc.StartMDNS()
+		}
 	}
 
 	if opts.GlobalAnnEnabled {
@@ -880,6 +1074,24 @@ func discovery(extPort int) *discover.Discoverer {
 	return disc
 }
 
+// newDiscoveryServer returns a global discovery server as given by the
+// options.
+func newDiscoveryServer(opts config.OptionsConfiguration) (*discover.Server, error) {
+	var devices []protocol.DeviceID
+	for _, dev := range opts.DiscoSrvDevices {
+		id, err := protocol.DeviceIDFromString(dev)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, id)
+	}
+
+	return discover.NewServer(discover.ServerOptions{
+		ListenAddress: opts.DiscoSrvListenAddr,
+		Devices:       devices,
+	})
+}
+
 func ensureDir(dir string, mode int) {
 	fi, err := os.Stat(dir)
 	if os.IsNotExist(err) {
@@ -917,12 +1129,59 @@ func getFreePort(host string, ports ...int) (int, error) {
 	return addr.Port, nil
 }
 
+// optionOverrides are the -option flags, each name=value.
+type optionOverrides []string
+
+func (o *optionOverrides) String() string {
+	return strings.Join(*o, " ")
+}
+
+func (o *optionOverrides) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return fmt.Errorf("expected name=value")
+	}
+	*o = append(*o, s)
+	return nil
+}
+
+// overrideOptions overrides the options set in STOPTION_* and GUI options
+// set in STGUIOPTION_* environment variables, and then those in the -option
+// flags.
+func overrideOptions(cfg *config.Wrapper, environ []string, flags []string) error {
+	const prefix, guiPrefix = "STOPTION_", "STGUIOPTION_"
+	var overrides []string
+	for _, env := range environ {
+		switch {
+		case strings.HasPrefix(env, prefix):
+			overrides = append(overrides, env[len(prefix):])
+		case strings.HasPrefix(env, guiPrefix):
+			overrides = append(overrides, "gui."+env[len(guiPrefix):])
+		}
+	}
+	overrides = append(overrides, flags...)
+
+	for _, o := range overrides {
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q is not name=value", o)
+		}
+		if err := cfg.Override(parts[0], parts[1]); err != nil {
+			return err
+		}
+		l.Infof("Option %s overridden", parts[0])
+	}
+	return nil
+}
+
 func overrideGUIConfig(cfg config.GUIConfiguration, address, authentication, apikey string) config.GUIConfiguration {
 	if address != "" {
 		cfg.Enabled = true
 
 		if !strings.Contains(address, "//") {
-			// Assume just an IP was given. Don't touch he TLS setting.
+			// Assume just an IP, or a socket path, was given. Don't touch
+			// the TLS setting.
+			cfg.Address = address
+		} else if strings.HasPrefix(address, "unix://") {
 			cfg.Address = address
 		} else {
 			parsed, err := url.Parse(address)
@@ -1035,6 +1294,8 @@ func cleanConfigDirectory() {
 		"audit-*.log":    7 * 24 * time.Hour,  // keep audit logs for a week
 		"index":          14 * 24 * time.Hour, // keep old index format for two weeks
 		"config.xml.v*":  30 * 24 * time.Hour, // old config versions for a month
+		"config.json.v*": 30 * 24 * time.Hour, // likewise
+		"config.yaml.v*": 30 * 24 * time.Hour, // likewise
 		"*.idx.gz":       30 * 24 * time.Hour, // these should for sure no longer exist
 		"backup-of-v0.8": 30 * 24 * time.Hour, // these neither
 	}
@@ -178,3 +178,22 @@ func TestShortIDCheck(t *testing.T) {
 		t.Error("Should have gotten an error")
 	}
 }
+
+func TestOverrideOptions(t *testing.T) {
+	w := config.Wrap("/tmp/test", config.New(protocol.LocalDeviceID))
+	environ := []string{"HOME=/root", "STOPTION_MAXSENDKBPS=10", "STOPTION_MAXRECVKBPS=20", "STGUIOPTION_APIKEY=abc123"}
+
+	if err := overrideOptions(w, environ, []string{"maxRecvKbps=30", "gui.address=127.0.0.1:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	if opts := w.Options(); opts.MaxSendKbps != 10 || opts.MaxRecvKbps != 30 {
+		t.Errorf("Incorrect overrides %d, %d", opts.MaxSendKbps, opts.MaxRecvKbps)
+	}
+	if gui := w.GUI(); gui.Address != "127.0.0.1:8080" || !config.APIKeyMatches(gui.APIKey, "abc123") {
+		t.Errorf("Incorrect GUI overrides %q, %q", gui.Address, gui.APIKey)
+	}
+
+	if err := overrideOptions(w, []string{"STOPTION_NONEXISTENT=1"}, nil); err == nil {
+		t.Error("Unexpected nil error for an unknown option")
+	}
+}
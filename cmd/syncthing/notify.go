@@ -0,0 +1,228 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/stats"
+)
+
+// The same problem is mailed about at most this often, or once until it's
+// resolved for folder errors.
+const notifyRepeatInterval = 24 * time.Hour
+
+// The notifySvc sends mail about the problems that the options ask to be
+// notified of: folders stopping with an error, running out of disk space,
+// and devices staying disconnected.
+type notifySvc struct {
+	model *model.Model
+	send  func(opts config.OptionsConfiguration, subject, body string) error
+
+	sent         map[string]time.Time            // by problem
+	disconnected map[protocol.DeviceID]time.Time // since when
+	stop         chan struct{}
+}
+
+func newNotifySvc(m *model.Model) *notifySvc {
+	return &notifySvc{
+		model:        m,
+		send:         sendMail,
+		sent:         make(map[string]time.Time),
+		disconnected: make(map[protocol.DeviceID]time.Time),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Serve runs the notification service.
+func (s *notifySvc) Serve() {
+	sub := events.Default.Subscribe(events.StateChanged | events.ItemFinished | events.DeviceConnected | events.DeviceDisconnected)
+	defer events.Default.Unsubscribe(sub)
+
+	// After subscribing, so that devices connecting now aren't missed.
+	s.seedDisconnected(s.model.DeviceStatistics(), s.model.ConnectedTo, time.Now())
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-sub.C():
+			s.handleEvent(ev, cfg.Options())
+		case <-ticker.C:
+			s.checkDevices(cfg.Options(), time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the notification service.
+func (s *notifySvc) Stop() {
+	close(s.stop)
+}
+
+func (s *notifySvc) handleEvent(ev events.Event, opts config.OptionsConfiguration) {
+	switch ev.Type {
+	case events.DeviceConnected:
+		data, _ := ev.Data.(map[string]string)
+		if id, err := protocol.DeviceIDFromString(data["id"]); err == nil {
+			delete(s.disconnected, id)
+			delete(s.sent, "device "+id.String())
+		}
+
+	case events.DeviceDisconnected:
+		data, _ := ev.Data.(map[string]string)
+		if id, err := protocol.DeviceIDFromString(data["id"]); err == nil {
+			s.disconnected[id] = ev.Time
+		}
+
+	case events.StateChanged:
+		data, _ := ev.Data.(map[string]interface{})
+		folder, _ := data["folder"].(string)
+		if data["to"] != "error" {
+			if data["from"] == "error" {
+				delete(s.sent, "folder "+folder)
+			}
+			return
+		}
+		errStr, _ := data["error"].(string)
+		if isFreeSpaceError(errStr) {
+			if opts.NotifyLowDiskSpace {
+				s.notify(opts, "space "+folder, fmt.Sprintf("Folder %q is out of disk space", folder), errStr)
+			}
+		} else if opts.NotifyFolderErrors {
+			s.notify(opts, "folder "+folder, fmt.Sprintf("Folder %q stopped with an error", folder), errStr)
+		}
+
+	case events.ItemFinished:
+		// Running out of space while pulling a file doesn't stop the
+		// folder, but is worth knowing about all the same.
+		data, _ := ev.Data.(map[string]interface{})
+		folder, _ := data["folder"].(string)
+		errStr, _ := data["error"].(*string)
+		if opts.NotifyLowDiskSpace && errStr != nil && isFreeSpaceError(*errStr) {
+			s.notify(opts, "space "+folder, fmt.Sprintf("Folder %q is out of disk space", folder), *errStr)
+		}
+	}
+}
+
+// seedDisconnected counts the devices that aren't connected as disconnected
+// since they were last seen, or since now if they never were, so that devices
+// that went offline before a restart are noticed too.
+func (s *notifySvc) seedDisconnected(devStats map[string]stats.DeviceStatistics, connected func(protocol.DeviceID) bool, now time.Time) {
+	for idStr, st := range devStats {
+		id, err := protocol.DeviceIDFromString(idStr)
+		if err != nil || id == myID || connected(id) {
+			continue
+		}
+		since := st.LastSeen
+		if !since.After(time.Unix(0, 0)) {
+			since = now
+		}
+		if _, ok := s.disconnected[id]; !ok {
+			s.disconnected[id] = since
+		}
+	}
+}
+
+// checkDevices notifies of the devices that have been disconnected longer
+// than the options allow.
+func (s *notifySvc) checkDevices(opts config.OptionsConfiguration, now time.Time) {
+	if opts.NotifyDeviceOfflineH <= 0 {
+		return
+	}
+	limit := time.Duration(opts.NotifyDeviceOfflineH) * time.Hour
+	devices := cfg.Devices()
+	for id, since := range s.disconnected {
+		device, ok := devices[id]
+		if !ok {
+			// Removed from the configuration since.
+			delete(s.disconnected, id)
+			continue
+		}
+		if now.Sub(since) < limit {
+			continue
+		}
+		name := device.Name
+		if name == "" {
+			name = id.String()
+		}
+		body := fmt.Sprintf("Device %s (%s) has been disconnected since %s.", name, id, since.Format(time.RFC1123))
+		s.notify(opts, "device "+id.String(), fmt.Sprintf("Device %s is offline", name), body)
+	}
+}
+
+// notify sends the mail about the problem, unless it was sent recently.
+func (s *notifySvc) notify(opts config.OptionsConfiguration, problem, subject, body string) {
+	if opts.SMTP.Address == "" || len(opts.SMTP.To) == 0 {
+		return
+	}
+	if last, ok := s.sent[problem]; ok && time.Since(last) < notifyRepeatInterval {
+		return
+	}
+	s.sent[problem] = time.Now()
+
+	if err := s.send(opts, subject, body); err != nil {
+		l.Warnln("Sending notification mail:", err)
+	}
+}
+
+func isFreeSpaceError(err string) bool {
+	return strings.Contains(err, "insufficient free space")
+}
+
+// sendMail sends the mail using the SMTP settings in the options.
+func sendMail(opts config.OptionsConfiguration, subject, body string) error {
+	smtpCfg := opts.SMTP
+	from := smtpCfg.From
+	if from == "" {
+		from = "syncthing@localhost"
+	}
+
+	var auth smtp.Auth
+	if smtpCfg.User != "" {
+		host, _, err := net.SplitHostPort(smtpCfg.Address)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", smtpCfg.User, smtpCfg.Password, host)
+	}
+
+	// Folder IDs and device names end up in the subject, and mustn't add
+	// headers of their own.
+	subject = headerEscaper.Replace(fmt.Sprintf("[Syncthing %s] %s", myDeviceName(), subject))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(smtpCfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	msg.WriteString("\r\n")
+
+	return smtp.SendMail(smtpCfg.Address, auth, from, smtpCfg.To, msg.Bytes())
+}
+
+var headerEscaper = strings.NewReplacer("\r", " ", "\n", " ")
+
+func myDeviceName() string {
+	if device, ok := cfg.Devices()[myID]; ok && device.Name != "" {
+		return device.Name
+	}
+	return myID.String()[:7]
+}
@@ -0,0 +1,109 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/stats"
+)
+
+func TestNotify(t *testing.T) {
+	device, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = config.Wrap("/dev/null", config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device, Name: "nas"}},
+	})
+
+	opts := config.OptionsConfiguration{
+		SMTP:                 config.SMTPConfiguration{Address: "localhost:25", To: []string{"admin@example.com"}},
+		NotifyFolderErrors:   true,
+		NotifyLowDiskSpace:   true,
+		NotifyDeviceOfflineH: 2,
+	}
+
+	var subjects []string
+	s := newNotifySvc(nil)
+	s.send = func(opts config.OptionsConfiguration, subject, body string) error {
+		subjects = append(subjects, subject)
+		return nil
+	}
+	expect := func(what string, n int) {
+		if len(subjects) != n {
+			t.Fatalf("%s: %d mails sent, expected %d: %q", what, len(subjects), n, subjects)
+		}
+	}
+	state := func(from, to, err string) events.Event {
+		data := map[string]interface{}{"folder": "default", "from": from, "to": to}
+		if err != "" {
+			data["error"] = err
+		}
+		return events.Event{Type: events.StateChanged, Data: data}
+	}
+
+	s.handleEvent(state("idle", "error", "folder path missing"), opts)
+	expect("folder error", 1)
+	s.handleEvent(state("error", "error", "folder marker missing"), opts)
+	expect("changed folder error", 1)
+	s.handleEvent(state("error", "idle", ""), opts)
+	s.handleEvent(state("idle", "error", "folder path missing"), opts)
+	expect("recurring folder error", 2)
+
+	noSpace := "insufficient free space (1 MiB free, at least 10 MiB required)"
+	s.handleEvent(events.Event{Type: events.ItemFinished, Data: map[string]interface{}{"folder": "default", "error": &noSpace}}, opts)
+	s.handleEvent(state("idle", "error", noSpace), opts)
+	expect("disk space", 3)
+
+	now := time.Now()
+	s.handleEvent(events.Event{Type: events.DeviceDisconnected, Time: now, Data: map[string]string{"id": device.String()}}, opts)
+	s.checkDevices(opts, now.Add(time.Hour))
+	expect("device offline briefly", 3)
+	s.checkDevices(opts, now.Add(3*time.Hour))
+	expect("device offline", 4)
+	if subjects[3] != "Device nas is offline" {
+		t.Errorf("Incorrect subject %q", subjects[3])
+	}
+	s.handleEvent(events.Event{Type: events.DeviceConnected, Data: map[string]string{"id": device.String()}}, opts)
+	s.checkDevices(opts, now.Add(4*time.Hour))
+	expect("device back", 4)
+}
+
+func TestNotifySeedDisconnected(t *testing.T) {
+	seen, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	never := protocol.DeviceID{1}
+	connected := protocol.DeviceID{2}
+
+	now := time.Now()
+	lastSeen := now.Add(-5 * time.Hour)
+	s := newNotifySvc(nil)
+	s.seedDisconnected(map[string]stats.DeviceStatistics{
+		seen.String():      {LastSeen: lastSeen},
+		never.String():     {LastSeen: time.Unix(0, 0)},
+		connected.String(): {LastSeen: now},
+	}, func(id protocol.DeviceID) bool { return id == connected }, now)
+
+	if since := s.disconnected[seen]; !since.Equal(lastSeen) {
+		t.Errorf("Device disconnected since %v, expected %v", since, lastSeen)
+	}
+	if since := s.disconnected[never]; !since.Equal(now) {
+		t.Errorf("Device never seen disconnected since %v, expected now", since)
+	}
+	if _, ok := s.disconnected[connected]; ok {
+		t.Error("Connected device counted as disconnected")
+	}
+}
+
+func TestMailSubjectHeaders(t *testing.T) {
+	if s := headerEscaper.Replace("Folder \"a\r\nBcc: x@example.com\" stopped"); s != `Folder "a  Bcc: x@example.com" stopped` {
+		t.Errorf("Incorrect subject %q", s)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const powerCheckIntv = time.Minute
+
+// The power modes that can be set over the REST interface. In the automatic
+// mode activity is reduced while on battery power or a metered network.
+const (
+	powerModeAuto    = "auto"
+	powerModeReduced = "reduced"
+	powerModeNormal  = "normal"
+)
+
+// The powerSvc keeps an eye on the power and network state and reduces
+// activity (less frequent scans, no large pulls, fewer local discovery
+// announcements) while on battery power or a metered network.
+type powerSvc struct {
+	model   *model.Model
+	stop    chan struct{}
+	changed chan struct{}
+
+	mode      string
+	metered   bool // as told over the REST interface; we can't detect it
+	onBattery bool
+	reduced   bool
+	mut       sync.Mutex
+}
+
+func newPowerSvc(m *model.Model) *powerSvc {
+	return &powerSvc{
+		model:   m,
+		stop:    make(chan struct{}),
+		changed: make(chan struct{}, 1),
+		mode:    powerModeAuto,
+		mut:     sync.NewMutex(),
+	}
+}
+
+func (s *powerSvc) Serve() {
+	t := time.NewTicker(powerCheckIntv)
+	defer t.Stop()
+
+	for {
+		s.update()
+
+		select {
+		case <-t.C:
+		case <-s.changed:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *powerSvc) Stop() {
+	close(s.stop)
+}
+
+func (s *powerSvc) update() {
+	onBattery := osutil.OnBattery()
+
+	s.mut.Lock()
+	s.onBattery = onBattery
+	switch s.mode {
+	case powerModeReduced:
+		s.reduced = true
+	case powerModeNormal:
+		s.reduced = false
+	default:
+		s.reduced = s.onBattery || s.metered
+	}
+	reduced := s.reduced
+	s.mut.Unlock()
+
+	if debugNet.Enabled() {
+		l.Debugf("power: on battery %v, reduced %v", onBattery, reduced)
+	}
+
+	s.model.SetReducedActivity(reduced)
+	if discoverer != nil {
+		discoverer.SetReduced(reduced)
+	}
+}
+
+// SetMode overrides the detected state with one of the power modes, and sets
+// whether the network is metered.
+func (s *powerSvc) SetMode(mode string, metered bool) bool {
+	switch mode {
+	case powerModeAuto, powerModeReduced, powerModeNormal:
+	default:
+		return false
+	}
+
+	s.mut.Lock()
+	s.mode = mode
+	s.metered = metered
+	s.mut.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *powerSvc) Status() map[string]interface{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return map[string]interface{}{
+		"mode":      s.mode,
+		"metered":   s.metered,
+		"onBattery": s.onBattery,
+		"reduced":   s.reduced,
+	}
+}
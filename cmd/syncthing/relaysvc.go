@@ -0,0 +1,376 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/relay"
+	"github.com/syncthing/syncthing/internal/socks"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	relayTimeout        = 10 * time.Second
+	relayReselectIntv   = time.Hour
+	relayDialCandidates = 3 // the number of pool relays tried when dialing a device
+)
+
+var errNoRelay = errors.New("no relay could reach the device")
+
+// The relaySvc keeps us joined to the relay with the lowest latency, so that
+// devices that can't reach us directly can connect through it, and connects
+// to devices through relays when they can't be reached directly.
+type relaySvc struct {
+	cfg         *config.Wrapper
+	tlsCfg      *tls.Config
+	conns       chan<- typedConn
+	invitations chan relay.SessionInvitation
+	stop        chan struct{}
+
+	client *relay.Client
+	relays []relayStatus // sorted by latency, unreachable ones last
+	mut    sync.Mutex
+}
+
+type relayStatus struct {
+	URI     string `json:"uri"`
+	Latency int    `json:"latencyMs"`
+	Error   string `json:"error,omitempty"`
+}
+
+type relaysByLatency []relayStatus
+
+func (l relaysByLatency) Len() int      { return len(l) }
+func (l relaysByLatency) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l relaysByLatency) Less(a, b int) bool {
+	if (l[a].Error == "") != (l[b].Error == "") {
+		return l[a].Error == ""
+	}
+	return l[a].Latency < l[b].Latency
+}
+
+func newRelaySvc(cfg *config.Wrapper, tlsCfg *tls.Config, conns chan<- typedConn) *relaySvc {
+	return &relaySvc{
+		cfg:         cfg,
+		tlsCfg:      tlsCfg,
+		conns:       conns,
+		invitations: make(chan relay.SessionInvitation),
+		stop:        make(chan struct{}),
+		mut:         sync.NewMutex(),
+	}
+}
+
+func (s *relaySvc) Serve() {
+	t := time.NewTimer(0)
+	defer t.Stop()
+
+	for {
+		select {
+		case inv := <-s.invitations:
+			go s.acceptInvitation(inv)
+
+		case <-t.C:
+			s.update()
+			t.Reset(relayReselectIntv)
+
+		case <-s.stop:
+			s.mut.Lock()
+			if s.client != nil {
+				s.client.Stop()
+				s.client = nil
+			}
+			s.mut.Unlock()
+			return
+		}
+	}
+}
+
+func (s *relaySvc) Stop() {
+	close(s.stop)
+}
+
+// update measures the latency to the relays and joins the best one, unless
+// we are already joined to one that is still available.
+func (s *relaySvc) update() {
+	opts := s.cfg.Options()
+	if !opts.RelaysEnabled {
+		s.mut.Lock()
+		if s.client != nil {
+			s.client.Stop()
+			s.client = nil
+		}
+		s.relays = nil
+		s.mut.Unlock()
+		return
+	}
+
+	dialer := relayDialer{s.cfg}
+	relays := measureRelays(relayURIs(opts.RelayServers, dialer), s.tlsCfg.Certificates, dialer)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.relays = relays
+	if len(relays) == 0 || relays[0].Error != "" {
+		l.Infoln("No relay available")
+		return
+	}
+
+	if s.client != nil {
+		if connected, _ := s.client.Status(); connected {
+			for _, r := range relays {
+				if r.URI == s.client.URI().String() && r.Error == "" {
+					return
+				}
+			}
+		}
+		s.client.Stop()
+	}
+
+	uri, _ := url.Parse(relays[0].URI)
+	s.client = relay.NewClient(uri, s.tlsCfg.Certificates, relayDialer{s.cfg}, relayTimeout, s.invitations)
+	go s.client.Serve()
+}
+
+// acceptInvitation joins the session another device set up with us, and
+// hands the connection to the connection service.
+func (s *relaySvc) acceptInvitation(inv relay.SessionInvitation) {
+	if debugNet.Enabled() {
+		l.Debugf("relay invitation from %s", protocol.DeviceIDFromBytes(inv.From))
+	}
+
+	tc, err := s.joinSession(inv)
+	if err != nil {
+		l.Infoln("Relayed connection:", err)
+		return
+	}
+	s.conns <- typedConn{tc, connTypeRelay}
+}
+
+// dial connects to the device through a relay; those given as relay://
+// addresses of the device, or with a dynamic address, the pool relays with
+// the lowest latency.
+func (s *relaySvc) dial(deviceCfg config.DeviceConfiguration) (*tls.Conn, error) {
+	var uris []string
+	dynamic := false
+	for _, addr := range deviceCfg.Addresses {
+		if strings.HasPrefix(addr, "relay://") {
+			uris = append(uris, addr)
+		} else if addr == "dynamic" {
+			dynamic = true
+		}
+	}
+	if dynamic {
+		s.mut.Lock()
+		for i := 0; i < len(s.relays) && i < relayDialCandidates && s.relays[i].Error == ""; i++ {
+			uris = append(uris, s.relays[i].URI)
+		}
+		s.mut.Unlock()
+	}
+
+	for _, uriStr := range uris {
+		uri, err := url.Parse(uriStr)
+		if err != nil {
+			continue
+		}
+		// The relay and the session address it gives must both be in the
+		// allowed networks of the device, if it has any.
+		if len(deviceCfg.AllowedNets) > 0 && len(allowedAddrs(deviceCfg.AllowedNets, []string{uri.Host})) == 0 {
+			continue
+		}
+		inv, err := relay.GetInvitation(uri, deviceCfg.DeviceID, s.tlsCfg.Certificates, relayDialer{s.cfg}, relayTimeout)
+		if err != nil {
+			if debugNet.Enabled() {
+				l.Debugf("relay %s: %v", uri, err)
+			}
+			continue
+		}
+		if len(deviceCfg.AllowedNets) > 0 && len(allowedAddrs(deviceCfg.AllowedNets, []string{net.IP(inv.Address).String()})) == 0 {
+			continue
+		}
+		tc, err := s.joinSession(inv)
+		if err != nil {
+			if debugNet.Enabled() {
+				l.Debugf("relay %s: %v", uri, err)
+			}
+			continue
+		}
+		return tc, nil
+	}
+	return nil, errNoRelay
+}
+
+// joinSession joins the relay session and sets up TLS over it, on the side
+// given by the invitation.
+func (s *relaySvc) joinSession(inv relay.SessionInvitation) (*tls.Conn, error) {
+	conn, err := relay.JoinSession(inv, relayDialer{s.cfg}, relayTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var tc *tls.Conn
+	if inv.ServerSocket {
+		tc = tls.Server(conn, s.tlsCfg)
+	} else {
+		tc = tls.Client(conn, s.tlsCfg)
+	}
+	tc.SetDeadline(time.Now().Add(relayTimeout))
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+func (s *relaySvc) Status() map[string]interface{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	status := map[string]interface{}{
+		"enabled": s.cfg.Options().RelaysEnabled,
+		"relays":  s.relays,
+	}
+	if s.client != nil {
+		connected, err := s.client.Status()
+		status["joined"] = s.client.URI().String()
+		status["connected"] = connected
+		if err != nil {
+			status["error"] = err.Error()
+		}
+	}
+	return status
+}
+
+// newRelayServer returns a relay server as given by the options.
+func newRelayServer(cert tls.Certificate, opts config.OptionsConfiguration) (*relay.Server, error) {
+	var devices []protocol.DeviceID
+	for _, dev := range opts.RelayServerDevices {
+		id, err := protocol.DeviceIDFromString(dev)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, id)
+	}
+
+	return relay.NewServer(cert, relay.ServerOptions{
+		ListenAddress:  opts.RelayServerListenAddr,
+		SessionAddress: opts.RelayServerSessionAddr,
+		MaxKbps:        opts.RelayServerMaxKbps,
+		SessionKbps:    opts.RelayServerSessionKbps,
+		Devices:        devices,
+	})
+}
+
+// relayURIs returns the relay addresses given in the configuration, with
+// the relay pools resolved into the relays they list.
+func relayURIs(servers []string, dialer relay.Dialer) []string {
+	var uris []string
+	for _, srv := range servers {
+		if !strings.HasPrefix(srv, "dynamic+") {
+			uris = append(uris, srv)
+			continue
+		}
+
+		pool, err := fetchRelayPool(strings.TrimPrefix(srv, "dynamic+"), dialer)
+		if err != nil {
+			l.Infoln("Fetching relay pool:", err)
+			continue
+		}
+		uris = append(uris, pool...)
+	}
+	return uris
+}
+
+func fetchRelayPool(poolURL string, dialer relay.Dialer) ([]string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{Dial: dialer.Dial},
+		Timeout:   relayTimeout,
+	}
+	resp, err := client.Get(poolURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var pool struct {
+		Relays []struct {
+			URL string `json:"url"`
+		} `json:"relays"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pool); err != nil {
+		return nil, err
+	}
+
+	uris := make([]string, 0, len(pool.Relays))
+	for _, r := range pool.Relays {
+		uris = append(uris, r.URL)
+	}
+	return uris, nil
+}
+
+// measureRelays returns the latency to each of the relays, sorted.
+func measureRelays(uris []string, certs []tls.Certificate, dialer relay.Dialer) []relayStatus {
+	res := make([]relayStatus, len(uris))
+	wg := sync.NewWaitGroup()
+	for i, uriStr := range uris {
+		res[i].URI = uriStr
+		uri, err := url.Parse(uriStr)
+		if err != nil {
+			res[i].Error = err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(uri *url.URL, r *relayStatus) {
+			defer wg.Done()
+			latency, err := relay.Latency(uri, certs, dialer, relayTimeout)
+			if err != nil {
+				r.Error = err.Error()
+				return
+			}
+			r.Latency = int(latency / time.Millisecond)
+		}(uri, &res[i])
+	}
+	wg.Wait()
+
+	sort.Sort(relaysByLatency(res))
+	return res
+}
+
+// relayDialer connects to relays, and to the relay pool, through the proxy
+// if one is configured, as connections to other devices are made.
+type relayDialer struct {
+	cfg *config.Wrapper
+}
+
+func (d relayDialer) Dial(network, addr string) (net.Conn, error) {
+	if proxyAddr := d.cfg.Options().ProxyAddress; proxyAddr != "" {
+		proxy, err := socks.Parse(proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		proxy.Timeout = relayTimeout
+		return proxy.Dial(network, addr)
+	}
+	return net.DialTimeout(network, addr, relayTimeout)
+}
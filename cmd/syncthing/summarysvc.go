@@ -182,9 +182,10 @@ func (c *folderSummarySvc) sendSummary(folder string) {
 		// remote device.
 		comp := c.model.Completion(devCfg.DeviceID, folder)
 		events.Default.Log(events.FolderCompletion, map[string]interface{}{
-			"folder":     folder,
-			"device":     devCfg.DeviceID.String(),
-			"completion": comp,
+			"folder":      folder,
+			"device":      devCfg.DeviceID.String(),
+			"completion":  comp,
+			"remoteState": c.model.RemoteFolderState(devCfg.DeviceID, folder),
 		})
 	}
 }
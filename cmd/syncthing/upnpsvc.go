@@ -11,11 +11,15 @@ import (
 	"time"
 
 	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/natpmp"
 	"github.com/syncthing/syncthing/internal/upnp"
 )
 
 // The UPnP service runs a loop for discovery of IGDs (Internet Gateway
-// Devices) and setup/renewal of a port mapping.
+// Devices) and setup/renewal of a port mapping. When there is no IGD, the
+// mapping is instead requested from the default gateway with PCP or
+// NAT-PMP. The IPv6 gateway is asked to open a pinhole to the listen port
+// with PCP.
 type upnpSvc struct {
 	cfg       *config.Wrapper
 	localPort int
@@ -35,16 +39,37 @@ func (s *upnpSvc) Serve() {
 	s.stop = make(chan struct{})
 
 	for {
-		igds := upnp.Discover(time.Duration(s.cfg.Options().UPnPTimeoutS) * time.Second)
+		opts := s.cfg.Options()
+		timeout := time.Duration(opts.UPnPTimeoutS) * time.Second
+
+		var igds []upnp.IGD
+		if opts.UPnPEnabled {
+			igds = upnp.Discover(timeout)
+		}
+		var gws4, gws6 []*natpmp.Gateway
+		if opts.NATPMPEnabled {
+			for _, gw := range natpmp.Discover(timeout) {
+				if gw.IPv6() {
+					gws6 = append(gws6, gw)
+				} else {
+					gws4 = append(gws4, gw)
+				}
+			}
+		}
+
 		if len(igds) > 0 {
 			foundIGD = true
 			extPort = s.tryIGDs(igds, extPort)
-		} else if foundIGD {
-			// Only print a notice if we've previously found an IGD or this is
-			// the first time around.
-			foundIGD = false
-			l.Infof("No UPnP device detected")
+		} else {
+			if foundIGD && opts.UPnPEnabled {
+				// Only print a notice if we've previously found an IGD or this
+				// is the first time around.
+				foundIGD = false
+				l.Infof("No UPnP device detected")
+			}
+			extPort = s.tryGateways(gws4, extPort)
 		}
+		s.openPinholes(gws6)
 
 		d := time.Duration(s.cfg.Options().UPnPRenewalM) * time.Minute
 		if d == 0 {
@@ -76,15 +101,10 @@ func (s *upnpSvc) tryIGDs(igds []upnp.IGD, prevExtPort int) int {
 		}
 
 		if extPort != prevExtPort {
-			// External port changed; refresh the discovery announcement.
-			// TODO: Don't reach out to some magic global here?
 			l.Infof("New UPnP port mapping: external port %d to local port %d.", extPort, s.localPort)
-			if s.cfg.Options().GlobalAnnEnabled {
-				discoverer.StopGlobal()
-				discoverer.StartGlobal(s.cfg.Options().GlobalAnnServers, uint16(extPort))
-			}
+			s.announce(extPort)
 		}
-		if debugNet {
+		if debugNet.Enabled() {
 			l.Debugf("Created/updated UPnP port mapping for external port %d on device %s.", extPort, igd.FriendlyIdentifier())
 		}
 		return extPort
@@ -93,6 +113,68 @@ func (s *upnpSvc) tryIGDs(igds []upnp.IGD, prevExtPort int) int {
 	return 0
 }
 
+// tryGateways requests a mapping from the PCP or NAT-PMP gateways, and
+// returns the external port of the first one that works.
+func (s *upnpSvc) tryGateways(gws []*natpmp.Gateway, prevExtPort int) int {
+	lease := s.natpmpLease()
+	suggested := prevExtPort
+	if suggested == 0 {
+		suggested = s.localPort
+	}
+
+	for _, gw := range gws {
+		m, err := gw.AddPortMapping(natpmp.TCP, s.localPort, suggested, lease)
+		if err != nil {
+			if debugNet.Enabled() {
+				l.Debugf("Port mapping on %v: %v", gw, err)
+			}
+			continue
+		}
+
+		if m.ExternalPort != prevExtPort {
+			l.Infof("New port mapping on %v: external port %d to local port %d.", gw, m.ExternalPort, s.localPort)
+			s.announce(m.ExternalPort)
+		}
+		if debugNet.Enabled() {
+			l.Debugf("Created/updated port mapping for external port %d on %v (lifetime %v).", m.ExternalPort, gw, m.Lifetime)
+		}
+		return m.ExternalPort
+	}
+
+	return 0
+}
+
+// openPinholes asks the IPv6 gateways to let connections to the listen port
+// through. The port is the same inside and out, so there is nothing new to
+// announce.
+func (s *upnpSvc) openPinholes(gws []*natpmp.Gateway) {
+	for _, gw := range gws {
+		_, err := gw.AddPortMapping(natpmp.TCP, s.localPort, s.localPort, s.natpmpLease())
+		if debugNet.Enabled() {
+			l.Debugf("Pinhole for port %d on %v: %v", s.localPort, gw, err)
+		}
+	}
+}
+
+func (s *upnpSvc) natpmpLease() time.Duration {
+	lease := time.Duration(s.cfg.Options().UPnPLeaseM) * time.Minute
+	if lease == 0 {
+		// Unlike with UPnP, zero would delete the mapping.
+		lease = time.Hour
+	}
+	return lease
+}
+
+// announce refreshes the discovery announcement after the external port
+// changed.
+// TODO: Don't reach out to some magic global here?
+func (s *upnpSvc) announce(extPort int) {
+	if s.cfg.Options().GlobalAnnEnabled {
+		discoverer.StopGlobal()
+		discoverer.StartGlobal(s.cfg.Options().GlobalAnnServers, uint16(extPort))
+	}
+}
+
 func (s *upnpSvc) tryIGD(igd upnp.IGD, suggestedPort int) (int, error) {
 	var err error
 	leaseTime := s.cfg.Options().UPnPLeaseM * 60
@@ -116,6 +116,12 @@ func (s *verboseSvc) formatEvent(ev events.Event) string {
 	case events.FolderCompletion:
 		data := ev.Data.(map[string]interface{})
 		return fmt.Sprintf("Completion for folder %q on device %v is %v%%", data["folder"], data["device"], data["completion"])
+	case events.FolderQuotaExceeded:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Folder %q has exceeded its quota of %v bytes", data["folder"], data["quotaBytes"])
+	case events.APIRequest:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("API key %q was used for %s %s", data["key"], data["method"], data["path"])
 	case events.FolderSummary:
 		data := ev.Data.(map[string]interface{})
 		sum := data["summary"].(map[string]interface{})
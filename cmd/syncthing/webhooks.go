@@ -0,0 +1,260 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	webhookQueueSize = 100 // events waiting per URL before we drop some
+	webhookAttempts  = 5
+)
+
+// The delay before the first retry of a failed post; it doubles for every
+// further attempt.
+var webhookRetryDelay = 2 * time.Second
+
+// The webhookSvc posts events to the webhooks in the configuration, one
+// event per request, in order per webhook. Failed posts are retried with
+// backoff for a while before the event is given up on.
+type webhookSvc struct {
+	client  *http.Client
+	senders []*webhookSender // one per webhook
+	mut     sync.Mutex       // protects senders
+	stop    chan struct{}
+}
+
+// A webhookSender posts the events queued for a webhook, until it's stopped
+// because the webhook was changed or removed.
+type webhookSender struct {
+	hook   config.Webhook
+	filter eventFilter
+	queue  chan []byte
+	stop   chan struct{}
+}
+
+func newWebhookSvc(hooks []config.Webhook) *webhookSvc {
+	s := &webhookSvc{
+		client: &http.Client{Timeout: 30 * time.Second},
+		mut:    sync.NewMutex(),
+		stop:   make(chan struct{}),
+	}
+	s.setHooks(hooks)
+	return s
+}
+
+// Serve runs the webhook service.
+func (s *webhookSvc) Serve() {
+	sub := events.Default.Subscribe(events.AllEvents)
+	defer events.Default.Unsubscribe(sub)
+
+	for {
+		select {
+		case ev := <-sub.C():
+			s.dispatch(ev)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the webhook service and its senders.
+func (s *webhookSvc) Stop() {
+	close(s.stop)
+	s.setHooks(nil)
+}
+
+func (s *webhookSvc) String() string {
+	return "webhookSvc"
+}
+
+// setHooks starts senders for the webhooks, keeping those of webhooks that
+// are unchanged and stopping the rest, along with what they had queued.
+func (s *webhookSvc) setHooks(hooks []config.Webhook) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	old := s.senders
+	s.senders = nil
+	for _, hook := range hooks {
+		filter, err := webhookFilter(hook)
+		if err != nil {
+			// Refused by VerifyConfiguration, unless it was in the file.
+			l.Warnf("Webhook at %s: %v", webhookHost(hook.URL), err)
+			continue
+		}
+
+		var sender *webhookSender
+		for i, o := range old {
+			if o != nil && reflect.DeepEqual(o.hook, hook) {
+				sender, old[i] = o, nil
+				break
+			}
+		}
+		if sender == nil {
+			sender = &webhookSender{
+				hook:   hook,
+				filter: filter,
+				queue:  make(chan []byte, webhookQueueSize),
+				stop:   make(chan struct{}),
+			}
+			go s.send(sender)
+		}
+		s.senders = append(s.senders, sender)
+	}
+	for _, o := range old {
+		if o != nil {
+			close(o.stop)
+		}
+	}
+}
+
+// dispatch queues the event for the webhooks it matches.
+func (s *webhookSvc) dispatch(ev events.Event) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, sender := range s.senders {
+		if !sender.filter.match(ev) {
+			continue
+		}
+		body, err := webhookBody(sender.hook, ev)
+		if err != nil {
+			continue
+		}
+		select {
+		case sender.queue <- body:
+		default:
+			l.Infof("Webhook at %s is falling behind; dropping event %d", webhookHost(sender.hook.URL), ev.ID)
+		}
+	}
+}
+
+func (s *webhookSvc) send(sender *webhookSender) {
+	for {
+		select {
+		case body := <-sender.queue:
+			s.post(sender.hook.URL, body, sender.stop)
+		case <-sender.stop:
+			return
+		}
+	}
+}
+
+// post posts the body to the URL, retrying on network errors and on the
+// responses that suggest trying again later, until stop is closed.
+func (s *webhookSvc) post(url string, body []byte, stop <-chan struct{}) {
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := s.postOnce(url, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			l.Infof("Webhook at %s: %v; giving up on the event", webhookHost(url), err)
+			return
+		}
+		if debugHTTP.Enabled() {
+			l.Debugf("webhook at %s: %v; retrying in %v", webhookHost(url), err, delay)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		delay *= 2
+	}
+}
+
+func (s *webhookSvc) postOnce(url string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "syncthing/"+Version)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+}
+
+// webhookFilter returns the filter for the event types and folders of the
+// webhook.
+func webhookFilter(hook config.Webhook) (eventFilter, error) {
+	return newEventFilter(url.Values{
+		"events": {strings.Join(hook.Events, ",")},
+		"folder": {strings.Join(hook.Folders, ",")},
+	})
+}
+
+// webhookBody returns the event encoded for the webhook.
+func webhookBody(hook config.Webhook, ev events.Event) ([]byte, error) {
+	if hook.Format != "slack" {
+		return json.Marshal(ev)
+	}
+
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return nil, err
+	}
+	text := fmt.Sprintf("%s on %s: `%s`", ev.Type, myID.String()[:7], data)
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// webhookHost returns the host of the URL for logging, as the rest of it
+// may well be a secret.
+func webhookHost(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return "(invalid URL)"
+}
+
+func (s *webhookSvc) VerifyConfiguration(from, to config.Configuration) error {
+	for _, hook := range to.Options.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook: %q is not an http or https URL", hook.URL)
+		}
+		if _, err := webhookFilter(hook); err != nil {
+			return fmt.Errorf("webhook: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *webhookSvc) CommitConfiguration(from, to config.Configuration) bool {
+	if !reflect.DeepEqual(from.Options.Webhooks, to.Options.Webhooks) {
+		s.setHooks(to.Options.Webhooks)
+	}
+	return true
+}
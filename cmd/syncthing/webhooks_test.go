@@ -0,0 +1,110 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+func TestWebhookRetry(t *testing.T) {
+	oldDelay := webhookRetryDelay
+	defer func() { webhookRetryDelay = oldDelay }()
+	webhookRetryDelay = time.Millisecond
+
+	received := make(chan events.Event, 10)
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		bs, _ := ioutil.ReadAll(r.Body)
+		var ev events.Event
+		if err := json.Unmarshal(bs, &ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer srv.Close()
+
+	s := newWebhookSvc([]config.Webhook{{URL: srv.URL, Events: []string{"FolderCompletion"}, Folders: []string{"default"}}})
+	defer s.Stop()
+	s.dispatch(events.Event{ID: 1, Type: events.FolderCompletion, Data: map[string]interface{}{"folder": "other"}})
+	s.dispatch(events.Event{ID: 2, Type: events.ItemFinished, Data: map[string]interface{}{"folder": "default"}})
+	s.dispatch(events.Event{ID: 3, Type: events.FolderCompletion, Data: map[string]interface{}{"folder": "default"}})
+
+	select {
+	case ev := <-received:
+		if ev.ID != 3 {
+			t.Errorf("Incorrect event %d posted", ev.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event not posted")
+	}
+	if failures != 0 {
+		t.Errorf("%d failures left", failures)
+	}
+}
+
+func TestWebhookVerify(t *testing.T) {
+	cases := map[string]bool{
+		"https://hooks.example.com/x": true,
+		"http://127.0.0.1:8000/":      true,
+		"ftp://example.com/":          false,
+		"hooks.example.com/x":         false,
+	}
+	s := newWebhookSvc(nil)
+	for u, ok := range cases {
+		to := config.Configuration{Options: config.OptionsConfiguration{Webhooks: []config.Webhook{{URL: u}}}}
+		if err := s.VerifyConfiguration(config.Configuration{}, to); (err == nil) != ok {
+			t.Errorf("Unexpected result %v for %s", err, u)
+		}
+	}
+
+	to := config.Configuration{Options: config.OptionsConfiguration{Webhooks: []config.Webhook{{URL: "https://example.com/", Events: []string{"Nonexistent"}}}}}
+	if err := s.VerifyConfiguration(config.Configuration{}, to); err == nil {
+		t.Error("Unexpected nil error for an unknown event type")
+	}
+}
+
+func TestWebhookCommit(t *testing.T) {
+	hook := config.Webhook{URL: "https://hooks.example.com/a"}
+	s := newWebhookSvc([]config.Webhook{hook})
+	defer s.Stop()
+	first := s.senders[0]
+
+	// An unchanged webhook keeps its sender and queue; a changed one gets a
+	// new one, and the old one is stopped.
+
+	other := config.Webhook{URL: "https://hooks.example.com/b"}
+	from := config.Configuration{Options: config.OptionsConfiguration{Webhooks: []config.Webhook{hook}}}
+	to := config.Configuration{Options: config.OptionsConfiguration{Webhooks: []config.Webhook{hook, other}}}
+	s.CommitConfiguration(from, to)
+	if len(s.senders) != 2 || s.senders[0] != first {
+		t.Fatalf("Incorrect senders %v after adding a webhook", s.senders)
+	}
+
+	from, to = to, config.Configuration{Options: config.OptionsConfiguration{Webhooks: []config.Webhook{other}}}
+	s.CommitConfiguration(from, to)
+	if len(s.senders) != 1 || s.senders[0].hook.URL != other.URL {
+		t.Fatalf("Incorrect senders %v after removing a webhook", s.senders)
+	}
+	select {
+	case <-first.stop:
+	default:
+		t.Error("Sender of the removed webhook not stopped")
+	}
+}
@@ -21,6 +21,7 @@ angular.module('syncthing.core')
         // pubic/scope definitions
 
         $scope.completion = {};
+        $scope.remoteState = {};
         $scope.config = {};
         $scope.configInSync = true;
         $scope.connections = {};
@@ -265,6 +266,7 @@ angular.module('syncthing.core')
                 $scope.completion[data.device] = {};
             }
             $scope.completion[data.device][data.folder] = data.completion;
+            setRemoteState(data.device, data.folder, data.remoteState);
 
             var tot = 0,
                 cnt = 0;
@@ -350,6 +352,7 @@ angular.module('syncthing.core')
                     $scope.completion[device] = {};
                 }
                 $scope.completion[device][folder] = data.completion;
+                setRemoteState(device, folder, data.remoteState);
 
                 var tot = 0,
                     cnt = 0;
@@ -366,6 +369,17 @@ angular.module('syncthing.core')
             }).error($scope.emitHTTPError);
         }
 
+        function setRemoteState(device, folder, state) {
+            if (!$scope.remoteState[device]) {
+                $scope.remoteState[device] = {};
+            }
+            if (state) {
+                $scope.remoteState[device][folder] = state;
+            } else {
+                delete $scope.remoteState[device][folder];
+            }
+        }
+
         function refreshConnectionStats() {
             $http.get(urlbase + '/system/connections').success(function (data) {
                 var now = Date.now(),
@@ -595,6 +609,10 @@ angular.module('syncthing.core')
             if ($scope.connections[deviceCfg.deviceID]) {
                 if ($scope.completion[deviceCfg.deviceID] && $scope.completion[deviceCfg.deviceID]._total === 100) {
                     return 'insync';
+                } else if (!isEmptyObject($scope.remoteState[deviceCfg.deviceID] || {})) {
+                    // The device doesn't sync some folder, so the completion
+                    // won't progress.
+                    return 'pausedremotely';
                 } else {
                     return 'syncing';
                 }
@@ -613,6 +631,8 @@ angular.module('syncthing.core')
             if ($scope.connections[deviceCfg.deviceID]) {
                 if ($scope.completion[deviceCfg.deviceID] && $scope.completion[deviceCfg.deviceID]._total === 100) {
                     return 'success';
+                } else if (!isEmptyObject($scope.remoteState[deviceCfg.deviceID] || {})) {
+                    return 'warning';
                 } else {
                     return 'primary';
                 }
@@ -1048,12 +1068,15 @@ angular.module('syncthing.core')
             $('#editFolder').modal();
         };
 
-        $scope.addFolderAndShare = function (folder, device) {
+        $scope.addFolderAndShare = function (folder, device, defaultPath) {
             $scope.dismissFolderRejection(folder, device);
             $scope.currentFolder = {
                 id: folder,
                 selectedDevices: {}
             };
+            if (defaultPath) {
+                $scope.currentFolder.path = defaultPath;
+            }
             $scope.currentFolder.selectedDevices[device] = true;
 
             $scope.currentFolder.rescanIntervalS = 60;
@@ -1084,12 +1107,19 @@ angular.module('syncthing.core')
 
             $('#editFolder').modal('hide');
             folderCfg = $scope.currentFolder;
+            // Keep which introducer shared the folder with the devices that
+            // stay selected.
+            var introducedBy = {};
+            (folderCfg.devices || []).forEach(function (n) {
+                introducedBy[n.deviceID] = n.introducedBy;
+            });
             folderCfg.devices = [];
             folderCfg.selectedDevices[$scope.myID] = true;
             for (var deviceID in folderCfg.selectedDevices) {
                 if (folderCfg.selectedDevices[deviceID] === true) {
                     folderCfg.devices.push({
-                        deviceID: deviceID
+                        deviceID: deviceID,
+                        introducedBy: introducedBy[deviceID] || ''
                     });
                 }
             }
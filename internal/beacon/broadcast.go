@@ -31,7 +31,7 @@ func NewBroadcast(port int) *Broadcast {
 			FailureBackoff:   60 * time.Second,
 			// Only log restarts in debug mode.
 			Log: func(line string) {
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(line)
 				}
 			},
@@ -70,7 +70,7 @@ type broadcastWriter struct {
 }
 
 func (w *broadcastWriter) Serve() {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(w, "starting")
 		defer l.Debugln(w, "stopping")
 	}
@@ -91,7 +91,7 @@ func (w *broadcastWriter) Serve() {
 	for bs := range w.inbox {
 		addrs, err := net.InterfaceAddrs()
 		if err != nil {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("Local discovery (broadcast writer):", err)
 			}
 			continue
@@ -110,7 +110,7 @@ func (w *broadcastWriter) Serve() {
 			dsts = append(dsts, net.IP{0xff, 0xff, 0xff, 0xff})
 		}
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("addresses:", dsts)
 		}
 
@@ -127,7 +127,7 @@ func (w *broadcastWriter) Serve() {
 				return
 			} else if err, ok := err.(net.Error); ok && err.Temporary() {
 				// A transient error. Lets hope for better luck in the future.
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(err)
 				}
 				continue
@@ -136,7 +136,7 @@ func (w *broadcastWriter) Serve() {
 				l.Infoln("Local discovery (broadcast writer):", err)
 				w.failed = true
 				return
-			} else if debug {
+			} else if debug.Enabled() {
 				l.Debugf("sent %d bytes to %s", len(bs), dst)
 			}
 		}
@@ -159,7 +159,7 @@ type broadcastReader struct {
 }
 
 func (r *broadcastReader) Serve() {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(r, "starting")
 		defer l.Debugln(r, "stopping")
 	}
@@ -188,7 +188,7 @@ func (r *broadcastReader) Serve() {
 
 		r.failed = false
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("recv %d bytes from %s", n, addr)
 		}
 
@@ -197,7 +197,7 @@ func (r *broadcastReader) Serve() {
 		select {
 		case r.outbox <- recv{c, addr}:
 		default:
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("dropping message")
 			}
 		}
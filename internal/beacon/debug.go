@@ -7,13 +7,11 @@
 package beacon
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "beacon") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("beacon")
 	l     = logger.DefaultLogger
 )
@@ -57,9 +57,9 @@ func (b *Multicast) writer() {
 	addr.Zone = b.intf.Name
 	for bs := range b.inbox {
 		_, err := b.conn.WriteTo(bs, &addr)
-		if err != nil && debug {
+		if err != nil && debug.Enabled() {
 			l.Debugln(err, "on write to", addr)
-		} else if debug {
+		} else if debug.Enabled() {
 			l.Debugf("sent %d bytes to %s", len(bs), addr.String())
 		}
 	}
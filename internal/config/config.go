@@ -13,6 +13,7 @@ import (
 	"io"
 	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -27,7 +28,7 @@ import (
 
 const (
 	OldestHandledVersion = 5
-	CurrentVersion       = 10
+	CurrentVersion       = 11
 )
 
 type Configuration struct {
@@ -58,6 +59,7 @@ func (cfg Configuration) Copy() Configuration {
 	}
 
 	newCfg.Options = cfg.Options.Copy()
+	newCfg.GUI = cfg.GUI.Copy()
 
 	// DeviceIDs are values
 	newCfg.IgnoredDevices = make([]protocol.DeviceID, len(cfg.IgnoredDevices))
@@ -71,14 +73,31 @@ type FolderConfiguration struct {
 	RawPath         string                      `xml:"path,attr" json:"path"`
 	Devices         []FolderDeviceConfiguration `xml:"device" json:"devices"`
 	ReadOnly        bool                        `xml:"ro,attr" json:"readOnly"`
+	ReceiveOnly     bool                        `xml:"receiveOnly,attr" json:"receiveOnly"` // Local changes are never sent to other devices.
 	RescanIntervalS int                         `xml:"rescanIntervalS,attr" json:"rescanIntervalS"`
 	IgnorePerms     bool                        `xml:"ignorePerms,attr" json:"ignorePerms"`
+	IgnoreAttrs     bool                        `xml:"ignoreAttributes,attr" json:"ignoreAttributes"` // Don't sync hidden, system and read-only attributes.
 	AutoNormalize   bool                        `xml:"autoNormalize,attr" json:"autoNormalize"`
+	DetectHardLinks bool                        `xml:"detectHardLinks,attr" json:"detectHardLinks"`
+	MergeConflicts  bool                        `xml:"mergeConflicts,attr" json:"mergeConflicts"` // Conflicting text files are merged, based on the last archived version, when possible.
+	MaxConflicts    int                         `xml:"maxConflicts,attr" json:"maxConflicts"`     // The number of conflict copies kept per file. Zero means unlimited.
 	Versioning      VersioningConfiguration     `xml:"versioning" json:"versioning"`
 	Copiers         int                         `xml:"copiers" json:"copiers"` // This defines how many files are handled concurrently.
 	Pullers         int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
 	Hashers         int                         `xml:"hashers" json:"hashers"` // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
 	Order           PullOrder                   `xml:"order" json:"order"`
+	ReparsePoints   ReparsePolicy               `xml:"reparsePoints" json:"reparsePoints"`
+	Subtrees        []string                    `xml:"subtree" json:"subtrees"` // If set, only these paths within the folder are synced.
+	MaxSendKbps     int                         `xml:"maxSendKbps,attr" json:"maxSendKbps"`
+	MaxRecvKbps     int                         `xml:"maxRecvKbps,attr" json:"maxRecvKbps"`
+	MinDiskFreePct  float64                     `xml:"minDiskFreePct,attr" json:"minDiskFreePct"` // Stop pulling when less than this percentage of the disk would be free.
+	MinDiskFreeMiB  int                         `xml:"minDiskFreeMiB,attr" json:"minDiskFreeMiB"` // Stop pulling when less than this many MiB would be free.
+	QuotaMiB        int                         `xml:"quotaMiB,attr" json:"quotaMiB"`             // The maximum size of the folder on this device. Zero means unlimited.
+	Barrier         bool                        `xml:"barrier,attr" json:"barrier"`               // Changes are applied only once all needed files are available.
+	DeltaBlocks     bool                        `xml:"deltaBlocks,attr" json:"deltaBlocks"`       // Only the changed parts of modified blocks are transferred, when the other device supports it.
+	QuietHours      []TimeWindow                `xml:"quietHours" json:"quietHours"`              // The folder is not synced during these times.
+	MarkerName      string                      `xml:"markerName,attr" json:"markerName"`         // In the folder root, the file or directory showing the folder is available. Defaults to .stfolder.
+	Paused          bool                        `xml:"paused,attr" json:"paused"`                 // Neither scanned nor pulled while set.
 
 	Invalid string `xml:"-" json:"invalid"` // Set at runtime when there is an error, not saved
 
@@ -89,9 +108,38 @@ func (f FolderConfiguration) Copy() FolderConfiguration {
 	c := f
 	c.Devices = make([]FolderDeviceConfiguration, len(f.Devices))
 	copy(c.Devices, f.Devices)
+	c.deviceIDs = nil // the devices may be changed in the copy
+	if f.Subtrees != nil {
+		c.Subtrees = make([]string, len(f.Subtrees))
+		copy(c.Subtrees, f.Subtrees)
+	}
+	if f.QuietHours != nil {
+		c.QuietHours = make([]TimeWindow, len(f.QuietHours))
+		copy(c.QuietHours, f.QuietHours)
+	}
 	return c
 }
 
+// IsSelected returns true if the named file (relative to the folder root)
+// is to be synced. That is the case for everything when no subtrees are
+// configured, otherwise for the subtrees themselves, everything within them
+// and the directories leading up to them.
+func (f FolderConfiguration) IsSelected(name string) bool {
+	if len(f.Subtrees) == 0 {
+		return true
+	}
+
+	sep := string(filepath.Separator)
+	name = filepath.Clean(name)
+	for _, sub := range f.Subtrees {
+		sub = filepath.Clean(filepath.FromSlash(sub))
+		if name == sub || strings.HasPrefix(name, sub+sep) || strings.HasPrefix(sub, name+sep) {
+			return true
+		}
+	}
+	return false
+}
+
 func (f FolderConfiguration) Path() string {
 	// This is intentionally not a pointer method, because things like
 	// cfg.Folders["default"].Path() should be valid.
@@ -120,22 +168,38 @@ func (f FolderConfiguration) Path() string {
 	return f.RawPath
 }
 
+// DefaultMarkerName is the folder marker used unless another is configured.
+const DefaultMarkerName = ".stfolder"
+
+// Marker returns the path to the folder marker.
+func (f *FolderConfiguration) Marker() string {
+	name := f.MarkerName
+	if name == "" {
+		name = DefaultMarkerName
+	}
+	return filepath.Join(f.Path(), filepath.FromSlash(name))
+}
+
+// CreateMarker creates the folder marker, as an empty file, unless it
+// already exists. Any existing file or directory can serve as the marker.
 func (f *FolderConfiguration) CreateMarker() error {
 	if !f.HasMarker() {
-		marker := filepath.Join(f.Path(), ".stfolder")
+		marker := f.Marker()
 		fd, err := os.Create(marker)
 		if err != nil {
 			return err
 		}
 		fd.Close()
-		osutil.HideFile(marker)
+		if f.MarkerName == "" {
+			osutil.HideFile(marker)
+		}
 	}
 
 	return nil
 }
 
 func (f *FolderConfiguration) HasMarker() bool {
-	_, err := os.Stat(filepath.Join(f.Path(), ".stfolder"))
+	_, err := os.Stat(f.Marker())
 	if err != nil {
 		return false
 	}
@@ -193,50 +257,105 @@ func (c *VersioningConfiguration) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 }
 
 type DeviceConfiguration struct {
-	DeviceID    protocol.DeviceID    `xml:"id,attr" json:"deviceID"`
-	Name        string               `xml:"name,attr,omitempty" json:"name"`
-	Addresses   []string             `xml:"address,omitempty" json:"addresses"`
-	Compression protocol.Compression `xml:"compression,attr" json:"compression"`
-	CertName    string               `xml:"certName,attr,omitempty" json:"certName"`
-	Introducer  bool                 `xml:"introducer,attr" json:"introducer"`
+	DeviceID          protocol.DeviceID    `xml:"id,attr" json:"deviceID"`
+	Name              string               `xml:"name,attr,omitempty" json:"name"`
+	Addresses         []string             `xml:"address,omitempty" json:"addresses"`
+	Compression       protocol.Compression `xml:"compression,attr" json:"compression"`
+	CertName          string               `xml:"certName,attr,omitempty" json:"certName"`
+	Introducer        bool                 `xml:"introducer,attr" json:"introducer"`
+	MaxSendKbps       int                  `xml:"maxSendKbps,attr,omitempty" json:"maxSendKbps"`
+	MaxRecvKbps       int                  `xml:"maxRecvKbps,attr,omitempty" json:"maxRecvKbps"`
+	Connections       int                  `xml:"connections,attr,omitempty" json:"connections"` // The number of connections to keep, with block requests spread over them. Zero means one.
+	Paused            bool                 `xml:"paused,attr" json:"paused"`
+	AllowedNets       []string             `xml:"allowedNet,omitempty" json:"allowedNets"`
+	NoRelays          bool                 `xml:"noRelays,attr,omitempty" json:"noRelays"`
+	IntroducedBy      string               `xml:"introducedBy,attr,omitempty" json:"introducedBy"`           // The ID of the introducer that added the device, if any.
+	RemoveIntroduced  bool                 `xml:"removeIntroduced,attr,omitempty" json:"removeIntroduced"`   // For introducers: remove the devices and shares they added once they drop them.
+	AutoAcceptFolders bool                 `xml:"autoAcceptFolders,attr,omitempty" json:"autoAcceptFolders"` // Folders it offers are added under the default folder path.
 }
 
 func (orig DeviceConfiguration) Copy() DeviceConfiguration {
 	c := orig
 	c.Addresses = make([]string, len(orig.Addresses))
 	copy(c.Addresses, orig.Addresses)
+	if orig.AllowedNets != nil {
+		c.AllowedNets = make([]string, len(orig.AllowedNets))
+		copy(c.AllowedNets, orig.AllowedNets)
+	}
 	return c
 }
 
 type FolderDeviceConfiguration struct {
-	DeviceID protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	DeviceID     protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	IntroducedBy string            `xml:"introducedBy,attr,omitempty" json:"introducedBy"` // The ID of the introducer that shared the folder with the device, if any.
 }
 
 type OptionsConfiguration struct {
-	ListenAddress           []string `xml:"listenAddress" json:"listenAddress" default:"0.0.0.0:22000"`
-	GlobalAnnServers        []string `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026, udp6://announce-v6.syncthing.net:22026"`
-	GlobalAnnEnabled        bool     `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
-	LocalAnnEnabled         bool     `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
-	LocalAnnPort            int      `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21025"`
-	LocalAnnMCAddr          string   `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
-	MaxSendKbps             int      `xml:"maxSendKbps" json:"maxSendKbps"`
-	MaxRecvKbps             int      `xml:"maxRecvKbps" json:"maxRecvKbps"`
-	ReconnectIntervalS      int      `xml:"reconnectionIntervalS" json:"reconnectionIntervalS" default:"60"`
-	StartBrowser            bool     `xml:"startBrowser" json:"startBrowser" default:"true"`
-	UPnPEnabled             bool     `xml:"upnpEnabled" json:"upnpEnabled" default:"true"`
-	UPnPLeaseM              int      `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"60"`
-	UPnPRenewalM            int      `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
-	UPnPTimeoutS            int      `xml:"upnpTimeoutSeconds" json:"upnpTimeoutSeconds" default:"10"`
-	URAccepted              int      `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
-	URUniqueID              string   `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
-	RestartOnWakeup         bool     `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
-	AutoUpgradeIntervalH    int      `xml:"autoUpgradeIntervalH" json:"autoUpgradeIntervalH" default:"12"` // 0 for off
-	KeepTemporariesH        int      `xml:"keepTemporariesH" json:"keepTemporariesH" default:"24"`         // 0 for off
-	CacheIgnoredFiles       bool     `xml:"cacheIgnoredFiles" json:"cacheIgnoredFiles" default:"true"`
-	ProgressUpdateIntervalS int      `xml:"progressUpdateIntervalS" json:"progressUpdateIntervalS" default:"5"`
-	SymlinksEnabled         bool     `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
-	LimitBandwidthInLan     bool     `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
-	DatabaseBlockCacheMiB   int      `xml:"databaseBlockCacheMiB" json:"databaseBlockCacheMiB" default:"0"`
+	ListenAddress           []string          `xml:"listenAddress" json:"listenAddress" default:":22000"`
+	GlobalAnnServers        []string          `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026, udp6://announce-v6.syncthing.net:22026"`
+	GlobalAnnEnabled        bool              `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
+	GlobalAnnIntervalS      int               `xml:"globalAnnounceIntervalS" json:"globalAnnounceIntervalS" default:"1800"`
+	LocalAnnEnabled         bool              `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
+	LocalAnnPort            int               `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21025"`
+	LocalAnnMCAddr          string            `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
+	LocalAnnMDNSEnabled     bool              `xml:"localAnnounceMDNSEnabled" json:"localAnnounceMDNSEnabled"` // Answer and announce over multicast DNS as well.
+	LocalAnnIntervalS       int               `xml:"localAnnounceIntervalS" json:"localAnnounceIntervalS" default:"30"`
+	MaxSendKbps             int               `xml:"maxSendKbps" json:"maxSendKbps"`
+	MaxRecvKbps             int               `xml:"maxRecvKbps" json:"maxRecvKbps"`
+	ReconnectIntervalS      int               `xml:"reconnectionIntervalS" json:"reconnectionIntervalS" default:"60"`
+	DialTimeoutS            int               `xml:"dialTimeoutS" json:"dialTimeoutS" default:"20"`
+	KeepAliveS              int               `xml:"keepAliveS" json:"keepAliveS" default:"60"`
+	PingTimeoutS            int               `xml:"pingTimeoutS" json:"pingTimeoutS" default:"30"`
+	TrafficClass            int               `xml:"trafficClass" json:"trafficClass"`
+	TCPKeepAliveS           int               `xml:"tcpKeepAliveS" json:"tcpKeepAliveS"`       // Between TCP keepalive probes; 0 for keepAliveS, -1 for none.
+	TCPNoDelay              bool              `xml:"tcpNoDelay" json:"tcpNoDelay"`             // Send small writes at once instead of coalescing them.
+	TCPSendBufferKiB        int               `xml:"tcpSendBufferKiB" json:"tcpSendBufferKiB"` // 0 for the system default.
+	TCPRecvBufferKiB        int               `xml:"tcpRecvBufferKiB" json:"tcpRecvBufferKiB"` // 0 for the system default.
+	StartBrowser            bool              `xml:"startBrowser" json:"startBrowser" default:"true"`
+	UPnPEnabled             bool              `xml:"upnpEnabled" json:"upnpEnabled" default:"true"`
+	UPnPLeaseM              int               `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"60"`
+	UPnPRenewalM            int               `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
+	UPnPTimeoutS            int               `xml:"upnpTimeoutSeconds" json:"upnpTimeoutSeconds" default:"10"`
+	NATPMPEnabled           bool              `xml:"natpmpEnabled" json:"natpmpEnabled" default:"true"`
+	URAccepted              int               `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
+	URUniqueID              string            `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
+	RestartOnWakeup         bool              `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
+	AutoUpgradeIntervalH    int               `xml:"autoUpgradeIntervalH" json:"autoUpgradeIntervalH" default:"12"` // 0 for off
+	KeepTemporariesH        int               `xml:"keepTemporariesH" json:"keepTemporariesH" default:"24"`         // 0 for off
+	CacheIgnoredFiles       bool              `xml:"cacheIgnoredFiles" json:"cacheIgnoredFiles" default:"true"`
+	ProgressUpdateIntervalS int               `xml:"progressUpdateIntervalS" json:"progressUpdateIntervalS" default:"5"`
+	SymlinksEnabled         bool              `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
+	LimitBandwidthInLan     bool              `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
+	AlwaysLocalNets         []string          `xml:"alwaysLocalNet" json:"alwaysLocalNets"`
+	DatabaseBlockCacheMiB   int               `xml:"databaseBlockCacheMiB" json:"databaseBlockCacheMiB" default:"0"`
+	DatabaseCompactionH     int               `xml:"databaseCompactionH" json:"databaseCompactionH" default:"168"`
+	DatabaseInMemory        bool              `xml:"databaseInMemory" json:"databaseInMemory"`
+	QuietHours              []TimeWindow      `xml:"quietHours" json:"quietHours"`     // Nothing is synced during these times.
+	RateLimits              []RateLimitWindow `xml:"rateLimit" json:"rateLimits"`      // The first window containing the current time overrides maxSendKbps and maxRecvKbps.
+	ProxyAddress            string            `xml:"proxyAddress" json:"proxyAddress"` // Outgoing connections to devices go through this SOCKS5 proxy, given as socks5://[user:password@]host:port.
+	RelaysEnabled           bool              `xml:"relaysEnabled" json:"relaysEnabled" default:"true"`
+	RelayServers            []string          `xml:"relayServer" json:"relayServers" default:"dynamic+https://relays.syncthing.net/endpoint"` // relay://host:port, or dynamic+ and the URL of a relay pool.
+	RelayServerEnabled      bool              `xml:"relayServerEnabled" json:"relayServerEnabled"`                                            // Act as a relay for other devices.
+	RelayServerListenAddr   string            `xml:"relayServerListenAddress" json:"relayServerListenAddress" default:":22067"`
+	RelayServerSessionAddr  string            `xml:"relayServerSessionAddress" json:"relayServerSessionAddress" default:":22068"`
+	RelayServerMaxKbps      int               `xml:"relayServerMaxKbps" json:"relayServerMaxKbps"`         // For all relayed traffic together; 0 for unlimited.
+	RelayServerSessionKbps  int               `xml:"relayServerSessionKbps" json:"relayServerSessionKbps"` // For each relayed session; 0 for unlimited.
+	RelayServerDevices      []string          `xml:"relayServerDevice" json:"relayServerDevices"`          // When set, only these devices may join the relay.
+	DiscoSrvEnabled         bool              `xml:"discoveryServerEnabled" json:"discoveryServerEnabled"` // Act as a global discovery server for other devices.
+	DiscoSrvListenAddr      string            `xml:"discoveryServerListenAddress" json:"discoveryServerListenAddress" default:":22026"`
+	DiscoSrvDevices         []string          `xml:"discoveryServerDevice" json:"discoveryServerDevices"` // When set, only these devices may announce themselves.
+	EventLogSize            int               `xml:"eventLogSize" json:"eventLogSize" default:"1000"`     // Events kept in the database across restarts; 0 for off.
+	EventLogTypes           []string          `xml:"eventLogType" json:"eventLogTypes"`                   // The types of events kept; all of them when empty.
+	Webhooks                []Webhook         `xml:"webhook" json:"webhooks"`
+	SMTP                    SMTPConfiguration `xml:"smtp" json:"smtp"`                                 // For the notifications by email below.
+	NotifyFolderErrors      bool              `xml:"notifyFolderErrors" json:"notifyFolderErrors"`     // Mail when a folder stops with an error.
+	NotifyLowDiskSpace      bool              `xml:"notifyLowDiskSpace" json:"notifyLowDiskSpace"`     // Mail when a folder runs out of disk space.
+	NotifyDeviceOfflineH    int               `xml:"notifyDeviceOfflineH" json:"notifyDeviceOfflineH"` // Mail when a device has been disconnected this long; 0 for off.
+	AuditEnabled            bool              `xml:"auditEnabled" json:"auditEnabled"`                 // Write the audit log, as with -audit, from the next start.
+	AuditFile               string            `xml:"auditFile" json:"auditFile"`                       // Appended to across restarts. When empty, each start writes a new audit-*.log in the config directory, kept for a week.
+	DesktopNotify           []string          `xml:"desktopNotify" json:"desktopNotify"`               // Event types shown as desktop notifications: StateChanged for folders coming in sync, FileConflict, and DeviceRejected and FolderRejected for new devices and folders. They're shown by running notify-send (libnotify) or, on Mac OS X, osascript, rather than by talking to D-Bus or Notification Center directly, so those must be installed; there's no support for Windows.
+	DefaultFolderPath       string            `xml:"defaultFolderPath" json:"defaultFolderPath"`       // Suggested for folders offered by other devices; see DefaultFolderPathFor.
+	ConfigHistory           int               `xml:"configHistory" json:"configHistory" default:"10"`  // The number of saved versions of the config file kept in config.history. Zero keeps none.
 }
 
 func (orig OptionsConfiguration) Copy() OptionsConfiguration {
@@ -245,6 +364,99 @@ func (orig OptionsConfiguration) Copy() OptionsConfiguration {
 	copy(c.ListenAddress, orig.ListenAddress)
 	c.GlobalAnnServers = make([]string, len(orig.GlobalAnnServers))
 	copy(c.GlobalAnnServers, orig.GlobalAnnServers)
+	c.RelayServers = make([]string, len(orig.RelayServers))
+	copy(c.RelayServers, orig.RelayServers)
+	if orig.AlwaysLocalNets != nil {
+		c.AlwaysLocalNets = make([]string, len(orig.AlwaysLocalNets))
+		copy(c.AlwaysLocalNets, orig.AlwaysLocalNets)
+	}
+	if orig.RelayServerDevices != nil {
+		c.RelayServerDevices = make([]string, len(orig.RelayServerDevices))
+		copy(c.RelayServerDevices, orig.RelayServerDevices)
+	}
+	if orig.DiscoSrvDevices != nil {
+		c.DiscoSrvDevices = make([]string, len(orig.DiscoSrvDevices))
+		copy(c.DiscoSrvDevices, orig.DiscoSrvDevices)
+	}
+	if orig.EventLogTypes != nil {
+		c.EventLogTypes = make([]string, len(orig.EventLogTypes))
+		copy(c.EventLogTypes, orig.EventLogTypes)
+	}
+	if orig.QuietHours != nil {
+		c.QuietHours = make([]TimeWindow, len(orig.QuietHours))
+		copy(c.QuietHours, orig.QuietHours)
+	}
+	if orig.RateLimits != nil {
+		c.RateLimits = make([]RateLimitWindow, len(orig.RateLimits))
+		copy(c.RateLimits, orig.RateLimits)
+	}
+	c.SMTP.To = copyStrings(orig.SMTP.To)
+	c.DesktopNotify = copyStrings(orig.DesktopNotify)
+	if orig.Webhooks != nil {
+		c.Webhooks = make([]Webhook, len(orig.Webhooks))
+		for i := range orig.Webhooks {
+			c.Webhooks[i] = orig.Webhooks[i].Copy()
+		}
+	}
+	return c
+}
+
+// DefaultFolderPathFor returns the path suggested for the folder offered by
+// the device, from the DefaultFolderPath template, or "" if there is none.
+// The template may contain ${id} (and ${label}, the same for now, as
+// folders have no labels), ${device} for the name of the device, or its
+// short ID if it has no name, and ${deviceID}; other variables are taken
+// from the environment. The values can't add directories to the path.
+func (orig OptionsConfiguration) DefaultFolderPathFor(id string, device DeviceConfiguration) string {
+	if orig.DefaultFolderPath == "" {
+		return ""
+	}
+	name := device.Name
+	if name == "" {
+		name = device.DeviceID.String()[:7]
+	}
+	vars := map[string]string{
+		"id":       id,
+		"label":    id,
+		"device":   name,
+		"deviceID": device.DeviceID.String(),
+	}
+	return os.Expand(orig.DefaultFolderPath, func(v string) string {
+		value, ok := vars[v]
+		if !ok {
+			return os.Getenv(v)
+		}
+		value = strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+		if value == "." || value == ".." {
+			value = "_"
+		}
+		return value
+	})
+}
+
+// The SMTPConfiguration is the mail server and the addresses that
+// notifications are sent from and to. STARTTLS is used when the server
+// offers it, and required to log in unless the server is on localhost.
+type SMTPConfiguration struct {
+	Address  string   `xml:"address,omitempty" json:"address"` // host:port; no mail is sent when empty.
+	User     string   `xml:"user,omitempty" json:"user"`       // For PLAIN authentication, when set.
+	Password string   `xml:"password,omitempty" json:"password"`
+	From     string   `xml:"from,omitempty" json:"from"`
+	To       []string `xml:"to" json:"to"`
+}
+
+// A Webhook is a URL that events are posted to as they happen.
+type Webhook struct {
+	URL     string   `xml:"url,attr" json:"url"`
+	Format  string   `xml:"format,attr,omitempty" json:"format"` // "slack" for Slack's message format, otherwise the events as they are.
+	Events  []string `xml:"event" json:"events"`                 // The types of events posted; all of them when empty.
+	Folders []string `xml:"folder" json:"folders"`               // When set, only events about these folders, or about no folder at all, are posted.
+}
+
+func (orig Webhook) Copy() Webhook {
+	c := orig
+	c.Events = copyStrings(orig.Events)
+	c.Folders = copyStrings(orig.Folders)
 	return c
 }
 
@@ -255,6 +467,145 @@ type GUIConfiguration struct {
 	Password string `xml:"password,omitempty" json:"password"`
 	UseTLS   bool   `xml:"tls,attr" json:"useTLS"`
 	APIKey   string `xml:"apikey,omitempty" json:"apiKey"`
+
+	// Keys in addition to the one above, which has full access.
+	ExtraAPIKeys []APIKeyConfiguration `xml:"extraApikey" json:"extraApiKeys"`
+
+	// Keep only SHA-256 hashes of the API keys, which then can't be shown
+	// again. Keys in the clear are hashed at load and when set. On by
+	// default; turning it off only keeps new keys in the clear.
+	HashAPIKeys bool `xml:"hashApiKeys" json:"hashApiKeys" default:"true"`
+
+	// Octal permissions, such as "0660", set on the socket file when the
+	// address is a Unix socket. Otherwise the umask decides.
+	UnixSocketPermissions string `xml:"unixSocketPermissions,omitempty" json:"unixSocketPermissions"`
+
+	// The path the GUI is mounted under by a reverse proxy, such as
+	// "/syncthing". Requests are accepted with or without it.
+	BasePath string `xml:"basePath,omitempty" json:"basePath"`
+
+	// Origins, such as "https://dashboard.example.com" or "*" for any, whose
+	// pages may call the REST API with an API key. The methods and headers
+	// they may use have defaults if left empty.
+	CORSAllowedOrigins []string `xml:"corsAllowedOrigin" json:"corsAllowedOrigins"`
+	CORSAllowedMethods []string `xml:"corsAllowedMethod" json:"corsAllowedMethods"`
+	CORSAllowedHeaders []string `xml:"corsAllowedHeader" json:"corsAllowedHeaders"`
+
+	// Client certificates on the HTTPS listener. With "accept" a trusted
+	// certificate stands in for the user and password, with "require"
+	// requests without one are refused. Certificates are trusted when signed
+	// by a CA in the PEM file or when their SHA-256 fingerprint is listed.
+	ClientCertAuth         string   `xml:"clientCertAuth,omitempty" json:"clientCertAuth"`
+	ClientCAFile           string   `xml:"clientCAFile,omitempty" json:"clientCAFile"`
+	ClientCertFingerprints []string `xml:"clientCertFingerprint" json:"clientCertFingerprints"`
+
+	// With "ldap", logins are checked against the LDAP server instead of
+	// the user and password above.
+	AuthMode string            `xml:"authMode,omitempty" json:"authMode"`
+	LDAP     LDAPConfiguration `xml:"ldap" json:"ldap"`
+
+	// Two factor authentication: the TOTP secret, encrypted with a key
+	// derived from the device key, and bcrypt hashes of the unused recovery
+	// codes. They are managed through their own endpoints, not the config.
+	TOTPSecret        string   `xml:"totpSecret,omitempty" json:"-"`
+	TOTPRecoveryCodes []string `xml:"totpRecoveryCode" json:"-"`
+
+	// Sessions end after this long without requests, and this long after
+	// the login, respectively. Zero means never.
+	SessionIdleTimeoutS int `xml:"sessionIdleTimeoutS,omitempty" json:"sessionIdleTimeoutS"`
+	SessionMaxAgeS      int `xml:"sessionMaxAgeS,omitempty" json:"sessionMaxAgeS"`
+
+	// Whether /rest/noauth/health can be used without authentication. With
+	// clientCertAuth "require" it still needs a trusted certificate.
+	UnauthenticatedHealth bool `xml:"unauthenticatedHealth" json:"unauthenticatedHealth" default:"true"`
+
+	// Sections of the configuration that can't be changed in the GUI or
+	// over the REST API, for deployments where the config file is managed
+	// by other means: folders, devices, options and gui, or all for
+	// everything. The lock itself can only be changed in the file.
+	LockedSections []string `xml:"lockedSection" json:"lockedSections"`
+}
+
+// IsLocked returns whether the section of the configuration is locked
+// against changes in the GUI and over the REST API.
+func (c GUIConfiguration) IsLocked(section string) bool {
+	for _, locked := range c.LockedSections {
+		if locked == section || locked == "all" {
+			return true
+		}
+	}
+	return false
+}
+
+type LDAPConfiguration struct {
+	Address            string `xml:"address,omitempty" json:"address"`     // host:port
+	BindDN             string `xml:"bindDN,omitempty" json:"bindDN"`       // Such as "uid=%s,ou=people,dc=example,dc=com", with %s replaced by the user name.
+	Transport          string `xml:"transport,omitempty" json:"transport"` // "starttls" (the default), "tls" or "plain", which sends passwords in the clear.
+	InsecureSkipVerify bool   `xml:"insecureSkipVerify,omitempty" json:"insecureSkipVerify"`
+
+	// If set, the user must also be listed in this attribute ("member" by
+	// default) of the group entry.
+	GroupDN        string `xml:"groupDN,omitempty" json:"groupDN"`
+	GroupAttribute string `xml:"groupAttribute,omitempty" json:"groupAttribute"`
+}
+
+// URLBase returns the base path cleaned up to start with a slash and not end
+// with one, or "" if the GUI is at the root.
+func (c GUIConfiguration) URLBase() string {
+	base := path.Clean("/" + c.BasePath)
+	if base == "/" {
+		return ""
+	}
+	return base
+}
+
+// Network returns "unix" when the address is a Unix socket, given as an
+// absolute path or as unix:///path, and "tcp" otherwise.
+func (c GUIConfiguration) Network() string {
+	if strings.HasPrefix(c.Address, "unix://") || strings.HasPrefix(c.Address, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// ListenAddress returns the address to listen on for the network, that is
+// the socket path without any unix:// prefix.
+func (c GUIConfiguration) ListenAddress() string {
+	return strings.TrimPrefix(c.Address, "unix://")
+}
+
+// UnixSocketMode returns the configured permissions of the Unix socket, or
+// zero if none are.
+func (c GUIConfiguration) UnixSocketMode() (os.FileMode, error) {
+	if c.UnixSocketPermissions == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(c.UnixSocketPermissions, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid Unix socket permissions %q", c.UnixSocketPermissions)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (c GUIConfiguration) Copy() GUIConfiguration {
+	n := c
+	if c.ExtraAPIKeys != nil {
+		n.ExtraAPIKeys = make([]APIKeyConfiguration, len(c.ExtraAPIKeys))
+		copy(n.ExtraAPIKeys, c.ExtraAPIKeys)
+	}
+	n.CORSAllowedOrigins = copyStrings(c.CORSAllowedOrigins)
+	n.CORSAllowedMethods = copyStrings(c.CORSAllowedMethods)
+	n.CORSAllowedHeaders = copyStrings(c.CORSAllowedHeaders)
+	n.ClientCertFingerprints = copyStrings(c.ClientCertFingerprints)
+	n.TOTPRecoveryCodes = copyStrings(c.TOTPRecoveryCodes)
+	n.LockedSections = copyStrings(c.LockedSections)
+	return n
+}
+
+type APIKeyConfiguration struct {
+	Key      string `xml:",chardata" json:"key"`
+	Label    string `xml:"label,attr,omitempty" json:"label"` // Names the user of the key in the logs.
+	ReadOnly bool   `xml:"readOnly,attr" json:"readOnly"`     // Only for looking, not for changing anything.
 }
 
 func New(myID protocol.DeviceID) Configuration {
@@ -272,6 +623,14 @@ func New(myID protocol.DeviceID) Configuration {
 }
 
 func ReadXML(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
+	cfg, err := decodeXML(r)
+	cfg.prepare(myID)
+	return cfg, err
+}
+
+// decodeXML reads the configuration, with defaults for what's missing, but
+// doesn't yet prepare it for use.
+func decodeXML(r io.Reader) (Configuration, error) {
 	var cfg Configuration
 
 	setDefaults(&cfg)
@@ -280,8 +639,6 @@ func ReadXML(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
 
 	err := xml.NewDecoder(r).Decode(&cfg)
 	cfg.OriginalVersion = cfg.Version
-
-	cfg.prepare(myID)
 	return cfg, err
 }
 
@@ -330,6 +687,16 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 			folder.ID = "default"
 		}
 
+		if name := folder.MarkerName; name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			l.Warnf("Folder %q marker name %q is not a name in the folder root; using the default", folder.ID, name)
+			folder.MarkerName = ""
+		}
+
+		if folder.ReadOnly && folder.ReceiveOnly {
+			l.Warnf("Folder %q can't be both read only and receive only; making it read only", folder.ID)
+			folder.ReceiveOnly = false
+		}
+
 		if seen, ok := seenFolders[folder.ID]; ok {
 			l.Warnf("Multiple folders with ID %q; disabling", folder.ID)
 
@@ -366,6 +733,9 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 	if cfg.Version == 9 {
 		convertV9V10(cfg)
 	}
+	if cfg.Version == 10 {
+		convertV10V11(cfg)
+	}
 
 	// Hash old cleartext passwords
 	if len(cfg.GUI.Password) > 0 && cfg.GUI.Password[0] != '$' {
@@ -423,12 +793,35 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		cfg.Options.ReconnectIntervalS = 5
 	}
 
+	// Zero timeouts would mean giving up immediately
+	if cfg.Options.DialTimeoutS < 1 {
+		cfg.Options.DialTimeoutS = 20
+	}
+	if cfg.Options.KeepAliveS < 1 {
+		cfg.Options.KeepAliveS = 60
+	}
+	if cfg.Options.PingTimeoutS < 1 {
+		cfg.Options.PingTimeoutS = 30
+	}
+	if cfg.Options.GlobalAnnIntervalS < 1 {
+		cfg.Options.GlobalAnnIntervalS = 1800
+	}
+	if cfg.Options.LocalAnnIntervalS < 1 {
+		cfg.Options.LocalAnnIntervalS = 30
+	}
+
+	// The traffic class is a byte; anything else leaves it as it is
+	if cfg.Options.TrafficClass < 0 || cfg.Options.TrafficClass > 255 {
+		cfg.Options.TrafficClass = 0
+	}
+
 	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
 	cfg.Options.GlobalAnnServers = uniqueStrings(cfg.Options.GlobalAnnServers)
 
 	if cfg.GUI.APIKey == "" {
 		cfg.GUI.APIKey = randomString(32)
 	}
+	cfg.GUI.hashAPIKeys()
 }
 
 // ChangeRequiresRestart returns true if updating the configuration requires a
@@ -462,6 +855,16 @@ func ChangeRequiresRestart(from, to Configuration) bool {
 	return false
 }
 
+func convertV10V11(cfg *Configuration) {
+	// Listen on IPv6 as well, unless the user has chosen otherwise.
+	for i, addr := range cfg.Options.ListenAddress {
+		if addr == "0.0.0.0:22000" {
+			cfg.Options.ListenAddress[i] = ":22000"
+		}
+	}
+	cfg.Version = 11
+}
+
 func convertV9V10(cfg *Configuration) {
 	// Enable auto normalization on existing folders.
 	for i := range cfg.Folders {
@@ -593,6 +996,16 @@ func uniqueStrings(ss []string) []string {
 	return us
 }
 
+// copyStrings returns a copy of the slice, or nil if it's nil.
+func copyStrings(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	cs := make([]string, len(ss))
+	copy(cs, ss)
+	return cs
+}
+
 func ensureDevicePresent(devices []FolderDeviceConfiguration, myID protocol.DeviceID) []FolderDeviceConfiguration {
 	for _, device := range devices {
 		if device.DeviceID.Equals(myID) {
@@ -730,3 +1143,44 @@ func (o *PullOrder) UnmarshalText(bs []byte) error {
 	}
 	return nil
 }
+
+// ReparsePolicy decides what the scanner does with Windows junctions and
+// other reparse points that aren't plain symlinks.
+type ReparsePolicy int
+
+const (
+	ReparseSkip   ReparsePolicy = iota // default is to skip them
+	ReparseFollow                      // treat them as the directory or file they point to
+	ReparseError                       // fail the scan, setting the folder error
+)
+
+func (p ReparsePolicy) String() string {
+	switch p {
+	case ReparseSkip:
+		return "skip"
+	case ReparseFollow:
+		return "follow"
+	case ReparseError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func (p ReparsePolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *ReparsePolicy) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "skip":
+		*p = ReparseSkip
+	case "follow":
+		*p = ReparseFollow
+	case "error":
+		*p = ReparseError
+	default:
+		*p = ReparseSkip
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -31,20 +32,27 @@ func init() {
 
 func TestDefaultValues(t *testing.T) {
 	expected := OptionsConfiguration{
-		ListenAddress:           []string{"0.0.0.0:22000"},
+		ListenAddress:           []string{":22000"},
 		GlobalAnnServers:        []string{"udp4://announce.syncthing.net:22026", "udp6://announce-v6.syncthing.net:22026"},
 		GlobalAnnEnabled:        true,
+		GlobalAnnIntervalS:      1800,
 		LocalAnnEnabled:         true,
 		LocalAnnPort:            21025,
 		LocalAnnMCAddr:          "[ff32::5222]:21026",
+		LocalAnnMDNSEnabled:     false,
+		LocalAnnIntervalS:       30,
 		MaxSendKbps:             0,
 		MaxRecvKbps:             0,
 		ReconnectIntervalS:      60,
+		DialTimeoutS:            20,
+		KeepAliveS:              60,
+		PingTimeoutS:            30,
 		StartBrowser:            true,
 		UPnPEnabled:             true,
 		UPnPLeaseM:              60,
 		UPnPRenewalM:            30,
 		UPnPTimeoutS:            10,
+		NATPMPEnabled:           true,
 		RestartOnWakeup:         true,
 		AutoUpgradeIntervalH:    12,
 		KeepTemporariesH:        24,
@@ -53,6 +61,14 @@ func TestDefaultValues(t *testing.T) {
 		SymlinksEnabled:         true,
 		LimitBandwidthInLan:     false,
 		DatabaseBlockCacheMiB:   0,
+		RelaysEnabled:           true,
+		RelayServers:            []string{"dynamic+https://relays.syncthing.net/endpoint"},
+		RelayServerListenAddr:   ":22067",
+		RelayServerSessionAddr:  ":22068",
+		DiscoSrvListenAddr:      ":22026",
+		EventLogSize:            1000,
+		ConfigHistory:           10,
+		DatabaseCompactionH:     168,
 	}
 
 	cfg := New(device1)
@@ -123,6 +139,21 @@ func TestDeviceConfig(t *testing.T) {
 	}
 }
 
+func TestListenAddressV11(t *testing.T) {
+	cfg := Configuration{
+		Version: 10,
+		Options: OptionsConfiguration{
+			ListenAddress: []string{"0.0.0.0:22000", "192.0.2.42:22001"},
+		},
+	}
+	convertV10V11(&cfg)
+
+	expected := []string{":22000", "192.0.2.42:22001"}
+	if !reflect.DeepEqual(cfg.Options.ListenAddress, expected) {
+		t.Errorf("Unexpected ListenAddress %#v", cfg.Options.ListenAddress)
+	}
+}
+
 func TestNoListenAddress(t *testing.T) {
 	cfg, err := Load("testdata/nolistenaddress.xml", device1)
 	if err != nil {
@@ -141,12 +172,23 @@ func TestOverriddenValues(t *testing.T) {
 		ListenAddress:           []string{":23000"},
 		GlobalAnnServers:        []string{"udp4://syncthing.nym.se:22026"},
 		GlobalAnnEnabled:        false,
+		GlobalAnnIntervalS:      600,
 		LocalAnnEnabled:         false,
 		LocalAnnPort:            42123,
 		LocalAnnMCAddr:          "quux:3232",
+		LocalAnnMDNSEnabled:     true,
+		LocalAnnIntervalS:       120,
 		MaxSendKbps:             1234,
 		MaxRecvKbps:             2341,
 		ReconnectIntervalS:      6000,
+		DialTimeoutS:            120,
+		KeepAliveS:              300,
+		PingTimeoutS:            180,
+		TrafficClass:            32,
+		TCPKeepAliveS:           -1,
+		TCPNoDelay:              true,
+		TCPSendBufferKiB:        256,
+		TCPRecvBufferKiB:        512,
 		StartBrowser:            false,
 		UPnPEnabled:             false,
 		UPnPLeaseM:              90,
@@ -159,7 +201,27 @@ func TestOverriddenValues(t *testing.T) {
 		ProgressUpdateIntervalS: 10,
 		SymlinksEnabled:         false,
 		LimitBandwidthInLan:     true,
+		AlwaysLocalNets:         []string{"10.8.0.0/16", "fd00:1::/64"},
 		DatabaseBlockCacheMiB:   42,
+		RelaysEnabled:           false,
+		RelayServers:            []string{"relay://192.0.2.42:22067"},
+		RelayServerEnabled:      true,
+		RelayServerListenAddr:   ":1234",
+		RelayServerSessionAddr:  ":1235",
+		RelayServerMaxKbps:      10000,
+		RelayServerSessionKbps:  1000,
+		RelayServerDevices:      []string{"AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR"},
+		DiscoSrvEnabled:         true,
+		DiscoSrvListenAddr:      ":1236",
+		DiscoSrvDevices:         []string{"AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR"},
+		EventLogSize:            100,
+		EventLogTypes:           []string{"DeviceConnected", "DeviceDisconnected"},
+		Webhooks: []Webhook{
+			{URL: "https://hooks.example.com/syncthing", Format: "slack", Events: []string{"FolderCompletion"}, Folders: []string{"default"}},
+		},
+		ConfigHistory:       5,
+		DatabaseCompactionH: 24,
+		DatabaseInMemory:    true,
 	}
 
 	cfg, err := Load("testdata/overridenvalues.xml", device1)
@@ -362,6 +424,69 @@ func TestFolderPath(t *testing.T) {
 	}
 }
 
+func TestFolderMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The default marker is created as needed.
+
+	folder := FolderConfiguration{RawPath: dir}
+	if folder.HasMarker() {
+		t.Error("Unexpected marker in empty folder")
+	}
+	if err := folder.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".stfolder")); err != nil {
+		t.Error("Default marker not created:", err)
+	}
+
+	// An existing directory serves as the marker as is.
+
+	if err := os.Mkdir(filepath.Join(dir, "DCIM"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	folder.MarkerName = "DCIM"
+	if !folder.HasMarker() {
+		t.Error("Existing directory should serve as marker")
+	}
+	if err := folder.CreateMarker(); err != nil {
+		t.Error("Creating an existing marker should be a no-op:", err)
+	}
+
+	folder.MarkerName = "marker"
+	if folder.HasMarker() {
+		t.Error("Unexpected custom marker")
+	}
+	if err := folder.CreateMarker(); err != nil {
+		t.Fatal(err)
+	}
+	if !folder.HasMarker() {
+		t.Error("Custom marker not created")
+	}
+}
+
+func TestFolderMarkerName(t *testing.T) {
+	cfg := Configuration{Folders: []FolderConfiguration{
+		{ID: "a", RawPath: "a", MarkerName: "marker"},
+		{ID: "b", RawPath: "b", MarkerName: "../marker"},
+		{ID: "c", RawPath: "c", MarkerName: "DCIM/marker"},
+		{ID: "d", RawPath: "d", MarkerName: `DCIM\marker`},
+		{ID: "e", RawPath: "e", MarkerName: ".."},
+	}}
+	cfg.prepare(device1)
+
+	expected := []string{"marker", "", "", "", ""}
+	for i, folder := range cfg.Folders {
+		if folder.MarkerName != expected[i] {
+			t.Errorf("Folder %q marker name %q, expected %q", folder.ID, folder.MarkerName, expected[i])
+		}
+	}
+}
+
 func TestNewSaveLoad(t *testing.T) {
 	path := "testdata/temp.xml"
 	os.Remove(path)
@@ -401,6 +526,204 @@ func TestNewSaveLoad(t *testing.T) {
 	os.Remove(path)
 }
 
+func TestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.xml")
+	main := `<configuration version="12">
+    <folder id="own" path="/own">
+        <device id="` + device2.String() + `"></device>
+    </folder>
+</configuration>`
+	inc := `<configuration>
+    <folder id="photos" path="/photos">
+        <device id="` + device2.String() + `"></device>
+    </folder>
+    <device id="` + device2.String() + `" name="included"></device>
+    <options><listenAddress>nowhere</listenAddress></options>
+</configuration>`
+	os.Mkdir(filepath.Join(dir, IncludeDir), 0755)
+	ioutil.WriteFile(path, []byte(main), 0644)
+	ioutil.WriteFile(filepath.Join(dir, IncludeDir, "photos.xml"), []byte(inc), 0644)
+	ioutil.WriteFile(filepath.Join(dir, IncludeDir, "notes.txt"), []byte("not xml"), 0644)
+
+	cfg, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders := cfg.Folders()
+	if _, ok := folders["photos"]; !ok || len(folders) != 2 {
+		t.Fatalf("Incorrect folders %v", folders)
+	}
+	if own := folders["own"]; len(own.DeviceIDs()) != 2 {
+		t.Errorf("Included device not shared with the folder, %v", own.Devices)
+	}
+	if cfg.Devices()[device2].Name != "included" {
+		t.Error("Included device missing")
+	}
+	if cfg.Options().ListenAddress[0] == "nowhere" {
+		t.Error("Options taken from a drop-in file")
+	}
+
+	// Saving keeps the included folders and devices out of the config file.
+	if err := cfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadFile(path)
+	if bytes.Contains(bs, []byte("photos")) || bytes.Contains(bs, []byte("included")) {
+		t.Errorf("Included config saved:\n%s", bs)
+	}
+	cfg, err = Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Folders()) != 2 || len(cfg.Devices()) != 2 {
+		t.Errorf("Incorrect config after saving, %v", cfg.Raw())
+	}
+}
+
+func TestOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.xml")
+	cfg := Wrap(path, New(device1))
+
+	if err := cfg.Override("GlobalAnnounceEnabled", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Override("listenAddress", "tcp://:1234, tcp://:5678"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Override("nonexistent", "1"); err == nil {
+		t.Error("Unexpected nil error for an unknown option")
+	}
+	if err := cfg.Override("maxSendKbps", "fast"); err == nil {
+		t.Error("Unexpected nil error for a bad value")
+	}
+	if err := cfg.Override("gui.address", "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Override("gui.nonexistent", "1"); err == nil {
+		t.Error("Unexpected nil error for an unknown GUI option")
+	}
+	if err := cfg.Override("quietHours", ""); err == nil {
+		t.Error("Unexpected nil error for an option that can't be overridden")
+	}
+
+	opts := cfg.Options()
+	if opts.GlobalAnnEnabled || len(opts.ListenAddress) != 2 || opts.ListenAddress[1] != "tcp://:5678" {
+		t.Fatalf("Options not overridden, %+v", opts)
+	}
+
+	// Changes keep the overrides, but aren't saved with them.
+	opts.GlobalAnnEnabled = true
+	opts.MaxSendKbps = 100
+	cfg.SetOptions(opts)
+	if opts := cfg.Options(); opts.GlobalAnnEnabled || opts.MaxSendKbps != 100 {
+		t.Errorf("Incorrect options after a change, %+v", opts)
+	}
+	if err := cfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := saved.Options(); !opts.GlobalAnnEnabled || opts.ListenAddress[0] != ":22000" || opts.MaxSendKbps != 100 {
+		t.Errorf("Incorrect options saved, %+v", opts)
+	}
+	if gui := cfg.GUI(); gui.Address != "127.0.0.1:8080" {
+		t.Errorf("GUI address not overridden, %q", gui.Address)
+	}
+	if gui := saved.GUI(); gui.Address != "127.0.0.1:8384" {
+		t.Errorf("Incorrect GUI address saved, %q", gui.Address)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("STTESTAPIKEY", "key-from-env")
+	defer os.Setenv("STTESTAPIKEY", "")
+	os.Setenv("STTESTWEBHOOK", "https://hooks.example.com/token")
+	defer os.Setenv("STTESTWEBHOOK", "")
+	secret := filepath.Join(dir, "smtp-password")
+	ioutil.WriteFile(secret, []byte("hunter2\n"), 0600)
+
+	path := filepath.Join(dir, "config.xml")
+	xml := `<configuration version="12">
+    <gui>
+        <apikey>env:STTESTAPIKEY</apikey>
+        <extraApikey>plain</extraApikey>
+    </gui>
+    <options>
+        <smtp><password>file:` + secret + `</password></smtp>
+        <webhook url="env:STTESTWEBHOOK"></webhook>
+    </options>
+</configuration>`
+	ioutil.WriteFile(path, []byte(xml), 0644)
+
+	cfg, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gui := cfg.GUI()
+	if !APIKeyMatches(gui.APIKey, "key-from-env") || APIKeyMatches(gui.APIKey, "env:STTESTAPIKEY") {
+		t.Errorf("Incorrect API key %q", gui.APIKey)
+	}
+	if gui.ExtraAPIKeys[0].Key != HashAPIKey("plain") {
+		t.Errorf("Extra API key not hashed, %q", gui.ExtraAPIKeys[0].Key)
+	}
+	if pw := cfg.Options().SMTP.Password; pw != "hunter2" {
+		t.Errorf("Incorrect SMTP password %q", pw)
+	}
+	if url := cfg.Options().Webhooks[0].URL; url != "https://hooks.example.com/token" {
+		t.Errorf("Incorrect webhook URL %q", url)
+	}
+
+	// The file was migrated at load, keeping the references.
+	bs, _ := ioutil.ReadFile(path)
+	for _, s := range []string{"env:STTESTAPIKEY", "file:" + secret, "env:STTESTWEBHOOK", HashAPIKey("plain")} {
+		if !bytes.Contains(bs, []byte(s)) {
+			t.Errorf("%q missing from the saved config", s)
+		}
+	}
+	if bytes.Contains(bs, []byte(">plain<")) || bytes.Contains(bs, []byte("hunter2")) || bytes.Contains(bs, []byte("token")) {
+		t.Errorf("Secret in the clear in the saved config:\n%s", bs)
+	}
+
+	if url := cfg.Options().Webhooks[0].URL; url != "https://hooks.example.com/token" {
+		t.Errorf("Webhook URL changed by saving, %q", url)
+	}
+
+	// A changed secret is saved as it is.
+	opts := cfg.Options()
+	opts.SMTP.Password = "changed"
+	cfg.SetOptions(opts)
+	cfg.Save()
+	bs, _ = ioutil.ReadFile(path)
+	if !bytes.Contains(bs, []byte("changed")) || !bytes.Contains(bs, []byte("env:STTESTAPIKEY")) {
+		t.Errorf("Incorrect config saved after a change:\n%s", bs)
+	}
+
+	os.Setenv("STTESTAPIKEY", "")
+	if _, err := Load(path, device1); err == nil {
+		t.Error("Unexpected nil error for an unset environment variable")
+	}
+}
+
 func TestPrepare(t *testing.T) {
 	var cfg Configuration
 
@@ -531,6 +854,119 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+func TestRemoveFolderDevice(t *testing.T) {
+	wrapper, err := Load("testdata/example.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := wrapper.RemoveFolder("nonexistent"); ok {
+		t.Error("Removed a nonexistent folder")
+	}
+	if _, ok := wrapper.RemoveDevice(device3); ok {
+		t.Error("Removed a nonexistent device")
+	}
+
+	if _, ok := wrapper.RemoveDevice(device4); !ok {
+		t.Fatal("Device not removed")
+	}
+	if _, ok := wrapper.Devices()[device4]; ok {
+		t.Error("Device still in the config")
+	}
+	folder := wrapper.Folders()["default"]
+	for _, dev := range folder.DeviceIDs() {
+		if dev == device4 {
+			t.Error("Folder still shared with the removed device")
+		}
+	}
+	if len(folder.Devices) != 3 {
+		t.Errorf("Incorrect devices %v for the folder", folder.Devices)
+	}
+
+	if _, ok := wrapper.RemoveFolder("default"); !ok {
+		t.Fatal("Folder not removed")
+	}
+	if len(wrapper.Folders()) != 0 {
+		t.Errorf("Incorrect folders %v after removal", wrapper.Folders())
+	}
+}
+
+func TestExtraAPIKeys(t *testing.T) {
+	wrapper, err := Load("testdata/apikeys.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []APIKeyConfiguration{
+		{Key: "def456", Label: "dashboard", ReadOnly: true},
+		{Key: "ghi789"},
+	}
+	if gui := wrapper.GUI(); gui.APIKey != "abc123" || !reflect.DeepEqual(gui.ExtraAPIKeys, expected) {
+		t.Errorf("Incorrect API keys %q, %+v", gui.APIKey, gui.ExtraAPIKeys)
+	}
+}
+
+func TestHashAPIKeysDefault(t *testing.T) {
+	cfg := Wrap("/tmp/test", New(device1))
+	gui := cfg.GUI()
+	if !gui.HashAPIKeys {
+		t.Fatal("API keys not hashed by default")
+	}
+
+	gui.APIKey = "abc123"
+	gui.ExtraAPIKeys = []APIKeyConfiguration{{Key: "def456"}}
+	cfg.SetGUI(gui)
+	if gui := cfg.GUI(); gui.APIKey != HashAPIKey("abc123") || gui.ExtraAPIKeys[0].Key != HashAPIKey("def456") {
+		t.Errorf("API keys not hashed, %q, %+v", gui.APIKey, gui.ExtraAPIKeys)
+	}
+}
+
+func TestGUIUnixSocket(t *testing.T) {
+	cases := []struct {
+		address string
+		network string
+		listen  string
+	}{
+		{"127.0.0.1:8384", "tcp", "127.0.0.1:8384"},
+		{":8384", "tcp", ":8384"},
+		{"/var/run/syncthing.sock", "unix", "/var/run/syncthing.sock"},
+		{"unix:///var/run/syncthing.sock", "unix", "/var/run/syncthing.sock"},
+	}
+	for _, tc := range cases {
+		gui := GUIConfiguration{Address: tc.address}
+		if net, addr := gui.Network(), gui.ListenAddress(); net != tc.network || addr != tc.listen {
+			t.Errorf("Incorrect %s %s for %q", net, addr, tc.address)
+		}
+	}
+
+	modes := map[string]os.FileMode{"": 0, "0660": 0660, "600": 0600}
+	for perms, expected := range modes {
+		if mode, err := (GUIConfiguration{UnixSocketPermissions: perms}).UnixSocketMode(); err != nil || mode != expected {
+			t.Errorf("Incorrect mode %o, %v for %q", mode, err, perms)
+		}
+	}
+	for _, perms := range []string{"0868", "rw-rw----", "01777"} {
+		if _, err := (GUIConfiguration{UnixSocketPermissions: perms}).UnixSocketMode(); err == nil {
+			t.Errorf("No error for %q", perms)
+		}
+	}
+}
+
+func TestGUIURLBase(t *testing.T) {
+	cases := map[string]string{
+		"":             "",
+		"/":            "",
+		"syncthing":    "/syncthing",
+		"/syncthing/":  "/syncthing",
+		"//a/./b/../c": "/a/c",
+	}
+	for base, expected := range cases {
+		if actual := (GUIConfiguration{BasePath: base}).URLBase(); actual != expected {
+			t.Errorf("Incorrect URL base %q for %q, expected %q", actual, base, expected)
+		}
+	}
+}
+
 func TestPullOrder(t *testing.T) {
 	wrapper, err := Load("testdata/pullorder.xml", device1)
 	if err != nil {
@@ -578,3 +1014,234 @@ func TestPullOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestFolderIsSelected(t *testing.T) {
+	fcfg := FolderConfiguration{
+		Subtrees: []string{"photos/2015", "docs"},
+	}
+
+	cases := []struct {
+		name     string
+		selected bool
+	}{
+		{"docs", true},
+		{"docs/report.txt", true},
+		{"photos", true},
+		{"photos/2015", true},
+		{"photos/2015/img.jpg", true},
+		{"photos/2014", false},
+		{"photos/2014/img.jpg", false},
+		{"photos/20150", false},
+		{"documents", false},
+		{"other", false},
+	}
+
+	for _, tc := range cases {
+		if sel := fcfg.IsSelected(filepath.FromSlash(tc.name)); sel != tc.selected {
+			t.Errorf("IsSelected(%q) = %v, expected %v", tc.name, sel, tc.selected)
+		}
+	}
+
+	if !(FolderConfiguration{}).IsSelected("anything") {
+		t.Error("Everything should be selected without subtrees")
+	}
+}
+
+func TestDefaultFolderPathFor(t *testing.T) {
+	os.Setenv("STTESTSTORAGE", "/storage")
+	defer os.Setenv("STTESTSTORAGE", "")
+
+	opts := OptionsConfiguration{DefaultFolderPath: "${STTESTSTORAGE}/${device}/${id}"}
+	cases := []struct {
+		id     string
+		device DeviceConfiguration
+		path   string
+	}{
+		{"photos", DeviceConfiguration{DeviceID: device1, Name: "laptop"}, "/storage/laptop/photos"},
+		{"photos", DeviceConfiguration{DeviceID: device1}, "/storage/AIR6LPZ/photos"},
+		{"../etc", DeviceConfiguration{DeviceID: device1, Name: ".."}, "/storage/_/.._etc"},
+	}
+	for _, tc := range cases {
+		if path := opts.DefaultFolderPathFor(tc.id, tc.device); path != tc.path {
+			t.Errorf("Incorrect path %q for %q, expected %q", path, tc.id, tc.path)
+		}
+	}
+
+	if path := (OptionsConfiguration{}).DefaultFolderPathFor("photos", DeviceConfiguration{}); path != "" {
+		t.Errorf("Unexpected path %q without a template", path)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := New(device1)
+	raw.Options.ConfigHistory = 2
+	raw.Options.SMTP.Password = "hunter2"
+	raw.Options.Webhooks = []Webhook{{URL: "https://hooks.example.com/token"}}
+	raw.GUI.TOTPSecret = "JBSWY3DPEHPK3PXP"
+	cfg := Wrap(filepath.Join(dir, "config.xml"), raw)
+	cfg.SetHistoryDir(filepath.Join(dir, "config.history"))
+
+	save := func(name string) {
+		dev := cfg.Devices()[device1]
+		dev.Name = name
+		cfg.SetDevice(dev)
+		if err := cfg.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("first")
+	save("second")
+	save("second") // the same again, not a new version
+	versions, err := cfg.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Incorrect number of versions %d != 2", len(versions))
+	}
+	first := versions[1].Version
+
+	save("third")
+	versions, _ = cfg.History()
+	if len(versions) != 2 || versions[1].Version == first {
+		t.Fatalf("Oldest version not removed, %v", versions)
+	}
+
+	old, err := cfg.HistoryConfig(versions[1].Version, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := old.Devices[0].Name; name != "second" {
+		t.Errorf("Incorrect device name %q in the old version", name)
+	}
+
+	// The secrets are kept out of the history, and the current ones are used
+	// for the old version.
+	hist, _ := ioutil.ReadDir(filepath.Join(dir, "config.history"))
+	for _, info := range hist {
+		bs, _ := ioutil.ReadFile(filepath.Join(dir, "config.history", info.Name()))
+		for _, secret := range []string{"hunter2", "token", "JBSWY3DPEHPK3PXP"} {
+			if bytes.Contains(bs, []byte(secret)) {
+				t.Errorf("Secret %q in the history file %s", secret, info.Name())
+			}
+		}
+	}
+	if old.Options.SMTP.Password != "hunter2" || old.Options.Webhooks[0].URL != "https://hooks.example.com/token" || old.GUI.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Secrets not restored in the old version, %+v", old)
+	}
+	if cfg.Options().Webhooks[0].URL != "https://hooks.example.com/token" {
+		t.Error("Webhook URL redacted in the configuration in use")
+	}
+	if _, err := cfg.HistoryFile("../config"); err == nil {
+		t.Error("History file read outside the history")
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	// The same configuration, as JSON.
+	xmlCfg, err := Load("testdata/overridenvalues.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := xmlCfg.Raw()
+	raw.GUI.TOTPSecret = "sealed"
+	var buf bytes.Buffer
+	if err := raw.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	jsonCfg, err := ReadJSON(&buf, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jsonCfg.Options, raw.Options) {
+		t.Errorf("Options differ after a JSON round trip;\n  E: %#v\n  A: %#v", raw.Options, jsonCfg.Options)
+	}
+	if jsonCfg.GUI.TOTPSecret != "sealed" {
+		t.Error("TOTP secret lost in JSON")
+	}
+
+	// A config.json is loaded and saved as JSON.
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{
+    "version": 12,
+    "devices": [{"deviceID": "`+device1.String()+`", "name": "me"}],
+    "options": {"listenAddress": [":23000"]}
+}`), 0644)
+
+	cfg, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := cfg.Devices()[device1].Name; name != "me" {
+		t.Errorf("Incorrect device name %q", name)
+	}
+	opts := cfg.Options()
+	if opts.ListenAddress[0] != ":23000" || opts.ConfigHistory != 10 {
+		t.Errorf("Incorrect options %v, %d", opts.ListenAddress, opts.ConfigHistory)
+	}
+	if err := cfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(bs, []byte("{")) {
+		t.Errorf("Config not saved as JSON: %.40s", bs)
+	}
+}
+
+func TestYAMLFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A config.yaml is loaded and saved as YAML.
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte(`version: 12
+devices:
+- deviceID: `+device1.String()+`
+  name: me
+options:
+  listenAddress: [":23000"]
+  maxSendKbps: 100
+`), 0644)
+
+	cfg, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := cfg.Devices()[device1].Name; name != "me" {
+		t.Errorf("Incorrect device name %q", name)
+	}
+	opts := cfg.Options()
+	if opts.ListenAddress[0] != ":23000" || opts.MaxSendKbps != 100 || opts.ConfigHistory != 10 {
+		t.Errorf("Incorrect options %v, %d, %d", opts.ListenAddress, opts.MaxSendKbps, opts.ConfigHistory)
+	}
+	if err := cfg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(bs, []byte("version: ")) {
+		t.Errorf("Config not saved as YAML: %.40s", bs)
+	}
+
+	// It reads back the same.
+	saved, err := Load(path, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Options(), cfg.Options()) || saved.Devices()[device1].Name != "me" {
+		t.Errorf("Config differs after a YAML round trip;\n  E: %+v\n  A: %+v", cfg.Raw(), saved.Raw())
+	}
+}
@@ -7,13 +7,11 @@
 package config
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "config") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("config")
 	l     = logger.DefaultLogger
 )
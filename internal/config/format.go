@@ -0,0 +1,182 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/protocol"
+	"gopkg.in/yaml.v2"
+)
+
+// The config file, and the drop-in files, may be JSON or YAML instead of
+// XML when their names end in .json, or .yaml or .yml. The JSON is that of
+// the REST API, with the same version number and conversions from older
+// versions, plus the two factor authentication secrets that the API leaves
+// out. The YAML holds the same as the JSON.
+
+// isJSON returns whether the file at the path is in JSON.
+func isJSON(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+// isYAML returns whether the file at the path is in YAML.
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return strings.EqualFold(ext, ".yaml") || strings.EqualFold(ext, ".yml")
+}
+
+// decodeFile reads the configuration in the format of the file at the path.
+func decodeFile(path string, r io.Reader) (Configuration, error) {
+	switch {
+	case isJSON(path):
+		return decodeJSON(r)
+	case isYAML(path):
+		bs, err := yamlToJSON(r)
+		if err != nil {
+			return Configuration{}, err
+		}
+		return decodeJSON(bytes.NewReader(bs))
+	}
+	return decodeXML(r)
+}
+
+// writeFile writes the configuration in the format of the file at the path.
+func (cfg *Configuration) writeFile(path string, w io.Writer) error {
+	switch {
+	case isJSON(path):
+		return cfg.WriteJSON(w)
+	case isYAML(path):
+		return cfg.WriteYAML(w)
+	}
+	return cfg.WriteXML(w)
+}
+
+// jsonConfiguration is the configuration as kept in a JSON file.
+type jsonConfiguration struct {
+	Configuration
+	GUI jsonGUIConfiguration `json:"gui"`
+}
+
+type jsonGUIConfiguration struct {
+	GUIConfiguration
+	TOTPSecret        string   `json:"totpSecret,omitempty"`
+	TOTPRecoveryCodes []string `json:"totpRecoveryCodes,omitempty"`
+}
+
+func ReadJSON(r io.Reader, myID protocol.DeviceID) (Configuration, error) {
+	cfg, err := decodeJSON(r)
+	cfg.prepare(myID)
+	return cfg, err
+}
+
+// decodeJSON reads the configuration, with defaults for what's missing, but
+// doesn't yet prepare it for use.
+func decodeJSON(r io.Reader) (Configuration, error) {
+	var jc jsonConfiguration
+
+	setDefaults(&jc.Configuration)
+	setDefaults(&jc.Options)
+	setDefaults(&jc.GUI.GUIConfiguration)
+
+	err := json.NewDecoder(r).Decode(&jc)
+	cfg := jc.Configuration
+	cfg.GUI = jc.GUI.GUIConfiguration
+	cfg.GUI.TOTPSecret = jc.GUI.TOTPSecret
+	cfg.GUI.TOTPRecoveryCodes = jc.GUI.TOTPRecoveryCodes
+	cfg.OriginalVersion = cfg.Version
+	return cfg, err
+}
+
+func (cfg *Configuration) WriteJSON(w io.Writer) error {
+	jc := jsonConfiguration{
+		Configuration: *cfg,
+		GUI: jsonGUIConfiguration{
+			GUIConfiguration:  cfg.GUI,
+			TOTPSecret:        cfg.GUI.TOTPSecret,
+			TOTPRecoveryCodes: cfg.GUI.TOTPRecoveryCodes,
+		},
+	}
+	bs, err := json.MarshalIndent(jc, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+// WriteYAML writes the configuration as YAML, with the fields in the same
+// order as in the JSON.
+func (cfg *Configuration) WriteYAML(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := cfg.WriteJSON(&buf); err != nil {
+		return err
+	}
+	// JSON is YAML, and decoding into a MapSlice keeps the order.
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		return err
+	}
+	bs, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bs)
+	return err
+}
+
+// yamlToJSON reads YAML and returns the same as JSON.
+func yamlToJSON(r io.Reader) ([]byte, error) {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	doc, err = jsonValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// jsonValue returns the decoded YAML value with its maps keyed by strings,
+// as JSON needs them.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			s, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", key)
+			}
+			var err error
+			if m[s], err = jsonValue(value); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+
+	case []interface{}:
+		for i, value := range v {
+			var err error
+			if v[i], err = jsonValue(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
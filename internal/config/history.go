@@ -0,0 +1,184 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// Every version of the config file that is saved is also kept in the
+// history directory, when one is set, as config-<time>.xml, or .json or
+// .yaml like the config file, with the secrets redacted. The time, in UTC,
+// names the version. The last Options.ConfigHistory versions are kept.
+
+const historyTimeFormat = "20060102-150405.000"
+
+// A HistoryVersion is a saved version of the config file.
+type HistoryVersion struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	Size    int64     `json:"size"`
+}
+
+// SetHistoryDir sets the directory the saved versions of the config file
+// are kept in. Without one no history is kept.
+func (w *Wrapper) SetHistoryDir(dir string) {
+	w.mut.Lock()
+	w.historyDir = dir
+	w.mut.Unlock()
+}
+
+// History returns the saved versions of the config file, the latest first.
+func (w *Wrapper) History() ([]HistoryVersion, error) {
+	w.mut.Lock()
+	dir := w.historyDir
+	w.mut.Unlock()
+	if dir == "" {
+		return nil, nil
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(w.path)
+	var versions []HistoryVersion
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, "config-") || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "config-"), ext)
+		t, err := time.Parse(historyTimeFormat, version)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, HistoryVersion{version, t, info.Size()})
+	}
+	sort.Sort(sort.Reverse(historyByTime(versions)))
+	return versions, nil
+}
+
+// HistoryFile returns the contents of the saved version of the config file,
+// with the secrets redacted, also in versions saved before they were.
+func (w *Wrapper) HistoryFile(version string) ([]byte, error) {
+	w.mut.Lock()
+	dir := w.historyDir
+	w.mut.Unlock()
+	if _, err := time.Parse(historyTimeFormat, version); dir == "" || err != nil {
+		return nil, fmt.Errorf("no such version %q", version)
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, w.historyName(version)))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := decodeFile(w.path, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	cfg = withoutSecrets(cfg)
+	var buf bytes.Buffer
+	err = cfg.writeFile(w.path, &buf)
+	return buf.Bytes(), err
+}
+
+// HistoryConfig returns the saved version of the configuration, ready for
+// use like a loaded one, along with the current drop-in files. The redacted
+// secrets are those of the current configuration.
+func (w *Wrapper) HistoryConfig(version string, myID protocol.DeviceID) (Configuration, error) {
+	bs, err := w.HistoryFile(version)
+	if err != nil {
+		return Configuration{}, err
+	}
+	cfg, err := decodeFile(w.path, bytes.NewReader(bs))
+	if err != nil {
+		return Configuration{}, err
+	}
+	if _, err := mergeIncludes(&cfg, filepath.Join(filepath.Dir(w.path), IncludeDir)); err != nil {
+		return Configuration{}, err
+	}
+	w.mut.Lock()
+	restoreSecrets(&cfg, w.cfg)
+	w.mut.Unlock()
+	if _, err := resolveSecrets(&cfg); err != nil {
+		return Configuration{}, err
+	}
+	cfg.GUI.hashAPIKeys()
+	cfg.prepare(myID)
+	return cfg, nil
+}
+
+// addHistory keeps the configuration as saved in the history, unless it's
+// the same as the latest version there, and removes the versions beyond
+// those to keep.
+func (w *Wrapper) addHistory(cfg Configuration) error {
+	w.mut.Lock()
+	dir, keep := w.historyDir, w.cfg.Options.ConfigHistory
+	w.mut.Unlock()
+	if dir == "" || keep <= 0 {
+		return nil
+	}
+
+	cfg = withoutSecrets(cfg)
+	var buf bytes.Buffer
+	if err := cfg.writeFile(w.path, &buf); err != nil {
+		return err
+	}
+	bs := buf.Bytes()
+
+	versions, err := w.History()
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		if latest, err := w.HistoryFile(versions[0].Version); err == nil && bytes.Equal(latest, bs) {
+			return nil
+		}
+	}
+
+	if err := osutil.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Versions saved within the same millisecond still get their own names.
+	t := time.Now().UTC().Truncate(time.Millisecond)
+	if len(versions) > 0 && !t.After(versions[0].Time) {
+		t = versions[0].Time.Add(time.Millisecond)
+	}
+	version := t.Format(historyTimeFormat)
+	if err := ioutil.WriteFile(filepath.Join(dir, w.historyName(version)), bs, 0600); err != nil {
+		return err
+	}
+
+	for i, old := range versions {
+		if i+1 >= keep {
+			os.Remove(filepath.Join(dir, w.historyName(old.Version)))
+		}
+	}
+	return nil
+}
+
+func (w *Wrapper) historyName(version string) string {
+	return "config-" + version + filepath.Ext(w.path)
+}
+
+type historyByTime []HistoryVersion
+
+func (l historyByTime) Len() int           { return len(l) }
+func (l historyByTime) Less(a, b int) bool { return l[a].Time.Before(l[b].Time) }
+func (l historyByTime) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
@@ -0,0 +1,115 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/protocol"
+)
+
+// IncludeDir is the directory, next to the config file, of drop-in files
+// with more folders and devices. Each *.xml, *.json, *.yaml or *.yml file in
+// it holds a configuration like the config file itself; its folders and
+// devices are added to those of the config file at load, in file name
+// order, and everything else in it is ignored.
+//
+// The drop-in files belong to whoever manages them, so their folders and
+// devices are never written back to the config file. Changes made to them
+// in the GUI last until the next restart.
+const IncludeDir = "config.d"
+
+// mergeIncludes adds the folders and devices of the drop-in files in dir to
+// the configuration, and returns the IDs of the devices added. A device that
+// is already configured is left as it is.
+func mergeIncludes(cfg *Configuration, dir string) (map[protocol.DeviceID]bool, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[protocol.DeviceID]bool)
+	for _, device := range cfg.Devices {
+		devices[device.DeviceID] = false
+	}
+
+	for _, info := range infos {
+		if ext := filepath.Ext(info.Name()); info.IsDir() || ext != ".xml" && !isJSON(ext) && !isYAML(ext) {
+			continue
+		}
+		name := filepath.Join(dir, info.Name())
+		inc, err := readInclude(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		cfg.Folders = append(cfg.Folders, inc.Folders...)
+		for _, device := range inc.Devices {
+			if _, ok := devices[device.DeviceID]; ok {
+				l.Warnf("Device %s in %s is already configured; ignoring", device.DeviceID, name)
+				continue
+			}
+			devices[device.DeviceID] = true
+			cfg.Devices = append(cfg.Devices, device)
+		}
+	}
+
+	included := make(map[protocol.DeviceID]bool)
+	for id, inc := range devices {
+		if inc {
+			included[id] = true
+		}
+	}
+	return included, nil
+}
+
+func readInclude(name string) (Configuration, error) {
+	var inc Configuration
+	fd, err := os.Open(name)
+	if err != nil {
+		return inc, err
+	}
+	defer fd.Close()
+	switch {
+	case isJSON(name):
+		err = json.NewDecoder(fd).Decode(&inc)
+	case isYAML(name):
+		var bs []byte
+		if bs, err = yamlToJSON(fd); err == nil {
+			err = json.Unmarshal(bs, &inc)
+		}
+	default:
+		err = xml.NewDecoder(fd).Decode(&inc)
+	}
+	return inc, err
+}
+
+// withoutIncludes returns the configuration without the folders and devices
+// of the drop-in files, as it's saved to the config file.
+func (w *Wrapper) withoutIncludes() Configuration {
+	cfg := w.cfg
+	cfg.Folders = nil
+	for _, folder := range w.cfg.Folders {
+		if !w.includedFolders[folder.ID] {
+			cfg.Folders = append(cfg.Folders, folder)
+		}
+	}
+	cfg.Devices = nil
+	for _, device := range w.cfg.Devices {
+		if !w.includedDevices[device.DeviceID] {
+			cfg.Devices = append(cfg.Devices, device)
+		}
+	}
+	return cfg
+}
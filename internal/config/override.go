@@ -0,0 +1,132 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Override sets the option with the given name, as in the config file, for
+// as long as the program runs; the value takes precedence over whatever the
+// config file or later changes say, and isn't saved. Names prefixed with
+// "gui.", such as "gui.address" and "gui.apikey", are those of the GUI
+// section. Strings, numbers and booleans can be overridden, as well as lists
+// of strings, given as a comma separated list.
+func (w *Wrapper) Override(name, value string) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	key, err := overrideField(name)
+	if err != nil {
+		return err
+	}
+	cfg := w.cfg
+	if err := setField(key.field(&cfg), value); err != nil {
+		return fmt.Errorf("option %s: %v", name, err)
+	}
+	cfg.GUI.hashAPIKeys()
+
+	if w.overrides == nil {
+		w.overrides = make(map[overrideKey]string)
+		w.unoverridden = w.cfg
+	}
+	w.overrides[key] = value
+	w.cfg = cfg
+	return nil
+}
+
+// An overrideKey is an overridable field, by section and field index.
+type overrideKey struct {
+	gui bool
+	idx int
+}
+
+func (k overrideKey) field(cfg *Configuration) reflect.Value {
+	if k.gui {
+		return reflect.ValueOf(&cfg.GUI).Elem().Field(k.idx)
+	}
+	return reflect.ValueOf(&cfg.Options).Elem().Field(k.idx)
+}
+
+// applyOverrides sets the overridden options on the configuration.
+func (w *Wrapper) applyOverrides(cfg *Configuration) {
+	for key, value := range w.overrides {
+		// The value was checked by Override.
+		setField(key.field(cfg), value)
+	}
+}
+
+// withoutOverrides returns the configuration with the options as they were
+// before being overridden, as they're saved to the config file.
+func (w *Wrapper) withoutOverrides(cfg Configuration) Configuration {
+	for key := range w.overrides {
+		key.field(&cfg).Set(key.field(&w.unoverridden))
+	}
+	return cfg
+}
+
+// overrideField returns the field with the given XML name, compared without
+// regard to case, in the options or, with the "gui." prefix, the GUI
+// section.
+func overrideField(name string) (overrideKey, error) {
+	var key overrideKey
+	t := reflect.TypeOf(OptionsConfiguration{})
+	field := name
+	if len(name) > 4 && strings.EqualFold(name[:4], "gui.") {
+		key.gui = true
+		t = reflect.TypeOf(GUIConfiguration{})
+		field = name[4:]
+	}
+	for i := 0; i < t.NumField(); i++ {
+		xmlName := strings.Split(t.Field(i).Tag.Get("xml"), ",")[0]
+		if strings.EqualFold(xmlName, field) {
+			key.idx = i
+			return key, nil
+		}
+	}
+	return key, fmt.Errorf("no option %q", name)
+}
+
+func setField(f reflect.Value, value string) error {
+	switch f.Interface().(type) {
+	case string:
+		f.SetString(value)
+
+	case int:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(i)
+
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+
+	case []string:
+		var vs []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				vs = append(vs, v)
+			}
+		}
+		if vs == nil {
+			vs = []string{}
+		}
+		f.Set(reflect.ValueOf(vs))
+
+	default:
+		return fmt.Errorf("can't be overridden")
+	}
+	return nil
+}
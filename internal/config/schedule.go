@@ -0,0 +1,91 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+// A TimeWindow is a period of the day, such as 09:00 to 17:00, optionally
+// on certain days of the week only. A window that ends before it starts
+// passes midnight; one that ends when it starts lasts all day.
+type TimeWindow struct {
+	Start string `xml:"start,attr" json:"start"`         // HH:MM
+	End   string `xml:"end,attr" json:"end"`             // HH:MM
+	Days  string `xml:"days,attr,omitempty" json:"days"` // Comma separated, e.g. "mon,tue,wed". Empty means every day.
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Contains returns true if the given time is within the window. Windows that
+// can't be parsed never contain anything.
+func (w TimeWindow) Contains(t time.Time) bool {
+	start, ok := parseClock(w.Start)
+	if !ok {
+		return false
+	}
+	end, ok := parseClock(w.End)
+	if !ok {
+		return false
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	switch {
+	case start == end:
+		return w.onDay(today)
+	case start < end:
+		return start <= now && now < end && w.onDay(today)
+	default:
+		// The window passes midnight, so the early hours belong to the
+		// window started the day before.
+		return now >= start && w.onDay(today) || now < end && w.onDay(yesterday)
+	}
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if w.Days == "" {
+		return true
+	}
+	for _, d := range strings.Split(w.Days, ",") {
+		if strings.ToLower(strings.TrimSpace(d)) == weekdays[day] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock returns the number of minutes past midnight of a time given as
+// HH:MM.
+func parseClock(s string) (int, bool) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// A RateLimitWindow sets the rate limits in effect during a time window. Zero
+// means unlimited.
+type RateLimitWindow struct {
+	TimeWindow
+	MaxSendKbps int `xml:"maxSendKbps,attr" json:"maxSendKbps"`
+	MaxRecvKbps int `xml:"maxRecvKbps,attr" json:"maxRecvKbps"`
+}
+
+// InWindows returns true if the given time is within any of the windows.
+func InWindows(windows []TimeWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
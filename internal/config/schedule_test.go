@@ -0,0 +1,50 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2015-06-01 was a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2015, time.June, day, hour, min, 0, 0, time.Local)
+	}
+
+	cases := []struct {
+		w  TimeWindow
+		t  time.Time
+		in bool
+	}{
+		{TimeWindow{Start: "09:00", End: "17:00"}, at(1, 9, 0), true},
+		{TimeWindow{Start: "09:00", End: "17:00"}, at(1, 16, 59), true},
+		{TimeWindow{Start: "09:00", End: "17:00"}, at(1, 17, 0), false},
+		{TimeWindow{Start: "09:00", End: "17:00"}, at(1, 8, 59), false},
+		{TimeWindow{Start: "9:00", End: "17:00"}, at(1, 12, 0), true},
+		{TimeWindow{Start: "09:00", End: "17:00", Days: "mon,tue"}, at(2, 12, 0), true},
+		{TimeWindow{Start: "09:00", End: "17:00", Days: "mon, tue"}, at(3, 12, 0), false},
+		{TimeWindow{Start: "09:00", End: "17:00", Days: "Sat,Sun"}, at(7, 12, 0), true},
+		// Past midnight, the early hours belong to the day before
+		{TimeWindow{Start: "22:00", End: "06:00"}, at(1, 23, 0), true},
+		{TimeWindow{Start: "22:00", End: "06:00"}, at(1, 5, 0), true},
+		{TimeWindow{Start: "22:00", End: "06:00"}, at(1, 12, 0), false},
+		{TimeWindow{Start: "22:00", End: "06:00", Days: "fri"}, at(6, 5, 0), true},
+		{TimeWindow{Start: "22:00", End: "06:00", Days: "fri"}, at(5, 5, 0), false},
+		// All day
+		{TimeWindow{Start: "00:00", End: "00:00"}, at(4, 13, 37), true},
+		// Invalid
+		{TimeWindow{Start: "9am", End: "17:00"}, at(1, 12, 0), false},
+	}
+
+	for i, tc := range cases {
+		if in := tc.w.Contains(tc.t); in != tc.in {
+			t.Errorf("%d: %+v contains %v = %v, expected %v", i, tc.w, tc.t, in, tc.in)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The secrets in the config file can be given as references instead, as
+// env:NAME for an environment variable or file:PATH for the contents of a
+// file. They are resolved at load and the reference is kept when saving,
+// unless the secret was changed since.
+//
+// secretFields returns the secrets of the configuration by name. The webhook
+// URLs count, as they often carry a token. Their slice is shared with other
+// copies of the configuration, so it's copied before writing to them.
+func secretFields(cfg *Configuration) map[string]*string {
+	fields := map[string]*string{
+		"gui apikey":     &cfg.GUI.APIKey,
+		"gui password":   &cfg.GUI.Password,
+		"gui totpSecret": &cfg.GUI.TOTPSecret,
+		"smtp password":  &cfg.Options.SMTP.Password,
+	}
+	for i := range cfg.Options.Webhooks {
+		fields[fmt.Sprintf("webhook %d url", i+1)] = &cfg.Options.Webhooks[i].URL
+	}
+	return fields
+}
+
+// A secretRef is a secret given as a reference, and the value it had after
+// loading.
+type secretRef struct {
+	ref   string
+	value string
+}
+
+// resolveSecrets replaces the references among the secrets with what they
+// refer to, and returns the references by field.
+func resolveSecrets(cfg *Configuration) (map[string]string, error) {
+	refs := make(map[string]string)
+	for name, p := range secretFields(cfg) {
+		var value string
+		switch {
+		case !isSecretRef(*p):
+			continue
+		case strings.HasPrefix(*p, "env:"):
+			value = os.Getenv((*p)[4:])
+			if value == "" {
+				return nil, fmt.Errorf("%s: environment variable %s is not set", name, (*p)[4:])
+			}
+		case strings.HasPrefix(*p, "file:"):
+			bs, err := ioutil.ReadFile((*p)[5:])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			value = strings.TrimSpace(string(bs))
+		}
+		refs[name] = *p
+		*p = value
+	}
+	return refs, nil
+}
+
+func isSecretRef(s string) bool {
+	return strings.HasPrefix(s, "env:") || strings.HasPrefix(s, "file:")
+}
+
+// The secrets are kept out of the config history, and the diffs of it,
+// as redactedSecret. References to secrets are kept as they are.
+const redactedSecret = "[redacted]"
+
+// withoutSecrets returns the configuration with the secrets redacted.
+func withoutSecrets(cfg Configuration) Configuration {
+	cfg.Options.Webhooks = append([]Webhook(nil), cfg.Options.Webhooks...)
+	for _, p := range secretFields(&cfg) {
+		if *p != "" && !isSecretRef(*p) {
+			*p = redactedSecret
+		}
+	}
+	if len(cfg.GUI.TOTPRecoveryCodes) > 0 {
+		cfg.GUI.TOTPRecoveryCodes = []string{redactedSecret}
+	}
+	return cfg
+}
+
+// restoreSecrets puts the secrets of the current configuration in place of
+// the redacted ones.
+func restoreSecrets(cfg *Configuration, cur Configuration) {
+	curFields := secretFields(&cur)
+	for name, p := range secretFields(cfg) {
+		if *p == redactedSecret {
+			if cp, ok := curFields[name]; ok {
+				*p = *cp
+			} else {
+				*p = ""
+			}
+		}
+	}
+	if codes := cfg.GUI.TOTPRecoveryCodes; len(codes) == 1 && codes[0] == redactedSecret {
+		cfg.GUI.TOTPRecoveryCodes = cur.GUI.TOTPRecoveryCodes
+	}
+}
+
+// withSecretRefs returns the configuration with the secrets that still have
+// the value they were loaded with put back as references.
+func (w *Wrapper) withSecretRefs(cfg Configuration) Configuration {
+	if len(w.secretRefs) == 0 {
+		return cfg
+	}
+	cfg.Options.Webhooks = append([]Webhook(nil), cfg.Options.Webhooks...)
+	fields := secretFields(&cfg)
+	for name, ref := range w.secretRefs {
+		if p, ok := fields[name]; ok && *p == ref.value {
+			*p = ref.ref
+		}
+	}
+	return cfg
+}
+
+const apiKeyHashPrefix = "sha256:"
+
+// HashAPIKey returns the hashed form of the API key, as it can be kept in the
+// config file in its place.
+func HashAPIKey(key string) string {
+	if IsHashedAPIKey(key) {
+		return key
+	}
+	return hashKey(key)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// IsHashedAPIKey returns whether the configured API key is hashed.
+func IsHashedAPIKey(key string) bool {
+	return strings.HasPrefix(key, apiKeyHashPrefix)
+}
+
+// APIKeyMatches returns whether the key given by a client matches the
+// configured one, hashed or not.
+func APIKeyMatches(configured, key string) bool {
+	if configured == "" || key == "" {
+		return false
+	}
+	if IsHashedAPIKey(configured) {
+		// Hashed even if it looks hashed already, or the hash would do
+		// as the key.
+		key = hashKey(key)
+	}
+	return subtle.ConstantTimeCompare([]byte(configured), []byte(key)) == 1
+}
+
+// hashAPIKeys hashes the API keys that aren't yet, if the configuration asks
+// for it, and returns whether there were any.
+func (c *GUIConfiguration) hashAPIKeys() bool {
+	if !c.HashAPIKeys {
+		return false
+	}
+	changed := false
+	if c.APIKey != "" && !IsHashedAPIKey(c.APIKey) {
+		c.APIKey = HashAPIKey(c.APIKey)
+		changed = true
+	}
+	// The slice may well be shared with another copy of the configuration.
+	extras := make([]APIKeyConfiguration, len(c.ExtraAPIKeys))
+	extrasChanged := false
+	for i, extra := range c.ExtraAPIKeys {
+		extras[i] = extra
+		if !IsHashedAPIKey(extra.Key) {
+			extras[i].Key = HashAPIKey(extra.Key)
+			extrasChanged = true
+		}
+	}
+	if extrasChanged {
+		c.ExtraAPIKeys = extras
+	}
+	return changed || extrasChanged
+}
@@ -7,6 +7,7 @@
 package config
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -64,6 +65,17 @@ type Wrapper struct {
 	replaces  chan Configuration
 	mut       sync.Mutex
 
+	// From the drop-in files, and so not saved
+	includedFolders map[string]bool
+	includedDevices map[protocol.DeviceID]bool
+
+	overrides    map[overrideKey]string
+	unoverridden Configuration // as loaded, for saving
+
+	secretRefs map[string]secretRef // by secret field
+
+	historyDir string
+
 	subs []Committer
 	sMut sync.Mutex
 }
@@ -81,8 +93,8 @@ func Wrap(path string, cfg Configuration) *Wrapper {
 	return w
 }
 
-// Load loads an existing file on disk and returns a new configuration
-// wrapper.
+// Load loads an existing file on disk, along with the drop-in files in the
+// IncludeDir next to it, and returns a new configuration wrapper.
 func Load(path string, myID protocol.DeviceID) (*Wrapper, error) {
 	fd, err := os.Open(path)
 	if err != nil {
@@ -90,12 +102,44 @@ func Load(path string, myID protocol.DeviceID) (*Wrapper, error) {
 	}
 	defer fd.Close()
 
-	cfg, err := ReadXML(fd, myID)
+	cfg, err := decodeFile(path, fd)
 	if err != nil {
 		return nil, err
 	}
 
-	return Wrap(path, cfg), nil
+	own := len(cfg.Folders)
+	devices, err := mergeIncludes(&cfg, filepath.Join(filepath.Dir(path), IncludeDir))
+	if err != nil {
+		return nil, err
+	}
+	refs, err := resolveSecrets(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	migrate := cfg.GUI.hashAPIKeys()
+	cfg.prepare(myID)
+
+	w := Wrap(path, cfg)
+	w.secretRefs = make(map[string]secretRef, len(refs))
+	fields := secretFields(&cfg)
+	for name, ref := range refs {
+		w.secretRefs[name] = secretRef{ref, *fields[name]}
+	}
+	if len(cfg.Folders) > own || len(devices) > 0 {
+		w.includedFolders = make(map[string]bool)
+		for _, folder := range cfg.Folders[own:] {
+			w.includedFolders[folder.ID] = true
+		}
+		w.includedDevices = devices
+	}
+
+	if migrate {
+		l.Infoln("Hashing the API keys in the config file")
+		if err := w.Save(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
 }
 
 // Stop stops the Serve() loop. Set and Replace operations will panic after a
@@ -117,6 +161,25 @@ func (w *Wrapper) Raw() Configuration {
 	return w.cfg
 }
 
+// ConfigPath returns the path of the config file.
+func (w *Wrapper) ConfigPath() string {
+	return w.path
+}
+
+// Update makes the changes of fn to a copy of the configuration and replaces
+// the current one with it, unless fn returns an error. Nothing else can
+// change the configuration in between.
+func (w *Wrapper) Update(fn func(cfg *Configuration) error) (CommitResponse, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	newCfg := w.cfg.Copy()
+	if err := fn(&newCfg); err != nil {
+		return ResponseNoRestart, err
+	}
+	return w.replaceLocked(newCfg), nil
+}
+
 // Replace swaps the current configuration object for the given one.
 func (w *Wrapper) Replace(cfg Configuration) CommitResponse {
 	w.mut.Lock()
@@ -124,31 +187,50 @@ func (w *Wrapper) Replace(cfg Configuration) CommitResponse {
 	return w.replaceLocked(cfg)
 }
 
-func (w *Wrapper) replaceLocked(to Configuration) CommitResponse {
-	from := w.cfg
+// Verify returns the error the subscribers would reject the configuration
+// with, without replacing the current one.
+func (w *Wrapper) Verify(to Configuration) error {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	w.applyOverrides(&to)
+	to.GUI.hashAPIKeys()
+	return w.verifyLocked(to)
+}
 
+func (w *Wrapper) verifyLocked(to Configuration) error {
 	for _, sub := range w.subs {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln(sub, "verifying configuration")
 		}
-		if err := sub.VerifyConfiguration(from, to); err != nil {
-			if debug {
+		if err := sub.VerifyConfiguration(w.cfg, to); err != nil {
+			if debug.Enabled() {
 				l.Debugln(sub, "rejected config:", err)
 			}
-			return CommitResponse{
-				ValidationError: err,
-			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Wrapper) replaceLocked(to Configuration) CommitResponse {
+	from := w.cfg
+	w.applyOverrides(&to)
+	to.GUI.hashAPIKeys()
+
+	if err := w.verifyLocked(to); err != nil {
+		return CommitResponse{
+			ValidationError: err,
 		}
 	}
 
 	allOk := true
 	for _, sub := range w.subs {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln(sub, "committing configuration")
 		}
 		ok := sub.CommitConfiguration(from, to)
 		if !ok {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln(sub, "requires restart")
 			}
 			allOk = false
@@ -236,6 +318,55 @@ func (w *Wrapper) SetFolder(fld FolderConfiguration) CommitResponse {
 	return w.replaceLocked(newCfg)
 }
 
+// RemoveFolder removes the folder with the given ID from the configuration.
+// It returns false if there is no such folder.
+func (w *Wrapper) RemoveFolder(id string) (CommitResponse, bool) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	newCfg := w.cfg.Copy()
+	for i := range newCfg.Folders {
+		if newCfg.Folders[i].ID == id {
+			newCfg.Folders = append(newCfg.Folders[:i], newCfg.Folders[i+1:]...)
+			return w.replaceLocked(newCfg), true
+		}
+	}
+	return ResponseNoRestart, false
+}
+
+// RemoveDevice removes the device from the configuration, and stops sharing
+// all folders with it. It returns false if there is no such device.
+func (w *Wrapper) RemoveDevice(id protocol.DeviceID) (CommitResponse, bool) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	newCfg := w.cfg.Copy()
+	found := false
+	for i := range newCfg.Devices {
+		if newCfg.Devices[i].DeviceID == id {
+			newCfg.Devices = append(newCfg.Devices[:i], newCfg.Devices[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ResponseNoRestart, false
+	}
+
+	for i := range newCfg.Folders {
+		folder := &newCfg.Folders[i]
+		devs := folder.Devices[:0]
+		for _, dev := range folder.Devices {
+			if dev.DeviceID != id {
+				devs = append(devs, dev)
+			}
+		}
+		folder.Devices = devs
+		folder.deviceIDs = nil
+	}
+	return w.replaceLocked(newCfg), true
+}
+
 // Options returns the current options configuration object.
 func (w *Wrapper) Options() OptionsConfiguration {
 	w.mut.Lock()
@@ -281,15 +412,40 @@ func (w *Wrapper) IgnoredDevice(id protocol.DeviceID) bool {
 	return false
 }
 
+// SavedConfiguration is the data of the ConfigSaved event: the configuration,
+// which is all that's shown of it, and who saved it, when known.
+type SavedConfiguration struct {
+	Configuration
+	By map[string]string `json:"-"`
+}
+
 // Save writes the configuration to disk, and generates a ConfigSaved event.
 func (w *Wrapper) Save() error {
+	return w.SaveBy(nil)
+}
+
+// SaveBy is Save, for a change made by the given actor, such as the user or
+// API key of a request, for the audit log.
+func (w *Wrapper) SaveBy(by map[string]string) error {
 	fd, err := ioutil.TempFile(filepath.Dir(w.path), "cfg")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(fd.Name())
 
-	err = w.cfg.WriteXML(fd)
+	cfg := w.cfg
+	if w.includedFolders != nil {
+		cfg = w.withoutIncludes()
+	}
+	if w.overrides != nil {
+		cfg = w.withoutOverrides(cfg)
+	}
+	cfg = w.withSecretRefs(cfg)
+	var buf bytes.Buffer
+	err = cfg.writeFile(w.path, &buf)
+	if err == nil {
+		_, err = fd.Write(buf.Bytes())
+	}
 	if err != nil {
 		fd.Close()
 		return err
@@ -300,7 +456,13 @@ func (w *Wrapper) Save() error {
 		return err
 	}
 
-	events.Default.Log(events.ConfigSaved, w.cfg)
+	events.Default.Log(events.ConfigSaved, SavedConfiguration{Configuration: w.cfg, By: by})
 
-	return osutil.Rename(fd.Name(), w.path)
+	if err := osutil.Rename(fd.Name(), w.path); err != nil {
+		return err
+	}
+	if err := w.addHistory(cfg); err != nil {
+		l.Warnln("Keeping the config history:", err)
+	}
+	return nil
 }
@@ -41,12 +41,13 @@ func NewBlockMap(db *leveldb.DB, folder string) *BlockMap {
 	}
 }
 
-// Add files to the block map, ignoring any deleted or invalid files.
+// Add files to the block map, ignoring any deleted or invalid files and hard
+// links.
 func (m *BlockMap) Add(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
 	buf := make([]byte, 4)
 	for _, file := range files {
-		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() {
+		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() || IsHardLink(file) {
 			continue
 		}
 
@@ -58,7 +59,8 @@ func (m *BlockMap) Add(files []protocol.FileInfo) error {
 	return m.db.Write(batch, nil)
 }
 
-// Update block map state, removing any deleted or invalid files.
+// Update block map state, removing any deleted or invalid files and hard
+// links.
 func (m *BlockMap) Update(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
 	buf := make([]byte, 4)
@@ -67,7 +69,9 @@ func (m *BlockMap) Update(files []protocol.FileInfo) error {
 			continue
 		}
 
-		if file.IsDeleted() || file.IsInvalid() {
+		if file.IsDeleted() || file.IsInvalid() || IsHardLink(file) {
+			// The blocks of a hard link are its target name, nothing that
+			// can be copied from.
 			for _, block := range file.Blocks {
 				batch.Delete(m.blockKey(block.Hash, file.Name))
 			}
@@ -0,0 +1,371 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// FolderCheck is what CheckIndex found in the index of a folder, and whether
+// the folder was rebuilt. Everything else found is fixed in place.
+type FolderCheck struct {
+	Folder            string `json:"folder"`
+	CorruptEntries    int    `json:"corruptEntries"`    // can't be decoded, or make no sense
+	DanglingGlobals   int    `json:"danglingGlobals"`   // global versions of files the device doesn't have
+	MissingGlobals    int    `json:"missingGlobals"`    // device files not among the global versions
+	VersionMismatches int    `json:"versionMismatches"` // global versions that aren't those of the device's file
+	OrphanedBlocks    int    `json:"orphanedBlocks"`    // block map entries for blocks no local file has
+	Rebuilt           bool   `json:"rebuilt"`           // dropped, to be rebuilt by scanning and from the other devices
+}
+
+// Problems returns the number of problems found.
+func (c FolderCheck) Problems() int {
+	return c.CorruptEntries + c.DanglingGlobals + c.MissingGlobals + c.VersionMismatches + c.OrphanedBlocks
+}
+
+func (c FolderCheck) String() string {
+	if c.Problems() == 0 {
+		return fmt.Sprintf("folder %q: ok", c.Folder)
+	}
+	var found []string
+	for _, p := range []struct {
+		n    int
+		what string
+	}{
+		{c.CorruptEntries, "corrupt entries"},
+		{c.DanglingGlobals, "dangling global versions"},
+		{c.MissingGlobals, "missing global versions"},
+		{c.VersionMismatches, "mismatched global versions"},
+		{c.OrphanedBlocks, "orphaned blocks"},
+	} {
+		if p.n > 0 {
+			found = append(found, fmt.Sprintf("%d %s", p.n, p.what))
+		}
+	}
+	s := fmt.Sprintf("folder %q: %s", c.Folder, strings.Join(found, ", "))
+	if c.Rebuilt {
+		s += "; rebuilt"
+	}
+	return s
+}
+
+// CheckIndex checks the index of every folder in the database against the
+// invariants kept by the rest of this package: every valid file of a device
+// is among the global versions of the file, with the same version; every
+// global version is that of a valid file of the device; version vectors are
+// sorted by ID, which comparing them depends on; and every block map entry is
+// a block of a local file. With repair set, the problems found are fixed, or, for
+// folders with corrupt entries, the folder is dropped so that it's rebuilt
+// by scanning and from the indexes of the other devices.
+//
+// Repairs mustn't race with other changes to the database, so repair only
+// before the folders are opened.
+func CheckIndex(db *leveldb.DB, repair bool) []FolderCheck {
+	var res []FolderCheck
+	for _, folder := range listAllFolders(db) {
+		res = append(res, checkFolder(db, folder, repair))
+	}
+	return res
+}
+
+// ScheduleRepair asks for the index to be checked and repaired the next time
+// RepairIfScheduled is called, at startup.
+func ScheduleRepair(db *leveldb.DB) {
+	NewMiscDataNamespace(db).PutTime("repairScheduled", time.Now())
+}
+
+// RepairIfScheduled checks and repairs the index if ScheduleRepair asked for
+// it, and returns what was found.
+func RepairIfScheduled(db *leveldb.DB) []FolderCheck {
+	misc := NewMiscDataNamespace(db)
+	if _, ok := misc.Time("repairScheduled"); !ok {
+		return nil
+	}
+	res := CheckIndex(db, true)
+	misc.Delete("repairScheduled")
+	return res
+}
+
+// listAllFolders returns the folders in the database, including those with
+// only some of their entries left.
+func listAllFolders(db *leveldb.DB) []string {
+	seen := make(map[string]bool)
+	for _, keyType := range []byte{KeyTypeDevice, KeyTypeGlobal, KeyTypeBlock} {
+		dbi := db.NewIterator(util.BytesPrefix([]byte{keyType}), nil)
+		for dbi.Next() {
+			key := dbi.Key()
+			if len(key) < 1+64 {
+				continue
+			}
+			seen[string(bytes.TrimRight(key[1:1+64], "\x00"))] = true
+			// Skip to the next folder.
+			dbi.Seek(util.BytesPrefix(key[:1+64]).Limit)
+			dbi.Prev()
+		}
+		dbi.Release()
+	}
+
+	folders := make([]string, 0, len(seen))
+	for folder := range seen {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// A file version to be added to, or corrected in, the global version list.
+type globalFix struct {
+	name    []byte
+	device  []byte
+	version protocol.Vector
+}
+
+func checkFolder(db *leveldb.DB, folder string, repair bool) FolderCheck {
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+
+	res := FolderCheck{Folder: folder}
+	batch := new(leveldb.Batch)
+	fixes := checkGlobals(snap, []byte(folder), batch, &res)
+	fixes = append(fixes, checkDeviceFiles(snap, []byte(folder), &res)...)
+	checkBlocks(snap, folder, batch, &res)
+
+	if !repair || res.Problems() == 0 {
+		return res
+	}
+	if res.CorruptEntries > 0 {
+		DropFolder(db, folder)
+		res.Rebuilt = true
+		return res
+	}
+	if err := db.Write(batch, nil); err != nil {
+		panic(err)
+	}
+	for _, fix := range fixes {
+		// One at a time, as several may be for the same file.
+		batch := new(leveldb.Batch)
+		ldbUpdateGlobal(db, batch, []byte(folder), fix.device, fix.name, fix.version)
+		if err := db.Write(batch, nil); err != nil {
+			panic(err)
+		}
+	}
+	return res
+}
+
+// checkGlobals checks the global version lists of the folder, dropping
+// versions of files the device doesn't have (or has as invalid) in the batch,
+// and returns the versions to be corrected.
+func checkGlobals(snap *leveldb.Snapshot, folder []byte, batch *leveldb.Batch, res *FolderCheck) []globalFix {
+	dbi := snap.NewIterator(util.BytesPrefix(globalKey(folder, nil)), nil)
+	defer dbi.Release()
+
+	var fixes []globalFix
+	var fk []byte
+	for dbi.Next() {
+		var vl versionList
+		if err := vl.UnmarshalXDR(dbi.Value()); err != nil {
+			res.CorruptEntries++
+			continue
+		}
+
+		if len(vl.versions) == 0 {
+			res.DanglingGlobals++
+			batch.Delete(dbi.Key())
+			continue
+		}
+
+		name := globalKeyName(dbi.Key())
+		var newVL versionList
+		for _, version := range vl.versions {
+			if !saneVector(version.version) {
+				res.CorruptEntries++
+				continue
+			}
+			fk = deviceKeyInto(fk[:cap(fk)], folder, version.device, name)
+			bs, err := snap.Get(fk, nil)
+			if err == leveldb.ErrNotFound {
+				res.DanglingGlobals++
+				continue
+			}
+			if err != nil {
+				panic(err)
+			}
+			var f FileInfoTruncated
+			if err := f.UnmarshalXDR(bs); err != nil {
+				// Counted as corrupt along with the rest of the device
+				// files.
+				continue
+			}
+			if f.IsInvalid() {
+				res.DanglingGlobals++
+				continue
+			}
+			if !f.Version.Equal(version.version) {
+				res.VersionMismatches++
+				fixes = append(fixes, globalFix{
+					name:    append([]byte(nil), name...),
+					device:  append([]byte(nil), version.device...),
+					version: f.Version,
+				})
+				continue
+			}
+			newVL.versions = append(newVL.versions, version)
+		}
+
+		switch {
+		case len(newVL.versions) == len(vl.versions):
+		case len(newVL.versions) == 0:
+			batch.Delete(dbi.Key())
+		default:
+			batch.Put(dbi.Key(), newVL.MustMarshalXDR())
+		}
+	}
+	return fixes
+}
+
+// checkDeviceFiles checks the files of all devices in the folder and returns
+// the valid ones that aren't among the global versions.
+func checkDeviceFiles(snap *leveldb.Snapshot, folder []byte, res *FolderCheck) []globalFix {
+	dbi := snap.NewIterator(util.BytesPrefix(deviceKey(folder, nil, nil)[:1+64]), nil)
+	defer dbi.Release()
+
+	var fixes []globalFix
+	for dbi.Next() {
+		key := dbi.Key()
+		if len(key) < 1+64+32 {
+			res.CorruptEntries++
+			continue
+		}
+		var f FileInfoTruncated
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			res.CorruptEntries++
+			continue
+		}
+		name := deviceKeyName(key)
+		if f.Name != string(name) || !saneVector(f.Version) {
+			res.CorruptEntries++
+			continue
+		}
+		if f.IsInvalid() {
+			continue
+		}
+
+		device := deviceKeyDevice(key)
+		bs, err := snap.Get(globalKey(folder, name), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			panic(err)
+		}
+		var vl versionList
+		if err == nil && vl.UnmarshalXDR(bs) != nil {
+			// Counted as corrupt by checkGlobals.
+			continue
+		}
+		found := false
+		for _, version := range vl.versions {
+			if bytes.Equal(version.device, device) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res.MissingGlobals++
+			fixes = append(fixes, globalFix{
+				name:    append([]byte(nil), name...),
+				device:  append([]byte(nil), device...),
+				version: f.Version,
+			})
+		}
+	}
+	return fixes
+}
+
+// The number of block hashes checkBlocks keeps decoded, as the block map
+// entries of a file are spread all over the block map.
+const checkBlocksCache = 1 << 20
+
+// checkBlocks checks the block map of the folder, deleting the entries that
+// aren't blocks of local files in the batch.
+func checkBlocks(snap *leveldb.Snapshot, folder string, batch *leveldb.Batch, res *FolderCheck) {
+	dbi := snap.NewIterator(util.BytesPrefix(toBlockKey(nil, folder, "")[:1+64]), nil)
+	defer dbi.Release()
+
+	// The block hashes of local files by name, nil for files that aren't
+	// there or have no blocks to copy from.
+	cache := make(map[string][][]byte)
+	cached := 0
+	blocks := func(name []byte) ([][]byte, bool) {
+		if hashes, ok := cache[string(name)]; ok {
+			return hashes, true
+		}
+		bs, err := snap.Get(deviceKey([]byte(folder), protocol.LocalDeviceID[:], name), nil)
+		if err == leveldb.ErrNotFound {
+			return nil, true
+		}
+		if err != nil {
+			panic(err)
+		}
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(bs); err != nil {
+			return nil, false
+		}
+		var hashes [][]byte
+		if !f.IsDirectory() && !f.IsDeleted() && !f.IsInvalid() && !IsHardLink(f) {
+			for _, block := range f.Blocks {
+				hashes = append(hashes, block.Hash)
+			}
+		}
+		if cached+len(hashes) > checkBlocksCache {
+			cache = make(map[string][][]byte)
+			cached = 0
+		}
+		cache[string(name)] = hashes
+		cached += len(hashes)
+		return hashes, true
+	}
+
+	for dbi.Next() {
+		key := dbi.Key()
+		if len(key) < 1+64+32+1 || len(dbi.Value()) != 4 {
+			res.OrphanedBlocks++
+			batch.Delete(key)
+			continue
+		}
+		hashes, ok := blocks(key[1+64+32:])
+		if !ok {
+			// The local file is counted as corrupt by checkDeviceFiles.
+			continue
+		}
+		index := binary.BigEndian.Uint32(dbi.Value())
+		if int(index) >= len(hashes) || !bytes.Equal(hashes[index], key[1+64:1+64+32]) {
+			res.OrphanedBlocks++
+			batch.Delete(key)
+		}
+	}
+}
+
+// saneVector returns whether the counters of the vector are sorted by ID,
+// without duplicates, as Vector.Update keeps them.
+func saneVector(v protocol.Vector) bool {
+	for i := range v {
+		if i > 0 && v[i].ID <= v[i-1].ID {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestCheckIndex(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	block := func(b byte) protocol.BlockInfo {
+		return protocol.BlockInfo{Size: 128, Hash: bytes.Repeat([]byte{b}, 32)}
+	}
+	file := func(name string, v uint64, blocks ...protocol.BlockInfo) protocol.FileInfo {
+		return protocol.FileInfo{Name: name, Version: protocol.Vector{{ID: 1, Value: v}}, Blocks: blocks}
+	}
+
+	s := NewFileSet("default", ldb)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{file("a", 1, block(1)), file("b", 1, block(2)), file("c", 1)})
+	s.Replace(remote, []protocol.FileInfo{file("a", 1), file("b", 2), file("c", 1)})
+
+	check := func(repair bool) FolderCheck {
+		res := CheckIndex(ldb, repair)
+		if len(res) != 1 || res[0].Folder != "default" {
+			t.Fatalf("Incorrect folders checked, %v", res)
+		}
+		return res[0]
+	}
+	if res := check(false); res.Problems() != 0 {
+		t.Fatalf("Problems in a consistent index: %v", res)
+	}
+
+	folder := []byte("default")
+	// The remote device no longer has a, but the global version says so.
+	ldb.Delete(deviceKey(folder, remote[:], []byte("a")), nil)
+	// The global version of b is from before the remote device updated it.
+	batch := new(leveldb.Batch)
+	ldbUpdateGlobal(ldb, batch, folder, remote[:], []byte("b"), protocol.Vector{{ID: 1, Value: 1}})
+	ldb.Write(batch, nil)
+	// The local c isn't among the global versions.
+	batch = new(leveldb.Batch)
+	ldbRemoveFromGlobal(ldb, batch, folder, protocol.LocalDeviceID[:], []byte("c"))
+	ldb.Write(batch, nil)
+	// A block of a file that was never there, and one at the wrong index.
+	buf := make([]byte, 4)
+	ldb.Put(toBlockKey(block(3).Hash, "default", "d"), buf, nil)
+	binary.BigEndian.PutUint32(buf, 1)
+	ldb.Put(toBlockKey(block(1).Hash, "default", "a"), buf, nil)
+
+	expected := FolderCheck{
+		Folder:            "default",
+		DanglingGlobals:   1,
+		MissingGlobals:    1,
+		VersionMismatches: 1,
+		OrphanedBlocks:    2,
+	}
+	if res := check(false); res != expected {
+		t.Errorf("Incorrect check\n%v, expected\n%v", res, expected)
+	}
+	if res := check(true); res != expected {
+		t.Errorf("Incorrect repair\n%v, expected\n%v", res, expected)
+	}
+	if res := check(false); res.Problems() != 0 {
+		t.Errorf("Problems after repair: %v", res)
+	}
+	if f, ok := s.GetGlobal("b"); !ok || !f.Version.Equal(protocol.Vector{{ID: 1, Value: 2}}) {
+		t.Errorf("Incorrect global b after repair, %v", f)
+	}
+
+	// A folder with an entry that can't be decoded is rebuilt.
+	ldb.Put(deviceKey(folder, remote[:], []byte("e")), []byte("garbage"), nil)
+	if res := check(true); res.CorruptEntries != 1 || !res.Rebuilt {
+		t.Errorf("Incorrect repair of a corrupt entry, %v", res)
+	}
+	if res := CheckIndex(ldb, false); len(res) != 0 {
+		t.Errorf("Folder left after rebuild, %v", res)
+	}
+}
+
+func TestRepairIfScheduled(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewFileSet("default", ldb).Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a"}})
+
+	if res := RepairIfScheduled(ldb); res != nil {
+		t.Errorf("Repair without being scheduled, %v", res)
+	}
+	ScheduleRepair(ldb)
+	if res := RepairIfScheduled(ldb); len(res) != 1 {
+		t.Errorf("No repair when scheduled, %v", res)
+	}
+	if res := RepairIfScheduled(ldb); res != nil {
+		t.Errorf("Repair scheduled again, %v", res)
+	}
+}
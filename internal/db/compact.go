@@ -0,0 +1,55 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Compact compacts the whole database in the directory. Deleted and
+// overwritten entries otherwise stay on disk until leveldb happens to compact
+// the files they are in, which after dropping a large folder may be never. It
+// returns the size of the directory before and after.
+func Compact(ldb *leveldb.DB, dir string) (before, after int64, err error) {
+	before, err = dirSize(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := ldb.CompactRange(util.Range{}); err != nil {
+		return before, before, err
+	}
+	after, err = dirSize(dir)
+	return before, after, err
+}
+
+// NewMiscDataNamespace returns the namespace for odds and ends that belong to
+// no folder or device.
+func NewMiscDataNamespace(ldb *leveldb.DB) *NamespacedKV {
+	return NewNamespacedKV(ldb, string([]byte{KeyTypeMiscData}))
+}
+
+func dirSize(dir string) (int64, error) {
+	if dir == "" {
+		// The database is in memory.
+		return 0, nil
+	}
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	// Enough data to end up in tables, all of it deleted again.
+	value := bytes.Repeat([]byte("syncthing"), 1000)
+	for i := 0; i < 2000; i++ {
+		ldb.Put([]byte(fmt.Sprintf("key%d", i)), value, nil)
+	}
+	for i := 0; i < 2000; i++ {
+		ldb.Delete([]byte(fmt.Sprintf("key%d", i)), nil)
+	}
+	ldb.Put([]byte("kept"), []byte("value"), nil)
+
+	before, after, err := Compact(ldb, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before || before-after < 1<<20 {
+		t.Errorf("Incorrect sizes %d before, %d after compaction", before, after)
+	}
+	if v, err := ldb.Get([]byte("kept"), nil); err != nil || string(v) != "value" {
+		t.Errorf("Incorrect value %q after compaction, %v", v, err)
+	}
+}
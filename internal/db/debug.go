@@ -7,14 +7,12 @@
 package db
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug   = strings.Contains(os.Getenv("STTRACE"), "files") || os.Getenv("STTRACE") == "all"
-	debugDB = strings.Contains(os.Getenv("STTRACE"), "db") || os.Getenv("STTRACE") == "all"
+	debug   = trace.Register("files")
+	debugDB = trace.Register("db")
 	l       = logger.DefaultLogger
 )
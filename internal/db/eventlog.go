@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// EventLog keeps encoded events in the database, by ID, so that they survive
+// a restart. It doesn't care what the events look like.
+type EventLog struct {
+	db *leveldb.DB
+}
+
+func NewEventLog(ldb *leveldb.DB) *EventLog {
+	return &EventLog{db: ldb}
+}
+
+func eventLogKey(id int) []byte {
+	key := make([]byte, 9)
+	key[0] = KeyTypeEventLog
+	binary.BigEndian.PutUint64(key[1:], uint64(id))
+	return key
+}
+
+// The highest event ID used, kept apart from the events as not every event
+// is stored.
+var eventLogLastIDKey = append([]byte{KeyTypeMiscData}, "eventLogLastID"...)
+
+// An EventBatch collects events to be written to the log at once.
+type EventBatch struct {
+	batch  leveldb.Batch
+	lastID int
+}
+
+// Add adds the event with the given ID, which must be higher than the IDs
+// already stored.
+func (b *EventBatch) Add(id int, data []byte) {
+	b.batch.Put(eventLogKey(id), data)
+	b.Seen(id)
+}
+
+// Seen records that the event ID has been used, whether or not the event is
+// stored.
+func (b *EventBatch) Seen(id int) {
+	if id > b.lastID {
+		b.lastID = id
+	}
+}
+
+// Empty returns whether there's nothing to write.
+func (b *EventBatch) Empty() bool {
+	return b.lastID == 0
+}
+
+// Append writes the batch, and resets it.
+func (e *EventLog) Append(b *EventBatch) {
+	if b.Empty() {
+		return
+	}
+	var bs [8]byte
+	binary.BigEndian.PutUint64(bs[:], uint64(b.lastID))
+	b.batch.Put(eventLogLastIDKey, bs[:])
+	if err := e.db.Write(&b.batch, nil); err != nil {
+		panic(err)
+	}
+	b.batch.Reset()
+	b.lastID = 0
+}
+
+// LastID returns the highest event ID recorded as used, or zero.
+func (e *EventLog) LastID() int {
+	bs, err := e.db.Get(eventLogLastIDKey, nil)
+	if err != nil || len(bs) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(bs))
+}
+
+// Events returns the stored events, oldest first.
+func (e *EventLog) Events() [][]byte {
+	var evs [][]byte
+	it := e.db.NewIterator(util.BytesPrefix([]byte{KeyTypeEventLog}), nil)
+	defer it.Release()
+	for it.Next() {
+		evs = append(evs, append([]byte(nil), it.Value()...))
+	}
+	return evs
+}
+
+// Truncate removes all but the latest keep events.
+func (e *EventLog) Truncate(keep int) {
+	it := e.db.NewIterator(util.BytesPrefix([]byte{KeyTypeEventLog}), nil)
+	defer it.Release()
+
+	// Walk backwards past the events to keep, then delete the rest.
+	batch := new(leveldb.Batch)
+	for ok := it.Last(); ok; ok = it.Prev() {
+		if keep > 0 {
+			keep--
+			continue
+		}
+		batch.Delete(append([]byte(nil), it.Key()...))
+		if batch.Len() > batchFlushSize {
+			if err := e.db.Write(batch, nil); err != nil {
+				panic(err)
+			}
+			batch.Reset()
+		}
+	}
+	if batch.Len() > 0 {
+		if err := e.db.Write(batch, nil); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestEventLog(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := NewEventLog(ldb)
+
+	// Past 255, so that a byte order mistake would show.
+	var b EventBatch
+	for id := 250; id < 260; id++ {
+		b.Add(id, []byte(fmt.Sprint(id)))
+	}
+	if evs := log.Events(); len(evs) != 0 {
+		t.Fatalf("Events %q stored before the batch was written", evs)
+	}
+	b.Seen(262)
+	log.Append(&b)
+	evs := log.Events()
+	if len(evs) != 10 || string(evs[0]) != "250" || string(evs[9]) != "259" {
+		t.Fatalf("Incorrect events %q", evs)
+	}
+	if id := log.LastID(); id != 262 {
+		t.Errorf("Incorrect last ID %d", id)
+	}
+	if !b.Empty() {
+		t.Error("Batch not reset after writing")
+	}
+
+	log.Truncate(3)
+	evs = log.Events()
+	if len(evs) != 3 || string(evs[0]) != "257" || string(evs[2]) != "259" {
+		t.Fatalf("Incorrect events %q after truncating", evs)
+	}
+}
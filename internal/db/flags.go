@@ -0,0 +1,29 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import "github.com/syncthing/protocol"
+
+// FileInfo flags in addition to those defined by the protocol. Devices that
+// don't know about them refuse files with unknown bits set, so they are only
+// sent to devices advertising support for them in the cluster config.
+const (
+	FlagHidden      uint32 = 1 << 18
+	FlagSystem             = 1 << 19
+	FlagReadOnly           = 1 << 20
+	FlagHardLink           = 1 << 21
+	FlagLocalChange        = 1 << 22 // Never sent; a local change in a receive only folder, always also invalid
+
+	FlagsAll = (1 << 23) - 1
+
+	AttributeMask = FlagHidden | FlagSystem | FlagReadOnly
+)
+
+// IsHardLink returns true if the file is a hard link to another file.
+func IsHardLink(f protocol.FileInfo) bool {
+	return f.Flags&FlagHardLink != 0
+}
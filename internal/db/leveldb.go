@@ -46,6 +46,9 @@ const (
 	KeyTypeDeviceStatistic
 	KeyTypeFolderStatistic
 	KeyTypeVirtualMtime
+	KeyTypeTempBlocks
+	KeyTypeEventLog
+	KeyTypeMiscData
 )
 
 type fileVersion struct {
@@ -178,18 +181,18 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
 
 	batch := new(leveldb.Batch)
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("new batch %p", batch)
 	}
 	snap, err := db.GetSnapshot()
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -220,13 +223,13 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 
 		cmp := bytes.Compare(newName, oldName)
 
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("generic replace; folder=%q device=%v moreFs=%v moreDb=%v cmp=%d newName=%q oldName=%q", folder, protocol.DeviceIDFromBytes(device), moreFs, moreDb, cmp, newName, oldName)
 		}
 
 		switch {
 		case moreFs && (!moreDb || cmp == -1):
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugln("generic replace; missing - insert")
 			}
 			// Database is missing this file. Insert it.
@@ -244,13 +247,13 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			// File exists on both sides - compare versions. We might get an
 			// update with the same version and different flags if a device has
 			// marked a file as invalid, so handle that too.
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugln("generic replace; exists - compare")
 			}
 			var ef FileInfoTruncated
 			ef.UnmarshalXDR(dbi.Value())
 			if !fs[fsi].Version.Equal(ef.Version) || fs[fsi].Flags != ef.Flags {
-				if debugDB {
+				if debugDB.Enabled() {
 					l.Debugln("generic replace; differs - insert")
 				}
 				if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
@@ -261,7 +264,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 				} else {
 					ldbUpdateGlobal(snap, batch, folder, device, newName, fs[fsi].Version)
 				}
-			} else if debugDB {
+			} else if debugDB.Enabled() {
 				l.Debugln("generic replace; equal - ignore")
 			}
 
@@ -269,7 +272,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			moreDb = dbi.Next()
 
 		case moreDb && (!moreFs || cmp == 1):
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugln("generic replace; exists - remove")
 			}
 			if lv := deleteFn(snap, batch, folder, device, oldName, dbi); lv > maxLocalVer {
@@ -281,7 +284,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		// Write out and reuse the batch every few records, to avoid the batch
 		// growing too large and thus allocating unnecessarily much memory.
 		if batch.Len() > batchFlushSize {
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugf("db.Write %p", batch)
 			}
 
@@ -294,7 +297,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		}
 	}
 
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("db.Write %p", batch)
 	}
 	err = db.Write(batch, nil)
@@ -309,11 +312,11 @@ func ldbReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) i
 	// TODO: Return the remaining maxLocalVer?
 	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64 {
 		// Database has a file that we are missing. Remove it.
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("delete; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
 		}
 		ldbRemoveFromGlobal(db, batch, folder, device, name)
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("batch.Delete %p %x", batch, dbi.Key())
 		}
 		batch.Delete(dbi.Key())
@@ -331,7 +334,7 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 			panic(err)
 		}
 		if !tf.IsDeleted() {
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugf("mark deleted; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
 			}
 			ts := clock(tf.LocalVersion)
@@ -343,7 +346,7 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 				Modified:     tf.Modified,
 			}
 			bs, _ := f.MarshalXDR()
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugf("batch.Put %p %x", batch, dbi.Key())
 			}
 			batch.Put(dbi.Key(), bs)
@@ -359,18 +362,18 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 	runtime.GC()
 
 	batch := new(leveldb.Batch)
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("new batch %p", batch)
 	}
 	snap, err := db.GetSnapshot()
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -381,7 +384,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 	for _, f := range fs {
 		name := []byte(f.Name)
 		fk = deviceKeyInto(fk[:cap(fk)], folder, device, name)
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
 		bs, err := snap.Get(fk, nil)
@@ -418,7 +421,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		// Write out and reuse the batch every few records, to avoid the batch
 		// growing too large and thus allocating unnecessarily much memory.
 		if batch.Len() > batchFlushSize {
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugf("db.Write %p", batch)
 			}
 
@@ -431,7 +434,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		}
 	}
 
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("db.Write %p", batch)
 	}
 	err = db.Write(batch, nil)
@@ -443,7 +446,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 }
 
 func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) int64 {
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("insert; folder=%q device=%v %v", folder, protocol.DeviceIDFromBytes(device), file)
 	}
 
@@ -453,7 +456,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 
 	name := []byte(file.Name)
 	nk := deviceKey(folder, device, name)
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("batch.Put %p %x", batch, nk)
 	}
 	batch.Put(nk, file.MustMarshalXDR())
@@ -465,7 +468,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 // file. If the device is already present in the list, the version is updated.
 // If the file does not have an entry in the global list, it is created.
 func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, version protocol.Vector) bool {
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("update global; folder=%q device=%v file=%q version=%d", folder, protocol.DeviceIDFromBytes(device), file, version)
 	}
 	gk := globalKey(folder, file)
@@ -515,7 +518,7 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 	fl.versions = append(fl.versions, nv)
 
 done:
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("batch.Put %p %x", batch, gk)
 		l.Debugf("new global after update: %v", fl)
 	}
@@ -528,7 +531,7 @@ done:
 // given file. If the version list is empty after this, the file entry is
 // removed entirely.
 func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byte) {
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("remove from global; folder=%q device=%v file=%q", folder, protocol.DeviceIDFromBytes(device), file)
 	}
 
@@ -554,12 +557,12 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 	}
 
 	if len(fl.versions) == 0 {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("batch.Delete %p %x", batch, gk)
 		}
 		batch.Delete(gk)
 	} else {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("batch.Put %p %x", batch, gk)
 			l.Debugf("new global after remove: %v", fl)
 		}
@@ -574,11 +577,11 @@ func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -607,11 +610,11 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -668,17 +671,17 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
 	}()
 
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
 	bs, err := snap.Get(k, nil)
@@ -700,7 +703,7 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	}
 
 	k = deviceKey(folder, vl.versions[0].device, file)
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
 	bs, err = snap.Get(k, nil)
@@ -722,11 +725,11 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -748,7 +751,7 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 		}
 		name := globalKeyName(dbi.Key())
 		fk = deviceKeyInto(fk[:cap(fk)], folder, vl.versions[0].device, name)
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
 		bs, err := snap.Get(fk, nil)
@@ -811,11 +814,11 @@ func ldbWithNeed(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -863,7 +866,7 @@ nextFile:
 					continue nextFile
 				}
 				fk = deviceKeyInto(fk[:cap(fk)], folder, vl.versions[i].device, name)
-				if debugDB {
+				if debugDB.Enabled() {
 					l.Debugf("snap.Get %p %x", snap, fk)
 				}
 				bs, err := snap.Get(fk, nil)
@@ -895,7 +898,7 @@ nextFile:
 					continue nextFile
 				}
 
-				if debugDB {
+				if debugDB.Enabled() {
 					l.Debugf("need folder=%q device=%v name=%q need=%v have=%v haveV=%d globalV=%d", folder, protocol.DeviceIDFromBytes(device), name, need, have, haveVersion, vl.versions[0].version)
 				}
 
@@ -917,11 +920,11 @@ func ldbListFolders(db *leveldb.DB) []string {
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -947,6 +950,24 @@ func ldbListFolders(db *leveldb.DB) []string {
 	return folders
 }
 
+func ldbListDevices(db *leveldb.DB, folder []byte) []protocol.DeviceID {
+	dbi := db.NewIterator(util.BytesPrefix(deviceKey(folder, nil, nil)[:1+64]), nil)
+	defer dbi.Release()
+
+	var devices []protocol.DeviceID
+	for dbi.Next() {
+		key := dbi.Key()
+		if len(key) < 1+64+32 {
+			continue
+		}
+		devices = append(devices, protocol.DeviceIDFromBytes(deviceKeyDevice(key)))
+		// Skip past the rest of the files of the device.
+		dbi.Seek(util.BytesPrefix(key[:1+64+32]).Limit)
+		dbi.Prev()
+	}
+	return devices
+}
+
 func ldbDropFolder(db *leveldb.DB, folder []byte) {
 	runtime.GC()
 
@@ -954,11 +975,11 @@ func ldbDropFolder(db *leveldb.DB, folder []byte) {
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -1004,11 +1025,11 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 	if err != nil {
 		panic(err)
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("created snapshot %p", snap)
 	}
 	defer func() {
-		if debugDB {
+		if debugDB.Enabled() {
 			l.Debugf("close snapshot %p", snap)
 		}
 		snap.Release()
@@ -1020,7 +1041,7 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 	defer dbi.Release()
 
 	batch := new(leveldb.Batch)
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Debugf("new batch %p", batch)
 	}
 
@@ -1042,7 +1063,7 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 		var newVL versionList
 		for _, version := range vl.versions {
 			fk = deviceKeyInto(fk[:cap(fk)], folder, version.device, name)
-			if debugDB {
+			if debugDB.Enabled() {
 				l.Debugf("snap.Get %p %x", snap, fk)
 			}
 			_, err := snap.Get(fk, nil)
@@ -1060,7 +1081,7 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 			batch.Put(dbi.Key(), newVL.MustMarshalXDR())
 		}
 	}
-	if debugDB {
+	if debugDB.Enabled() {
 		l.Infoln("db check completed for %q", folder)
 	}
 	db.Write(batch, nil)
@@ -62,7 +62,7 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 		}
 		return true
 	})
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("loaded localVersion for %q: %#v", folder, s.localVersion)
 	}
 	clock(s.localVersion[protocol.LocalDeviceID])
@@ -71,7 +71,7 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 }
 
 func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s Replace(%v, [%d])", s.folder, device, len(fs))
 	}
 	normalizeFilenames(fs)
@@ -89,7 +89,7 @@ func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 }
 
 func (s *FileSet) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.FileInfo, myID uint64) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s ReplaceWithDelete(%v, [%d])", s.folder, device, len(fs))
 	}
 	normalizeFilenames(fs)
@@ -105,7 +105,7 @@ func (s *FileSet) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.File
 }
 
 func (s *FileSet) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s Update(%v, [%d])", s.folder, device, len(fs))
 	}
 	normalizeFilenames(fs)
@@ -130,49 +130,49 @@ func (s *FileSet) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 }
 
 func (s *FileSet) WithNeed(device protocol.DeviceID, fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithNeed(%v)", s.folder, device)
 	}
 	ldbWithNeed(s.db, []byte(s.folder), device[:], false, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithNeedTruncated(device protocol.DeviceID, fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithNeedTruncated(%v)", s.folder, device)
 	}
 	ldbWithNeed(s.db, []byte(s.folder), device[:], true, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithHave(device protocol.DeviceID, fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithHave(%v)", s.folder, device)
 	}
 	ldbWithHave(s.db, []byte(s.folder), device[:], false, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithHaveTruncated(device protocol.DeviceID, fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithHaveTruncated(%v)", s.folder, device)
 	}
 	ldbWithHave(s.db, []byte(s.folder), device[:], true, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithGlobal(fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithGlobal()", s.folder)
 	}
 	ldbWithGlobal(s.db, []byte(s.folder), nil, false, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithGlobalTruncated(fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithGlobalTruncated()", s.folder)
 	}
 	ldbWithGlobal(s.db, []byte(s.folder), nil, true, nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithPrefixedGlobalTruncated(prefix string, fn Iterator) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%s WithPrefixedGlobalTruncated()", s.folder, prefix)
 	}
 	ldbWithGlobal(s.db, []byte(s.folder), []byte(osutil.NormalizedFilename(prefix)), true, nativeFileIterator(fn))
@@ -214,6 +214,12 @@ func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
 	return s.localVersion[device]
 }
 
+// Devices returns the devices that have files in the set, the local device
+// included.
+func (s *FileSet) Devices() []protocol.DeviceID {
+	return ldbListDevices(s.db, []byte(s.folder))
+}
+
 // ListFolders returns the folder IDs seen in the database.
 func ListFolders(db *leveldb.DB) []string {
 	return ldbListFolders(db)
@@ -229,6 +235,7 @@ func DropFolder(db *leveldb.DB, folder string) {
 	}
 	bm.Drop()
 	NewVirtualMtimeRepo(db, folder).Drop()
+	NewTempBlockRepo(db, folder).Drop()
 }
 
 func normalizeFilenames(fs []protocol.FileInfo) {
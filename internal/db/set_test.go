@@ -741,6 +741,38 @@ func TestLocalVersion(t *testing.T) {
 	}
 }
 
+func TestListDevices(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.NewFileSet("test", ldb)
+	if devices := s.Devices(); len(devices) != 0 {
+		t.Errorf("Devices %v in an empty set", devices)
+	}
+
+	files := []protocol.FileInfo{
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+	}
+	s.Replace(protocol.LocalDeviceID, files)
+	s.Replace(remoteDevice1, files)
+	s.Replace(remoteDevice0, files)
+	db.NewFileSet("other", ldb).Replace(remoteDevice0, files)
+
+	expected := []protocol.DeviceID{remoteDevice0, remoteDevice1, protocol.LocalDeviceID}
+	if devices := s.Devices(); !reflect.DeepEqual(devices, expected) {
+		t.Errorf("Incorrect devices\nE: %v\nA: %v", expected, devices)
+	}
+
+	s.Replace(remoteDevice1, nil)
+	expected = []protocol.DeviceID{remoteDevice0, protocol.LocalDeviceID}
+	if devices := s.Devices(); !reflect.DeepEqual(devices, expected) {
+		t.Errorf("Incorrect devices after replace\nE: %v\nA: %v", expected, devices)
+	}
+}
+
 func TestListDropFolder(t *testing.T) {
 	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
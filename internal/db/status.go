@@ -0,0 +1,127 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Status describes the size and makeup of the database.
+type Status struct {
+	Size    int64          `json:"size"` // of the database directory
+	Levels  []LevelStatus  `json:"levels"`
+	Folders []FolderStatus `json:"folders"`
+}
+
+// LevelStatus describes a level of the leveldb tables, as leveldb reports
+// it. The compaction figures are since the database was opened.
+type LevelStatus struct {
+	Level           int     `json:"level"`
+	Tables          int     `json:"tables"`
+	SizeMiB         float64 `json:"sizeMiB"`
+	CompactionTimeS float64 `json:"compactionTimeS"`
+	CompactionRead  float64 `json:"compactionReadMiB"`
+	CompactionWrite float64 `json:"compactionWriteMiB"`
+}
+
+// FolderStatus describes the index of a folder.
+type FolderStatus struct {
+	Folder      string `json:"folder"`
+	Size        int64  `json:"size"`        // of its files and block map on disk, approximately
+	LocalFiles  int    `json:"localFiles"`  // including deleted files
+	RemoteFiles int    `json:"remoteFiles"` // of all other devices together
+	GlobalFiles int    `json:"globalFiles"`
+	Blocks      int    `json:"blocks"` // in the block map
+}
+
+// DatabaseStatus returns the status of the database in the directory.
+func DatabaseStatus(ldb *leveldb.DB, dir string) (Status, error) {
+	var res Status
+	var err error
+	if res.Size, err = dirSize(dir); err != nil {
+		return res, err
+	}
+
+	stats, err := ldb.GetProperty("leveldb.stats")
+	if err != nil {
+		return res, err
+	}
+	res.Levels = parseLevelStats(stats)
+
+	res.Folders = []FolderStatus{}
+	for _, folder := range listAllFolders(ldb) {
+		fs, err := folderStatus(ldb, folder)
+		if err != nil {
+			return res, err
+		}
+		res.Folders = append(res.Folders, fs)
+	}
+	return res, nil
+}
+
+// parseLevelStats returns the levels in the table of the leveldb.stats
+// property.
+func parseLevelStats(stats string) []LevelStatus {
+	levels := []LevelStatus{}
+	for _, line := range strings.Split(stats, "\n") {
+		var ls LevelStatus
+		n, _ := fmt.Sscanf(line, " %d | %d | %f | %f | %f | %f", &ls.Level, &ls.Tables, &ls.SizeMiB, &ls.CompactionTimeS, &ls.CompactionRead, &ls.CompactionWrite)
+		if n == 6 {
+			levels = append(levels, ls)
+		}
+	}
+	return levels
+}
+
+func folderStatus(ldb *leveldb.DB, folder string) (FolderStatus, error) {
+	res := FolderStatus{Folder: folder}
+	devicePrefix := deviceKey([]byte(folder), nil, nil)[:1+64]
+	globalPrefix := globalKey([]byte(folder), nil)
+	blockPrefix := toBlockKey(nil, folder, "")[:1+64]
+
+	sizes, err := ldb.SizeOf([]util.Range{*util.BytesPrefix(devicePrefix), *util.BytesPrefix(globalPrefix), *util.BytesPrefix(blockPrefix)})
+	if err != nil {
+		return res, err
+	}
+	res.Size = int64(sizes.Sum())
+
+	snap, err := ldb.GetSnapshot()
+	if err != nil {
+		return res, err
+	}
+	defer snap.Release()
+
+	count := func(prefix []byte, fn func(key []byte)) error {
+		dbi := snap.NewIterator(util.BytesPrefix(prefix), nil)
+		defer dbi.Release()
+		for dbi.Next() {
+			fn(dbi.Key())
+		}
+		return dbi.Error()
+	}
+	err = count(devicePrefix, func(key []byte) {
+		if len(key) >= 1+64+32 && bytes.Equal(deviceKeyDevice(key), protocol.LocalDeviceID[:]) {
+			res.LocalFiles++
+		} else {
+			res.RemoteFiles++
+		}
+	})
+	if err != nil {
+		return res, err
+	}
+	if err := count(globalPrefix, func([]byte) { res.GlobalFiles++ }); err != nil {
+		return res, err
+	}
+	err = count(blockPrefix, func([]byte) { res.Blocks++ })
+	return res, err
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestDatabaseStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	remote, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	blocks := []protocol.BlockInfo{
+		{Size: 128, Hash: bytes.Repeat([]byte{1}, 32)},
+		{Size: 128, Hash: bytes.Repeat([]byte{2}, 32)},
+	}
+	s := NewFileSet("default", ldb)
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Blocks: blocks}, {Name: "b"}})
+	s.Replace(remote, []protocol.FileInfo{{Name: "c"}})
+	ldb.CompactRange(util.Range{})
+
+	res, err := DatabaseStatus(ldb, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Size == 0 || len(res.Levels) == 0 {
+		t.Errorf("Incorrect status %+v", res)
+	}
+	if len(res.Folders) != 1 {
+		t.Fatalf("Incorrect folders %+v", res.Folders)
+	}
+	fs := res.Folders[0]
+	fs.Size = 0
+	expected := FolderStatus{Folder: "default", LocalFiles: 2, RemoteFiles: 1, GlobalFiles: 3, Blocks: 2}
+	if fs != expected {
+		t.Errorf("Incorrect folder status %+v, expected %+v", fs, expected)
+	}
+}
+
+func TestParseLevelStats(t *testing.T) {
+	stats := "Compactions\n" +
+		" Level |   Tables   |    Size(MB)   |    Time(sec)  |    Read(MB)   |   Write(MB)\n" +
+		"-------+------------+---------------+---------------+---------------+---------------\n" +
+		"   0   |          1 |       0.00050 |       0.00100 |       0.00000 |       0.00050\n" +
+		"   2   |         12 |      24.00000 |       1.50000 |      30.00000 |      24.00000\n"
+	levels := parseLevelStats(stats)
+	expected := []LevelStatus{
+		{Level: 0, Tables: 1, SizeMiB: 0.0005, CompactionTimeS: 0.001, CompactionWrite: 0.0005},
+		{Level: 2, Tables: 12, SizeMiB: 24, CompactionTimeS: 1.5, CompactionRead: 30, CompactionWrite: 24},
+	}
+	if len(levels) != len(expected) {
+		t.Fatalf("Incorrect levels %+v", levels)
+	}
+	for i := range expected {
+		if levels[i] != expected[i] {
+			t.Errorf("Incorrect level %+v, expected %+v", levels[i], expected[i])
+		}
+	}
+}
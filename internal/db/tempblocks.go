@@ -0,0 +1,94 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// This type encapsulates a repository of the blocks that are already in place
+// in the temporary files of partially pulled files. When a pull is resumed,
+// after a restart or a lost connection, the blocks don't have to be found by
+// rehashing what might be a very large temporary file.
+
+type TempBlockRepo struct {
+	ns *NamespacedKV
+}
+
+func NewTempBlockRepo(ldb *leveldb.DB, folder string) *TempBlockRepo {
+	prefix := string([]byte{KeyTypeTempBlocks}) + folder
+
+	return &TempBlockRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+// PutBlocks records the blocks in place in the temporary file for the given
+// file name.
+func (r *TempBlockRepo) PutBlocks(path string, blocks []protocol.BlockInfo) {
+	if debug.Enabled() {
+		l.Debugf("temp blocks: storing %d blocks for path:%s", len(blocks), path)
+	}
+
+	var data []byte
+	var hdr [13]byte
+	for _, b := range blocks {
+		binary.BigEndian.PutUint64(hdr[:], uint64(b.Offset))
+		binary.BigEndian.PutUint32(hdr[8:], uint32(b.Size))
+		hdr[12] = byte(len(b.Hash))
+		data = append(data, hdr[:]...)
+		data = append(data, b.Hash...)
+	}
+
+	r.ns.PutBytes(path, data)
+}
+
+// Blocks returns the blocks recorded for the given file name, and whether
+// there was a record at all.
+func (r *TempBlockRepo) Blocks(path string) ([]protocol.BlockInfo, bool) {
+	data, exists := r.ns.Bytes(path)
+	if !exists {
+		return nil, false
+	}
+
+	var blocks []protocol.BlockInfo
+	for len(data) >= 13 {
+		hashLen := int(data[12])
+		if len(data) < 13+hashLen {
+			break
+		}
+		blocks = append(blocks, protocol.BlockInfo{
+			Offset: int64(binary.BigEndian.Uint64(data)),
+			Size:   int32(binary.BigEndian.Uint32(data[8:])),
+			Hash:   append([]byte(nil), data[13:13+hashLen]...),
+		})
+		data = data[13+hashLen:]
+	}
+
+	if len(data) != 0 {
+		// A corrupt record is as good as none.
+		l.Infof("Discarding corrupt temp block record for %s", path)
+		r.ns.Delete(path)
+		return nil, false
+	}
+
+	if debug.Enabled() {
+		l.Debugf("temp blocks: found %d blocks for path:%s", len(blocks), path)
+	}
+	return blocks, true
+}
+
+func (r *TempBlockRepo) DeleteBlocks(path string) {
+	r.ns.Delete(path)
+}
+
+func (r *TempBlockRepo) Drop() {
+	r.ns.Reset()
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTempBlockRepo(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1 := NewTempBlockRepo(ldb, "folder1")
+	repo2 := NewTempBlockRepo(ldb, "folder2")
+
+	blocks := []protocol.BlockInfo{
+		{Offset: 0, Size: protocol.BlockSize, Hash: []byte("first hash")},
+		{Offset: 3 * protocol.BlockSize, Size: 1234, Hash: []byte("another, longer, hash")},
+	}
+
+	if _, ok := repo1.Blocks("file"); ok {
+		t.Error("Blocks should be missing at start")
+	}
+
+	repo1.PutBlocks("file", blocks)
+	if bs, ok := repo1.Blocks("file"); !ok || !reflect.DeepEqual(bs, blocks) {
+		t.Errorf("Incorrect blocks %v != %v", bs, blocks)
+	}
+	if _, ok := repo2.Blocks("file"); ok {
+		t.Error("Blocks should be missing from the other folder")
+	}
+
+	// A record of no blocks is still a record.
+
+	repo2.PutBlocks("file", nil)
+	if bs, ok := repo2.Blocks("file"); !ok || len(bs) != 0 {
+		t.Errorf("Incorrect blocks %v, %v", bs, ok)
+	}
+
+	repo1.DeleteBlocks("file")
+	if _, ok := repo1.Blocks("file"); ok {
+		t.Error("Blocks should be gone after deletion")
+	}
+
+	repo2.Drop()
+	if _, ok := repo2.Blocks("file"); ok {
+		t.Error("Blocks should be gone after drop")
+	}
+}
@@ -7,7 +7,14 @@
 package discover
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"math/big"
 	"net"
 	"time"
 
@@ -217,3 +224,94 @@ func TestUDP4Failure(t *testing.T) {
 
 	client.Stop()
 }
+
+// newTestDevice returns the ID of a device presenting its certificate to
+// TLS connections on the returned port.
+func newTestDevice(t *testing.T) (protocol.DeviceID, uint16, net.Listener) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syncthing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+	lst, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return protocol.NewDeviceID(der), uint16(lst.Addr().(*net.TCPAddr).Port), lst
+}
+
+func TestServer(t *testing.T) {
+	id, port, lst := newTestDevice(t)
+	defer lst.Close()
+	var spoofed, other protocol.DeviceID
+	spoofed[0] = 42
+	other[0] = 43
+
+	srv, err := NewServer(ServerOptions{
+		ListenAddress: "127.0.0.1:0",
+		Devices:       []protocol.DeviceID{id, spoofed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Stop()
+
+	address := fmt.Sprintf("udp4://%s", srv.Addr())
+	announce := func(id protocol.DeviceID) Client {
+		client, err := New(address, &Announce{
+			Magic: AnnouncementMagic,
+			This:  Device{id[:], []Address{{Port: port}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	client := announce(id)
+	defer client.Stop()
+	spoofer := announce(spoofed)
+	defer spoofer.Stop()
+	disallowed := announce(other)
+	defer disallowed.Stop()
+
+	// The announcement is verified by a lookup a second later.
+	time.Sleep(1500 * time.Millisecond)
+
+	if !client.StatusOK() {
+		t.Error("announcement of an allowed device failed")
+	}
+	if addrs := client.Lookup(id); len(addrs) != 1 || addrs[0] != fmt.Sprintf("127.0.0.1:%d", port) {
+		t.Errorf("incorrect addresses %v", addrs)
+	}
+	if spoofer.StatusOK() {
+		t.Error("announcement at the address of another device succeeded")
+	}
+	if disallowed.StatusOK() {
+		t.Error("announcement of a device not allowed succeeded")
+	}
+}
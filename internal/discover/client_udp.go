@@ -78,8 +78,10 @@ func (d *UDPClient) Start(uri *url.URL, pkt *Announce) error {
 		d.errorRetryInterval = time.Duration(retrySeconds) * time.Second
 	}
 
-	d.wg.Add(1)
-	go d.broadcast(pkt.MustMarshalXDR())
+	if params.Get("mode") != modeLookup {
+		d.wg.Add(1)
+		go d.broadcast(pkt.MustMarshalXDR())
+	}
 	return nil
 }
 
@@ -88,7 +90,7 @@ func (d *UDPClient) broadcast(pkt []byte) {
 
 	conn, err := net.ListenUDP(d.url.Scheme, d.listenAddress)
 	for err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: broadcast listen: %v; trying again in %v", d.url, err, d.errorRetryInterval)
 		}
 		select {
@@ -102,7 +104,7 @@ func (d *UDPClient) broadcast(pkt []byte) {
 
 	remote, err := net.ResolveUDPAddr(d.url.Scheme, d.url.Host)
 	for err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: broadcast resolve: %v; trying again in %v", d.url, err, d.errorRetryInterval)
 		}
 		select {
@@ -122,13 +124,13 @@ func (d *UDPClient) broadcast(pkt []byte) {
 		case <-timer.C:
 			var ok bool
 
-			if debug {
+			if debug.Enabled() {
 				l.Debugf("discover %s: broadcast: Sending self announcement to %v", d.url, remote)
 			}
 
 			_, err := conn.WriteTo(pkt, remote)
 			if err != nil {
-				if debug {
+				if debug.Enabled() {
 					l.Debugf("discover %s: broadcast: Failed to send self announcement: %s", d.url, err)
 				}
 				ok = false
@@ -138,7 +140,7 @@ func (d *UDPClient) broadcast(pkt []byte) {
 				time.Sleep(1 * time.Second)
 
 				res := d.Lookup(d.id)
-				if debug {
+				if debug.Enabled() {
 					l.Debugf("discover %s: broadcast: Self-lookup returned: %v", d.url, res)
 				}
 				ok = len(res) > 0
@@ -160,7 +162,7 @@ func (d *UDPClient) broadcast(pkt []byte) {
 func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 	extIP, err := net.ResolveUDPAddr(d.url.Scheme, d.url.Host)
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
 		}
 		return nil
@@ -168,7 +170,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 
 	conn, err := net.DialUDP(d.url.Scheme, d.listenAddress, extIP)
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
 		}
 		return nil
@@ -177,7 +179,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 
 	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
 		}
 		return nil
@@ -186,7 +188,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 	buf := Query{QueryMagic, device[:]}.MustMarshalXDR()
 	_, err = conn.Write(buf)
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
 		}
 		return nil
@@ -199,7 +201,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 			// Expected if the server doesn't know about requested device ID
 			return nil
 		}
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
 		}
 		return nil
@@ -208,7 +210,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 	var pkt Announce
 	err = pkt.UnmarshalXDR(buf[:n])
 	if err != nil && err != io.EOF {
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover %s: Lookup(%s): %s\n%s", d.url, device, err, hex.Dump(buf[:n]))
 		}
 		return nil
@@ -219,7 +221,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 		deviceAddr := net.JoinHostPort(net.IP(a.IP).String(), strconv.Itoa(int(a.Port)))
 		addrs = append(addrs, deviceAddr)
 	}
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("discover %s: Lookup(%s) result: %v", d.url, device, addrs)
 	}
 	return addrs
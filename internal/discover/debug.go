@@ -7,13 +7,11 @@
 package discover
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "discover") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("discover")
 	l     = logger.DefaultLogger
 )
@@ -12,8 +12,10 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/url"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/syncthing/protocol"
@@ -30,36 +32,63 @@ type Discoverer struct {
 	cacheLifetime   time.Duration
 	negCacheCutoff  time.Duration
 	beacons         []beacon.Interface
-	extPort         uint16
+	mcastIntfs      map[string]bool // interfaces with a multicast beacon
 	localBcastTick  <-chan time.Time
 	forcedBcastTick chan time.Time
+	reduced         bool // send fewer local announcements
 
 	registryLock sync.RWMutex
 	registry     map[protocol.DeviceID][]CacheEntry
 	lastLookup   map[protocol.DeviceID]time.Time
+	globalAddrs  map[protocol.DeviceID][]string // last found by global lookup
 
 	clients []Client
-	mut     sync.RWMutex
+	mut     sync.RWMutex // protects the above, and beacons and mcastIntfs
 }
 
 type CacheEntry struct {
 	Address string
 	Seen    time.Time
+	Hinted  bool // only hinted at by another device, not seen announced
 }
 
+const (
+	reducedBcastFactor = 4
+	// Interfaces that come up later get a multicast beacon on the next
+	// rescan.
+	mcastRescanIntv = time.Minute
+)
+
 var (
-	ErrIncorrectMagic = errors.New("incorrect magic number")
+	ErrIncorrectMagic             = errors.New("incorrect magic number")
+	DefaultLocalBroadcastInterval = 30 * time.Second
+)
+
+// A global discovery server can be used only to announce us, with
+// ?mode=announce in its address, or only to look up others, with
+// ?mode=lookup.
+const (
+	modeAnnounce = "announce"
+	modeLookup   = "lookup"
 )
 
 func NewDiscoverer(id protocol.DeviceID, addresses []string) *Discoverer {
+	// Local announcements must arrive again before they expire.
+	cacheLifetime := 5 * time.Minute
+	if lt := 3 * DefaultLocalBroadcastInterval; lt > cacheLifetime {
+		cacheLifetime = lt
+	}
+
 	return &Discoverer{
 		myID:           id,
 		listenAddrs:    addresses,
-		localBcastIntv: 30 * time.Second,
-		cacheLifetime:  5 * time.Minute,
+		localBcastIntv: DefaultLocalBroadcastInterval,
+		cacheLifetime:  cacheLifetime,
 		negCacheCutoff: 3 * time.Minute,
 		registry:       make(map[protocol.DeviceID][]CacheEntry),
 		lastLookup:     make(map[protocol.DeviceID]time.Time),
+		globalAddrs:    make(map[protocol.DeviceID][]string),
+		mcastIntfs:     make(map[string]bool),
 		registryLock:   sync.NewRWMutex(),
 		mut:            sync.NewRWMutex(),
 	}
@@ -71,10 +100,11 @@ func (d *Discoverer) StartLocal(localPort int, localMCAddr string) {
 	}
 
 	if len(localMCAddr) > 0 {
-		d.startLocalIPv6Multicasts(localMCAddr)
-	}
-
-	if len(d.beacons) == 0 {
+		if d.startLocalIPv6Multicasts(localMCAddr) == 0 {
+			l.Infoln("Local discovery over IPv6 unavailable for now")
+		}
+		go d.rescanMulticastInterfaces(localMCAddr)
+	} else if len(d.beacons) == 0 {
 		l.Warnln("Local discovery unavailable")
 		return
 	}
@@ -92,18 +122,25 @@ func (d *Discoverer) startLocalIPv4Broadcasts(localPort int) {
 	bb.ServeBackground()
 }
 
-func (d *Discoverer) startLocalIPv6Multicasts(localMCAddr string) {
+// startLocalIPv6Multicasts starts a multicast beacon on each interface that
+// is up and doesn't have one yet. It returns the number of interfaces with a
+// beacon.
+func (d *Discoverer) startLocalIPv6Multicasts(localMCAddr string) int {
 	intfs, err := net.Interfaces()
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("discover: interfaces:", err)
 		}
-		l.Infoln("Local discovery over IPv6 unavailable")
-		return
+		return 0
 	}
 
-	v6Intfs := 0
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
 	for _, intf := range intfs {
+		if d.mcastIntfs[intf.Name] {
+			continue
+		}
 		// Interface flags seem to always be 0 on Windows
 		if runtime.GOOS != "windows" && (intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagMulticast == 0) {
 			continue
@@ -111,19 +148,26 @@ func (d *Discoverer) startLocalIPv6Multicasts(localMCAddr string) {
 
 		mb, err := beacon.NewMulticast(localMCAddr, intf.Name)
 		if err != nil {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("discover: Start local v6:", err)
 			}
 			continue
 		}
+		if debug.Enabled() {
+			l.Debugln("discover: Started local v6 on", intf.Name)
+		}
 
 		d.beacons = append(d.beacons, mb)
+		d.mcastIntfs[intf.Name] = true
 		go d.recvAnnouncements(mb)
-		v6Intfs++
 	}
 
-	if v6Intfs == 0 {
-		l.Infoln("Local discovery over IPv6 unavailable")
+	return len(d.mcastIntfs)
+}
+
+func (d *Discoverer) rescanMulticastInterfaces(localMCAddr string) {
+	for range time.Tick(mcastRescanIntv) {
+		d.startLocalIPv6Multicasts(localMCAddr)
 	}
 }
 
@@ -135,13 +179,19 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 		d.stopGlobal()
 	}
 
-	d.extPort = extPort
-	pkt := d.announcementPkt()
+	pkt4 := d.announcementPkt(extPort)
+	// IPv6 isn't NATed, so a mapped external port doesn't apply there; we
+	// are reachable on the listen port.
+	pkt6 := d.announcementPkt(0)
 	wg := sync.NewWaitGroup()
 	clients := make(chan Client, len(servers))
 	for _, address := range servers {
+		pkt := pkt4
+		if strings.HasPrefix(address, "udp6://") {
+			pkt = pkt6
+		}
 		wg.Add(1)
-		go func(addr string) {
+		go func(addr string, pkt *Announce) {
 			defer wg.Done()
 			client, err := New(addr, pkt)
 			if err != nil {
@@ -149,7 +199,7 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 				return
 			}
 			clients <- client
-		}(address)
+		}(address, pkt)
 	}
 
 	wg.Wait()
@@ -179,7 +229,9 @@ func (d *Discoverer) ExtAnnounceOK() map[string]bool {
 
 	ret := make(map[string]bool)
 	for _, client := range d.clients {
-		ret[client.Address()] = client.StatusOK()
+		if serverMode(client) != modeLookup {
+			ret[client.Address()] = client.StatusOK()
+		}
 	}
 	return ret
 }
@@ -215,6 +267,9 @@ func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 		results := make(chan []string, len(d.clients))
 		wg := sync.NewWaitGroup()
 		for _, client := range d.clients {
+			if serverMode(client) == modeAnnounce {
+				continue
+			}
 			wg.Add(1)
 			go func(c Client) {
 				defer wg.Done()
@@ -225,19 +280,12 @@ func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 		wg.Wait()
 		close(results)
 
-		cached := []CacheEntry{}
 		seen := make(map[string]struct{})
-		now := time.Now()
-
 		var addrs []string
 		for result := range results {
 			for _, addr := range result {
 				_, ok := seen[addr]
 				if !ok {
-					cached = append(cached, CacheEntry{
-						Address: addr,
-						Seen:    now,
-					})
 					seen[addr] = struct{}{}
 					addrs = append(addrs, addr)
 				}
@@ -245,6 +293,26 @@ func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 		}
 
 		d.registryLock.Lock()
+		if len(addrs) > 0 {
+			d.globalAddrs[device] = addrs
+		} else if !d.anyClientOK() {
+			// None of the servers accept our own announcements, so the
+			// empty answer is more likely an outage than the device being
+			// unknown. Keep using what they told us before.
+			addrs = d.globalAddrs[device]
+			if debug.Enabled() && len(addrs) > 0 {
+				l.Debugf("discover: Global discovery unavailable; using previous addresses %v for %s", addrs, device)
+			}
+		}
+
+		now := time.Now()
+		cached := make([]CacheEntry, len(addrs))
+		for i, addr := range addrs {
+			cached[i] = CacheEntry{
+				Address: addr,
+				Seen:    now,
+			}
+		}
 		d.registry[device] = cached
 		d.lastLookup[device] = time.Now()
 		d.registryLock.Unlock()
@@ -255,6 +323,45 @@ func (d *Discoverer) Lookup(device protocol.DeviceID) []string {
 	return nil
 }
 
+// anyClientOK returns whether any of the global discovery servers is known
+// to work. Must be called with mut held.
+func (d *Discoverer) anyClientOK() bool {
+	for _, client := range d.clients {
+		if serverMode(client) != modeLookup && client.StatusOK() {
+			return true
+		}
+	}
+	return false
+}
+
+// serverMode returns the mode given in the address of the client's server,
+// or the empty string for both announcing and lookups.
+func serverMode(c Client) string {
+	uri, err := url.Parse(c.Address())
+	if err != nil {
+		return ""
+	}
+	return uri.Query().Get("mode")
+}
+
+// Known returns the cached addresses of the device, without looking it up.
+// Addresses that were only hinted at aren't included, so that they aren't
+// passed on to other devices unverified.
+func (d *Discoverer) Known(device protocol.DeviceID) []string {
+	d.registryLock.RLock()
+	defer d.registryLock.RUnlock()
+	var addrs []string
+	for _, entry := range d.registry[device] {
+		if !entry.Hinted && time.Since(entry.Seen) <= d.cacheLifetime {
+			addrs = append(addrs, entry.Address)
+		}
+	}
+	return addrs
+}
+
+// Hint caches addresses of the device that another device told us about.
+// They expire the cache lifetime after they were first hinted at, however
+// often they're hinted at again, unless the device announces them itself.
 func (d *Discoverer) Hint(device string, addrs []string) {
 	resAddrs := resolveAddrs(addrs)
 	var id protocol.DeviceID
@@ -262,7 +369,7 @@ func (d *Discoverer) Hint(device string, addrs []string) {
 	d.registerDevice(nil, Device{
 		Addresses: resAddrs,
 		ID:        id[:],
-	})
+	}, true)
 }
 
 func (d *Discoverer) All() map[protocol.DeviceID][]CacheEntry {
@@ -277,17 +384,19 @@ func (d *Discoverer) All() map[protocol.DeviceID][]CacheEntry {
 	return devices
 }
 
-func (d *Discoverer) announcementPkt() *Announce {
+// announcementPkt returns the announcement of the external port, or of the
+// listen addresses if it's zero.
+func (d *Discoverer) announcementPkt(extPort uint16) *Announce {
 	var addrs []Address
-	if d.extPort != 0 {
-		addrs = []Address{{Port: d.extPort}}
+	if extPort != 0 {
+		addrs = []Address{{Port: extPort}}
 	} else {
 		for _, astr := range d.listenAddrs {
 			addr, err := net.ResolveTCPAddr("tcp", astr)
 			if err != nil {
 				l.Warnln("discover: %v: not announcing %s", err, astr)
 				continue
-			} else if debug {
+			} else if debug.Enabled() {
 				l.Debugf("discover: resolved %s as %#v", astr, addr)
 			}
 			if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
@@ -314,18 +423,34 @@ func (d *Discoverer) sendLocalAnnouncements() {
 	}
 	msg := pkt.MustMarshalXDR()
 
-	for {
-		for _, b := range d.beacons {
-			b.Send(msg)
+	for n := 0; ; n++ {
+		d.mut.RLock()
+		skip := d.reduced && n%reducedBcastFactor != 0
+		beacons := d.beacons
+		d.mut.RUnlock()
+
+		if !skip {
+			for _, b := range beacons {
+				b.Send(msg)
+			}
 		}
 
 		select {
 		case <-d.localBcastTick:
 		case <-d.forcedBcastTick:
+			n = -1
 		}
 	}
 }
 
+// SetReduced sets whether activity should be reduced. Local announcements
+// are then only sent every reducedBcastFactor intervals.
+func (d *Discoverer) SetReduced(reduced bool) {
+	d.mut.Lock()
+	d.reduced = reduced
+	d.mut.Unlock()
+}
+
 func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 	for {
 		buf, addr := b.Recv()
@@ -333,19 +458,19 @@ func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 		var pkt Announce
 		err := pkt.UnmarshalXDR(buf)
 		if err != nil && err != io.EOF {
-			if debug {
+			if debug.Enabled() {
 				l.Debugf("discover: Failed to unmarshal local announcement from %s:\n%s", addr, hex.Dump(buf))
 			}
 			continue
 		}
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("discover: Received local announcement from %s for %s", addr, protocol.DeviceIDFromBytes(pkt.This.ID))
 		}
 
 		var newDevice bool
 		if bytes.Compare(pkt.This.ID, d.myID[:]) != 0 {
-			newDevice = d.registerDevice(addr, pkt.This)
+			newDevice = d.registerDevice(addr, pkt.This, false)
 		}
 
 		if newDevice {
@@ -356,7 +481,7 @@ func (d *Discoverer) recvAnnouncements(b beacon.Interface) {
 	}
 }
 
-func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
+func (d *Discoverer) registerDevice(addr net.Addr, device Device, hinted bool) bool {
 	var id protocol.DeviceID
 	copy(id[:], device.ID)
 
@@ -378,18 +503,22 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 		}
 		for i := range current {
 			if current[i].Address == deviceAddr {
-				current[i].Seen = time.Now()
+				if !hinted {
+					current[i].Seen = time.Now()
+					current[i].Hinted = false
+				}
 				goto done
 			}
 		}
 		current = append(current, CacheEntry{
 			Address: deviceAddr,
 			Seen:    time.Now(),
+			Hinted:  hinted,
 		})
 	done:
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("discover: Caching %s addresses: %v", id, current)
 	}
 
@@ -412,7 +541,7 @@ func (d *Discoverer) registerDevice(addr net.Addr, device Device) bool {
 func (d *Discoverer) filterCached(c []CacheEntry) []CacheEntry {
 	for i := 0; i < len(c); {
 		if ago := time.Since(c[i].Seen); ago > d.cacheLifetime {
-			if debug {
+			if debug.Enabled() {
 				l.Debugf("discover: Removing cached address %s - seen %v ago", c[i].Address, ago)
 			}
 			c[i] = c[len(c)-1]
@@ -7,7 +7,10 @@
 package discover
 
 import (
+	"net"
 	"net/url"
+	"reflect"
+	"strconv"
 	"time"
 
 	"testing"
@@ -137,3 +140,214 @@ func TestGlobalDiscovery(t *testing.T) {
 		}
 	}
 }
+
+func TestGlobalDiscoveryOutage(t *testing.T) {
+	c := &DummyClient{
+		statusRet: true,
+		lookupRet: []string{"test.com:1234"},
+	}
+	Register("test3", func(uri *url.URL, pkt *Announce) (Client, error) {
+		c.url = uri
+		return c, nil
+	})
+
+	d := NewDiscoverer(device, []string{})
+	d.localBcastStart = time.Time{}
+	d.cacheLifetime = 0
+	d.negCacheCutoff = 0
+	d.StartGlobal([]string{"test3://123.123.123.123:1234"}, 1234)
+	defer d.StopGlobal()
+
+	if addrs := d.Lookup(device); len(addrs) != 1 {
+		t.Fatal("Wrong number of addresses", addrs)
+	}
+
+	// A working server not knowing the device anymore is believed.
+	c.lookupRet = nil
+	if addrs := d.Lookup(device); len(addrs) != 0 {
+		t.Error("Unexpected addresses", addrs)
+	}
+
+	// A failing one isn't; the previous answer still holds.
+	c.lookupRet = []string{"test.com:1234"}
+	d.Lookup(device)
+	c.lookupRet = nil
+	c.statusRet = false
+	if addrs := d.Lookup(device); len(addrs) != 1 || addrs[0] != "test.com:1234" {
+		t.Error("Wrong addresses during outage", addrs)
+	}
+	if len(c.lookups) != 4 {
+		t.Error("Wrong number of lookups", len(c.lookups))
+	}
+}
+
+func TestGlobalDiscoveryModes(t *testing.T) {
+	clients := map[string]*DummyClient{
+		"both":     {statusRet: true, lookupRet: []string{"both.com:1234"}},
+		"announce": {statusRet: true, lookupRet: []string{"announce.com:1234"}},
+		"lookup":   {statusRet: true, lookupRet: []string{"lookup.com:1234"}},
+	}
+	Register("test4", func(uri *url.URL, pkt *Announce) (Client, error) {
+		c := clients[uri.Host]
+		c.url = uri
+		return c, nil
+	})
+
+	d := NewDiscoverer(device, []string{})
+	d.localBcastStart = time.Time{}
+	d.StartGlobal([]string{"test4://both", "test4://announce?mode=announce", "test4://lookup?mode=lookup"}, 1234)
+	defer d.StopGlobal()
+
+	// Servers we only look up on are no announcement servers.
+	status := d.ExtAnnounceOK()
+	if len(status) != 2 || !status["test4://both"] || !status["test4://announce?mode=announce"] {
+		t.Error("Wrong status", status)
+	}
+
+	// Servers we only announce to aren't asked.
+	addrs := d.Lookup(device)
+	if len(addrs) != 2 || len(clients["announce"].lookups) != 0 {
+		t.Error("Wrong addresses", addrs)
+	}
+}
+
+func TestMulticastRescan(t *testing.T) {
+	d := NewDiscoverer(device, []string{})
+
+	// Interfaces that already have a beacon don't get another one.
+	n := d.startLocalIPv6Multicasts("[ff12::8384]:21026")
+	beacons := len(d.beacons)
+	if n2 := d.startLocalIPv6Multicasts("[ff12::8384]:21026"); n2 != n || len(d.beacons) != beacons {
+		t.Errorf("Rescan changed %d interfaces with %d beacons to %d with %d", n, beacons, n2, len(d.beacons))
+	}
+}
+
+func TestHint(t *testing.T) {
+	d := NewDiscoverer(device, []string{})
+	other := protocol.DeviceID{1}
+
+	d.Hint(other.String(), []string{"192.0.2.1:22000"})
+	if known := d.Known(other); len(known) != 0 {
+		t.Errorf("Hinted addresses %v are known", known)
+	}
+	first := d.All()[other][0].Seen
+
+	// Hinting again doesn't keep the address from expiring.
+	time.Sleep(10 * time.Millisecond)
+	d.Hint(other.String(), []string{"192.0.2.1:22000"})
+	if entries := d.All()[other]; len(entries) != 1 || !entries[0].Seen.Equal(first) || !entries[0].Hinted {
+		t.Errorf("Hint changed the cached address to %+v", entries)
+	}
+
+	// The device announcing it makes it known.
+	d.registerDevice(nil, Device{
+		ID:        other[:],
+		Addresses: []Address{{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 22000}},
+	}, false)
+	if known := d.Known(other); !reflect.DeepEqual(known, []string{"192.0.2.1:22000"}) {
+		t.Errorf("Announced addresses %v not known", known)
+	}
+}
+
+func TestMDNSAnnouncement(t *testing.T) {
+	d := NewDiscoverer(device, []string{"192.0.2.42:22000", "[2001:db8::1]:22001"})
+
+	msg, err := parseDNSMessage(d.mdnsAnnouncement())
+	if err != nil {
+		t.Fatal(err)
+	}
+	devs := mdnsDevices(msg)
+	if len(devs) != 1 || protocol.DeviceIDFromBytes(devs[0].ID) != device {
+		t.Fatalf("Wrong devices %+v", devs)
+	}
+
+	var addrs []string
+	for _, a := range devs[0].Addresses {
+		addrs = append(addrs, net.JoinHostPort(net.IP(a.IP).String(), strconv.Itoa(int(a.Port))))
+	}
+	expected := []string{"192.0.2.42:22000", "[2001:db8::1]:22001"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Wrong addresses %v != %v", addrs, expected)
+	}
+}
+
+func TestDNSNameCompression(t *testing.T) {
+	// "local." at 12, then "_tcp" pointing to it at 19.
+	buf := append(make([]byte, 12), 5, 'l', 'o', 'c', 'a', 'l', 0, 4, '_', 't', 'c', 'p', 0xc0, 12, 0xff)
+	name, next, err := readDNSName(buf, 19)
+	if err != nil || name != "_tcp.local." || next != 26 {
+		t.Errorf("Wrong name %q, next %d, error %v", name, next, err)
+	}
+
+	// A pointer to itself is no name.
+	buf = append(make([]byte, 12), 0xc0, 12)
+	if _, _, err := readDNSName(buf, 12); err == nil {
+		t.Error("Unexpected nil error for a pointer loop")
+	}
+}
+
+func TestParseMalformedDNS(t *testing.T) {
+	header := func(qd, an int) []byte {
+		return []byte{0, 0, 0x84, 0, 0, byte(qd), 0, byte(an), 0, 0, 0, 0}
+	}
+	name := []byte{4, '_', 't', 'c', 'p', 5, 'l', 'o', 'c', 'a', 'l', 0}
+	rr := func(typ byte, data ...byte) []byte {
+		b := append([]byte(nil), name...)
+		b = append(b, 0, typ, 0, 1, 0, 0, 0, 120, 0, byte(len(data)))
+		return append(b, data...)
+	}
+	cat := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+
+	cases := []struct {
+		what string
+		msg  []byte
+	}{
+		{"short header", header(0, 0)[:11]},
+		{"missing question", header(1, 0)},
+		{"truncated question name", cat(header(1, 0), name[:4])},
+		{"question without type", cat(header(1, 0), name)},
+		{"label past the end", cat(header(1, 0), []byte{63, 'a'})},
+		{"truncated pointer", cat(header(1, 0), []byte{0xc0})},
+		{"pointer past the end", cat(header(1, 0), []byte{0xc0, 0xff, 0, 1, 0, 1})},
+		{"missing record", header(0, 1)},
+		{"truncated record header", cat(header(0, 1), rr(dnsTypeA, 1, 2, 3, 4)[:len(name)+6])},
+		{"record length past the end", cat(header(0, 1), rr(dnsTypeA, 1, 2, 3, 4)[:len(name)+12])},
+		{"short address", cat(header(0, 1), rr(dnsTypeA, 1, 2, 3))},
+		{"short SRV", cat(header(0, 1), rr(dnsTypeSRV, 0, 0, 0, 0, 0x55))},
+		{"SRV target past the end", cat(header(0, 1), rr(dnsTypeSRV, 0, 0, 0, 0, 0x55, 0x3c, 9))},
+		{"PTR target past the end", cat(header(0, 1), rr(dnsTypePTR, 9, 'a'))},
+		{"TXT string past the end", cat(header(0, 1), rr(dnsTypeTXT, 5, 'i', 'd'))},
+		{"more records than sent", cat(header(0, 255), rr(dnsTypeA, 1, 2, 3, 4))},
+	}
+	for _, tc := range cases {
+		if _, err := parseDNSMessage(tc.msg); err == nil {
+			t.Errorf("Unexpected nil error for %s", tc.what)
+		}
+	}
+}
+
+func TestParseCorruptDNS(t *testing.T) {
+	// Any truncation of a valid message is rejected, and corruption is
+	// either rejected or parsed into something, never a panic.
+
+	d := NewDiscoverer(device, []string{"192.0.2.42:22000", "[2001:db8::1]:22001"})
+	msg := d.mdnsAnnouncement()
+	for i := range msg {
+		if _, err := parseDNSMessage(msg[:i]); err == nil {
+			t.Errorf("Unexpected nil error for message truncated to %d bytes", i)
+		}
+		for _, b := range []byte{0x00, 0x3f, 0xc0, 0xff} {
+			corrupt := append([]byte(nil), msg...)
+			corrupt[i] = b
+			if m, err := parseDNSMessage(corrupt); err == nil {
+				mdnsDevices(m)
+			}
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+// Besides our own local announcements, the listen addresses are announced
+// as a DNS-SD service over multicast DNS (RFC 6762, 6763), so that they are
+// found across mDNS reflecting routers and by anything speaking Bonjour or
+// Avahi. The service instance is named after the device ID.
+
+const (
+	mdnsService      = "_syncthing._tcp.local."
+	mdnsTTL          = 300 // seconds
+	mdnsAnnounceIntv = 2 * time.Minute
+	mdnsReplyIntv    = time.Second // at most one answer to queries per this
+)
+
+var mdnsGroups = []string{"224.0.0.251:5353", "[ff02::fb]:5353"}
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+
+	dnsClassIN         = 1
+	dnsClassCacheFlush = 0x8000 // for records only we answer for
+	dnsFlagResponse    = 0x8400 // authoritative answer
+)
+
+var errMalformedDNS = errors.New("malformed DNS message")
+
+// A dnsRecord is a question, when it has no data, or a resource record.
+type dnsRecord struct {
+	name   string
+	typ    uint16
+	class  uint16
+	ttl    uint32
+	target string // PTR, SRV
+	port   uint16 // SRV
+	ip     net.IP // A, AAAA
+	txt    []string
+}
+
+type dnsMessage struct {
+	response  bool
+	questions []dnsRecord
+	records   []dnsRecord // answers and additional records together
+}
+
+// StartMDNS announces us over multicast DNS, and registers the devices
+// announced that way. It works on the default interface for each of IPv4
+// and IPv6.
+func (d *Discoverer) StartMDNS() {
+	var conns []*net.UDPConn
+	var groups []*net.UDPAddr
+	for _, addr := range mdnsGroups {
+		gaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		network := "udp6"
+		if gaddr.IP.To4() != nil {
+			network = "udp4"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, gaddr)
+		if err != nil {
+			if debug.Enabled() {
+				l.Debugln("discover: Start mDNS:", err)
+			}
+			continue
+		}
+		conns = append(conns, conn)
+		groups = append(groups, gaddr)
+	}
+
+	if len(conns) == 0 {
+		l.Infoln("Local discovery over mDNS unavailable")
+		return
+	}
+
+	for i := range conns {
+		go d.recvMDNS(conns[i], groups[i])
+	}
+	go d.sendMDNS(conns, groups)
+}
+
+func (d *Discoverer) sendMDNS(conns []*net.UDPConn, groups []*net.UDPAddr) {
+	query := encodeDNSQuery(mdnsService, dnsTypePTR)
+	for i, conn := range conns {
+		conn.WriteTo(query, groups[i])
+	}
+
+	for {
+		msg := d.mdnsAnnouncement()
+		for i, conn := range conns {
+			if _, err := conn.WriteTo(msg, groups[i]); err != nil && debug.Enabled() {
+				l.Debugln("discover: mDNS announcement:", err)
+			}
+		}
+		time.Sleep(mdnsAnnounceIntv)
+	}
+}
+
+func (d *Discoverer) recvMDNS(conn *net.UDPConn, group *net.UDPAddr) {
+	var lastReply time.Time
+	buf := make([]byte, 9000) // the largest mDNS message
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			l.Warnln("mDNS read:", err)
+			return
+		}
+
+		msg, err := parseDNSMessage(buf[:n])
+		if err != nil {
+			if debug.Enabled() {
+				l.Debugf("discover: mDNS message from %s: %v", addr, err)
+			}
+			continue
+		}
+
+		if !msg.response {
+			if msg.asks(mdnsService, dnsTypePTR) && time.Since(lastReply) > mdnsReplyIntv {
+				conn.WriteTo(d.mdnsAnnouncement(), group)
+				lastReply = time.Now()
+			}
+			continue
+		}
+
+		for _, dev := range mdnsDevices(msg) {
+			if protocol.DeviceIDFromBytes(dev.ID) == d.myID {
+				continue
+			}
+			if debug.Enabled() {
+				l.Debugf("discover: Received mDNS announcement from %s for %s", addr, protocol.DeviceIDFromBytes(dev.ID))
+			}
+			src := *addr
+			d.registerDevice(&src, dev, false)
+		}
+	}
+}
+
+// mdnsAnnouncement returns the DNS-SD records of our service instance: a
+// PTR to it, an SRV for each listen address, our device ID in a TXT record,
+// and the addresses of the hosts the SRVs point to.
+func (d *Discoverer) mdnsAnnouncement() []byte {
+	id := d.myID.String()
+	instance := id + "." + mdnsService
+	prefix := "st-" + strings.ToLower(id[:7])
+
+	records := []dnsRecord{
+		{name: mdnsService, typ: dnsTypePTR, class: dnsClassIN, ttl: mdnsTTL, target: instance},
+		{name: instance, typ: dnsTypeTXT, class: dnsClassIN | dnsClassCacheFlush, ttl: mdnsTTL, txt: []string{"id=" + id}},
+	}
+
+	// Listen addresses with an IP each get a host name of their own; the
+	// others share one with all the addresses of the host.
+	hosts := make(map[string]bool)
+	for i, addr := range resolveAddrs(d.listenAddrs) {
+		host := prefix + ".local."
+		ips := []net.IP{net.IP(addr.IP)}
+		if len(addr.IP) > 0 {
+			host = fmt.Sprintf("%s-%d.local.", prefix, i)
+		} else {
+			ips = localIPs()
+		}
+
+		records = append(records, dnsRecord{name: instance, typ: dnsTypeSRV, class: dnsClassIN | dnsClassCacheFlush, ttl: mdnsTTL, target: host, port: addr.Port})
+		if hosts[host] {
+			continue
+		}
+		hosts[host] = true
+		for _, ip := range ips {
+			typ := uint16(dnsTypeAAAA)
+			if ip4 := ip.To4(); ip4 != nil {
+				typ, ip = dnsTypeA, ip4
+			}
+			records = append(records, dnsRecord{name: host, typ: typ, class: dnsClassIN | dnsClassCacheFlush, ttl: mdnsTTL, ip: ip})
+		}
+	}
+
+	return encodeDNSResponse(records)
+}
+
+// localIPs returns the addresses of the host that can be reached from the
+// local network without a zone.
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// mdnsDevices returns the Syncthing devices in the DNS-SD records of the
+// message. Addresses without IP are at the sender of the message.
+func mdnsDevices(msg dnsMessage) []Device {
+	var devs []Device
+	for _, ptr := range msg.records {
+		if ptr.typ != dnsTypePTR || !strings.EqualFold(ptr.name, mdnsService) {
+			continue
+		}
+
+		idStr := strings.TrimSuffix(ptr.target, "."+mdnsService)
+		for _, txt := range msg.find(ptr.target, dnsTypeTXT) {
+			for _, kv := range txt.txt {
+				if strings.HasPrefix(kv, "id=") {
+					idStr = kv[3:]
+				}
+			}
+		}
+		id, err := protocol.DeviceIDFromString(idStr)
+		if err != nil {
+			continue
+		}
+
+		var addrs []Address
+		for _, srv := range msg.find(ptr.target, dnsTypeSRV) {
+			ips := msg.find(srv.target, dnsTypeA)
+			ips = append(ips, msg.find(srv.target, dnsTypeAAAA)...)
+			if len(ips) == 0 {
+				addrs = append(addrs, Address{Port: srv.port})
+			}
+			for _, ip := range ips {
+				addrs = append(addrs, Address{IP: ip.ip, Port: srv.port})
+			}
+		}
+		if len(addrs) > 0 {
+			devs = append(devs, Device{ID: id[:], Addresses: addrs})
+		}
+	}
+	return devs
+}
+
+func (m dnsMessage) asks(name string, typ uint16) bool {
+	for _, q := range m.questions {
+		if q.typ == typ && strings.EqualFold(q.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m dnsMessage) find(name string, typ uint16) []dnsRecord {
+	var res []dnsRecord
+	for _, rr := range m.records {
+		if rr.typ == typ && strings.EqualFold(rr.name, name) {
+			res = append(res, rr)
+		}
+	}
+	return res
+}
+
+func encodeDNSQuery(name string, typ uint16) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[4:], 1)
+	buf = appendDNSName(buf, name)
+	return append(buf, byte(typ>>8), byte(typ), 0, dnsClassIN)
+}
+
+func encodeDNSResponse(records []dnsRecord) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[2:], dnsFlagResponse)
+	binary.BigEndian.PutUint16(buf[6:], uint16(len(records)))
+
+	for _, rr := range records {
+		buf = appendDNSName(buf, rr.name)
+		var hdr [10]byte
+		binary.BigEndian.PutUint16(hdr[0:], rr.typ)
+		binary.BigEndian.PutUint16(hdr[2:], rr.class)
+		binary.BigEndian.PutUint32(hdr[4:], rr.ttl)
+		buf = append(buf, hdr[:]...)
+
+		start := len(buf)
+		switch rr.typ {
+		case dnsTypePTR:
+			buf = appendDNSName(buf, rr.target)
+		case dnsTypeSRV:
+			// Priority and weight are zero.
+			buf = append(buf, 0, 0, 0, 0, byte(rr.port>>8), byte(rr.port))
+			buf = appendDNSName(buf, rr.target)
+		case dnsTypeTXT:
+			for _, txt := range rr.txt {
+				buf = append(buf, byte(len(txt)))
+				buf = append(buf, txt...)
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			buf = append(buf, rr.ip...)
+		}
+		binary.BigEndian.PutUint16(buf[start-2:], uint16(len(buf)-start))
+	}
+	return buf
+}
+
+func appendDNSName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+func parseDNSMessage(buf []byte) (dnsMessage, error) {
+	var m dnsMessage
+	if len(buf) < 12 {
+		return m, errMalformedDNS
+	}
+	m.response = buf[2]&0x80 != 0
+	qdcount := int(binary.BigEndian.Uint16(buf[4:]))
+	rrcount := int(binary.BigEndian.Uint16(buf[6:])) + int(binary.BigEndian.Uint16(buf[8:])) + int(binary.BigEndian.Uint16(buf[10:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, n, err := readDNSName(buf, off)
+		if err != nil || n+4 > len(buf) {
+			return m, errMalformedDNS
+		}
+		m.questions = append(m.questions, dnsRecord{
+			name:  name,
+			typ:   binary.BigEndian.Uint16(buf[n:]),
+			class: binary.BigEndian.Uint16(buf[n+2:]),
+		})
+		off = n + 4
+	}
+
+	for i := 0; i < rrcount; i++ {
+		name, n, err := readDNSName(buf, off)
+		if err != nil || n+10 > len(buf) {
+			return m, errMalformedDNS
+		}
+		rr := dnsRecord{
+			name:  name,
+			typ:   binary.BigEndian.Uint16(buf[n:]),
+			class: binary.BigEndian.Uint16(buf[n+2:]),
+			ttl:   binary.BigEndian.Uint32(buf[n+4:]),
+		}
+		start := n + 10
+		end := start + int(binary.BigEndian.Uint16(buf[n+8:]))
+		if end > len(buf) {
+			return m, errMalformedDNS
+		}
+		data := buf[start:end]
+
+		switch rr.typ {
+		case dnsTypePTR:
+			rr.target, _, err = readDNSName(buf, start)
+		case dnsTypeSRV:
+			if len(data) < 7 {
+				return m, errMalformedDNS
+			}
+			rr.port = binary.BigEndian.Uint16(data[4:])
+			rr.target, _, err = readDNSName(buf, start+6)
+		case dnsTypeTXT:
+			for j := 0; j < len(data); {
+				size := int(data[j])
+				if j+1+size > len(data) {
+					return m, errMalformedDNS
+				}
+				rr.txt = append(rr.txt, string(data[j+1:j+1+size]))
+				j += 1 + size
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			if len(data) != net.IPv4len && len(data) != net.IPv6len {
+				return m, errMalformedDNS
+			}
+			rr.ip = net.IP(append([]byte(nil), data...))
+		}
+		if err != nil {
+			return m, errMalformedDNS
+		}
+
+		m.records = append(m.records, rr)
+		off = end
+	}
+
+	return m, nil
+}
+
+// readDNSName returns the possibly compressed name at the offset, and the
+// offset following it.
+func readDNSName(buf []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(buf) {
+			return "", 0, errMalformedDNS
+		}
+		size := int(buf[off])
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+
+		case size&0xc0 == 0xc0:
+			if off+1 >= len(buf) || jumps > 16 {
+				return "", 0, errMalformedDNS
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(buf[off:]) & 0x3fff)
+			jumps++
+
+		default:
+			if off+1+size > len(buf) {
+				return "", 0, errMalformedDNS
+			}
+			labels = append(labels, string(buf[off+1:off+1+size]))
+			off += 1 + size
+		}
+	}
+}
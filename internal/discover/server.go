@@ -0,0 +1,295 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	// Devices announce themselves every half hour by default; an
+	// announcement is kept for a few of those intervals.
+	serverEntryLifetime = 90 * time.Minute
+	// The most devices whose announcements are kept, and the most
+	// announcements being verified at a time.
+	maxServerEntries = 10000
+	maxServerPending = 100
+	// For connecting to an announced address to verify it.
+	serverVerifyTimeout = 10 * time.Second
+)
+
+// ServerOptions configures a discovery Server.
+type ServerOptions struct {
+	ListenAddress string
+	Devices       []protocol.DeviceID // When set, only these devices may announce themselves. Anyone may look them up.
+}
+
+// A Server is a global discovery server, answering the lookups of the UDP
+// clients with the addresses devices announced to it.
+//
+// Announcements aren't signed, so anyone could announce any device ID. An
+// announced address is only given out once the device at it has presented
+// the certificate of the device ID in a TLS handshake.
+type Server struct {
+	opts ServerOptions
+	conn *net.UDPConn
+	stop chan struct{}
+
+	devices map[protocol.DeviceID]serverEntry
+	pending map[protocol.DeviceID]bool // announcements being verified
+	mut     sync.Mutex
+}
+
+type serverEntry struct {
+	announced []Address // as announced
+	addrs     []Address // those verified
+	seen      time.Time
+}
+
+// NewServer returns a discovery server listening on the address in the
+// options.
+func NewServer(opts ServerOptions) (*Server, error) {
+	addr, err := net.ResolveUDPAddr("udp", opts.ListenAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		opts:    opts,
+		conn:    conn,
+		stop:    make(chan struct{}),
+		devices: make(map[protocol.DeviceID]serverEntry),
+		pending: make(map[protocol.DeviceID]bool),
+		mut:     sync.NewMutex(),
+	}, nil
+}
+
+func (s *Server) Serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			l.Warnln("Discovery server:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		s.handle(buf[:n], addr)
+	}
+}
+
+func (s *Server) Stop() {
+	close(s.stop)
+	s.conn.Close()
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Status returns the number of devices currently announced.
+func (s *Server) Status() map[string]interface{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.expire()
+	return map[string]interface{}{
+		"listenAddress":    s.conn.LocalAddr().String(),
+		"announcedDevices": len(s.devices),
+	}
+}
+
+func (s *Server) handle(buf []byte, addr *net.UDPAddr) {
+	if len(buf) < 4 {
+		return
+	}
+
+	switch binary.BigEndian.Uint32(buf) {
+	case AnnouncementMagic:
+		var pkt Announce
+		if err := pkt.UnmarshalXDR(buf); err != nil && err != io.EOF {
+			if debug.Enabled() {
+				l.Debugf("discover server: announcement from %s: %v", addr, err)
+			}
+			return
+		}
+		s.announce(pkt.This, addr)
+
+	case QueryMagic:
+		var pkt Query
+		if err := pkt.UnmarshalXDR(buf); err != nil && err != io.EOF {
+			if debug.Enabled() {
+				l.Debugf("discover server: query from %s: %v", addr, err)
+			}
+			return
+		}
+		if len(pkt.DeviceID) != len(protocol.DeviceID{}) {
+			return
+		}
+		s.query(protocol.DeviceIDFromBytes(pkt.DeviceID), addr)
+	}
+}
+
+// announce remembers the addresses of the device, once verified. Those
+// without an IP are at the address the announcement came from.
+func (s *Server) announce(dev Device, from *net.UDPAddr) {
+	if len(dev.ID) != len(protocol.DeviceID{}) {
+		return
+	}
+	id := protocol.DeviceIDFromBytes(dev.ID)
+	if !s.allowed(id) {
+		if debug.Enabled() {
+			l.Debugf("discover server: ignoring announcement of %s from %s; not allowed", id, from)
+		}
+		return
+	}
+
+	ip := from.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	addrs := make([]Address, len(dev.Addresses))
+	for i, a := range dev.Addresses {
+		addrs[i] = a
+		if len(a.IP) == 0 {
+			addrs[i].IP = ip
+		}
+	}
+
+	if debug.Enabled() {
+		l.Debugf("discover server: %s announced from %s", id, from)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if entry, ok := s.devices[id]; ok && addressesEqual(entry.announced, addrs) {
+		entry.seen = time.Now()
+		s.devices[id] = entry
+		return
+	}
+	if s.pending[id] || len(s.pending) >= maxServerPending {
+		return
+	}
+	s.pending[id] = true
+	go s.verify(id, addrs)
+}
+
+// verify keeps the addresses at which the device presents its certificate,
+// if any. Until then, any addresses verified before are kept.
+func (s *Server) verify(id protocol.DeviceID, addrs []Address) {
+	var verified []Address
+	for _, addr := range addrs {
+		if presentsDevice(addr, id) {
+			verified = append(verified, addr)
+		}
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.pending, id)
+	if len(verified) == 0 {
+		if debug.Enabled() {
+			l.Debugf("discover server: no address of %s verified", id)
+		}
+		return
+	}
+	if _, ok := s.devices[id]; !ok && len(s.devices) >= maxServerEntries {
+		s.expire()
+		if len(s.devices) >= maxServerEntries {
+			if debug.Enabled() {
+				l.Debugf("discover server: ignoring announcement of %s; too many devices", id)
+			}
+			return
+		}
+	}
+	s.devices[id] = serverEntry{announced: addrs, addrs: verified, seen: time.Now()}
+}
+
+// presentsDevice returns whether whoever listens at the address presents
+// the certificate of the device in the TLS handshake. We present none, so
+// the device drops the connection without further ado.
+func presentsDevice(addr Address, id protocol.DeviceID) bool {
+	hostPort := net.JoinHostPort(net.IP(addr.IP).String(), strconv.Itoa(int(addr.Port)))
+	dialer := &net.Dialer{Timeout: serverVerifyTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", hostPort, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	return len(certs) == 1 && protocol.NewDeviceID(certs[0].Raw) == id
+}
+
+func addressesEqual(a, b []Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !net.IP(a[i].IP).Equal(b[i].IP) || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+	return true
+}
+
+// query answers with the announcement of the device, if we have one. Like
+// the public servers, we stay silent about unknown devices.
+func (s *Server) query(id protocol.DeviceID, from *net.UDPAddr) {
+	s.mut.Lock()
+	s.expire()
+	entry, ok := s.devices[id]
+	s.mut.Unlock()
+	if !ok {
+		return
+	}
+
+	pkt := Announce{
+		Magic: AnnouncementMagic,
+		This:  Device{ID: id[:], Addresses: entry.addrs},
+	}
+	s.conn.WriteToUDP(pkt.MustMarshalXDR(), from)
+}
+
+// expire forgets the devices that didn't announce themselves in a while.
+// Must be called with mut held.
+func (s *Server) expire() {
+	for id, entry := range s.devices {
+		if time.Since(entry.seen) > serverEntryLifetime {
+			delete(s.devices, id)
+		}
+	}
+}
+
+func (s *Server) allowed(id protocol.DeviceID) bool {
+	if len(s.opts.Devices) == 0 {
+		return true
+	}
+	for _, dev := range s.opts.Devices {
+		if dev == id {
+			return true
+		}
+	}
+	return false
+}
@@ -7,13 +7,11 @@
 package events
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "events") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("events")
 	dl    = logger.DefaultLogger
 )
@@ -35,6 +35,9 @@ const (
 	DownloadProgress
 	FolderSummary
 	FolderCompletion
+	FolderQuotaExceeded
+	APIRequest
+	FileConflict
 
 	AllEvents = (1 << iota) - 1
 )
@@ -75,6 +78,12 @@ func (t EventType) String() string {
 		return "FolderSummary"
 	case FolderCompletion:
 		return "FolderCompletion"
+	case FolderQuotaExceeded:
+		return "FolderQuotaExceeded"
+	case APIRequest:
+		return "APIRequest"
+	case FileConflict:
+		return "FileConflict"
 	default:
 		return "Unknown"
 	}
@@ -84,6 +93,25 @@ func (t EventType) MarshalText() ([]byte, error) {
 	return []byte(t.String()), nil
 }
 
+func (t *EventType) UnmarshalText(bs []byte) error {
+	*t = UnmarshalEventType(string(bs))
+	if *t == 0 {
+		return errors.New("unknown event type " + string(bs))
+	}
+	return nil
+}
+
+// UnmarshalEventType returns the event type with the given name, or zero
+// for an unknown name.
+func UnmarshalEventType(s string) EventType {
+	for t := EventType(1); t&AllEvents != 0; t <<= 1 {
+		if t.String() == s {
+			return t
+		}
+	}
+	return 0
+}
+
 const BufferSize = 64
 
 type Logger struct {
@@ -122,7 +150,7 @@ func NewLogger() *Logger {
 
 func (l *Logger) Log(t EventType, data interface{}) {
 	l.mutex.Lock()
-	if debug {
+	if debug.Enabled() {
 		dl.Debugln("log", l.nextID, t.String(), data)
 	}
 	e := Event{
@@ -144,9 +172,19 @@ func (l *Logger) Log(t EventType, data interface{}) {
 	l.mutex.Unlock()
 }
 
+// Resume makes the IDs of the events logged from now on follow id, so that
+// they don't repeat the IDs of events kept from an earlier run.
+func (l *Logger) Resume(id int) {
+	l.mutex.Lock()
+	if l.nextID <= id {
+		l.nextID = id + 1
+	}
+	l.mutex.Unlock()
+}
+
 func (l *Logger) Subscribe(mask EventType) *Subscription {
 	l.mutex.Lock()
-	if debug {
+	if debug.Enabled() {
 		dl.Debugln("subscribe", mask)
 	}
 	s := &Subscription{
@@ -163,7 +201,7 @@ func (l *Logger) Subscribe(mask EventType) *Subscription {
 
 func (l *Logger) Unsubscribe(s *Subscription) {
 	l.mutex.Lock()
-	if debug {
+	if debug.Enabled() {
 		dl.Debugln("unsubscribe")
 	}
 	delete(l.subs, s.id)
@@ -175,7 +213,7 @@ func (l *Logger) Unsubscribe(s *Subscription) {
 // out of the event channel is closed. Poll should not be called concurrently
 // from multiple goroutines for a single subscription.
 func (s *Subscription) Poll(timeout time.Duration) (Event, error) {
-	if debug {
+	if debug.Enabled() {
 		dl.Debugln("poll", timeout)
 	}
 
@@ -205,11 +243,26 @@ type BufferedSubscription struct {
 }
 
 func NewBufferedSubscription(s *Subscription, size int) *BufferedSubscription {
+	return NewBufferedSubscriptionFrom(s, size, nil)
+}
+
+// NewBufferedSubscriptionFrom returns a buffered subscription with the
+// buffer starting out holding the given events, oldest first, which must
+// all be older than the events of the subscription.
+func NewBufferedSubscriptionFrom(s *Subscription, size int, history []Event) *BufferedSubscription {
 	bs := &BufferedSubscription{
 		sub: s,
 		buf: make([]Event, size),
 		mut: sync.NewMutex(),
 	}
+	if len(history) > size {
+		history = history[len(history)-size:]
+	}
+	for _, ev := range history {
+		bs.buf[bs.next] = ev
+		bs.next = (bs.next + 1) % size
+		bs.cur = ev.ID
+	}
 	bs.cond = stdsync.NewCond(bs.mut)
 	go bs.pollingLoop()
 	return bs
@@ -178,3 +178,36 @@ func TestBufferedSub(t *testing.T) {
 	}
 
 }
+
+func TestUnmarshalEventType(t *testing.T) {
+	for t0 := events.EventType(1); t0&events.AllEvents != 0; t0 <<= 1 {
+		if t1 := events.UnmarshalEventType(t0.String()); t1 != t0 {
+			t.Errorf("Incorrect type %v for %v", t1, t0)
+		}
+	}
+	if t0 := events.UnmarshalEventType("Nonexistent"); t0 != 0 {
+		t.Errorf("Unexpected type %v for an unknown name", t0)
+	}
+}
+
+func TestBufferedSubHistory(t *testing.T) {
+	history := []events.Event{
+		{ID: 40, Type: events.DeviceConnected},
+		{ID: 41, Type: events.DeviceDisconnected},
+	}
+
+	l := events.NewLogger()
+	l.Resume(41)
+	s := l.Subscribe(events.AllEvents)
+	bs := events.NewBufferedSubscriptionFrom(s, 10, history)
+
+	if evs := bs.Since(40, nil); len(evs) != 1 || evs[0].ID != 41 {
+		t.Fatalf("Incorrect history %v", evs)
+	}
+
+	l.Log(events.DeviceConnected, "foo")
+	evs := bs.Since(41, nil)
+	if len(evs) != 1 || evs[0].ID <= 41 {
+		t.Fatalf("Incorrect events %v after the history", evs)
+	}
+}
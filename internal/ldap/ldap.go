@@ -0,0 +1,315 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ldap implements as much of an LDAPv3 client (RFC 4511) as checking
+// a user's password takes: simple binds, compares and StartTLS.
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Result codes of interest.
+const (
+	ResultSuccess            = 0
+	ResultCompareFalse       = 5
+	ResultCompareTrue        = 6
+	ResultInvalidCredentials = 49
+)
+
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// BER tags of the elements we use.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+
+	tagBindRequest      = 0x60
+	tagBindResponse     = 0x61
+	tagUnbindRequest    = 0x42
+	tagCompareRequest   = 0x6e
+	tagCompareResponse  = 0x6f
+	tagExtendedRequest  = 0x77
+	tagExtendedResponse = 0x78
+
+	tagSimpleAuth  = 0x80 // [0] of the bind request
+	tagRequestName = 0x80 // [0] of the extended request
+)
+
+const maxMessageSize = 1 << 20
+
+var errMalformed = errors.New("ldap: malformed response")
+
+// ResultError is a result other than success from the server.
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("ldap: result %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("ldap: result %d", e.Code)
+}
+
+// Conn is a connection to an LDAP server. It is not safe for concurrent use.
+type Conn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+// Dial connects to the server at address, which is a host:port. With a TLS
+// configuration the connection is encrypted from the start (LDAPS).
+func Dial(address string, tlsCfg *tls.Config, timeout time.Duration) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsCfg != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsCfg)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn returns an LDAP connection over an established connection.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// SetDeadline sets the deadline for the rest of the exchange.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// StartTLS upgrades the connection to TLS.
+func (c *Conn) StartTLS(tlsCfg *tls.Config) error {
+	req := element(tagExtendedRequest, element(tagRequestName, []byte(startTLSOID)))
+	if _, err := c.request(req, tagExtendedResponse); err != nil {
+		return err
+	}
+
+	tc := tls.Client(c.conn, tlsCfg)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tc
+	c.r = bufio.NewReader(tc)
+	return nil
+}
+
+// Bind authenticates as dn with the password. An empty password would make
+// this an unauthenticated bind, which servers accept from anyone, so it's
+// refused.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return errors.New("ldap: empty password")
+	}
+	req := element(tagBindRequest,
+		element(tagInteger, []byte{3}),
+		element(tagOctetString, []byte(dn)),
+		element(tagSimpleAuth, []byte(password)))
+	_, err := c.request(req, tagBindResponse)
+	return err
+}
+
+// Compare returns whether the attribute of the entry dn has the value.
+func (c *Conn) Compare(dn, attribute, value string) (bool, error) {
+	req := element(tagCompareRequest,
+		element(tagOctetString, []byte(dn)),
+		element(tagSequence,
+			element(tagOctetString, []byte(attribute)),
+			element(tagOctetString, []byte(value))))
+	code, err := c.request(req, tagCompareResponse)
+	switch code {
+	case ResultCompareTrue:
+		return true, nil
+	case ResultCompareFalse:
+		return false, nil
+	}
+	if err == nil {
+		err = &ResultError{Code: code}
+	}
+	return false, err
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.msgID++
+	c.conn.Write(element(tagSequence, element(tagInteger, encodeInt(c.msgID)), element(tagUnbindRequest)))
+	return c.conn.Close()
+}
+
+// request sends the operation and reads the result code of the response,
+// which must be of the given type. Codes other than success and the compare
+// results are returned as a ResultError.
+func (c *Conn) request(op []byte, respTag byte) (int, error) {
+	c.msgID++
+	msg := element(tagSequence, element(tagInteger, encodeInt(c.msgID)), op)
+	if _, err := c.conn.Write(msg); err != nil {
+		return 0, err
+	}
+
+	tag, content, err := readElement(c.r)
+	if err != nil {
+		return 0, err
+	}
+	if tag != tagSequence {
+		return 0, errMalformed
+	}
+	children, err := parseElements(content)
+	if err != nil || len(children) < 2 || children[0].tag != tagInteger {
+		return 0, errMalformed
+	}
+	if id := decodeInt(children[0].content); id != c.msgID {
+		// Notices of disconnection come with message ID zero.
+		return 0, fmt.Errorf("ldap: unexpected response to message %d", id)
+	}
+	if children[1].tag != respTag {
+		return 0, errMalformed
+	}
+
+	// Every response we handle starts with an LDAPResult: resultCode,
+	// matchedDN, diagnosticMessage.
+	result, err := parseElements(children[1].content)
+	if err != nil || len(result) < 3 || result[0].tag != tagEnumerated {
+		return 0, errMalformed
+	}
+	code := decodeInt(result[0].content)
+	if code != ResultSuccess && code != ResultCompareFalse && code != ResultCompareTrue {
+		return code, &ResultError{Code: code, Message: string(result[2].content)}
+	}
+	return code, nil
+}
+
+// EscapeDN escapes a value for use in a distinguished name (RFC 4514).
+func EscapeDN(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// element encodes a BER element with the tag and the concatenated content.
+func element(tag byte, content ...[]byte) []byte {
+	var size int
+	for _, c := range content {
+		size += len(c)
+	}
+
+	bs := []byte{tag}
+	switch {
+	case size < 0x80:
+		bs = append(bs, byte(size))
+	case size <= 0xff:
+		bs = append(bs, 0x81, byte(size))
+	case size <= 0xffff:
+		bs = append(bs, 0x82, byte(size>>8), byte(size))
+	default:
+		bs = append(bs, 0x83, byte(size>>16), byte(size>>8), byte(size))
+	}
+	for _, c := range content {
+		bs = append(bs, c...)
+	}
+	return bs
+}
+
+// encodeInt encodes a non-negative integer in as few bytes as BER allows.
+func encodeInt(v int) []byte {
+	bs := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		bs = append([]byte{byte(v)}, bs...)
+	}
+	if bs[0]&0x80 != 0 {
+		bs = append([]byte{0}, bs...)
+	}
+	return bs
+}
+
+func decodeInt(bs []byte) int {
+	var v int
+	for _, b := range bs {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// readElement reads a complete BER element.
+func readElement(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := int(hdr[1])
+	if size&0x80 != 0 {
+		n := size & 0x7f
+		if n == 0 || n > 3 {
+			return 0, nil, errMalformed
+		}
+		ext := make([]byte, n)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		size = decodeInt(ext)
+	}
+	if size > maxMessageSize {
+		return 0, nil, errMalformed
+	}
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], content, nil
+}
+
+// parseElements splits the content of a constructed element into its
+// children.
+func parseElements(bs []byte) ([]berElement, error) {
+	var els []berElement
+	r := bytes.NewReader(bs)
+	for r.Len() > 0 {
+		tag, content, err := readElement(r)
+		if err != nil {
+			return nil, errMalformed
+		}
+		els = append(els, berElement{tag, content})
+	}
+	return els, nil
+}
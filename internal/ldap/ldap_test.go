@@ -0,0 +1,212 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ldap
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// fakeServer answers binds and compares on the connection, knowing the
+// passwords and group members given.
+func fakeServer(t *testing.T, conn net.Conn, passwords map[string]string, members map[string]bool) {
+	defer conn.Close()
+	for {
+		tag, content, err := readElement(conn)
+		if err != nil {
+			return
+		}
+		msg, err := parseElements(content)
+		if err != nil || tag != tagSequence || len(msg) != 2 {
+			t.Error("Malformed request")
+			return
+		}
+		id := msg[0].content
+		op, _ := parseElements(msg[1].content)
+
+		var respTag byte
+		var code int
+		switch msg[1].tag {
+		case tagBindRequest:
+			respTag = tagBindResponse
+			if pw, ok := passwords[string(op[1].content)]; !ok || pw != string(op[2].content) {
+				code = ResultInvalidCredentials
+			}
+		case tagCompareRequest:
+			respTag = tagCompareResponse
+			ava, _ := parseElements(op[1].content)
+			code = ResultCompareFalse
+			if members[string(op[0].content)+" "+string(ava[0].content)+" "+string(ava[1].content)] {
+				code = ResultCompareTrue
+			}
+		case tagUnbindRequest:
+			return
+		default:
+			t.Errorf("Unexpected request %x", msg[1].tag)
+			return
+		}
+
+		resp := element(tagSequence, element(tagInteger, id), element(respTag,
+			element(tagEnumerated, encodeInt(code)),
+			element(tagOctetString),
+			element(tagOctetString)))
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestBindCompare(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeServer(t, server,
+		map[string]string{"uid=jb,ou=people": "secret"},
+		map[string]bool{"cn=syncthing,ou=groups member uid=jb,ou=people": true})
+
+	c := NewConn(client)
+	defer c.Close()
+
+	err := c.Bind("uid=jb,ou=people", "wrong")
+	if rerr, ok := err.(*ResultError); !ok || rerr.Code != ResultInvalidCredentials {
+		t.Errorf("Unexpected error %v for a wrong password", err)
+	}
+	if err := c.Bind("uid=jb,ou=people", ""); err == nil {
+		t.Error("Unauthenticated bind allowed")
+	}
+	if err := c.Bind("uid=jb,ou=people", "secret"); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	if ok, err := c.Compare("cn=syncthing,ou=groups", "member", "uid=jb,ou=people"); !ok || err != nil {
+		t.Errorf("Unexpected compare result %v, %v for a member", ok, err)
+	}
+	if ok, err := c.Compare("cn=admins,ou=groups", "member", "uid=jb,ou=people"); ok || err != nil {
+		t.Errorf("Unexpected compare result %v, %v for a non member", ok, err)
+	}
+}
+
+func TestEncodeInt(t *testing.T) {
+	cases := map[int][]byte{
+		0:     {0},
+		1:     {1},
+		127:   {0x7f},
+		128:   {0, 0x80},
+		256:   {1, 0},
+		65535: {0, 0xff, 0xff},
+	}
+	for v, expected := range cases {
+		if bs := encodeInt(v); string(bs) != string(expected) {
+			t.Errorf("Incorrect encoding %x of %d, expected %x", bs, v, expected)
+		}
+		if d := decodeInt(expected); d != v {
+			t.Errorf("Incorrect decoding %d of %x", d, expected)
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	cases := map[string]string{
+		"jb":          "jb",
+		"a,ou=admins": `a\,ou\=admins`,
+		" #x ":        `\ #x\ `,
+		"#a#":         `\#a#`,
+		`q"<>;+\`:     `q\"\<\>\;\+\\`,
+		"nul\x00byte": `nul\00byte`,
+	}
+	for in, expected := range cases {
+		if out := EscapeDN(in); out != expected {
+			t.Errorf("Incorrect escape %q of %q, expected %q", out, in, expected)
+		}
+	}
+}
+
+func TestReadElementMalformed(t *testing.T) {
+	cases := map[string][]byte{
+		"empty":                {},
+		"no length":            {tagSequence},
+		"truncated content":    {tagOctetString, 5, 'a', 'b'},
+		"indefinite length":    {tagSequence, 0x80, 0, 0},
+		"long length too long": {tagSequence, 0x84, 0, 0, 0, 1, 0},
+		"truncated length":     {tagSequence, 0x82, 0x01},
+		"oversized":            {tagSequence, 0x83, 0x7f, 0xff, 0xff},
+		"oversized, no data":   {tagOctetString, 0x83, 0x10, 0x00, 0x01},
+	}
+	for name, bs := range cases {
+		if _, _, err := readElement(bytes.NewReader(bs)); err == nil {
+			t.Errorf("%s: no error for %x", name, bs)
+		}
+	}
+
+	// Children that run past the end of their parent.
+	if _, err := parseElements([]byte{tagOctetString, 3, 'a'}); err != errMalformed {
+		t.Errorf("Unexpected error %v for a truncated child", err)
+	}
+}
+
+// respondWith answers the first request on the connection with the raw
+// response, and closes it.
+func respondWith(conn net.Conn, resp []byte) {
+	defer conn.Close()
+	if _, _, err := readElement(conn); err != nil {
+		return
+	}
+	conn.Write(resp)
+}
+
+func TestMalformedResponses(t *testing.T) {
+	result := element(tagBindResponse,
+		element(tagEnumerated, encodeInt(ResultSuccess)),
+		element(tagOctetString),
+		element(tagOctetString))
+
+	cases := map[string][]byte{
+		"not a sequence":   element(tagOctetString, []byte("hello")),
+		"no operation":     element(tagSequence, element(tagInteger, encodeInt(1))),
+		"no message ID":    element(tagSequence, element(tagOctetString), result),
+		"wrong message ID": element(tagSequence, element(tagInteger, encodeInt(0)), result),
+		"wrong response":   element(tagSequence, element(tagInteger, encodeInt(1)), element(tagCompareResponse)),
+		"short result": element(tagSequence, element(tagInteger, encodeInt(1)),
+			element(tagBindResponse, element(tagEnumerated, encodeInt(ResultSuccess)))),
+		"result not enumerated": element(tagSequence, element(tagInteger, encodeInt(1)),
+			element(tagBindResponse, element(tagOctetString), element(tagOctetString), element(tagOctetString))),
+		"truncated child": element(tagSequence, element(tagInteger, encodeInt(1)), []byte{tagBindResponse, 10, 0}),
+	}
+	for name, resp := range cases {
+		client, server := net.Pipe()
+		go respondWith(server, resp)
+		c := NewConn(client)
+		if err := c.Bind("uid=jb", "secret"); err == nil {
+			t.Errorf("%s: bind succeeded", name)
+		}
+		client.Close()
+	}
+}
+
+// TestCorruptResponses checks that responses with random bytes changed are
+// either parsed or refused, without panicking.
+func TestCorruptResponses(t *testing.T) {
+	valid := element(tagSequence, element(tagInteger, encodeInt(1)), element(tagCompareResponse,
+		element(tagEnumerated, encodeInt(ResultCompareTrue)),
+		element(tagOctetString, []byte("cn=syncthing")),
+		element(tagOctetString, []byte("diagnostics"))))
+
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 1000; i++ {
+		resp := append([]byte(nil), valid...)
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			resp[rnd.Intn(len(resp))] = byte(rnd.Intn(256))
+		}
+		resp = resp[:rnd.Intn(len(resp)+1)]
+
+		client, server := net.Pipe()
+		go respondWith(server, resp)
+		c := NewConn(client)
+		c.Compare("cn=syncthing", "member", "uid=jb")
+		client.Close()
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package merge implements line based three way merging of text files,
+// and line based differences between two of them.
+package merge
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxCells limits the size of the table used to match the lines of two
+// files, and thus the size of files we attempt to merge.
+const maxCells = 4 << 20
+
+// IsText returns true if the data looks like text; valid UTF-8 without NUL
+// bytes.
+func IsText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) == -1
+}
+
+// Merge3 merges the changes made from base to local and from base to remote.
+// The merged result and true is returned if the changes don't overlap; if
+// they do, or if the files are too large to merge, false is returned.
+func Merge3(base, local, remote []byte) ([]byte, bool) {
+	o, a, b := lines(base), lines(local), lines(remote)
+
+	ma, ok := match(o, a)
+	if !ok {
+		return nil, false
+	}
+	mb, ok := match(o, b)
+	if !ok {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	i, j, k := 0, 0, 0
+	for {
+		// Lines unchanged in both versions
+		for i < len(o) && ma[i] == j && mb[i] == k {
+			out.WriteString(o[i])
+			i++
+			j++
+			k++
+		}
+		if i == len(o) && j == len(a) && k == len(b) {
+			return out.Bytes(), true
+		}
+
+		// Find the next base line kept in both versions. Everything up to
+		// there has been changed in at least one of them.
+		next, na, nb := len(o), len(a), len(b)
+		for n := i; n < len(o); n++ {
+			if ma[n] != -1 && mb[n] != -1 {
+				next, na, nb = n, ma[n], mb[n]
+				break
+			}
+		}
+
+		oc, ac, bc := o[i:next], a[j:na], b[k:nb]
+		switch {
+		case equal(ac, oc):
+			// Changed in remote only
+			writeLines(&out, bc)
+		case equal(bc, oc), equal(ac, bc):
+			// Changed in local only, or the same way in both
+			writeLines(&out, ac)
+		default:
+			return nil, false
+		}
+
+		i, j, k = next, na, nb
+	}
+}
+
+// diffContext is the number of unchanged lines shown around the changes in
+// a diff.
+const diffContext = 3
+
+// Diff returns the changes from a to b in the unified diff format, without
+// the file names, and true; or false if the files are too large to compare.
+func Diff(a, b []byte) (string, bool) {
+	o, n := lines(a), lines(b)
+	m, ok := match(o, n)
+	if !ok {
+		return "", false
+	}
+
+	// The edit script: each line of either file, prefixed with ' ' when
+	// kept, '-' when removed and '+' when added.
+	var script []string
+	for i, j := 0, 0; i < len(o) || j < len(n); {
+		switch {
+		case i < len(o) && m[i] == j:
+			script = append(script, " "+o[i])
+			i++
+			j++
+		case i < len(o) && m[i] == -1:
+			script = append(script, "-"+o[i])
+			i++
+		default:
+			script = append(script, "+"+n[j])
+			j++
+		}
+	}
+
+	var out bytes.Buffer
+	ai, bi := 0, 0 // lines of a and b before script[k]
+	for k := 0; k < len(script); {
+		if script[k][0] == ' ' {
+			ai++
+			bi++
+			k++
+			continue
+		}
+
+		// A hunk of changes, with the context before them, and extended
+		// for as long as the next change is within twice the context.
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for end < len(script) {
+			if script[end][0] != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(script) && next-end < 2*diffContext && script[next][0] == ' ' {
+				next++
+			}
+			if next == len(script) || script[next][0] == ' ' {
+				break
+			}
+			end = next
+		}
+		if end += diffContext; end > len(script) {
+			end = len(script)
+		}
+
+		as, bs := ai-(k-start), bi-(k-start)
+		var al, bl int
+		for _, line := range script[start:end] {
+			if line[0] != '+' {
+				al++
+			}
+			if line[0] != '-' {
+				bl++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(as, al), hunkRange(bs, bl))
+		for _, line := range script[start:end] {
+			out.WriteString(line)
+			if line[len(line)-1] != '\n' {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		ai, bi = as+al, bs+bl
+		k = end
+	}
+	return out.String(), true
+}
+
+// hunkRange returns the start and length of the lines in a hunk header,
+// counting from one.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// lines splits the data into lines, keeping the line endings.
+func lines(data []byte) []string {
+	var res []string
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 {
+			n = len(data)
+		}
+		res = append(res, string(data[:n]))
+		data = data[n:]
+	}
+	return res
+}
+
+// match returns, for each line in o, the index of the matching line in a, or
+// -1 if the line has no match. The matching is a longest common subsequence
+// of the two.
+func match(o, a []string) ([]int, bool) {
+	if (len(o)+1)*(len(a)+1) > maxCells {
+		return nil, false
+	}
+
+	// lcs[i*w+j] is the length of the longest common subsequence of o[i:]
+	// and a[j:].
+	w := len(a) + 1
+	lcs := make([]int32, (len(o)+1)*w)
+	for i := len(o) - 1; i >= 0; i-- {
+		for j := len(a) - 1; j >= 0; j-- {
+			if o[i] == a[j] {
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			} else if l, r := lcs[(i+1)*w+j], lcs[i*w+j+1]; l >= r {
+				lcs[i*w+j] = l
+			} else {
+				lcs[i*w+j] = r
+			}
+		}
+	}
+
+	m := make([]int, len(o))
+	for i := range m {
+		m[i] = -1
+	}
+	for i, j := 0, 0; i < len(o) && j < len(a); {
+		switch {
+		case o[i] == a[j]:
+			m[i] = j
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return m, true
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(buf *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+}
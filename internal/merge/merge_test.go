@@ -0,0 +1,95 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package merge
+
+import "testing"
+
+var mergeCases = []struct {
+	base, local, remote string
+	merged              string
+	ok                  bool
+}{
+	// Changes in one version only
+	{"a\nb\nc\n", "a\nb\nc\n", "a\nx\nc\n", "a\nx\nc\n", true},
+	{"a\nb\nc\n", "a\nx\nc\n", "a\nb\nc\n", "a\nx\nc\n", true},
+	// Changes to different lines
+	{"a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+	// Additions at both ends
+	{"b\n", "a\nb\n", "b\nc\n", "a\nb\nc\n", true},
+	// Deletion in one, change elsewhere in the other
+	{"a\nb\nc\nd\n", "a\nc\nd\n", "a\nb\nc\nD\n", "a\nc\nD\n", true},
+	// The same change in both
+	{"a\nb\nc\n", "a\nx\nc\n", "a\nx\nc\n", "a\nx\nc\n", true},
+	// A missing final newline is kept
+	{"a\nb", "x\nb", "a\nb", "x\nb", true},
+	// Everything new
+	{"", "", "a\n", "a\n", true},
+	// Different changes to the same line
+	{"a\nb\nc\n", "a\nx\nc\n", "a\ny\nc\n", "", false},
+	// Insertions at the same place
+	{"a\nc\n", "a\nx\nc\n", "a\ny\nc\n", "", false},
+}
+
+func TestMerge3(t *testing.T) {
+	for i, tc := range mergeCases {
+		merged, ok := Merge3([]byte(tc.base), []byte(tc.local), []byte(tc.remote))
+		if ok != tc.ok {
+			t.Errorf("%d: unexpected result %v != %v", i, ok, tc.ok)
+			continue
+		}
+		if ok && string(merged) != tc.merged {
+			t.Errorf("%d: incorrect merge %q != %q", i, merged, tc.merged)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	if !IsText([]byte("some text\nåäö\n")) {
+		t.Error("Text should be text")
+	}
+	if IsText([]byte("some\x00binary")) {
+		t.Error("Data with NUL should not be text")
+	}
+	if IsText([]byte{0xff, 0xfe, 'a'}) {
+		t.Error("Invalid UTF-8 should not be text")
+	}
+}
+
+var diffCases = []struct {
+	a, b string
+	diff string
+}{
+	{"a\nb\nc\n", "a\nb\nc\n", ""},
+	{"a\nb\nc\n", "a\nx\nc\n", "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+	{"", "a\n", "@@ -0,0 +1 @@\n+a\n"},
+	{"a\nb", "a\nc", "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+	// Changes far apart are separate hunks
+	{
+		"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+		"x\n2\n3\n4\n5\n6\n7\n8\n9\ny\n",
+		"@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+y\n",
+	},
+	// and close ones the same
+	{
+		"1\n2\n3\n4\n5\n6\n7\n8\n",
+		"x\n2\n3\n4\n5\n6\n7\ny\n",
+		"@@ -1,8 +1,8 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n",
+	},
+}
+
+func TestDiff(t *testing.T) {
+	for i, tc := range diffCases {
+		diff, ok := Diff([]byte(tc.a), []byte(tc.b))
+		if !ok {
+			t.Errorf("%d: no diff", i)
+			continue
+		}
+		if diff != tc.diff {
+			t.Errorf("%d: incorrect diff %q != %q", i, diff, tc.diff)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/scanner"
+)
+
+// Modified blocks can be transferred in parts. The puller first asks for the
+// hashes of the sub blocks of a block, by setting the subBlockHashesOption
+// on the Request to the sub block size. It then compares them to the block
+// it already has at the same offset and requests only the sub blocks that
+// differ. Support is announced with the option of the same name in the
+// cluster config.
+const (
+	subBlockHashesOption = "subBlockHashes"
+	subBlockSize         = 4 << 10
+	minSubBlockSize      = 512
+)
+
+var errSubBlockHashes = errors.New("incorrect sub block hashes")
+
+// subBlockHashes returns the concatenated SHA-256 hashes of each size bytes
+// of data. The last sub block may be shorter.
+func subBlockHashes(data []byte, size int) []byte {
+	hashes := make([]byte, 0, (len(data)+size-1)/size*sha256.Size)
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		hash := sha256.Sum256(data[:n])
+		hashes = append(hashes, hash[:]...)
+		data = data[n:]
+	}
+	return hashes
+}
+
+// requestedSubBlockSize returns the sub block size asked for in the Request
+// options, or zero if the data itself is requested.
+func requestedSubBlockSize(options []protocol.Option) (int, error) {
+	for _, opt := range options {
+		if opt.Key != subBlockHashesOption {
+			continue
+		}
+		size, err := strconv.Atoi(opt.Value)
+		if err != nil || size < minSubBlockSize || size > protocol.BlockSize {
+			return 0, errSubBlockHashes
+		}
+		return size, nil
+	}
+	return 0, nil
+}
+
+// pullBlock fetches the whole block from the given device. It returns the
+// block and the number of bytes received.
+func (p *rwFolder) pullBlock(device protocol.DeviceID, state pullBlockState) ([]byte, int, error) {
+	p.limiter.waitRecv(int(state.block.Size))
+	buf, err := p.model.requestGlobal(device, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, 0, nil)
+	return buf, len(buf), err
+}
+
+// pullDelta fetches the block from the given device, transferring only the
+// sub blocks that differ from the old version of the file. If there is no
+// old version, or the result doesn't check out, the whole block is fetched.
+// It returns the block and the number of bytes received, sub blocks, hashes
+// and all.
+func (p *rwFolder) pullDelta(device protocol.DeviceID, state pullBlockState) ([]byte, int, error) {
+	size := int(state.block.Size)
+	old, ok := readOldBlock(state.realName, state.block.Offset, size)
+	if !ok {
+		return p.pullBlock(device, state)
+	}
+	received := 0
+	fallback := func() ([]byte, int, error) {
+		buf, n, err := p.pullBlock(device, state)
+		return buf, received + n, err
+	}
+
+	hashesOpt := []protocol.Option{{Key: subBlockHashesOption, Value: strconv.Itoa(subBlockSize)}}
+	nHashes := (size + subBlockSize - 1) / subBlockSize
+	p.limiter.waitRecv(nHashes * sha256.Size)
+	theirs, err := p.model.requestGlobal(device, p.folder, state.file.Name, state.block.Offset, size, nil, 0, hashesOpt)
+	if err != nil {
+		return nil, received, err
+	}
+	received += len(theirs)
+	if len(theirs) != nHashes*sha256.Size {
+		return fallback()
+	}
+	ours := subBlockHashes(old, subBlockSize)
+
+	// Fetch each run of differing sub blocks with a single request.
+	buf := old
+	for i := 0; i < nHashes; {
+		if bytes.Equal(ours[i*sha256.Size:(i+1)*sha256.Size], theirs[i*sha256.Size:(i+1)*sha256.Size]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < nHashes && !bytes.Equal(ours[j*sha256.Size:(j+1)*sha256.Size], theirs[j*sha256.Size:(j+1)*sha256.Size]) {
+			j++
+		}
+
+		start, end := i*subBlockSize, j*subBlockSize
+		if end > size {
+			end = size
+		}
+		p.limiter.waitRecv(end - start)
+		data, err := p.model.requestGlobal(device, p.folder, state.file.Name, state.block.Offset+int64(start), end-start, nil, 0, nil)
+		if err != nil {
+			return nil, received, err
+		}
+		received += len(data)
+		if len(data) != end-start {
+			return fallback()
+		}
+		copy(buf[start:end], data)
+		i = j
+	}
+
+	if debug.Enabled() {
+		l.Debugf("%v delta pull %q o=%d s=%d", p, state.file.Name, state.block.Offset, size)
+	}
+
+	if _, err := scanner.VerifyBuffer(buf, state.block); err != nil {
+		return fallback()
+	}
+	return buf, received, nil
+}
+
+// readOldBlock reads size bytes at offset from the current version of the
+// file, if it is long enough.
+func readOldBlock(name string, offset int64, size int) ([]byte, bool) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer fd.Close()
+
+	buf := make([]byte, size)
+	if _, err := fd.ReadAt(buf, offset); err != nil {
+		return nil, false
+	}
+	return buf, true
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// A servingConnection answers requests from another model, counting the
+// bytes sent.
+type servingConnection struct {
+	FakeConnection
+	model *Model
+	sent  *int
+}
+
+func (c servingConnection) Request(folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
+	data, err := c.model.Request(device1, folder, name, offset, size, hash, flags, options)
+	*c.sent += len(data)
+	return data, err
+}
+
+func TestDeltaPull(t *testing.T) {
+	oldDir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(oldDir)
+	newDir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(newDir)
+
+	oldData := make([]byte, protocol.BlockSize)
+	rand.Read(oldData)
+	newData := make([]byte, len(oldData))
+	copy(newData, oldData)
+	copy(newData[10000:], "a few changed bytes")
+
+	if err := ioutil.WriteFile(filepath.Join(oldDir, "file"), oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(newDir, "file"), newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The serving side has the new version of the file.
+	fcfg := config.FolderConfiguration{
+		ID:          "default",
+		RawPath:     newDir,
+		Devices:     []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		DeltaBlocks: true,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+	sdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	server := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", sdb)
+	server.AddFolder(fcfg)
+	server.StartFolderRO("default")
+	if err := server.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pulling side has the old one.
+	fcfg.RawPath = oldDir
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	var sent int
+	fc := servingConnection{FakeConnection{id: device1}, server, &sent}
+	m.AddConnection(fc, fc)
+	m.ClusterConfig(device1, server.clusterConfig(device1))
+	if !m.deviceDeltaBlocks(device1) {
+		t.Fatal("Device should support delta blocks")
+	}
+
+	blocks, err := scanner.Blocks(bytes.NewReader(newData), protocol.BlockSize, int64(len(newData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := protocol.FileInfo{Name: "file", Blocks: blocks}
+	state := pullBlockState{
+		sharedPullerState: &sharedPullerState{
+			file:     file,
+			realName: filepath.Join(oldDir, "file"),
+		},
+		block: blocks[0],
+	}
+
+	p := newRWFolder(m, m.shortID, fcfg)
+	buf, received, err := p.pullDelta(device1, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, newData) {
+		t.Error("Incorrect block data")
+	}
+	if sent > 2*subBlockSize+protocol.BlockSize/subBlockSize*32 {
+		t.Errorf("Too much data sent for a small change: %d bytes", sent)
+	}
+	if received != sent {
+		t.Errorf("Received %d bytes, but %d were sent", received, sent)
+	}
+
+	// Without an old version the whole block is fetched.
+	sent = 0
+	state.realName = filepath.Join(oldDir, "nonexistent")
+	buf, received, err = p.pullDelta(device1, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, newData) {
+		t.Error("Incorrect block data")
+	}
+	if sent != len(newData) {
+		t.Errorf("Expected the whole block to be sent, not %d bytes", sent)
+	}
+	if received != sent {
+		t.Errorf("Received %d bytes, but %d were sent", received, sent)
+	}
+}
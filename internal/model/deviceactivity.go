@@ -28,6 +28,26 @@ func newDeviceActivity() *deviceActivity {
 
 func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.DeviceID {
 	m.mut.Lock()
+	selected := m.leastBusyLocked(availability)
+	m.mut.Unlock()
+	return selected
+}
+
+// useLeastBusy selects the least busy device and marks it as in use, as one
+// operation. Concurrent callers are thus spread over the devices instead of
+// all picking the one that was least busy before any of them started. The
+// zero device ID is returned, and nothing marked, when there is no device.
+func (m *deviceActivity) useLeastBusy(availability []protocol.DeviceID) protocol.DeviceID {
+	m.mut.Lock()
+	selected := m.leastBusyLocked(availability)
+	if selected != (protocol.DeviceID{}) {
+		m.act[selected]++
+	}
+	m.mut.Unlock()
+	return selected
+}
+
+func (m *deviceActivity) leastBusyLocked(availability []protocol.DeviceID) protocol.DeviceID {
 	low := 2<<30 - 1
 	var selected protocol.DeviceID
 	for _, device := range availability {
@@ -36,7 +56,6 @@ func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.De
 			selected = device
 		}
 	}
-	m.mut.Unlock()
 	return selected
 }
 
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
 )
 
 func TestDeviceActivity(t *testing.T) {
@@ -56,3 +57,33 @@ func TestDeviceActivity(t *testing.T) {
 		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
 	}
 }
+
+func TestDeviceActivitySpread(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	n1 := protocol.DeviceID([32]byte{5, 6, 7, 8})
+	n2 := protocol.DeviceID([32]byte{9, 10, 11, 12})
+	devices := []protocol.DeviceID{n0, n1, n2}
+	na := newDeviceActivity()
+
+	// Six concurrent requests are spread evenly over the three devices.
+
+	wg := sync.NewWaitGroup()
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			na.useLeastBusy(devices)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	for _, dev := range devices {
+		if n := na.act[dev]; n != 2 {
+			t.Errorf("Device %v has %d requests, not 2", dev, n)
+		}
+	}
+
+	if lb := na.useLeastBusy(nil); lb != (protocol.DeviceID{}) {
+		t.Errorf("No device should be selected from nothing, not %v", lb)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"io"
+
+	"github.com/syncthing/protocol"
+)
+
+// An extraConn is an additional connection to an already connected device.
+// Indexes and the cluster config are exchanged over the first connection
+// only; the extra connections carry block requests, which are spread over
+// all connections to the device. As far as the protocol is concerned the
+// extra connections are complete connections, so each side sends an empty
+// cluster config and index over them before making requests.
+type extraConn struct {
+	model  *Model
+	id     protocol.DeviceID
+	raw    io.Closer
+	conn   protocol.Connection
+	closed bool // protected by model.pmut
+}
+
+// AddExtraConnection adds another connection to an already connected device.
+// The protocol connection is created by the given function, using the
+// receiver passed to it. It returns false, having closed the connection, if
+// the device is not connected.
+func (m *Model) AddExtraConnection(deviceID protocol.DeviceID, rawConn io.Closer, newConn func(receiver protocol.Model) protocol.Connection) bool {
+	ec := &extraConn{
+		model: m,
+		id:    deviceID,
+		raw:   rawConn,
+	}
+	ec.conn = newConn(ec)
+
+	m.pmut.Lock()
+	if _, ok := m.protoConn[deviceID]; !ok || ec.closed {
+		m.pmut.Unlock()
+		rawConn.Close()
+		return false
+	}
+	m.extraConns[deviceID] = append(m.extraConns[deviceID], ec)
+	n := len(m.extraConns[deviceID]) + 1
+	m.pmut.Unlock()
+
+	ec.conn.ClusterConfig(protocol.ClusterConfigMessage{
+		ClientName:    m.clientName,
+		ClientVersion: m.clientVersion,
+	})
+	ec.conn.Index("", nil, 0, nil)
+
+	l.Infof("Device %s now has %d connections", deviceID, n)
+	return true
+}
+
+// Connections returns the number of connections to the device.
+func (m *Model) Connections(deviceID protocol.DeviceID) int {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+
+	if _, ok := m.protoConn[deviceID]; !ok {
+		return 0
+	}
+	return len(m.extraConns[deviceID]) + 1
+}
+
+// requestConn returns a connection to make a request to the device over,
+// taking turns between the connections we have.
+func (m *Model) requestConn(deviceID protocol.DeviceID) (protocol.Connection, bool) {
+	m.pmut.Lock()
+	defer m.pmut.Unlock()
+
+	nc, ok := m.protoConn[deviceID]
+	if !ok {
+		return nil, false
+	}
+	extra := m.extraConns[deviceID]
+	if len(extra) == 0 {
+		return nc, true
+	}
+
+	m.connTurn++
+	if i := m.connTurn % (len(extra) + 1); i > 0 {
+		return extra[i-1].conn, true
+	}
+	return nc, true
+}
+
+// closeExtraConnsLocked closes all extra connections to the device.
+func (m *Model) closeExtraConnsLocked(deviceID protocol.DeviceID) {
+	for _, ec := range m.extraConns[deviceID] {
+		ec.closed = true
+		closeRawConn(ec.raw)
+	}
+	delete(m.extraConns, deviceID)
+}
+
+func (c *extraConn) Index(protocol.DeviceID, string, []protocol.FileInfo, uint32, []protocol.Option) {
+}
+
+func (c *extraConn) IndexUpdate(protocol.DeviceID, string, []protocol.FileInfo, uint32, []protocol.Option) {
+}
+
+func (c *extraConn) ClusterConfig(protocol.DeviceID, protocol.ClusterConfigMessage) {
+}
+
+func (c *extraConn) Request(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
+	return c.model.Request(deviceID, folder, name, offset, size, hash, flags, options)
+}
+
+// Close removes the connection from the model. The device stays connected
+// over the others.
+func (c *extraConn) Close(deviceID protocol.DeviceID, err error) {
+	m := c.model
+	m.pmut.Lock()
+	defer m.pmut.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	closeRawConn(c.raw)
+
+	conns := m.extraConns[deviceID]
+	for i, ec := range conns {
+		if ec == c {
+			m.extraConns[deviceID] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	l.Infof("Extra connection to %s closed: %v", deviceID, err)
+}
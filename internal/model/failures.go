@@ -0,0 +1,159 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"sort"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	failureRetryIntv    = time.Minute
+	maxFailureRetryIntv = time.Hour
+)
+
+// A FailedItem is a file that could not be synced, and when we will try
+// again.
+type FailedItem struct {
+	Name      string    `json:"name"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	NextRetry time.Time `json:"nextRetry"`
+
+	version protocol.Vector
+}
+
+// The failureTracker keeps track of the items that failed to sync. Items
+// that keep failing are retried with an exponentially increasing delay,
+// instead of on every pull.
+type failureTracker struct {
+	items map[string]FailedItem
+	mut   sync.Mutex
+}
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{
+		items: make(map[string]FailedItem),
+		mut:   sync.NewMutex(),
+	}
+}
+
+// record registers the outcome of an attempt to sync the given file. A nil
+// error forgets any earlier failures.
+func (t *failureTracker) record(file protocol.FileInfo, err error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if err == nil || err == errNoDevice {
+		// Nothing is wrong with the item itself when there is no device to
+		// pull it from; we'll try again as soon as one connects.
+		delete(t.items, file.Name)
+		return
+	}
+
+	item, ok := t.items[file.Name]
+	if !ok || !item.version.Equal(file.Version) {
+		// A new version of the file starts over.
+		item = FailedItem{
+			Name:    file.Name,
+			version: file.Version,
+		}
+	}
+
+	delay := maxFailureRetryIntv
+	if item.Attempts < 8 {
+		delay = failureRetryIntv << uint(item.Attempts)
+		if delay > maxFailureRetryIntv {
+			delay = maxFailureRetryIntv
+		}
+	}
+
+	item.Error = err.Error()
+	item.Attempts++
+	item.NextRetry = time.Now().Add(delay)
+	t.items[file.Name] = item
+}
+
+// backingOff returns true if the given file has failed before and should
+// not be retried yet. New versions of the file are always tried.
+func (t *failureTracker) backingOff(file protocol.FileInfo) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	item, ok := t.items[file.Name]
+	return ok && item.version.Equal(file.Version) && time.Now().Before(item.NextRetry)
+}
+
+// has returns true if there is a failure recorded for the given name.
+func (t *failureTracker) has(name string) bool {
+	t.mut.Lock()
+	_, ok := t.items[name]
+	t.mut.Unlock()
+	return ok
+}
+
+// retain forgets the failures for all items not in the given set, i.e.
+// those we no longer need.
+func (t *failureTracker) retain(names map[string]struct{}) {
+	t.mut.Lock()
+	for name := range t.items {
+		if _, ok := names[name]; !ok {
+			delete(t.items, name)
+		}
+	}
+	t.mut.Unlock()
+}
+
+// failedWith returns true if any item last failed with the given error.
+func (t *failureTracker) failedWith(err error) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	for _, item := range t.items {
+		if item.Error == err.Error() {
+			return true
+		}
+	}
+	return false
+}
+
+// nextRetry returns the earliest time at which an item should be retried,
+// and false if there are no failed items.
+func (t *failureTracker) nextRetry() (time.Time, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	var next time.Time
+	for _, item := range t.items {
+		if next.IsZero() || item.NextRetry.Before(next) {
+			next = item.NextRetry
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// list returns the failed items, sorted by name.
+func (t *failureTracker) list() []FailedItem {
+	t.mut.Lock()
+	items := make([]FailedItem, 0, len(t.items))
+	for _, item := range t.items {
+		items = append(items, item)
+	}
+	t.mut.Unlock()
+
+	sort.Sort(failedItemsByName(items))
+	return items
+}
+
+type failedItemsByName []FailedItem
+
+func (l failedItemsByName) Len() int           { return len(l) }
+func (l failedItemsByName) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+func (l failedItemsByName) Less(a, b int) bool { return l[a].Name < l[b].Name }
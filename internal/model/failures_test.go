@@ -0,0 +1,74 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestFailureBackoff(t *testing.T) {
+	tr := newFailureTracker()
+	f := protocol.FileInfo{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}}
+	errDenied := errors.New("permission denied")
+
+	if tr.backingOff(f) {
+		t.Error("Unexpected backoff before any failure")
+	}
+
+	var prev time.Duration
+	for i := 1; i <= 4; i++ {
+		tr.record(f, errDenied)
+		if !tr.backingOff(f) {
+			t.Fatal("Should back off after a failure")
+		}
+
+		items := tr.list()
+		if len(items) != 1 || items[0].Attempts != i || items[0].Error != errDenied.Error() {
+			t.Fatalf("Incorrect failed items %+v", items)
+		}
+		delay := items[0].NextRetry.Sub(time.Now())
+		if delay <= prev {
+			t.Errorf("Delay %v after attempt %d should be longer than %v", delay, i, prev)
+		}
+		prev = delay
+	}
+
+	// A new version is tried immediately and starts over.
+
+	f2 := f
+	f2.Version = f.Version.Update(2)
+	if tr.backingOff(f2) {
+		t.Error("Unexpected backoff for new version")
+	}
+	tr.record(f2, errDenied)
+	if items := tr.list(); items[0].Attempts != 1 {
+		t.Errorf("Attempts should restart for a new version, not %d", items[0].Attempts)
+	}
+
+	// Success forgets the failure.
+
+	tr.record(f2, nil)
+	if _, ok := tr.nextRetry(); ok {
+		t.Error("Unexpected failed items after success")
+	}
+}
+
+func TestFailureRetain(t *testing.T) {
+	tr := newFailureTracker()
+	err := errors.New("path too long")
+	tr.record(protocol.FileInfo{Name: "a"}, err)
+	tr.record(protocol.FileInfo{Name: "b"}, err)
+
+	tr.retain(map[string]struct{}{"b": {}})
+	if items := tr.list(); len(items) != 1 || items[0].Name != "b" {
+		t.Errorf("Incorrect failed items %+v", items)
+	}
+}
@@ -44,6 +44,12 @@ type stateTracker struct {
 	current folderState
 	err     error
 	changed time.Time
+
+	// How long the last completed scan took.
+	scanTime time.Duration
+
+	// Called when the folder enters or leaves the error state, if set.
+	errorChanged func()
 }
 
 // setState sets the new folder state, for states other than FolderError.
@@ -70,6 +76,12 @@ func (s *stateTracker) setState(newState folderState) {
 			eventData["duration"] = time.Since(s.changed).Seconds()
 		}
 
+		if s.current == FolderError {
+			s.notifyErrorChanged()
+		}
+		if s.current == FolderScanning && !s.changed.IsZero() {
+			s.scanTime = time.Since(s.changed)
+		}
 		s.current = newState
 		s.changed = time.Now()
 
@@ -87,6 +99,14 @@ func (s *stateTracker) getState() (current folderState, changed time.Time, err e
 	return
 }
 
+// lastScanDuration returns how long the last completed scan took, or zero
+// if no scan has completed yet.
+func (s *stateTracker) lastScanDuration() time.Duration {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.scanTime
+}
+
 // setError sets the folder state to FolderError with the specified error.
 func (s *stateTracker) setError(err error) {
 	s.mut.Lock()
@@ -102,6 +122,9 @@ func (s *stateTracker) setError(err error) {
 			eventData["duration"] = time.Since(s.changed).Seconds()
 		}
 
+		if s.current != FolderError {
+			s.notifyErrorChanged()
+		}
 		s.current = FolderError
 		s.err = err
 		s.changed = time.Now()
@@ -125,6 +148,7 @@ func (s *stateTracker) clearError() {
 			eventData["duration"] = time.Since(s.changed).Seconds()
 		}
 
+		s.notifyErrorChanged()
 		s.current = FolderIdle
 		s.err = nil
 		s.changed = time.Now()
@@ -133,3 +157,11 @@ func (s *stateTracker) clearError() {
 	}
 	s.mut.Unlock()
 }
+
+// notifyErrorChanged calls errorChanged, without holding up the caller of
+// the state change.
+func (s *stateTracker) notifyErrorChanged() {
+	if s.errorChanged != nil {
+		go s.errorChanged()
+	}
+}
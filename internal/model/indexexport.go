@@ -0,0 +1,155 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// The index of a folder can be exported to a file and imported into the same
+// folder on another device, after the data has been copied there by other
+// means. The files that are on disk as the index says, with the same size and
+// modification time, then needn't be hashed again by the first scan.
+//
+// The file is gzipped, starting with indexExportMagic, followed by the local
+// files of the folder as XDR encoded FileInfos, each preceded by its length.
+const (
+	indexExportMagic   = 0x53544958 // "STIX"
+	maxIndexExportSize = 64 << 20   // of a single FileInfo
+)
+
+var errNotIndexExport = errors.New("not an exported index")
+
+// ExportIndex writes the local index of the folder to w.
+func (m *Model) ExportIndex(folder string, w io.Writer) error {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errFolderMissing
+	}
+
+	gw := gzip.NewWriter(w)
+	if err := binary.Write(gw, binary.BigEndian, uint32(indexExportMagic)); err != nil {
+		return err
+	}
+	var err error
+	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		f.Name = osutil.NormalizedFilename(f.Name)
+		bs := f.MustMarshalXDR()
+		if err = binary.Write(gw, binary.BigEndian, uint32(len(bs))); err != nil {
+			return false
+		}
+		_, err = gw.Write(bs)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ImportIndex reads an index written by ExportIndex into the local index of
+// the folder. Only the files that aren't in the local index yet, and that
+// are on disk as the imported index says, are imported; the rest are
+// skipped and left to scanning.
+func (m *Model) ImportIndex(folder string, r io.Reader) (imported, skipped int, err error) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return 0, 0, errFolderMissing
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, 0, errNotIndexExport
+	}
+	br := bufio.NewReader(gr)
+	var magic uint32
+	if err := binary.Read(br, binary.BigEndian, &magic); err != nil || magic != indexExportMagic {
+		return 0, 0, errNotIndexExport
+	}
+
+	mtimes := db.NewVirtualMtimeRepo(m.db, folder)
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	for {
+		var size uint32
+		if err := binary.Read(br, binary.BigEndian, &size); err == io.EOF {
+			break
+		} else if err != nil {
+			return imported, skipped, err
+		}
+		if size > maxIndexExportSize {
+			return imported, skipped, errNotIndexExport
+		}
+		bs := make([]byte, size)
+		if _, err := io.ReadFull(br, bs); err != nil {
+			return imported, skipped, err
+		}
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(bs); err != nil {
+			return imported, skipped, err
+		}
+
+		if _, ok := fs.Get(protocol.LocalDeviceID, f.Name); ok || !onDiskAsIndexed(cfg.Path(), mtimes, f) {
+			skipped++
+			continue
+		}
+		f.LocalVersion = 0
+		batch = append(batch, f)
+		imported++
+		if len(batch) == indexBatchSize {
+			m.updateLocals(folder, batch)
+			batch = make([]protocol.FileInfo, 0, indexBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		m.updateLocals(folder, batch)
+	}
+	return imported, skipped, nil
+}
+
+// onDiskAsIndexed returns whether the file is in the folder as the index
+// entry says: a regular file of the same size and modification time, a
+// directory, or nothing at all for a deleted file. Symlinks, hard links and
+// invalid files are left to scanning.
+func onDiskAsIndexed(dir string, mtimes *db.VirtualMtimeRepo, f protocol.FileInfo) bool {
+	name := filepath.Clean(osutil.NativeFilename(f.Name))
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+		return false
+	}
+	if f.IsInvalid() || f.IsSymlink() || db.IsHardLink(f) {
+		return false
+	}
+
+	info, err := os.Lstat(filepath.Join(dir, name))
+	switch {
+	case f.IsDeleted():
+		return os.IsNotExist(err)
+	case err != nil:
+		return false
+	case f.IsDirectory():
+		return info.IsDir()
+	default:
+		return info.Mode().IsRegular() && info.Size() == f.Size() &&
+			mtimes.GetMtime(name, info.ModTime()).Unix() == f.Modified
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestExportImportIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newModel := func(path string) *Model {
+		os.MkdirAll(path, 0755)
+		fcfg := config.FolderConfiguration{ID: "default", RawPath: path}
+		cfg := config.Wrap(path+".xml", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+		db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+		m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+		m.AddFolder(fcfg)
+		return m
+	}
+	src := newModel(filepath.Join(dir, "src"))
+	dst := newModel(filepath.Join(dir, "dst"))
+
+	// The files as copied to the destination; b has changed since.
+	mtime := time.Unix(1400000000, 0)
+	for name, data := range map[string]string{"a": "data of a", "b": "new data of b"} {
+		path := filepath.Join(dir, "dst", name)
+		ioutil.WriteFile(path, []byte(data), 0644)
+		os.Chtimes(path, mtime, mtime)
+	}
+	version := protocol.Vector{{ID: 42, Value: 3}}
+	file := func(name string, size int32, flags uint32) protocol.FileInfo {
+		return protocol.FileInfo{
+			Name:     name,
+			Flags:    flags,
+			Modified: mtime.Unix(),
+			Version:  version,
+			Blocks:   []protocol.BlockInfo{{Size: size, Hash: bytes.Repeat([]byte{1}, 32)}},
+		}
+	}
+	src.updateLocals("default", []protocol.FileInfo{
+		file("a", 9, 0644),
+		file("b", 9, 0644),
+		{Name: "c", Flags: protocol.FlagDeleted, Version: version},
+		file("../escaped", 9, 0644),
+	})
+
+	var buf bytes.Buffer
+	if err := src.ExportIndex("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+	imported, skipped, err := dst.ImportIndex("default", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 || skipped != 2 {
+		t.Errorf("Incorrect %d imported, %d skipped; expected 2 and 2", imported, skipped)
+	}
+	for name, expected := range map[string]bool{"a": true, "b": false, "c": true, "../escaped": false} {
+		f, ok := dst.CurrentFolderFile("default", name)
+		if ok != expected {
+			t.Errorf("File %q imported %v, expected %v", name, ok, expected)
+		}
+		if ok && !f.Version.Equal(version) {
+			t.Errorf("Incorrect version %v of imported %q", f.Version, name)
+		}
+	}
+
+	if _, _, err := dst.ImportIndex("default", bytes.NewReader([]byte("not an index"))); err != errNotIndexExport {
+		t.Errorf("Incorrect error %v importing garbage", err)
+	}
+}
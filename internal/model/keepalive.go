@@ -0,0 +1,138 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+const (
+	// How often a connection is checked for whether it needs a keepalive
+	// probe.
+	monitorInterval = time.Second
+	// A busy connection is probed anyway when its round trip time is older
+	// than this, to keep it current.
+	rttMaxAge = 5 * time.Minute
+	// The transfer rates are measured over this interval.
+	rateInterval = 5 * time.Second
+	// While activity is reduced, idle connections are probed at most this
+	// often and busy ones not at all.
+	reducedKeepAlive = 5 * time.Minute
+)
+
+// A monitoredConnection is a protocol connection that is kept alive by
+// probing the other device when nothing has been received from it for the
+// keepalive interval, and given up on when a probe isn't answered within the
+// ping timeout. The probes measure the round trip time, and the transfer
+// rates are measured along the way.
+//
+// The probe is a request with a negative offset, which devices answer with
+// an error straight away, without looking at the folder or file. The
+// protocol library pings connections that have been idle for a minute on
+// its own; probing more often than that keeps it from doing so.
+type monitoredConnection struct {
+	// Accessed atomically, first in the struct for alignment.
+	rtt     int64 // nanoseconds
+	inRate  int64 // bytes per second over the last rateInterval
+	outRate int64 // bytes per second over the last rateInterval
+
+	protocol.Connection
+	started time.Time
+	stop    chan struct{}
+}
+
+func newMonitoredConnection(conn protocol.Connection) *monitoredConnection {
+	return &monitoredConnection{
+		Connection: conn,
+		started:    time.Now(),
+		stop:       make(chan struct{}),
+	}
+}
+
+// keepaliveSettings returns the current keepalive interval and ping timeout,
+// and whether activity is reduced.
+type keepaliveSettings func() (interval, timeout time.Duration, reduced bool)
+
+// monitor keeps the connection alive until it's stopped, calling closeConn
+// when a probe isn't answered in time.
+func (c *monitoredConnection) monitor(settings keepaliveSettings, closeConn func(error)) {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+
+	rateStats := c.Statistics()
+	lastIn := rateStats.InBytesTotal
+	lastRecv := time.Now()
+	var rttAt time.Time
+
+	var answered chan time.Duration // while a probe is outstanding
+	var timeout <-chan time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case rtt := <-answered:
+			atomic.StoreInt64(&c.rtt, int64(rtt))
+			rttAt = time.Now()
+			answered, timeout = nil, nil
+			continue
+		case <-timeout:
+			closeConn(fmt.Errorf("keepalive probe timeout"))
+			return
+		case <-c.stop:
+			return
+		}
+
+		stats := c.Statistics()
+		if stats.InBytesTotal != lastIn {
+			lastIn, lastRecv = stats.InBytesTotal, stats.At
+		}
+		if d := stats.At.Sub(rateStats.At); d >= rateInterval {
+			atomic.StoreInt64(&c.inRate, (stats.InBytesTotal-rateStats.InBytesTotal)*int64(time.Second)/int64(d))
+			atomic.StoreInt64(&c.outRate, (stats.OutBytesTotal-rateStats.OutBytesTotal)*int64(time.Second)/int64(d))
+			rateStats = stats
+		}
+		if answered != nil {
+			continue
+		}
+		interval, pingTimeout, reduced := settings()
+		if reduced && interval < reducedKeepAlive {
+			interval = reducedKeepAlive
+		}
+		idle := time.Since(lastRecv) >= interval
+		rttOld := !reduced && time.Since(rttAt) >= rttMaxAge
+		if !idle && !rttOld {
+			continue
+		}
+
+		answered = make(chan time.Duration, 1)
+		timeout = time.After(pingTimeout)
+		go c.probe(answered)
+	}
+}
+
+// probe sends a probe and the round trip time on answered once it's
+// answered.
+func (c *monitoredConnection) probe(answered chan<- time.Duration) {
+	t0 := time.Now()
+	if _, err := c.Request("", "", -1, 0, nil, 0, nil); err == protocol.ErrClosed {
+		return
+	}
+	answered <- time.Since(t0)
+}
+
+// RTT returns the round trip time measured by the last probe, or zero.
+func (c *monitoredConnection) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Rates returns the recent receive and send rates, in bytes per second.
+func (c *monitoredConnection) Rates() (in, out int64) {
+	return atomic.LoadInt64(&c.inRate), atomic.LoadInt64(&c.outRate)
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+// A probeConn answers requests after the given delay, or never if it's
+// negative.
+type probeConn struct {
+	FakeConnection
+	delay   time.Duration
+	offsets chan int64
+}
+
+func (c *probeConn) Request(folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
+	c.offsets <- offset
+	if c.delay < 0 {
+		select {}
+	}
+	time.Sleep(c.delay)
+	return nil, protocol.ErrNoSuchFile
+}
+
+func TestKeepaliveProbe(t *testing.T) {
+	conn := &probeConn{delay: 10 * time.Millisecond, offsets: make(chan int64, 10)}
+	mc := newMonitoredConnection(conn)
+	settings := func() (time.Duration, time.Duration, bool) { return time.Millisecond, time.Minute, false }
+	go mc.monitor(settings, func(err error) { t.Error("Connection closed:", err) })
+	defer close(mc.stop)
+
+	select {
+	case offset := <-conn.offsets:
+		if offset >= 0 {
+			t.Errorf("Probe with offset %d, should be negative", offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle connection not probed")
+	}
+
+	for i := 0; mc.RTT() == 0; i++ {
+		if i == 50 {
+			t.Fatal("Round trip time not measured")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if rtt := mc.RTT(); rtt < 10*time.Millisecond {
+		t.Errorf("Incorrect round trip time %v", rtt)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	conn := &probeConn{delay: -1, offsets: make(chan int64, 10)}
+	mc := newMonitoredConnection(conn)
+	settings := func() (time.Duration, time.Duration, bool) { return time.Millisecond, 10 * time.Millisecond, false }
+	closed := make(chan error, 1)
+	go mc.monitor(settings, func(err error) { closed <- err })
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not closed after unanswered probe")
+	}
+}
+
+func TestKeepaliveReduced(t *testing.T) {
+	conn := &probeConn{offsets: make(chan int64, 10)}
+	mc := newMonitoredConnection(conn)
+	settings := func() (time.Duration, time.Duration, bool) { return time.Millisecond, time.Minute, true }
+	go mc.monitor(settings, func(err error) { t.Error("Connection closed:", err) })
+	defer close(mc.stop)
+
+	// The connection was just made, so it's not idle for the reduced
+	// keepalive interval yet, and the round trip time isn't refreshed.
+
+	select {
+	case <-conn.offsets:
+		t.Error("Connection probed with reduced activity")
+	case <-time.After(3 * monitorInterval):
+	}
+}
@@ -8,6 +8,7 @@ package model
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -19,6 +20,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	stdsync "sync"
 	"time"
@@ -48,11 +51,17 @@ const (
 	reqValidationCacheSize = 1000       // How many entries to aim for in the validation cache size
 )
 
+// How long to wait for the cluster config from a device before sending it
+// indexes anyway.
+const clusterConfigTimeout = time.Minute
+
 type service interface {
 	Serve()
 	Stop()
 	Jobs() ([]string, []string) // In progress, Queued
+	FailedItems() []FailedItem
 	BringToFront(string)
+	PullNow(string)
 	DelayScan(d time.Duration)
 	IndexUpdated() // Remote index was updated notification
 
@@ -60,6 +69,7 @@ type service interface {
 	setError(err error)
 	clearError()
 	getState() (folderState, time.Time, error)
+	lastScanDuration() time.Duration
 }
 
 type Model struct {
@@ -84,24 +94,59 @@ type Model struct {
 	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
 	folderRunners  map[string]service                                     // folder -> puller or scanner
 	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
+	folderLimits   map[string]folderLimiter                               // folder -> rate limits
+	reduced        bool                                                   // activity is reduced, on battery or a metered network
+	quotaExceeded  map[string]bool                                        // folder -> quota exceeded
 	fmut           sync.RWMutex                                           // protects the above
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn    map[protocol.DeviceID]protocol.Connection
+	rawConn      map[protocol.DeviceID]io.Closer
+	deviceVer    map[protocol.DeviceID]string
+	deviceFlags  map[protocol.DeviceID]uint32               // deviceID -> FileInfo flags it understands
+	deviceDelta  map[protocol.DeviceID]bool                 // deviceID -> serves sub block hashes
+	deviceCompr  map[protocol.DeviceID]protocol.Compression // deviceID -> the compression it is configured to use with us
+	connCompr    map[protocol.DeviceID]protocol.Compression // deviceID -> the compression used on the current connection
+	deviceCCRcvd map[protocol.DeviceID]chan struct{}        // deviceID -> closed when the cluster config is received
+	remoteState  map[protocol.DeviceID]map[string]string    // deviceID -> folder -> state announced by the device
+	extraConns   map[protocol.DeviceID][]*extraConn         // deviceID -> connections in addition to protoConn
+	connTurn     int                                        // spreads requests over the connections
+	pmut         sync.RWMutex                               // protects the above
 
 	addedFolder bool
 	started     bool
+	addrBook    AddressBook
 
 	reqValidationCache map[string]time.Time // folder / file name => time when confirmed to exist
 	rvmut              sync.RWMutex         // protects reqValidationCache
 }
 
 var (
-	SymlinkWarning = stdsync.Once{}
+	SymlinkWarning   = stdsync.Once{}
+	errQuietHours    = errors.New("quiet hours")
+	errFolderMissing = errors.New("no such folder")
+)
+
+// A folder that we don't sync at the moment has its state announced in the
+// cluster config, so that the other devices can tell why their completion
+// doesn't progress.
+const (
+	folderStateOption = "state"
+	folderStatePaused = "paused"
+	folderStateError  = "error"
 )
 
+// The addresses we know for a device are passed in the cluster config to the
+// other devices sharing a folder with it, so that they can reach it even when
+// discovery doesn't work for them. The value is a comma separated list.
+const deviceAddrsOption = "addresses"
+
+// An AddressBook knows the addresses of devices without looking them up,
+// and takes hints about them.
+type AddressBook interface {
+	Known(device protocol.DeviceID) []string
+	Hint(device string, addrs []string)
+}
+
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local folder in any way.
@@ -109,7 +154,7 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 	m := &Model{
 		Supervisor: suture.New("model", suture.Spec{
 			Log: func(line string) {
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(line)
 				}
 			},
@@ -124,6 +169,7 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		clientName:         clientName,
 		clientVersion:      clientVersion,
 		folderCfgs:         make(map[string]config.FolderConfiguration),
+		quotaExceeded:      make(map[string]bool),
 		folderFiles:        make(map[string]*db.FileSet),
 		folderDevices:      make(map[string][]protocol.DeviceID),
 		deviceFolders:      make(map[protocol.DeviceID][]string),
@@ -131,9 +177,17 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		folderIgnores:      make(map[string]*ignore.Matcher),
 		folderRunners:      make(map[string]service),
 		folderStatRefs:     make(map[string]*stats.FolderStatisticsReference),
+		folderLimits:       make(map[string]folderLimiter),
 		protoConn:          make(map[protocol.DeviceID]protocol.Connection),
 		rawConn:            make(map[protocol.DeviceID]io.Closer),
 		deviceVer:          make(map[protocol.DeviceID]string),
+		deviceFlags:        make(map[protocol.DeviceID]uint32),
+		deviceDelta:        make(map[protocol.DeviceID]bool),
+		deviceCompr:        make(map[protocol.DeviceID]protocol.Compression),
+		connCompr:          make(map[protocol.DeviceID]protocol.Compression),
+		extraConns:         make(map[protocol.DeviceID][]*extraConn),
+		deviceCCRcvd:       make(map[protocol.DeviceID]chan struct{}),
+		remoteState:        make(map[protocol.DeviceID]map[string]string),
 		reqValidationCache: make(map[string]time.Time),
 
 		fmut:  sync.NewRWMutex(),
@@ -217,16 +271,71 @@ type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
 	ClientVersion string
+	Compression   protocol.Compression
+	Connections   int
+	StartedAt     time.Time
+	InBytesRate   int64         // per second, recently
+	OutBytesRate  int64         // per second, recently
+	RTT           time.Duration // zero until measured
+	Crypto        string
+	Type          string // set by the connection service
 }
 
 func (info ConnectionInfo) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
+	res := map[string]interface{}{
 		"at":            info.At,
 		"inBytesTotal":  info.InBytesTotal,
 		"outBytesTotal": info.OutBytesTotal,
 		"address":       info.Address,
 		"clientVersion": info.ClientVersion,
-	})
+		"compression":   info.Compression,
+		"connections":   info.Connections,
+	}
+	if !info.StartedAt.IsZero() {
+		// The statistics of a single connection, not the totals.
+		secs := info.At.Sub(info.StartedAt).Seconds()
+		res["startedAt"] = info.StartedAt
+		res["inBytesRate"] = info.InBytesRate
+		res["outBytesRate"] = info.OutBytesRate
+		if secs > 0 {
+			res["inBytesAvgRate"] = int64(float64(info.InBytesTotal) / secs)
+			res["outBytesAvgRate"] = int64(float64(info.OutBytesTotal) / secs)
+		}
+		res["rttMs"] = float64(info.RTT) / float64(time.Millisecond)
+		res["crypto"] = info.Crypto
+		res["type"] = info.Type
+	}
+	return json.Marshal(res)
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+}
+
+// The cipher suites we configure.
+var tlsCipherSuiteNames = map[uint16]string{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "ECDHE-RSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "ECDHE-ECDSA-AES128-GCM-SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "ECDHE-RSA-AES128-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "ECDHE-ECDSA-AES128-SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "ECDHE-RSA-AES256-SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "ECDHE-ECDSA-AES256-SHA",
+}
+
+// cryptoDescription describes the protocol version and cipher suite of the
+// TLS connection, e.g. "TLS1.2-ECDHE-RSA-AES128-GCM-SHA256".
+func cryptoDescription(state tls.ConnectionState) string {
+	version, ok := tlsVersionNames[state.Version]
+	if !ok {
+		version = fmt.Sprintf("TLS-0x%04x", state.Version)
+	}
+	suite, ok := tlsCipherSuiteNames[state.CipherSuite]
+	if !ok {
+		suite = fmt.Sprintf("0x%04x", state.CipherSuite)
+	}
+	return version + "-" + suite
 }
 
 // ConnectionStats returns a map with connection statistics for each connected device.
@@ -244,10 +353,20 @@ func (m *Model) ConnectionStats() map[string]interface{} {
 		ci := ConnectionInfo{
 			Statistics:    conn.Statistics(),
 			ClientVersion: m.deviceVer[device],
+			Compression:   m.connCompr[device],
+			Connections:   len(m.extraConns[device]) + 1,
 		}
 		if nc, ok := m.rawConn[device].(remoteAddrer); ok {
 			ci.Address = nc.RemoteAddr().String()
 		}
+		if tc, ok := m.rawConn[device].(*tls.Conn); ok {
+			ci.Crypto = cryptoDescription(tc.ConnectionState())
+		}
+		if mc, ok := conn.(*monitoredConnection); ok {
+			ci.StartedAt = mc.started
+			ci.InBytesRate, ci.OutBytesRate = mc.Rates()
+			ci.RTT = mc.RTT()
+		}
 
 		conns[device.String()] = ci
 	}
@@ -294,13 +413,21 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 
 	m.fmut.RLock()
 	rf, ok := m.folderFiles[folder]
+	folderCfg := m.folderCfgs[folder]
 	m.fmut.RUnlock()
 	if !ok {
 		return 0 // Folder doesn't exist, so we hardly have any of it
 	}
 
+	// Only the parts of the folder we sync count towards our own
+	// completion.
+	selected := func(string) bool { return true }
+	if device == protocol.LocalDeviceID {
+		selected = folderCfg.IsSelected
+	}
+
 	rf.WithGlobalTruncated(func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
+		if !f.IsDeleted() && selected(f.(db.FileInfoTruncated).Name) {
 			tot += f.Size()
 		}
 		return true
@@ -312,14 +439,14 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 
 	var need int64
 	rf.WithNeedTruncated(device, func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
+		if !f.IsDeleted() && selected(f.(db.FileInfoTruncated).Name) {
 			need += f.Size()
 		}
 		return true
 	})
 
 	res := 100 * (1 - float64(need)/float64(tot))
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%v Completion(%s, %q): %f (%d / %d)", m, device, folder, res, need, tot)
 	}
 
@@ -388,7 +515,11 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
+		selected := m.folderCfgs[folder].IsSelected
 		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
+			if !selected(f.(db.FileInfoTruncated).Name) {
+				return true
+			}
 			fs, de, by := sizeOfFile(f)
 			nfiles += fs + de
 			bytes += by
@@ -396,7 +527,7 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 		})
 	}
 	bytes -= m.progressEmitter.BytesCompleted(folder)
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%v NeedSize(%q): %d %d", m, folder, nfiles, bytes)
 	}
 	return
@@ -405,7 +536,12 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 // NeedFolderFiles returns paginated list of currently needed files in
 // progress, queued, and to be queued on next puller iteration, as well as the
 // total number of files currently needed.
-func (m *Model) NeedFolderFiles(folder string, page, perpage int) ([]db.FileInfoTruncated, []db.FileInfoTruncated, []db.FileInfoTruncated, int) {
+// NeedFolderFiles returns a page of the files we need of the folder, in
+// three parts: the files being pulled, the files queued for pulling, and
+// the rest, and how many files are needed in total. With a filter, only
+// the files with matching names are returned; see nameMatcher. The rest is
+// in the given order, or in alphabetic order for random.
+func (m *Model) NeedFolderFiles(folder string, page, perpage int, filter string, order config.PullOrder) ([]db.FileInfoTruncated, []db.FileInfoTruncated, []db.FileInfoTruncated, int) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 
@@ -422,9 +558,18 @@ func (m *Model) NeedFolderFiles(folder string, page, perpage int) ([]db.FileInfo
 	skip := (page - 1) * perpage
 	get := perpage
 
+	matches := func(string) bool { return true }
+	if filter != "" {
+		matches = nameMatcher(filter)
+	}
+
 	runner, ok := m.folderRunners[folder]
 	if ok {
 		allProgressNames, allQueuedNames := runner.Jobs()
+		if filter != "" {
+			allProgressNames = filterNames(allProgressNames, matches)
+			allQueuedNames = filterNames(allQueuedNames, matches)
+		}
 
 		var progressNames, queuedNames []string
 		progressNames, skip, get = getChunk(allProgressNames, skip, get)
@@ -449,9 +594,21 @@ func (m *Model) NeedFolderFiles(folder string, page, perpage int) ([]db.FileInfo
 		}
 	}
 
-	rest = make([]db.FileInfoTruncated, 0, perpage)
+	selected := m.folderCfgs[folder].IsSelected
+	sorted := order != config.OrderRandom && order != config.OrderAlphabetic
 	rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
+		if name := f.(db.FileInfoTruncated).Name; !selected(name) || !matches(name) {
+			return true
+		}
 		total++
+		if sorted {
+			// Paged once all are sorted.
+			ft := f.(db.FileInfoTruncated)
+			if _, ok := seen[ft.Name]; !ok {
+				rest = append(rest, ft)
+			}
+			return true
+		}
 		if skip > 0 {
 			skip--
 			return true
@@ -466,9 +623,204 @@ func (m *Model) NeedFolderFiles(folder string, page, perpage int) ([]db.FileInfo
 		return true
 	})
 
+	if sorted {
+		sort.Stable(filesByOrder{rest, order})
+		if skip >= len(rest) {
+			rest = nil
+		} else {
+			rest = rest[skip:]
+		}
+		if len(rest) > get {
+			rest = rest[:get]
+		}
+	}
+
 	return progress, queued, rest, total
 }
 
+func filterNames(names []string, matches func(string) bool) []string {
+	var res []string
+	for _, name := range names {
+		if matches(name) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// filesByOrder sorts files in a pull order other than random or alphabetic.
+type filesByOrder struct {
+	files []db.FileInfoTruncated
+	order config.PullOrder
+}
+
+func (s filesByOrder) Len() int      { return len(s.files) }
+func (s filesByOrder) Swap(a, b int) { s.files[a], s.files[b] = s.files[b], s.files[a] }
+func (s filesByOrder) Less(a, b int) bool {
+	fa, fb := s.files[a], s.files[b]
+	switch s.order {
+	case config.OrderSmallestFirst:
+		return fa.Size() < fb.Size()
+	case config.OrderLargestFirst:
+		return fa.Size() > fb.Size()
+	case config.OrderOldestFirst:
+		return fa.Modified < fb.Modified
+	case config.OrderNewestFirst:
+		return fa.Modified > fb.Modified
+	}
+	return fa.Name < fb.Name
+}
+
+// A RemoteNeededFile is a file a remote device needs, with how much of the
+// needed version it already has.
+type RemoteNeededFile struct {
+	db.FileInfoTruncated
+	Completion float64 // percent
+}
+
+// RemoteNeedFiles returns a page of the files the device needs of the
+// folder, and how many it needs in total.
+func (m *Model) RemoteNeedFiles(device protocol.DeviceID, folder string, page, perpage int) ([]RemoteNeededFile, int) {
+	m.fmut.RLock()
+	rf, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, 0
+	}
+
+	var files []RemoteNeededFile
+	total := 0
+	skip := (page - 1) * perpage
+	rf.WithNeedTruncated(device, func(f db.FileIntf) bool {
+		total++
+		if total > skip && len(files) < perpage {
+			files = append(files, RemoteNeededFile{FileInfoTruncated: f.(db.FileInfoTruncated)})
+		}
+		return true
+	})
+
+	// Only for the page, as this means reading the blocks of each file.
+	for i := range files {
+		global, _ := rf.GetGlobal(files[i].Name)
+		have, _ := rf.Get(device, files[i].Name)
+		files[i].Completion = blockCompletion(have.Blocks, global)
+	}
+	return files, total
+}
+
+// RemoteHaveFiles returns a page of the files of the folder in the index of
+// the device, and how many there are in total.
+func (m *Model) RemoteHaveFiles(device protocol.DeviceID, folder string, page, perpage int) ([]db.FileInfoTruncated, int) {
+	m.fmut.RLock()
+	rf, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, 0
+	}
+
+	var files []db.FileInfoTruncated
+	total := 0
+	skip := (page - 1) * perpage
+	rf.WithHaveTruncated(device, func(f db.FileIntf) bool {
+		total++
+		if total > skip && len(files) < perpage {
+			files = append(files, f.(db.FileInfoTruncated))
+		}
+		return true
+	})
+	return files, total
+}
+
+// A FoundFile is a file matching a search, and the folder it's in.
+type FoundFile struct {
+	db.FileInfoTruncated
+	Folder string
+}
+
+// SearchFiles returns a page of the files in the global index whose name
+// matches the query, and how many match in total; see nameMatcher. All
+// folders are searched when folder is empty.
+func (m *Model) SearchFiles(folder, query string, page, perpage int) ([]FoundFile, int) {
+	m.fmut.RLock()
+	var folders []string
+	for id := range m.folderFiles {
+		if folder == "" || id == folder {
+			folders = append(folders, id)
+		}
+	}
+	m.fmut.RUnlock()
+	sort.Strings(folders)
+
+	match := nameMatcher(query)
+	var files []FoundFile
+	total := 0
+	skip := (page - 1) * perpage
+	for _, id := range folders {
+		m.fmut.RLock()
+		rf, ok := m.folderFiles[id]
+		m.fmut.RUnlock()
+		if !ok {
+			continue
+		}
+
+		rf.WithGlobalTruncated(func(fi db.FileIntf) bool {
+			f := fi.(db.FileInfoTruncated)
+			if f.IsDeleted() || f.IsInvalid() || !match(f.Name) {
+				return true
+			}
+			total++
+			if total > skip && len(files) < perpage {
+				files = append(files, FoundFile{f, id})
+			}
+			return true
+		})
+	}
+	return files, total
+}
+
+// nameMatcher returns a function telling whether a file name matches the
+// query. A query containing glob wildcards is matched against the whole
+// name and against the last element of it; any other query is a case
+// insensitive substring.
+func nameMatcher(query string) func(name string) bool {
+	query = osutil.NativeFilename(query)
+	if strings.ContainsAny(query, "*?[") {
+		return func(name string) bool {
+			ok, _ := filepath.Match(query, name)
+			if !ok {
+				ok, _ = filepath.Match(query, filepath.Base(name))
+			}
+			return ok
+		}
+	}
+	query = strings.ToLower(query)
+	return func(name string) bool {
+		return strings.Contains(strings.ToLower(name), query)
+	}
+}
+
+// blockCompletion returns the percentage of the file that is covered by
+// the given blocks, which is what a device having them doesn't need to
+// transfer.
+func blockCompletion(have []protocol.BlockInfo, file protocol.FileInfo) float64 {
+	size := file.Size()
+	if file.IsDeleted() || size == 0 {
+		return 0
+	}
+
+	hashes := make(map[string]struct{}, len(have))
+	for _, b := range have {
+		hashes[string(b.Hash)] = struct{}{}
+	}
+	var done int64
+	for _, b := range file.Blocks {
+		if _, ok := hashes[string(b.Hash)]; ok {
+			done += int64(b.Size)
+		}
+	}
+	return 100 * float64(done) / float64(size)
+}
+
 // Index is called when a new device is connected and we receive their full index.
 // Implements the protocol.Model interface.
 func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) {
@@ -477,14 +829,15 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		return
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("IDX(in): %s %q: %d files", deviceID, folder, len(fs))
 	}
 
 	if !m.folderSharedWith(folder, deviceID) {
 		events.Default.Log(events.FolderRejected, map[string]string{
-			"folder": folder,
-			"device": deviceID.String(),
+			"folder":      folder,
+			"device":      deviceID.String(),
+			"defaultPath": m.cfg.Options().DefaultFolderPathFor(folder, m.cfg.Devices()[deviceID]),
 		})
 		l.Infof("Unexpected folder ID %q sent from device %q; ensure that the folder exists and that this device is selected under \"Share With\" in the folder configuration.", folder, deviceID)
 		return
@@ -506,14 +859,14 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 	}
 
 	for i := 0; i < len(fs); {
-		if fs[i].Flags&^protocol.FlagsAll != 0 {
-			if debug {
+		if fs[i].Flags&^db.FlagsAll != 0 {
+			if debug.Enabled() {
 				l.Debugln("dropping update for file with unknown bits set", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
 		} else if symlinkInvalid(fs[i].IsSymlink()) {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("dropping update for unsupported symlink", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
@@ -541,7 +894,7 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 		return
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%v IDXUP(in): %s / %q: %d files", m, deviceID, folder, len(fs))
 	}
 
@@ -560,14 +913,14 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	}
 
 	for i := 0; i < len(fs); {
-		if fs[i].Flags&^protocol.FlagsAll != 0 {
-			if debug {
+		if fs[i].Flags&^db.FlagsAll != 0 {
+			if debug.Enabled() {
 				l.Debugln("dropping update for file with unknown bits set", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
 		} else if symlinkInvalid(fs[i].IsSymlink()) {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("dropping update for unsupported symlink", fs[i])
 			}
 			fs[i] = fs[len(fs)-1]
@@ -608,6 +961,47 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		m.deviceVer[deviceID] = cm.ClientName + " " + cm.ClientVersion
 	}
 
+	// Devices that don't tell us which flags they understand only know
+	// about those in the protocol.
+	m.deviceFlags[deviceID] = protocol.FlagsAll
+	if flags, err := strconv.ParseUint(cm.GetOption("flags"), 16, 32); err == nil {
+		m.deviceFlags[deviceID] = uint32(flags)
+	}
+	m.deviceDelta[deviceID] = cm.GetOption(subBlockHashesOption) != ""
+	m.remoteState[deviceID] = remoteFolderStates(cm)
+
+	// The compression is negotiated down to the least that either of us is
+	// configured for, and to none if we have no algorithm in common. The
+	// device's wish is only known now, so if we already use more on this
+	// connection we reconnect to use the negotiated one.
+	var compr protocol.Compression
+	known := false
+	if opt := cm.GetOption("compression"); opt != "" {
+		compr.UnmarshalText([]byte(opt))
+		known = true
+	}
+	if opt := cm.GetOption(compressionAlgorithmsOption); opt != "" && commonCompressionAlgorithm(opt) == "" {
+		compr, known = protocol.CompressNever, true
+	}
+	if known {
+		m.deviceCompr[deviceID] = compr
+		if used, ok := m.connCompr[deviceID]; ok && used != m.negotiatedCompressionLocked(deviceID) {
+			l.Infof("Device %s is configured for compression %q; reconnecting to use it", deviceID, compr)
+			m.closeRawConnLocked(deviceID)
+		}
+	}
+	// The cluster config is sent again when the state of a folder changes.
+	// That's not a new connection.
+	update := false
+	if ch, ok := m.deviceCCRcvd[deviceID]; ok {
+		select {
+		case <-ch:
+			update = true
+		default:
+			close(ch)
+		}
+	}
+
 	event := map[string]string{
 		"id":            deviceID.String(),
 		"clientName":    cm.ClientName,
@@ -620,9 +1014,10 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 	m.pmut.Unlock()
 
-	events.Default.Log(events.DeviceConnected, event)
-
-	l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
+	if !update {
+		events.Default.Log(events.DeviceConnected, event)
+		l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
+	}
 
 	var changed bool
 
@@ -636,7 +1031,7 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		}
 	}
 
-	if m.cfg.Devices()[deviceID].Introducer {
+	if introducer := m.cfg.Devices()[deviceID]; introducer.Introducer {
 		// This device is an introducer. Go through the announced lists of folders
 		// and devices and add what we are missing.
 
@@ -658,9 +1053,10 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 					l.Infof("Adding device %v to config (vouched for by introducer %v)", id, deviceID)
 					newDeviceCfg := config.DeviceConfiguration{
-						DeviceID:    id,
-						Compression: m.cfg.Devices()[deviceID].Compression,
-						Addresses:   []string{"dynamic"},
+						DeviceID:     id,
+						Compression:  introducer.Compression,
+						Addresses:    []string{"dynamic"},
+						IntroducedBy: deviceID.String(),
 					}
 
 					// The introducers' introducers are also our introducers.
@@ -691,18 +1087,228 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 				folderCfg := m.cfg.Folders()[folder.ID]
 				folderCfg.Devices = append(folderCfg.Devices, config.FolderDeviceConfiguration{
-					DeviceID: id,
+					DeviceID:     id,
+					IntroducedBy: deviceID.String(),
 				})
 				m.cfg.SetFolder(folderCfg)
 
 				changed = true
 			}
 		}
+
+		if introducer.RemoveIntroduced && m.removeUnintroduced(deviceID, cm) {
+			changed = true
+		}
+	}
+
+	if device := m.cfg.Devices()[deviceID]; device.AutoAcceptFolders {
+		for _, folder := range cm.Folders {
+			if m.autoAcceptFolder(device, folder.ID) {
+				changed = true
+			}
+		}
 	}
 
 	if changed {
 		m.cfg.Save()
 	}
+
+	m.takeAddressHints(deviceID, cm)
+}
+
+// removeUnintroduced stops sharing folders with the devices the introducer
+// added to them, once it no longer shares the folders with those devices
+// itself, and removes the devices it added that share nothing with us
+// anymore. Devices and shares added by hand are left alone. It's only done
+// for introducers configured with removeIntroduced.
+func (m *Model) removeUnintroduced(introducer protocol.DeviceID, cm protocol.ClusterConfigMessage) bool {
+	announced := make(map[string]map[protocol.DeviceID]bool, len(cm.Folders))
+	for _, folder := range cm.Folders {
+		devices := make(map[protocol.DeviceID]bool, len(folder.Devices))
+		for _, device := range folder.Devices {
+			var id protocol.DeviceID
+			copy(id[:], device.ID)
+			devices[id] = true
+		}
+		announced[folder.ID] = devices
+	}
+
+	changed := false
+	shared := make(map[protocol.DeviceID]bool)
+	for _, folderCfg := range m.cfg.Folders() {
+		sharedWithIntroducer := false
+		for _, device := range folderCfg.Devices {
+			if device.DeviceID == introducer {
+				sharedWithIntroducer = true
+			}
+		}
+
+		devices := make([]config.FolderDeviceConfiguration, 0, len(folderCfg.Devices))
+		for _, device := range folderCfg.Devices {
+			if sharedWithIntroducer && device.IntroducedBy == introducer.String() && !announced[folderCfg.ID][device.DeviceID] {
+				l.Infof("Unsharing folder %q with device %v (no longer shared by introducer %v)", folderCfg.ID, device.DeviceID, introducer)
+				m.unshareFolder(folderCfg.ID, device.DeviceID)
+				continue
+			}
+			devices = append(devices, device)
+			shared[device.DeviceID] = true
+		}
+		if len(devices) != len(folderCfg.Devices) {
+			folderCfg.Devices = devices
+			m.cfg.SetFolder(folderCfg)
+			changed = true
+		}
+	}
+
+	for id, device := range m.cfg.Devices() {
+		if device.IntroducedBy == introducer.String() && !shared[id] {
+			l.Infof("Removing device %v from config (no longer shared by introducer %v)", id, introducer)
+			m.cfg.RemoveDevice(id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// unshareFolder stops sharing the folder with the device.
+func (m *Model) unshareFolder(folder string, device protocol.DeviceID) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	devices := m.folderDevices[folder][:0:0]
+	for _, id := range m.folderDevices[folder] {
+		if id != device {
+			devices = append(devices, id)
+		}
+	}
+	m.folderDevices[folder] = devices
+
+	folders := m.deviceFolders[device][:0:0]
+	for _, id := range m.deviceFolders[device] {
+		if id != folder {
+			folders = append(folders, id)
+		}
+	}
+	m.deviceFolders[device] = folders
+}
+
+// autoAcceptFolder adds the folder offered by the device to the
+// configuration, under the default folder path and shared with the device,
+// unless we have it already or the folders are locked, and starts it.
+func (m *Model) autoAcceptFolder(device config.DeviceConfiguration, folder string) bool {
+	if _, ok := m.cfg.Folders()[folder]; ok {
+		return false
+	}
+	if m.cfg.GUI().IsLocked("folders") {
+		l.Infof("Not accepting folder %q from device %v; the folders are locked", folder, device.DeviceID)
+		return false
+	}
+	path := m.cfg.Options().DefaultFolderPathFor(folder, device)
+	if path == "" {
+		l.Infof("Not accepting folder %q from device %v; there is no default folder path", folder, device.DeviceID)
+		return false
+	}
+
+	l.Infof("Adding folder %q at %q (offered by device %v)", folder, path, device.DeviceID)
+	resp := m.cfg.SetFolder(config.FolderConfiguration{
+		ID:              folder,
+		RawPath:         path,
+		RescanIntervalS: 60,
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: m.id},
+			{DeviceID: device.DeviceID},
+		},
+	})
+	if resp.ValidationError != nil {
+		l.Warnf("Adding folder %q: %v", folder, resp.ValidationError)
+		return false
+	}
+
+	// The commit asks for a restart, as for any added folder; instead the
+	// folder is started here and the devices are told about it.
+	fcfg := m.cfg.Folders()[folder]
+	if err := osutil.MkdirAll(fcfg.Path(), 0700); err != nil {
+		l.Warnf("Creating folder %q: %v", folder, err)
+	} else if err := fcfg.CreateMarker(); err != nil {
+		l.Warnf("Creating folder marker for %q: %v", folder, err)
+	}
+	m.AddFolder(fcfg)
+	m.StartFolderRW(folder)
+	m.sendClusterConfigs()
+	return true
+}
+
+// SetAddressBook sets where the addresses of devices passed on to other
+// devices come from, and where those we are told about go. It must be set
+// before any connections are added.
+func (m *Model) SetAddressBook(ab AddressBook) {
+	m.addrBook = ab
+}
+
+// knownAddresses returns the comma separated addresses to pass on for the
+// device: the static ones it's configured with, and those in the address
+// book.
+func (m *Model) knownAddresses(device protocol.DeviceID) string {
+	var addrs []string
+	for _, addr := range m.cfg.Devices()[device].Addresses {
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if m.addrBook != nil {
+		addrs = append(addrs, m.addrBook.Known(device)...)
+	}
+
+	// Option values are limited to 1024 bytes.
+	res := ""
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] || len(res)+len(addr)+1 > 1024 {
+			continue
+		}
+		seen[addr] = true
+		if res != "" {
+			res += ","
+		}
+		res += addr
+	}
+	return res
+}
+
+// takeAddressHints passes the addresses the device tells us for the devices
+// we share folders with both it and them on to the address book.
+func (m *Model) takeAddressHints(from protocol.DeviceID, cm protocol.ClusterConfigMessage) {
+	if m.addrBook == nil {
+		return
+	}
+
+	hints := make(map[protocol.DeviceID][]string)
+	for _, folder := range cm.Folders {
+		if !m.folderSharedWith(folder.ID, from) {
+			continue
+		}
+		for _, device := range folder.Devices {
+			if len(device.ID) != len(protocol.DeviceID{}) {
+				continue
+			}
+			id := protocol.DeviceIDFromBytes(device.ID)
+			if id == m.id || id == from || !m.folderSharedWith(folder.ID, id) {
+				continue
+			}
+			for _, opt := range device.Options {
+				if opt.Key == deviceAddrsOption && opt.Value != "" {
+					hints[id] = append(hints[id], strings.Split(opt.Value, ",")...)
+				}
+			}
+		}
+	}
+
+	for id, addrs := range hints {
+		if debug.Enabled() {
+			l.Debugf("%v addresses for %s from %s: %v", m, id, from, addrs)
+		}
+		m.addrBook.Hint(id.String(), addrs)
+	}
 }
 
 // Close removes the peer from the model and closes the underlying connection if possible.
@@ -721,21 +1327,30 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 	}
 	m.fmut.RUnlock()
 
-	conn, ok := m.rawConn[device]
-	if ok {
-		if conn, ok := conn.(*tls.Conn); ok {
-			// If the underlying connection is a *tls.Conn, Close() does more
-			// than it says on the tin. Specifically, it sends a TLS alert
-			// message, which might block forever if the connection is dead
-			// and we don't have a deadline site.
-			conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
-		}
-		conn.Close()
+	m.closeRawConnLocked(device)
+	m.closeExtraConnsLocked(device)
+	if mc, ok := m.protoConn[device].(*monitoredConnection); ok {
+		close(mc.stop)
 	}
 	delete(m.protoConn, device)
 	delete(m.rawConn, device)
 	delete(m.deviceVer, device)
+	delete(m.deviceFlags, device)
+	delete(m.deviceDelta, device)
+	delete(m.connCompr, device)
+	if ch, ok := m.deviceCCRcvd[device]; ok {
+		// Release anyone still waiting for the cluster config.
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+		delete(m.deviceCCRcvd, device)
+	}
+	delete(m.remoteState, device)
 	m.pmut.Unlock()
+
+	m.deviceStatRef(device).SaveTraffic()
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -750,11 +1365,20 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, protocol.ErrNoSuchFile
 	}
 
+	if m.InQuietHours(folder) {
+		return nil, errQuietHours
+	}
+
 	if flags != 0 {
 		// We don't currently support or expect any flags.
 		return nil, fmt.Errorf("protocol error: unknown flags 0x%x in Request message", flags)
 	}
 
+	subSize, err := requestedSubBlockSize(options)
+	if err != nil {
+		return nil, err
+	}
+
 	// Verify that the requested file exists in the local model. We only need
 	// to validate this file if we haven't done so recently, so we keep a
 	// cache of successfull results. "Recently" can be quite a long time, as
@@ -786,14 +1410,14 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		}
 
 		if lf.IsInvalid() || lf.IsDeleted() {
-			if debug {
+			if debug.Enabled() {
 				l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d; invalid: %v", m, deviceID, folder, name, offset, size, lf)
 			}
 			return nil, protocol.ErrInvalid
 		}
 
 		if offset > lf.Size() {
-			if debug {
+			if debug.Enabled() {
 				l.Debugf("%v REQ(in; nonexistent): %s: %q o=%d s=%d", m, deviceID, name, offset, size)
 			}
 			return nil, protocol.ErrNoSuchFile
@@ -812,15 +1436,21 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		m.rvmut.Unlock()
 	}
 
-	if debug && deviceID != protocol.LocalDeviceID {
+	if debug.Enabled() && deviceID != protocol.LocalDeviceID {
 		l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
 	}
 	m.fmut.RLock()
 	fn := filepath.Join(m.folderCfgs[folder].Path(), name)
+	limiter := m.folderLimits[folder]
 	m.fmut.RUnlock()
 
+	if subSize == 0 {
+		limiter.waitSend(size)
+	} else {
+		limiter.waitSend((size + subSize - 1) / subSize * sha256.Size)
+	}
+
 	var reader io.ReaderAt
-	var err error
 	if info, err := os.Lstat(fn); err == nil && info.Mode()&os.ModeSymlink != 0 {
 		target, _, err := symlinks.Read(fn)
 		if err != nil {
@@ -844,9 +1474,83 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, err
 	}
 
+	if subSize > 0 {
+		// The peer has an older version of the block and wants to know
+		// which parts of it changed.
+		buf = subBlockHashes(buf, subSize)
+	}
+
+	m.transferred(deviceID, folder, 0, len(buf))
 	return buf, nil
 }
 
+// NegotiateCompression returns the compression to use on a new connection to
+// the device; the least of what we and the device are configured for, as far
+// as we know. The choice is remembered, and the connection closed to be
+// reestablished should the device turn out to be configured for less.
+func (m *Model) NegotiateCompression(deviceID protocol.DeviceID) protocol.Compression {
+	m.pmut.Lock()
+	defer m.pmut.Unlock()
+
+	compr := m.negotiatedCompressionLocked(deviceID)
+	m.connCompr[deviceID] = compr
+	return compr
+}
+
+func (m *Model) negotiatedCompressionLocked(deviceID protocol.DeviceID) protocol.Compression {
+	ours := m.cfg.Devices()[deviceID].Compression
+	theirs, ok := m.deviceCompr[deviceID]
+	if !ok || compressionRank(ours) <= compressionRank(theirs) {
+		return ours
+	}
+	return theirs
+}
+
+// The compression algorithms we support, in order of preference, announced
+// comma separated in the cluster config. The protocol library implements
+// only LZ4 and the wire format has a single bit saying whether a message is
+// compressed, so there is nothing to choose between yet; a device announcing
+// algorithms without LZ4 among them gets uncompressed connections. Devices
+// that don't announce any are assumed to use LZ4.
+const compressionAlgorithmsOption = "compressionAlgorithms"
+
+var compressionAlgorithms = []string{"lz4"}
+
+// commonCompressionAlgorithm returns our most preferred compression
+// algorithm among the announced ones, or the empty string if there is none.
+func commonCompressionAlgorithm(announced string) string {
+	theirs := strings.Split(announced, ",")
+	for _, ours := range compressionAlgorithms {
+		for _, alg := range theirs {
+			if strings.TrimSpace(alg) == ours {
+				return ours
+			}
+		}
+	}
+	return ""
+}
+
+// compressionRank orders the compression settings from least to most
+// compression.
+func compressionRank(c protocol.Compression) int {
+	switch c {
+	case protocol.CompressNever:
+		return 0
+	case protocol.CompressAlways:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// deviceDeltaBlocks returns true if the device serves sub block hashes, so
+// that we can pull only the changed parts of blocks from it.
+func (m *Model) deviceDeltaBlocks(deviceID protocol.DeviceID) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return m.deviceDelta[deviceID]
+}
+
 // ReplaceLocal replaces the local folder index with the given list of files.
 func (m *Model) ReplaceLocal(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
@@ -883,10 +1587,26 @@ type cFiler struct {
 
 // Implements scanner.CurrentFiler
 func (cf cFiler) CurrentFile(file string) (protocol.FileInfo, bool) {
-	return cf.m.CurrentFolderFile(cf.r, file)
+	f, ok := cf.m.CurrentFolderFile(cf.r, file)
+	if f.Flags&db.FlagLocalChange != 0 {
+		// Local changes in receive only folders are invalid to the rest of
+		// the cluster, but perfectly valid files as far as the scanner is
+		// concerned.
+		f.Flags &^= protocol.FlagInvalid | db.FlagLocalChange
+	}
+	return f, ok
 }
 
-// ConnectedTo returns true if we are connected to the named device.
+// Disconnect closes the connection to the device and returns. The model lets
+// go of it, and of any extra connections, once the protocol connection
+// notices and calls Close.
+func (m *Model) Disconnect(deviceID protocol.DeviceID) {
+	m.pmut.RLock()
+	m.closeRawConnLocked(deviceID)
+	m.pmut.RUnlock()
+}
+
+// ConnectedTo returns true if we are connected to the named device.
 func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
 	m.pmut.RLock()
 	_, ok := m.protoConn[deviceID]
@@ -966,6 +1686,25 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 	return m.ScanFolder(folder)
 }
 
+// closeRawConnLocked closes the underlying connection to the device, if there
+// is one. Must be called with pmut held.
+func (m *Model) closeRawConnLocked(device protocol.DeviceID) {
+	if conn, ok := m.rawConn[device]; ok {
+		closeRawConn(conn)
+	}
+}
+
+func closeRawConn(conn io.Closer) {
+	if conn, ok := conn.(*tls.Conn); ok {
+		// If the underlying connection is a *tls.Conn, Close() does more
+		// than it says on the tin. Specifically, it sends a TLS alert
+		// message, which might block forever if the connection is dead
+		// and we don't have a deadline site.
+		conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+	}
+	conn.Close()
+}
+
 // AddConnection adds a new peer connection to the model. An initial index will
 // be sent to the connected peer, thereafter index updates whenever the local
 // folder changes.
@@ -976,11 +1715,18 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	if _, ok := m.protoConn[deviceID]; ok {
 		panic("add existing device")
 	}
+	mc := newMonitoredConnection(protoConn)
+	protoConn = mc
 	m.protoConn[deviceID] = protoConn
 	if _, ok := m.rawConn[deviceID]; ok {
 		panic("add existing device")
 	}
 	m.rawConn[deviceID] = rawConn
+	go mc.monitor(m.keepaliveSettings, func(err error) {
+		l.Infof("Closing connection to %s: %v", deviceID, err)
+		closeRawConn(rawConn)
+	})
+	m.deviceCCRcvd[deviceID] = make(chan struct{})
 
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
@@ -988,7 +1734,8 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	m.fmut.RLock()
 	for _, folder := range m.deviceFolders[deviceID] {
 		fs := m.folderFiles[folder]
-		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
+		selection := m.selectionFunc(folder)
+		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder], selection, m.folderLimits[folder], m.deviceFlagsFunc(deviceID))
 	}
 	m.fmut.RUnlock()
 	m.pmut.Unlock()
@@ -996,6 +1743,52 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	m.deviceWasSeen(deviceID)
 }
 
+// keepaliveSettings returns the configured keepalive interval and ping
+// timeout, or the defaults when unset, and whether activity is reduced.
+func (m *Model) keepaliveSettings() (interval, timeout time.Duration, reduced bool) {
+	opts := m.cfg.Options()
+	interval, timeout = 60*time.Second, 30*time.Second
+	if opts.KeepAliveS > 0 {
+		interval = time.Duration(opts.KeepAliveS) * time.Second
+	}
+	if opts.PingTimeoutS > 0 {
+		timeout = time.Duration(opts.PingTimeoutS) * time.Second
+	}
+	return interval, timeout, m.ReducedActivity()
+}
+
+// selectionFunc returns a function that returns the current selection of the
+// folder, as it may change while we're connected.
+func (m *Model) selectionFunc(folder string) func() func(string) bool {
+	return func() func(string) bool {
+		return m.selection(folder)
+	}
+}
+
+// deviceFlagsFunc returns a function that returns the FileInfo flags the
+// device understands, waiting for its cluster config if need be.
+func (m *Model) deviceFlagsFunc(deviceID protocol.DeviceID) func() uint32 {
+	return func() uint32 {
+		m.pmut.RLock()
+		ch := m.deviceCCRcvd[deviceID]
+		m.pmut.RUnlock()
+
+		if ch != nil {
+			select {
+			case <-ch:
+			case <-time.After(clusterConfigTimeout):
+			}
+		}
+
+		m.pmut.RLock()
+		defer m.pmut.RUnlock()
+		if flags, ok := m.deviceFlags[deviceID]; ok {
+			return flags
+		}
+		return protocol.FlagsAll
+	}
+}
+
 func (m *Model) deviceStatRef(deviceID protocol.DeviceID) *stats.DeviceStatisticsReference {
 	m.fmut.Lock()
 	defer m.fmut.Unlock()
@@ -1013,6 +1806,20 @@ func (m *Model) deviceWasSeen(deviceID protocol.DeviceID) {
 	m.deviceStatRef(deviceID).WasSeen()
 }
 
+// LastAddress returns the address we last connected to the device on, as
+// remembered across restarts.
+func (m *Model) LastAddress(deviceID protocol.DeviceID) string {
+	return m.deviceStatRef(deviceID).GetLastAddress()
+}
+
+// SetLastAddress remembers the address we connected to the device on.
+func (m *Model) SetLastAddress(deviceID protocol.DeviceID, addr string) {
+	sr := m.deviceStatRef(deviceID)
+	if sr.GetLastAddress() != addr {
+		sr.SetLastAddress(addr)
+	}
+}
+
 func (m *Model) folderStatRef(folder string) *stats.FolderStatisticsReference {
 	m.fmut.Lock()
 	defer m.fmut.Unlock()
@@ -1025,20 +1832,30 @@ func (m *Model) folderStatRef(folder string) *stats.FolderStatisticsReference {
 	return sr
 }
 
+// transferred counts file data received from or sent to the device.
+func (m *Model) transferred(deviceID protocol.DeviceID, folder string, in, out int) {
+	if deviceID == protocol.LocalDeviceID {
+		return
+	}
+	m.deviceStatRef(deviceID).Transferred(int64(in), int64(out))
+	m.folderStatRef(folder).Transferred(int64(in), int64(out))
+}
+
 func (m *Model) receivedFile(folder, filename string) {
 	m.folderStatRef(folder).ReceivedFile(filename)
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
+func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, selection func() func(string) bool, limiter folderLimiter, peerFlags func() uint32) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
 	}
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	flags := peerFlags()
+	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores, selection(), limiter, flags)
 
 	for err == nil {
 		time.Sleep(5 * time.Second)
@@ -1046,15 +1863,15 @@ func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignore
 			continue
 		}
 
-		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores)
+		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores, selection(), limiter, flags)
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("sendIndexes for %s-%s/%q exiting: %v", deviceID, name, folder, err)
 	}
 }
 
-func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) (int64, error) {
+func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, selected func(string) bool, limiter folderLimiter, peerFlags uint32) (int64, error) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
@@ -1073,18 +1890,40 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 		}
 
 		if ignores.Match(f.Name) || symlinkInvalid(f.IsSymlink()) {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("not sending update for ignored/unsupported symlink", f)
 			}
 			return true
 		}
 
+		if !selected(f.Name) {
+			// We don't sync this part of the folder, so what we might have
+			// of it is nobody else's business.
+			return true
+		}
+
+		f.Flags &^= db.FlagLocalChange
+		if f.Flags&^peerFlags != 0 {
+			if db.IsHardLink(f) && peerFlags&db.FlagHardLink == 0 {
+				// The block list of a hard link is meaningless to a device
+				// that doesn't know about them.
+				if debug.Enabled() {
+					l.Debugln("not sending hard link to device that doesn't support them", f)
+				}
+				return true
+			}
+			// Strip the flags the device doesn't understand, or it would
+			// drop the file altogether.
+			f.Flags &= peerFlags
+		}
+
 		if len(batch) == indexBatchSize || currentBatchSize > indexTargetSize {
+			limiter.waitSend(currentBatchSize)
 			if initial {
 				if err = conn.Index(folder, batch, 0, nil); err != nil {
 					return false
 				}
-				if debug {
+				if debug.Enabled() {
 					l.Debugf("sendIndexes for %s-%s/%q: %d files (<%d bytes) (initial index)", deviceID, name, folder, len(batch), currentBatchSize)
 				}
 				initial = false
@@ -1092,7 +1931,7 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 				if err = conn.IndexUpdate(folder, batch, 0, nil); err != nil {
 					return false
 				}
-				if debug {
+				if debug.Enabled() {
 					l.Debugf("sendIndexes for %s-%s/%q: %d files (<%d bytes) (batched update)", deviceID, name, folder, len(batch), currentBatchSize)
 				}
 			}
@@ -1106,14 +1945,18 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 		return true
 	})
 
+	if err == nil {
+		limiter.waitSend(currentBatchSize)
+	}
+
 	if initial && err == nil {
 		err = conn.Index(folder, batch, 0, nil)
-		if debug && err == nil {
+		if debug.Enabled() && err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (small initial index)", deviceID, name, folder, len(batch))
 		}
 	} else if len(batch) > 0 && err == nil {
 		err = conn.IndexUpdate(folder, batch, 0, nil)
-		if debug && err == nil {
+		if debug.Enabled() && err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (last batch)", deviceID, name, folder, len(batch))
 		}
 	}
@@ -1138,19 +1981,27 @@ func (m *Model) updateLocals(folder string, fs []protocol.FileInfo) {
 }
 
 func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
-	m.pmut.RLock()
-	nc, ok := m.protoConn[deviceID]
-	m.pmut.RUnlock()
-
+	nc, ok := m.requestConn(deviceID)
 	if !ok {
 		return nil, fmt.Errorf("requestGlobal: no such device: %s", deviceID)
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("%v REQ(out): %s: %q / %q o=%d s=%d h=%x f=%x op=%s", m, deviceID, folder, name, offset, size, hash, flags, options)
 	}
 
-	return nc.Request(folder, name, offset, size, hash, flags, options)
+	buf, err := nc.Request(folder, name, offset, size, hash, flags, options)
+	if err == protocol.ErrClosed {
+		// One of several connections to the device may have dropped. Try
+		// again over another one.
+		if nc2, ok := m.requestConn(deviceID); ok && nc2 != nc {
+			buf, err = nc2.Request(folder, name, offset, size, hash, flags, options)
+		}
+	}
+	if err == nil {
+		m.transferred(deviceID, folder, len(buf), 0)
+	}
+	return buf, err
 }
 
 func (m *Model) AddFolder(cfg config.FolderConfiguration) {
@@ -1174,6 +2025,7 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	ignores := ignore.New(m.cfg.Options().CacheIgnoredFiles)
 	_ = ignores.Load(filepath.Join(cfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
 	m.folderIgnores[cfg.ID] = ignores
+	m.folderLimits[cfg.ID] = newFolderLimiter(cfg)
 
 	m.addedFolder = true
 	m.fmut.Unlock()
@@ -1244,8 +2096,24 @@ func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 		return errors.New("no such folder")
 	}
 
+	if folderCfg.Paused {
+		if debug.Enabled() {
+			l.Debugln("not scanning paused folder", folder)
+		}
+		return nil
+	}
+
 	_ = ignores.Load(filepath.Join(folderCfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
 
+	// When syncing only some subtrees of the folder, only those are scanned.
+	if len(folderCfg.Subtrees) > 0 {
+		subs = selectedSubs(folderCfg, subs)
+		if len(subs) == 0 {
+			// Nothing we sync was asked to be scanned.
+			return nil
+		}
+	}
+
 	// Required to make sure that we start indexing at a directory we're already
 	// aware off.
 	var unifySubs []string
@@ -1270,18 +2138,22 @@ nextSub:
 	subs = unifySubs
 
 	w := &scanner.Walker{
-		Dir:           folderCfg.Path(),
-		Subs:          subs,
-		Matcher:       ignores,
-		BlockSize:     protocol.BlockSize,
-		TempNamer:     defTempNamer,
-		TempLifetime:  time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
-		CurrentFiler:  cFiler{m, folder},
-		MtimeRepo:     db.NewVirtualMtimeRepo(m.db, folderCfg.ID),
-		IgnorePerms:   folderCfg.IgnorePerms,
-		AutoNormalize: folderCfg.AutoNormalize,
-		Hashers:       m.numHashers(folder),
-		ShortID:       m.shortID,
+		Dir:             folderCfg.Path(),
+		Subs:            subs,
+		Matcher:         ignores,
+		BlockSize:       protocol.BlockSize,
+		TempNamer:       defTempNamer,
+		TempLifetime:    time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
+		CurrentFiler:    cFiler{m, folder},
+		MtimeRepo:       db.NewVirtualMtimeRepo(m.db, folderCfg.ID),
+		IgnorePerms:     folderCfg.IgnorePerms,
+		IgnoreAttrs:     folderCfg.IgnoreAttrs,
+		AutoNormalize:   folderCfg.AutoNormalize,
+		Hashers:         m.numHashers(folder),
+		DetectHardLinks: folderCfg.DetectHardLinks,
+		ReparsePoints:   reparsePolicy(folderCfg.ReparsePoints),
+		ShortID:         m.shortID,
+		Marker:          folderCfg.MarkerName,
 	}
 
 	runner.setState(FolderScanning)
@@ -1305,6 +2177,9 @@ nextSub:
 	blocksHandled := 0
 
 	for f := range fchan {
+		if folderCfg.ReceiveOnly {
+			f = localChange(f)
+		}
 		if len(batch) == batchSizeFiles || blocksHandled > batchSizeBlocks {
 			if err := m.CheckFolderHealth(folder); err != nil {
 				l.Infof("Stopping folder %s mid-scan due to folder error: %s", folder, err)
@@ -1325,6 +2200,13 @@ nextSub:
 		m.updateLocals(folder, batch)
 	}
 
+	if err := w.Err(); err != nil {
+		// We haven't seen everything, so we can't tell what's been deleted.
+		l.Warnf("Stopping folder %s mid-scan: %v", folder, err)
+		runner.setError(err)
+		return err
+	}
+
 	batch = batch[:0]
 	// TODO: We should limit the Have scanning to start at sub
 	seenPrefix := false
@@ -1362,7 +2244,7 @@ nextSub:
 
 			if ignores.Match(f.Name) || symlinkInvalid(f.IsSymlink()) {
 				// File has been ignored or an unsupported symlink. Set invalid bit.
-				if debug {
+				if debug.Enabled() {
 					l.Debugln("setting invalid bit on ignored", f)
 				}
 				nf := protocol.FileInfo{
@@ -1388,6 +2270,9 @@ nextSub:
 					Modified: f.Modified,
 					Version:  f.Version.Update(m.shortID),
 				}
+				if folderCfg.ReceiveOnly {
+					nf = localChange(nf)
+				}
 				batch = append(batch, nf)
 			}
 		}
@@ -1410,6 +2295,61 @@ nextSub:
 	return nil
 }
 
+// reparsePolicy returns the scanner equivalent of the configured policy.
+func reparsePolicy(p config.ReparsePolicy) scanner.ReparsePolicy {
+	switch p {
+	case config.ReparseFollow:
+		return scanner.ReparseFollow
+	case config.ReparseError:
+		return scanner.ReparseError
+	default:
+		return scanner.ReparseSkip
+	}
+}
+
+// selectedSubs limits the given scan subdirectories to the selected subtrees
+// of the folder. No subdirectories means the whole folder.
+func selectedSubs(folderCfg config.FolderConfiguration, subs []string) []string {
+	if len(folderCfg.Subtrees) == 0 {
+		return subs
+	}
+
+	var selected []string
+	if len(subs) == 0 {
+		for _, sub := range folderCfg.Subtrees {
+			selected = append(selected, filepath.Clean(filepath.FromSlash(sub)))
+		}
+		return selected
+	}
+
+	sep := string(filepath.Separator)
+	for _, sub := range subs {
+		sub = filepath.Clean(sub)
+		for _, tree := range folderCfg.Subtrees {
+			tree = filepath.Clean(filepath.FromSlash(tree))
+			if sub == tree || strings.HasPrefix(sub, tree+sep) {
+				// The subdirectory is within a selected subtree.
+				selected = append(selected, sub)
+				break
+			}
+			if strings.HasPrefix(tree, sub+sep) {
+				// The selected subtree is within the subdirectory.
+				selected = append(selected, tree)
+			}
+		}
+	}
+	return selected
+}
+
+// selection returns a function telling whether a file is within the parts of
+// the folder we are currently syncing.
+func (m *Model) selection(folder string) func(string) bool {
+	m.fmut.RLock()
+	folderCfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	return folderCfg.IsSelected
+}
+
 func (m *Model) DelayScan(folder string, next time.Duration) {
 	m.fmut.Lock()
 	runner, ok := m.folderRunners[folder]
@@ -1442,7 +2382,7 @@ func (m *Model) numHashers(folder string) int {
 }
 
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer device
-func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMessage {
+func (m *Model) clusterConfig(to protocol.DeviceID) protocol.ClusterConfigMessage {
 	cm := protocol.ClusterConfigMessage{
 		ClientName:    m.clientName,
 		ClientVersion: m.clientVersion,
@@ -1451,14 +2391,33 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   "flags",
+				Value: strconv.FormatUint(uint64(db.FlagsAll&^db.FlagLocalChange), 16),
+			},
+			{
+				Key:   subBlockHashesOption,
+				Value: "1",
+			},
+			{
+				Key:   "compression",
+				Value: m.cfg.Devices()[to].Compression.String(),
+			},
+			{
+				Key:   compressionAlgorithmsOption,
+				Value: strings.Join(compressionAlgorithms, ","),
+			},
 		},
 	}
 
 	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
+	for _, folder := range m.deviceFolders[to] {
 		cr := protocol.Folder{
 			ID: folder,
 		}
+		if state := m.localFolderStateLocked(folder); state != "" {
+			cr.Options = []protocol.Option{{Key: folderStateOption, Value: state}}
+		}
 		for _, device := range m.folderDevices[folder] {
 			// DeviceID is a value type, but with an underlying array. Copy it
 			// so we don't grab aliases to the same array later on in device[:]
@@ -1471,6 +2430,11 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 			if deviceCfg := m.cfg.Devices()[device]; deviceCfg.Introducer {
 				cn.Flags |= protocol.FlagIntroducer
 			}
+			if device != m.id && device != to {
+				if addrs := m.knownAddresses(device); len(addrs) > 0 {
+					cn.Options = []protocol.Option{{Key: deviceAddrsOption, Value: addrs}}
+				}
+			}
 			cr.Devices = append(cr.Devices, cn)
 		}
 		cm.Folders = append(cm.Folders, cr)
@@ -1480,6 +2444,55 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 	return cm
 }
 
+// localFolderStateLocked returns the folder state to announce to other
+// devices, or the empty string when the folder is synced as usual. The fmut
+// must be held.
+func (m *Model) localFolderStateLocked(folder string) string {
+	if m.folderCfgs[folder].Paused {
+		return folderStatePaused
+	}
+	if runner, ok := m.folderRunners[folder]; ok {
+		if state, _, _ := runner.getState(); state == FolderError {
+			return folderStateError
+		}
+	}
+	return ""
+}
+
+// remoteFolderStates returns the folder states announced in the cluster
+// config.
+func remoteFolderStates(cm protocol.ClusterConfigMessage) map[string]string {
+	states := make(map[string]string)
+	for _, folder := range cm.Folders {
+		for _, opt := range folder.Options {
+			if opt.Key == folderStateOption && opt.Value != "" {
+				states[folder.ID] = opt.Value
+			}
+		}
+	}
+	return states
+}
+
+// RemoteFolderState returns the state of the folder as announced by the
+// device: "paused" or "error" when the device doesn't sync the folder at the
+// moment, or the empty string.
+func (m *Model) RemoteFolderState(device protocol.DeviceID, folder string) string {
+	m.pmut.RLock()
+	state := m.remoteState[device][folder]
+	m.pmut.RUnlock()
+	return state
+}
+
+// sendClusterConfigs sends the cluster config to all connected devices again,
+// to tell them about changed folder states.
+func (m *Model) sendClusterConfigs() {
+	m.pmut.RLock()
+	for device, conn := range m.protoConn {
+		conn.ClusterConfig(m.clusterConfig(device))
+	}
+	m.pmut.RUnlock()
+}
+
 func (m *Model) State(folder string) (string, time.Time, error) {
 	m.fmut.RLock()
 	runner, ok := m.folderRunners[folder]
@@ -1491,10 +2504,32 @@ func (m *Model) State(folder string) (string, time.Time, error) {
 		return "", time.Time{}, nil
 	}
 	state, changed, err := runner.getState()
+	if m.folderPaused(folder) {
+		return "paused", changed, nil
+	}
+	if m.InQuietHours(folder) {
+		return "quiet", changed, err
+	}
 	return state.String(), changed, err
 }
 
-func (m *Model) Override(folder string) {
+// LastScanDuration returns how long the last completed scan of the folder
+// took, or zero if there has been none.
+func (m *Model) LastScanDuration(folder string) time.Duration {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return 0
+	}
+	return runner.lastScanDuration()
+}
+
+// Override makes our versions of the files in the given send only folder
+// the newest ones, throwing away the changes made by other devices. Only the
+// files matching the paths are overridden, or all files if there are none;
+// see pathMatcher.
+func (m *Model) Override(folder string, paths []string) {
 	m.fmut.RLock()
 	fs, ok := m.folderFiles[folder]
 	runner := m.folderRunners[folder]
@@ -1503,10 +2538,14 @@ func (m *Model) Override(folder string) {
 		return
 	}
 
+	matches := pathMatcher(paths)
 	runner.setState(FolderScanning)
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
 	fs.WithNeed(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
 		need := fi.(protocol.FileInfo)
+		if !matches(need.Name) {
+			return true
+		}
 		if len(batch) == indexBatchSize {
 			fs.Update(protocol.LocalDeviceID, batch)
 			batch = batch[:0]
@@ -1533,6 +2572,131 @@ func (m *Model) Override(folder string) {
 	runner.setState(FolderIdle)
 }
 
+// localChange marks the file as a local change in a receive only folder.
+// It's invalid so the rest of the cluster ignores it, and the puller
+// leaves it alone until it's reverted.
+func localChange(f protocol.FileInfo) protocol.FileInfo {
+	f.Flags |= protocol.FlagInvalid | db.FlagLocalChange
+	return f
+}
+
+// LocalChangedFiles returns the files that have been changed locally in the
+// given receive only folder.
+func (m *Model) LocalChangedFiles(folder string) []db.FileInfoTruncated {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var files []db.FileInfoTruncated
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.Flags&db.FlagLocalChange != 0 {
+			files = append(files, f)
+		}
+		return true
+	})
+	return files
+}
+
+// Revert throws away the local changes in the given receive only folder.
+// Files that also exist in the cluster are pulled again; files that exist
+// only locally are removed. Only the files matching the paths are reverted,
+// or all files if there are none; see pathMatcher.
+func (m *Model) Revert(folder string, paths []string) {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	runner := m.folderRunners[folder]
+	folderCfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return
+	}
+
+	matches := pathMatcher(paths)
+	runner.setState(FolderScanning)
+	var batch []protocol.FileInfo
+	var additions []string
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.Flags&db.FlagLocalChange == 0 || !matches(f.Name) {
+			return true
+		}
+
+		// The entry still describes what's on disk, so the scanner leaves
+		// it alone, but with an empty version that is older than the global
+		// one. The global version will be pulled again.
+		nf, ok := fs.Get(protocol.LocalDeviceID, f.Name)
+		if !ok {
+			return true
+		}
+		nf.Flags &^= protocol.FlagInvalid | db.FlagLocalChange
+		nf.Version = protocol.Vector{}
+		if _, ok := fs.GetGlobalTruncated(f.Name); !ok {
+			// Nobody else has it. Forget about it and remove it from disk.
+			nf.Flags |= protocol.FlagDeleted | protocol.FlagInvalid
+			nf.Version = f.Version
+			nf.Blocks = nil
+			if !f.IsDeleted() {
+				additions = append(additions, f.Name)
+			}
+		}
+		batch = append(batch, nf)
+		return true
+	})
+
+	// Remove children before their parents.
+	sort.Sort(sort.Reverse(sort.StringSlice(additions)))
+	for _, name := range additions {
+		if err := osutil.InWritableDir(osutil.Remove, filepath.Join(folderCfg.Path(), name)); err != nil && !os.IsNotExist(err) {
+			l.Infof("Revert (folder %q, file %q): %v", folder, name, err)
+		}
+	}
+
+	if len(batch) > 0 {
+		m.updateLocals(folder, batch)
+	}
+	runner.setState(FolderIdle)
+	runner.IndexUpdated()
+}
+
+// pathMatcher returns a function telling whether a file name matches any of
+// the paths. A path is either a glob pattern, matched against the whole
+// name, or a directory or file name, matching itself and everything below
+// it. Without paths, every name matches.
+func pathMatcher(paths []string) func(name string) bool {
+	if len(paths) == 0 {
+		return func(string) bool { return true }
+	}
+
+	sep := string(filepath.Separator)
+	var globs, prefixes []string
+	for _, path := range paths {
+		path = osutil.NativeFilename(path)
+		if strings.ContainsAny(path, "*?[") {
+			globs = append(globs, path)
+		} else {
+			prefixes = append(prefixes, strings.TrimSuffix(path, sep))
+		}
+	}
+
+	return func(name string) bool {
+		for _, prefix := range prefixes {
+			if name == prefix || strings.HasPrefix(name, prefix+sep) {
+				return true
+			}
+		}
+		for _, glob := range globs {
+			if ok, _ := filepath.Match(glob, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // CurrentLocalVersion returns the change version for the given folder.
 // This is guaranteed to increment if the contents of the local folder has
 // changed.
@@ -1587,6 +2751,17 @@ func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly
 		prefix = prefix + sep
 	}
 
+	// The files below the prefix we don't have the global version of.
+	needed := make(map[string]bool)
+	if !dirsonly {
+		files.WithNeedTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+			if name := fi.(db.FileInfoTruncated).Name; strings.HasPrefix(name, prefix) {
+				needed[name] = true
+			}
+			return true
+		})
+	}
+
 	files.WithPrefixedGlobalTruncated(prefix, func(fi db.FileIntf) bool {
 		f := fi.(db.FileInfoTruncated)
 
@@ -1594,6 +2769,10 @@ func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly
 			return true
 		}
 
+		state := "synced"
+		if needed[f.Name] {
+			state = "needed"
+		}
 		f.Name = strings.Replace(f.Name, prefix, "", 1)
 
 		var dir, base string
@@ -1624,7 +2803,7 @@ func (m *Model) GlobalDirectoryTree(folder, prefix string, levels int, dirsonly
 
 		if !dirsonly && base != "" {
 			last[base] = []interface{}{
-				time.Unix(f.Modified, 0), f.Size(),
+				time.Unix(f.Modified, 0), f.Size(), state,
 			}
 		}
 
@@ -1659,8 +2838,8 @@ func (m *Model) Availability(folder, file string) []protocol.DeviceID {
 
 // BringToFront bumps the given files priority in the job queue.
 func (m *Model) BringToFront(folder, file string) {
-	m.pmut.RLock()
-	defer m.pmut.RUnlock()
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
 
 	runner, ok := m.folderRunners[folder]
 	if ok {
@@ -1668,6 +2847,77 @@ func (m *Model) BringToFront(folder, file string) {
 	}
 }
 
+// PullNow pulls the given file right away, with the highest priority. It
+// returns false if the file is already in sync, and an error if there is no
+// such file.
+func (m *Model) PullNow(folder, file string) (bool, error) {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return false, errFolderMissing
+	}
+
+	if _, ok := m.CurrentGlobalFile(folder, file); !ok {
+		return false, protocol.ErrNoSuchFile
+	}
+	if !m.NeedsFile(folder, file) {
+		return false, nil
+	}
+
+	runner.PullNow(file)
+	return true, nil
+}
+
+// NeedsFile returns true if the global version of the file differs from the
+// one we have.
+func (m *Model) NeedsFile(folder, file string) bool {
+	gf, ok := m.CurrentGlobalFile(folder, file)
+	if !ok {
+		return false
+	}
+	lf, ok := m.CurrentFolderFile(folder, file)
+	return !ok || !lf.Version.Equal(gf.Version)
+}
+
+// PullProgress returns the progress of the given file, if it is being
+// pulled.
+func (m *Model) PullProgress(folder, file string) (*pullerProgress, bool) {
+	return m.progressEmitter.Progress(folder, file)
+}
+
+// AllPullProgress returns the progress of the files being pulled in the
+// folder, or in all folders if it's empty, by folder and file name.
+func (m *Model) AllPullProgress(folder string) map[string]map[string]*pullerProgress {
+	return m.progressEmitter.AllProgress(folder)
+}
+
+// PullQueue returns the names of the files currently being pulled and the
+// ones queued for pulling, in the order they will be pulled.
+func (m *Model) PullQueue(folder string) ([]string, []string) {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil, nil
+	}
+	return runner.Jobs()
+}
+
+// FailedItems returns the items of the folder that failed to sync and are
+// waiting to be retried.
+func (m *Model) FailedItems(folder string) []FailedItem {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	return runner.FailedItems()
+}
+
 // CheckFolderHealth checks the folder for common errors and returns the
 // current folder error, or nil if the folder is healthy.
 func (m *Model) CheckFolderHealth(id string) error {
@@ -1728,6 +2978,30 @@ func (m *Model) CheckFolderHealth(id string) error {
 	return err
 }
 
+// checkFreeSpace returns an error if writing need more bytes to the
+// filesystem holding path would leave less free space than the given
+// percentage or number of MiB. If we can't tell the free space, all is
+// assumed to be well.
+func checkFreeSpace(path string, minPct float64, minMiB int, need int64) error {
+	if minPct <= 0 && minMiB <= 0 {
+		return nil
+	}
+
+	free, total, err := osutil.DiskFree(path)
+	if err != nil || total <= 0 {
+		return nil
+	}
+	free -= need
+
+	if minMiB > 0 && free < int64(minMiB)<<20 {
+		return fmt.Errorf("insufficient free space (%d MiB free, at least %d MiB required)", free>>20, minMiB)
+	}
+	if pct := 100 * float64(free) / float64(total); minPct > 0 && pct < minPct {
+		return fmt.Errorf("insufficient free space (%.1f%% free, at least %.1f%% required)", pct, minPct)
+	}
+	return nil
+}
+
 func (m *Model) ResetFolder(folder string) error {
 	for _, f := range db.ListFolders(m.db) {
 		if f == folder {
@@ -1739,6 +3013,60 @@ func (m *Model) ResetFolder(folder string) error {
 	return fmt.Errorf("Unknown folder %q", folder)
 }
 
+// DropUnsharedDevices removes the files of the devices that the folders
+// aren't shared with from the index, and with them their versions from the
+// global versions, so that they don't count towards what's needed.
+func (m *Model) DropUnsharedDevices() {
+	type drop struct {
+		folder string
+		device protocol.DeviceID
+		files  *db.FileSet
+	}
+	var drops []drop
+	m.fmut.RLock()
+	for folder, files := range m.folderFiles {
+		shared := make(map[protocol.DeviceID]bool)
+		for _, device := range m.folderDevices[folder] {
+			shared[device] = true
+		}
+		for _, device := range files.Devices() {
+			if device != protocol.LocalDeviceID && !shared[device] {
+				drops = append(drops, drop{folder, device, files})
+			}
+		}
+	}
+	m.fmut.RUnlock()
+
+	for _, d := range drops {
+		l.Infof("Cleaning data of device %v for folder %q, which is no longer shared with it", d.device, d.folder)
+		d.files.Replace(d.device, nil)
+		events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
+			"device":  d.device.String(),
+			"folder":  d.folder,
+			"items":   0,
+			"version": d.files.LocalVersion(d.device),
+		})
+	}
+}
+
+// CheckIndex checks the index of every folder and returns what it found. As
+// the index is in use, repairing it must wait for a restart; see
+// ScheduleIndexRepair.
+func (m *Model) CheckIndex() []db.FolderCheck {
+	return db.CheckIndex(m.db, false)
+}
+
+// DatabaseStatus returns the size and makeup of the database, which is in the
+// given directory.
+func (m *Model) DatabaseStatus(dir string) (db.Status, error) {
+	return db.DatabaseStatus(m.db, dir)
+}
+
+// ScheduleIndexRepair has the index checked and repaired at the next start.
+func (m *Model) ScheduleIndexRepair() {
+	db.ScheduleRepair(m.db)
+}
+
 func (m *Model) String() string {
 	return fmt.Sprintf("model@%p", m)
 }
@@ -1750,10 +3078,23 @@ func (m *Model) VerifyConfiguration(from, to config.Configuration) error {
 func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 	// TODO: This should not use reflect, and should take more care to try to handle stuff without restart.
 
-	// Adding, removing or changing folders requires restart
-	if !reflect.DeepEqual(from.Folders, to.Folders) {
+	// Removed folders and shares are let go of right away, and their data
+	// dropped from the database in the background.
+	if removed, unshared := m.stopRemoved(from, to); len(removed) > 0 || unshared {
+		go m.dropRemoved(removed, unshared)
+	}
+
+	// Adding, removing or changing folders requires restart, except for
+	// changing which subtrees of them are synced, their quiet hours and
+	// pausing or resuming them.
+	if !reflect.DeepEqual(withoutLiveSettings(from.Folders), withoutLiveSettings(to.Folders)) {
 		return false
 	}
+	for _, fcfg := range to.Folders {
+		m.setSubtrees(fcfg.ID, fcfg.Subtrees)
+		m.setFolderPaused(fcfg.ID, fcfg.Paused)
+		m.setQuietHours(fcfg.ID, fcfg.QuietHours)
+	}
 
 	// Removing a device requres restart
 	toDevs := make(map[protocol.DeviceID]bool, len(from.Devices))
@@ -1766,14 +3107,262 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 		}
 	}
 
-	// All of the generic options require restart
-	if !reflect.DeepEqual(from.Options, to.Options) {
+	// All of the generic options require restart, except for the quiet
+	// hours which are looked up when needed.
+	fromOpts, toOpts := from.Options, to.Options
+	fromOpts.QuietHours, toOpts.QuietHours = nil, nil
+	if !reflect.DeepEqual(fromOpts, toOpts) {
 		return false
 	}
 
+	// Pausing a device drops the connection to it. The connection service
+	// won't establish a new one until the device is resumed.
+	m.pmut.Lock()
+	for _, dev := range to.Devices {
+		if dev.Paused {
+			m.closeRawConnLocked(dev.DeviceID)
+		}
+	}
+	m.pmut.Unlock()
+
 	return true
 }
 
+// stopRemoved stops and forgets the folders removed from the configuration,
+// and stops sharing the remaining ones with the devices removed from them.
+// It returns the removed folders, and whether any were unshared.
+func (m *Model) stopRemoved(from, to config.Configuration) ([]string, bool) {
+	toFolders := make(map[string]config.FolderConfiguration, len(to.Folders))
+	for _, fcfg := range to.Folders {
+		toFolders[fcfg.ID] = fcfg
+	}
+
+	var removed []string
+	unshared := false
+	for _, fcfg := range from.Folders {
+		toCfg, ok := toFolders[fcfg.ID]
+		if !ok {
+			removed = append(removed, fcfg.ID)
+			continue
+		}
+		shared := make(map[protocol.DeviceID]bool, len(toCfg.Devices))
+		for _, device := range toCfg.DeviceIDs() {
+			shared[device] = true
+		}
+		for _, device := range fcfg.DeviceIDs() {
+			if !shared[device] {
+				m.unshareFolder(fcfg.ID, device)
+				unshared = true
+			}
+		}
+	}
+
+	for _, folder := range removed {
+		m.fmut.Lock()
+		runner, running := m.folderRunners[folder]
+		for _, device := range m.folderDevices[folder] {
+			folders := m.deviceFolders[device][:0:0]
+			for _, id := range m.deviceFolders[device] {
+				if id != folder {
+					folders = append(folders, id)
+				}
+			}
+			m.deviceFolders[device] = folders
+		}
+		delete(m.folderCfgs, folder)
+		delete(m.folderFiles, folder)
+		delete(m.folderDevices, folder)
+		delete(m.folderIgnores, folder)
+		delete(m.folderRunners, folder)
+		delete(m.folderStatRefs, folder)
+		delete(m.folderLimits, folder)
+		delete(m.quotaExceeded, folder)
+		m.fmut.Unlock()
+		if running {
+			runner.Stop()
+		}
+	}
+	return removed, unshared
+}
+
+// dropRemoved drops the data of the removed folders, and that of devices
+// folders are no longer shared with, from the database.
+func (m *Model) dropRemoved(removed []string, unshared bool) {
+	for _, folder := range removed {
+		l.Infof("Cleaning data for removed folder %q", folder)
+		db.DropFolder(m.db, folder)
+	}
+	if unshared {
+		m.DropUnsharedDevices()
+	}
+}
+
+// withoutLiveSettings returns the folders with the settings that can be
+// changed without a restart cleared.
+func withoutLiveSettings(folders []config.FolderConfiguration) []config.FolderConfiguration {
+	res := make([]config.FolderConfiguration, len(folders))
+	for i, fcfg := range folders {
+		fcfg.Subtrees = nil
+		fcfg.Paused = false
+		fcfg.QuietHours = nil
+		res[i] = fcfg
+	}
+	return res
+}
+
+// setSubtrees changes which subtrees of the folder are synced. Newly selected
+// subtrees are scanned and pulled right away; anything no longer selected is
+// left alone on disk.
+func (m *Model) setSubtrees(folder string, subtrees []string) {
+	m.fmut.Lock()
+	folderCfg, ok := m.folderCfgs[folder]
+	if !ok || reflect.DeepEqual(folderCfg.Subtrees, subtrees) {
+		m.fmut.Unlock()
+		return
+	}
+	folderCfg.Subtrees = subtrees
+	m.folderCfgs[folder] = folderCfg
+	runner, ok := m.folderRunners[folder]
+	m.fmut.Unlock()
+
+	if ok {
+		go func() {
+			m.ScanFolder(folder)
+			runner.IndexUpdated()
+		}()
+	}
+}
+
+// setFolderPaused pauses or resumes scanning and pulling of the folder. A
+// resumed folder is rescanned and pulled right away.
+func (m *Model) setFolderPaused(folder string, paused bool) {
+	m.fmut.Lock()
+	folderCfg, ok := m.folderCfgs[folder]
+	if !ok || folderCfg.Paused == paused {
+		m.fmut.Unlock()
+		return
+	}
+	folderCfg.Paused = paused
+	m.folderCfgs[folder] = folderCfg
+	runner, ok := m.folderRunners[folder]
+	m.fmut.Unlock()
+
+	m.sendClusterConfigs()
+
+	if paused {
+		l.Infof("Folder %q paused", folder)
+		return
+	}
+
+	l.Infof("Folder %q resumed", folder)
+	if ok {
+		go func() {
+			m.ScanFolder(folder)
+			runner.IndexUpdated()
+		}()
+	}
+}
+
+// SetReducedActivity sets whether activity should be reduced, because we're
+// on battery power or a metered network connection. While reduced, folders
+// are scanned less often, large files are not pulled and connections are
+// probed less often.
+func (m *Model) SetReducedActivity(reduced bool) {
+	m.fmut.Lock()
+	if m.reduced == reduced {
+		m.fmut.Unlock()
+		return
+	}
+	m.reduced = reduced
+	runners := make([]service, 0, len(m.folderRunners))
+	for _, runner := range m.folderRunners {
+		runners = append(runners, runner)
+	}
+	m.fmut.Unlock()
+
+	if reduced {
+		l.Infoln("Reducing activity (on battery or metered network)")
+		return
+	}
+
+	l.Infoln("Resuming normal activity")
+	for _, runner := range runners {
+		// Have another look at the files that were postponed.
+		runner.IndexUpdated()
+	}
+}
+
+// setQuotaExceeded records whether files have been refused because they
+// would make the folder exceed its quota.
+func (m *Model) setQuotaExceeded(folder string, quota int64, exceeded bool) {
+	m.fmut.Lock()
+	changed := m.quotaExceeded[folder] != exceeded
+	m.quotaExceeded[folder] = exceeded
+	m.fmut.Unlock()
+
+	if !changed {
+		return
+	}
+	if !exceeded {
+		l.Infof("Folder %q is within its quota again", folder)
+		return
+	}
+
+	l.Warnf("Folder %q has exceeded its quota of %d MiB; not accepting new data", folder, quota>>20)
+	_, _, localBytes := m.LocalSize(folder)
+	events.Default.Log(events.FolderQuotaExceeded, map[string]interface{}{
+		"folder":     folder,
+		"quotaBytes": quota,
+		"localBytes": localBytes,
+	})
+}
+
+// QuotaExceeded returns true if the folder has refused files because of its
+// quota.
+func (m *Model) QuotaExceeded(folder string) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.quotaExceeded[folder]
+}
+
+// ReducedActivity returns true if activity should currently be reduced.
+func (m *Model) ReducedActivity() bool {
+	m.fmut.RLock()
+	reduced := m.reduced
+	m.fmut.RUnlock()
+	return reduced
+}
+
+func (m *Model) setQuietHours(folder string, windows []config.TimeWindow) {
+	m.fmut.Lock()
+	if folderCfg, ok := m.folderCfgs[folder]; ok {
+		folderCfg.QuietHours = windows
+		m.folderCfgs[folder] = folderCfg
+	}
+	m.fmut.Unlock()
+}
+
+// InQuietHours returns true if it's currently quiet hours, globally or for
+// the given folder, and the folder should not be synced.
+func (m *Model) InQuietHours(folder string) bool {
+	now := time.Now()
+	if config.InWindows(m.cfg.Options().QuietHours, now) {
+		return true
+	}
+
+	m.fmut.RLock()
+	windows := m.folderCfgs[folder].QuietHours
+	m.fmut.RUnlock()
+	return config.InWindows(windows, now)
+}
+
+func (m *Model) folderPaused(folder string) bool {
+	m.fmut.RLock()
+	paused := m.folderCfgs[folder].Paused
+	m.fmut.RUnlock()
+	return paused
+}
+
 func symlinkInvalid(isLink bool) bool {
 	if !symlinks.Supported && isLink {
 		SymlinkWarning.Do(func() {
@@ -8,12 +8,15 @@ package model
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -21,6 +24,10 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -363,6 +370,131 @@ func TestDeviceRename(t *testing.T) {
 	}
 }
 
+func TestDropUnsharedDevices(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	// Files from device2, with which the folder is no longer shared.
+	version := protocol.Vector{{ID: 42, Value: 1}}
+	db.NewFileSet("default", ldb).Replace(device2, []protocol.FileInfo{{Name: "gone", Version: version}})
+	db.NewFileSet("default", ldb).Replace(device1, []protocol.FileInfo{{Name: "kept", Version: version}})
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+	if files, _ := m.NeedSize("default"); files != 2 {
+		t.Fatalf("Incorrect %d files needed before dropping", files)
+	}
+
+	m.DropUnsharedDevices()
+	if files, _ := m.NeedSize("default"); files != 1 {
+		t.Errorf("Incorrect %d files needed after dropping", files)
+	}
+	if _, ok := m.CurrentGlobalFile("default", "gone"); ok {
+		t.Error("File of the dropped device still global")
+	}
+}
+
+func TestDropRemoved(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	version := protocol.Vector{{ID: 42, Value: 1}}
+	fs := db.NewFileSet("default", ldb)
+	fs.Replace(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "local", Version: version}})
+	fs.Replace(device1, []protocol.FileInfo{{Name: "shared", Version: version}})
+	db.NewFileSet("other", ldb).Replace(device1, []protocol.FileInfo{{Name: "removed", Version: version}})
+
+	from := defaultConfig.Raw()
+	from.Folders = []config.FolderConfiguration{defaultFolderConfig, {ID: "other", RawPath: "testdata", Devices: defaultFolderConfig.Devices}}
+	m := NewModel(config.Wrap("/tmp/test", from), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	for _, fcfg := range from.Folders {
+		m.AddFolder(fcfg)
+	}
+
+	// The other folder is removed, and the default one unshared with device1.
+	to := from.Copy()
+	to.Folders = to.Folders[:1]
+	to.Folders[0].Devices = []config.FolderDeviceConfiguration{{DeviceID: protocol.LocalDeviceID}}
+	removed, unshared := m.stopRemoved(from, to)
+	if len(removed) != 1 || removed[0] != "other" || !unshared {
+		t.Fatalf("Incorrect removals %v, %v", removed, unshared)
+	}
+	if m.folderSharedWith("default", device1) {
+		t.Error("Folder still shared with device1")
+	}
+	if _, ok := m.folderCfgs["other"]; ok {
+		t.Error("Removed folder still known")
+	}
+
+	m.dropRemoved(removed, unshared)
+	if folders := db.ListFolders(ldb); len(folders) != 1 || folders[0] != "default" {
+		t.Errorf("Incorrect folders %v in the database", folders)
+	}
+	if _, ok := m.CurrentGlobalFile("default", "shared"); ok {
+		t.Error("File of the unshared device still global")
+	}
+}
+
+func TestAutoAcceptFolders(t *testing.T) {
+	defer os.Remove("tmpconfig.xml")
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rawCfg := config.New(device1)
+	rawCfg.Options.DefaultFolderPath = filepath.Join(dir, "${device}", "${id}")
+	rawCfg.GUI.LockedSections = []string{"folders"}
+	rawCfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1, Name: "trusted", AutoAcceptFolders: true},
+		{DeviceID: device2, Name: "other"},
+	}
+	cfg := config.Wrap("tmpconfig.xml", rawCfg)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+
+	cm := protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{{ID: "photos"}},
+	}
+	m.ClusterConfig(device2, cm)
+	if _, ok := cfg.Folders()["photos"]; ok {
+		t.Fatal("Folder accepted from a device without autoAcceptFolders")
+	}
+	m.ClusterConfig(device1, cm)
+	if _, ok := cfg.Folders()["photos"]; ok {
+		t.Fatal("Folder accepted while the folders are locked")
+	}
+
+	gui := cfg.GUI()
+	gui.LockedSections = nil
+	cfg.SetGUI(gui)
+	m.ClusterConfig(device1, cm)
+	fcfg, ok := cfg.Folders()["photos"]
+	if !ok {
+		t.Fatal("Folder not accepted")
+	}
+	if fcfg.RawPath != filepath.Join(dir, "trusted", "photos") {
+		t.Errorf("Incorrect path %q", fcfg.RawPath)
+	}
+	if !fcfg.HasMarker() {
+		t.Error("Accepted folder not created")
+	}
+	if _, _, err := m.State("photos"); err != nil {
+		t.Errorf("Accepted folder not started: %v", err)
+	}
+	devices := fcfg.DeviceIDs()
+	if len(devices) != 2 || devices[0] != protocol.LocalDeviceID || devices[1] != device1 {
+		t.Errorf("Incorrect devices %v", devices)
+	}
+
+	cfgw, err := config.Load("tmpconfig.xml", protocol.LocalDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfgw.Folders()["photos"]; !ok {
+		t.Error("Accepted folder not saved in config")
+	}
+}
+
 func TestClusterConfig(t *testing.T) {
 	cfg := config.New(device1)
 	cfg.Devices = []config.DeviceConfiguration{
@@ -444,6 +576,79 @@ func TestClusterConfig(t *testing.T) {
 	}
 }
 
+func TestIntroducerProvenance(t *testing.T) {
+	defer os.Remove("tmpconfig.xml")
+
+	rawCfg := config.New(device1)
+	rawCfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1, Introducer: true, RemoveIntroduced: true},
+	}
+	rawCfg.Folders = []config.FolderConfiguration{
+		{
+			ID: "folder1",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: protocol.LocalDeviceID},
+				{DeviceID: device1},
+			},
+		},
+	}
+	cfg := config.Wrap("tmpconfig.xml", rawCfg)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(rawCfg.Folders[0])
+
+	announce := func(devices ...protocol.DeviceID) {
+		folder := protocol.Folder{ID: "folder1"}
+		for _, id := range devices {
+			folder.Devices = append(folder.Devices, protocol.Device{ID: id[:]})
+		}
+		m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+			Folders: []protocol.Folder{folder},
+		})
+	}
+	shared := func() (string, bool) {
+		for _, dev := range cfg.Folders()["folder1"].Devices {
+			if dev.DeviceID == device2 {
+				return dev.IntroducedBy, true
+			}
+		}
+		return "", false
+	}
+
+	announce(device1, device2)
+	if by := cfg.Devices()[device2].IntroducedBy; by != device1.String() {
+		t.Errorf("Device introduced by %q, expected %v", by, device1)
+	}
+	if by, ok := shared(); !ok || by != device1.String() {
+		t.Errorf("Folder shared with device2 by %q (%v), expected %v", by, ok, device1)
+	}
+
+	announce(device1)
+	if _, ok := shared(); ok {
+		t.Error("Folder still shared with device2 after the introducer dropped it")
+	}
+	if _, ok := cfg.Devices()[device2]; ok {
+		t.Error("Device2 still configured after the introducer dropped it")
+	}
+	if m.folderSharedWith("folder1", device2) {
+		t.Error("Model still shares the folder with device2")
+	}
+
+	// By default, what the introducer added is left in place.
+	announce(device1, device2)
+	introducer := cfg.Devices()[device1]
+	introducer.RemoveIntroduced = false
+	cfg.SetDevice(introducer)
+	announce(device1)
+	if _, ok := shared(); !ok {
+		t.Error("Folder unshared with device2 without removeIntroduced")
+	}
+	if _, ok := cfg.Devices()[device2]; !ok {
+		t.Error("Device2 removed without removeIntroduced")
+	}
+}
+
 func TestIgnores(t *testing.T) {
 	arrEqual := func(a, b []string) bool {
 		if len(a) != len(b) {
@@ -511,64 +716,820 @@ func TestIgnores(t *testing.T) {
 		t.Error(err)
 	}
 
-	if !arrEqual(ignores, expected) {
-		t.Errorf("Incorrect ignores: %v != %v", ignores, expected)
+	if !arrEqual(ignores, expected) {
+		t.Errorf("Incorrect ignores: %v != %v", ignores, expected)
+	}
+
+	ignores, _, err = m.GetIgnores("doesnotexist")
+	if err == nil {
+		t.Error("No error")
+	}
+
+	err = m.SetIgnores("doesnotexist", expected)
+	if err == nil {
+		t.Error("No error")
+	}
+
+	m.AddFolder(config.FolderConfiguration{ID: "fresh", RawPath: "XXX"})
+	ignores, _, err = m.GetIgnores("fresh")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(ignores) > 0 {
+		t.Errorf("Expected no ignores, got: %v", ignores)
+	}
+}
+
+func TestRefuseUnknownBits(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	m.ScanFolder("default")
+	m.Index(device1, "default", []protocol.FileInfo{
+		{
+			Name:  "invalid1",
+			Flags: (db.FlagsAll + 1) &^ protocol.FlagInvalid,
+		},
+		{
+			Name:  "invalid2",
+			Flags: (db.FlagsAll + 2) &^ protocol.FlagInvalid,
+		},
+		{
+			Name:  "invalid3",
+			Flags: (1 << 31) &^ protocol.FlagInvalid,
+		},
+		{
+			Name:  "valid",
+			Flags: db.FlagsAll &^ (protocol.FlagInvalid | protocol.FlagSymlink),
+		},
+	}, 0, nil)
+
+	for _, name := range []string{"invalid1", "invalid2", "invalid3"} {
+		f, ok := m.CurrentGlobalFile("default", name)
+		if ok || f.Name == name {
+			t.Error("Invalid file found or name match")
+		}
+	}
+	f, ok := m.CurrentGlobalFile("default", "valid")
+	if !ok || f.Name != "valid" {
+		t.Error("Valid file not found or name mismatch", ok, f)
+	}
+}
+
+type indexRecorder struct {
+	FakeConnection
+	files []protocol.FileInfo
+}
+
+func (c *indexRecorder) Index(folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) error {
+	c.files = append(c.files, fs...)
+	return nil
+}
+
+func TestSendIndexPeerFlags(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fs := db.NewFileSet("default", ldb)
+	fs.Replace(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "hidden", Flags: db.FlagHidden | 0644},
+		{Name: "link", Flags: db.FlagHardLink | 0644},
+		{Name: "local", Flags: protocol.FlagInvalid | db.FlagLocalChange | 0644},
+	})
+	selected := func(string) bool { return true }
+
+	flagsOf := func(peerFlags uint32) map[string]uint32 {
+		conn := &indexRecorder{FakeConnection: FakeConnection{id: device1}}
+		if _, err := sendIndexTo(true, 0, conn, "default", fs, ignore.New(false), selected, folderLimiter{}, peerFlags); err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]uint32)
+		for _, f := range conn.files {
+			res[f.Name] = f.Flags
+		}
+		return res
+	}
+
+	// A device that only knows about the flags in the protocol
+
+	flags := flagsOf(protocol.FlagsAll)
+	if len(flags) != 2 {
+		t.Errorf("Expected two files sent to older device, got %v", flags)
+	}
+	if flags["hidden"] != 0644 {
+		t.Errorf("Incorrect flags %o for hidden file", flags["hidden"])
+	}
+	if _, ok := flags["link"]; ok {
+		t.Error("Hard link should not be sent to older device")
+	}
+	if flags["local"] != protocol.FlagInvalid|0644 {
+		t.Errorf("Incorrect flags %o for locally changed file", flags["local"])
+	}
+
+	// A device that understands all our flags
+
+	flags = flagsOf(db.FlagsAll &^ db.FlagLocalChange)
+	if flags["hidden"] != db.FlagHidden|0644 {
+		t.Errorf("Incorrect flags %o for hidden file", flags["hidden"])
+	}
+	if flags["link"] != db.FlagHardLink|0644 {
+		t.Errorf("Incorrect flags %o for hard link", flags["link"])
+	}
+	if flags["local"] != protocol.FlagInvalid|0644 {
+		t.Errorf("Incorrect flags %o for locally changed file", flags["local"])
+	}
+}
+
+func TestDeviceFlagsAfterClose(t *testing.T) {
+	raw := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddConnection(&closeRecorder{}, FakeConnection{id: device1})
+
+	// Waiting for the cluster config of a device that goes away before
+	// sending one must not block.
+
+	done := make(chan uint32)
+	go func() {
+		done <- m.deviceFlagsFunc(device1)()
+	}()
+	m.Close(device1, errors.New("closed"))
+
+	select {
+	case flags := <-done:
+		if flags != protocol.FlagsAll {
+			t.Errorf("Incorrect flags %x for closed device", flags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Still waiting for the cluster config of a closed device")
+	}
+}
+
+func TestReceiveOnlyRevert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receiveonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{".stfolder": "", "addition": "", "shared": "local"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:              "ro",
+		RawPath:         dir,
+		ReceiveOnly:     true,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Copiers:         1,
+		Pullers:         1,
+		Hashers:         1,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	// The other device has different contents for "shared".
+
+	remote := []byte("remote")
+	blocks, _ := scanner.Blocks(bytes.NewReader(remote), protocol.BlockSize, 0)
+	fc := FakeConnection{
+		id:          device1,
+		requestData: remote,
+	}
+	m.AddConnection(fc, fc)
+	m.Index(device1, "ro", []protocol.FileInfo{
+		{
+			Name:     "shared",
+			Flags:    0644,
+			Modified: time.Now().Add(-time.Hour).Unix(),
+			Version:  protocol.Vector{{ID: device1.Short(), Value: 1}},
+			Blocks:   blocks,
+		},
+	}, 0, nil)
+
+	m.StartFolderRW("ro")
+	if err := m.ScanFolder("ro"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"addition", "shared"} {
+		f, ok := m.CurrentFolderFile("ro", name)
+		if !ok || f.Flags&db.FlagLocalChange == 0 || !f.IsInvalid() {
+			t.Fatalf("Local %s should be flagged as a local change: %v", name, f)
+		}
+	}
+	if _, ok := m.CurrentGlobalFile("ro", "addition"); ok {
+		t.Error("Local addition should not be part of the global index")
+	}
+	if files := m.LocalChangedFiles("ro"); len(files) != 2 {
+		t.Errorf("Incorrect number of local changes %d != 2", len(files))
+	}
+
+	// Reverting only the addition leaves the other change alone.
+
+	m.Revert("ro", []string{"addition"})
+	if _, err := os.Stat(filepath.Join(dir, "addition")); !os.IsNotExist(err) {
+		t.Error("Local addition should have been removed:", err)
+	}
+	if files := m.LocalChangedFiles("ro"); len(files) != 1 || files[0].Name != "shared" {
+		t.Errorf("Incorrect local changes %v after partial revert", files)
+	}
+
+	m.Revert("ro", nil)
+
+	// A scan before the puller gets to it must not bring the local change
+	// back.
+
+	if err := m.ScanFolder("ro"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "addition")); !os.IsNotExist(err) {
+		t.Error("Local addition should have been removed:", err)
+	}
+	if files := m.LocalChangedFiles("ro"); len(files) != 0 {
+		t.Errorf("Incorrect number of local changes %d != 0", len(files))
+	}
+
+	timeout := time.Now().Add(10 * time.Second)
+	for {
+		bs, _ := ioutil.ReadFile(filepath.Join(dir, "shared"))
+		if bytes.Equal(bs, remote) {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("Local change was not reverted, contents %q", bs)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestPathMatcher(t *testing.T) {
+	matches := pathMatcher([]string{"docs/", "photos/*.jpg"})
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"docs", true},
+		{"docs/a/b.txt", true},
+		{"docsx/a.txt", false},
+		{"photos/a.jpg", true},
+		{"photos/a.png", false},
+		{"photos/sub/a.jpg", false},
+		{"a.txt", false},
+	}
+	for _, tc := range cases {
+		if ok := matches(filepath.FromSlash(tc.name)); ok != tc.ok {
+			t.Errorf("%q: got %v, expected %v", tc.name, ok, tc.ok)
+		}
+	}
+
+	if !pathMatcher(nil)("anything") {
+		t.Error("Without paths, everything should match")
+	}
+}
+
+func TestHardLinkRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hardlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:              "default",
+		RawPath:         dir,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Copiers:         1,
+		Pullers:         1,
+		Hashers:         1,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other device has the same "a" and "b" as a hard link to it.
+
+	a, ok := m.CurrentFolderFile("default", "a")
+	if !ok {
+		t.Fatal("a not scanned")
+	}
+	b := protocol.FileInfo{
+		Name:     "b",
+		Flags:    db.FlagHardLink | 0644,
+		Modified: a.Modified,
+		Version:  protocol.Vector{{ID: device1.Short(), Value: 1}},
+		Blocks:   scanner.HardLinkBlocks("a"),
+	}
+	m.Index(device1, "default", []protocol.FileInfo{a, b}, 0, nil)
+
+	p := newRWFolder(m, m.shortID, fcfg)
+	p.pullerIteration(ignore.New(false))
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "b"))
+	if err != nil || string(bs) != "hello" {
+		t.Fatalf("Hard link not created: %q, %v", bs, err)
+	}
+	lb, ok := m.CurrentFolderFile("default", "b")
+	if !ok || !lb.Version.Equal(b.Version) {
+		t.Fatalf("Hard link not recorded: %v", lb)
+	}
+
+	// Rescanning, with and without looking for hard links, must not find
+	// any changes or the devices would keep announcing new versions to each
+	// other.
+
+	for _, detect := range []bool{false, true} {
+		m.fmut.Lock()
+		fcfg.DetectHardLinks = detect
+		m.folderCfgs["default"] = fcfg
+		m.fmut.Unlock()
+
+		if err := m.ScanFolder("default"); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []protocol.FileInfo{a, b} {
+			if cur, ok := m.CurrentFolderFile("default", f.Name); !ok || !cur.Version.Equal(f.Version) {
+				t.Errorf("%s changed by rescan (detect %v): %v", f.Name, detect, cur)
+			}
+		}
+	}
+}
+
+func TestSubtreeSelection(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		RawPath: "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	raw := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	blocks := []protocol.BlockInfo{{Size: 100, Hash: []byte("some hash bytes")}}
+	version := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: filepath.Join("a", "file"), Flags: 0644, Version: version, Blocks: blocks},
+		{Name: filepath.Join("b", "file"), Flags: 0644, Version: version, Blocks: blocks},
+	}, 0, nil)
+
+	if files, _ := m.NeedSize("default"); files != 2 {
+		t.Errorf("Incorrect number of needed files %d != 2", files)
+	}
+
+	// Selecting a subtree takes effect without a restart.
+
+	to := raw.Copy()
+	to.Folders[0].Subtrees = []string{"a"}
+	if !m.CommitConfiguration(raw, to) {
+		t.Fatal("Changing subtrees should not require a restart")
+	}
+
+	if files, bytes := m.NeedSize("default"); files != 1 || bytes != 100 {
+		t.Errorf("Incorrect need %d files, %d bytes != 1 file, 100 bytes", files, bytes)
+	}
+	if _, _, _, total := m.NeedFolderFiles("default", 1, 10, "", config.OrderRandom); total != 1 {
+		t.Errorf("Incorrect number of needed files %d != 1", total)
+	}
+	if c := m.Completion(protocol.LocalDeviceID, "default"); c != 0 {
+		t.Errorf("Incorrect completion %f != 0", c)
+	}
+	if sel := m.selection("default"); !sel(filepath.Join("a", "file")) || sel(filepath.Join("b", "file")) {
+		t.Error("Incorrect selection")
+	}
+}
+
+func TestPauseFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:              "default",
+		RawPath:         dir,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Paused:          true,
+	}
+	raw := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.CurrentFolderFile("default", "a"); ok {
+		t.Error("Paused folder should not be scanned")
+	}
+	if state, _, _ := m.State("default"); state != "paused" {
+		t.Errorf("Incorrect state %q != paused", state)
+	}
+
+	to := raw.Copy()
+	to.Folders[0].Paused = false
+	if !m.CommitConfiguration(raw, to) {
+		t.Fatal("Resuming a folder should not require a restart")
+	}
+
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.CurrentFolderFile("default", "a"); !ok {
+		t.Error("Resumed folder should be scanned")
+	}
+	if state, _, _ := m.State("default"); state == "paused" {
+		t.Error("Resumed folder should not be paused")
+	}
+}
+
+// ccRecorder is a connection that passes on the cluster configs sent on it.
+type ccRecorder struct {
+	FakeConnection
+	cms chan protocol.ClusterConfigMessage
+}
+
+func (c ccRecorder) ClusterConfig(cm protocol.ClusterConfigMessage) {
+	c.cms <- cm
+}
+
+func TestFolderStateAnnounced(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		RawPath: "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	raw := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	fc := ccRecorder{FakeConnection{id: device1}, make(chan protocol.ClusterConfigMessage, 2)}
+	m.AddConnection(fc, fc)
+	if cm := <-fc.cms; len(cm.Folders[0].Options) != 0 {
+		t.Errorf("Unexpected options %v for a folder being synced", cm.Folders[0].Options)
+	}
+
+	// Pausing the folder tells the connected device about it.
+
+	to := raw.Copy()
+	to.Folders[0].Paused = true
+	if !m.CommitConfiguration(raw, to) {
+		t.Fatal("Pausing a folder should not require a restart")
+	}
+	select {
+	case cm := <-fc.cms:
+		if state := remoteFolderStates(cm)["default"]; state != folderStatePaused {
+			t.Errorf("Incorrect announced state %q != paused", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No cluster config sent for the paused folder")
+	}
+
+	// The state the device announces is kept until it changes.
+
+	cm := protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Folders: []protocol.Folder{{
+			ID:      "default",
+			Options: []protocol.Option{{Key: folderStateOption, Value: folderStateError}},
+		}},
+	}
+	m.ClusterConfig(device1, cm)
+	if state := m.RemoteFolderState(device1, "default"); state != folderStateError {
+		t.Errorf("Incorrect remote state %q != error", state)
+	}
+	cm.Folders[0].Options = nil
+	m.ClusterConfig(device1, cm)
+	if state := m.RemoteFolderState(device1, "default"); state != "" {
+		t.Errorf("Incorrect remote state %q after it was cleared", state)
+	}
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPauseDevice(t *testing.T) {
+	raw := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+
+	rc1, rc2 := &closeRecorder{}, &closeRecorder{}
+	m.AddConnection(rc1, FakeConnection{id: device1})
+	m.AddConnection(rc2, FakeConnection{id: device2})
+
+	to := raw.Copy()
+	to.Devices[0].Paused = true
+	if !m.CommitConfiguration(raw, to) {
+		t.Fatal("Pausing a device should not require a restart")
+	}
+
+	if !rc1.closed {
+		t.Error("Connection to paused device should be closed")
+	}
+	if rc2.closed {
+		t.Error("Connection to other device should remain open")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	raw := config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+
+	rc := &closeRecorder{}
+	m.AddConnection(rc, FakeConnection{id: device1})
+
+	m.Disconnect(device1)
+	if !rc.closed {
+		t.Error("Connection should be closed")
+	}
+
+	// The model lets go of the connection once told it's closed, after
+	// which a new one can be added.
+
+	m.Close(device1, errors.New("closed"))
+	if m.ConnectedTo(device1) {
+		t.Error("Device should not be connected")
+	}
+	m.AddConnection(&closeRecorder{}, FakeConnection{id: device1})
+	if !m.ConnectedTo(device1) {
+		t.Error("Device should be connected")
+	}
+}
+
+func TestReducedActivity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reduced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:              "default",
+		RawPath:         dir,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Copiers:         1,
+		Pullers:         1,
+		Hashers:         1,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	// A directory and a file too large to pull while activity is reduced.
+
+	var blocks []protocol.BlockInfo
+	for i := int64(0); i <= reducedMaxPullSize/protocol.BlockSize; i++ {
+		blocks = append(blocks, protocol.BlockInfo{Offset: i * protocol.BlockSize, Size: protocol.BlockSize, Hash: []byte("hash")})
+	}
+	version := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "big", Flags: 0644, Version: version, Blocks: blocks},
+		{Name: "dir", Flags: protocol.FlagDirectory | 0755, Version: version},
+	}, 0, nil)
+
+	m.SetReducedActivity(true)
+	p := newRWFolder(m, m.shortID, fcfg)
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Errorf("Expected only the directory to be handled, not %d items", changed)
+	}
+	if _, ok := m.CurrentFolderFile("default", "dir"); !ok {
+		t.Error("Directory should be created while activity is reduced")
+	}
+
+	m.SetReducedActivity(false)
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Errorf("Expected the large file to be handled, not %d items", changed)
+	}
+}
+
+func TestFolderQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:              "default",
+		RawPath:         dir,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Copiers:         1,
+		Pullers:         1,
+		Hashers:         1,
+		QuotaMiB:        1,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	// A two MiB file doesn't fit in the one MiB quota.
+
+	var blocks []protocol.BlockInfo
+	for i := int64(0); i < 16; i++ {
+		blocks = append(blocks, protocol.BlockInfo{Offset: i * protocol.BlockSize, Size: protocol.BlockSize, Hash: []byte("hash")})
+	}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "big", Flags: 0644, Version: protocol.Vector{{ID: device1.Short(), Value: 1}}, Blocks: blocks},
+	}, 0, nil)
+
+	p := newRWFolder(m, m.shortID, fcfg)
+	p.pullerIteration(ignore.New(false))
+
+	if !m.QuotaExceeded("default") {
+		t.Error("Folder quota should be exceeded")
+	}
+	if items := p.FailedItems(); len(items) != 1 || items[0].Error != errQuotaExceeded.Error() {
+		t.Errorf("Expected the file to fail on the quota, not %+v", items)
+	}
+	if _, err := os.Stat(filepath.Join(dir, defTempNamer.TempName("big"))); err == nil {
+		t.Error("No data should be written beyond the quota")
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "barrier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:              "default",
+		RawPath:         dir,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Copiers:         1,
+		Pullers:         1,
+		Hashers:         1,
+		Barrier:         true,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other device has "b", which we can copy from "a", and "c", which
+	// we can't get from anywhere.
+
+	a, _ := m.CurrentFolderFile("default", "a")
+	version := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	b := protocol.FileInfo{Name: "b", Flags: 0644, Modified: a.Modified, Version: version, Blocks: a.Blocks}
+	c := protocol.FileInfo{Name: "c", Flags: 0644, Modified: a.Modified, Version: version, Blocks: []protocol.BlockInfo{{Size: 5, Hash: []byte("unavailable")}}}
+	m.Index(device1, "default", []protocol.FileInfo{a, b, c}, 0, nil)
+
+	p := newRWFolder(m, m.shortID, fcfg)
+	p.pullerIteration(ignore.New(false))
+
+	if _, err := os.Stat(filepath.Join(dir, "b")); err == nil {
+		t.Error("b should be held back while c is unavailable")
+	}
+	if _, err := os.Stat(filepath.Join(dir, defTempNamer.TempName("b"))); err != nil {
+		t.Error("b should be staged in its temporary file:", err)
+	}
+
+	// Once c is gone, nothing holds b back.
+
+	c.Flags |= protocol.FlagDeleted
+	c.Blocks = nil
+	c.Version = c.Version.Update(device1.Short())
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{c}, 0, nil)
+
+	p.pullerIteration(ignore.New(false))
+
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, "b")); err != nil || string(bs) != "hello" {
+		t.Errorf("b should be in place, %q, %v", bs, err)
 	}
+}
 
-	ignores, _, err = m.GetIgnores("doesnotexist")
-	if err == nil {
-		t.Error("No error")
-	}
+func TestQuietHours(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.QuietHours = []config.TimeWindow{{Start: "00:00", End: "00:00"}}
+	raw := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	}.Copy()
 
-	err = m.SetIgnores("doesnotexist", expected)
-	if err == nil {
-		t.Error("No error")
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	if state, _, _ := m.State("default"); state != "quiet" {
+		t.Errorf("Folder should be quiet all day, not %q", state)
+	}
+	if _, err := m.Request(device1, "default", "foo", 0, 6, nil, 0, nil); err != errQuietHours {
+		t.Errorf("Request during quiet hours should be refused, not %v", err)
 	}
 
-	m.AddFolder(config.FolderConfiguration{ID: "fresh", RawPath: "XXX"})
-	ignores, _, err = m.GetIgnores("fresh")
-	if err != nil {
-		t.Error(err)
+	// Quiet hours can be changed without a restart.
+
+	to := raw.Copy()
+	to.Folders[0].QuietHours = nil
+	if !m.CommitConfiguration(raw, to) {
+		t.Fatal("Changing quiet hours should not require a restart")
 	}
-	if len(ignores) > 0 {
-		t.Errorf("Expected no ignores, got: %v", ignores)
+	if _, err := m.Request(device1, "default", "foo", 0, 6, nil, 0, nil); err != nil {
+		t.Error("Request outside quiet hours should succeed:", err)
 	}
 }
 
-func TestRefuseUnknownBits(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
-	m.AddFolder(defaultFolderConfig)
-
-	m.ScanFolder("default")
-	m.Index(device1, "default", []protocol.FileInfo{
-		{
-			Name:  "invalid1",
-			Flags: (protocol.FlagsAll + 1) &^ protocol.FlagInvalid,
-		},
-		{
-			Name:  "invalid2",
-			Flags: (protocol.FlagsAll + 2) &^ protocol.FlagInvalid,
-		},
-		{
-			Name:  "invalid3",
-			Flags: (1 << 31) &^ protocol.FlagInvalid,
-		},
-		{
-			Name:  "valid",
-			Flags: protocol.FlagsAll &^ (protocol.FlagInvalid | protocol.FlagSymlink),
-		},
-	}, 0, nil)
+func TestCheckFreeSpace(t *testing.T) {
+	free, total, err := osutil.DiskFree(".")
+	if err != nil {
+		t.Skip("Free space is not available on this platform:", err)
+	}
 
-	for _, name := range []string{"invalid1", "invalid2", "invalid3"} {
-		f, ok := m.CurrentGlobalFile("default", name)
-		if ok || f.Name == name {
-			t.Error("Invalid file found or name match")
-		}
+	if err := checkFreeSpace(".", 0, 0, 0); err != nil {
+		t.Error("Unexpected error without limits:", err)
 	}
-	f, ok := m.CurrentGlobalFile("default", "valid")
-	if !ok || f.Name != "valid" {
-		t.Error("Valid file not found or name mismatch", ok, f)
+	if err := checkFreeSpace(".", 0, 1, 0); free > 1<<20 && err != nil {
+		t.Error("Unexpected error with 1 MiB limit:", err)
+	}
+	if err := checkFreeSpace(".", 0, 1, free); err == nil {
+		t.Error("Filling the disk should leave less than 1 MiB free")
+	}
+	if err := checkFreeSpace(".", 100*float64(free)/float64(total)+1, 0, 0); err == nil {
+		t.Error("Percentage limit above what's free should be exceeded")
 	}
 }
 
@@ -760,7 +1721,8 @@ func TestGlobalDirectoryTree(t *testing.T) {
 		}
 	}
 
-	filedata := []interface{}{time.Unix(0x666, 0), 0xa}
+	// All files are from the other device, so we need them.
+	filedata := []interface{}{time.Unix(0x666, 0), 0xa, "needed"}
 
 	testdata := []protocol.FileInfo{
 		b(false, "another"),
@@ -987,6 +1949,166 @@ func TestGlobalDirectoryTree(t *testing.T) {
 	if mm(result) != mm(currentResult) {
 		t.Errorf("Does not match:\n%s\n%s", mm(result), mm(currentResult))
 	}
+	// Once we have the file, it's in sync.
+	m.fmut.RLock()
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{b(true, "rootfile")})
+	m.fmut.RUnlock()
+
+	result = m.GlobalDirectoryTree("default", "", 0, false)
+	if data := result["rootfile"].([]interface{}); data[2] != "synced" {
+		t.Errorf("Incorrect state %v for a file we have", data[2])
+	}
+}
+
+func TestRemoteNeedHave(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	block := func(hash byte) protocol.BlockInfo {
+		return protocol.BlockInfo{Size: 10, Hash: []byte{hash}}
+	}
+	file := func(name string, version uint64, blocks ...protocol.BlockInfo) protocol.FileInfo {
+		return protocol.FileInfo{
+			Name:    name,
+			Version: protocol.Vector{{ID: 1, Value: version}},
+			Blocks:  blocks,
+		}
+	}
+
+	// The other device has an older version of "a", sharing one of two
+	// blocks with ours, and none of "b".
+
+	m.fmut.RLock()
+	m.folderFiles["default"].Update(protocol.LocalDeviceID, []protocol.FileInfo{
+		file("a", 2, block(1), block(3)),
+		file("b", 1, block(4)),
+		file("c", 1, block(5)),
+	})
+	m.fmut.RUnlock()
+	m.Index(device1, "default", []protocol.FileInfo{
+		file("a", 1, block(1), block(2)),
+		file("c", 1, block(5)),
+	}, 0, nil)
+
+	need, total := m.RemoteNeedFiles(device1, "default", 1, 10)
+	if total != 2 || len(need) != 2 {
+		t.Fatalf("Incorrect need %v, %d", need, total)
+	}
+	if need[0].Name != "a" || need[0].Completion != 50 {
+		t.Errorf("Incorrect completion %v for a", need[0].Completion)
+	}
+	if need[1].Name != "b" || need[1].Completion != 0 {
+		t.Errorf("Incorrect completion %v for b", need[1].Completion)
+	}
+
+	need, total = m.RemoteNeedFiles(device1, "default", 2, 1)
+	if total != 2 || len(need) != 1 || need[0].Name != "b" {
+		t.Errorf("Incorrect second page %v", need)
+	}
+
+	have, total := m.RemoteHaveFiles(device1, "default", 1, 10)
+	if total != 2 || len(have) != 2 || have[0].Name != "a" || have[1].Name != "c" {
+		t.Errorf("Incorrect have %v, %d", have, total)
+	}
+}
+
+func TestSearchFiles(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	var files []protocol.FileInfo
+	for _, name := range []string{"docs/Report.pdf", "docs/notes.txt", "photos/report.jpg", "src/main.go", "old.txt"} {
+		files = append(files, protocol.FileInfo{Name: filepath.FromSlash(name), Version: protocol.Vector{{ID: 1, Value: 1}}})
+	}
+	files[4].Flags = protocol.FlagDeleted
+	m.Index(device1, "default", files, 0, nil)
+
+	names := func(fs []FoundFile) []string {
+		var res []string
+		for _, f := range fs {
+			if f.Folder != "default" {
+				t.Errorf("Incorrect folder %q", f.Folder)
+			}
+			res = append(res, filepath.ToSlash(f.Name))
+		}
+		return res
+	}
+
+	cases := []struct {
+		folder, query string
+		expected      []string
+	}{
+		{"default", "report", []string{"docs/Report.pdf", "photos/report.jpg"}},
+		{"", "REPORT", []string{"docs/Report.pdf", "photos/report.jpg"}},
+		{"default", "*.txt", []string{"docs/notes.txt"}},
+		{"default", "src/*", []string{"src/main.go"}},
+		{"default", "old", nil},
+		{"other", "report", nil},
+	}
+	for _, tc := range cases {
+		found, total := m.SearchFiles(tc.folder, tc.query, 1, 10)
+		if res := names(found); !reflect.DeepEqual(res, tc.expected) || total != len(tc.expected) {
+			t.Errorf("%q in %q: got %v, %d, expected %v", tc.query, tc.folder, res, total, tc.expected)
+		}
+	}
+
+	found, total := m.SearchFiles("", "o", 2, 2)
+	if res := names(found); total != 4 || !reflect.DeepEqual(res, []string{"photos/report.jpg", "src/main.go"}) {
+		t.Errorf("Incorrect second page %v of %d", res, total)
+	}
+}
+
+func TestNeedFolderFilesOrder(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	file := func(name string, size int32, modified int64) protocol.FileInfo {
+		return protocol.FileInfo{
+			Name:     name,
+			Modified: modified,
+			Version:  protocol.Vector{{ID: 1, Value: 1}},
+			Blocks:   []protocol.BlockInfo{{Size: size, Hash: []byte{byte(size)}}},
+		}
+	}
+	m.Index(device1, "default", []protocol.FileInfo{
+		file("a.txt", 30, 3),
+		file("b.jpg", 10, 1),
+		file("c.txt", 20, 4),
+		file("d.jpg", 40, 2),
+	}, 0, nil)
+
+	names := func(fs []db.FileInfoTruncated) []string {
+		var res []string
+		for _, f := range fs {
+			res = append(res, f.Name)
+		}
+		return res
+	}
+
+	cases := []struct {
+		page, perpage int
+		filter        string
+		order         config.PullOrder
+		expected      []string
+		total         int
+	}{
+		{1, 10, "", config.OrderRandom, []string{"a.txt", "b.jpg", "c.txt", "d.jpg"}, 4},
+		{2, 3, "", config.OrderAlphabetic, []string{"d.jpg"}, 4},
+		{1, 10, "*.txt", config.OrderRandom, []string{"a.txt", "c.txt"}, 2},
+		{1, 10, "", config.OrderLargestFirst, []string{"d.jpg", "a.txt", "c.txt", "b.jpg"}, 4},
+		{2, 2, "", config.OrderSmallestFirst, []string{"a.txt", "d.jpg"}, 4},
+		{1, 10, "JPG", config.OrderNewestFirst, []string{"d.jpg", "b.jpg"}, 2},
+		{3, 2, "", config.OrderOldestFirst, nil, 4},
+	}
+	for i, tc := range cases {
+		_, _, rest, total := m.NeedFolderFiles("default", tc.page, tc.perpage, tc.filter, tc.order)
+		if res := names(rest); !reflect.DeepEqual(res, tc.expected) || total != tc.total {
+			t.Errorf("%d: got %v, %d, expected %v, %d", i, res, total, tc.expected, tc.total)
+		}
+	}
 }
 
 func TestGlobalDirectorySelfFixing(t *testing.T) {
@@ -1009,7 +2131,7 @@ func TestGlobalDirectorySelfFixing(t *testing.T) {
 		}
 	}
 
-	filedata := []interface{}{time.Unix(0x666, 0).Format(time.RFC3339), 0xa}
+	filedata := []interface{}{time.Unix(0x666, 0).Format(time.RFC3339), 0xa, "needed"}
 
 	testdata := []protocol.FileInfo{
 		b(true, "another", "directory", "afile"),
@@ -1177,3 +2299,344 @@ func benchmarkTree(b *testing.B, n1, n2 int) {
 	}
 	b.ReportAllocs()
 }
+
+func TestPullNow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pullnow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:              "default",
+		RawPath:         dir,
+		RescanIntervalS: 3600,
+		Devices:         []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		Copiers:         1,
+		Pullers:         1,
+		Hashers:         1,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	var blocks []protocol.BlockInfo
+	for i := int64(0); i <= reducedMaxPullSize/protocol.BlockSize; i++ {
+		blocks = append(blocks, protocol.BlockInfo{Offset: i * protocol.BlockSize, Size: protocol.BlockSize, Hash: []byte("hash")})
+	}
+	version := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "big", Flags: 0644, Version: version, Blocks: blocks},
+		{Name: "other", Flags: 0644, Version: version, Blocks: blocks},
+	}, 0, nil)
+
+	if !m.NeedsFile("default", "big") {
+		t.Error("File should be needed")
+	}
+	if m.NeedsFile("default", "nonexistent") {
+		t.Error("Nonexistent file should not be needed")
+	}
+	if _, err := m.PullNow("nonexistent", "big"); err == nil {
+		t.Error("Unexpected nil error for nonexistent folder")
+	}
+
+	// A file asked for is pulled even while activity is reduced, the others
+	// wait.
+	m.SetReducedActivity(true)
+	p := newRWFolder(m, m.shortID, fcfg)
+	p.PullNow("big")
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Errorf("Expected only the urgent file to be handled, not %d items", changed)
+	}
+	if changed := p.pullerIteration(ignore.New(false)); changed != 0 {
+		t.Errorf("Expected nothing to be handled, not %d items", changed)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Devices: []config.DeviceConfiguration{{DeviceID: device1, Compression: protocol.CompressAlways}},
+	})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+
+	cm := m.clusterConfig(device1)
+	if opt := cm.GetOption("compression"); opt != "always" {
+		t.Errorf("Incorrect compression option %q", opt)
+	}
+
+	// Until we know better we use what we're configured for.
+	if c := m.NegotiateCompression(device1); c != protocol.CompressAlways {
+		t.Errorf("Incorrect compression %v before cluster config", c)
+	}
+
+	fc := FakeConnection{id: device1}
+	m.AddConnection(fc, fc)
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Options:       []protocol.Option{{Key: "compression", Value: "never"}},
+	})
+	if c := m.NegotiateCompression(device1); c != protocol.CompressNever {
+		t.Errorf("Incorrect compression %v after cluster config", c)
+	}
+
+	// The device asking for more doesn't make us compress more.
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Options:       []protocol.Option{{Key: "compression", Value: "always"}},
+	})
+	cfg.SetDevice(config.DeviceConfiguration{DeviceID: device1, Compression: protocol.CompressMetadata})
+	if c := m.NegotiateCompression(device1); c != protocol.CompressMetadata {
+		t.Errorf("Incorrect compression %v", c)
+	}
+
+	// Nor at all without an algorithm in common.
+	if opt := cm.GetOption("compressionAlgorithms"); opt != "lz4" {
+		t.Errorf("Incorrect compression algorithms option %q", opt)
+	}
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Options: []protocol.Option{
+			{Key: "compression", Value: "always"},
+			{Key: "compressionAlgorithms", Value: "zstd"},
+		},
+	})
+	if c := m.NegotiateCompression(device1); c != protocol.CompressNever {
+		t.Errorf("Incorrect compression %v without a common algorithm", c)
+	}
+}
+
+func TestExtraConnections(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	extra := FakeConnection{id: device1, requestData: []byte("extra")}
+	newExtra := func(receiver protocol.Model) protocol.Connection {
+		return extra
+	}
+
+	if m.AddExtraConnection(device1, extra, newExtra) {
+		t.Error("Extra connection added to unconnected device")
+	}
+
+	fc := FakeConnection{id: device1, requestData: []byte("first")}
+	m.AddConnection(fc, fc)
+	if !m.AddExtraConnection(device1, extra, newExtra) {
+		t.Fatal("Extra connection not added")
+	}
+	if n := m.Connections(device1); n != 2 {
+		t.Errorf("Expected 2 connections, not %d", n)
+	}
+
+	// Requests take turns between the connections.
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		data, err := m.requestGlobal(device1, "default", "foo", 0, 5, nil, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)]++
+	}
+	if seen["first"] != 2 || seen["extra"] != 2 {
+		t.Errorf("Requests not spread over the connections: %v", seen)
+	}
+
+	// Losing the extra connection leaves the device connected.
+	m.pmut.RLock()
+	ec := m.extraConns[device1][0]
+	m.pmut.RUnlock()
+	ec.Close(device1, errors.New("test"))
+	if n := m.Connections(device1); n != 1 {
+		t.Errorf("Expected 1 connection, not %d", n)
+	}
+
+	// Losing the first one closes them all.
+	m.AddExtraConnection(device1, extra, newExtra)
+	m.Close(device1, errors.New("test"))
+	if n := m.Connections(device1); n != 0 {
+		t.Errorf("Expected no connections, not %d", n)
+	}
+	m.pmut.RLock()
+	n := len(m.extraConns[device1])
+	m.pmut.RUnlock()
+	if n != 0 {
+		t.Errorf("Extra connections left after close: %d", n)
+	}
+}
+
+func TestConnectionInfoJSON(t *testing.T) {
+	started := time.Now().Add(-10 * time.Second)
+	info := ConnectionInfo{
+		Statistics: protocol.Statistics{
+			At:            started.Add(10 * time.Second),
+			InBytesTotal:  1000,
+			OutBytesTotal: 5000,
+		},
+		InBytesRate: 42,
+		RTT:         1500 * time.Microsecond,
+		StartedAt:   started,
+		Crypto:      cryptoDescription(tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}),
+		Type:        "LAN",
+	}
+
+	bs, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(bs, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"inBytesRate":     42.0,
+		"inBytesAvgRate":  100.0,
+		"outBytesAvgRate": 500.0,
+		"rttMs":           1.5,
+		"crypto":          "TLS1.2-ECDHE-RSA-AES128-GCM-SHA256",
+		"type":            "LAN",
+	}
+	for key, val := range expected {
+		if res[key] != val {
+			t.Errorf("Incorrect %s %v != %v", key, res[key], val)
+		}
+	}
+}
+
+func TestTrafficAccounting(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.Request(device1, "default", "foo", 0, 6, nil, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Denied requests transfer nothing.
+	m.Request(device2, "default", "foo", 0, 6, nil, 0, nil)
+
+	expected := stats.Traffic{OutBytes: 12}
+	if tr := m.DeviceStatistics()[device1.String()].Traffic; tr != expected {
+		t.Errorf("Incorrect device traffic %+v != %+v", tr, expected)
+	}
+	if tr := m.DeviceStatistics()[device2.String()].Traffic; tr != (stats.Traffic{}) {
+		t.Errorf("Incorrect device traffic %+v for a denied device", tr)
+	}
+	if tr := m.FolderStatistics()["default"].Traffic; tr != expected {
+		t.Errorf("Incorrect folder traffic %+v != %+v", tr, expected)
+	}
+
+	// The traffic is kept in the database.
+
+	m.deviceStatRef(device1).SaveTraffic()
+	if tr := stats.NewDeviceStatisticsReference(db, device1).GetStatistics().Traffic; tr != expected {
+		t.Errorf("Incorrect saved device traffic %+v != %+v", tr, expected)
+	}
+}
+
+// fakeAddressBook knows the addresses of device2, and records hints.
+type fakeAddressBook struct {
+	hints map[string][]string
+}
+
+func (b *fakeAddressBook) Known(device protocol.DeviceID) []string {
+	if device == device2 {
+		return []string{"192.0.2.42:22000"}
+	}
+	return nil
+}
+
+func (b *fakeAddressBook) Hint(device string, addrs []string) {
+	b.hints[device] = addrs
+}
+
+func TestAddressExchange(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		RawPath: "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}
+	raw := config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{
+			{DeviceID: device1, Addresses: []string{"dynamic"}},
+			{DeviceID: device2, Addresses: []string{"dynamic", "example.com:22000"}},
+		},
+	}.Copy()
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", raw), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	book := &fakeAddressBook{hints: make(map[string][]string)}
+	m.SetAddressBook(book)
+
+	// device1 is told the addresses of device2, and nothing about itself.
+
+	fc := ccRecorder{FakeConnection{id: device1}, make(chan protocol.ClusterConfigMessage, 1)}
+	m.AddConnection(fc, fc)
+	cm := <-fc.cms
+	addrs := make(map[string]string)
+	for _, dev := range cm.Folders[0].Devices {
+		for _, opt := range dev.Options {
+			if opt.Key == deviceAddrsOption {
+				addrs[protocol.DeviceIDFromBytes(dev.ID).String()] = opt.Value
+			}
+		}
+	}
+	expected := map[string]string{device2.String(): "example.com:22000,192.0.2.42:22000"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Incorrect addresses %v != %v", addrs, expected)
+	}
+
+	// What device1 tells us about device2 is taken, but not about a device
+	// we don't share the folder with.
+
+	var other protocol.DeviceID
+	other[0] = 42
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Folders: []protocol.Folder{{
+			ID: "default",
+			Devices: []protocol.Device{
+				{ID: device2[:], Options: []protocol.Option{{Key: deviceAddrsOption, Value: "198.51.100.7:22000,[2001:db8::1]:22000"}}},
+				{ID: other[:], Options: []protocol.Option{{Key: deviceAddrsOption, Value: "203.0.113.1:22000"}}},
+			},
+		}},
+	})
+	expectedHints := map[string][]string{device2.String(): {"198.51.100.7:22000", "[2001:db8::1]:22000"}}
+	if !reflect.DeepEqual(book.hints, expectedHints) {
+		t.Errorf("Incorrect hints %v != %v", book.hints, expectedHints)
+	}
+}
+
+func TestLastAddress(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	if addr := m.LastAddress(device1); addr != "" {
+		t.Errorf("Unexpected address %q before connecting", addr)
+	}
+	m.SetLastAddress(device1, "192.0.2.42:22000")
+
+	// The address is remembered in the database, across restarts.
+
+	m = NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	if addr := m.LastAddress(device1); addr != "192.0.2.42:22000" {
+		t.Errorf("Incorrect address %q after restart", addr)
+	}
+	if addr := m.DeviceStatistics()[device1.String()].LastAddress; addr != "192.0.2.42:22000" {
+		t.Errorf("Incorrect address %q in statistics", addr)
+	}
+}
@@ -51,29 +51,23 @@ func (t *ProgressEmitter) Serve() {
 	for {
 		select {
 		case <-t.stop:
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("progress emitter: stopping")
 			}
 			return
 		case <-t.timer.C:
 			t.mut.Lock()
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("progress emitter: timer - looking after", len(t.registry))
 			}
-			output := make(map[string]map[string]*pullerProgress)
-			for _, puller := range t.registry {
-				if output[puller.folder] == nil {
-					output[puller.folder] = make(map[string]*pullerProgress)
-				}
-				output[puller.folder][puller.file.Name] = puller.Progress()
-			}
+			output := t.progressLocked("")
 			if !reflect.DeepEqual(t.last, output) {
 				events.Default.Log(events.DownloadProgress, output)
 				t.last = output
-				if debug {
+				if debug.Enabled() {
 					l.Debugf("progress emitter: emitting %#v", output)
 				}
-			} else if debug {
+			} else if debug.Enabled() {
 				l.Debugln("progress emitter: nothing new")
 			}
 			if len(t.registry) != 0 {
@@ -95,7 +89,7 @@ func (t *ProgressEmitter) CommitConfiguration(from, to config.Configuration) boo
 	defer t.mut.Unlock()
 
 	t.interval = time.Duration(to.Options.ProgressUpdateIntervalS) * time.Second
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("progress emitter: updated interval", t.interval)
 	}
 
@@ -112,7 +106,7 @@ func (t *ProgressEmitter) Stop() {
 func (t *ProgressEmitter) Register(s *sharedPullerState) {
 	t.mut.Lock()
 	defer t.mut.Unlock()
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("progress emitter: registering", s.folder, s.file.Name)
 	}
 	if len(t.registry) == 0 {
@@ -125,7 +119,7 @@ func (t *ProgressEmitter) Register(s *sharedPullerState) {
 func (t *ProgressEmitter) Deregister(s *sharedPullerState) {
 	t.mut.Lock()
 	defer t.mut.Unlock()
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("progress emitter: deregistering", s.folder, s.file.Name)
 	}
 	delete(t.registry, filepath.Join(s.folder, s.file.Name))
@@ -141,12 +135,46 @@ func (t *ProgressEmitter) BytesCompleted(folder string) (bytes int64) {
 			bytes += s.Progress().BytesDone
 		}
 	}
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("progress emitter: bytes completed for %s: %d", folder, bytes)
 	}
 	return
 }
 
+// Progress returns the progress of the given file, if it is being pulled.
+func (t *ProgressEmitter) Progress(folder, file string) (*pullerProgress, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	s, ok := t.registry[filepath.Join(folder, file)]
+	if !ok {
+		return nil, false
+	}
+	return s.Progress(), true
+}
+
+// AllProgress returns the progress of the files being pulled in the given
+// folder, or in all folders if it's empty, by folder and file name.
+func (t *ProgressEmitter) AllProgress(folder string) map[string]map[string]*pullerProgress {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.progressLocked(folder)
+}
+
+func (t *ProgressEmitter) progressLocked(folder string) map[string]map[string]*pullerProgress {
+	output := make(map[string]map[string]*pullerProgress)
+	for _, puller := range t.registry {
+		if folder != "" && puller.folder != folder {
+			continue
+		}
+		if output[puller.folder] == nil {
+			output[puller.folder] = make(map[string]*pullerProgress)
+		}
+		output[puller.folder][puller.file.Name] = puller.Progress()
+	}
+	return output
+}
+
 func (t *ProgressEmitter) String() string {
 	return fmt.Sprintf("ProgressEmitter@%p", t)
 }
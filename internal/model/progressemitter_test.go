@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/sync"
@@ -59,7 +60,7 @@ func TestProgressEmitter(t *testing.T) {
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
 
-	s.copyDone()
+	s.copyDone(protocol.BlockInfo{})
 
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
@@ -74,7 +75,7 @@ func TestProgressEmitter(t *testing.T) {
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
 
-	s.pullDone()
+	s.pullDone(protocol.BlockInfo{})
 
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
@@ -85,3 +86,25 @@ func TestProgressEmitter(t *testing.T) {
 	expectTimeout(w, t)
 
 }
+
+func TestProgressEmitterAllProgress(t *testing.T) {
+	c := config.Wrap("/tmp/test", config.Configuration{})
+	p := NewProgressEmitter(c)
+
+	a := sharedPullerState{folder: "default", file: protocol.FileInfo{Name: "a"}, mut: sync.NewMutex()}
+	b := sharedPullerState{folder: "other", file: protocol.FileInfo{Name: "b"}, mut: sync.NewMutex()}
+	p.Register(&a)
+	p.Register(&b)
+	a.copyDone(protocol.BlockInfo{Size: 10})
+	a.copiedFromOrigin()
+
+	all := p.AllProgress("")
+	if len(all) != 2 || all["default"]["a"] == nil || all["other"]["b"] == nil {
+		t.Fatalf("Incorrect progress %v", all)
+	}
+
+	one := p.AllProgress("default")
+	if len(one) != 1 || one["default"]["a"].CopiedFromOrigin != 1 {
+		t.Errorf("Incorrect progress %v for one folder", one["default"]["a"])
+	}
+}
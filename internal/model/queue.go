@@ -16,6 +16,7 @@ import (
 type jobQueue struct {
 	progress []string
 	queued   []jobQueueEntry
+	wanted   []string // asked to be brought to front before being queued
 	mut      sync.Mutex
 }
 
@@ -52,10 +53,38 @@ func (q *jobQueue) Pop() (string, bool) {
 	return f, true
 }
 
+// BringToFront moves the file to the front of the queue. A file that isn't
+// queued yet is remembered and moved to the front by BringWantedToFront once
+// it is.
 func (q *jobQueue) BringToFront(filename string) {
 	q.mut.Lock()
 	defer q.mut.Unlock()
 
+	if q.bringToFront(filename) {
+		return
+	}
+	for _, cur := range q.wanted {
+		if cur == filename {
+			return
+		}
+	}
+	q.wanted = append(q.wanted, filename)
+}
+
+// BringWantedToFront moves the files asked for before they were queued to
+// the front of the queue, most recently asked for first. Files that are still
+// not queued are forgotten.
+func (q *jobQueue) BringWantedToFront() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for _, filename := range q.wanted {
+		q.bringToFront(filename)
+	}
+	q.wanted = nil
+}
+
+func (q *jobQueue) bringToFront(filename string) bool {
 	for i, cur := range q.queued {
 		if cur.name == filename {
 			if i > 0 {
@@ -65,9 +94,10 @@ func (q *jobQueue) BringToFront(filename string) {
 				// Put the selected element at the front
 				q.queued[0] = cur
 			}
-			return
+			return true
 		}
 	}
+	return false
 }
 
 func (q *jobQueue) Done(file string) {
@@ -159,6 +159,35 @@ func TestBringToFront(t *testing.T) {
 	}
 }
 
+func TestBringToFrontBeforeQueued(t *testing.T) {
+	q := newJobQueue()
+	q.BringToFront("f3")
+	q.BringToFront("f5") // never queued
+	q.BringToFront("f2")
+
+	q.Push("f1", 0, 0)
+	q.Push("f2", 0, 0)
+	q.Push("f3", 0, 0)
+	q.Push("f4", 0, 0)
+
+	q.BringWantedToFront()
+
+	_, queued := q.Jobs()
+	if !reflect.DeepEqual(queued, []string{"f2", "f3", "f1", "f4"}) {
+		t.Errorf("Incorrect order %v", queued)
+	}
+
+	// The wishes have been used up.
+
+	q.Push("f5", 0, 0)
+	q.BringWantedToFront()
+
+	_, queued = q.Jobs()
+	if !reflect.DeepEqual(queued, []string{"f2", "f3", "f1", "f4", "f5"}) {
+		t.Errorf("Incorrect order %v", queued)
+	}
+}
+
 func TestShuffle(t *testing.T) {
 	q := newJobQueue()
 	q.Push("f1", 0, 0)
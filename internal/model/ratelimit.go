@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// A folderLimiter holds the send and receive rate limits for a folder. The
+// buckets are shared by everything transferring data for the folder, on all
+// connections. A nil bucket means no limit.
+type folderLimiter struct {
+	send *ratelimit.Bucket
+	recv *ratelimit.Bucket
+}
+
+func newFolderLimiter(cfg config.FolderConfiguration) folderLimiter {
+	var l folderLimiter
+	if cfg.MaxSendKbps > 0 {
+		l.send = osutil.NewRateLimit(cfg.MaxSendKbps)
+	}
+	if cfg.MaxRecvKbps > 0 {
+		l.recv = osutil.NewRateLimit(cfg.MaxRecvKbps)
+	}
+	return l
+}
+
+// waitSend blocks until n bytes may be sent.
+func (l folderLimiter) waitSend(n int) {
+	if l.send != nil {
+		l.send.Wait(int64(n))
+	}
+}
+
+// waitRecv blocks until n bytes may be received.
+func (l folderLimiter) waitRecv(n int) {
+	if l.recv != nil {
+		l.recv.Wait(int64(n))
+	}
+}
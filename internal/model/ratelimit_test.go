@@ -0,0 +1,41 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestFolderLimiter(t *testing.T) {
+	l := newFolderLimiter(config.FolderConfiguration{})
+	if l.send != nil || l.recv != nil {
+		t.Fatal("Unexpected limits on unlimited folder")
+	}
+	// Should not block or panic
+	l.waitSend(1 << 30)
+	l.waitRecv(1 << 30)
+
+	l = newFolderLimiter(config.FolderConfiguration{MaxSendKbps: 100, MaxRecvKbps: 200})
+	if r := l.send.Rate(); r != 100e3 {
+		t.Errorf("Incorrect send rate %v", r)
+	}
+	if r := l.recv.Rate(); r != 200e3 {
+		t.Errorf("Incorrect receive rate %v", r)
+	}
+
+	// The bucket starts out full with five seconds worth of data, anything
+	// beyond that has to wait.
+	if d := l.recv.Take(5 * 200e3); d != 0 {
+		t.Errorf("Unexpected wait %v for initial burst", d)
+	}
+	if d := l.recv.Take(200e3); d < 900*time.Millisecond {
+		t.Errorf("Unexpectedly short wait %v after burst", d)
+	}
+}
@@ -28,8 +28,9 @@ type roFolder struct {
 func newROFolder(model *Model, folder string, interval time.Duration) *roFolder {
 	return &roFolder{
 		stateTracker: stateTracker{
-			folder: folder,
-			mut:    sync.NewMutex(),
+			folder:       folder,
+			mut:          sync.NewMutex(),
+			errorChanged: model.sendClusterConfigs,
 		},
 		folder:    folder,
 		intv:      interval,
@@ -41,7 +42,7 @@ func newROFolder(model *Model, folder string, interval time.Duration) *roFolder
 }
 
 func (s *roFolder) Serve() {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(s, "starting")
 		defer l.Debugln(s, "exiting")
 	}
@@ -56,7 +57,11 @@ func (s *roFolder) Serve() {
 		}
 		// Sleep a random time between 3/4 and 5/4 of the configured interval.
 		sleepNanos := (s.intv.Nanoseconds()*3 + rand.Int63n(2*s.intv.Nanoseconds())) / 4
-		s.timer.Reset(time.Duration(sleepNanos) * time.Nanosecond)
+		intv := time.Duration(sleepNanos) * time.Nanosecond
+		if s.model.ReducedActivity() {
+			intv *= reducedScanFactor
+		}
+		s.timer.Reset(intv)
 	}
 
 	initialScanCompleted := false
@@ -72,7 +77,7 @@ func (s *roFolder) Serve() {
 				continue
 			}
 
-			if debug {
+			if debug.Enabled() {
 				l.Debugln(s, "rescan")
 			}
 
@@ -116,10 +121,16 @@ func (s *roFolder) String() string {
 
 func (s *roFolder) BringToFront(string) {}
 
+func (s *roFolder) PullNow(string) {}
+
 func (s *roFolder) Jobs() ([]string, []string) {
 	return nil, nil
 }
 
+func (s *roFolder) FailedItems() []FailedItem {
+	return nil
+}
+
 func (s *roFolder) DelayScan(next time.Duration) {
 	s.delayScan <- next
 }
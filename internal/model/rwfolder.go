@@ -13,6 +13,8 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/syncthing/protocol"
@@ -20,6 +22,7 @@ import (
 	"github.com/syncthing/syncthing/internal/db"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/ignore"
+	"github.com/syncthing/syncthing/internal/merge"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/symlinks"
@@ -33,6 +36,16 @@ const (
 	pauseIntv     = 60 * time.Second
 	nextPullIntv  = 10 * time.Second
 	shortPullIntv = 5 * time.Second
+
+	tempBlocksSaveIntv = 10 * time.Second
+
+	maxMergeSize = 1 << 20
+
+	// While activity is reduced, folders are scanned reducedScanFactor
+	// times less often and files larger than reducedMaxPullSize are not
+	// pulled.
+	reducedScanFactor  = 4
+	reducedMaxPullSize = 16 << 20
 )
 
 // A pullBlockState is passed to the puller routine for each block that needs
@@ -50,8 +63,11 @@ type copyBlocksState struct {
 }
 
 var (
-	activity    = newDeviceActivity()
-	errNoDevice = errors.New("no available source device")
+	activity            = newDeviceActivity()
+	errNoDevice         = errors.New("no available source device")
+	errNoHardLinkTarget = errors.New("hard link target is not available")
+	errQuotaExceeded    = errors.New("folder quota exceeded")
+	errHeldBack         = errors.New("held back until all needed files are available")
 )
 
 type rwFolder struct {
@@ -66,10 +82,31 @@ type rwFolder struct {
 	scanIntv    time.Duration
 	versioner   versioner.Versioner
 	ignorePerms bool
+	ignoreAttrs bool
+	receiveOnly bool
+	mergeConfl  bool
+	maxConfl    int
 	copiers     int
 	pullers     int
 	shortID     uint64
 	order       config.PullOrder
+	limiter     folderLimiter
+	failures    *failureTracker
+	minFreePct  float64
+	minFreeMiB  int
+	quota       int64 // bytes, zero is unlimited
+	quotaUsed   int64 // by the files we have and are pulling; puller routine only
+	quotaHit    bool  // a file didn't fit this iteration; puller routine only
+	barrier     bool
+	deltaBlocks bool
+
+	// With the barrier, files are staged until all of them are available.
+	staged          []*sharedPullerState // complete temp files; finisher routine only
+	stagedShortcuts []protocol.FileInfo  // metadata updates; puller routine only
+	stagingFailed   bool                 // a file failed; finisher routine only
+
+	urgent    map[string]struct{} // files to pull now, regardless of backoff or reduced activity
+	urgentMut sync.Mutex          // protects urgent
 
 	stop        chan struct{}
 	queue       *jobQueue
@@ -83,8 +120,9 @@ type rwFolder struct {
 func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFolder {
 	return &rwFolder{
 		stateTracker: stateTracker{
-			folder: cfg.ID,
-			mut:    sync.NewMutex(),
+			folder:       cfg.ID,
+			mut:          sync.NewMutex(),
+			errorChanged: m.sendClusterConfigs,
 		},
 
 		model:            m,
@@ -95,10 +133,23 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		dir:         cfg.Path(),
 		scanIntv:    time.Duration(cfg.RescanIntervalS) * time.Second,
 		ignorePerms: cfg.IgnorePerms,
+		ignoreAttrs: cfg.IgnoreAttrs,
+		receiveOnly: cfg.ReceiveOnly,
+		mergeConfl:  cfg.MergeConflicts,
+		maxConfl:    cfg.MaxConflicts,
 		copiers:     cfg.Copiers,
 		pullers:     cfg.Pullers,
 		shortID:     shortID,
 		order:       cfg.Order,
+		limiter:     m.folderLimits[cfg.ID], // The caller holds fmut.
+		failures:    newFailureTracker(),
+		minFreePct:  cfg.MinDiskFreePct,
+		minFreeMiB:  cfg.MinDiskFreeMiB,
+		quota:       int64(cfg.QuotaMiB) << 20,
+		barrier:     cfg.Barrier,
+		deltaBlocks: cfg.DeltaBlocks,
+		urgent:      make(map[string]struct{}),
+		urgentMut:   sync.NewMutex(),
 
 		stop:        make(chan struct{}),
 		queue:       newJobQueue(),
@@ -116,10 +167,55 @@ func (p *rwFolder) ignorePermissions(file protocol.FileInfo) bool {
 	return p.ignorePerms || file.Flags&protocol.FlagNoPermBits != 0
 }
 
+// chtimes is os.Chtimes, replaceable so that tests can simulate filesystems
+// with coarse mtime resolution.
+var chtimes = os.Chtimes
+
+// setMtime sets the modification time of the file at path, which is known
+// as name in the folder. Some filesystems (FAT, ExFAT, many Android mounts)
+// refuse to set the mtime or silently store it with reduced precision. In
+// those cases we remember the intended mtime in the virtual mtime repo so
+// that the scanner doesn't consider the file changed.
+func (p *rwFolder) setMtime(name, path string, t time.Time) error {
+	// An error from Chtimes is handled by the verification below.
+	chtimes(path, t, t)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if diskMtime := info.ModTime(); !diskMtime.Equal(t) {
+		p.virtualMtimeRepo.UpdateMtime(name, diskMtime, t)
+	} else {
+		// The filesystem got it right; make sure a stale record from an
+		// earlier version of the file can't shadow the real mtime.
+		p.virtualMtimeRepo.DeleteMtime(name)
+	}
+	return nil
+}
+
+// setAttributes applies the DOS attributes carried in the file flags, on
+// platforms that have them. On Windows the read-only attribute is what chmod
+// manipulates for the write bits, so it's left alone unless we're ignoring
+// permissions. Directories use read-only for other purposes and never get
+// it.
+func (p *rwFolder) setAttributes(path string, file protocol.FileInfo) error {
+	if p.ignoreAttrs || !osutil.AttributesSupported {
+		return nil
+	}
+
+	mask := osutil.AttributeHidden | osutil.AttributeSystem
+	if p.ignorePermissions(file) && !file.IsDirectory() {
+		mask |= osutil.AttributeReadOnly
+	}
+	return osutil.SetAttributes(path, scanner.FlagsToAttributes(file.Flags), mask)
+}
+
 // Serve will run scans and pulls. It will return when Stop()ed or on a
 // critical error.
 func (p *rwFolder) Serve() {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(p, "starting")
 		defer l.Debugln(p, "exiting")
 	}
@@ -143,8 +239,11 @@ func (p *rwFolder) Serve() {
 		// Sleep a random time between 3/4 and 5/4 of the configured interval.
 		sleepNanos := (p.scanIntv.Nanoseconds()*3 + rand.Int63n(2*p.scanIntv.Nanoseconds())) / 4
 		intv := time.Duration(sleepNanos) * time.Nanosecond
+		if p.model.ReducedActivity() {
+			intv *= reducedScanFactor
+		}
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugln(p, "next rescan in", intv)
 		}
 		p.scanTimer.Reset(intv)
@@ -161,19 +260,49 @@ func (p *rwFolder) Serve() {
 		case <-p.remoteIndex:
 			prevVer = 0
 			p.pullTimer.Reset(shortPullIntv)
-			if debug {
+			if debug.Enabled() {
 				l.Debugln(p, "remote index updated, rescheduling pull")
 			}
 
 		case <-p.pullTimer.C:
 			if !initialScanCompleted {
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(p, "skip (initial)")
 				}
 				p.pullTimer.Reset(nextPullIntv)
 				continue
 			}
 
+			if p.model.folderPaused(p.folder) {
+				if debug.Enabled() {
+					l.Debugln(p, "skip (paused)")
+				}
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
+			if p.model.InQuietHours(p.folder) {
+				if debug.Enabled() {
+					l.Debugln(p, "skip (quiet hours)")
+				}
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
+			if err := p.model.CheckFolderHealth(p.folder); err != nil {
+				l.Infoln("Skipping folder", p.folder, "pull due to folder error:", err)
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
+			// Scanning goes on when we're out of space, but there's no
+			// point in trying to pull anything.
+			if err := checkFreeSpace(p.dir, p.minFreePct, p.minFreeMiB, 0); err != nil {
+				l.Infoln("Skipping folder", p.folder, "pull:", err)
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
 			p.model.fmut.RLock()
 			curIgnores := p.model.folderIgnores[p.folder]
 			p.model.fmut.RUnlock()
@@ -181,7 +310,7 @@ func (p *rwFolder) Serve() {
 			if newHash := curIgnores.Hash(); newHash != prevIgnoreHash {
 				// The ignore patterns have changed. We need to re-evaluate if
 				// there are files we need now that were ignored before.
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(p, "ignore patterns have changed, resetting prevVer")
 				}
 				prevVer = 0
@@ -191,14 +320,14 @@ func (p *rwFolder) Serve() {
 			// RemoteLocalVersion() is a fast call, doesn't touch the database.
 			curVer := p.model.RemoteLocalVersion(p.folder)
 			if curVer == prevVer {
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(p, "skip (curVer == prevVer)", prevVer)
 				}
 				p.pullTimer.Reset(nextPullIntv)
 				continue
 			}
 
-			if debug {
+			if debug.Enabled() {
 				l.Debugln(p, "pulling", prevVer, curVer)
 			}
 			p.setState(FolderSyncing)
@@ -207,11 +336,26 @@ func (p *rwFolder) Serve() {
 				tries++
 
 				changed := p.pullerIteration(curIgnores)
-				if debug {
+				if debug.Enabled() {
 					l.Debugln(p, "changed", changed)
 				}
 
 				if changed == 0 {
+					if next, ok := p.failures.nextRetry(); ok {
+						// There are failed items waiting to be retried, so
+						// we're not in sync. Pull again when the first one
+						// is due.
+						intv := next.Sub(time.Now())
+						if intv < shortPullIntv {
+							intv = shortPullIntv
+						}
+						if debug.Enabled() {
+							l.Debugln(p, "retrying failed items in", intv)
+						}
+						p.pullTimer.Reset(intv)
+						break
+					}
+
 					// No files were changed by the puller, so we are in
 					// sync. Remember the local version number and
 					// schedule a resync a little bit into the future.
@@ -229,7 +373,7 @@ func (p *rwFolder) Serve() {
 						curVer = lv
 					}
 					prevVer = curVer
-					if debug {
+					if debug.Enabled() {
 						l.Debugln(p, "next pull in", nextPullIntv)
 					}
 					p.pullTimer.Reset(nextPullIntv)
@@ -242,7 +386,7 @@ func (p *rwFolder) Serve() {
 					// errors preventing us. Flag this with a warning and
 					// wait a bit longer before retrying.
 					l.Warnf("Folder %q isn't making progress - check logs for possible root cause. Pausing puller for %v.", p.folder, pauseIntv)
-					if debug {
+					if debug.Enabled() {
 						l.Debugln(p, "next pull in", pauseIntv)
 					}
 					p.pullTimer.Reset(pauseIntv)
@@ -261,7 +405,7 @@ func (p *rwFolder) Serve() {
 				continue
 			}
 
-			if debug {
+			if debug.Enabled() {
 				l.Debugln(p, "rescan")
 			}
 
@@ -322,7 +466,7 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	pullWg := sync.NewWaitGroup()
 	doneWg := sync.NewWaitGroup()
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(p, "c", p.copiers, "p", p.pullers)
 	}
 
@@ -363,6 +507,11 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	folderFiles := p.model.folderFiles[p.folder]
 	p.model.fmut.RUnlock()
 
+	if p.quota > 0 {
+		_, _, p.quotaUsed = p.model.LocalSize(p.folder)
+		p.quotaHit = false
+	}
+
 	// !!!
 	// WithNeed takes a database snapshot (by necessity). By the time we've
 	// handled a bunch of files it might have become out of date and we might
@@ -373,7 +522,13 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 
 	fileDeletions := map[string]protocol.FileInfo{}
 	dirDeletions := []protocol.FileInfo{}
+	hardLinks := []protocol.FileInfo{}
 	buckets := map[string][]protocol.FileInfo{}
+	selected := p.model.selection(p.folder)
+	stillFailing := make(map[string]struct{})
+	reduced := p.model.ReducedActivity()
+	held := false // with the barrier, something needed is not handled now
+	urgent := p.takeUrgent()
 
 	folderFiles.WithNeed(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
 		// Needed items are delivered sorted lexicographically. We'll handle
@@ -387,7 +542,39 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 			return true
 		}
 
-		if debug {
+		if !selected(file.Name) {
+			// Outside of the subtrees we sync. Skip it, continue iteration.
+			return true
+		}
+
+		if p.receiveOnly {
+			if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && cur.Flags&db.FlagLocalChange != 0 {
+				// This file has been changed locally. It stays that way
+				// until the change is reverted.
+				return true
+			}
+		}
+
+		_, isUrgent := urgent[file.Name]
+
+		if reduced && !isUrgent && !file.IsDeleted() && file.Size() > reducedMaxPullSize {
+			// Large files wait until activity is back to normal. Skip it,
+			// continue iteration.
+			held = true
+			return true
+		}
+
+		if p.failures.has(file.Name) {
+			stillFailing[file.Name] = struct{}{}
+			if !isUrgent && p.failures.backingOff(file) {
+				// This item has failed before and it's not yet time to
+				// try again. Skip it, continue iteration.
+				held = true
+				return true
+			}
+		}
+
+		if debug.Enabled() {
 			l.Debugln(p, "handling", file.Name)
 		}
 
@@ -403,18 +590,24 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 				// number, hence the deletion coming in again as part of
 				// WithNeed, furthermore, the file can simply be of the wrong
 				// type if we haven't yet managed to pull it.
-				if ok && !df.IsDeleted() && !df.IsSymlink() && !df.IsDirectory() {
-					// Put files into buckets per first hash
+				if ok && !p.barrier && !df.IsDeleted() && !df.IsSymlink() && !df.IsDirectory() && !db.IsHardLink(df) {
+					// Put files into buckets per first hash. With the
+					// barrier, files aren't renamed into place early but
+					// copied and deleted like anything else.
 					key := string(df.Blocks[0].Hash)
 					buckets[key] = append(buckets[key], df)
 				}
 			}
 		case file.IsDirectory() && !file.IsSymlink():
 			// A new or changed directory
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("Creating directory", file.Name)
 			}
 			p.handleDir(file)
+		case db.IsHardLink(file):
+			// Hard links are created once the files they point to are in
+			// place, after the file queue has been processed.
+			hardLinks = append(hardLinks, file)
 		default:
 			// A new or changed file or symlink. This is the only case where we
 			// do stuff concurrently in the background
@@ -425,22 +618,17 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		return true
 	})
 
+	// Forget the failures of items we no longer need.
+
+	p.failures.retain(stillFailing)
+
 	// Reorder the file queue according to configuration
 
-	switch p.order {
-	case config.OrderRandom:
-		p.queue.Shuffle()
-	case config.OrderAlphabetic:
-		// The queue is already in alphabetic order.
-	case config.OrderSmallestFirst:
-		p.queue.SortSmallestFirst()
-	case config.OrderLargestFirst:
-		p.queue.SortLargestFirst()
-	case config.OrderOldestFirst:
-		p.queue.SortOldestFirst()
-	case config.OrderNewestFirst:
-		p.queue.SortOldestFirst()
-	}
+	p.sortQueue()
+
+	// Files that were asked for before they were queued go first.
+
+	p.queue.BringWantedToFront()
 
 	// Process the file queue
 
@@ -462,7 +650,7 @@ nextFile:
 		// number, hence the deletion coming in again as part of
 		// WithNeed, furthermore, the file can simply be of the wrong type if
 		// the global index changed while we were processing this iteration.
-		if !f.IsDeleted() && !f.IsSymlink() && !f.IsDirectory() {
+		if !f.IsDeleted() && !f.IsSymlink() && !f.IsDirectory() && !db.IsHardLink(f) {
 			key := string(f.Blocks[0].Hash)
 			for i, candidate := range buckets[key] {
 				if scanner.BlocksEqual(candidate.Blocks, f.Blocks) {
@@ -503,8 +691,25 @@ nextFile:
 	// Wait for the finisherChan to finish.
 	doneWg.Wait()
 
+	if p.barrier {
+		if held || p.stagingFailed {
+			// Not everything we need is available. Leave all of it, the
+			// complete temporary files included, for the next iteration.
+			l.Infof("Folder %q: holding back changes until all needed files are available", p.folder)
+			p.holdStaged()
+			fileDeletions = nil
+			dirDeletions = nil
+			hardLinks = nil
+		} else {
+			p.applyStaged()
+		}
+		p.staged = nil
+		p.stagedShortcuts = nil
+		p.stagingFailed = false
+	}
+
 	for _, file := range fileDeletions {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("Deleting file", file.Name)
 		}
 		p.deleteFile(file)
@@ -512,7 +717,7 @@ nextFile:
 
 	for i := range dirDeletions {
 		dir := dirDeletions[len(dirDeletions)-i-1]
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("Deleting dir", dir.Name)
 		}
 		p.deleteDir(dir)
@@ -522,9 +727,52 @@ nextFile:
 	close(p.dbUpdates)
 	updateWg.Wait()
 
+	if len(hardLinks) > 0 {
+		// Hard links are checked against the database state of their
+		// targets, so that must include what we just pulled.
+		p.dbUpdates = make(chan protocol.FileInfo)
+		updateWg.Add(1)
+		go func() {
+			p.dbUpdaterRoutine()
+			updateWg.Done()
+		}()
+
+		for _, file := range hardLinks {
+			p.handleHardLink(file)
+		}
+
+		close(p.dbUpdates)
+		updateWg.Wait()
+	}
+
+	if p.quota > 0 {
+		// Files waiting to be retried after hitting the quota earlier still
+		// don't fit.
+		p.model.setQuotaExceeded(p.folder, p.quota, p.quotaHit || p.failures.failedWith(errQuotaExceeded))
+	}
+
 	return changed
 }
 
+// sortQueue reorders the queued files according to the configured pull
+// order. Files are queued in alphabetic order.
+func (p *rwFolder) sortQueue() {
+	switch p.order {
+	case config.OrderRandom:
+		p.queue.Shuffle()
+	case config.OrderAlphabetic:
+		// The queue is already in alphabetic order.
+	case config.OrderSmallestFirst:
+		p.queue.SortSmallestFirst()
+	case config.OrderLargestFirst:
+		p.queue.SortLargestFirst()
+	case config.OrderOldestFirst:
+		p.queue.SortOldestFirst()
+	case config.OrderNewestFirst:
+		p.queue.SortNewestFirst()
+	}
+}
+
 // handleDir creates or updates the given directory
 func (p *rwFolder) handleDir(file protocol.FileInfo) {
 	var err error
@@ -536,6 +784,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 	})
 
 	defer func() {
+		p.failures.record(file, err)
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -551,7 +800,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		mode = 0777
 	}
 
-	if debug {
+	if debug.Enabled() {
 		curFile, _ := p.model.CurrentFolderFile(p.folder, file.Name)
 		l.Debugf("need dir\n\t%v\n\t%v", file, curFile)
 	}
@@ -576,10 +825,15 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		// not MkdirAll because the parent should already exist.
 		mkdir := func(path string) error {
 			err = os.Mkdir(path, mode)
-			if err != nil || p.ignorePermissions(file) {
+			if err != nil {
 				return err
 			}
-			return os.Chmod(path, mode)
+			if !p.ignorePermissions(file) {
+				if err = os.Chmod(path, mode); err != nil {
+					return err
+				}
+			}
+			return p.setAttributes(path, file)
 		}
 
 		if err = osutil.InWritableDir(mkdir, realName); err == nil {
@@ -599,13 +853,93 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 	// don't handle modification times on directories, because that sucks...)
 	// It's OK to change mode bits on stuff within non-writable directories.
 
-	if p.ignorePermissions(file) {
-		p.dbUpdates <- file
-	} else if err := os.Chmod(realName, mode); err == nil {
-		p.dbUpdates <- file
-	} else {
+	if !p.ignorePermissions(file) {
+		if err := os.Chmod(realName, mode); err != nil {
+			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+			return
+		}
+	}
+	if err := p.setAttributes(realName, file); err != nil {
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		return
+	}
+	p.dbUpdates <- file
+}
+
+// handleHardLink makes the given file a hard link to its target. If the
+// filesystem doesn't support hard links, the target is copied instead.
+func (p *rwFolder) handleHardLink(file protocol.FileInfo) {
+	var err error
+	events.Default.Log(events.ItemStarted, map[string]interface{}{
+		"folder": p.folder,
+		"item":   file.Name,
+		"type":   "file",
+		"action": "update",
+	})
+
+	defer func() {
+		p.failures.record(file, err)
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   file.Name,
+			"error":  events.Error(err),
+			"type":   "file",
+			"action": "update",
+		})
+	}()
+
+	// The target must be in sync, or we would be linking to stale data.
+	// We'll get another chance at the next pull.
+	target := scanner.HardLinkTarget(file.Blocks)
+	lf, ok := p.model.CurrentFolderFile(p.folder, target)
+	gf, _ := p.model.CurrentGlobalFile(p.folder, target)
+	if target == "" || !ok || lf.IsDeleted() || !lf.Version.Equal(gf.Version) {
+		err = errNoHardLinkTarget
+		l.Infof("Puller (folder %q, file %q): hard link: %v", p.folder, file.Name, err)
+		return
+	}
+
+	realName := filepath.Join(p.dir, file.Name)
+	targetName := filepath.Join(p.dir, target)
+
+	tinfo, err := osutil.Lstat(targetName)
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): hard link: %v", p.folder, file.Name, err)
+		return
+	}
+
+	if info, err := osutil.Lstat(realName); err == nil && os.SameFile(info, tinfo) {
+		// Already linked, so only the metadata can differ.
+		err = p.shortcutFile(file)
+		return
+	}
+
+	if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && p.inConflict(cur.Version, file.Version) {
+		remote := file.Version.Copy()
+		file.Version = file.Version.Merge(cur.Version)
+		err = osutil.InWritableDir(p.conflictMover(cur.Version, remote), realName)
+	} else if p.versioner != nil {
+		err = p.versioner.Archive(realName)
+	}
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): hard link: %v", p.folder, file.Name, err)
+		return
+	}
+
+	err = osutil.InWritableDir(func(path string) error {
+		osutil.Remove(path)
+		if err := os.Link(targetName, path); err == nil {
+			return nil
+		}
+		// Hard links aren't supported here, so settle for a copy.
+		return osutil.Copy(targetName, path)
+	}, realName)
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): hard link: %v", p.folder, file.Name, err)
+		return
 	}
+
+	err = p.shortcutFile(file)
 }
 
 // deleteDir attempts to delete the given directory
@@ -618,6 +952,7 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 		"action": "delete",
 	})
 	defer func() {
+		p.failures.record(file, err)
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -664,6 +999,7 @@ func (p *rwFolder) deleteFile(file protocol.FileInfo) {
 		"action": "delete",
 	})
 	defer func() {
+		p.failures.record(file, err)
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -680,8 +1016,9 @@ func (p *rwFolder) deleteFile(file protocol.FileInfo) {
 		// There is a conflict here. Move the file to a conflict copy instead
 		// of deleting. Also merge with the version vector we had, to indicate
 		// we have resolved the conflict.
+		remote := file.Version.Copy()
 		file.Version = file.Version.Merge(cur.Version)
-		err = osutil.InWritableDir(moveForConflict, realName)
+		err = osutil.InWritableDir(p.conflictMover(cur.Version, remote), realName)
 	} else if p.versioner != nil {
 		err = osutil.InWritableDir(p.versioner.Archive, realName)
 	} else {
@@ -719,6 +1056,8 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		"action": "update",
 	})
 	defer func() {
+		p.failures.record(source, err)
+		p.failures.record(target, err)
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   source.Name,
@@ -735,7 +1074,7 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		})
 	}()
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(p, "taking rename shortcut", source.Name, "->", target.Name)
 	}
 
@@ -820,6 +1159,7 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		"item":   file.Name,
 		"type":   "file",
 		"action": "update",
+		"size":   file.Size(),
 	})
 
 	curFile, ok := p.model.CurrentFolderFile(p.folder, file.Name)
@@ -828,23 +1168,15 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		// We are supposed to copy the entire file, and then fetch nothing. We
 		// are only updating metadata, so we don't actually *need* to make the
 		// copy.
-		if debug {
+		if debug.Enabled() {
 			l.Debugln(p, "taking shortcut on", file.Name)
 		}
 		p.queue.Done(file.Name)
-		var err error
-		if file.IsSymlink() {
-			err = p.shortcutSymlink(file)
-		} else {
-			err = p.shortcutFile(file)
+		if p.barrier {
+			p.stagedShortcuts = append(p.stagedShortcuts, file)
+			return
 		}
-		events.Default.Log(events.ItemFinished, map[string]interface{}{
-			"folder": p.folder,
-			"item":   file.Name,
-			"error":  events.Error(err),
-			"type":   "file",
-			"action": "update",
-		})
+		p.takeShortcut(file)
 		return
 	}
 
@@ -855,18 +1187,15 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	realName := filepath.Join(p.dir, file.Name)
 
 	reused := 0
-	var blocks []protocol.BlockInfo
+	var blocks, reusedBlocks []protocol.BlockInfo
 
 	// Check for an old temporary file which might have some blocks we could
 	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize)
+	tempBlocks, err := p.tempFileBlocks(file.Name, tempName)
 	if err == nil {
-		// Check for any reusable blocks in the temp file
-		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
-
 		// block.String() returns a string unique to the block
-		existingBlocks := make(map[string]struct{}, len(tempCopyBlocks))
-		for _, block := range tempCopyBlocks {
+		existingBlocks := make(map[string]struct{}, len(tempBlocks))
+		for _, block := range tempBlocks {
 			existingBlocks[block.String()] = struct{}{}
 		}
 
@@ -875,12 +1204,14 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 			_, ok := existingBlocks[block.String()]
 			if !ok {
 				blocks = append(blocks, block)
+			} else {
+				reusedBlocks = append(reusedBlocks, block)
 			}
 		}
 
 		// The sharedpullerstate will know which flags to use when opening the
 		// temp file depending if we are reusing any blocks or not.
-		reused = len(file.Blocks) - len(blocks)
+		reused = len(reusedBlocks)
 		if reused == 0 {
 			// Otherwise, discard the file ourselves in order for the
 			// sharedpuller not to panic when it fails to exclusively create a
@@ -901,10 +1232,39 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		reused:      reused,
 		ignorePerms: p.ignorePermissions(file),
 		version:     curFile.Version,
+		started:     time.Now(),
+		written:     reusedBlocks,
 		mut:         sync.NewMutex(),
 	}
+	for _, block := range reusedBlocks {
+		s.localBytes += int64(block.Size)
+	}
+
+	// Don't start writing the file if it would leave less free space than
+	// configured.
+	var need int64
+	for _, block := range blocks {
+		need += int64(block.Size)
+	}
+	if err := checkFreeSpace(p.dir, p.minFreePct, p.minFreeMiB, need); err != nil {
+		s.fail("free space", err)
+		finisherChan <- &s
+		return
+	}
 
-	if debug {
+	// Nor if the folder would grow beyond its quota.
+	if p.quota > 0 {
+		grow := file.Size() - curFile.Size()
+		if grow > 0 && p.quotaUsed+grow > p.quota {
+			p.quotaHit = true
+			s.fail("quota", errQuotaExceeded)
+			finisherChan <- &s
+			return
+		}
+		p.quotaUsed += grow
+	}
+
+	if debug.Enabled() {
 		l.Debugf("%v need file %s; copy %d, reused %v", p, file.Name, len(blocks), reused)
 	}
 
@@ -915,6 +1275,33 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	copyChan <- cs
 }
 
+// tempFileBlocks returns the blocks in place in the temporary file for the
+// named file. They are on record if we were pulling the file before, as long
+// as the temporary file still covers them; otherwise the file is hashed.
+func (p *rwFolder) tempFileBlocks(name, tempName string) ([]protocol.BlockInfo, error) {
+	repo := db.NewTempBlockRepo(p.model.db, p.folder)
+
+	info, err := osutil.Lstat(tempName)
+	if err != nil {
+		repo.DeleteBlocks(name)
+		return nil, err
+	}
+
+	if blocks, ok := repo.Blocks(name); ok {
+		var end int64
+		for _, block := range blocks {
+			if e := block.Offset + int64(block.Size); e > end {
+				end = e
+			}
+		}
+		if end <= info.Size() {
+			return blocks, nil
+		}
+	}
+
+	return scanner.HashFile(tempName, protocol.BlockSize)
+}
+
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
 func (p *rwFolder) shortcutFile(file protocol.FileInfo) error {
@@ -927,15 +1314,14 @@ func (p *rwFolder) shortcutFile(file protocol.FileInfo) error {
 	}
 
 	t := time.Unix(file.Modified, 0)
-	if err := os.Chtimes(realName, t, t); err != nil {
-		// Try using virtual mtimes
-		info, err := os.Stat(realName)
-		if err != nil {
-			l.Infof("Puller (folder %q, file %q): shortcut: unable to stat file: %v", p.folder, file.Name, err)
-			return err
-		}
+	if err := p.setMtime(file.Name, realName, t); err != nil {
+		l.Infof("Puller (folder %q, file %q): shortcut: unable to stat file: %v", p.folder, file.Name, err)
+		return err
+	}
 
-		p.virtualMtimeRepo.UpdateMtime(file.Name, info.ModTime(), t)
+	if err := p.setAttributes(realName, file); err != nil {
+		l.Infof("Puller (folder %q, file %q): shortcut: attributes: %v", p.folder, file.Name, err)
+		return err
 	}
 
 	// This may have been a conflict. We should merge the version vectors so
@@ -1000,14 +1386,14 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				hash, err := scanner.VerifyBuffer(buf, block)
 				if err != nil {
 					if hash != nil {
-						if debug {
+						if debug.Enabled() {
 							l.Debugf("Finder block mismatch in %s:%s:%d expected %q got %q", folder, file, index, block.Hash, hash)
 						}
 						err = p.model.finder.Fix(folder, file, index, block.Hash, hash)
 						if err != nil {
 							l.Warnln("finder fix:", err)
 						}
-					} else if debug {
+					} else if debug.Enabled() {
 						l.Debugln("Finder failed to verify buffer", err)
 					}
 					return false
@@ -1035,7 +1421,7 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				}
 				pullChan <- ps
 			} else {
-				state.copyDone()
+				state.copyDone(block)
 			}
 		}
 		out <- state.sharedPullerState
@@ -1061,10 +1447,12 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 		var lastError error
 		potentialDevices := p.model.Availability(p.folder, state.file.Name)
 		for {
-			// Select the least busy device to pull the block from. If we found no
+			// Select the least busy device to pull the block from, marking it
+			// as in use so that the other pullers, possibly working on other
+			// blocks of the same file, select another device. If we found no
 			// feasible device at all, fail the block (and in the long run, the
 			// file).
-			selected := activity.leastBusy(potentialDevices)
+			selected := activity.useLeastBusy(potentialDevices)
 			if selected == (protocol.DeviceID{}) {
 				if lastError != nil {
 					state.fail("pull", lastError)
@@ -1076,10 +1464,16 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 
 			potentialDevices = removeDevice(potentialDevices, selected)
 
-			// Fetch the block, while marking the selected device as in use so that
-			// leastBusy can select another device when someone else asks.
-			activity.using(selected)
-			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, 0, nil)
+			// Fetch the block and mark the device as no longer in use. When
+			// we have an older version of the block, and the device
+			// supports it, we try to fetch only the parts that changed.
+			var buf []byte
+			var received int
+			if p.deltaBlocks && p.model.deviceDeltaBlocks(selected) {
+				buf, received, lastError = p.pullDelta(selected, state)
+			} else {
+				buf, received, lastError = p.pullBlock(selected, state)
+			}
 			activity.done(selected)
 			if lastError != nil {
 				continue
@@ -1097,7 +1491,8 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 			if err != nil {
 				state.fail("save", err)
 			} else {
-				state.pullDone()
+				state.pulledFrom(selected, received)
+				state.pullDone(state.block)
 			}
 			break
 		}
@@ -1106,6 +1501,12 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 }
 
 func (p *rwFolder) performFinish(state *sharedPullerState) error {
+	conflict := p.inConflict(state.version, state.file.Version)
+
+	// A conflicting text file may be resolved by merging the changes into
+	// the temp file instead of keeping a conflict copy.
+	merged := conflict && p.mergeConflict(state)
+
 	// Set the correct permission bits on the new file
 	if !p.ignorePermissions(state.file) {
 		if err := os.Chmod(state.tempName, os.FileMode(state.file.Flags&0777)); err != nil {
@@ -1113,25 +1514,33 @@ func (p *rwFolder) performFinish(state *sharedPullerState) error {
 		}
 	}
 
-	// Set the correct timestamp on the new file
-	t := time.Unix(state.file.Modified, 0)
-	if err := os.Chtimes(state.tempName, t, t); err != nil {
-		// Try using virtual mtimes instead
-		info, err := os.Stat(state.tempName)
-		if err != nil {
+	// Set the correct timestamp on the new file. A merged file keeps the
+	// time of the merge, so that the next scan finds it changed and
+	// announces the result.
+	if !merged {
+		t := time.Unix(state.file.Modified, 0)
+		if err := p.setMtime(state.file.Name, state.tempName, t); err != nil {
 			return err
 		}
-		p.virtualMtimeRepo.UpdateMtime(state.file.Name, info.ModTime(), t)
+	}
+
+	if err := p.setAttributes(state.tempName, state.file); err != nil {
+		return err
+	}
+
+	remote := state.file.Version.Copy()
+	if conflict {
+		// Merge with the version vector we had, to indicate we have resolved
+		// the conflict.
+		state.file.Version = state.file.Version.Merge(state.version)
 	}
 
 	var err error
-	if p.inConflict(state.version, state.file.Version) {
+	if conflict && !merged {
 		// The new file has been changed in conflict with the existing one. We
 		// should file it away as a conflict instead of just removing or
-		// archiving. Also merge with the version vector we had, to indicate
-		// we have resolved the conflict.
-		state.file.Version = state.file.Version.Merge(state.version)
-		err = osutil.InWritableDir(moveForConflict, state.realName)
+		// archiving.
+		err = osutil.InWritableDir(p.conflictMover(state.version, remote), state.realName)
 	} else if p.versioner != nil {
 		// If we should use versioning, let the versioner archive the old
 		// file before we replace it. Archiving a non-existent file is not
@@ -1177,46 +1586,220 @@ func (p *rwFolder) performFinish(state *sharedPullerState) error {
 	return nil
 }
 
+// mergeConflict attempts a three way merge of the local and the pulled
+// versions of a conflicting text file, with the last archived version as the
+// base. On success the merged result replaces the pulled data in the temp
+// file and true is returned.
+//
+// The last archived version is what the file was before it was last
+// replaced by a pull, which is not necessarily what both sides changed
+// from; the content the devices last agreed on isn't kept anywhere. What
+// changed between the two then shows up as the same change on both sides,
+// and where it touches the lines changed on only one side the merge fails,
+// leaving the usual conflict copy.
+func (p *rwFolder) mergeConflict(state *sharedPullerState) bool {
+	if !p.mergeConfl || state.file.IsSymlink() || state.file.Size() > maxMergeSize {
+		return false
+	}
+
+	lister, ok := p.versioner.(versioner.Lister)
+	if !ok {
+		return false
+	}
+	versions, err := lister.Versions(state.realName)
+	if err != nil || len(versions) == 0 {
+		return false
+	}
+
+	var data [3][]byte
+	for i, name := range []string{versions[len(versions)-1], state.realName, state.tempName} {
+		if info, err := os.Stat(name); err != nil || info.Size() > maxMergeSize {
+			return false
+		}
+		data[i], err = ioutil.ReadFile(name)
+		if err != nil || !merge.IsText(data[i]) {
+			return false
+		}
+	}
+
+	merged, ok := merge.Merge3(data[0], data[1], data[2])
+	if !ok {
+		if debug.Enabled() {
+			l.Debugln(p, "cannot merge", state.file.Name)
+		}
+		return false
+	}
+
+	// Write the merged data to a new file and move it into place, so that a
+	// failure leaves the pulled data intact.
+	mergedName := state.tempName + ".merged"
+	if err := ioutil.WriteFile(mergedName, merged, 0644); err != nil {
+		l.Infof("Puller (folder %q, file %q): merge: %v", p.folder, state.file.Name, err)
+		os.Remove(mergedName)
+		return false
+	}
+	if err := osutil.Rename(mergedName, state.tempName); err != nil {
+		l.Infof("Puller (folder %q, file %q): merge: %v", p.folder, state.file.Name, err)
+		os.Remove(mergedName)
+		return false
+	}
+
+	// The blocks we wrote are no longer what the temp file holds.
+	state.clearWritten()
+
+	l.Infof("Merged conflicting changes to %q in folder %q", state.file.Name, p.folder)
+	return true
+}
+
 func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 	for state := range in {
 		if closed, err := state.finalClose(); closed {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln(p, "closing", state.file.Name)
 			}
 
 			p.queue.Done(state.file.Name)
 
-			if err == nil {
-				err = p.performFinish(state)
-			}
-
-			if err != nil {
-				l.Infoln("Puller: final:", err)
+			if err == nil && p.barrier {
+				// The temporary file is complete, but it's moved into place
+				// only once all the others are.
+				db.NewTempBlockRepo(p.model.db, p.folder).PutBlocks(state.file.Name, state.writtenBlocks())
+				p.staged = append(p.staged, state)
+			} else {
+				if err != nil {
+					p.stagingFailed = true
+				}
+				p.finishFile(state, err)
 			}
-			events.Default.Log(events.ItemFinished, map[string]interface{}{
-				"folder": p.folder,
-				"item":   state.file.Name,
-				"error":  events.Error(err),
-				"type":   "file",
-				"action": "update",
-			})
 
 			if p.progressEmitter != nil {
 				p.progressEmitter.Deregister(state)
 			}
+		} else if blocks, ok := state.blocksToSave(tempBlocksSaveIntv); ok {
+			// Every now and then, record the blocks in place in the
+			// temporary file while still pulling, in case we're interrupted.
+			db.NewTempBlockRepo(p.model.db, p.folder).PutBlocks(state.file.Name, blocks)
 		}
 	}
 }
 
+// finishFile moves the pulled file into place, unless pulling it failed with
+// err, and reports the result.
+func (p *rwFolder) finishFile(state *sharedPullerState, err error) {
+	if err == nil {
+		err = p.performFinish(state)
+	}
+
+	// Keep a record of the blocks in place in the temporary file left
+	// behind by a failure, so pulling the file again can continue where we
+	// left off.
+	repo := db.NewTempBlockRepo(p.model.db, p.folder)
+	if err != nil {
+		l.Infoln("Puller: final:", err)
+		repo.PutBlocks(state.file.Name, state.writtenBlocks())
+	} else {
+		repo.DeleteBlocks(state.file.Name)
+	}
+	p.failures.record(state.file, err)
+
+	data := state.transferStats()
+	data["folder"] = p.folder
+	data["item"] = state.file.Name
+	data["error"] = events.Error(err)
+	data["type"] = "file"
+	data["action"] = "update"
+	events.Default.Log(events.ItemFinished, data)
+}
+
+// takeShortcut updates the metadata of a file whose contents are already in
+// place.
+func (p *rwFolder) takeShortcut(file protocol.FileInfo) {
+	var err error
+	if file.IsSymlink() {
+		err = p.shortcutSymlink(file)
+	} else {
+		err = p.shortcutFile(file)
+	}
+	p.failures.record(file, err)
+	events.Default.Log(events.ItemFinished, map[string]interface{}{
+		"folder": p.folder,
+		"item":   file.Name,
+		"error":  events.Error(err),
+		"type":   "file",
+		"action": "update",
+	})
+}
+
+// applyStaged puts the files staged behind the barrier into place, now that
+// all of them are available.
+func (p *rwFolder) applyStaged() {
+	if debug.Enabled() {
+		l.Debugf("%v applying %d staged files and %d shortcuts", p, len(p.staged), len(p.stagedShortcuts))
+	}
+	for _, file := range p.stagedShortcuts {
+		p.takeShortcut(file)
+	}
+	for _, state := range p.staged {
+		p.finishFile(state, nil)
+	}
+}
+
+// holdStaged reports the files staged behind the barrier as not done, as not
+// all needed files are available.
+func (p *rwFolder) holdStaged() {
+	var names []string
+	for _, file := range p.stagedShortcuts {
+		names = append(names, file.Name)
+	}
+	for _, state := range p.staged {
+		names = append(names, state.file.Name)
+	}
+	for _, name := range names {
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   name,
+			"error":  events.Error(errHeldBack),
+			"type":   "file",
+			"action": "update",
+		})
+	}
+}
+
 // Moves the given filename to the front of the job queue
 func (p *rwFolder) BringToFront(filename string) {
 	p.queue.BringToFront(filename)
 }
 
+// PullNow pulls the given file as soon as possible, ahead of everything else
+// and even if it would otherwise wait for a retry or for activity to return
+// to normal.
+func (p *rwFolder) PullNow(filename string) {
+	p.urgentMut.Lock()
+	p.urgent[filename] = struct{}{}
+	p.urgentMut.Unlock()
+
+	p.queue.BringToFront(filename)
+	p.IndexUpdated()
+}
+
+// takeUrgent returns the files to pull now, forgetting them.
+func (p *rwFolder) takeUrgent() map[string]struct{} {
+	p.urgentMut.Lock()
+	defer p.urgentMut.Unlock()
+
+	urgent := p.urgent
+	p.urgent = make(map[string]struct{})
+	return urgent
+}
+
 func (p *rwFolder) Jobs() ([]string, []string) {
 	return p.queue.Jobs()
 }
 
+func (p *rwFolder) FailedItems() []FailedItem {
+	return p.failures.list()
+}
+
 func (p *rwFolder) DelayScan(next time.Duration) {
 	p.delayScan <- next
 }
@@ -1301,7 +1884,18 @@ func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []proto
 	return devices
 }
 
-func moveForConflict(name string) error {
+// conflictMover returns a function that moves the file at a path out of the
+// way as a conflict copy, between the local and remote versions.
+func (p *rwFolder) conflictMover(local, remote protocol.Vector) func(string) error {
+	return func(name string) error {
+		return p.moveForConflict(name, local, remote)
+	}
+}
+
+// moveForConflict moves the file out of the way as a conflict copy, and
+// logs a FileConflict event with the two versions and the devices that
+// changed them.
+func (p *rwFolder) moveForConflict(name string, local, remote protocol.Vector) error {
 	ext := filepath.Ext(name)
 	withoutExt := name[:len(name)-len(ext)]
 	newName := withoutExt + time.Now().Format(".sync-conflict-20060102-150405") + ext
@@ -1313,5 +1907,105 @@ func moveForConflict(name string) error {
 		// matter, go ahead as if the move succeeded.
 		return nil
 	}
-	return err
+	if err != nil {
+		return err
+	}
+
+	item, _ := filepath.Rel(p.dir, name)
+	conflictCopy, _ := filepath.Rel(p.dir, newName)
+	events.Default.Log(events.FileConflict, map[string]interface{}{
+		"folder":       p.folder,
+		"item":         filepath.ToSlash(item),
+		"conflictCopy": filepath.ToSlash(conflictCopy),
+		"local":        p.conflictSide(local, remote),
+		"remote":       p.conflictSide(remote, local),
+	})
+
+	if p.maxConfl > 0 {
+		p.removeOldConflicts(name)
+	}
+	return nil
+}
+
+// removeOldConflicts removes all but the maxConfl most recent conflict
+// copies of the given file. They are archived if there is a versioner,
+// otherwise deleted.
+func (p *rwFolder) removeOldConflicts(name string) {
+	conflicts := conflictCopies(name)
+	if len(conflicts) <= p.maxConfl {
+		return
+	}
+
+	// The timestamp in the name sorts oldest first.
+	sort.Strings(conflicts)
+	for _, conflict := range conflicts[:len(conflicts)-p.maxConfl] {
+		var err error
+		if p.versioner != nil {
+			err = p.versioner.Archive(conflict)
+		} else {
+			err = osutil.Remove(conflict)
+		}
+		if err != nil {
+			l.Infof("Puller (folder %q): removing old conflict copy %q: %v", p.folder, conflict, err)
+		} else if debug.Enabled() {
+			l.Debugf("%v removed old conflict copy %q", p, conflict)
+		}
+	}
+}
+
+// conflictCopies returns the paths of the existing conflict copies of the
+// given file.
+func conflictCopies(name string) []string {
+	dir, base := filepath.Split(name)
+	ext := filepath.Ext(base)
+	prefix := base[:len(base)-len(ext)] + ".sync-conflict-"
+
+	fd, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return nil
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil
+	}
+
+	var conflicts []string
+	for _, n := range names {
+		if strings.HasPrefix(n, prefix) && strings.HasSuffix(n, ext) && len(n) == len(prefix)+len("20060102-150405")+len(ext) {
+			conflicts = append(conflicts, filepath.Join(dir, n))
+		}
+	}
+	return conflicts
+}
+
+// conflictSide describes one version in a conflict: the version vector, by
+// device, and the devices that changed it since the other version.
+func (p *rwFolder) conflictSide(version, other protocol.Vector) map[string]interface{} {
+	counters := make(map[string]uint64, len(version))
+	modifiedBy := []string{}
+	for _, c := range version {
+		device := p.deviceForShortID(c.ID)
+		counters[device] = c.Value
+		if c.Value > other.Counter(c.ID) {
+			modifiedBy = append(modifiedBy, device)
+		}
+	}
+	return map[string]interface{}{
+		"version":    counters,
+		"modifiedBy": modifiedBy,
+	}
+}
+
+// deviceForShortID returns the ID of the device with the short ID used in
+// version vectors, or the short ID in hex when it's no device we know.
+func (p *rwFolder) deviceForShortID(short uint64) string {
+	if p.model != nil {
+		for id := range p.model.cfg.Devices() {
+			if id.Short() == short {
+				return id.String()
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", short)
 }
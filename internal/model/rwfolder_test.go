@@ -7,13 +7,22 @@
 package model
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syncthing/syncthing/internal/versioner"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -150,6 +159,47 @@ func TestHandleFileWithTemp(t *testing.T) {
 	}
 }
 
+func TestHandleFileWithRecordedTemp(t *testing.T) {
+	// The temp file holds blocks 2, 3, 4 and 7, but we only have a record of
+	// having written block 2. Trusting the record, we should:
+	// Copy: 1, 3, 4, 5, 6, 7, 8
+
+	requiredFile := protocol.FileInfo{
+		Name:   "file",
+		Blocks: blocks[1:],
+	}
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	db.NewTempBlockRepo(ldb, "default").PutBlocks("file", []protocol.BlockInfo{blocks[2]})
+
+	p := rwFolder{
+		folder: "default",
+		dir:    "testdata",
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState, 1)
+
+	p.handleFile(requiredFile, copyChan, nil)
+
+	toCopy := <-copyChan
+
+	if toCopy.reused != 1 {
+		t.Errorf("Unexpected count of reused blocks: %d != 1", toCopy.reused)
+	}
+	if len(toCopy.blocks) != 7 {
+		t.Fatalf("Unexpected count of copy blocks: %d != 7", len(toCopy.blocks))
+	}
+	for i, eq := range []int{1, 3, 4, 5, 6, 7, 8} {
+		if string(toCopy.blocks[i].Hash) != string(blocks[eq].Hash) {
+			t.Errorf("Block mismatch: %s != %s", toCopy.blocks[i].String(), blocks[eq].String())
+		}
+	}
+}
+
 func TestCopierFinder(t *testing.T) {
 	// After diff between required and existing we should:
 	// Copy: 1, 2, 3, 4, 6, 7, 8
@@ -249,6 +299,81 @@ func TestCopierFinder(t *testing.T) {
 	os.Remove(tempFile)
 }
 
+func TestCopierOtherFolder(t *testing.T) {
+	// A block the other local folder has is copied from there instead of
+	// being pulled from the network.
+
+	dir, err := ioutil.TempDir("", "otherfolder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("some data the other folder has")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	blks, err := scanner.Blocks(bytes.NewReader(data), protocol.BlockSize, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherFolderConfig := config.FolderConfiguration{
+		ID:      "other",
+		RawPath: dir,
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{defaultFolderConfig, otherFolderConfig},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+	m.AddFolder(otherFolderConfig)
+	m.updateLocals("other", []protocol.FileInfo{{Name: "a", Blocks: blks}})
+
+	p := rwFolder{
+		folder: "default",
+		dir:    "testdata",
+		model:  m,
+	}
+
+	requiredFile := protocol.FileInfo{
+		Name:   "fromother",
+		Blocks: blks,
+	}
+	tempFile := filepath.Join("testdata", defTempNamer.TempName(requiredFile.Name))
+	defer os.Remove(tempFile)
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, 1)
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+
+	p.handleFile(requiredFile, copyChan, finisherChan)
+
+	finish := <-finisherChan
+	finish.fd.Close()
+
+	select {
+	case <-pullChan:
+		t.Fatal("Block should not be pulled")
+	default:
+	}
+	if err := finish.failed(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect data copied %q != %q", bs, data)
+	}
+}
+
 // Test that updating a file removes it's old blocks from the blockmap
 func TestCopierCleanup(t *testing.T) {
 	iterFn := func(folder, file string, index int32) bool {
@@ -390,6 +515,7 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 		model:           m,
 		queue:           newJobQueue(),
 		progressEmitter: emitter,
+		failures:        newFailureTracker(),
 	}
 
 	// queue.Done should be called by the finisher routine
@@ -477,6 +603,7 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		model:           m,
 		queue:           newJobQueue(),
 		progressEmitter: emitter,
+		failures:        newFailureTracker(),
 	}
 
 	// queue.Done should be called by the finisher routine
@@ -531,3 +658,232 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+func TestSetMtime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-mtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	repo := db.NewVirtualMtimeRepo(ldb, "default")
+	p := rwFolder{
+		folder:           "default",
+		dir:              dir,
+		virtualMtimeRepo: repo,
+	}
+
+	mtime := time.Date(2015, 6, 1, 12, 30, 45, 0, time.Local)
+	truncated := time.Date(2015, 6, 1, 12, 30, 44, 0, time.Local)
+
+	// A stale record claiming that the file really has another mtime when it
+	// looks like mtime on disk. Setting the mtime successfully removes it.
+
+	repo.UpdateMtime("file", mtime, mtime.Add(time.Hour))
+	if err := p.setMtime("file", path, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if vm := repo.GetMtime("file", mtime); !vm.Equal(mtime) {
+		t.Errorf("Stale record not removed; got virtual mtime %v, expected %v", vm, mtime)
+	}
+
+	// A filesystem that can only store even seconds. The intended mtime is
+	// recorded and returned for the truncated one on disk.
+
+	chtimes = func(path string, atime, mtime time.Time) error {
+		return os.Chtimes(path, truncated, truncated)
+	}
+	defer func() {
+		chtimes = os.Chtimes
+	}()
+
+	if err := p.setMtime("file", path, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(truncated) {
+		t.Fatalf("Unexpected mtime on disk %v", info.ModTime())
+	}
+	if vm := repo.GetMtime("file", info.ModTime()); !vm.Equal(mtime) {
+		t.Errorf("Got virtual mtime %v, expected %v", vm, mtime)
+	}
+}
+
+func TestSortQueue(t *testing.T) {
+	cases := []struct {
+		order    config.PullOrder
+		expected []string
+	}{
+		{config.OrderAlphabetic, []string{"a", "b", "c"}},
+		{config.OrderSmallestFirst, []string{"c", "a", "b"}},
+		{config.OrderLargestFirst, []string{"b", "a", "c"}},
+		{config.OrderOldestFirst, []string{"b", "c", "a"}},
+		{config.OrderNewestFirst, []string{"a", "c", "b"}},
+	}
+
+	for _, tc := range cases {
+		p := rwFolder{
+			queue: newJobQueue(),
+			order: tc.order,
+		}
+		p.queue.Push("a", 200, 30)
+		p.queue.Push("b", 300, 10)
+		p.queue.Push("c", 100, 20)
+
+		p.sortQueue()
+
+		if _, queued := p.queue.Jobs(); !reflect.DeepEqual(queued, tc.expected) {
+			t.Errorf("Order %v: %v != %v", tc.order, queued, tc.expected)
+		}
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, data string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	realName := filepath.Join(dir, "notes.txt")
+	tempName := filepath.Join(dir, defTempNamer.TempName("notes.txt"))
+	write(filepath.Join(dir, ".stversions", "notes~20150101-120000.txt"), "one\ntwo\nthree\n")
+	write(realName, "one\ntwo\nthree\nfour\n")
+	write(tempName, "zero\none\ntwo\nthree\n")
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+
+	p := rwFolder{
+		folder:     "default",
+		dir:        dir,
+		model:      m,
+		versioner:  versioner.NewSimple("default", dir, map[string]string{"keep": "5"}),
+		mergeConfl: true,
+		dbUpdates:  make(chan protocol.FileInfo, 1),
+
+		virtualMtimeRepo: db.NewVirtualMtimeRepo(ldb, "default"),
+	}
+	state := &sharedPullerState{
+		file: protocol.FileInfo{
+			Name:    "notes.txt",
+			Flags:   0644,
+			Version: protocol.Vector{{ID: 2, Value: 1}},
+		},
+		version:  protocol.Vector{{ID: 1, Value: 1}},
+		tempName: tempName,
+		realName: realName,
+		mut:      sync.NewMutex(),
+	}
+
+	if err := p.performFinish(state); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(realName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "zero\none\ntwo\nthree\nfour\n" {
+		t.Errorf("Incorrect merge result %q", bs)
+	}
+	if conflicts, _ := filepath.Glob(filepath.Join(dir, "*sync-conflict*")); len(conflicts) != 0 {
+		t.Errorf("Unexpected conflict copies %v", conflicts)
+	}
+	if f := <-p.dbUpdates; !f.Version.Equal(state.version.Merge(protocol.Vector{{ID: 2, Value: 1}})) {
+		t.Errorf("Incorrect version %v", f.Version)
+	}
+
+	// Changes to the same line can't be merged and leave a conflict copy.
+
+	write(realName, "one\nTWO\nthree\n")
+	write(tempName, "one\n2\nthree\n")
+	state.version = protocol.Vector{{ID: 1, Value: 2}}
+	state.file.Version = protocol.Vector{{ID: 2, Value: 2}}
+
+	if err := p.performFinish(state); err != nil {
+		t.Fatal(err)
+	}
+	<-p.dbUpdates
+
+	if conflicts, _ := filepath.Glob(filepath.Join(dir, "*sync-conflict*")); len(conflicts) != 1 {
+		t.Errorf("Expected one conflict copy, not %v", conflicts)
+	}
+}
+
+func TestMaxConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := []string{
+		"file.sync-conflict-20150101-120000.txt",
+		"file.sync-conflict-20150102-120000.txt",
+		"file.sync-conflict-20150103-120000.txt",
+		"other.sync-conflict-20150101-120000.txt",
+	}
+	for _, name := range append(old, "file.txt") {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := rwFolder{
+		folder:   "default",
+		dir:      dir,
+		maxConfl: 2,
+	}
+	sub := events.Default.Subscribe(events.FileConflict)
+	defer events.Default.Unsubscribe(sub)
+	local := protocol.Vector{{ID: 1, Value: 2}, {ID: 2, Value: 1}}
+	remote := protocol.Vector{{ID: 1, Value: 1}, {ID: 2, Value: 2}}
+	if err := p.moveForConflict(filepath.Join(dir, "file.txt"), local, remote); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ev.Data.(map[string]interface{})
+	if data["item"] != "file.txt" {
+		t.Errorf("Incorrect conflict item %v", data["item"])
+	}
+	if by := data["local"].(map[string]interface{})["modifiedBy"].([]string); len(by) != 1 || by[0] != "0000000000000001" {
+		t.Errorf("Incorrect local modifiers %v", by)
+	}
+	if v := data["remote"].(map[string]interface{})["version"].(map[string]uint64); v["0000000000000002"] != 2 {
+		t.Errorf("Incorrect remote version %v", v)
+	}
+
+	conflicts := conflictCopies(filepath.Join(dir, "file.txt"))
+	if len(conflicts) != 2 {
+		t.Fatalf("Expected two conflict copies to remain, not %v", conflicts)
+	}
+	sort.Strings(conflicts)
+	if filepath.Base(conflicts[0]) != old[2] {
+		t.Errorf("Incorrect conflict copy kept, %q", conflicts[0])
+	}
+	if _, err := os.Stat(filepath.Join(dir, old[3])); err != nil {
+		t.Error("Conflict copy of another file should be kept:", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
@@ -27,17 +28,23 @@ type sharedPullerState struct {
 	reused      int // Number of blocks reused from temporary file
 	ignorePerms bool
 	version     protocol.Vector // The current (old) version
+	started     time.Time
 
 	// Mutable, must be locked for access
-	err        error      // The first error we hit
-	fd         *os.File   // The fd of the temp file
-	copyTotal  int        // Total number of copy actions for the whole job
-	pullTotal  int        // Total number of pull actions for the whole job
-	copyOrigin int        // Number of blocks copied from the original file
-	copyNeeded int        // Number of copy actions still pending
-	pullNeeded int        // Number of block pulls still pending
-	closed     bool       // True if the file has been finalClosed.
-	mut        sync.Mutex // Protects the above
+	err        error                // The first error we hit
+	fd         *os.File             // The fd of the temp file
+	copyTotal  int                  // Total number of copy actions for the whole job
+	pullTotal  int                  // Total number of pull actions for the whole job
+	copyOrigin int                  // Number of blocks copied from the original file
+	copyNeeded int                  // Number of copy actions still pending
+	pullNeeded int                  // Number of block pulls still pending
+	localBytes int64                // Bytes reused from the temp file or copied locally
+	recvBytes  int64                // Bytes received from other devices
+	sources    []protocol.DeviceID  // Devices we pulled blocks from
+	closed     bool                 // True if the file has been finalClosed.
+	written    []protocol.BlockInfo // Blocks in place in the temp file
+	savedAt    time.Time            // When the blocks in place were last saved
+	mut        sync.Mutex           // Protects the above
 }
 
 // A momentary state representing the progress of the puller
@@ -174,10 +181,12 @@ func (s *sharedPullerState) failed() error {
 	return s.err
 }
 
-func (s *sharedPullerState) copyDone() {
+func (s *sharedPullerState) copyDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.copyNeeded--
-	if debug {
+	s.localBytes += int64(block.Size)
+	s.written = append(s.written, block)
+	if debug.Enabled() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
 	s.mut.Unlock()
@@ -195,21 +204,58 @@ func (s *sharedPullerState) pullStarted() {
 	s.copyNeeded--
 	s.pullTotal++
 	s.pullNeeded++
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded start ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
-func (s *sharedPullerState) pullDone() {
+func (s *sharedPullerState) pullDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.pullNeeded--
-	if debug {
+	s.written = append(s.written, block)
+	if debug.Enabled() {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
+// pulledFrom records that a block was pulled from the device and saved,
+// having received the given number of bytes for it.
+func (s *sharedPullerState) pulledFrom(device protocol.DeviceID, received int) {
+	s.mut.Lock()
+	s.recvBytes += int64(received)
+	known := false
+	for _, d := range s.sources {
+		if d == device {
+			known = true
+			break
+		}
+	}
+	if !known {
+		s.sources = append(s.sources, device)
+	}
+	s.mut.Unlock()
+}
+
+// transferStats returns the statistics of the finished pull, for the
+// ItemFinished event.
+func (s *sharedPullerState) transferStats() map[string]interface{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	sources := make([]string, len(s.sources))
+	for i, device := range s.sources {
+		sources[i] = device.String()
+	}
+	return map[string]interface{}{
+		"bytesTransferred": s.recvBytes,
+		"bytesReused":      s.localBytes,
+		"durationS":        time.Since(s.started).Seconds(),
+		"sources":          sources,
+	}
+}
+
 // finalClose atomically closes and returns closed status of a file. A true
 // first return value means the file was closed and should be finished, with
 // the error indicating the success or failure of the close. A false first
@@ -230,6 +276,11 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 	}
 
 	if s.fd != nil {
+		if s.err != nil {
+			// Make sure what we've written survives, so that pulling the
+			// file again can pick up from here.
+			s.fd.Sync()
+		}
 		if closeErr := s.fd.Close(); closeErr != nil && s.err == nil {
 			// This is our error if we weren't errored before. Otherwise we
 			// keep the earlier error.
@@ -243,6 +294,49 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 	return true, s.err
 }
 
+// writtenBlocks returns the blocks in place in the temp file.
+func (s *sharedPullerState) writtenBlocks() []protocol.BlockInfo {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	blocks := make([]protocol.BlockInfo, len(s.written))
+	copy(blocks, s.written)
+	return blocks
+}
+
+// clearWritten forgets the blocks in place in the temp file, as it has been
+// rewritten.
+func (s *sharedPullerState) clearWritten() {
+	s.mut.Lock()
+	s.written = nil
+	s.mut.Unlock()
+}
+
+// blocksToSave returns the blocks in place in the temp file, once the given
+// interval has passed since they were last returned. The temp file is synced
+// to disk first, so that the blocks are really there should we crash.
+func (s *sharedPullerState) blocksToSave(intv time.Duration) ([]protocol.BlockInfo, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.savedAt.IsZero() {
+		// Start counting from the first progress we see.
+		s.savedAt = time.Now()
+		return nil, false
+	}
+	if s.fd == nil || s.err != nil || time.Since(s.savedAt) < intv {
+		return nil, false
+	}
+	if err := s.fd.Sync(); err != nil {
+		return nil, false
+	}
+	s.savedAt = time.Now()
+
+	blocks := make([]protocol.BlockInfo, len(s.written))
+	copy(blocks, s.written)
+	return blocks, true
+}
+
 // Returns the momentarily progress for the puller
 func (s *sharedPullerState) Progress() *pullerProgress {
 	s.mut.Lock()
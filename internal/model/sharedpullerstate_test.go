@@ -10,6 +10,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/sync"
 )
 
@@ -60,6 +61,28 @@ func TestSourceFileBad(t *testing.T) {
 	}
 }
 
+func TestTransferStats(t *testing.T) {
+	s := sharedPullerState{
+		mut: sync.NewMutex(),
+	}
+
+	s.copyDone(protocol.BlockInfo{Size: 100})
+	s.pulledFrom(device1, 50)
+	s.pulledFrom(device2, 70)
+	s.pulledFrom(device1, 30)
+
+	stats := s.transferStats()
+	if stats["bytesTransferred"] != int64(150) {
+		t.Errorf("Incorrect bytes transferred %v", stats["bytesTransferred"])
+	}
+	if stats["bytesReused"] != int64(100) {
+		t.Errorf("Incorrect bytes reused %v", stats["bytesReused"])
+	}
+	if sources := stats["sources"].([]string); len(sources) != 2 || sources[0] != device1.String() || sources[1] != device2.String() {
+		t.Errorf("Incorrect sources %v", sources)
+	}
+}
+
 // Test creating temporary file inside read-only directory
 func TestReadOnlyDir(t *testing.T) {
 	// Create a read only directory, clean it up afterwards.
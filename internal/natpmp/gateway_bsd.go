@@ -0,0 +1,53 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package natpmp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateways returns the gateways of the default IPv4 and IPv6
+// routes, as told by route(8).
+func defaultGateways() []net.IPAddr {
+	var gws []net.IPAddr
+	for _, family := range []string{"-inet", "-inet6"} {
+		if gw, ok := defaultGateway(family); ok {
+			gws = append(gws, gw)
+		}
+	}
+	return gws
+}
+
+func defaultGateway(family string) (net.IPAddr, bool) {
+	out, err := exec.Command("route", "-n", "get", family, "default").Output()
+	if err != nil {
+		return net.IPAddr{}, false
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 || fields[0] != "gateway:" {
+			continue
+		}
+		// Link local IPv6 addresses are given as fe80::1%en0.
+		host, zone := fields[1], ""
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host, zone = host[:i], host[i+1:]
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			return net.IPAddr{IP: ip, Zone: zone}, true
+		}
+	}
+	return net.IPAddr{}, false
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natpmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultGateways returns the gateways of the default IPv4 and IPv6
+// routes, from the kernel routing tables.
+func defaultGateways() []net.IPAddr {
+	var gws []net.IPAddr
+
+	// Iface Destination Gateway Flags ..., with the addresses in host
+	// (little endian) byte order.
+
+	scanRoutes("/proc/net/route", func(fields []string) {
+		if len(fields) < 3 || fields[1] != "00000000" {
+			return
+		}
+		bs, err := hex.DecodeString(fields[2])
+		if err != nil || len(bs) != net.IPv4len {
+			return
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(bs))
+		if !ip.IsUnspecified() {
+			gws = append(gws, net.IPAddr{IP: ip})
+		}
+	})
+
+	// Destination DestPrefixLen Source SourcePrefixLen NextHop Metric
+	// RefCnt Use Flags Iface, with the addresses in network byte order.
+
+	scanRoutes("/proc/net/ipv6_route", func(fields []string) {
+		if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+			return
+		}
+		ip, err := hex.DecodeString(fields[4])
+		if err != nil || len(ip) != net.IPv6len || net.IP(ip).IsUnspecified() {
+			return
+		}
+		gws = append(gws, net.IPAddr{IP: ip, Zone: fields[9]})
+	})
+
+	return gws
+}
+
+func scanRoutes(path string, fn func(fields []string)) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		fn(strings.Fields(sc.Text()))
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package natpmp
+
+import "net"
+
+// defaultGateways guesses the gateways, as we can't easily ask the system
+// on this platform: the first address of each private IPv4 network we are
+// on, which is where home routers usually are. IPv6 gateways are left out;
+// their link local addresses can't be guessed.
+func defaultGateways() []net.IPAddr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var gws []net.IPAddr
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip4 := ipnet.IP.To4()
+		if ip4 == nil || !isPrivate(ip4) {
+			continue
+		}
+		gw := ip4.Mask(ipnet.Mask)
+		gw[3]++
+		if !gw.Equal(ip4) {
+			gws = append(gws, net.IPAddr{IP: gw})
+		}
+	}
+	return gws
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip[0] == 10 || ip[0] == 172 && ip[1]&0xf0 == 16 || ip[0] == 192 && ip[1] == 168
+}
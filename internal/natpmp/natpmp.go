@@ -0,0 +1,349 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package natpmp implements port mapping with PCP (RFC 6887), falling back
+// to its predecessor NAT-PMP (RFC 6886) for gateways that don't speak PCP.
+package natpmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	ServerPort = 5351
+
+	pcpVersion    = 2
+	natpmpVersion = 0
+
+	pcpOpMap            = 1
+	natpmpOpExternalIP  = 0
+	natpmpOpMapUDP      = 1
+	natpmpOpMapTCP      = 2
+	responseBit         = 0x80
+	resultUnsuppVersion = 1
+
+	initialRetransmit = 250 * time.Millisecond
+)
+
+// Protocol is the IANA protocol number, as used by PCP.
+type Protocol int
+
+const (
+	TCP Protocol = 6
+	UDP Protocol = 17
+)
+
+var (
+	ErrNoResponse         = errors.New("no response from gateway")
+	errUnsupportedVersion = errors.New("unsupported version")
+)
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external address",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// A Gateway is a router that may do port mapping with PCP or NAT-PMP. On
+// IPv6, where there is no NAT, a PCP mapping opens a pinhole in the firewall
+// of the gateway instead.
+type Gateway struct {
+	IP      net.IP
+	Zone    string // for IPv6 link local addresses
+	localIP net.IP // the address to map; nil for the one the system chooses
+	timeout time.Duration
+	port    int
+	nonce   [12]byte
+	natpmp  bool // the gateway doesn't speak PCP
+}
+
+// A Mapping is a port on the gateway forwarded to us.
+type Mapping struct {
+	ExternalIP   net.IP // may be nil
+	ExternalPort int
+	Lifetime     time.Duration
+}
+
+// Discover returns the default IPv4 and IPv6 gateways of this host.
+// Whether they actually do port mapping is only known once a mapping is
+// attempted.
+func Discover(timeout time.Duration) []*Gateway {
+	var gws []*Gateway
+	for _, addr := range defaultGateways() {
+		gw := NewGateway(addr.IP, timeout)
+		if gw.IPv6() {
+			// The gateway is usually at a link local address, which would
+			// make that the source of our requests. We want the global
+			// address mapped.
+			gw.Zone = addr.Zone
+			gw.localIP = globalIPv6(addr.Zone)
+			if gw.localIP == nil {
+				continue
+			}
+		}
+		gws = append(gws, gw)
+	}
+	return gws
+}
+
+// NewGateway returns the gateway at the given address, waiting up to
+// timeout for it to answer requests.
+func NewGateway(ip net.IP, timeout time.Duration) *Gateway {
+	g := &Gateway{
+		IP:      ip,
+		timeout: timeout,
+		port:    ServerPort,
+	}
+	// The nonce identifies us as the owner of the mapping when renewing it.
+	rand.Read(g.nonce[:])
+	return g
+}
+
+// AddPortMapping asks the gateway to forward an external port, preferably
+// the suggested one, to the internal port on this host. An existing mapping
+// is renewed.
+func (g *Gateway) AddPortMapping(proto Protocol, internalPort, suggestedPort int, lifetime time.Duration) (Mapping, error) {
+	if !g.natpmp {
+		m, err := g.pcpMap(proto, internalPort, suggestedPort, lifetime)
+		if err != errUnsupportedVersion || g.IPv6() {
+			// There is no NAT-PMP over IPv6.
+			return m, err
+		}
+		if debug.Enabled() {
+			l.Debugf("natpmp: %s doesn't speak PCP, falling back to NAT-PMP", g.IP)
+		}
+		g.natpmp = true
+	}
+	return g.natpmpMap(proto, internalPort, suggestedPort, lifetime)
+}
+
+// IPv6 returns whether the gateway is at an IPv6 address.
+func (g *Gateway) IPv6() bool {
+	return g.IP.To4() == nil
+}
+
+func (g *Gateway) String() string {
+	if g.natpmp {
+		return "NAT-PMP gateway " + g.IP.String()
+	}
+	return "PCP gateway " + g.IP.String()
+}
+
+func (g *Gateway) pcpMap(proto Protocol, internalPort, suggestedPort int, lifetime time.Duration) (Mapping, error) {
+	conn, err := g.dial()
+	if err != nil {
+		return Mapping{}, err
+	}
+	defer conn.Close()
+
+	// Common request header, RFC 6887 section 7.1.
+
+	req := make([]byte, 60)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+
+	// MAP opcode, section 11.1. The suggested external address is the
+	// unspecified address of the gateway's family, i.e. any.
+
+	copy(req[24:36], g.nonce[:])
+	req[36] = byte(proto)
+	binary.BigEndian.PutUint16(req[40:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:], uint16(suggestedPort))
+	if g.IP.To4() != nil {
+		copy(req[44:60], net.IPv4zero.To16())
+	}
+
+	resp, err := g.request(conn, req, func(resp []byte) bool {
+		// A NAT-PMP gateway answers with its own version and an error.
+		return len(resp) >= 4 && (resp[0] == natpmpVersion || resp[0] == pcpVersion && resp[1] == responseBit|pcpOpMap)
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	if resp[0] == natpmpVersion || resp[3] == resultUnsuppVersion {
+		return Mapping{}, errUnsupportedVersion
+	}
+	if resp[3] != 0 {
+		return Mapping{}, pcpError(resp[3])
+	}
+	if len(resp) < 60 || string(resp[24:36]) != string(g.nonce[:]) {
+		return Mapping{}, errors.New("pcp: malformed response")
+	}
+
+	m := Mapping{
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[42:])),
+		ExternalIP:   net.IP(resp[44:60]),
+	}
+	if ip4 := m.ExternalIP.To4(); ip4 != nil {
+		m.ExternalIP = ip4
+	}
+	return m, nil
+}
+
+func (g *Gateway) natpmpMap(proto Protocol, internalPort, suggestedPort int, lifetime time.Duration) (Mapping, error) {
+	conn, err := g.dial()
+	if err != nil {
+		return Mapping{}, err
+	}
+	defer conn.Close()
+
+	op := byte(natpmpOpMapTCP)
+	if proto == UDP {
+		op = natpmpOpMapUDP
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(suggestedPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp, err := g.request(conn, req, natpmpResponse(op, 16))
+	if err != nil {
+		return Mapping{}, err
+	}
+	if res := binary.BigEndian.Uint16(resp[2:]); res != 0 {
+		return Mapping{}, natpmpError(res)
+	}
+
+	m := Mapping{
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}
+
+	// The external address is a separate request. Not getting it is no
+	// reason to fail the mapping.
+
+	resp, err = g.request(conn, []byte{natpmpVersion, natpmpOpExternalIP}, natpmpResponse(natpmpOpExternalIP, 12))
+	if err == nil && binary.BigEndian.Uint16(resp[2:]) == 0 {
+		m.ExternalIP = net.IP(resp[8:12])
+	}
+	return m, nil
+}
+
+func natpmpResponse(op byte, size int) func([]byte) bool {
+	return func(resp []byte) bool {
+		return len(resp) >= size && resp[0] == natpmpVersion && resp[1] == responseBit|op
+	}
+}
+
+func (g *Gateway) dial() (*net.UDPConn, error) {
+	var laddr *net.UDPAddr
+	if g.localIP != nil {
+		laddr = &net.UDPAddr{IP: g.localIP}
+	}
+	return net.DialUDP("udp", laddr, &net.UDPAddr{IP: g.IP, Port: g.port, Zone: g.Zone})
+}
+
+// globalIPv6 returns a global unicast IPv6 address of the named interface,
+// or of any interface if the name is empty.
+func globalIPv6(intfName string) net.IP {
+	var addrs []net.Addr
+	var err error
+	if intfName == "" {
+		addrs, err = net.InterfaceAddrs()
+	} else {
+		var intf *net.Interface
+		intf, err = net.InterfaceByName(intfName)
+		if err == nil {
+			addrs, err = intf.Addrs()
+		}
+	}
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil {
+			continue
+		}
+		// Unique local addresses (fc00::/7) aren't reachable from the
+		// internet either.
+		if ipnet.IP.IsGlobalUnicast() && ipnet.IP[0]&0xfe != 0xfc {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// request sends the request until a response accepted by valid arrives,
+// with exponential backoff as recommended by both RFCs, or until the
+// timeout.
+func (g *Gateway) request(conn *net.UDPConn, req []byte, valid func([]byte) bool) ([]byte, error) {
+	deadline := time.Now().Add(g.timeout)
+	retransmit := initialRetransmit
+	buf := make([]byte, 1100) // the largest PCP message
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		next := time.Now().Add(retransmit)
+		if next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if valid(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		retransmit *= 2
+	}
+
+	return nil, ErrNoResponse
+}
+
+func pcpError(code byte) error {
+	if msg, ok := pcpResults[code]; ok {
+		return errors.New("pcp: " + msg)
+	}
+	return fmt.Errorf("pcp: result code %d", code)
+}
+
+func natpmpError(code uint16) error {
+	if msg, ok := natpmpResults[code]; ok {
+		return errors.New("nat-pmp: " + msg)
+	}
+	return fmt.Errorf("nat-pmp: result code %d", code)
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natpmp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var testExternalIP = net.IP{192, 0, 2, 42}
+
+// fakeGateway answers port mapping requests on a local UDP socket, mapping
+// every port to external port 40000. It speaks PCP if pcp is true, and
+// NAT-PMP only otherwise.
+func fakeGateway(t *testing.T, pcp bool) *Gateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 1100)
+		for {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+
+			var resp []byte
+			switch {
+			case req[0] == pcpVersion && pcp:
+				resp = make([]byte, 60)
+				resp[0] = pcpVersion
+				resp[1] = responseBit | req[1]
+				copy(resp[4:8], req[4:8])
+				copy(resp[24:40], req[24:40])
+				binary.BigEndian.PutUint16(resp[40:], binary.BigEndian.Uint16(req[40:]))
+				binary.BigEndian.PutUint16(resp[42:], 40000)
+				copy(resp[44:60], testExternalIP.To16())
+
+			case req[0] == pcpVersion:
+				resp = []byte{natpmpVersion, responseBit | req[1], 0, resultUnsuppVersion}
+
+			case req[1] == natpmpOpExternalIP:
+				resp = make([]byte, 12)
+				resp[1] = responseBit | req[1]
+				copy(resp[8:], testExternalIP)
+
+			default:
+				resp = make([]byte, 16)
+				resp[1] = responseBit | req[1]
+				copy(resp[8:10], req[4:6])
+				binary.BigEndian.PutUint16(resp[10:], 40000)
+				copy(resp[12:16], req[8:12])
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	g := NewGateway(net.IPv4(127, 0, 0, 1), 2*time.Second)
+	g.port = conn.LocalAddr().(*net.UDPAddr).Port
+	return g
+}
+
+func TestPortMapping(t *testing.T) {
+	for _, pcp := range []bool{true, false} {
+		g := fakeGateway(t, pcp)
+
+		m, err := g.AddPortMapping(TCP, 22000, 22000, time.Hour)
+		if err != nil {
+			t.Errorf("pcp=%v: %v", pcp, err)
+			continue
+		}
+		if m.ExternalPort != 40000 || !m.ExternalIP.Equal(testExternalIP) || m.Lifetime != time.Hour {
+			t.Errorf("pcp=%v: incorrect mapping %+v", pcp, m)
+		}
+		if g.natpmp == pcp {
+			t.Errorf("pcp=%v: incorrect protocol for %v", pcp, g)
+		}
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	g := NewGateway(net.IPv4(127, 0, 0, 1), 500*time.Millisecond)
+	g.port = conn.LocalAddr().(*net.UDPAddr).Port
+	if _, err := g.AddPortMapping(TCP, 22000, 22000, time.Hour); err != ErrNoResponse {
+		t.Errorf("unexpected error %v", err)
+	}
+}
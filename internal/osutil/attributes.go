@@ -0,0 +1,17 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+// DOS file attributes, using the same bit values as the corresponding
+// FILE_ATTRIBUTE_* constants on Windows.
+const (
+	AttributeReadOnly uint32 = 0x1
+	AttributeHidden   uint32 = 0x2
+	AttributeSystem   uint32 = 0x4
+
+	AttributeMask = AttributeReadOnly | AttributeHidden | AttributeSystem
+)
@@ -0,0 +1,20 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package osutil
+
+// AttributesSupported is true when the platform stores DOS file attributes.
+const AttributesSupported = false
+
+func Attributes(path string) (uint32, error) {
+	return 0, nil
+}
+
+func SetAttributes(path string, attrs, mask uint32) error {
+	return nil
+}
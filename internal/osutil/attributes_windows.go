@@ -0,0 +1,51 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import "syscall"
+
+// AttributesSupported is true when the platform stores DOS file attributes.
+const AttributesSupported = true
+
+// Attributes returns the DOS attributes (within AttributeMask) of the file
+// at path.
+func Attributes(path string) (uint32, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return attrs & AttributeMask, nil
+}
+
+// SetAttributes sets the DOS attributes selected by mask on the file at path
+// to the values given in attrs. Attributes outside of mask are left alone.
+func SetAttributes(path string, attrs, mask uint32) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	cur, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return err
+	}
+
+	mask &= AttributeMask
+	next := cur&^mask | attrs&mask
+	if next == cur {
+		return nil
+	}
+	return syscall.SetFileAttributes(p, next)
+}
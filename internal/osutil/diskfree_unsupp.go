@@ -0,0 +1,17 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package osutil
+
+import "errors"
+
+// DiskFree returns the number of bytes available to us, and the total size,
+// of the filesystem holding the given path.
+func DiskFree(path string) (free, total int64, err error) {
+	return 0, 0, errors.New("not implemented")
+}
@@ -0,0 +1,31 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileID identifies the file (inode) behind a directory entry. All hard
+// links to a file share the same FileID.
+type FileID struct {
+	Dev, Ino uint64
+}
+
+// HardLinkInfo returns the FileID and the number of hard links for the file
+// described by info. The boolean is false if the information is not
+// available on this platform.
+func HardLinkInfo(info os.FileInfo) (FileID, uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, 0, false
+	}
+	return FileID{uint64(st.Dev), uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -0,0 +1,24 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import "os"
+
+// FileID identifies the file (inode) behind a directory entry. All hard
+// links to a file share the same FileID.
+type FileID struct {
+	Dev, Ino uint64
+}
+
+// HardLinkInfo returns the FileID and the number of hard links for the file
+// described by info. The os.FileInfo on Windows doesn't carry the file index
+// so hard links can't be detected while scanning.
+func HardLinkInfo(info os.FileInfo) (FileID, uint64, bool) {
+	return FileID{}, 0, false
+}
@@ -7,6 +7,7 @@
 package osutil_test
 
 import (
+	"net"
 	"os"
 	"runtime"
 	"testing"
@@ -164,3 +165,25 @@ func TestInWritableDirWindowsRename(t *testing.T) {
 		}
 	}
 }
+
+func TestSetTrafficClass(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("not supported on Windows")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := osutil.SetTrafficClass(conn.(*net.TCPConn), 32); err != nil {
+		t.Error(err)
+	}
+}
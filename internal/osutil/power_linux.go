@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// OnBattery returns true if the system is running on battery power. Systems
+// without batteries, or where we can't tell, are considered to be on mains.
+func OnBattery() bool {
+	supplies, err := ioutil.ReadDir(powerSupplyDir)
+	if err != nil {
+		return false
+	}
+
+	battery := false
+	for _, supply := range supplies {
+		dir := filepath.Join(powerSupplyDir, supply.Name())
+		switch readSysValue(filepath.Join(dir, "type")) {
+		case "Mains", "USB":
+			if readSysValue(filepath.Join(dir, "online")) == "1" {
+				return false
+			}
+		case "Battery":
+			battery = true
+		}
+	}
+	return battery
+}
+
+func readSysValue(path string) string {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bs))
+}
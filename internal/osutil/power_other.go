@@ -0,0 +1,15 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux,!windows
+
+package osutil
+
+// OnBattery returns true if the system is running on battery power. We
+// can't tell on this platform, so we assume mains.
+func OnBattery() bool {
+	return false
+}
@@ -0,0 +1,15 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+import "github.com/juju/ratelimit"
+
+// NewRateLimit returns a token bucket allowing the given rate in kB/s, with
+// room for bursts of five seconds worth of data.
+func NewRateLimit(kbps int) *ratelimit.Bucket {
+	return ratelimit.NewBucketWithRate(float64(1000*kbps), int64(5*1000*kbps))
+}
@@ -0,0 +1,18 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package osutil
+
+import "os"
+
+// IsReparsePoint returns true if the file at path, described by info, is a
+// reparse point other than a symlink. There are no reparse points outside of
+// Windows.
+func IsReparsePoint(path string, info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+const ioReparseTagSymlink = 0xA000000C
+
+// IsReparsePoint returns true if the file at path, described by info, is a
+// reparse point other than a symlink, such as a junction or a mount point.
+// Depending on the Go version junctions may or may not look like symlinks
+// in info, so the reparse tag is what decides.
+func IsReparsePoint(path string, info os.FileInfo) bool {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok || data.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		return false
+	}
+
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	var fd syscall.Win32finddata
+	h, err := syscall.FindFirstFile(p, &fd)
+	if err != nil {
+		return false
+	}
+	syscall.FindClose(h)
+
+	// For reparse points, Reserved0 holds the reparse tag.
+	return fd.Reserved0 != ioReparseTagSymlink
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package osutil
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetTrafficClass sets the IPv4 type of service or the IPv6 traffic class
+// of the packets sent on the connection. The DSCP is the upper six bits of
+// the class.
+func SetTrafficClass(conn *net.TCPConn, class int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ipv4 := true
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv4 = false
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, class)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, class)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,20 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import (
+	"errors"
+	"net"
+)
+
+// SetTrafficClass is not supported on Windows, which ignores the type of
+// service set by applications unless told otherwise by group policy.
+func SetTrafficClass(conn *net.TCPConn, class int) error {
+	return errors.New("setting the traffic class is not supported on Windows")
+}
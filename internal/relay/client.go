@@ -0,0 +1,351 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	pingInterval   = time.Minute
+	pingTimeout    = 2 * pingInterval
+	reconnectDelay = 20 * time.Second
+)
+
+// A Dialer makes the connections to relays, such as a *net.Dialer or a
+// proxy. Where a nil Dialer is given, relays are connected to directly.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// A Client keeps us joined to a relay, so that other devices can connect to
+// us through it. The invitations to the sessions they set up are sent on the
+// invitations channel.
+type Client struct {
+	uri         *url.URL
+	certs       []tls.Certificate
+	dialer      Dialer
+	timeout     time.Duration
+	invitations chan<- SessionInvitation
+
+	conn      *tls.Conn
+	connected bool
+	err       error
+	stop      chan struct{}
+	mut       sync.Mutex
+}
+
+func NewClient(uri *url.URL, certs []tls.Certificate, dialer Dialer, timeout time.Duration, invitations chan<- SessionInvitation) *Client {
+	return &Client{
+		uri:         uri,
+		certs:       certs,
+		dialer:      dialer,
+		timeout:     timeout,
+		invitations: invitations,
+		stop:        make(chan struct{}),
+		mut:         sync.NewMutex(),
+	}
+}
+
+// Serve joins the relay and stays joined, reconnecting as necessary, until
+// stopped.
+func (c *Client) Serve() {
+	for {
+		err := c.serveOnce()
+
+		c.mut.Lock()
+		c.connected = false
+		c.err = err
+		c.conn = nil
+		c.mut.Unlock()
+
+		if debug.Enabled() {
+			l.Debugf("relay client %s: %v", c.uri, err)
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (c *Client) serveOnce() error {
+	conn, err := dialRelay(c.uri, c.certs, c.dialer, c.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := WriteMessage(conn, JoinRelayRequest{}); err != nil {
+		return err
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	res, ok := msg.(Response)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	if err := responseError(res); err != nil {
+		return err
+	}
+
+	c.mut.Lock()
+	select {
+	case <-c.stop:
+		c.mut.Unlock()
+		return errors.New("stopped")
+	default:
+	}
+	c.conn = conn
+	c.connected = true
+	c.err = nil
+	c.mut.Unlock()
+
+	l.Infoln("Joined relay", c.uri)
+
+	// Pings are sent from their own routine; everything else is answered
+	// from the reading loop. Writes are serialized by wmut.
+
+	wmut := sync.NewMutex()
+	write := func(msg message) error {
+		wmut.Lock()
+		defer wmut.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		return WriteMessage(conn, msg)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(pingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := write(Ping{}); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(pingTimeout))
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case Ping:
+			if err := write(Pong{}); err != nil {
+				return err
+			}
+		case Pong:
+		case SessionInvitation:
+			if len(msg.Address) == 0 {
+				// The session is on the relay itself.
+				msg.Address = relayIP(conn)
+			}
+			select {
+			case c.invitations <- msg:
+			case <-c.stop:
+				return errors.New("stopped")
+			}
+		case Response:
+			return responseError(msg)
+		default:
+			return fmt.Errorf("unexpected message %T", msg)
+		}
+	}
+}
+
+// Stop leaves the relay.
+func (c *Client) Stop() {
+	c.mut.Lock()
+	close(c.stop)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mut.Unlock()
+}
+
+// URI returns the address of the relay.
+func (c *Client) URI() *url.URL {
+	return c.uri
+}
+
+// Status returns whether we are joined to the relay, and the error that
+// made us leave it last.
+func (c *Client) Status() (bool, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.connected, c.err
+}
+
+// GetInvitation asks the relay for an invitation to a session with the
+// given device, which must be joined to the relay.
+func GetInvitation(uri *url.URL, id protocol.DeviceID, certs []tls.Certificate, dialer Dialer, timeout time.Duration) (SessionInvitation, error) {
+	conn, err := dialRelay(uri, certs, dialer, timeout)
+	if err != nil {
+		return SessionInvitation{}, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := WriteMessage(conn, ConnectRequest{ID: id[:]}); err != nil {
+		return SessionInvitation{}, err
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return SessionInvitation{}, err
+	}
+
+	switch msg := msg.(type) {
+	case SessionInvitation:
+		if len(msg.Address) == 0 {
+			msg.Address = relayIP(conn)
+		}
+		return msg, nil
+	case Response:
+		if err := responseError(msg); err != nil {
+			return SessionInvitation{}, err
+		}
+	}
+	return SessionInvitation{}, fmt.Errorf("unexpected message %T", msg)
+}
+
+// JoinSession connects to the session we were invited to. Once the other
+// device has joined as well, the returned connection leads to it.
+func JoinSession(inv SessionInvitation, dialer Dialer, timeout time.Duration) (net.Conn, error) {
+	addr := net.JoinHostPort(net.IP(inv.Address).String(), fmt.Sprint(inv.Port))
+	conn, err := dial(dialer, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := WriteMessage(conn, JoinSessionRequest{Key: inv.Key}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, ok := msg.(Response)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected message %T", msg)
+	}
+	if err := responseError(res); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Latency returns the time it takes to connect to the relay and get an
+// answer to a ping.
+func Latency(uri *url.URL, certs []tls.Certificate, dialer Dialer, timeout time.Duration) (time.Duration, error) {
+	t0 := time.Now()
+	conn, err := dialRelay(uri, certs, dialer, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := WriteMessage(conn, Ping{}); err != nil {
+		return 0, err
+	}
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := msg.(Pong); !ok {
+		return 0, fmt.Errorf("unexpected message %T", msg)
+	}
+	return time.Since(t0), nil
+}
+
+// dialRelay connects to the relay in protocol mode. If the address has an
+// id parameter, the relay must present the certificate of that device ID.
+func dialRelay(uri *url.URL, certs []tls.Certificate, dialer Dialer, timeout time.Duration) (*tls.Conn, error) {
+	if uri.Scheme != "relay" {
+		return nil, fmt.Errorf("unsupported relay scheme %q", uri.Scheme)
+	}
+
+	raw, err := dial(dialer, uri.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{
+		Certificates:       certs,
+		NextProtos:         []string{ProtocolName},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if idStr := uri.Query().Get("id"); idStr != "" {
+		id, err := protocol.DeviceIDFromString(idStr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		certs := conn.ConnectionState().PeerCertificates
+		if len(certs) != 1 || protocol.NewDeviceID(certs[0].Raw) != id {
+			conn.Close()
+			return nil, fmt.Errorf("relay %s presented an unexpected certificate", uri.Host)
+		}
+	}
+
+	return conn, nil
+}
+
+// dial connects to the address with the dialer, or directly if it's nil.
+func dial(dialer Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: timeout}
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+func relayIP(conn net.Conn) []byte {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return ip4
+		}
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
+)
+
+var (
+	debug = trace.Register("relay")
+	l     = logger.DefaultLogger
+)
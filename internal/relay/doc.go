@@ -0,0 +1,19 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package relay implements the relay protocol, which lets two devices that
+// can't reach each other connect through a third party.
+//
+// A device joins a relay by connecting to it over TLS and sending a
+// JoinRelayRequest. It stays connected, and is sent a SessionInvitation
+// whenever another device wants to connect to it. The other device gets its
+// own invitation to the same session by sending a ConnectRequest with the
+// ID of the device it wants to reach. Both then connect to the session
+// address of the relay, send a JoinSessionRequest with the key from their
+// invitation, and once both have joined the relay passes data between them
+// as is. The devices set up TLS over the session like over any other
+// connection; the relay never sees the data.
+package relay
@@ -0,0 +1,136 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	headerSize     = 12
+	maxMessageSize = 1024
+)
+
+// Response codes
+const (
+	ResponseSuccess          = 0
+	ResponseNotFound         = 1
+	ResponseAlreadyConnected = 2
+	ResponseNotAllowed       = 3
+	ResponseUnexpected       = 100
+)
+
+var (
+	ErrNotFound         = errors.New("device not found on the relay")
+	ErrAlreadyConnected = errors.New("device already connected to the relay")
+	ErrNotAllowed       = errors.New("device not allowed on the relay")
+)
+
+type message interface {
+	AppendXDR([]byte) ([]byte, error)
+}
+
+// WriteMessage writes the message, preceded by its header.
+func WriteMessage(w io.Writer, msg message) error {
+	var typ int32
+	switch msg.(type) {
+	case Ping:
+		typ = messageTypePing
+	case Pong:
+		typ = messageTypePong
+	case JoinRelayRequest:
+		typ = messageTypeJoinRelayRequest
+	case JoinSessionRequest:
+		typ = messageTypeJoinSessionRequest
+	case Response:
+		typ = messageTypeResponse
+	case ConnectRequest:
+		typ = messageTypeConnectRequest
+	case SessionInvitation:
+		typ = messageTypeSessionInvitation
+	default:
+		return fmt.Errorf("unknown message type %T", msg)
+	}
+
+	buf, err := msg.AppendXDR(make([]byte, headerSize, 64))
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(buf[0:], magic)
+	binary.BigEndian.PutUint32(buf[4:], uint32(typ))
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(buf)-headerSize))
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a message and returns it as one of the message types,
+// i.e. Ping, Pong, etc.
+func ReadMessage(r io.Reader) (interface{}, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if m := binary.BigEndian.Uint32(hdr[0:]); m != magic {
+		return nil, fmt.Errorf("incorrect magic 0x%08x", m)
+	}
+	typ := int32(binary.BigEndian.Uint32(hdr[4:]))
+	size := binary.BigEndian.Uint32(hdr[8:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message too large (%d bytes)", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case messageTypePing:
+		return Ping{}, nil
+	case messageTypePong:
+		return Pong{}, nil
+	case messageTypeJoinRelayRequest:
+		return JoinRelayRequest{}, nil
+	case messageTypeJoinSessionRequest:
+		var msg JoinSessionRequest
+		err := msg.UnmarshalXDR(buf)
+		return msg, err
+	case messageTypeResponse:
+		var msg Response
+		err := msg.UnmarshalXDR(buf)
+		return msg, err
+	case messageTypeConnectRequest:
+		var msg ConnectRequest
+		err := msg.UnmarshalXDR(buf)
+		return msg, err
+	case messageTypeSessionInvitation:
+		var msg SessionInvitation
+		err := msg.UnmarshalXDR(buf)
+		return msg, err
+	}
+	return nil, fmt.Errorf("unknown message type %d", typ)
+}
+
+// responseError returns the error corresponding to a Response, nil for
+// success.
+func responseError(res Response) error {
+	switch res.Code {
+	case ResponseSuccess:
+		return nil
+	case ResponseNotFound:
+		return ErrNotFound
+	case ResponseAlreadyConnected:
+		return ErrAlreadyConnected
+	case ResponseNotAllowed:
+		return ErrNotAllowed
+	}
+	return fmt.Errorf("relay error %d: %s", res.Code, res.Message)
+}
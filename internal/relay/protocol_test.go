@@ -0,0 +1,54 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundtrip(t *testing.T) {
+	msgs := []message{
+		Ping{},
+		Pong{},
+		JoinRelayRequest{},
+		JoinSessionRequest{Key: []byte("0123456789abcdef")},
+		Response{Code: ResponseNotFound, Message: "not found"},
+		ConnectRequest{ID: bytes.Repeat([]byte{0x42}, 32)},
+		SessionInvitation{
+			From:         bytes.Repeat([]byte{0x17}, 32),
+			Key:          []byte("fedcba9876543210"),
+			Address:      []byte{192, 0, 2, 42},
+			Port:         22067,
+			ServerSocket: true,
+		},
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range msgs {
+		res, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res, msg) {
+			t.Errorf("incorrect message %#v != %#v", res, msg)
+		}
+	}
+}
+
+func TestReadMessageBadMagic(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, headerSize))
+	if _, err := ReadMessage(buf); err == nil {
+		t.Error("unexpected nil error for incorrect magic")
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	sessionJoinTimeout = 30 * time.Second // for both devices to join a session
+	handshakeTimeout   = 10 * time.Second
+	pendingInvitations = 8
+)
+
+// ServerOptions configures a relay Server.
+type ServerOptions struct {
+	ListenAddress  string              // Protocol mode, over TLS.
+	SessionAddress string              // Session mode, plain TCP.
+	MaxKbps        int                 // For all sessions together; 0 for unlimited.
+	SessionKbps    int                 // For each session; 0 for unlimited.
+	Devices        []protocol.DeviceID // When set, only these devices may join the relay. Anyone may still connect to a joined device.
+}
+
+// A Server relays connections between the devices that use it.
+type Server struct {
+	relayed  int64 // bytes, accessed atomically; first for alignment
+	opts     ServerOptions
+	tlsCfg   *tls.Config
+	listener net.Listener
+	sessions net.Listener
+	limit    *ratelimit.Bucket
+	stop     chan struct{}
+
+	joined  map[protocol.DeviceID]chan SessionInvitation
+	pending map[string]*session // by key
+	conns   map[net.Conn]struct{}
+	active  int
+	mut     sync.Mutex
+}
+
+// A session waits for the two devices to join with their keys.
+type session struct {
+	keys  [2]string
+	conns [2]net.Conn
+	timer *time.Timer
+}
+
+// NewServer returns a relay presenting the given certificate, listening on
+// the addresses in the options.
+func NewServer(cert tls.Certificate, opts ServerOptions) (*Server, error) {
+	tlsCfg := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		NextProtos:             []string{ProtocolName},
+		ClientAuth:             tls.RequestClientCert,
+		SessionTicketsDisabled: true,
+		MinVersion:             tls.VersionTLS12,
+	}
+
+	listener, err := tls.Listen("tcp", opts.ListenAddress, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := net.Listen("tcp", opts.SessionAddress)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		opts:     opts,
+		tlsCfg:   tlsCfg,
+		listener: listener,
+		sessions: sessions,
+		stop:     make(chan struct{}),
+		joined:   make(map[protocol.DeviceID]chan SessionInvitation),
+		pending:  make(map[string]*session),
+		conns:    make(map[net.Conn]struct{}),
+		mut:      sync.NewMutex(),
+	}
+	if opts.MaxKbps > 0 {
+		s.limit = osutil.NewRateLimit(opts.MaxKbps)
+	}
+	return s, nil
+}
+
+func (s *Server) Serve() {
+	go s.accept(s.sessions, s.handleSession)
+	s.accept(s.listener, s.handleProtocol)
+}
+
+func (s *Server) Stop() {
+	close(s.stop)
+	s.listener.Close()
+	s.sessions.Close()
+
+	s.mut.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mut.Unlock()
+}
+
+// Addr returns the address of the protocol mode listener.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Status returns the number of joined devices, of active sessions, and of
+// bytes relayed so far.
+func (s *Server) Status() map[string]interface{} {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return map[string]interface{}{
+		"listenAddress":  s.listener.Addr().String(),
+		"sessionAddress": s.sessions.Addr().String(),
+		"joinedDevices":  len(s.joined),
+		"activeSessions": s.active,
+		"bytesRelayed":   atomic.LoadInt64(&s.relayed),
+	}
+}
+
+func (s *Server) accept(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			l.Warnln("Relay server:", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// track remembers the connection, so that it's closed when we stop. It
+// returns false if we are already stopping.
+func (s *Server) track(conn net.Conn) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	select {
+	case <-s.stop:
+		return false
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mut.Lock()
+	delete(s.conns, conn)
+	s.mut.Unlock()
+	conn.Close()
+}
+
+func (s *Server) handleProtocol(conn net.Conn) {
+	defer s.untrack(conn)
+
+	tc := conn.(*tls.Conn)
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		if debug.Enabled() {
+			l.Debugf("relay server: handshake with %s: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) != 1 {
+		return
+	}
+	id := protocol.NewDeviceID(certs[0].Raw)
+
+	for {
+		tc.SetDeadline(time.Now().Add(handshakeTimeout))
+		msg, err := ReadMessage(tc)
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case Ping:
+			if err := WriteMessage(tc, Pong{}); err != nil {
+				return
+			}
+
+		case JoinRelayRequest:
+			s.serveJoined(tc, id)
+			return
+
+		case ConnectRequest:
+			s.connect(tc, id, protocol.DeviceIDFromBytes(msg.ID))
+			return
+
+		default:
+			WriteMessage(tc, Response{Code: ResponseUnexpected, Message: "unexpected message"})
+			return
+		}
+	}
+}
+
+// serveJoined keeps the device joined until it leaves, passing it the
+// invitations for sessions other devices set up with it.
+func (s *Server) serveJoined(conn *tls.Conn, id protocol.DeviceID) {
+	if !s.allowed(id) {
+		WriteMessage(conn, Response{Code: ResponseNotAllowed, Message: "not allowed"})
+		return
+	}
+
+	invitations := make(chan SessionInvitation, pendingInvitations)
+	s.mut.Lock()
+	if _, ok := s.joined[id]; ok {
+		s.mut.Unlock()
+		WriteMessage(conn, Response{Code: ResponseAlreadyConnected, Message: "already connected"})
+		return
+	}
+	s.joined[id] = invitations
+	s.mut.Unlock()
+
+	defer func() {
+		s.mut.Lock()
+		delete(s.joined, id)
+		s.mut.Unlock()
+	}()
+
+	if debug.Enabled() {
+		l.Debugf("relay server: %s joined from %s", id, conn.RemoteAddr())
+	}
+
+	// The reading loop answers pings and notices when the device leaves;
+	// invitations are written from here. Writes are serialized by wmut.
+
+	wmut := sync.NewMutex()
+	write := func(msg message) error {
+		wmut.Lock()
+		defer wmut.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+		return WriteMessage(conn, msg)
+	}
+
+	if err := write(Response{Code: ResponseSuccess}); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn.SetReadDeadline(time.Now().Add(pingTimeout))
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			switch msg.(type) {
+			case Ping:
+				if err := write(Pong{}); err != nil {
+					return
+				}
+			case Pong:
+			default:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case inv := <-invitations:
+			if err := write(inv); err != nil {
+				conn.Close()
+				<-done
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// connect sets up a session between the device and the joined device it
+// wants to reach, and sends them both invitations to it. The joined device
+// acts as the TLS server.
+func (s *Server) connect(conn *tls.Conn, from, to protocol.DeviceID) {
+	s.mut.Lock()
+	invitations, ok := s.joined[to]
+	s.mut.Unlock()
+	if !ok {
+		WriteMessage(conn, Response{Code: ResponseNotFound, Message: "not found"})
+		return
+	}
+
+	sess := s.newSession()
+	port := uint16(s.sessions.Addr().(*net.TCPAddr).Port)
+
+	select {
+	case invitations <- SessionInvitation{From: from[:], Key: []byte(sess.keys[1]), Port: port, ServerSocket: true}:
+	default:
+		s.dropSession(sess)
+		WriteMessage(conn, Response{Code: ResponseUnexpected, Message: "too many pending invitations"})
+		return
+	}
+
+	WriteMessage(conn, SessionInvitation{From: to[:], Key: []byte(sess.keys[0]), Port: port, ServerSocket: false})
+}
+
+func (s *Server) newSession() *session {
+	sess := &session{}
+	for i := range sess.keys {
+		key := make([]byte, 32)
+		rand.Read(key)
+		sess.keys[i] = string(key)
+	}
+
+	s.mut.Lock()
+	for _, key := range sess.keys {
+		s.pending[key] = sess
+	}
+	sess.timer = time.AfterFunc(sessionJoinTimeout, func() {
+		s.dropSession(sess)
+	})
+	s.mut.Unlock()
+	return sess
+}
+
+// dropSession forgets a session the devices didn't both join in time.
+func (s *Server) dropSession(sess *session) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.pending[sess.keys[0]]; !ok {
+		// Already started.
+		return
+	}
+	for i, key := range sess.keys {
+		delete(s.pending, key)
+		if sess.conns[i] != nil {
+			delete(s.conns, sess.conns[i])
+			sess.conns[i].Close()
+		}
+	}
+}
+
+func (s *Server) handleSession(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		s.untrack(conn)
+		return
+	}
+	req, ok := msg.(JoinSessionRequest)
+	if !ok {
+		WriteMessage(conn, Response{Code: ResponseUnexpected, Message: "unexpected message"})
+		s.untrack(conn)
+		return
+	}
+
+	s.mut.Lock()
+	sess, ok := s.pending[string(req.Key)]
+	if !ok {
+		s.mut.Unlock()
+		WriteMessage(conn, Response{Code: ResponseNotFound, Message: "no such session"})
+		s.untrack(conn)
+		return
+	}
+	for i, key := range sess.keys {
+		if key == string(req.Key) && sess.conns[i] == nil {
+			sess.conns[i] = conn
+		}
+	}
+	if sess.conns[0] == nil || sess.conns[1] == nil {
+		// Wait for the other device.
+		s.mut.Unlock()
+		return
+	}
+	sess.timer.Stop()
+	for _, key := range sess.keys {
+		delete(s.pending, key)
+	}
+	s.active++
+	s.mut.Unlock()
+
+	s.relay(sess.conns[0], sess.conns[1])
+
+	s.mut.Lock()
+	s.active--
+	s.mut.Unlock()
+}
+
+// relay passes data between the two connections until either is closed.
+func (s *Server) relay(a, b net.Conn) {
+	defer s.untrack(a)
+	defer s.untrack(b)
+
+	for _, conn := range []net.Conn{a, b} {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := WriteMessage(conn, Response{Code: ResponseSuccess}); err != nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	var limit *ratelimit.Bucket
+	if s.opts.SessionKbps > 0 {
+		limit = osutil.NewRateLimit(s.opts.SessionKbps)
+	}
+
+	done := make(chan struct{}, 2)
+	pass := func(dst, src net.Conn) {
+		io.Copy(dst, &limitedReader{src, []*ratelimit.Bucket{limit, s.limit}, &s.relayed})
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pass(a, b)
+	go pass(b, a)
+	<-done
+	<-done
+}
+
+func (s *Server) allowed(id protocol.DeviceID) bool {
+	if len(s.opts.Devices) == 0 {
+		return true
+	}
+	for _, dev := range s.opts.Devices {
+		if dev == id {
+			return true
+		}
+	}
+	return false
+}
+
+// A limitedReader waits for the data it has read to be allowed by each of
+// the buckets (a nil bucket allows anything), and counts it.
+type limitedReader struct {
+	r       io.Reader
+	buckets []*ratelimit.Bucket
+	count   *int64
+}
+
+func (r *limitedReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	for _, b := range r.buckets {
+		if b != nil {
+			b.Wait(int64(n))
+		}
+	}
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
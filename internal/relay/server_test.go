@@ -0,0 +1,216 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestCert(t *testing.T) (tls.Certificate, protocol.DeviceID) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syncthing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, protocol.NewDeviceID(der)
+}
+
+func newTestServer(t *testing.T, opts ServerOptions) (*Server, *url.URL) {
+	cert, id := newTestCert(t)
+	opts.ListenAddress = "127.0.0.1:0"
+	opts.SessionAddress = "127.0.0.1:0"
+	srv, err := NewServer(cert, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+
+	uri, err := url.Parse(fmt.Sprintf("relay://%s/?id=%s", srv.Addr(), id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, uri
+}
+
+// waitJoined waits for the client to have joined the relay, or to have
+// failed doing so.
+func waitJoined(c *Client) (bool, error) {
+	t0 := time.Now()
+	for time.Since(t0) < testTimeout {
+		if connected, err := c.Status(); connected || err != nil {
+			return connected, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false, nil
+}
+
+func TestRelaySession(t *testing.T) {
+	srv, uri := newTestServer(t, ServerOptions{})
+	defer srv.Stop()
+
+	certA, idA := newTestCert(t)
+	certB, idB := newTestCert(t)
+
+	// A joins the relay and B connects to it.
+
+	invitations := make(chan SessionInvitation, 1)
+	client := NewClient(uri, []tls.Certificate{certA}, nil, testTimeout, invitations)
+	go client.Serve()
+	defer client.Stop()
+
+	if ok, err := waitJoined(client); !ok {
+		t.Fatal("not joined:", err)
+	}
+
+	if _, err := GetInvitation(uri, idB, []tls.Certificate{certB}, nil, testTimeout); err != ErrNotFound {
+		t.Errorf("unexpected error %v for a device not on the relay", err)
+	}
+
+	invB, err := GetInvitation(uri, idA, []tls.Certificate{certB}, nil, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol.DeviceIDFromBytes(invB.From) != idA || invB.ServerSocket {
+		t.Errorf("incorrect invitation %+v for B", invB)
+	}
+
+	var invA SessionInvitation
+	select {
+	case invA = <-invitations:
+	case <-time.After(testTimeout):
+		t.Fatal("no invitation for A")
+	}
+	if protocol.DeviceIDFromBytes(invA.From) != idB || !invA.ServerSocket {
+		t.Errorf("incorrect invitation %+v for A", invA)
+	}
+
+	// Both join the session, and what one sends arrives at the other.
+
+	joined := make(chan error)
+	go func() {
+		conn, err := JoinSession(invA, nil, testTimeout)
+		if err == nil {
+			_, err = conn.Write([]byte("hello"))
+			conn.Close()
+		}
+		joined <- err
+	}()
+
+	conn, err := JoinSession(invB, nil, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-joined; err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	var buf [5]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:]) != "hello" {
+		t.Errorf("incorrect data %q", buf)
+	}
+}
+
+func TestRelayAllowedDevices(t *testing.T) {
+	certA, idA := newTestCert(t)
+	certB, _ := newTestCert(t)
+
+	srv, uri := newTestServer(t, ServerOptions{Devices: []protocol.DeviceID{idA}})
+	defer srv.Stop()
+
+	clientA := NewClient(uri, []tls.Certificate{certA}, nil, testTimeout, make(chan SessionInvitation))
+	go clientA.Serve()
+	defer clientA.Stop()
+	if ok, err := waitJoined(clientA); !ok {
+		t.Error("allowed device not joined:", err)
+	}
+
+	clientB := NewClient(uri, []tls.Certificate{certB}, nil, testTimeout, make(chan SessionInvitation))
+	go clientB.Serve()
+	defer clientB.Stop()
+	if ok, err := waitJoined(clientB); ok || err != ErrNotAllowed {
+		t.Errorf("unexpected join state %v, %v for a device not allowed", ok, err)
+	}
+}
+
+func TestRelayLatency(t *testing.T) {
+	srv, uri := newTestServer(t, ServerOptions{})
+	defer srv.Stop()
+
+	cert, _ := newTestCert(t)
+	if _, err := Latency(uri, []tls.Certificate{cert}, nil, testTimeout); err != nil {
+		t.Error(err)
+	}
+
+	// A relay presenting another certificate than the expected one is
+	// refused.
+
+	_, otherID := newTestCert(t)
+	q := uri.Query()
+	q.Set("id", otherID.String())
+	uri.RawQuery = q.Encode()
+	if _, err := Latency(uri, []tls.Certificate{cert}, nil, testTimeout); err == nil {
+		t.Error("unexpected nil error for a relay with the wrong ID")
+	}
+}
+
+// A countingDialer counts the connections made through it.
+type countingDialer struct {
+	dials int32
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return net.DialTimeout(network, addr, testTimeout)
+}
+
+func TestRelayDialer(t *testing.T) {
+	srv, uri := newTestServer(t, ServerOptions{})
+	defer srv.Stop()
+
+	cert, _ := newTestCert(t)
+	dialer := new(countingDialer)
+	if _, err := Latency(uri, []tls.Certificate{cert}, dialer, testTimeout); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&dialer.dials); n != 1 {
+		t.Errorf("Relay dialed %d times through the dialer, expected once", n)
+	}
+}
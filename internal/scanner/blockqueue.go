@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
 	"github.com/syncthing/syncthing/internal/sync"
 )
 
@@ -39,7 +40,7 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 	fd, err := os.Open(path)
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("open:", err)
 		}
 		return []protocol.BlockInfo{}, err
@@ -48,7 +49,7 @@ func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 	fi, err := fd.Stat()
 	if err != nil {
 		fd.Close()
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("stat:", err)
 		}
 		return []protocol.BlockInfo{}, err
@@ -59,14 +60,14 @@ func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 
 func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
 	for f := range inbox {
-		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() {
+		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() || db.IsHardLink(f) {
 			outbox <- f
 			continue
 		}
 
 		blocks, err := HashFile(filepath.Join(dir, f.Name), blockSize)
 		if err != nil {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("hash error:", f.Name, err)
 			}
 			continue
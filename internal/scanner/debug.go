@@ -7,13 +7,11 @@
 package scanner
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "scanner") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("scanner")
 	l     = logger.DefaultLogger
 )
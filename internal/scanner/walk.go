@@ -8,6 +8,7 @@ package scanner
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -38,6 +39,16 @@ func init() {
 	}
 }
 
+// ReparsePolicy decides what the walker does with junctions and other reparse
+// points that aren't symlinks.
+type ReparsePolicy int
+
+const (
+	ReparseSkip   ReparsePolicy = iota // skip them silently
+	ReparseFollow                      // treat them as the directory or file they point to
+	ReparseError                       // fail the walk
+)
+
 type Walker struct {
 	// Dir is the base directory for the walk
 	Dir string
@@ -59,6 +70,17 @@ type Walker struct {
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+	// If IgnoreAttrs is true, DOS file attributes (hidden, system,
+	// read-only) are not read from disk. Whatever attributes the index had
+	// for the file are kept.
+	IgnoreAttrs bool
+	// If DetectHardLinks is true, files that are hard links to a file
+	// already seen during the walk are reported as links to that file
+	// instead of being hashed again.
+	DetectHardLinks bool
+	// ReparsePoints decides how junctions and other reparse points that
+	// aren't symlinks are handled.
+	ReparsePoints ReparsePolicy
 	// When AutoNormalize is set, file names that are in UTF8 but incorrect
 	// normalization form will be corrected.
 	AutoNormalize bool
@@ -66,6 +88,13 @@ type Walker struct {
 	Hashers int
 	// Our vector clock id
 	ShortID uint64
+	// If Marker is not empty, it's the name of a folder marker file in Dir,
+	// which is ignored like .stfolder. A directory serving as the marker is
+	// walked as usual.
+	Marker string
+
+	// The error that made the walk stop early, if any.
+	err error
 }
 
 type TempNamer interface {
@@ -83,7 +112,7 @@ type CurrentFiler interface {
 // Walk returns the list of files found in the local folder by scanning the
 // file system. Files are blockwise hashed.
 func (w *Walker) Walk() (chan protocol.FileInfo, error) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("Walk", w.Dir, w.Subs, w.BlockSize, w.Matcher)
 	}
 
@@ -99,10 +128,12 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 	go func() {
 		hashFiles := w.walkAndHashFiles(files)
 		if len(w.Subs) == 0 {
-			filepath.Walk(w.Dir, hashFiles)
+			w.err = filepath.Walk(w.Dir, hashFiles)
 		} else {
 			for _, sub := range w.Subs {
-				filepath.Walk(filepath.Join(w.Dir, sub), hashFiles)
+				if w.err = filepath.Walk(filepath.Join(w.Dir, sub), hashFiles); w.err != nil {
+					break
+				}
 			}
 		}
 		close(files)
@@ -111,9 +142,28 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 	return hashedFiles, nil
 }
 
+// Err returns the error that stopped the walk early, if any. The files seen
+// until then are not everything there is, so nothing should be considered
+// deleted because it wasn't seen. Err must only be called once the channel
+// returned by Walk has been closed.
+func (w *Walker) Err() error {
+	return w.err
+}
+
 func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFunc {
 	now := time.Now()
-	return func(p string, info os.FileInfo, err error) error {
+	hardLinks := make(map[osutil.FileID]string)
+
+	// The real locations of the directories we've walked through reparse
+	// points, starting with the folder itself, and the file reparse points
+	// we've followed.
+	followed := make(map[string]bool)
+	if root, err := filepath.EvalSymlinks(w.Dir); err == nil {
+		followed[canonicalPath(root)] = true
+	}
+
+	var hashFiles filepath.WalkFunc
+	hashFiles = func(p string, info os.FileInfo, err error) error {
 		// Return value used when we are returning early and don't want to
 		// process the item. For directories, this means do-not-descend.
 		var skip error // nil
@@ -123,7 +173,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if err != nil {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("error:", p, info, err)
 			}
 			return skip
@@ -131,7 +181,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		rn, err := filepath.Rel(w.Dir, p)
 		if err != nil {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("rel error:", p, err)
 			}
 			return skip
@@ -148,12 +198,12 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		if w.TempNamer != nil && w.TempNamer.IsTemporary(rn) {
 			// A temporary file
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("temporary:", rn)
 			}
 			if info.Mode().IsRegular() && mtime.Add(w.TempLifetime).Before(now) {
 				os.Remove(p)
-				if debug {
+				if debug.Enabled() {
 					l.Debugln("removing temporary:", rn, mtime)
 				}
 			}
@@ -161,9 +211,10 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if sn := filepath.Base(rn); sn == ".stignore" || sn == ".stfolder" ||
+			(rn == w.Marker && !info.IsDir()) ||
 			strings.HasPrefix(rn, ".stversions") || w.Matcher.Match(rn) {
 			// An ignored file
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("ignored:", rn)
 			}
 			return skip
@@ -214,6 +265,26 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			rn = normalizedRn
 		}
 
+		if !followed[canonicalPath(p)] && osutil.IsReparsePoint(p, info) {
+			// A junction or other reparse point. Descending into one may
+			// take us out of the folder or around in circles, so we only do
+			// so when told to, and never into a loop.
+			switch w.ReparsePoints {
+			case ReparseFollow:
+				if err := w.followReparsePoint(p, rn, followed, hashFiles); err != nil {
+					return err
+				}
+				return skip
+			case ReparseError:
+				return fmt.Errorf("%s: reparse point not allowed in folder", rn)
+			default:
+				if debug.Enabled() {
+					l.Debugln("reparse point:", rn)
+				}
+				return skip
+			}
+		}
+
 		var cf protocol.FileInfo
 		var ok bool
 
@@ -235,7 +306,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			target, flags, err := symlinks.Read(p)
 			flags = flags & protocol.SymlinkTypeMask
 			if err != nil {
-				if debug {
+				if debug.Enabled() {
 					l.Debugln("readlink error:", p, err)
 				}
 				return skip
@@ -243,7 +314,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 			blocks, err := Blocks(strings.NewReader(target), w.BlockSize, 0)
 			if err != nil {
-				if debug {
+				if debug.Enabled() {
 					l.Debugln("hash link error:", p, err)
 				}
 				return skip
@@ -271,7 +342,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				Blocks:   blocks,
 			}
 
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("symlink to hash:", p, f)
 			}
 
@@ -289,14 +360,16 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - was a directory previously (not a file or something else)
 				//  - was not a symlink (since it's a directory now)
 				//  - was not invalid (since it looks valid now)
+				//  - has the same file attributes as previously
 				cf, ok = w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() {
+				attrsUnchanged := cf.Flags&db.AttributeMask == w.attributeFlags(p, cf)
+				if ok && permUnchanged && attrsUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() {
 					return nil
 				}
 			}
 
-			flags := uint32(protocol.FlagDirectory)
+			flags := uint32(protocol.FlagDirectory) | w.attributeFlags(p, cf)
 			if w.IgnorePerms {
 				flags |= protocol.FlagNoPermBits | 0777
 			} else {
@@ -308,7 +381,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				Flags:    flags,
 				Modified: mtime.Unix(),
 			}
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("dir:", p, f)
 			}
 			fchan <- f
@@ -321,6 +394,16 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				curMode |= 0111
 			}
 
+			if w.DetectHardLinks {
+				if id, nlink, ok := osutil.HardLinkInfo(info); ok && nlink > 1 {
+					if target, seen := hardLinks[id]; seen {
+						w.walkHardLink(p, rn, target, curMode, mtime, fchan)
+						return nil
+					}
+					hardLinks[id] = rn
+				}
+			}
+
 			if w.CurrentFiler != nil {
 				// A file is "unchanged", if it
 				//  - exists
@@ -329,16 +412,29 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				//  - had the same modification time as it has now
 				//  - was not a directory previously (since it's a file now)
 				//  - was not a symlink (since it's a file now)
+				//  - was not a hard link (since it's the first of its kind now)
 				//  - was not invalid (since it looks valid now)
 				//  - has the same size as previously
+				//  - has the same file attributes as previously
 				cf, ok = w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, curMode)
-				if ok && permUnchanged && !cf.IsDeleted() && cf.Modified == mtime.Unix() && !cf.IsDirectory() &&
-					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size() {
+				attrsUnchanged := cf.Flags&db.AttributeMask == w.attributeFlags(p, cf)
+				if ok && permUnchanged && attrsUnchanged && !cf.IsDeleted() && cf.Modified == mtime.Unix() && !cf.IsDirectory() &&
+					!cf.IsSymlink() && !db.IsHardLink(cf) && !cf.IsInvalid() && cf.Size() == info.Size() {
 					return nil
 				}
 
-				if debug {
+				// The same goes for a file that was a hard link, but that we
+				// don't see as one. Either we're not looking for hard links,
+				// the filesystem can't tell us about them, or the link was
+				// pulled as a copy of the target. Either way it has the size
+				// of the target.
+				if ok && permUnchanged && attrsUnchanged && !cf.IsDeleted() && cf.Modified == mtime.Unix() &&
+					db.IsHardLink(cf) && !cf.IsInvalid() && w.hardLinkTargetSize(cf) == info.Size() {
+					return nil
+				}
+
+				if debug.Enabled() {
 					l.Debugln("rescan:", cf, mtime.Unix(), info.Mode()&os.ModePerm)
 				}
 			}
@@ -347,6 +443,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			if w.IgnorePerms {
 				flags = protocol.FlagNoPermBits | 0666
 			}
+			flags |= w.attributeFlags(p, cf)
 
 			f := protocol.FileInfo{
 				Name:     rn,
@@ -354,7 +451,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				Flags:    flags,
 				Modified: mtime.Unix(),
 			}
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("to hash:", p, f)
 			}
 			fchan <- f
@@ -362,6 +459,138 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		return nil
 	}
+	return hashFiles
+}
+
+// followReparsePoint walks what the reparse point at path (known as rn in the
+// folder) points to, as if it was at path. Each directory is followed once
+// per walk, and never when it contains the reparse point itself; either
+// would have us walking in circles.
+func (w *Walker) followReparsePoint(path, rn string, followed map[string]bool, fn filepath.WalkFunc) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		l.Infof("Reparse point %q can't be resolved; skipping: %v", rn, err)
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		l.Infof("Reparse point %q can't be resolved; skipping: %v", rn, err)
+		return nil
+	}
+
+	if !info.IsDir() {
+		// The file is what it points to.
+		followed[canonicalPath(path)] = true
+		return fn(path, info, nil)
+	}
+
+	key := canonicalPath(target)
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	sep := string(os.PathSeparator)
+	if followed[key] || strings.HasPrefix(canonicalPath(parent)+sep, strings.TrimSuffix(key, sep)+sep) {
+		l.Infof("Reparse point %q leads to a loop; skipping.", rn)
+		return nil
+	}
+	followed[key] = true
+
+	return filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+		rel, rerr := filepath.Rel(target, p)
+		if rerr != nil {
+			return rerr
+		}
+		return fn(filepath.Join(path, rel), info, err)
+	})
+}
+
+// canonicalPath returns path in a form that compares equal for equal paths.
+func canonicalPath(path string) string {
+	path = filepath.Clean(path)
+	if runtime.GOOS == "windows" {
+		// Paths are case insensitive on Windows.
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// walkHardLink sends the index entry for the file at path (known as rn in
+// the folder), which is a hard link to the previously seen target, unless
+// the entry is unchanged.
+func (w *Walker) walkHardLink(path, rn, target string, curMode uint32, mtime time.Time, fchan chan protocol.FileInfo) {
+	blocks := HardLinkBlocks(target)
+
+	var cf protocol.FileInfo
+	if w.CurrentFiler != nil {
+		// A hard link is "unchanged", if it
+		//  - exists
+		//  - has the same permissions as previously, unless we are ignoring permissions
+		//  - was not marked deleted (since it apparently exists now)
+		//  - had the same modification time as it has now
+		//  - was a hard link
+		//  - was not invalid (since it looks valid now)
+		//  - has the same file attributes as previously
+		//  - the block list (i.e. hash of target) was the same
+		var ok bool
+		cf, ok = w.CurrentFiler.CurrentFile(rn)
+		permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, curMode)
+		attrsUnchanged := cf.Flags&db.AttributeMask == w.attributeFlags(path, cf)
+		if ok && permUnchanged && attrsUnchanged && !cf.IsDeleted() && cf.Modified == mtime.Unix() && db.IsHardLink(cf) &&
+			!cf.IsInvalid() && BlocksEqual(cf.Blocks, blocks) {
+			return
+		}
+	}
+
+	var flags = curMode & uint32(maskModePerm)
+	if w.IgnorePerms {
+		flags = protocol.FlagNoPermBits | 0666
+	}
+	flags |= db.FlagHardLink | w.attributeFlags(path, cf)
+
+	f := protocol.FileInfo{
+		Name:     rn,
+		Version:  cf.Version.Update(w.ShortID),
+		Flags:    flags,
+		Modified: mtime.Unix(),
+		Blocks:   blocks,
+	}
+	if debug.Enabled() {
+		l.Debugln("hard link:", path, target, f)
+	}
+	fchan <- f
+}
+
+// hardLinkTargetSize returns the size of the target of the hard link cf, or
+// -1 if the target is unknown.
+func (w *Walker) hardLinkTargetSize(cf protocol.FileInfo) int64 {
+	tf, ok := w.CurrentFiler.CurrentFile(HardLinkTarget(cf.Blocks))
+	if !ok || tf.IsDeleted() || tf.IsInvalid() || tf.IsDirectory() || tf.IsSymlink() || db.IsHardLink(tf) {
+		return -1
+	}
+	return tf.Size()
+}
+
+// attributeFlags returns the attribute flags for the file at path. When we
+// can't or shouldn't read the attributes from disk, the attributes from the
+// current index entry are kept so that they survive a round trip through
+// devices without DOS attributes.
+func (w *Walker) attributeFlags(path string, cf protocol.FileInfo) uint32 {
+	if cf.IsDeleted() {
+		cf.Flags = 0
+	}
+	if w.IgnoreAttrs || !osutil.AttributesSupported {
+		return cf.Flags & db.AttributeMask
+	}
+
+	attrs, err := osutil.Attributes(path)
+	if err != nil {
+		if debug.Enabled() {
+			l.Debugln("attributes error:", path, err)
+		}
+		return cf.Flags & db.AttributeMask
+	}
+	return AttributesToFlags(attrs)
 }
 
 func checkDir(dir string) error {
@@ -369,7 +598,7 @@ func checkDir(dir string) error {
 		return err
 	} else if !info.IsDir() {
 		return errors.New(dir + ": not a directory")
-	} else if debug {
+	} else if debug.Enabled() {
 		l.Debugln("checkDir", dir, info)
 	}
 	return nil
@@ -401,3 +630,67 @@ func SymlinkTypeEqual(disk, index uint32) bool {
 	}
 	return disk&protocol.SymlinkTypeMask == index&protocol.SymlinkTypeMask
 }
+
+// AttributesToFlags converts DOS file attributes, as returned by
+// osutil.Attributes, to the corresponding protocol flags.
+func AttributesToFlags(attrs uint32) uint32 {
+	var flags uint32
+	if attrs&osutil.AttributeHidden != 0 {
+		flags |= db.FlagHidden
+	}
+	if attrs&osutil.AttributeSystem != 0 {
+		flags |= db.FlagSystem
+	}
+	if attrs&osutil.AttributeReadOnly != 0 {
+		flags |= db.FlagReadOnly
+	}
+	return flags
+}
+
+// FlagsToAttributes is the inverse of AttributesToFlags.
+func FlagsToAttributes(flags uint32) uint32 {
+	var attrs uint32
+	if flags&db.FlagHidden != 0 {
+		attrs |= osutil.AttributeHidden
+	}
+	if flags&db.FlagSystem != 0 {
+		attrs |= osutil.AttributeSystem
+	}
+	if flags&db.FlagReadOnly != 0 {
+		attrs |= osutil.AttributeReadOnly
+	}
+	return attrs
+}
+
+// The protocol limits block hashes to this many bytes.
+const hardLinkChunkSize = 64
+
+// HardLinkBlocks returns the block list for a hard link to target, the first
+// file of the link group in the folder. The target name is carried verbatim
+// in the hashes of the blocks, in chunks of at most hardLinkChunkSize bytes.
+func HardLinkBlocks(target string) []protocol.BlockInfo {
+	name := []byte(osutil.NormalizedFilename(target))
+	var blocks []protocol.BlockInfo
+	for offset := 0; offset < len(name); offset += hardLinkChunkSize {
+		end := offset + hardLinkChunkSize
+		if end > len(name) {
+			end = len(name)
+		}
+		blocks = append(blocks, protocol.BlockInfo{
+			Offset: int64(offset),
+			Size:   int32(end - offset),
+			Hash:   name[offset:end],
+		})
+	}
+	return blocks
+}
+
+// HardLinkTarget returns the name of the target of a hard link, given its
+// block list.
+func HardLinkTarget(blocks []protocol.BlockInfo) string {
+	var name []byte
+	for _, block := range blocks {
+		name = append(name, block.Hash...)
+	}
+	return osutil.NativeFilename(string(name))
+}
@@ -9,17 +9,21 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	rdebug "runtime/debug"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/symlinks"
 	"golang.org/x/text/unicode/norm"
 )
 
@@ -279,6 +283,169 @@ func TestIssue1507(t *testing.T) {
 	fn("", nil, protocol.ErrClosed)
 }
 
+func TestAttributeFlags(t *testing.T) {
+	for _, attrs := range []uint32{0, osutil.AttributeHidden, osutil.AttributeSystem | osutil.AttributeReadOnly, osutil.AttributeMask} {
+		flags := AttributesToFlags(attrs)
+		if flags&^db.AttributeMask != 0 {
+			t.Errorf("Attributes %x gave non attribute flags %x", attrs, flags)
+		}
+		if res := FlagsToAttributes(flags); res != attrs {
+			t.Errorf("Attributes %x did not survive round trip, got %x", attrs, res)
+		}
+	}
+
+	// Attributes are kept from the index when not read from disk, but not
+	// for deleted files.
+
+	w := Walker{IgnoreAttrs: true}
+	cf := protocol.FileInfo{Flags: db.FlagHidden | 0644}
+	if flags := w.attributeFlags("testdata/afile", cf); flags != db.FlagHidden {
+		t.Errorf("Incorrect attribute flags %x != %x", flags, db.FlagHidden)
+	}
+	cf.Flags |= protocol.FlagDeleted
+	if flags := w.attributeFlags("testdata/afile", cf); flags != 0 {
+		t.Errorf("Incorrect attribute flags %x != 0", flags)
+	}
+}
+
+func TestWalkHardLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not detected on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "walkhardlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+
+	w := Walker{
+		Dir:             dir,
+		BlockSize:       128 * 1024,
+		Hashers:         2,
+		DetectHardLinks: true,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+	sort.Sort(fileList(files))
+
+	if len(files) != 2 {
+		t.Fatalf("Incorrect number of files %d != 2", len(files))
+	}
+	if db.IsHardLink(files[0]) || files[0].Size() != 5 {
+		t.Errorf("First file should be a regular file: %v", files[0])
+	}
+	if !db.IsHardLink(files[1]) || !BlocksEqual(files[1].Blocks, HardLinkBlocks("a")) {
+		t.Errorf("Second file should be a hard link to the first: %v", files[1])
+	}
+}
+
+func TestWalkMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkmarker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"marker", "file"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Hashers:   2,
+		Marker:    "marker",
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for f := range fchan {
+		names = append(names, f.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"file"}) {
+		t.Errorf("Walked %v, expected only the file and not the marker", names)
+	}
+}
+
+func TestFollowReparsePoint(t *testing.T) {
+	if !symlinks.Supported {
+		t.Skip("symlinks not supported")
+	}
+
+	// Symlinks stand in for junctions here; the following is the same.
+
+	dir, err := ioutil.TempDir("", "reparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	root := filepath.Join(dir, "folder")
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(dir, "x"), 0755)
+	os.MkdirAll(filepath.Join(dir, "y"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "x", "file"), []byte("data"), 0644)
+
+	links := map[string]string{
+		filepath.Join(root, "a", "b", "up"): root,                    // to an ancestor
+		filepath.Join(root, "outside"):      filepath.Join(dir, "x"), // out of the folder
+		filepath.Join(dir, "x", "toy"):      filepath.Join(dir, "y"), // x -> y -> x
+		filepath.Join(dir, "y", "tox"):      filepath.Join(dir, "x"),
+		filepath.Join(dir, "y", "home"):     root, // back into the folder
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := Walker{Dir: root}
+	followed := map[string]bool{root: true}
+	var seen []string
+	var fn filepath.WalkFunc
+	fn = func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rn, _ := filepath.Rel(root, p)
+		if info.Mode()&os.ModeSymlink != 0 {
+			return w.followReparsePoint(p, rn, followed, fn)
+		}
+		seen = append(seen, filepath.ToSlash(rn))
+		return nil
+	}
+	if err := filepath.Walk(root, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(seen)
+	expected := []string{".", "a", "a/b", "outside", "outside/file", "outside/toy"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Incorrect walk through reparse points\n%v !=\n%v", seen, expected)
+	}
+}
+
 func walkDir(dir string) ([]protocol.FileInfo, error) {
 	w := Walker{
 		Dir:           dir,
@@ -338,3 +505,22 @@ func (l testfileList) String() string {
 	b.WriteString("}")
 	return b.String()
 }
+
+func TestHardLinkBlocks(t *testing.T) {
+	names := []string{
+		"a",
+		filepath.Join("dir", "file"),
+		strings.Repeat("long name ", 20),
+	}
+	for _, name := range names {
+		blocks := HardLinkBlocks(name)
+		for _, block := range blocks {
+			if len(block.Hash) > 64 {
+				t.Errorf("Block hash too long (%d bytes) for %q", len(block.Hash), name)
+			}
+		}
+		if target := HardLinkTarget(blocks); target != name {
+			t.Errorf("Incorrect target %q != %q", target, name)
+		}
+	}
+}
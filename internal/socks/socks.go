@@ -0,0 +1,231 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package socks implements a SOCKS5 client (RFC 1928), with optional
+// username and password authentication (RFC 1929).
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	version5 = 5
+
+	authNone     = 0
+	authPassword = 2
+	authNoAccept = 0xff
+
+	cmdConnect = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+var replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// A Proxy is a SOCKS5 proxy server.
+type Proxy struct {
+	Addr     string
+	User     string
+	Password string
+	Timeout  time.Duration // For connecting to the proxy and the handshake; zero means no timeout.
+}
+
+// Parse returns the proxy given as an URL on the form
+// socks5://[user:password@]host:port.
+func Parse(s string) (*Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{Addr: u.Host}
+	if u.User != nil {
+		p.User = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// Dial connects to the address through the proxy. Host names are resolved
+// by the proxy.
+func (p *Proxy) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks: unsupported network %q", network)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.Addr, p.timeout())
+	if err != nil {
+		return nil, err
+	}
+	if p.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.Timeout))
+	}
+
+	if err := p.handshake(conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *Proxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	// net.DialTimeout wants something
+	return 365 * 24 * time.Hour
+}
+
+func (p *Proxy) handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("socks: invalid port %q", portStr)
+	}
+
+	// Offer the authentication methods we can handle.
+
+	methods := []byte{authNone}
+	if p.User != "" {
+		methods = append(methods, authPassword)
+	}
+	msg := append([]byte{version5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != version5 {
+		return fmt.Errorf("socks: unexpected version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case authNone:
+	case authPassword:
+		if p.User == "" {
+			return errors.New("socks: proxy requires authentication")
+		}
+		if err := p.authenticate(conn); err != nil {
+			return err
+		}
+	case authNoAccept:
+		return errors.New("socks: no acceptable authentication method")
+	default:
+		return fmt.Errorf("socks: unsupported authentication method %d", resp[1])
+	}
+
+	// Ask the proxy to connect.
+
+	msg = []byte{version5, cmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks: host name too long")
+		}
+		msg = append(msg, atypDomain, byte(len(host)))
+		msg = append(msg, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, atypIPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, atypIPv6)
+		msg = append(msg, ip.To16()...)
+	}
+	msg = append(msg, byte(port>>8), byte(port))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != version5 {
+		return fmt.Errorf("socks: unexpected version %d", hdr[0])
+	}
+	if hdr[1] != 0 {
+		if reason, ok := replies[hdr[1]]; ok {
+			return fmt.Errorf("socks: connect to %s: %s", addr, reason)
+		}
+		return fmt.Errorf("socks: connect to %s: error %d", addr, hdr[1])
+	}
+
+	// Skip the bound address in the reply; we don't need it.
+
+	var skip int
+	switch hdr[3] {
+	case atypIPv4:
+		skip = net.IPv4len
+	case atypIPv6:
+		skip = net.IPv6len
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("socks: unexpected address type %d", hdr[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (p *Proxy) authenticate(conn net.Conn) error {
+	if len(p.User) > 255 || len(p.Password) > 255 {
+		return errors.New("socks: user name or password too long")
+	}
+
+	msg := []byte{1, byte(len(p.User))}
+	msg = append(msg, p.User...)
+	msg = append(msg, byte(len(p.Password)))
+	msg = append(msg, p.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("socks: authentication failed")
+	}
+	return nil
+}
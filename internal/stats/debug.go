@@ -7,13 +7,11 @@
 package stats
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "stats") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("stats")
 	l     = logger.DefaultLogger
 )
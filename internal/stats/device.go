@@ -15,19 +15,24 @@ import (
 )
 
 type DeviceStatistics struct {
-	LastSeen time.Time `json:"lastSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastAddress string    `json:"lastAddress"`
+	Traffic     Traffic   `json:"traffic"`
 }
 
 type DeviceStatisticsReference struct {
-	ns     *db.NamespacedKV
-	device protocol.DeviceID
+	ns      *db.NamespacedKV
+	device  protocol.DeviceID
+	traffic *trafficCounter
 }
 
 func NewDeviceStatisticsReference(ldb *leveldb.DB, device protocol.DeviceID) *DeviceStatisticsReference {
 	prefix := string(db.KeyTypeDeviceStatistic) + device.String()
+	ns := db.NewNamespacedKV(ldb, prefix)
 	return &DeviceStatisticsReference{
-		ns:     db.NewNamespacedKV(ldb, prefix),
-		device: device,
+		ns:      ns,
+		device:  device,
+		traffic: newTrafficCounter(ns),
 	}
 }
 
@@ -38,21 +43,47 @@ func (s *DeviceStatisticsReference) GetLastSeen() time.Time {
 		// time.Time{} from s.ns
 		return time.Unix(0, 0)
 	}
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("stats.DeviceStatisticsReference.GetLastSeen:", s.device, t)
 	}
 	return t
 }
 
 func (s *DeviceStatisticsReference) WasSeen() {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("stats.DeviceStatisticsReference.WasSeen:", s.device)
 	}
 	s.ns.PutTime("lastSeen", time.Now())
 }
 
+// GetLastAddress returns the address we last connected to the device on,
+// or the empty string.
+func (s *DeviceStatisticsReference) GetLastAddress() string {
+	addr, _ := s.ns.String("lastAddress")
+	return addr
+}
+
+func (s *DeviceStatisticsReference) SetLastAddress(addr string) {
+	if debug.Enabled() {
+		l.Debugln("stats.DeviceStatisticsReference.SetLastAddress:", s.device, addr)
+	}
+	s.ns.PutString("lastAddress", addr)
+}
+
+// Transferred adds to the traffic with the device.
+func (s *DeviceStatisticsReference) Transferred(in, out int64) {
+	s.traffic.add(in, out)
+}
+
+// SaveTraffic saves the traffic counted since it was last saved.
+func (s *DeviceStatisticsReference) SaveTraffic() {
+	s.traffic.save()
+}
+
 func (s *DeviceStatisticsReference) GetStatistics() DeviceStatistics {
 	return DeviceStatistics{
-		LastSeen: s.GetLastSeen(),
+		LastSeen:    s.GetLastSeen(),
+		LastAddress: s.GetLastAddress(),
+		Traffic:     s.traffic.get(),
 	}
 }
@@ -15,11 +15,13 @@ import (
 
 type FolderStatistics struct {
 	LastFile LastFile `json:"lastFile"`
+	Traffic  Traffic  `json:"traffic"`
 }
 
 type FolderStatisticsReference struct {
-	ns     *db.NamespacedKV
-	folder string
+	ns      *db.NamespacedKV
+	folder  string
+	traffic *trafficCounter
 }
 
 type LastFile struct {
@@ -29,9 +31,11 @@ type LastFile struct {
 
 func NewFolderStatisticsReference(ldb *leveldb.DB, folder string) *FolderStatisticsReference {
 	prefix := string(db.KeyTypeFolderStatistic) + folder
+	ns := db.NewNamespacedKV(ldb, prefix)
 	return &FolderStatisticsReference{
-		ns:     db.NewNamespacedKV(ldb, prefix),
-		folder: folder,
+		ns:      ns,
+		folder:  folder,
+		traffic: newTrafficCounter(ns),
 	}
 }
 
@@ -51,15 +55,26 @@ func (s *FolderStatisticsReference) GetLastFile() LastFile {
 }
 
 func (s *FolderStatisticsReference) ReceivedFile(filename string) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("stats.FolderStatisticsReference.ReceivedFile:", s.folder, filename)
 	}
 	s.ns.PutTime("lastFileAt", time.Now())
 	s.ns.PutString("lastFileName", filename)
 }
 
+// Transferred adds to the traffic of the folder.
+func (s *FolderStatisticsReference) Transferred(in, out int64) {
+	s.traffic.add(in, out)
+}
+
+// SaveTraffic saves the traffic counted since it was last saved.
+func (s *FolderStatisticsReference) SaveTraffic() {
+	s.traffic.save()
+}
+
 func (s *FolderStatisticsReference) GetStatistics() FolderStatistics {
 	return FolderStatistics{
 		LastFile: s.GetLastFile(),
+		Traffic:  s.traffic.get(),
 	}
 }
@@ -0,0 +1,82 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"time"
+
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// Traffic is the amount of file data transferred, in bytes. Index exchange
+// and protocol overhead aren't included.
+type Traffic struct {
+	InBytes  int64 `json:"inBytes"`
+	OutBytes int64 `json:"outBytes"`
+}
+
+// Traffic is counted in memory and saved this long after it started
+// changing, as it changes with every block transferred.
+var trafficSaveDelay = time.Minute
+
+// A trafficCounter keeps the cumulative traffic in the database.
+type trafficCounter struct {
+	ns      *db.NamespacedKV
+	mut     sync.Mutex
+	unsaved Traffic
+}
+
+func newTrafficCounter(ns *db.NamespacedKV) *trafficCounter {
+	return &trafficCounter{
+		ns:  ns,
+		mut: sync.NewMutex(),
+	}
+}
+
+func (c *trafficCounter) add(in, out int64) {
+	if in == 0 && out == 0 {
+		return
+	}
+	c.mut.Lock()
+	if c.unsaved == (Traffic{}) {
+		time.AfterFunc(trafficSaveDelay, c.save)
+	}
+	c.unsaved.InBytes += in
+	c.unsaved.OutBytes += out
+	c.mut.Unlock()
+}
+
+func (c *trafficCounter) get() Traffic {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	t := c.storedLocked()
+	t.InBytes += c.unsaved.InBytes
+	t.OutBytes += c.unsaved.OutBytes
+	return t
+}
+
+func (c *trafficCounter) save() {
+	c.mut.Lock()
+	c.saveLocked()
+	c.mut.Unlock()
+}
+
+func (c *trafficCounter) saveLocked() {
+	if c.unsaved != (Traffic{}) {
+		t := c.storedLocked()
+		c.ns.PutInt64("inBytes", t.InBytes+c.unsaved.InBytes)
+		c.ns.PutInt64("outBytes", t.OutBytes+c.unsaved.OutBytes)
+		c.unsaved = Traffic{}
+	}
+}
+
+func (c *trafficCounter) storedLocked() Traffic {
+	in, _ := c.ns.Int64("inBytes")
+	out, _ := c.ns.Int64("outBytes")
+	return Traffic{InBytes: in, OutBytes: out}
+}
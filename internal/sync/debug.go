@@ -9,23 +9,23 @@ package sync
 import (
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug     = strings.Contains(os.Getenv("STTRACE"), "locks") || os.Getenv("STTRACE") == "all"
+	debug     = trace.Register("locks")
 	threshold = time.Duration(100 * time.Millisecond)
 	l         = logger.DefaultLogger
 )
 
 func init() {
-	if n, err := strconv.Atoi(os.Getenv("STLOCKTHRESHOLD")); debug && err == nil {
+	if n, err := strconv.Atoi(os.Getenv("STLOCKTHRESHOLD")); debug.Enabled() && err == nil {
 		threshold = time.Duration(n) * time.Millisecond
 	}
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("Enabling lock logging at %v threshold", threshold)
 	}
 }
@@ -34,14 +34,14 @@ type WaitGroup interface {
 }
 
 func NewMutex() Mutex {
-	if debug {
+	if debug.Enabled() {
 		return &loggedMutex{}
 	}
 	return &sync.Mutex{}
 }
 
 func NewRWMutex() RWMutex {
-	if debug {
+	if debug.Enabled() {
 		return &loggedRWMutex{
 			unlockers: make([]string, 0),
 		}
@@ -50,7 +50,7 @@ func NewRWMutex() RWMutex {
 }
 
 func NewWaitGroup() WaitGroup {
-	if debug {
+	if debug.Enabled() {
 		return &loggedWaitGroup{}
 	}
 	return &sync.WaitGroup{}
@@ -22,7 +22,7 @@ const (
 )
 
 func TestTypes(t *testing.T) {
-	debug = false
+	debug.Set(false)
 
 	if _, ok := NewMutex().(*sync.Mutex); !ok {
 		t.Error("Wrong type")
@@ -36,7 +36,7 @@ func TestTypes(t *testing.T) {
 		t.Error("Wrong type")
 	}
 
-	debug = true
+	debug.Set(true)
 
 	if _, ok := NewMutex().(*loggedMutex); !ok {
 		t.Error("Wrong type")
@@ -50,11 +50,11 @@ func TestTypes(t *testing.T) {
 		t.Error("Wrong type")
 	}
 
-	debug = false
+	debug.Set(false)
 }
 
 func TestMutex(t *testing.T) {
-	debug = true
+	debug.Set(true)
 	threshold = logThreshold
 
 	msgmut := sync.Mutex{}
@@ -83,11 +83,11 @@ func TestMutex(t *testing.T) {
 		t.Errorf("Unexpected message count")
 	}
 
-	debug = false
+	debug.Set(false)
 }
 
 func TestRWMutex(t *testing.T) {
-	debug = true
+	debug.Set(true)
 	threshold = logThreshold
 
 	msgmut := sync.Mutex{}
@@ -141,11 +141,11 @@ func TestRWMutex(t *testing.T) {
 	mut.RUnlock()
 	mut.RUnlock()
 
-	debug = false
+	debug.Set(false)
 }
 
 func TestWaitGroup(t *testing.T) {
-	debug = true
+	debug.Set(true)
 	threshold = logThreshold
 
 	msgmut := sync.Mutex{}
@@ -181,5 +181,5 @@ func TestWaitGroup(t *testing.T) {
 		t.Errorf("Unexpected message count")
 	}
 
-	debug = false
+	debug.Set(false)
 }
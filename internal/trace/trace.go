@@ -0,0 +1,79 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package trace keeps track of the debug flags of the packages, the
+// facilities named in STTRACE, so that they can be listed and changed while
+// running.
+package trace
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	flags = make(map[string]*Flag)
+	mut   sync.Mutex
+)
+
+// A Flag is the debug flag of a facility. It can be checked while it's being
+// changed.
+type Flag struct {
+	enabled int32 // accessed atomically
+}
+
+// Enabled returns whether debugging is enabled for the facility.
+func (f *Flag) Enabled() bool {
+	return atomic.LoadInt32(&f.enabled) != 0
+}
+
+// Set enables or disables debugging for the facility.
+func (f *Flag) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&f.enabled, v)
+}
+
+// Register returns the debug flag of a package under the facility name,
+// enabled if STTRACE names the facility or is "all".
+func Register(facility string) *Flag {
+	env := os.Getenv("STTRACE")
+	f := new(Flag)
+	f.Set(strings.Contains(env, facility) || env == "all")
+
+	mut.Lock()
+	flags[facility] = f
+	mut.Unlock()
+	return f
+}
+
+// Facilities returns the registered facilities and whether they are enabled.
+func Facilities() map[string]bool {
+	mut.Lock()
+	defer mut.Unlock()
+	res := make(map[string]bool, len(flags))
+	for name, flag := range flags {
+		res[name] = flag.Enabled()
+	}
+	return res
+}
+
+// Set enables or disables the facility.
+func Set(facility string, enabled bool) error {
+	mut.Lock()
+	defer mut.Unlock()
+	flag, ok := flags[facility]
+	if !ok {
+		return fmt.Errorf("unknown facility %q", facility)
+	}
+	flag.Set(enabled)
+	return nil
+}
@@ -0,0 +1,26 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package trace
+
+import "testing"
+
+func TestSet(t *testing.T) {
+	flag := Register("test")
+
+	if err := Set("test", true); err != nil || !flag.Enabled() {
+		t.Errorf("Flag %v, %v after enabling", flag.Enabled(), err)
+	}
+	if enabled, ok := Facilities()["test"]; !ok || !enabled {
+		t.Error("Facility not listed as enabled")
+	}
+	if err := Set("test", false); err != nil || flag.Enabled() {
+		t.Errorf("Flag %v, %v after disabling", flag.Enabled(), err)
+	}
+	if err := Set("nonexistent", true); err == nil {
+		t.Error("No error for an unknown facility")
+	}
+}
@@ -7,13 +7,11 @@
 package upgrade
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "upgrade") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("upgrade")
 	l     = logger.DefaultLogger
 )
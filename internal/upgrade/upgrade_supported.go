@@ -79,10 +79,10 @@ func SelectLatestRelease(version string, rels []Release) (Release, error) {
 			assetName := path.Base(asset.Name)
 			// Check for the architecture
 			expectedRelease := releaseName(rel.Tag)
-			if debug {
+			if debug.Enabled() {
 				l.Debugf("expected release asset %q", expectedRelease)
 			}
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("considering release", assetName)
 			}
 			if strings.HasPrefix(assetName, expectedRelease) {
@@ -96,12 +96,12 @@ func SelectLatestRelease(version string, rels []Release) (Release, error) {
 // Upgrade to the given release, saving the previous binary with a ".old" extension.
 func upgradeTo(binary string, rel Release) error {
 	expectedRelease := releaseName(rel.Tag)
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("expected release asset %q", expectedRelease)
 	}
 	for _, asset := range rel.Assets {
 		assetName := path.Base(asset.Name)
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("considering release", assetName)
 		}
 
@@ -134,7 +134,7 @@ func upgradeToURL(binary string, url string) error {
 }
 
 func readRelease(dir, url string) (string, error) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("loading %q", url)
 	}
 
@@ -182,13 +182,13 @@ fileLoop:
 
 		shortName := path.Base(hdr.Name)
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("considering file %q", shortName)
 		}
 
 		switch shortName {
 		case "syncthing":
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("writing and hashing binary")
 			}
 			tempName, actualMD5, err = writeBinary(dir, tr)
@@ -208,7 +208,7 @@ fileLoop:
 			}
 
 			expectedMD5 = strings.TrimSpace(string(bs))
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("expected md5 is", actualMD5)
 			}
 
@@ -250,13 +250,13 @@ fileLoop:
 	for _, file := range archive.File {
 		shortName := path.Base(file.Name)
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("considering file %q", shortName)
 		}
 
 		switch shortName {
 		case "syncthing.exe":
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("writing and hashing binary")
 			}
 
@@ -285,7 +285,7 @@ fileLoop:
 			}
 
 			expectedMD5 = strings.TrimSpace(string(bs))
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("expected md5 is", actualMD5)
 			}
 
@@ -339,7 +339,7 @@ func writeBinary(dir string, inFile io.Reader) (filename, md5sum string, err err
 	}
 
 	actualMD5 := fmt.Sprintf("%x", h.Sum(nil))
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("actual md5 is", actualMD5)
 	}
 
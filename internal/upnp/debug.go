@@ -7,13 +7,11 @@
 package upnp
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "upnp") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("upnp")
 	l     = logger.DefaultLogger
 )
@@ -129,7 +129,7 @@ nextResult:
 	for result := range resultChan {
 		for _, existingResult := range results {
 			if existingResult.uuid == result.uuid {
-				if debug {
+				if debug.Enabled() {
 					l.Debugf("Skipping duplicate result %s with services:", result.uuid)
 					for _, svc := range result.services {
 						l.Debugf("* [%s] %s", svc.serviceID, svc.serviceURL)
@@ -140,7 +140,7 @@ nextResult:
 		}
 
 		results = append(results, result)
-		if debug {
+		if debug.Enabled() {
 			l.Debugf("UPnP discovery result %s with services:", result.uuid)
 			for _, svc := range result.services {
 				l.Debugf("* [%s] %s", svc.serviceID, svc.serviceURL)
@@ -167,13 +167,13 @@ Mx: %d
 
 	search := []byte(strings.Replace(searchStr, "\n", "\r\n", -1))
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("Starting discovery of device type " + deviceType + " on " + intf.Name)
 	}
 
 	socket, err := net.ListenMulticastUDP("udp4", intf, &net.UDPAddr{IP: ssdp.IP})
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln(err)
 		}
 		return
@@ -186,7 +186,7 @@ Mx: %d
 		return
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("Sending search request for device type " + deviceType + " on " + intf.Name)
 	}
 
@@ -196,7 +196,7 @@ Mx: %d
 		return
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("Listening for UPnP response for device type " + deviceType + " on " + intf.Name)
 	}
 
@@ -217,13 +217,13 @@ Mx: %d
 		}
 		results <- igd
 	}
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("Discovery for device type " + deviceType + " on " + intf.Name + " finished.")
 	}
 }
 
 func parseResponse(deviceType string, resp []byte) (IGD, error) {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("Handling UPnP response:\n\n" + string(resp))
 	}
 
@@ -383,7 +383,7 @@ func getIGDServices(rootURL string, device upnpDevice, wanDeviceURN string, wanC
 			for _, serviceURN := range serviceURNs {
 				services := getChildServices(connection, serviceURN)
 
-				if len(services) < 1 && debug {
+				if len(services) < 1 && debug.Enabled() {
 					l.Debugln("[" + rootURL + "] No services of type " + serviceURN + " found on connection.")
 				}
 
@@ -394,7 +394,7 @@ func getIGDServices(rootURL string, device upnpDevice, wanDeviceURN string, wanC
 						u, _ := url.Parse(rootURL)
 						replaceRawPath(u, service.ControlURL)
 
-						if debug {
+						if debug.Enabled() {
 							l.Debugln("[" + rootURL + "] Found " + service.ServiceType + " with URL " + u.String())
 						}
 
@@ -456,7 +456,7 @@ func soapRequest(url, service, function, message string) ([]byte, error) {
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Pragma", "no-cache")
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("SOAP Request URL: " + url)
 		l.Debugln("SOAP Action: " + req.Header.Get("SOAPAction"))
 		l.Debugln("SOAP Request:\n\n" + body)
@@ -464,14 +464,14 @@ func soapRequest(url, service, function, message string) ([]byte, error) {
 
 	r, err := http.DefaultClient.Do(req)
 	if err != nil {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln(err)
 		}
 		return resp, err
 	}
 
 	resp, _ = ioutil.ReadAll(r.Body)
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("SOAP Response: %v\n\n%v\n\n", r.StatusCode, string(resp))
 	}
 
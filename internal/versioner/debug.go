@@ -7,13 +7,11 @@
 package versioner
 
 import (
-	"os"
-	"strings"
-
 	"github.com/calmh/logger"
+	"github.com/syncthing/syncthing/internal/trace"
 )
 
 var (
-	debug = strings.Contains(os.Getenv("STTRACE"), "versioner") || os.Getenv("STTRACE") == "all"
+	debug = trace.Register("versioner")
 	l     = logger.DefaultLogger
 )
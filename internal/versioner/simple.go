@@ -35,18 +35,23 @@ func NewSimple(folderID, folderPath string, params map[string]string) Versioner
 		folderPath: folderPath,
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("instantiated %#v", s)
 	}
 	return s
 }
 
+// Versions returns the archived versions of the file, oldest first.
+func (v Simple) Versions(filePath string) ([]string, error) {
+	return archivedVersions(filepath.Join(v.folderPath, ".stversions"), v.folderPath, filePath)
+}
+
 // Archive moves the named file away to a version archive. If this function
 // returns nil, the named file does not exist any more (has been archived).
 func (v Simple) Archive(filePath string) error {
 	fileInfo, err := osutil.Lstat(filePath)
 	if os.IsNotExist(err) {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("not archiving nonexistent file", filePath)
 		}
 		return nil
@@ -58,7 +63,7 @@ func (v Simple) Archive(filePath string) error {
 	_, err = os.Stat(versionsDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("creating versions dir", versionsDir)
 			}
 			osutil.MkdirAll(versionsDir, 0755)
@@ -68,7 +73,7 @@ func (v Simple) Archive(filePath string) error {
 		}
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("archiving", filePath)
 	}
 
@@ -86,7 +91,7 @@ func (v Simple) Archive(filePath string) error {
 
 	ver := taggedFilename(file, fileInfo.ModTime().Format(TimeFormat))
 	dst := filepath.Join(dir, ver)
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("moving to", dst)
 	}
 	err = osutil.Rename(filePath, dst)
@@ -114,7 +119,7 @@ func (v Simple) Archive(filePath string) error {
 
 	if len(versions) > v.keep {
 		for _, toRemove := range versions[:len(versions)-v.keep] {
-			if debug {
+			if debug.Enabled() {
 				l.Debugln("cleaning out", toRemove)
 			}
 			err = os.Remove(toRemove)
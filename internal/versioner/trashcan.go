@@ -37,18 +37,35 @@ func NewTrashcan(folderID, folderPath string, params map[string]string) Versione
 		stop:         make(chan struct{}),
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugf("instantiated %#v", s)
 	}
 	return s
 }
 
+// Versions returns the archived version of the file, if there is one. The
+// trash can keeps only the last one.
+func (t *Trashcan) Versions(filePath string) ([]string, error) {
+	relativePath, err := filepath.Rel(t.folderPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	archivedPath := filepath.Join(t.folderPath, ".stversions", relativePath)
+	if _, err := osutil.Lstat(archivedPath); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []string{archivedPath}, nil
+}
+
 // Archive moves the named file away to a version archive. If this function
 // returns nil, the named file does not exist any more (has been archived).
 func (t *Trashcan) Archive(filePath string) error {
 	_, err := osutil.Lstat(filePath)
 	if os.IsNotExist(err) {
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("not archiving nonexistent file", filePath)
 		}
 		return nil
@@ -62,7 +79,7 @@ func (t *Trashcan) Archive(filePath string) error {
 			return err
 		}
 
-		if debug {
+		if debug.Enabled() {
 			l.Debugln("creating versions dir", versionsDir)
 		}
 		if err := osutil.MkdirAll(versionsDir, 0777); err != nil {
@@ -71,7 +88,7 @@ func (t *Trashcan) Archive(filePath string) error {
 		osutil.HideFile(versionsDir)
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("archiving", filePath)
 	}
 
@@ -85,7 +102,7 @@ func (t *Trashcan) Archive(filePath string) error {
 		return err
 	}
 
-	if debug {
+	if debug.Enabled() {
 		l.Debugln("moving to", archivedPath)
 	}
 
@@ -102,7 +119,7 @@ func (t *Trashcan) Archive(filePath string) error {
 }
 
 func (t *Trashcan) Serve() {
-	if debug {
+	if debug.Enabled() {
 		l.Debugln(t, "starting")
 		defer l.Debugln(t, "stopping")
 	}
@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+
+	"github.com/syncthing/syncthing/internal/osutil"
 )
 
 // Inserts ~tag just before the extension of the filename.
@@ -46,3 +48,36 @@ func uniqueSortedStrings(strings []string) []string {
 	sort.Strings(unique)
 	return unique
 }
+
+// archivedVersions returns the versions of the file archived with a time tag
+// in versionsDir, oldest first.
+func archivedVersions(versionsDir, folderPath, filePath string) ([]string, error) {
+	file := filepath.Base(filePath)
+	inFolderPath, err := filepath.Rel(folderPath, filepath.Dir(filePath))
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(versionsDir, inFolderPath)
+
+	// Glob according to the new file~timestamp.ext pattern.
+	newVersions, err := osutil.Glob(filepath.Join(dir, taggedFilename(file, TimeGlob)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Also according to the old file.ext~timestamp pattern.
+	oldVersions, err := osutil.Glob(filepath.Join(dir, file+"~"+TimeGlob))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := uniqueSortedStrings(append(oldVersions, newVersions...))
+	sort.Stable(byTag(versions))
+	return versions, nil
+}
+
+type byTag []string
+
+func (l byTag) Len() int           { return len(l) }
+func (l byTag) Less(a, b int) bool { return filenameTag(l[a]) < filenameTag(l[b]) }
+func (l byTag) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
@@ -12,6 +12,13 @@ type Versioner interface {
 	Archive(filePath string) error
 }
 
+// A Lister is a Versioner that can find the archived versions of a file.
+type Lister interface {
+	// Versions returns the paths of the archived versions of the file,
+	// oldest first.
+	Versions(filePath string) ([]string, error)
+}
+
 var Factories = map[string]func(folderID string, folderDir string, params map[string]string) Versioner{}
 
 const (
@@ -88,3 +88,37 @@ func TestSimpleVersioningVersionCount(t *testing.T) {
 		time.Sleep(time.Second)
 	}
 }
+
+func TestSimpleVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versionsDir := filepath.Join(dir, ".stversions", "sub")
+	if err := os.MkdirAll(versionsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a~20150102-030405.txt", "a.txt~20140102-030405", "a~20150101-030405.txt", "b~20150101-030405.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(versionsDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := NewSimple("", dir, nil).(Lister)
+	versions, err := v.Versions(filepath.Join(dir, "sub", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a.txt~20140102-030405", "a~20150101-030405.txt", "a~20150102-030405.txt"}
+	if len(versions) != len(expected) {
+		t.Fatalf("Incorrect versions %v", versions)
+	}
+	for i := range expected {
+		if versions[i] != filepath.Join(versionsDir, expected[i]) {
+			t.Errorf("Incorrect version %d %q != %q", i, versions[i], expected[i])
+		}
+	}
+}
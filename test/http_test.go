@@ -23,6 +23,7 @@ import (
 
 var jsonEndpoints = []string{
 	"/rest/db/completion?device=I6KAH76-66SLLLB-5PFXSOA-UFJCDZC-YAOMLEK-CP2GB32-BV5RQST-3PSROAU&folder=default",
+	"/rest/db/failed?folder=default",
 	"/rest/db/ignores?folder=default",
 	"/rest/db/need?folder=default",
 	"/rest/db/status?folder=default",
@@ -40,6 +41,8 @@ var jsonEndpoints = []string{
 	"/rest/system/discovery",
 	"/rest/system/error",
 	"/rest/system/ping",
+	"/rest/system/power",
+	"/rest/system/relays",
 	"/rest/system/status",
 	"/rest/system/upgrade",
 	"/rest/system/version",